@@ -0,0 +1,188 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLog writes one line per completed request in the Apache common or
+// combined formats, or as JSON, to a file rotated once it grows past maxSize.
+// The jsonl format is the exchange whole, as marshaled for the sinks.
+type AccessLog struct {
+	mu         sync.Mutex
+	path       string
+	format     string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	al := &AccessLog{
+		path:       cfg.Path,
+		format:     cfg.Format,
+		maxSize:    cfg.MaxSize,
+		maxBackups: cfg.MaxBackups,
+	}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AccessLog) open() error {
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.file, al.size = f, fi.Size()
+	return nil
+}
+
+// Reopen reopens the file, for use after it was moved away by logrotate.
+func (al *AccessLog) Reopen() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.file.Close()
+	return al.open()
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and starts a new file.
+func (al *AccessLog) rotate() error {
+	al.file.Close()
+	for i := al.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%v.%d", al.path, i), fmt.Sprintf("%v.%d", al.path, i+1))
+	}
+	if al.maxBackups > 0 {
+		os.Rename(al.path, al.path+".1")
+	} else {
+		os.Remove(al.path)
+	}
+	return al.open()
+}
+
+func (al *AccessLog) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	return nil
+}
+
+func (al *AccessLog) LogExchange(ctx context.Context, ex *Exchange) error {
+	status := http.StatusInternalServerError
+	if ex.Response != nil {
+		status = ex.Response.StatusCode
+	}
+	var line string
+	if al.format == "jsonl" {
+		b, err := json.Marshal(ex)
+		if err != nil {
+			return err
+		}
+		line = string(b) + "\n"
+	} else {
+		line = al.formatLine(ex.Request, ex.ID, ex.Tags, ex.Start, status, ex.Size)
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if al.maxSize > 0 && al.size+int64(len(line)) > al.maxSize && al.size > 0 {
+		if err := al.rotate(); err != nil {
+			return fmt.Errorf("rotate %v: %w", al.path, err)
+		}
+	}
+	n, err := al.file.WriteString(line)
+	al.size += int64(n)
+	return err
+}
+
+func (al *AccessLog) formatLine(req *http.Request, id string, tags []string, start time.Time, status int, size int64) string {
+	client := clientIP(req.RemoteAddr)
+
+	if al.format == "json" {
+		b, _ := json.Marshal(struct {
+			ID        string   `json:"request_id"`
+			Client    string   `json:"client"`
+			Time      string   `json:"time"`
+			Method    string   `json:"method"`
+			URL       string   `json:"url"`
+			Proto     string   `json:"proto"`
+			Status    int      `json:"status"`
+			Bytes     int64    `json:"bytes"`
+			Referer   string   `json:"referer"`
+			UserAgent string   `json:"user_agent"`
+			Tags      []string `json:"tags,omitempty"`
+		}{id, client, start.Format(time.RFC3339), req.Method, req.URL.String(), req.Proto, status, size,
+			req.Referer(), req.UserAgent(), tags})
+		return string(b) + "\n"
+	}
+
+	bytes := "-"
+	if size > 0 {
+		bytes = strconv.FormatInt(size, 10)
+	}
+	line := fmt.Sprintf("%v - - [%v] \"%v\" %d %v", client, start.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeLogField(req.Method+" "+req.URL.String()+" "+req.Proto), status, bytes)
+	if al.format == "combined" {
+		line += fmt.Sprintf(" \"%v\" \"%v\"", orDash(escapeLogField(req.Referer())), orDash(escapeLogField(req.UserAgent())))
+	}
+	return line + "\n"
+}
+
+// escapeLogField escapes quotes, backslashes and non-printable bytes the way
+// Apache does, so that attacker controlled fields can't forge log lines.
+func escapeLogField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Check makes sure the access log file is still there to be written to.
+func (al *AccessLog) Check(ctx context.Context) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	_, err := al.file.Stat()
+	return err
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (al *AccessLog) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	return al.file.Close()
+}
@@ -0,0 +1,58 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONLAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+	al, err := NewAccessLog(AccessLogConfig{Path: path, Format: "jsonl", MaxSize: 1, MaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+	for _, id := range []string{"r0", "r1"} {
+		req := httptest.NewRequest("POST", "http://a.example/login", nil)
+		req.Header.Set("User-Agent", "curl/8.0")
+		resp := &http.Response{StatusCode: 401, Proto: "HTTP/1.1", Header: http.Header{"Www-Authenticate": {"Basic"}}}
+		if err := al.LogExchange(context.Background(), finishedExchange(req, id, resp, 12)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each line is an exchange whole, the file being rotated by its size.
+	for file, id := range map[string]string{path + ".1": "r0", path: "r1"} {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var lines []map[string]interface{}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var line map[string]interface{}
+			if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+				t.Fatalf("%v: %q: %v", file, sc.Text(), err)
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) != 1 {
+			t.Fatalf("%v: got %d lines, want 1", file, len(lines))
+		}
+		req, _ := lines[0]["request"].(map[string]interface{})
+		headers, _ := req["headers"].(map[string]interface{})
+		resp, _ := lines[0]["response"].(map[string]interface{})
+		if lines[0]["request_id"] != id || lines[0]["responded"] == nil ||
+			fmt.Sprint(headers["User-Agent"]) != "[curl/8.0]" || resp["status"] != 401.0 || resp["bytes"] != 12.0 {
+			t.Errorf("%v: got %v", file, lines[0])
+		}
+	}
+}
@@ -0,0 +1,652 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newAdminHandler serves the admin API. It must only ever be exposed on the
+// admin listener, never through the proxy.
+func newAdminHandler(s *Server) http.Handler {
+	health := s.health
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := health.alive(); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "panics": panics.Load(), "log_failures": logFailures.Load()})
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		results, ok := health.ready(r.Context())
+		checks := make(map[string]string, len(results))
+		for name, err := range results {
+			checks[name] = "ok"
+			if err != nil {
+				checks[name] = err.Error()
+			}
+		}
+		status, code := "ok", http.StatusOK
+		if !ok {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+	})
+
+	mux.HandleFunc("/ui/", serveDashboard)
+
+	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, getBuildInfo())
+	})
+
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"version": getBuildInfo(), "rules": s.rules.status(), "tor": s.tor.status(), "feeds": s.feeds.status()})
+	})
+
+	mux.HandleFunc("/api/clients", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("top"))
+		if err != nil || n <= 0 {
+			n = 50
+		}
+		writeJSON(w, http.StatusOK, s.scores.top(n))
+	})
+	mux.HandleFunc("/api/clients/", func(w http.ResponseWriter, r *http.Request) {
+		score, ok := s.scores.get(strings.TrimPrefix(r.URL.Path, "/api/clients/"))
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown client"})
+			return
+		}
+		writeJSON(w, http.StatusOK, score)
+	})
+
+	mux.HandleFunc("/api/fingerprints", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("top"))
+		if err != nil || n <= 0 {
+			n = 50
+		}
+		writeJSON(w, http.StatusOK, s.prints.top(n))
+	})
+	mux.HandleFunc("/api/fingerprints/", func(w http.ResponseWriter, r *http.Request) {
+		hash := strings.TrimPrefix(r.URL.Path, "/api/fingerprints/")
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			// The body is {"label": "name"}, an empty label removing it.
+			var body struct {
+				Label string `json:"label"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if !s.prints.label(hash, body.Label) {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown fingerprint"})
+				return
+			}
+			if db, ok := s.db.(interface {
+				labelFingerprint(hash, label string) error
+			}); ok {
+				err := s.logger.call(r.Context(), "fingerprint label", func(context.Context) error {
+					return db.labelFingerprint(hash, body.Label)
+				})
+				if err != nil {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+					return
+				}
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		f, ok := s.prints.get(hash)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown fingerprint"})
+			return
+		}
+		writeJSON(w, http.StatusOK, f)
+	})
+
+	mux.HandleFunc("/api/requests", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			listRequests(ctx context.Context, q *requestQuery) (*requestPage, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage can't list requests"})
+			return
+		}
+		q, err := parseRequestQuery(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		page, err := db.listRequests(r.Context(), q)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+	})
+
+	mux.HandleFunc("/api/requests/", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			getRequest(ctx context.Context, requestID string) (*requestDetail, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage can't list requests"})
+			return
+		}
+		d, err := db.getRequest(r.Context(), strings.TrimPrefix(r.URL.Path, "/api/requests/"))
+		switch {
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		case d == nil:
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown request"})
+		default:
+			writeJSON(w, http.StatusOK, d)
+		}
+	})
+
+	mux.HandleFunc("/api/export/har", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(requestReader)
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage can't list requests"})
+			return
+		}
+		ids, ok := exportedIDs(w, r, db)
+		if !ok {
+			return
+		}
+		f := newHARFile()
+		err := readRequests(r.Context(), db, ids, func(d *requestDetail) error {
+			f.Log.Entries = append(f.Log.Entries, harExportEntry(d))
+			return nil
+		})
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename=stuffpot.har")
+		writeJSON(w, http.StatusOK, f)
+	})
+
+	mux.HandleFunc("/api/export/burp", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(requestReader)
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage can't list requests"})
+			return
+		}
+		ids, ok := exportedIDs(w, r, db)
+		if !ok {
+			return
+		}
+		rawDir := ""
+		if s.raw != nil {
+			rawDir = s.raw.dir
+		}
+		var items []burpItem
+		err := readRequests(r.Context(), db, ids, func(d *requestDetail) error {
+			items = append(items, burpExportItem(d, rawDir))
+			return nil
+		})
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Content-Disposition", "attachment; filename=stuffpot.xml")
+		writeBurpItems(w, items)
+	})
+
+	mux.HandleFunc("/api/cookies", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			sharedCookies(ctx context.Context, limit int) ([]sharedCookie, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage has no cookies"})
+			return
+		}
+		limit := defaultPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit: expected a positive number"})
+				return
+			}
+			limit = min(n, maxPageSize)
+		}
+		cookies, err := db.sharedCookies(r.Context(), limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"cookies": cookies})
+	})
+
+	mux.HandleFunc("/api/credentials", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			credentialAttempts(ctx context.Context, ip string, limit int) ([]credentialAttempt, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage has no credentials"})
+			return
+		}
+		limit := defaultPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit: expected a positive number"})
+				return
+			}
+			limit = min(n, maxPageSize)
+		}
+		attempts, err := db.credentialAttempts(r.Context(), r.URL.Query().Get("ip"), limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"credentials": attempts})
+	})
+
+	mux.HandleFunc("/api/sessions", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			listSessions(ctx context.Context, ip string, limit int) ([]listedSession, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage has no sessions"})
+			return
+		}
+		limit := defaultPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit: expected a positive number"})
+				return
+			}
+			limit = min(n, maxPageSize)
+		}
+		sessions, err := db.listSessions(r.Context(), r.URL.Query().Get("ip"), limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": sessions})
+	})
+
+	mux.HandleFunc("/api/profiles/", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			attackerProfile(ctx context.Context, ip string, limit int) (*attackerProfile, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage has no profiles"})
+			return
+		}
+		limit := defaultPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit: expected a positive number"})
+				return
+			}
+			limit = min(n, maxPageSize)
+		}
+		p, err := db.attackerProfile(r.Context(), strings.TrimPrefix(r.URL.Path, "/api/profiles/"), limit)
+		switch {
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		case p == nil:
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown client"})
+		default:
+			writeJSON(w, http.StatusOK, p)
+		}
+	})
+
+	mux.HandleFunc("/api/stream", s.stream.serve)
+
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			searchRequests(ctx context.Context, q *searchQuery) ([]searchResult, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage can't search requests"})
+			return
+		}
+		q, err := parseSearchQuery(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		results, err := db.searchRequests(r.Context(), q)
+		switch {
+		case errors.Is(err, errSearchDisabled):
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": err.Error()})
+		case errors.Is(err, errInvalidSearch):
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+		}
+	})
+
+	mux.HandleFunc("/api/stats/hosts", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			hostTraffic(since string, limit int) ([]hostTraffic, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage has no stats"})
+			return
+		}
+		since := r.URL.Query().Get("since")
+		if since != "" {
+			if _, err := time.Parse(dayFormat, since); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since: expected 2006-01-02"})
+				return
+			}
+		}
+		limit := defaultPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit: expected a positive number"})
+				return
+			}
+			limit = min(n, maxPageSize)
+		}
+		hosts, err := db.hostTraffic(since, limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"hosts": hosts})
+	})
+
+	mux.HandleFunc("/api/stats/tags", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			tagStats(since string, limit int) ([]tagStats, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage has no stats"})
+			return
+		}
+		since := r.URL.Query().Get("since")
+		if since != "" {
+			if _, err := time.Parse(dayFormat, since); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since: expected 2006-01-02"})
+				return
+			}
+		}
+		limit := defaultPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit: expected a positive number"})
+				return
+			}
+			limit = min(n, maxPageSize)
+		}
+		tags, err := db.tagStats(since, limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tags": tags})
+	})
+
+	mux.HandleFunc("/api/stats/connect-targets", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			connectTargets(since string, port, limit int) ([]targetStats, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage has no stats"})
+			return
+		}
+		since := r.URL.Query().Get("since")
+		if since != "" {
+			if _, err := time.Parse(dayFormat, since); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since: expected 2006-01-02"})
+				return
+			}
+		}
+		port := 0
+		if v := r.URL.Query().Get("port"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > 65535 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "port: expected a port number"})
+				return
+			}
+			port = n
+		}
+		limit := defaultPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit: expected a positive number"})
+				return
+			}
+			limit = min(n, maxPageSize)
+		}
+		targets, err := db.connectTargets(since, port, limit)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"targets": targets})
+	})
+
+	mux.HandleFunc("/api/stats/latency", func(w http.ResponseWriter, r *http.Request) {
+		db, ok := s.db.(interface {
+			latencyStats(day string) (*reportLatency, error)
+		})
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "the storage has no stats"})
+			return
+		}
+		day := r.URL.Query().Get("day")
+		if day == "" {
+			day = time.Now().UTC().Format(dayFormat)
+		} else if _, err := time.Parse(dayFormat, day); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "day: expected 2006-01-02"})
+			return
+		}
+		l, err := db.latencyStats(day)
+		switch {
+		case errors.Is(err, errNoDayFile):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, l)
+		}
+	})
+
+	mux.HandleFunc("/api/samples", func(w http.ResponseWriter, r *http.Request) {
+		if s.samples == nil {
+			writeJSON(w, http.StatusOK, []sample{})
+			return
+		}
+		writeJSON(w, http.StatusOK, s.samples.list())
+	})
+	mux.HandleFunc("/api/samples/", func(w http.ResponseWriter, r *http.Request) {
+		sha := strings.TrimPrefix(r.URL.Path, "/api/samples/")
+		if s.samples == nil || !sampleName.MatchString(sha) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown sample"})
+			return
+		}
+		path, ok := s.samples.path(sha)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown sample"})
+			return
+		}
+		// Samples are only ever downloaded, never rendered.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename="+sha+".bin")
+		http.ServeFile(w, r, path)
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		info := getBuildInfo()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintln(w, "# HELP stuffpot_build_info Build information, the value is always 1.")
+		fmt.Fprintln(w, "# TYPE stuffpot_build_info gauge")
+		fmt.Fprintf(w, "stuffpot_build_info{version=%q,commit=%q,build_date=%q,go_version=%q} 1\n",
+			info.Version, info.Commit, info.BuildDate, info.GoVersion)
+		s.metrics.write(w)
+		stages := make([]string, 0, len(logStages))
+		for name := range logStages {
+			stages = append(stages, name)
+		}
+		sort.Strings(stages)
+		fmt.Fprintln(w, "# HELP stuffpot_log_stage_seconds_total Time spent by logged events in each stage of the pipeline.")
+		fmt.Fprintln(w, "# TYPE stuffpot_log_stage_seconds_total counter")
+		for _, name := range stages {
+			fmt.Fprintf(w, "stuffpot_log_stage_seconds_total{stage=%q} %g\n", name, time.Duration(logStages[name].nanos.Load()).Seconds())
+		}
+		fmt.Fprintln(w, "# HELP stuffpot_log_stage_events_total Events through each stage of the pipeline.")
+		fmt.Fprintln(w, "# TYPE stuffpot_log_stage_events_total counter")
+		for _, name := range stages {
+			fmt.Fprintf(w, "stuffpot_log_stage_events_total{stage=%q} %d\n", name, logStages[name].events.Load())
+		}
+		fmt.Fprintln(w, "# HELP stuffpot_log_expired_total Events dropped past their deadline or at shutdown.")
+		fmt.Fprintln(w, "# TYPE stuffpot_log_expired_total counter")
+		fmt.Fprintf(w, "stuffpot_log_expired_total %d\n", expiredEvents.Load())
+		fmt.Fprintln(w, "# HELP stuffpot_log_shed_level Detail shed by the logging pipeline: 0 none, 1 bodies, 2 headers, 3 minimal rows.")
+		fmt.Fprintln(w, "# TYPE stuffpot_log_shed_level gauge")
+		fmt.Fprintf(w, "stuffpot_log_shed_level %d\n", shedCurrent.Load())
+		fmt.Fprintln(w, "# HELP stuffpot_log_shed_events_total Events logged with detail shed by level, and sampled in full at the minimal level.")
+		fmt.Fprintln(w, "# TYPE stuffpot_log_shed_events_total counter")
+		for _, name := range []string{"bodies", "headers", "minimal", "sampled"} {
+			fmt.Fprintf(w, "stuffpot_log_shed_events_total{level=%q} %d\n", name, shedEvents[name].Load())
+		}
+		fmt.Fprintln(w, "# HELP stuffpot_script_errors_total Requests passed through as the script failed on them.")
+		fmt.Fprintln(w, "# TYPE stuffpot_script_errors_total counter")
+		fmt.Fprintf(w, "stuffpot_script_errors_total %d\n", scriptErrors.Load())
+		if counts := s.geo.counts(); len(counts) > 0 {
+			fmt.Fprintln(w, "# HELP stuffpot_geo_requests_total Requests and tunnels by the country of their client.")
+			fmt.Fprintln(w, "# TYPE stuffpot_geo_requests_total counter")
+			for _, c := range counts {
+				fmt.Fprintf(w, "stuffpot_geo_requests_total{country=%q} %d\n", c.Country, c.Requests)
+			}
+			fmt.Fprintln(w, "# HELP stuffpot_geo_policy_hits_total Requests and tunnels hitting the origin policy by country.")
+			fmt.Fprintln(w, "# TYPE stuffpot_geo_policy_hits_total counter")
+			for _, c := range counts {
+				fmt.Fprintf(w, "stuffpot_geo_policy_hits_total{country=%q} %d\n", c.Country, c.Hits)
+			}
+		}
+		feeds := s.feeds.status()
+		if len(feeds) > 0 {
+			fmt.Fprintln(w, "# HELP stuffpot_feed_matches_total Logged requests whose client or host is listed by a feed.")
+			fmt.Fprintln(w, "# TYPE stuffpot_feed_matches_total counter")
+			for _, f := range feeds {
+				fmt.Fprintf(w, "stuffpot_feed_matches_total{feed=%q} %d\n", f.Name, f.Matches)
+			}
+			fmt.Fprintln(w, "# HELP stuffpot_feed_blocks_total Requests and tunnels refused by a block feed.")
+			fmt.Fprintln(w, "# TYPE stuffpot_feed_blocks_total counter")
+			for _, f := range feeds {
+				fmt.Fprintf(w, "stuffpot_feed_blocks_total{feed=%q} %d\n", f.Name, f.Blocks)
+			}
+			fmt.Fprintln(w, "# HELP stuffpot_feed_entries Addresses and networks of a feed.")
+			fmt.Fprintln(w, "# TYPE stuffpot_feed_entries gauge")
+			for _, f := range feeds {
+				fmt.Fprintf(w, "stuffpot_feed_entries{feed=%q} %d\n", f.Name, f.Entries)
+			}
+		}
+	})
+
+	// The body of a POST is an object of the runtime settings to change, by
+	// key. The changes are lost on restart, unless persist=true writes them
+	// to the config file; overrides lists those which would be.
+	mux.HandleFunc("/api/settings", func(w http.ResponseWriter, r *http.Request) {
+		persisted := false
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var body map[string]interface{}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			values, err := parseSettings(body)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			params := make(url.Values)
+			for key, v := range values {
+				params.Set(key, v)
+			}
+			auditParams(w, params)
+			persisted = r.URL.Query().Get("persist") == "true"
+			if err := s.config.set(values, persisted); err != nil {
+				writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		current, overrides := s.config.settings()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"settings": current, "overrides": overrides,
+			"persisted": persisted})
+	})
+
+	mux.HandleFunc("/api/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if err := s.Reload(); err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// exportedIDs returns the requests exported by r: those of its id parameters,
+// or else a page of those listed by the other ones, the next page's cursor
+// being set as X-Next-Cursor. The error is written to w when it fails.
+func exportedIDs(w http.ResponseWriter, r *http.Request, db requestReader) ([]string, bool) {
+	values := r.URL.Query()
+	if ids := values["id"]; len(ids) > 0 {
+		if len(ids) > maxPageSize {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("id: at most %d", maxPageSize)})
+			return nil, false
+		}
+		return ids, true
+	}
+	q, err := parseRequestQuery(values)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	page, err := db.listRequests(r.Context(), q)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	return listedIDs(page, q.Desc), true
+}
@@ -0,0 +1,313 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minTokenLength keeps guessable tokens out of the config.
+const minTokenLength = 16
+
+// compileAdmin validates the admin settings and reads the tokens file.
+func (c *Config) compileAdmin() error {
+	var errs []error
+	tokens := slices.Clone(c.Admin.Tokens)
+	if c.Admin.TokensFile != "" {
+		read, err := readTokensFile(c.Admin.TokensFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("admin.tokens_file: %v", err))
+		}
+		tokens = append(tokens, read...)
+	}
+	ids := make(map[string]bool)
+	for i, t := range tokens {
+		if t.ID == "" || ids[t.ID] {
+			errs = append(errs, fmt.Errorf("admin.tokens[%d]: missing or duplicate id %q", i, t.ID))
+		}
+		ids[t.ID] = true
+		if len(t.Token) < minTokenLength {
+			errs = append(errs, fmt.Errorf("admin.tokens[%d]: token must be at least %d characters", i, minTokenLength))
+		}
+		if t.Scope != "read" && t.Scope != "admin" {
+			errs = append(errs, fmt.Errorf("admin.tokens[%d]: unknown scope %q", i, t.Scope))
+		}
+	}
+	c.adminTokens = tokens
+
+	if (c.Admin.TLSCert == "") != (c.Admin.TLSKey == "") {
+		errs = append(errs, errors.New("admin: tls_cert and tls_key must be given together"))
+	}
+	if c.Admin.ClientCA != "" && c.Admin.TLSCert == "" {
+		errs = append(errs, errors.New("admin.client_ca: needs tls_cert"))
+	}
+	if c.Listen.Admin != "" && !loopbackAddr(c.Listen.Admin) && !c.adminProtected() {
+		errs = append(errs, fmt.Errorf("listen.admin: %v is reachable from other hosts, the admin API needs tokens or "+
+			"a client_ca there", c.Listen.Admin))
+	}
+	if c.Admin.ClientScope != "read" && c.Admin.ClientScope != "admin" {
+		errs = append(errs, fmt.Errorf("admin.client_scope: unknown scope %q", c.Admin.ClientScope))
+	}
+	return errors.Join(errs...)
+}
+
+// adminProtected tells whether the admin API has tokens or client CAs,
+// without which anyone reaching it is let in.
+func (c *Config) adminProtected() bool {
+	return len(c.adminTokens) > 0 || c.Admin.ClientCA != ""
+}
+
+// loopbackAddr tells whether addr, a host and port, is only reachable from the
+// host itself.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// readTokensFile reads the tokens of path, one "id scope token" per line.
+// Empty lines and those starting with # are skipped.
+func readTokensFile(path string) ([]AdminToken, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []AdminToken
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected id, scope and token", n)
+		}
+		tokens = append(tokens, AdminToken{ID: fields[0], Scope: fields[1], Token: fields[2]})
+	}
+	return tokens, sc.Err()
+}
+
+// adminTLS returns the TLS config of the admin listener, or nil to serve it
+// in plaintext. With client CAs, the clients without a certificate signed by
+// one of them are refused at the handshake, tokens or not.
+func adminTLS(cfg AdminConfig) (*tls.Config, error) {
+	if cfg.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("admin certificate: %w", err)
+	}
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.ClientCA != "" {
+		pem, err := os.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("admin client CA: %w", err)
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("admin client CA: no certificate in %v", cfg.ClientCA)
+		}
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// adminTLSStore holds the TLS config of the admin listener, reloaded with the
+// config so that the certificates are rotated without closing the listener.
+// TLS can't be turned on or off by a reload.
+type adminTLSStore struct {
+	atomic.Pointer[tls.Config]
+	config *ConfigStore
+	log    *slog.Logger
+	mu     sync.Mutex
+}
+
+func newAdminTLSStore(config *ConfigStore) (*adminTLSStore, error) {
+	store := &adminTLSStore{config: config, log: slog.With("component", "admin")}
+	tc, err := adminTLS(config.Load().Admin)
+	if err != nil {
+		return nil, err
+	}
+	store.Store(tc)
+	return store, nil
+}
+
+// reload loads the certificates again, keeping the current ones when it
+// fails.
+func (store *adminTLSStore) reload() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.Load() == nil {
+		return nil
+	}
+	tc, err := adminTLS(store.config.Load().Admin)
+	if err == nil && tc == nil {
+		err = errors.New("admin: TLS can't be turned off without a restart")
+	}
+	if err != nil {
+		store.log.Error("Keeping current admin certificates, reload failed", "error", err)
+		return err
+	}
+	store.Store(tc)
+	return nil
+}
+
+// serverConfig returns the TLS config of the admin server, which reads the
+// current one on every handshake, or nil without TLS.
+func (store *adminTLSStore) serverConfig() *tls.Config {
+	if store.Load() == nil {
+		return nil
+	}
+	return &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return store.Load(), nil
+	}}
+}
+
+// authenticate returns the id and scope of the caller of r, from its bearer
+// token or its verified client certificate. Browsers loading the web UI send
+// the token as the password of Basic credentials instead. It returns no scope
+// for anyone else. Every token is compared, in constant time, so that the
+// time taken doesn't tell how close a guess was.
+func authenticate(cfg *Config, r *http.Request) (id, scope string) {
+	token := ""
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		token = strings.TrimSpace(auth[7:])
+	} else if _, pass, ok := r.BasicAuth(); ok {
+		token = pass
+	}
+	if token != "" {
+		given := sha256.Sum256([]byte(token))
+		for _, t := range cfg.adminTokens {
+			want := sha256.Sum256([]byte(t.Token))
+			if subtle.ConstantTimeCompare(given[:], want[:]) == 1 {
+				id, scope = t.ID, t.Scope
+			}
+		}
+		if scope != "" {
+			return id, scope
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName, cfg.Admin.ClientScope
+	}
+	return "", ""
+}
+
+// adminCall is an admin API call, recorded in the admin_audit table.
+type adminCall struct {
+	TokenID  string
+	Method   string
+	Endpoint string
+	Params   string
+	Status   int
+	ClientIP string
+	At       time.Time
+}
+
+// statusWriter keeps the status of the response, and the parameters taken
+// from the request body which are recorded along the query.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	params url.Values
+}
+
+// auditParams records params along the admin call answered with w, for the
+// changes made by a request body.
+func auditParams(w http.ResponseWriter, params url.Values) {
+	if sw, ok := w.(*statusWriter); ok {
+		sw.params = params
+	}
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController the writer of the server, for the
+// streams to flush.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// adminAuth requires a token, or a client certificate, on every endpoint of
+// next but the health checks and the page of the web UI, once either is
+// configured, and records every call. The read scope only allows GET and HEAD
+// requests.
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	log := slog.With("component", "admin")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := s.config.Load()
+		sw := &statusWriter{ResponseWriter: w}
+		id, scope := authenticate(cfg, r)
+		switch {
+		case scope == "" && cfg.adminProtected():
+			// Browsers prompt for Basic credentials, not for a token.
+			if r.URL.Path == "/ui/" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="stuffpot"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeJSON(sw, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		case scope == "read" && r.Method != http.MethodGet && r.Method != http.MethodHead:
+			writeJSON(sw, http.StatusForbidden, map[string]string{"error": "read-only access"})
+		default:
+			next.ServeHTTP(sw, r)
+		}
+
+		if db, ok := s.db.(interface{ logAdminCall(call *adminCall) error }); ok {
+			params := r.URL.RawQuery
+			if len(sw.params) > 0 {
+				params = strings.TrimPrefix(params+"&"+sw.params.Encode(), "&")
+			}
+			call := &adminCall{TokenID: id, Method: r.Method, Endpoint: r.URL.Path, Params: params,
+				Status: sw.status, ClientIP: clientIP(r.RemoteAddr), At: time.Now()}
+			err := s.logger.enqueue(context.Background(), "admin call", "", func(context.Context) error {
+				return db.logAdminCall(call)
+			}, nil)
+			if err != nil {
+				log.Error("Failed to record admin call", "endpoint", call.Endpoint, "error", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,289 @@
+package stuffpot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority made up for a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key}
+}
+
+// issue returns a certificate of name signed by ca, for a server on the
+// loopback address or for a client, and writes it and its key to files.
+func (ca *testCA) issue(t *testing.T, name string, server bool) (cert tls.Certificate, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(time.Now().UnixNano()), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+// writePEM writes the certificate of ca to a file and returns its path.
+func (ca *testCA) writePEM(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testAdminToken = "0123456789abcdef-admin"
+
+// adminTLSServer serves the admin API over TLS, client certificates signed
+// by ca being accepted as well as testAdminToken, and returns its URL and
+// the pool of its CA.
+func adminTLSServer(t *testing.T, ca *testCA, args ...string) (string, *x509.CertPool) {
+	t.Helper()
+	_, certFile, keyFile := ca.issue(t, "admin", true)
+	tokens := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokens, []byte("ops admin "+testAdminToken+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	args = append([]string{"-admin-tls-cert", certFile, "-admin-tls-key", keyFile, "-admin-client-ca", ca.writePEM(t),
+		"-admin-tokens-file", tokens}, args...)
+	s, _ := startServer(t, testConfig(t, args...), &recordingLogger{})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return "https" + strings.TrimPrefix(serveAdmin(t, s), "http"), roots
+}
+
+// adminGet gets path from the admin API with the client certificate and
+// token given, if any. The certificate is sent even when the server asks for
+// those of other CAs.
+func adminGet(adminURL string, roots *x509.CertPool, path, token string, certs ...tls.Certificate) (int, error) {
+	tc := &tls.Config{RootCAs: roots}
+	if len(certs) > 0 {
+		tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &certs[0], nil }
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}, Timeout: 5 * time.Second}
+	req, err := http.NewRequest("GET", adminURL+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestAdminMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "stuffpot test CA")
+	adminURL, roots := adminTLSServer(t, ca)
+	valid, _, _ := ca.issue(t, "ops", false)
+	foreign, _, _ := newTestCA(t, "foreign CA").issue(t, "ops", false)
+
+	if _, err := adminGet(adminURL, roots, "/api/version", "", foreign); err == nil {
+		t.Error("a certificate of another CA passed the handshake")
+	}
+	if _, err := adminGet(adminURL, roots, "/api/version", testAdminToken, foreign); err == nil {
+		t.Error("a certificate of another CA passed the handshake along a valid token")
+	}
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		certs []tls.Certificate
+		want  int
+	}{
+		{"valid certificate", "/api/version", "", []tls.Certificate{valid}, http.StatusOK},
+		{"token", "/api/version", testAdminToken, []tls.Certificate{valid}, http.StatusOK},
+		{"healthz", "/healthz", "", []tls.Certificate{valid}, http.StatusOK},
+		{"readyz", "/readyz", "", []tls.Certificate{valid}, http.StatusOK},
+		{"ui", "/ui/", "", []tls.Certificate{valid}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		// The listener is ready once Serve has started.
+		code, err := adminGet(adminURL, roots, tt.path, tt.token, tt.certs...)
+		for deadline := time.Now().Add(5 * time.Second); tt.name == "readyz" && code != tt.want &&
+			time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			code, err = adminGet(adminURL, roots, tt.path, tt.token, tt.certs...)
+		}
+		if err != nil || code != tt.want {
+			t.Errorf("%v: got %v, %v, want %v", tt.name, code, err, tt.want)
+		}
+	}
+}
+
+func TestAdminRefusesClientsWithoutACertificate(t *testing.T) {
+	ca := newTestCA(t, "stuffpot test CA")
+	adminURL, roots := adminTLSServer(t, ca)
+	for _, path := range []string{"/api/version", "/healthz", "/ui/"} {
+		for _, token := range []string{"", testAdminToken} {
+			if _, err := adminGet(adminURL, roots, path, token); err == nil {
+				t.Errorf("%v with token %q: a client without a certificate passed the handshake", path, token)
+			}
+		}
+	}
+}
+
+func TestAdminTokens(t *testing.T) {
+	tokens := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokens, []byte("ops admin "+testAdminToken+"\nviewer read 0123456789abcdef-read\n"),
+		0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := startServer(t, testConfig(t, "-admin-tokens-file", tokens), &recordingLogger{})
+	adminURL := serveAdmin(t, s)
+	tests := []struct {
+		name, method, path string
+		auth               func(r *http.Request)
+		want               int
+		challenge          string
+	}{
+		{"token", "GET", "/api/version", bearer(testAdminToken), http.StatusOK, ""},
+		{"wrong token", "GET", "/api/version", bearer("0123456789abcdef-wrong"), http.StatusUnauthorized, "Bearer"},
+		{"nothing", "GET", "/api/version", nil, http.StatusUnauthorized, "Bearer"},
+		{"read scope", "POST", "/api/reload", bearer("0123456789abcdef-read"), http.StatusForbidden, ""},
+		{"healthz", "GET", "/healthz", nil, http.StatusOK, ""},
+		{"ui", "GET", "/ui/", nil, http.StatusUnauthorized, `Basic realm="stuffpot"`},
+		{"ui with the token as password", "GET", "/ui/", func(r *http.Request) { r.SetBasicAuth("ops", testAdminToken) },
+			http.StatusOK, ""},
+		{"ui with a wrong password", "GET", "/ui/", func(r *http.Request) { r.SetBasicAuth("ops", "nope") },
+			http.StatusUnauthorized, `Basic realm="stuffpot"`},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, adminURL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.auth != nil {
+			tt.auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want || resp.Header.Get("WWW-Authenticate") != tt.challenge {
+			t.Errorf("%v: got %v challenging for %q, want %v and %q", tt.name, resp.StatusCode,
+				resp.Header.Get("WWW-Authenticate"), tt.want, tt.challenge)
+		}
+	}
+}
+
+// bearer sets token as the bearer token of a request.
+func bearer(token string) func(r *http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func TestAdminWithoutCredentialsIsOnlyServedOnLoopback(t *testing.T) {
+	for _, addr := range []string{":8081", "0.0.0.0:8081", "192.0.2.1:8081", "[::]:8081"} {
+		_, err := NewConfigStore("stuffpot", []string{"-admin-addr", addr})
+		if err == nil || !strings.Contains(err.Error(), "listen.admin: "+addr+" is reachable from other hosts") {
+			t.Errorf("%v: got %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1:8081", "[::1]:8081", "localhost:8081"} {
+		if _, err := NewConfigStore("stuffpot", []string{"-admin-addr", addr}); err != nil {
+			t.Errorf("%v: %v", addr, err)
+		}
+	}
+	tokens := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokens, []byte("ops admin "+testAdminToken+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewConfigStore("stuffpot", []string{"-admin-addr", ":8081", "-admin-tokens-file", tokens}); err != nil {
+		t.Errorf("with tokens: %v", err)
+	}
+
+	// A listener given by the caller is checked too.
+	s, _ := startServer(t, testConfig(t), &recordingLogger{})
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ServeAdmin(ln); err == nil || !strings.Contains(err.Error(), "reachable from other hosts") {
+		t.Errorf("ServeAdmin on %v: got %v", ln.Addr(), err)
+	}
+}
+
+func TestNewServerClosesTheSinksWhenTheAdminCertificateFails(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	db := &recordingLogger{}
+	s, err := NewServer(testConfig(t, "-admin-tls-cert", missing, "-admin-tls-key", missing), db)
+	if err == nil {
+		s.Shutdown(t.Context())
+		t.Fatal("the server started without its admin certificate")
+	}
+	if !strings.Contains(err.Error(), "admin certificate") {
+		t.Errorf("got %v, want the admin certificate's error", err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.closed {
+		t.Error("the sinks were left open")
+	}
+}
@@ -0,0 +1,526 @@
+package stuffpot
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/smtp"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// alertQueue bounds the alerts waiting to be sent, those firing once
+	// it's full being dropped.
+	alertQueue = 256
+	// maxAlertCooldowns bounds the rules and clients whose cooldown is
+	// tracked, the expired ones being pruned once it's reached.
+	maxAlertCooldowns = 10000
+)
+
+// The channels alerts are sent to.
+var alertChannels = []string{"webhook", "slack", "email"}
+
+// The detections alert rules match with event, rather than requests and
+// CONNECTs.
+var alertEvents = []string{"bruteforce", "honeytoken", "proxy-check"}
+
+// AlertRule sends an alert for the requests and CONNECTs matching it, as
+// they're received. Every condition given must match.
+type AlertRule struct {
+	Name   string `yaml:"name"`
+	Method string `yaml:"method"`
+	Host   string `yaml:"host"`
+	// Path is matched against the path of requests, CONNECTs having none.
+	Path string `yaml:"path"`
+	// Tag is the name of a tag rule, those of the rule files, matching the
+	// request.
+	Tag string `yaml:"tag"`
+	// Credential matches the requests and CONNECTs carrying a credential.
+	Credential bool `yaml:"credential"`
+	// CIDRs are the addresses and networks of the watched clients.
+	CIDRs []string `yaml:"cidrs"`
+	// Event makes the rule match a detection instead of the requests and
+	// CONNECTs: a brute force session starting, a honeytoken recalled or a
+	// checker validating the proxy.
+	Event string `yaml:"event"`
+	// Notify names the channels of the rule, webhook, slack or email, all
+	// those configured when empty.
+	Notify []string `yaml:"notify"`
+
+	method, host, path *regexp.Regexp
+	cidrs              []netip.Prefix
+}
+
+func (r *AlertRule) compile() error {
+	if r.Name == "" {
+		return errors.New("missing name")
+	}
+	var errs []error
+	for _, p := range []struct {
+		re      **regexp.Regexp
+		name, s string
+	}{{&r.method, "method", r.Method}, {&r.host, "host", r.Host}, {&r.path, "path", r.Path}} {
+		if p.s == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", p.name, err))
+		}
+		*p.re = re
+	}
+	r.cidrs = nil
+	for _, s := range r.CIDRs {
+		p, err := parsePrefix(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cidrs: %v", err))
+		}
+		r.cidrs = append(r.cidrs, p)
+	}
+	for _, n := range r.Notify {
+		if !slices.Contains(alertChannels, n) {
+			errs = append(errs, fmt.Errorf("notify: unknown channel %q", n))
+		}
+	}
+	if r.Event != "" && !slices.Contains(alertEvents, r.Event) {
+		errs = append(errs, fmt.Errorf("event: unknown event %q, expected one of %v", r.Event, strings.Join(alertEvents, ", ")))
+	}
+	if len(errs) == 0 && r.Method == "" && r.Host == "" && r.Path == "" && r.Tag == "" && !r.Credential &&
+		len(r.CIDRs) == 0 && r.Event == "" {
+		return errors.New("no condition")
+	}
+	return errors.Join(errs...)
+}
+
+func (r *AlertRule) match(ev *alert) bool {
+	if r.Event == "" && ev.Kind != "request" && ev.Kind != "connect" || r.Event != "" && r.Event != ev.Kind {
+		return false
+	}
+	if r.method != nil && !r.method.MatchString(ev.Method) {
+		return false
+	}
+	if r.host != nil && !r.host.MatchString(ev.Host) {
+		return false
+	}
+	if r.path != nil && (ev.Kind != "request" || !r.path.MatchString(ev.Path)) {
+		return false
+	}
+	if r.Tag != "" && !slices.Contains(ev.Tags, r.Tag) {
+		return false
+	}
+	if r.Credential && ev.Credentials == 0 {
+		return false
+	}
+	if len(r.cidrs) > 0 {
+		a, err := netip.ParseAddr(ev.ClientIP)
+		if err != nil || !slices.ContainsFunc(r.cidrs, func(p netip.Prefix) bool { return p.Contains(a.Unmap()) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// notifies tells whether the rule sends its alerts to channel.
+func (r *AlertRule) notifies(channel string) bool {
+	return len(r.Notify) == 0 || slices.Contains(r.Notify, channel)
+}
+
+// compileAlerts validates the alert rules and channels.
+func (c *Config) compileAlerts() error {
+	var errs []error
+	names := make(map[string]bool)
+	for i, r := range c.Alerts.Rules {
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("alerts.rules[%d]: %v", i, err))
+		} else if names[r.Name] {
+			errs = append(errs, fmt.Errorf("alerts.rules[%d]: duplicate name %q", i, r.Name))
+		}
+		names[r.Name] = true
+	}
+	for _, u := range []struct{ name, url string }{{"webhook", c.Alerts.Webhook}, {"slack", c.Alerts.Slack}} {
+		if u.url == "" {
+			continue
+		}
+		if p, err := url.Parse(u.url); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			errs = append(errs, fmt.Errorf("alerts.%v: %q is not an http or https URL", u.name, u.url))
+		}
+	}
+	if c.Alerts.SMTP != "" {
+		if _, _, err := net.SplitHostPort(c.Alerts.SMTP); err != nil {
+			errs = append(errs, fmt.Errorf("alerts.smtp: %v", err))
+		}
+		if c.Alerts.From == "" || len(c.Alerts.To) == 0 {
+			errs = append(errs, errors.New("alerts.smtp: needs from and to"))
+		}
+	}
+	if c.Alerts.Cooldown < 0 {
+		errs = append(errs, errors.New("alerts.cooldown: must not be negative"))
+	}
+	if c.Alerts.Timeout <= 0 {
+		errs = append(errs, errors.New("alerts.timeout: must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// alert is a request, CONNECT or detection matching an alert rule, as sent
+// to the webhook.
+type alert struct {
+	Rule string    `json:"rule"`
+	Time time.Time `json:"time"`
+	// Kind is request, connect or the event of a detection, whose ID is that
+	// of the request, or of the session of a brute force.
+	Kind     string   `json:"kind"`
+	ID       string   `json:"request_id"`
+	ClientIP string   `json:"client"`
+	Method   string   `json:"method"`
+	Host     string   `json:"host"`
+	Path     string   `json:"path,omitempty"`
+	URL      string   `json:"url,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// Credentials counts the credentials sent, and Usernames are their
+	// users, the passwords being only stored.
+	Credentials int      `json:"credentials,omitempty"`
+	Usernames   []string `json:"usernames,omitempty"`
+	// Detail describes a detection: the attempts of a brute force, the
+	// honeytoken recalled or the service checking the proxy.
+	Detail string `json:"detail,omitempty"`
+}
+
+// newAlert returns the event of a request or CONNECT, to be checked against
+// the alert rules.
+func newAlert(kind, id string, req *http.Request, creds []credential, tags []string, at time.Time) alert {
+	al := alert{Time: at, Kind: kind, ID: id, ClientIP: clientIP(req.RemoteAddr), Method: req.Method, Host: req.Host,
+		Tags: tags, Credentials: len(creds)}
+	if kind != "connect" {
+		al.Path, al.URL = req.URL.Path, req.URL.String()
+	}
+	for _, c := range creds {
+		if c.Username != "" && !slices.Contains(al.Usernames, c.Username) {
+			al.Usernames = append(al.Usernames, c.Username)
+		}
+	}
+	return al
+}
+
+// text is the alert in a few lines, for Slack and email, the values of the
+// rule and the request, mostly sent by the client, given through quote.
+func (a *alert) text(quote func(string) string) string {
+	list := func(values []string) string {
+		quoted := make([]string, len(values))
+		for i, v := range values {
+			quoted[i] = quote(v)
+		}
+		return strings.Join(quoted, ", ")
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "stuffpot alert %v: %v from %v", quote(a.Rule), a.Kind, quote(a.ClientIP))
+	switch {
+	case a.URL != "":
+		fmt.Fprintf(&b, "\n%v %v", quote(a.Method), quote(a.URL))
+	case a.Method != "":
+		fmt.Fprintf(&b, "\n%v %v", quote(a.Method), quote(a.Host))
+	}
+	if a.Detail != "" {
+		fmt.Fprintf(&b, "\n%v", quote(a.Detail))
+	}
+	if len(a.Tags) > 0 {
+		fmt.Fprintf(&b, "\nTags: %v", list(a.Tags))
+	}
+	if len(a.Usernames) > 0 {
+		fmt.Fprintf(&b, "\nUsernames: %v", list(a.Usernames))
+	}
+	id := "Request"
+	if a.Kind == "bruteforce" {
+		id = "Session"
+	}
+	if a.ID != "" {
+		fmt.Fprintf(&b, "\n%v %v at %v", id, quote(a.ID), a.Time.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(&b, "\nAt %v", a.Time.Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+// slackEscape escapes the characters Slack's mrkdwn gives a meaning to, which
+// would let a client mention a channel or make up a link.
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+// slackCode quotes s as inline code in Slack's mrkdwn, where it isn't
+// formatted. Code spans can't hold backquotes or lines, those are replaced.
+func slackCode(s string) string {
+	s = strings.NewReplacer("`", "'", "\r", " ", "\n", " ").Replace(s)
+	return "`" + slackEscape(s) + "`"
+}
+
+func plainText(s string) string {
+	return s
+}
+
+// alerter matches the requests and CONNECTs against the alert rules as
+// they're received, and sends the alerts to their channels in the background.
+// A rule fires once per client within the cooldown.
+type alerter struct {
+	config *ConfigStore
+	client *http.Client
+	log    *slog.Logger
+	queue  chan *alert
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu    sync.Mutex
+	fired map[string]time.Time
+}
+
+func newAlerter(config *ConfigStore) *alerter {
+	return &alerter{
+		config: config,
+		client: &http.Client{},
+		log:    slog.With("component", "alerts"),
+		queue:  make(chan *alert, alertQueue),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		fired:  make(map[string]time.Time),
+	}
+}
+
+// check queues the alerts of the rules matching ev. It never blocks.
+func (a *alerter) check(ev alert) {
+	cfg := a.config.Load()
+	for _, r := range cfg.Alerts.Rules {
+		if !r.match(&ev) || !a.cool(cfg, r.Name, ev.ClientIP, ev.Time) {
+			continue
+		}
+		al := ev
+		al.Rule = r.Name
+		select {
+		case a.queue <- &al:
+			alertsTotal.Add(1)
+		default:
+			alertsDropped.Add(1)
+			a.log.Warn("Alert dropped, the queue is full", "rule", r.Name, "request_id", ev.ID)
+		}
+	}
+}
+
+// cool tells whether rule may fire for ip at now, and starts its cooldown if
+// so.
+func (a *alerter) cool(cfg *Config, rule, ip string, now time.Time) bool {
+	cooldown := cfg.Alerts.Cooldown
+	if cooldown == 0 {
+		return true
+	}
+	key := rule + "\x00" + ip
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if last, ok := a.fired[key]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	if len(a.fired) >= maxAlertCooldowns {
+		for k, t := range a.fired {
+			if now.Sub(t) >= cooldown {
+				delete(a.fired, k)
+			}
+		}
+	}
+	a.fired[key] = now
+	return true
+}
+
+// run sends the queued alerts until close is called, then those still
+// queued. The queue is never closed, the requests of the tunnels open at
+// shutdown may still fire.
+func (a *alerter) run() {
+	defer close(a.done)
+	for {
+		select {
+		case al := <-a.queue:
+			a.send(al)
+		case <-a.stop:
+			for {
+				select {
+				case al := <-a.queue:
+					a.send(al)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send sends al to the channels of its rule, logging those failing.
+func (a *alerter) send(al *alert) {
+	defer contain(a.log, "alert")
+	cfg := a.config.Load()
+	i := slices.IndexFunc(cfg.Alerts.Rules, func(r *AlertRule) bool { return r.Name == al.Rule })
+	if i < 0 {
+		return
+	}
+	rule := cfg.Alerts.Rules[i]
+	a.log.Info("Alert", "rule", al.Rule, "request_id", al.ID, "client", al.ClientIP, "host", al.Host)
+	for _, ch := range []struct {
+		name string
+		set  bool
+		send func(context.Context, *AlertsConfig, *alert) error
+	}{
+		{"webhook", cfg.Alerts.Webhook != "", a.webhook},
+		{"slack", cfg.Alerts.Slack != "", a.slack},
+		{"email", cfg.Alerts.SMTP != "", a.email},
+	} {
+		if !ch.set || !rule.notifies(ch.name) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Alerts.Timeout)
+		err := ch.send(ctx, &cfg.Alerts, al)
+		cancel()
+		if err != nil {
+			alertsFailed.Add(1)
+			a.log.Warn("Cannot send alert", "channel", ch.name, "rule", al.Rule, "request_id", al.ID, "error", err)
+		}
+	}
+}
+
+// post posts body to target as JSON.
+func (a *alerter) post(ctx context.Context, target string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+func (a *alerter) webhook(ctx context.Context, cfg *AlertsConfig, al *alert) error {
+	return a.post(ctx, cfg.Webhook, al)
+}
+
+// slack posts the alert to a Slack incoming webhook.
+func (a *alerter) slack(ctx context.Context, cfg *AlertsConfig, al *alert) error {
+	return a.post(ctx, cfg.Slack, map[string]string{"text": al.text(slackCode)})
+}
+
+func (a *alerter) email(ctx context.Context, cfg *AlertsConfig, al *alert) error {
+	return a.mail(ctx, cfg, "stuffpot alert: "+al.Rule, al.Time, al.text(plainText))
+}
+
+// mail sends a message through the SMTP server, over STARTTLS when it's
+// offered. The user and password are only sent over TLS, or to localhost.
+func (a *alerter) mail(ctx context.Context, cfg *AlertsConfig, subject string, date time.Time, body string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", cfg.SMTP)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	host, _, _ := net.SplitHostPort(cfg.SMTP)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %v\r\nTo: %v\r\nSubject: %v\r\nDate: %v\r\n", cfg.From, strings.Join(cfg.To, ", "),
+		subject, date.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n\r\n%v\r\n", strings.ReplaceAll(body, "\n", "\r\n"))
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// sendReport sends the daily report to the channels, logging those failing.
+// The webhook gets its JSON, Slack and email its text.
+func (a *alerter) sendReport(rep *report, channels []string) {
+	var text strings.Builder
+	if err := rep.writeText(&text); err != nil {
+		a.log.Warn("Cannot send the daily report", "day", rep.Day, "error", err)
+		return
+	}
+	cfg := a.config.Load()
+	for _, ch := range []struct {
+		name string
+		set  bool
+		send func(context.Context) error
+	}{
+		{"webhook", cfg.Alerts.Webhook != "", func(ctx context.Context) error {
+			return a.post(ctx, cfg.Alerts.Webhook, map[string]interface{}{"kind": "report", "report": rep})
+		}},
+		{"slack", cfg.Alerts.Slack != "", func(ctx context.Context) error {
+			// The text goes in a code block, which can't hold its delimiter.
+			block := strings.ReplaceAll(text.String(), "```", "'''")
+			return a.post(ctx, cfg.Alerts.Slack, map[string]string{"text": "```" + slackEscape(block) + "```"})
+		}},
+		{"email", cfg.Alerts.SMTP != "", func(ctx context.Context) error {
+			return a.mail(ctx, &cfg.Alerts, "stuffpot report for "+rep.Day, rep.Generated, text.String())
+		}},
+	} {
+		if !ch.set || !slices.Contains(channels, ch.name) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Alerts.Timeout)
+		err := ch.send(ctx)
+		cancel()
+		if err != nil {
+			alertsFailed.Add(1)
+			a.log.Warn("Cannot send the daily report", "channel", ch.name, "day", rep.Day, "error", err)
+		}
+	}
+}
+
+// close sends the alerts still queued, until ctx expires.
+func (a *alerter) close(ctx context.Context) {
+	close(a.stop)
+	select {
+	case <-a.done:
+	case <-ctx.Done():
+		a.log.Warn("Alerts still queued after grace period", "alerts", len(a.queue))
+	}
+}
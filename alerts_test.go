@@ -0,0 +1,194 @@
+package stuffpot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlackTextEscapesClientValues(t *testing.T) {
+	al := &alert{Rule: "wp-login", Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), Kind: "request", ID: "r1",
+		ClientIP: "192.0.2.1", Method: "GET", Host: "<!channel>", URL: "http://x/<https://evil.example|click me>?a=1&b=`x`",
+		Tags: []string{"*bold*"}, Usernames: []string{"admin\n<!here>"}}
+	text := al.text(slackCode)
+	for _, bad := range []string{"<!channel>", "<https://evil", "<!here>", "a=1&b"} {
+		if strings.Contains(text, bad) {
+			t.Errorf("%q is sent as is in %q", bad, text)
+		}
+	}
+	for _, want := range []string{"`http://x/&lt;https://evil.example|click me&gt;?a=1&amp;b='x'`", "`*bold*`",
+		"`admin &lt;!here&gt;`", "`192.0.2.1`", "`r1`"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("%q lacks %q", text, want)
+		}
+	}
+	if plain := al.text(plainText); !strings.Contains(plain, al.URL) {
+		t.Errorf("the email text %q lacks the URL as is", plain)
+	}
+}
+
+func TestEventRulesMatchTheirEventsOnly(t *testing.T) {
+	rules := map[string]*AlertRule{
+		"watched":    {Name: "watched", CIDRs: []string{"192.0.2.0/24"}},
+		"bruteforce": {Name: "bruteforce", Event: "bruteforce", CIDRs: []string{"192.0.2.0/24"}},
+		"honeytoken": {Name: "honeytoken", Event: "honeytoken"},
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			t.Fatalf("%v: %v", r.Name, err)
+		}
+	}
+	tests := []struct {
+		ev   alert
+		want []string
+	}{
+		{alert{Kind: "request", ClientIP: "192.0.2.1"}, []string{"watched"}},
+		{alert{Kind: "connect", ClientIP: "192.0.2.1"}, []string{"watched"}},
+		{alert{Kind: "bruteforce", ClientIP: "192.0.2.1"}, []string{"bruteforce"}},
+		{alert{Kind: "bruteforce", ClientIP: "198.51.100.1"}, nil},
+		{alert{Kind: "honeytoken", ClientIP: "198.51.100.1"}, []string{"honeytoken"}},
+		{alert{Kind: "proxy-check", ClientIP: "192.0.2.1"}, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, name := range []string{"watched", "bruteforce", "honeytoken"} {
+			if rules[name].match(&tt.ev) {
+				got = append(got, name)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%v from %v: matched %v, want %v", tt.ev.Kind, tt.ev.ClientIP, got, tt.want)
+		}
+	}
+	if err := (&AlertRule{Name: "x", Event: "nope"}).compile(); err == nil {
+		t.Error("an unknown event was accepted")
+	}
+}
+
+// webhookRecorder collects the alerts posted to it.
+type webhookRecorder struct {
+	mu     sync.Mutex
+	alerts []alert
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var al alert
+	if err := json.NewDecoder(r.Body).Decode(&al); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.mu.Lock()
+	w.alerts = append(w.alerts, al)
+	w.mu.Unlock()
+}
+
+// wait returns the alerts of rule once there is one, or nil after a while.
+func (w *webhookRecorder) wait(rule string) []alert {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w.mu.Lock()
+		var found []alert
+		for _, al := range w.alerts {
+			if al.Rule == rule {
+				found = append(found, al)
+			}
+		}
+		w.mu.Unlock()
+		if len(found) > 0 {
+			return found
+		}
+	}
+	return nil
+}
+
+func TestBruteForceSendsAnAlert(t *testing.T) {
+	hook := &webhookRecorder{}
+	webhook := httptest.NewServer(hook)
+	defer webhook.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "denied")
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "stuffpot.yaml")
+	err := os.WriteFile(path, []byte(fmt.Sprintf(`alerts:
+  webhook: %v
+  rules:
+    - name: brute
+      event: bruteforce
+`, webhook.URL)), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, client := startServer(t, testConfig(t, "-config", path, "-bruteforce-attempts", "3", "-bruteforce-credentials",
+		"2"), &recordingLogger{})
+	for i := 0; i < 4; i++ {
+		form := url.Values{"username": {fmt.Sprintf("admin%d", i)}, "password": {"hunter2"}}
+		resp, err := client.PostForm(upstream.URL+"/wp-login.php", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	alerts := hook.wait("brute")
+	if len(alerts) != 1 {
+		t.Fatalf("got %d brute force alerts, want 1", len(alerts))
+	}
+	if al := alerts[0]; al.Kind != "bruteforce" || al.ClientIP != "127.0.0.1" || al.ID == "" ||
+		!strings.Contains(al.Detail, "login attempts") {
+		t.Errorf("got %+v, want the brute force session of 127.0.0.1", al)
+	}
+}
+
+func TestDailyReportIsSentToTheNotifiedChannels(t *testing.T) {
+	bodies := make(chan []byte, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer webhook.Close()
+
+	path := filepath.Join(t.TempDir(), "log.db")
+	logger, err := NewLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Close()
+	config := testConfig(t, "-db", path, "-alert-webhook", webhook.URL, "-alert-slack", webhook.URL+"/slack",
+		"-report-notify", "webhook")
+	r := newReporter(config, newAlerter(config))
+	r.generate("", config.Load().Report.Notify, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	var got struct {
+		Kind   string `json:"kind"`
+		Report report `json:"report"`
+	}
+	select {
+	case b := <-bodies:
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("the report wasn't posted")
+	}
+	if got.Kind != "report" || got.Report.Day != "2024-06-01" {
+		t.Errorf("got %+v, want the report of 2024-06-01", got)
+	}
+	if len(bodies) != 0 {
+		t.Error("the report was sent to Slack, which isn't notified")
+	}
+
+	if _, err := NewConfigStore("stuffpot", []string{"-report-notify", "slack"}); err == nil ||
+		!strings.Contains(err.Error(), "report.notify: the slack alert channel isn't configured") {
+		t.Errorf("notifying an unset channel: got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package stuffpot
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseAnomalies are the oddities of a request as it was received, which
+// net/http smooths over before the request is seen, stored as JSON in the
+// parse_anomalies column.
+type parseAnomalies struct {
+	// FoldedHeaders are the headers whose value is continued on further
+	// lines, which net/http joins with spaces.
+	FoldedHeaders []string `json:"folded_headers,omitempty"`
+	// ContentLengths are the values of the Content-Length headers when there
+	// are several, identical ones as net/http refuses the others, and
+	// ContentLengthUsed the one the body was read with.
+	ContentLengths    []string `json:"content_lengths,omitempty"`
+	ContentLengthUsed string   `json:"content_length_used,omitempty"`
+	// MissingHost is set for the requests without a Host header, which
+	// net/http only accepts of HTTP/1.0.
+	MissingHost bool `json:"missing_host,omitempty"`
+	// TargetForm is the form of the request target, origin, absolute,
+	// authority or asterisk, when it's not the one expected: absolute for
+	// proxied requests and origin for those of a tunnel.
+	TargetForm string `json:"target_form,omitempty"`
+	// BareLF is set when lines of the head end with LF alone.
+	BareLF bool `json:"bare_lf,omitempty"`
+	// Trailers are the trailer fields following a chunked body.
+	Trailers http.Header `json:"trailers,omitempty"`
+}
+
+// badRequest is what net/http answers requests it can't parse with, which
+// the relays answer as well.
+const badRequest = "HTTP/1.1 400 Bad Request\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\n\r\n" +
+	"400 Bad Request"
+
+// targetForm returns the form of the target of req.
+func targetForm(req *http.Request) string {
+	switch uri := req.RequestURI; {
+	case uri == "*":
+		return "asterisk"
+	case strings.HasPrefix(uri, "/"):
+		return "origin"
+	case strings.Contains(uri, "://"):
+		return "absolute"
+	}
+	return "authority"
+}
+
+// noteAnomalies keeps the anomalies of req, those of its head as recorded,
+// if any, and prepares it to be forwarded as it was received: net/http would
+// add a User-Agent to requests sent without one, and only forwards the
+// trailers declared in the head.
+func (state *requestState) noteAnomalies(req *http.Request, head *parseAnomalies) {
+	a := &parseAnomalies{}
+	if head != nil {
+		a = head
+	}
+	if len(a.ContentLengths) > 1 {
+		a.ContentLengthUsed = strconv.FormatInt(req.ContentLength, 10)
+	} else {
+		a.ContentLengths = nil
+	}
+	want := "absolute"
+	if state.parentID != "" {
+		want = "origin"
+	}
+	if form := targetForm(req); form != want {
+		a.TargetForm = form
+	}
+	if a.TargetForm != "" || a.MissingHost || a.BareLF || len(a.FoldedHeaders) > 0 || len(a.ContentLengths) > 0 {
+		state.anomalies = a
+	}
+
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = nil
+	}
+	if len(req.TransferEncoding) > 0 && req.Trailer == nil {
+		req.Trailer = make(http.Header)
+	}
+}
+
+// addTrailers keeps the trailers of the request body, once it's been read.
+func (state *requestState) addTrailers(trailer http.Header) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	for k, v := range trailer {
+		if len(v) == 0 {
+			continue
+		}
+		if state.anomalies == nil {
+			state.anomalies = &parseAnomalies{}
+		}
+		if state.anomalies.Trailers == nil {
+			state.anomalies.Trailers = make(http.Header)
+		}
+		state.anomalies.Trailers[k] = append([]string(nil), v...)
+	}
+}
+
+// anomaliesJSON returns the anomalies of the request as JSON, or nil without
+// any.
+func (state *requestState) anomaliesJSON() json.RawMessage {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.anomalies == nil {
+		return nil
+	}
+	b, err := json.Marshal(state.anomalies)
+	if err != nil {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,122 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAnomaliesOfRawRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	path := filepath.Join(t.TempDir(), "log.db")
+	config, err := NewConfigStore("stuffpot", []string{"-db", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	// Each request is sent on its own connection, to /<name>. want is the
+	// parse_anomalies stored, or nil for none, and status the response's.
+	tests := []struct {
+		name   string
+		raw    string
+		status int
+		want   *parseAnomalies
+	}{
+		{"clean", "GET http://%[1]v/clean HTTP/1.1\r\nHost: %[1]v\r\n\r\n", 200, nil},
+		{"folded", "GET http://%[1]v/folded HTTP/1.1\r\nHost: %[1]v\r\nX-Folded: a\r\n b\r\n\tc\r\nAccept: */*\r\n\r\n",
+			200, &parseAnomalies{FoldedHeaders: []string{"X-Folded"}}},
+		{"content-lengths", "POST http://%[1]v/content-lengths HTTP/1.1\r\nHost: %[1]v\r\nContent-Length: 3\r\n" +
+			"Content-Length: 3\r\n\r\nabc", 200, &parseAnomalies{ContentLengths: []string{"3", "3"}, ContentLengthUsed: "3"}},
+		{"missing-host", "GET http://%[1]v/missing-host HTTP/1.0\r\n\r\n", 200, &parseAnomalies{MissingHost: true}},
+		{"bare-lf", "GET http://%[1]v/bare-lf HTTP/1.1\nHost: %[1]v\nAccept: */*\n\n", 200, &parseAnomalies{BareLF: true}},
+		{"mixed-endings", "GET http://%[1]v/mixed-endings HTTP/1.1\r\nHost: %[1]v\nAccept: */*\r\n\r\n", 200,
+			&parseAnomalies{BareLF: true}},
+		{"trailers", "POST http://%[1]v/trailers HTTP/1.1\r\nHost: %[1]v\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"3\r\nabc\r\n0\r\nX-Checksum: 42\r\n\r\n", 200, &parseAnomalies{Trailers: http.Header{"X-Checksum": {"42"}}}},
+		{"several", "GET http://%[1]v/several HTTP/1.0\nX-Folded: a\n b\n\n", 200,
+			&parseAnomalies{FoldedHeaders: []string{"X-Folded"}, MissingHost: true, BareLF: true}},
+		// Those net/http refuses are answered 400 and not logged.
+		{"conflicting-lengths", "POST http://%[1]v/conflicting-lengths HTTP/1.1\r\nHost: %[1]v\r\nContent-Length: 3\r\n" +
+			"Content-Length: 4\r\n\r\nabcd", 400, nil},
+		{"missing-host-1.1", "GET http://%[1]v/missing-host-1.1 HTTP/1.1\r\n\r\n", 400, nil},
+		{"space-in-name", "GET http://%[1]v/space-in-name HTTP/1.1\r\nHost: %[1]v\r\nX Bad: 1\r\n\r\n", 400, nil},
+	}
+	for _, tt := range tests {
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		fmt.Fprintf(conn, tt.raw, host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		conn.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%v: got %v, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, tt := range tests {
+		var anomalies sql.NullString
+		err := db.QueryRow("select parse_anomalies from requests where url = ?", "http://"+host+"/"+tt.name).Scan(&anomalies)
+		if tt.status != 200 {
+			if err != sql.ErrNoRows {
+				t.Errorf("%v: a refused request was logged: %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		var got *parseAnomalies
+		if anomalies.Valid {
+			got = &parseAnomalies{}
+			if err := json.Unmarshal([]byte(anomalies.String), got); err != nil {
+				t.Fatalf("%v: %v", tt.name, err)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %+v", tt.name, anomalies.String, tt.want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package stuffpot
+
+import (
+	"context"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queuedEvents counts the events waiting in the logging queue.
+var queuedEvents atomic.Int64
+
+// expiredEvents counts the events dropped once their deadline passed, or when
+// they were given up on at shutdown.
+var expiredEvents atomic.Int64
+
+// logStage times a stage of the logging pipeline.
+type logStage struct {
+	events atomic.Int64
+	nanos  atomic.Int64
+}
+
+func (s *logStage) observe(d time.Duration) {
+	s.events.Add(1)
+	s.nanos.Add(int64(d))
+}
+
+// logStages are the stages of the logging pipeline: queue is the wait for the
+// logging goroutine, prepare the analysis of requests and write the sinks.
+var logStages = map[string]*logStage{"queue": {}, "prepare": {}, "write": {}}
+
+// The shedding levels of the logging pipeline, each dropping more of what's
+// recorded of the requests and tunnels: the bodies and tunnel captures, then
+// the headers and tag details, then everything but the minimal request row.
+// The stats are always counted.
+const (
+	shedNone = iota
+	shedBodies
+	shedHeaders
+	shedMinimal
+)
+
+var shedNames = [...]string{"none", "bodies", "headers", "minimal"}
+
+// shedInterval is how often the pressure on the pipeline is checked, the
+// level moving by one step at most each time.
+const shedInterval = time.Second
+
+var (
+	// shedCurrent is the current shedding level.
+	shedCurrent atomic.Int64
+	// shedEvents counts the events logged with their detail shed, by level,
+	// and those sampled to be logged in full at the minimal level.
+	shedEvents = map[string]*atomic.Int64{"bodies": {}, "headers": {}, "minimal": {}, "sampled": {}}
+)
+
+type shedKey struct{}
+
+// shedLevel returns the shedding level the event of ctx is logged at.
+func shedLevel(ctx context.Context) int {
+	level, _ := ctx.Value(shedKey{}).(int)
+	return level
+}
+
+// shedder decides the shedding level from the depth of the queue and the
+// time the sinks take to write an event. It's only used by the logging
+// goroutine.
+type shedder struct {
+	cfg LimitsConfig
+	// avg is the moving average of the write times.
+	avg     time.Duration
+	level   int
+	checked time.Time
+	// minimal counts the events at the minimal level, one in ShedSample
+	// being logged in full.
+	minimal int
+	log     *slog.Logger
+}
+
+// observe adds the write time of an event to the average.
+func (s *shedder) observe(d time.Duration) {
+	s.avg += (d - s.avg) / 8
+}
+
+// decide returns the level of the next event, given the depth of the queue
+// and its size. The level rises while either threshold is crossed, and falls
+// once both are at half of theirs.
+func (s *shedder) decide(depth, size int) int {
+	if now := time.Now(); now.Sub(s.checked) >= shedInterval {
+		s.checked = now
+		pressure := float64(s.avg) / float64(s.cfg.ShedLatency)
+		if size > 0 {
+			pressure = max(pressure, float64(depth)/(s.cfg.ShedQueue*float64(size)))
+		}
+		switch {
+		case pressure >= 1 && s.level < shedMinimal:
+			s.level++
+			s.log.Warn("Logging pipeline overloaded, shedding detail", "level", shedNames[s.level], "queue", depth,
+				"write_time", s.avg)
+		case pressure < 0.5 && s.level > shedNone:
+			s.level--
+			s.log.Info("Logging pipeline pressure down, restoring detail", "level", shedNames[s.level], "queue", depth,
+				"write_time", s.avg)
+		}
+		shedCurrent.Store(int64(s.level))
+	}
+	level := s.level
+	if level == shedMinimal {
+		if s.minimal++; s.cfg.ShedSample > 0 && s.minimal%s.cfg.ShedSample == 0 {
+			shedEvents["sampled"].Add(1)
+			return shedNone
+		}
+	}
+	if level > shedNone {
+		shedEvents[shedNames[level]].Add(1)
+	}
+	return level
+}
+
+// asyncLogger hands the events to a goroutine which runs prepare and then the
+// sinks, in order, so that requests don't wait on the analysis or the storage.
+// Requests only wait once the queue is full. The requests and tunnels are
+// written to the database in batches, a transaction each.
+//
+// Every event gets a context detached from the request's, which carries its id
+// and expires after deadline. An event still queued then is dropped, and the
+// sinks give up on it. The errors of the sinks are logged by the goroutine, the
+// Log methods only fail once the logger is closed or the event expired.
+type asyncLogger struct {
+	next Logger
+	// prepare is called before LogExchange, for analysis of the exchange
+	// which mustn't delay it.
+	prepare  func(ex *Exchange)
+	deadline time.Duration
+	// batchSize events are written to the database in a single transaction,
+	// those queued within flush of the first one.
+	batchSize int
+	flush     time.Duration
+	// shed is nil unless the detail of the events is shed under pressure.
+	shed *shedder
+	log  *slog.Logger
+	// base is canceled by abandon, which cancels every queued event.
+	base    context.Context
+	abandon context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan queuedEvent
+	done   chan struct{}
+}
+
+// queuedEvent is an event waiting in the queue, named for the logs.
+type queuedEvent struct {
+	ctx context.Context
+	// cancel is called once the event is run or dropped.
+	cancel   func()
+	name     string
+	queuedAt time.Time
+	run      func(ctx context.Context) error
+}
+
+func newAsyncLogger(next Logger, limits LimitsConfig, prepare func(ex *Exchange)) *asyncLogger {
+	base, abandon := context.WithCancel(context.Background())
+	l := &asyncLogger{
+		next:      next,
+		prepare:   prepare,
+		deadline:  limits.LogDeadline,
+		batchSize: limits.LogBatch,
+		flush:     limits.LogFlush,
+		log:       slog.With("component", "logger"),
+		base:      base,
+		abandon:   abandon,
+		queue:     make(chan queuedEvent, limits.LogQueue),
+		done:      make(chan struct{}),
+	}
+	if limits.Shed {
+		l.shed = &shedder{cfg: limits, log: l.log}
+	}
+	go l.run()
+	return l
+}
+
+func (l *asyncLogger) run() {
+	defer close(l.done)
+	var next *queuedEvent
+	for {
+		var ev queuedEvent
+		if next != nil {
+			ev, next = *next, nil
+		} else if e, ok := <-l.queue; ok {
+			ev = e
+		} else {
+			return
+		}
+		b, ok := l.next.(batcher)
+		if !ok || l.batchSize <= 1 || !ev.batched() {
+			l.runEvent(ev, nil)
+			continue
+		}
+		events := l.collect(ev)
+		if last := events[len(events)-1]; len(events) > 1 && !last.batched() {
+			events, next = events[:len(events)-1], &last
+		}
+		err := b.writeBatch(func(in func(ctx context.Context) context.Context) {
+			for _, ev := range events {
+				l.runEvent(ev, in)
+			}
+		})
+		logFailed(l.log, "batch", err)
+	}
+}
+
+// batched tells whether ev is written in batches: the requests and tunnels.
+func (ev *queuedEvent) batched() bool {
+	return ev.name == "exchange" || ev.name == "tunnel"
+}
+
+// collect returns the batch started by ev, adding the events queued until it's
+// full or the flush interval is over. The batch ends with the first event which
+// isn't batched, if any.
+func (l *asyncLogger) collect(ev queuedEvent) []queuedEvent {
+	events := []queuedEvent{ev}
+	flush := time.NewTimer(l.flush)
+	defer flush.Stop()
+	for len(events) < l.batchSize {
+		select {
+		case ev, ok := <-l.queue:
+			if !ok {
+				return events
+			}
+			events = append(events, ev)
+			if !ev.batched() {
+				return events
+			}
+		case <-flush.C:
+			return events
+		}
+	}
+	return events
+}
+
+// runEvent runs ev, with the context in returns for it unless in is nil.
+func (l *asyncLogger) runEvent(ev queuedEvent, in func(ctx context.Context) context.Context) {
+	defer contain(l.log, "logging queue")
+	defer queuedEvents.Add(-1)
+	defer ev.cancel()
+	logStages["queue"].observe(time.Since(ev.queuedAt))
+	key := "request_id"
+	if ev.name == "tunnel" {
+		key = "tunnel_id"
+	}
+	log := l.log.With(key, contextRequestID(ev.ctx))
+	if err := ev.ctx.Err(); err != nil {
+		expiredEvents.Add(1)
+		logFailed(log, ev.name, fmt.Errorf("dropped from the queue: %w", err))
+		return
+	}
+	ctx := ev.ctx
+	if l.shed != nil && ev.batched() {
+		ctx = context.WithValue(ctx, shedKey{}, l.shed.decide(len(l.queue), cap(l.queue)))
+	}
+	if in != nil {
+		ctx = in(ctx)
+	}
+	logFailed(log, ev.name, ev.run(ctx))
+}
+
+// enqueue queues run with the context of the event named name, for the
+// request or tunnel id. It waits for room in the queue until the event's
+// deadline. done, if not nil, is called once the event is run or dropped.
+func (l *asyncLogger) enqueue(ctx context.Context, name, id string, run func(ctx context.Context) error, done func()) error {
+	if done == nil {
+		done = func() {}
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		done()
+		return errLoggerClosed
+	}
+	ctx = context.WithoutCancel(ctx)
+	var cancel context.CancelFunc
+	if l.deadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, l.deadline)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	stop := context.AfterFunc(l.base, cancel)
+	ev := queuedEvent{withRequestID(ctx, id), func() { stop(); cancel(); done() }, name, time.Now(), run}
+
+	queuedEvents.Add(1)
+	select {
+	case l.queue <- ev:
+		return nil
+	case <-ctx.Done():
+		queuedEvents.Add(-1)
+		expiredEvents.Add(1)
+		ev.cancel()
+		return fmt.Errorf("logging queue full: %w", ctx.Err())
+	}
+}
+
+// call runs f on the goroutine of the queue, like the events, and waits for
+// its result. It mustn't be called from that goroutine.
+func (l *asyncLogger) call(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	err := fmt.Errorf("%v dropped from the logging queue", name)
+	done := make(chan struct{})
+	if qerr := l.enqueue(ctx, name, "", func(ctx context.Context) error {
+		err = f(ctx)
+		return err
+	}, func() { close(done) }); qerr != nil {
+		return qerr
+	}
+	<-done
+	return err
+}
+
+// write times the sinks.
+func (l *asyncLogger) write(f func() error) error {
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		logStages["write"].observe(d)
+		if l.shed != nil {
+			l.shed.observe(d)
+		}
+	}()
+	return f()
+}
+
+func (l *asyncLogger) LogExchange(ctx context.Context, ex *Exchange) error {
+	return l.enqueue(ctx, "exchange", ex.ID, func(ctx context.Context) error {
+		if l.prepare != nil {
+			start := time.Now()
+			l.prepare(ex)
+			logStages["prepare"].observe(time.Since(start))
+		}
+		return l.write(func() error { return l.next.LogExchange(ctx, ex) })
+	}, nil)
+}
+
+func (l *asyncLogger) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	tc.retain()
+	return l.enqueue(ctx, "tunnel", requestID(pctx), func(ctx context.Context) error {
+		return l.write(func() error { return l.next.LogTunnel(ctx, req, tc, smtp, pctx) })
+	}, tc.release)
+}
+
+func (l *asyncLogger) Reopen() error {
+	if r, ok := l.next.(reopener); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// Close logs the queued events, then closes the sinks.
+func (l *asyncLogger) Close() error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mu.Unlock()
+
+	<-l.done
+	return l.next.Close()
+}
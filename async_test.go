@@ -0,0 +1,255 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEnqueueRacingClose(t *testing.T) {
+	for _, queue := range []int{1, 16, 1024} {
+		t.Run(fmt.Sprintf("queue %d", queue), func(t *testing.T) {
+			l := newAsyncLogger(&recordingLogger{}, LimitsConfig{LogQueue: queue}, nil)
+			const goroutines, events = 32, 200
+			var accepted, rejected, ran, done atomic.Int64
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					for i := 0; i < events; i++ {
+						err := l.enqueue(context.Background(), "event", "", func(ctx context.Context) error {
+							ran.Add(1)
+							return nil
+						}, func() { done.Add(1) })
+						switch {
+						case err == nil:
+							accepted.Add(1)
+						case errors.Is(err, errLoggerClosed):
+							rejected.Add(1)
+						default:
+							t.Errorf("enqueue: %v", err)
+						}
+					}
+				}()
+			}
+			close(start)
+			time.Sleep(time.Millisecond)
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+
+			if accepted.Load()+rejected.Load() != goroutines*events {
+				t.Errorf("%d accepted and %d rejected of %d", accepted.Load(), rejected.Load(), goroutines*events)
+			}
+			if ran.Load() != accepted.Load() {
+				t.Errorf("ran %d of the %d events accepted", ran.Load(), accepted.Load())
+			}
+			if done.Load() != goroutines*events {
+				t.Errorf("done was called for %d of %d events", done.Load(), goroutines*events)
+			}
+		})
+	}
+}
+
+func TestLogExchangeRacingClose(t *testing.T) {
+	rec := &recordingLogger{}
+	l := newAsyncLogger(rec, LimitsConfig{LogQueue: 8}, nil)
+	const goroutines, events = 16, 100
+	var accepted, dropped atomic.Int64
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < events; i++ {
+				ex := &Exchange{ID: fmt.Sprintf("%d-%d", g, i), Request: httptest.NewRequest("GET", "http://example.com/", nil)}
+				if err := l.LogExchange(context.Background(), ex); err != nil {
+					dropped.Add(1)
+				} else {
+					accepted.Add(1)
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	logged := rec.logged()
+	if int64(len(logged)) != accepted.Load() || accepted.Load()+dropped.Load() != goroutines*events {
+		t.Errorf("%d exchanges persisted, %d accepted and %d dropped of %d", len(logged), accepted.Load(),
+			dropped.Load(), goroutines*events)
+	}
+	seen := make(map[string]bool)
+	for _, ex := range logged {
+		if seen[ex.ID] {
+			t.Errorf("exchange %v persisted twice", ex.ID)
+		}
+		seen[ex.ID] = true
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if !rec.closed {
+		t.Error("the sink wasn't closed")
+	}
+}
+
+// TestDatabaseLoggerRacingClose has the exchanges of many requests logged to
+// a database as Close is called, every one accepted having its rows.
+func TestDatabaseLoggerRacingClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.db")
+	db, err := NewLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := testConfig(t).Load().Limits
+	limits.LogQueue = 256
+	panicked := panics.Load()
+	l := newAsyncLogger(db, limits, nil)
+	const goroutines, events = 32, 100
+	var accepted, rejected atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < events; i++ {
+				req := httptest.NewRequest("POST", fmt.Sprintf("http://a.example/wp-login.php?i=%d", i), nil)
+				req.RemoteAddr = fmt.Sprintf("192.0.2.%d:40000", g+1)
+				state := &requestState{id: fmt.Sprintf("%d-%d", g, i), start: time.Now()}
+				state.exchange = newExchange(req, state)
+				ex := state.finish(&http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{}}, 5, nil)
+				switch err := l.LogExchange(context.Background(), ex); {
+				case err == nil:
+					accepted.Add(1)
+				case errors.Is(err, errLoggerClosed):
+					rejected.Add(1)
+				default:
+					t.Errorf("LogExchange: %v", err)
+				}
+			}
+		}()
+	}
+	close(start)
+	time.Sleep(20 * time.Millisecond)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if accepted.Load()+rejected.Load() != goroutines*events {
+		t.Fatalf("%d accepted and %d rejected of %d", accepted.Load(), rejected.Load(), goroutines*events)
+	}
+	if accepted.Load() == 0 || rejected.Load() == 0 {
+		t.Logf("%d accepted and %d rejected, Close didn't race the requests", accepted.Load(), rejected.Load())
+	}
+	if n := panics.Load() - panicked; n != 0 {
+		t.Errorf("%d panics were recovered", n)
+	}
+	check, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer check.Close()
+	for _, table := range []string{"requests", "responses"} {
+		var n int64
+		if err := check.QueryRow("select count(*) from " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != accepted.Load() {
+			t.Errorf("%v has %d rows, want the %d exchanges accepted", table, n, accepted.Load())
+		}
+	}
+}
+
+func TestShedderLevels(t *testing.T) {
+	s := &shedder{cfg: LimitsConfig{ShedQueue: 0.5, ShedLatency: 100 * time.Millisecond, ShedSample: 3},
+		log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	// The level moves by one per interval.
+	if level := s.decide(8, 10); level != shedBodies {
+		t.Fatalf("a queue over its threshold: got level %v, want bodies", shedNames[level])
+	}
+	if level := s.decide(8, 10); level != shedBodies {
+		t.Errorf("within the interval: got level %v, want bodies", shedNames[level])
+	}
+	for i := 0; i < 20; i++ {
+		s.observe(time.Second)
+	}
+	s.checked = time.Time{}
+	if level := s.decide(0, 10); level != shedHeaders {
+		t.Fatalf("slow writes: got level %v, want headers", shedNames[level])
+	}
+	s.checked = time.Time{}
+	levels := []int{s.decide(0, 10), s.decide(0, 10), s.decide(0, 10)}
+	if !reflect.DeepEqual(levels, []int{shedMinimal, shedMinimal, shedNone}) {
+		t.Errorf("at the minimal level: got levels %v, want one in 3 logged in full", levels)
+	}
+	if shedCurrent.Load() != shedMinimal {
+		t.Errorf("got the level %v exported, want minimal", shedCurrent.Load())
+	}
+
+	// It falls back once both are under half their threshold.
+	s.checked = time.Time{}
+	if level := s.decide(2, 10); level != shedMinimal {
+		t.Errorf("still slow writes: got level %v, want minimal", shedNames[level])
+	}
+	for i := 0; i < 100; i++ {
+		s.observe(0)
+	}
+	s.checked = time.Time{}
+	if level := s.decide(2, 10); level != shedHeaders {
+		t.Errorf("under half the thresholds: got level %v, want headers", shedNames[level])
+	}
+}
+
+func TestShedDetailIsLeftOutOfTheRow(t *testing.T) {
+	logger := testLogger(t)
+	for i, level := range []int{shedNone, shedBodies, shedHeaders, shedMinimal} {
+		req := httptest.NewRequest("POST", "http://a.example/login", nil)
+		req.Header.Set("User-Agent", "curl/8.0")
+		state := &requestState{id: fmt.Sprintf("r%d", i), start: time.Now()}
+		state.exchange = newExchange(req, state)
+		ex := state.finish(&http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{"Server": {"x"}}}, 5,
+			nil)
+		if err := logger.LogExchange(context.WithValue(context.Background(), shedKey{}, level), ex); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The request row, its headers, the response row and its headers.
+	want := [][]string{
+		{"r0", "1", "1", "1"},
+		{"r1", "1", "1", "1"},
+		{"r2", "0", "1", "0"},
+		{"r3", "0", "0", "0"},
+	}
+	got := queryRows(t, logger.db, `select requests.request_id, requests.headers is not null,
+	  responses.request_id is not null, responses.headers is not null
+	  from requests left join responses using (request_id) order by requests.request_id`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := queryRows(t, logger.db, "select requests from client_stats"); !reflect.DeepEqual(got,
+		[][]string{{"4"}}) {
+		t.Errorf("got the requests counted %v, want all of them", got)
+	}
+}
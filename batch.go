@@ -0,0 +1,118 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// batcher is implemented by the sinks writing the events of a batch in a
+// single transaction. writeBatch runs f, which logs the events of the batch,
+// each with the context in returns for it.
+type batcher interface {
+	writeBatch(f func(in func(ctx context.Context) context.Context)) error
+}
+
+type batchKey struct{}
+
+// batch is the transaction of a batch, by the logger writing it.
+type batch struct {
+	logger *HttpLogger
+	tx     *sql.Tx
+}
+
+// writeBatch writes the events of f in a single transaction, holding the
+// lock of the logger meanwhile. Each event is a savepoint of it, which the
+// event rolls back on failure without the others.
+func (logger *HttpLogger) writeBatch(f func(in func(ctx context.Context) context.Context)) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	tx, err := logger.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	b := &batch{logger, tx}
+	f(func(ctx context.Context) context.Context { return context.WithValue(ctx, batchKey{}, b) })
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit batch: %w", err)
+	}
+	return nil
+}
+
+// eventTx is the transaction of an event, its own or a savepoint of the batch
+// it's part of.
+type eventTx struct {
+	logger  *HttpLogger
+	tx      *sql.Tx
+	batched bool
+	done    bool
+}
+
+// begin starts the transaction of an event, taking the lock of the logger
+// unless the event is part of a batch it writes, which holds it. end must be
+// called once the event is written.
+func (logger *HttpLogger) begin(ctx context.Context) (*sql.Tx, *eventTx, error) {
+	if b, ok := ctx.Value(batchKey{}).(*batch); ok && b.logger == logger {
+		if _, err := b.tx.Exec("savepoint event"); err != nil {
+			return nil, nil, err
+		}
+		return b.tx, &eventTx{logger: logger, tx: b.tx, batched: true}, nil
+	}
+	logger.mu.Lock()
+	tx, err := logger.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.mu.Unlock()
+		return nil, nil, err
+	}
+	return tx, &eventTx{logger: logger, tx: tx}, nil
+}
+
+// commit commits the event.
+func (ev *eventTx) commit() error {
+	ev.done = true
+	if ev.batched {
+		_, err := ev.tx.Exec("release event")
+		return err
+	}
+	return ev.tx.Commit()
+}
+
+// end rolls the event back unless it was committed, and releases the lock
+// taken by begin.
+func (ev *eventTx) end() {
+	switch {
+	case !ev.batched:
+		if !ev.done {
+			ev.tx.Rollback()
+		}
+		ev.logger.mu.Unlock()
+	case !ev.done:
+		ev.tx.Exec("rollback to event")
+		ev.tx.Exec("release event")
+	}
+}
+
+// writeBatch writes the batch with the logger of the current day. The events
+// logged once the day is over are written on their own.
+func (r *RollingLogger) writeBatch(f func(in func(ctx context.Context) context.Context)) error {
+	l, err := r.current()
+	if err != nil {
+		f(func(ctx context.Context) context.Context { return ctx })
+		return nil
+	}
+	return l.writeBatch(f)
+}
+
+// writeBatch writes the batch in the transaction of the first logger which
+// batches, the others writing each event as usual.
+func (m multiLogger) writeBatch(f func(in func(ctx context.Context) context.Context)) error {
+	for _, l := range m {
+		if b, ok := l.(batcher); ok {
+			return b.writeBatch(f)
+		}
+	}
+	f(func(ctx context.Context) context.Context { return ctx })
+	return nil
+}
@@ -0,0 +1,94 @@
+package stuffpot
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testBatchKey struct{}
+
+// batchingLogger records the ids of the exchanges of each batch it writes.
+type batchingLogger struct {
+	recordingLogger
+	batches [][]string
+}
+
+func (l *batchingLogger) writeBatch(f func(in func(ctx context.Context) context.Context)) error {
+	var ids []string
+	f(func(ctx context.Context) context.Context { return context.WithValue(ctx, testBatchKey{}, &ids) })
+	l.batches = append(l.batches, ids)
+	return nil
+}
+
+func (l *batchingLogger) LogExchange(ctx context.Context, ex *Exchange) error {
+	if ids, ok := ctx.Value(testBatchKey{}).(*[]string); ok {
+		*ids = append(*ids, ex.ID)
+	}
+	return l.recordingLogger.LogExchange(ctx, ex)
+}
+
+func TestExchangesAreWrittenInBatches(t *testing.T) {
+	sink := &batchingLogger{}
+	limits := testConfig(t).Load().Limits
+	limits.LogBatch, limits.LogFlush = 2, time.Second
+	l := newAsyncLogger(sink, limits, nil)
+	logExchange := func(id string) {
+		ex := &Exchange{ID: id, Request: httptest.NewRequest("GET", "http://example.com/", nil)}
+		if err := l.LogExchange(context.Background(), ex); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		logExchange(fmt.Sprintf("e%d", i))
+	}
+	// Other work ends the batch, and runs on its own.
+	err := l.enqueue(context.Background(), "admin call", "", func(context.Context) error {
+		sink.batches = append(sink.batches, []string{"admin call"})
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logExchange("e3")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"e0", "e1"}, {"e2"}, {"admin call"}, {"e3"}}
+	if !reflect.DeepEqual(sink.batches, want) {
+		t.Errorf("got the batches %v, want %v", sink.batches, want)
+	}
+}
+
+func TestBatchedEventsRollBackAlone(t *testing.T) {
+	logger := testLogger(t)
+	err := logger.writeBatch(func(in func(ctx context.Context) context.Context) {
+		for i := 0; i < 3; i++ {
+			tx, ev, err := logger.begin(in(context.Background()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Exec("insert into metadata (key, value) values (?, 'x')", fmt.Sprintf("event-%d", i)); err != nil {
+				t.Fatal(err)
+			}
+			// The second event fails after its write.
+			if i != 1 {
+				if err := ev.commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ev.end()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := queryRows(t, logger.db, "select key from metadata where key like 'event-%' order by key")
+	if want := [][]string{{"event-0"}, {"event-2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the events which didn't fail", got)
+	}
+}
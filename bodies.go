@@ -0,0 +1,70 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// capturedBody is a request or response body stored in the bodies table,
+// decoded when it had a Content-Encoding we undo.
+type capturedBody struct {
+	// Location is request or response.
+	Location    string
+	ContentType string
+	// Encoding is the Content-Encoding left on Data, empty when it was
+	// decoded or there was none.
+	Encoding string
+	// Size is the size of the body as sent, and Truncated set when Data is
+	// only the start of it.
+	Size      int64
+	Truncated bool
+	Data      []byte
+	// Raw is the start of the body as sent, before it was decoded.
+	Raw []byte
+}
+
+// newCapturedBody returns the body read of location, of which the first bytes
+// b of the n read were kept, its decoded form truncated to limit.
+func newCapturedBody(b []byte, n, limit int64, header http.Header, location string) *capturedBody {
+	c := &capturedBody{Location: location, Size: n, Encoding: header.Get("Content-Encoding"),
+		Raw: b[:min(int64(len(b)), limit)]}
+	if t, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		c.ContentType = t
+	}
+	data, decoded := decodeEncoding(b, c.Encoding, limit+1)
+	if decoded {
+		c.Encoding = ""
+	}
+	c.Truncated = n > int64(len(b)) || int64(len(data)) > limit
+	c.Data = data[:min(int64(len(data)), limit)]
+	return c
+}
+
+// addCapture keeps a body for the bodies table, unless the exchange has been
+// analyzed already.
+func (state *requestState) addCapture(c *capturedBody) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if !state.scanned {
+		state.captured = append(state.captured, c)
+	}
+}
+
+// logBodies stores the bodies of ex read by the time it's logged.
+func (logger *HttpLogger) logBodies(tx *sql.Tx, ex *Exchange, at string) error {
+	ex.state.mu.Lock()
+	captured := ex.state.captured
+	ex.state.mu.Unlock()
+
+	stmt := tx.Stmt(logger.insertBody)
+	for _, c := range captured {
+		_, err := stmt.Exec(ex.ID, c.Location, c.ContentType, c.Encoding, c.Size, c.Truncated, c.Data, at)
+		if err != nil {
+			return fmt.Errorf("insert body: %w", err)
+		}
+	}
+	return nil
+}
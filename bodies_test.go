@@ -0,0 +1,94 @@
+package stuffpot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for s, want := range map[string]ByteSize{"1048576": 1 << 20, "512KB": 512 << 10, "1MB": 1 << 20, "2 gb": 2 << 30,
+		"64KiB": 64 << 10, "0": 0} {
+		if got, err := parseByteSize(s); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "MB", "1TB", "1.5MB", "9999999999GB"} {
+		if got, err := parseByteSize(s); err == nil {
+			t.Errorf("%q: got %v, want an error", s, got)
+		}
+	}
+}
+
+func TestNewCapturedBody(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("hello, compressed world"))
+	zw.Close()
+
+	header := http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "Content-Encoding": {"gzip"}}
+	c := newCapturedBody(gz.Bytes(), int64(gz.Len()), 5, header, "response")
+	if string(c.Data) != "hello" || !c.Truncated || c.Encoding != "" || c.ContentType != "text/plain" ||
+		c.Size != int64(gz.Len()) {
+		t.Errorf("a gzipped body over the limit: got %+v", c)
+	}
+	c = newCapturedBody(gz.Bytes(), int64(gz.Len()), 1024, header, "response")
+	if string(c.Data) != "hello, compressed world" || c.Truncated {
+		t.Errorf("a gzipped body within the limit: got %+v", c)
+	}
+
+	// Encodings which aren't undone are kept, along with the body as sent.
+	c = newCapturedBody([]byte("abc"), 3, 1024, http.Header{"Content-Encoding": {"br"}}, "request")
+	if string(c.Data) != "abc" || c.Encoding != "br" || c.Truncated {
+		t.Errorf("a br body: got %+v", c)
+	}
+	// Only the start of the bodies past the scan limit is read.
+	c = newCapturedBody([]byte("abc"), 10, 1024, http.Header{}, "request")
+	if string(c.Data) != "abc" || !c.Truncated || c.Size != 10 {
+		t.Errorf("a body read in part: got %+v", c)
+	}
+}
+
+func TestBodiesAreStored(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>" + strings.Repeat("x", 100) + "</html>"))
+	}))
+	defer upstream.Close()
+
+	config := testConfig(t, "-max-body-size", "16")
+	s, client := startServer(t, config, nil)
+	resp, err := client.Post(upstream.URL+"/login", "application/x-www-form-urlencoded",
+		strings.NewReader("user=admin&pass=hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{
+		{"request", "application/x-www-form-urlencoded", "23", "1", "user=admin&pass="},
+		{"response", "text/html", "113", "1", "<html>xxxxxxxxxx"},
+	}
+	got := queryRows(t, db, `select location, content_type, size, truncated, cast(data as text) from bodies
+	  order by location`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got bodies %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,248 @@
+package stuffpot
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// maxLoginBody bounds the body read to find the credentials of a login.
+	maxLoginBody = 64 << 10
+	// maxTrackedAttempts bounds the attempts remembered per client before a
+	// session starts.
+	maxTrackedAttempts = 1024
+)
+
+var (
+	passwordField = regexp.MustCompile(`(?i)pass|pwd|secret`)
+	usernameField = regexp.MustCompile(`(?i)user|login|email|account|^log$|^name$`)
+)
+
+// loginAttempt is a POST which looks like a login, its credentials hashed to
+// tell them apart. Those stored are the credentials table's.
+type loginAttempt struct {
+	user        uint64
+	credentials uint64
+}
+
+// readLogin tells whether req, whose form or JSON fields are form, is a login
+// attempt.
+func readLogin(req *http.Request, cfg *Config, form map[string]string) *loginAttempt {
+	if req.Method != http.MethodPost || cfg.Bruteforce.Attempts == 0 {
+		return nil
+	}
+	byPath := cfg.loginPath.MatchString(req.URL.Path)
+
+	user, password, found := loginFields(form)
+	if !byPath && !found {
+		return nil
+	}
+	attempt := &loginAttempt{}
+	if found {
+		h := fnv.New64a()
+		h.Write([]byte(user))
+		attempt.user = h.Sum64()
+		h.Write([]byte{0})
+		h.Write([]byte(password))
+		attempt.credentials = h.Sum64()
+	}
+	return attempt
+}
+
+// readForm returns the fields of the form or JSON body of a POST, read and
+// put back for the proxy.
+func readForm(req *http.Request) map[string]string {
+	if req.Method != http.MethodPost || req.Body == nil {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "application/json" {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxLoginBody))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+	if err != nil {
+		return nil
+	}
+	return formFields(mediaType, data)
+}
+
+// loginFields returns the username and password of the fields of a login
+// form, found being set when there's a password field.
+func loginFields(form map[string]string) (user, password string, found bool) {
+	for name, v := range form {
+		switch {
+		case passwordField.MatchString(name):
+			password, found = v, true
+		case usernameField.MatchString(name):
+			user = v
+		}
+	}
+	return user, password, found
+}
+
+// formFields returns the string fields of a form or a JSON object.
+func formFields(mediaType string, data []byte) map[string]string {
+	fields := make(map[string]string)
+	if mediaType == "application/json" {
+		var obj map[string]interface{}
+		if json.Unmarshal(data, &obj) != nil {
+			return nil
+		}
+		for k, v := range obj {
+			if s, ok := v.(string); ok {
+				fields[k] = s
+			}
+		}
+		return fields
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil && len(values) == 0 {
+		return nil
+	}
+	for k, v := range values {
+		fields[k] = v[0]
+	}
+	return fields
+}
+
+// bruteSession is a client found brute forcing, from the attempt which
+// reached the thresholds until it stays idle for the window. Attempts and
+// Usernames include the attempts which led to it.
+type bruteSession struct {
+	ID        string
+	Tag       string
+	ClientIP  string
+	Started   time.Time
+	Updated   time.Time
+	Attempts  int
+	Usernames int
+}
+
+type bruteClient struct {
+	// attempts are the ones within the window, before a session starts.
+	attempts []bruteAttempt
+	session  *bruteSession
+	users    map[uint64]bool
+}
+
+type bruteAttempt struct {
+	at time.Time
+	loginAttempt
+}
+
+// bruteTracker counts the login attempts of each client as they're logged.
+type bruteTracker struct {
+	config *ConfigStore
+	// detected is called when a session starts.
+	detected func(bruteSession)
+
+	mu        sync.Mutex
+	clients   map[string]*bruteClient
+	lastSweep time.Time
+}
+
+func newBruteTracker(config *ConfigStore, detected func(bruteSession)) *bruteTracker {
+	return &bruteTracker{config: config, detected: detected, clients: make(map[string]*bruteClient)}
+}
+
+// observe records a request from ip at t, attempt being nil unless it's a
+// login attempt. It returns a copy of the session of the client, if any.
+func (b *bruteTracker) observe(ip string, attempt *loginAttempt, t time.Time) *bruteSession {
+	cfg := b.config.Load().Bruteforce
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if t.Sub(b.lastSweep) > cfg.Window {
+		b.sweep(t, cfg.Window)
+	}
+	c := b.clients[ip]
+	if c != nil && c.session != nil && t.Sub(c.session.Updated) > cfg.Window {
+		c.session = nil
+	}
+	if attempt == nil {
+		if c == nil || c.session == nil {
+			return nil
+		}
+		s := *c.session
+		return &s
+	}
+
+	if c == nil {
+		c = &bruteClient{}
+		b.clients[ip] = c
+	}
+	if c.session != nil {
+		c.session.Attempts++
+		c.session.Updated = t
+		if attempt.user != 0 && !c.users[attempt.user] {
+			c.users[attempt.user] = true
+			c.session.Usernames++
+		}
+		s := *c.session
+		return &s
+	}
+
+	c.attempts = append(c.attempts, bruteAttempt{t, *attempt})
+	for len(c.attempts) > 0 && (t.Sub(c.attempts[0].at) > cfg.Window || len(c.attempts) > maxTrackedAttempts) {
+		c.attempts = c.attempts[1:]
+	}
+	if len(c.attempts) < cfg.Attempts {
+		return nil
+	}
+	users := make(map[uint64]bool)
+	credentials := make(map[uint64]bool)
+	for _, a := range c.attempts {
+		if a.user != 0 {
+			users[a.user] = true
+			credentials[a.credentials] = true
+		}
+	}
+	if len(credentials) < cfg.Credentials {
+		return nil
+	}
+
+	c.session = &bruteSession{
+		ID:        newID(),
+		Tag:       "bruteforce",
+		ClientIP:  ip,
+		Started:   c.attempts[0].at,
+		Updated:   t,
+		Attempts:  len(c.attempts),
+		Usernames: len(users),
+	}
+	c.users = users
+	c.attempts = nil
+	s := *c.session
+	if b.detected != nil {
+		b.detected(s)
+	}
+	return &s
+}
+
+// sweep forgets the clients without attempts or session within the window.
+// It must be called with mu held.
+func (b *bruteTracker) sweep(t time.Time, window time.Duration) {
+	b.lastSweep = t
+	for ip, c := range b.clients {
+		if c.session != nil && t.Sub(c.session.Updated) <= window {
+			continue
+		}
+		if len(c.attempts) > 0 && t.Sub(c.attempts[len(c.attempts)-1].at) <= window {
+			continue
+		}
+		delete(b.clients, ip)
+	}
+}
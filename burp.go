@@ -0,0 +1,224 @@
+package stuffpot
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// burpItems is a file of items as Burp Suite saves them from its proxy
+// history, for Burp and the tools reading its exports to load.
+type burpItems struct {
+	XMLName    xml.Name   `xml:"items"`
+	ExportTime string     `xml:"exportTime,attr"`
+	Items      []burpItem `xml:"item"`
+}
+
+type burpItem struct {
+	Time      string      `xml:"time"`
+	URL       burpText    `xml:"url"`
+	Host      burpHost    `xml:"host"`
+	Port      string      `xml:"port"`
+	Protocol  string      `xml:"protocol"`
+	Method    burpText    `xml:"method"`
+	Path      burpText    `xml:"path"`
+	Extension string      `xml:"extension"`
+	Request   burpMessage `xml:"request"`
+	// Status and ResponseLength are empty without a response.
+	Status         string      `xml:"status"`
+	ResponseLength string      `xml:"responselength"`
+	MimeType       string      `xml:"mimetype"`
+	Response       burpMessage `xml:"response"`
+	Comment        string      `xml:"comment"`
+}
+
+type burpText struct {
+	Text string `xml:",cdata"`
+}
+
+type burpHost struct {
+	IP   string `xml:"ip,attr"`
+	Name string `xml:",chardata"`
+}
+
+type burpMessage struct {
+	Base64 bool   `xml:"base64,attr"`
+	Data   string `xml:",cdata"`
+}
+
+// burpTime is the layout of the item times, that of Java's dates.
+const burpTime = "Mon Jan 02 15:04:05 MST 2006"
+
+// burpMimeType returns the MIME type Burp shows for contentType.
+func burpMimeType(contentType string) string {
+	t := strings.ToLower(contentType)
+	switch {
+	case strings.Contains(t, "html"):
+		return "HTML"
+	case strings.Contains(t, "json"):
+		return "JSON"
+	case strings.Contains(t, "xml"):
+		return "XML"
+	case strings.Contains(t, "javascript"):
+		return "script"
+	case strings.Contains(t, "css"):
+		return "CSS"
+	case strings.HasPrefix(t, "image/"):
+		sub, _, _ := strings.Cut(strings.TrimPrefix(t, "image/"), ";")
+		return strings.ToUpper(sub)
+	case strings.HasPrefix(t, "text/"):
+		return "text"
+	}
+	return ""
+}
+
+// burpMessages returns the request and the response of d as they were sent,
+// read from rawDir when they're stored there, or else rebuilt from what was
+// logged: the headers, in the order the request sent them, and the bodies as
+// far as they were stored. The response is nil when there's none.
+func burpMessages(d *requestDetail, rawDir string) ([]byte, []byte) {
+	bodies := make(map[string][]byte)
+	for _, b := range d.Bodies {
+		bodies[b.Location] = b.Data
+	}
+	message := func(sha, start string, headers []harHeader, body []byte) []byte {
+		if rawDir != "" && sha != "" {
+			if b, err := readRaw(rawDir, sha); err == nil {
+				return b
+			}
+		}
+		var b bytes.Buffer
+		b.WriteString(start + "\r\n")
+		for _, h := range headers {
+			fmt.Fprintf(&b, "%v: %v\r\n", h.Name, h.Value)
+		}
+		b.WriteString("\r\n")
+		b.Write(body)
+		return b.Bytes()
+	}
+
+	target := d.URL
+	if u, err := url.Parse(d.URL); err == nil {
+		target = u.RequestURI()
+	}
+	req := message(d.RawRequest, d.Method+" "+target+" HTTP/1.1", requestHeaders(d), bodies["request"])
+	resp := d.Response
+	if resp == nil {
+		return req, nil
+	}
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	status := fmt.Sprintf("%v %d %v", proto, resp.Status, http.StatusText(resp.Status))
+	return req, message(d.RawResponse, status, harHeaders(resp.Headers), bodies["response"])
+}
+
+// burpExportItem converts a request and its response into a Burp item, commented
+// with its id, client and tags.
+func burpExportItem(d *requestDetail, rawDir string) burpItem {
+	it := burpItem{URL: burpText{d.URL}, Method: burpText{d.Method}, Extension: "null",
+		Comment: fmt.Sprintf("stuffpot %v from %v", d.RequestID, d.Client)}
+	if len(d.Tags) > 0 {
+		it.Comment += ", tags " + strings.Join(d.Tags, ",")
+	}
+	if t, err := time.Parse(time.DateTime, d.CreatedAt); err == nil {
+		it.Time = t.UTC().Format(burpTime)
+	}
+	if u, err := url.Parse(d.URL); err == nil {
+		it.Host.Name, it.Port, it.Protocol = u.Hostname(), u.Port(), u.Scheme
+		it.Path.Text = u.RequestURI()
+		if it.Port == "" {
+			it.Port = "80"
+			if u.Scheme == "https" {
+				it.Port = "443"
+			}
+		}
+		if ext := strings.TrimPrefix(path.Ext(u.Path), "."); ext != "" {
+			it.Extension = ext
+		}
+	}
+
+	req, resp := burpMessages(d, rawDir)
+	it.Request = burpMessage{Base64: true, Data: base64.StdEncoding.EncodeToString(req)}
+	if resp != nil {
+		it.Status, it.ResponseLength = fmt.Sprint(d.Response.Status), fmt.Sprint(len(resp))
+		it.Response = burpMessage{Base64: true, Data: base64.StdEncoding.EncodeToString(resp)}
+		for _, h := range harHeaders(d.Response.Headers) {
+			if strings.EqualFold(h.Name, "content-type") {
+				it.MimeType = burpMimeType(h.Value)
+			}
+		}
+	}
+	return it
+}
+
+// writeBurpItems writes items as an XML file.
+func writeBurpItems(w io.Writer, items []burpItem) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(burpItems{ExportTime: time.Now().UTC().Format(burpTime), Items: items}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// burpExportCommand implements the burp export:
+//
+//	stuffpot export burp [-db path] [-raw-dir dir] [-o file] [filters] [request_id...]
+//
+// It writes the selected requests as a Burp items file.
+func burpExportCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot export burp", flag.ExitOnError)
+	var sel requestSelection
+	sel.addFlags(fs, cfg)
+	rawDir := fs.String("raw-dir", cfg.Storage.RawDir, "Directory the raw requests and responses are read from, if stored")
+	out := fs.String("o", "", "File the items are written to, instead of the standard output")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stuffpot export burp [-db path] [-raw-dir dir] [-o file] [-client ip] [-host host] "+
+			"[-tag tag] [-session id] [-since time] [-until time] [-limit n] [request_id...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := sel.parse(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var items []burpItem
+	err := sel.each(context.Background(), func(d *requestDetail) error {
+		items = append(items, burpExportItem(d, *rawDir))
+		return nil
+	})
+	if err == nil {
+		err = writeExport(*out, func(w io.Writer) error { return writeBurpItems(w, items) })
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *out != "" {
+		fmt.Printf("%d requests exported to %v\n", len(items), *out)
+	}
+}
@@ -0,0 +1,167 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBurpMimeType(t *testing.T) {
+	for contentType, want := range map[string]string{
+		"text/html; charset=utf-8": "HTML", "application/json": "JSON", "application/xml": "XML",
+		"application/javascript": "script", "text/css": "CSS", "image/png": "PNG", "image/svg+xml": "XML",
+		"text/plain": "text", "application/octet-stream": "",
+	} {
+		if got := burpMimeType(contentType); got != want {
+			t.Errorf("burpMimeType(%q): got %q, want %q", contentType, got, want)
+		}
+	}
+}
+
+func TestBurpExportItem(t *testing.T) {
+	d := &requestDetail{
+		listedRequest: listedRequest{RequestID: "r1", Client: "192.0.2.1", Method: "POST", Host: "a.example",
+			URL: "https://a.example/wp-login.php?x=1", Tags: []string{"login", "wordpress"},
+			CreatedAt: "2024-06-01 10:00:00"},
+		Headers:     "Content-Type: text/plain\r\nUser-Agent: curl/8.0\r\n",
+		HeaderOrder: "User-Agent,Host,Content-Type",
+		Response:    &detailResponse{Status: 200, Headers: "Content-Type: text/html\r\n", Size: 2},
+		Bodies: []detailBody{{Location: "request", Data: []byte("log=admin")},
+			{Location: "response", Data: []byte("ok")}},
+		// Without the raw directory, the messages are rebuilt.
+		RawRequest: strings.Repeat("0", 64),
+	}
+	it := burpExportItem(d, "")
+	if it.Time != "Sat Jun 01 10:00:00 UTC 2024" || it.Host.Name != "a.example" || it.Port != "443" ||
+		it.Protocol != "https" || it.Path.Text != "/wp-login.php?x=1" || it.Extension != "php" || it.Status != "200" ||
+		it.MimeType != "HTML" || it.Comment != "stuffpot r1 from 192.0.2.1, tags login,wordpress" {
+		t.Errorf("got the item %+v", it)
+	}
+	decode := func(m burpMessage) string {
+		t.Helper()
+		b, err := base64.StdEncoding.DecodeString(m.Data)
+		if err != nil || !m.Base64 {
+			t.Fatalf("got the message %+v, %v", m, err)
+		}
+		return string(b)
+	}
+	if got, want := decode(it.Request), "POST /wp-login.php?x=1 HTTP/1.1\r\nUser-Agent: curl/8.0\r\nHost: a.example\r\n"+
+		"Content-Type: text/plain\r\n\r\nlog=admin"; got != want {
+		t.Errorf("got the request %q, want %q", got, want)
+	}
+	resp := decode(it.Response)
+	if want := "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\nok"; resp != want {
+		t.Errorf("got the response %q, want %q", resp, want)
+	}
+	if it.ResponseLength != strconv.Itoa(len(resp)) {
+		t.Errorf("got the response length %v, want that of the response", it.ResponseLength)
+	}
+
+	d.Response = nil
+	if it := burpExportItem(d, ""); it.Status != "" || it.Response.Data != "" {
+		t.Errorf("got the item %+v of a request without a response", it)
+	}
+}
+
+func TestBurpExportAndRequestSelection(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	}))
+	defer upstream.Close()
+	raw := filepath.Join(t.TempDir(), "raw")
+	config := testConfig(t, "-raw-dir", raw, "-max-body-size", "64KB")
+	s, client := startServer(t, config, nil)
+	adminURL := serveAdmin(t, s)
+	for _, method := range []string{"GET", "POST", "POST"} {
+		req, _ := http.NewRequest(method, upstream.URL+"/"+strings.ToLower(method), nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	var page requestPage
+	for deadline := time.Now().Add(5 * time.Second); len(page.Requests) != 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the requests weren't logged")
+		}
+		getJSON(t, adminURL, "/api/requests", &page)
+	}
+
+	// The messages stored as sent are exported as they are.
+	resp, err := http.Get(adminURL + "/api/export/burp?method=get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items burpItems
+	err = xml.NewDecoder(resp.Body).Decode(&items)
+	resp.Body.Close()
+	if err != nil || len(items.Items) != 1 || resp.Header.Get("Content-Type") != "application/xml" {
+		t.Fatalf("got %+v, %v, want the GET request", items, err)
+	}
+	var d requestDetail
+	getJSON(t, adminURL, "/api/requests/"+page.Requests[2].RequestID, &d)
+	for _, m := range []struct {
+		sha     string
+		message burpMessage
+	}{{d.RawRequest, items.Items[0].Request}, {d.RawResponse, items.Items[0].Response}} {
+		want, err := readRaw(raw, m.sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := base64.StdEncoding.DecodeString(m.message.Data); string(got) != string(want) {
+			t.Errorf("got the message %q, want that stored, %q", got, want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	selected := func(args ...string) []string {
+		t.Helper()
+		fs := flag.NewFlagSet("export", flag.ContinueOnError)
+		var sel requestSelection
+		sel.addFlags(fs, defaultConfig())
+		if err := fs.Parse(append([]string{"-db", config.Load().Storage.Path}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		if err := sel.parse(fs); err != nil {
+			t.Fatal(err)
+		}
+		var urls []string
+		err := sel.each(context.Background(), func(d *requestDetail) error {
+			urls = append(urls, strings.TrimPrefix(d.URL, upstream.URL))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return urls
+	}
+	for _, c := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"/get", "/post", "/post"}},
+		{[]string{"-method", "post"}, []string{"/post", "/post"}},
+		{[]string{"-limit", "2"}, []string{"/get", "/post"}},
+		{[]string{page.Requests[0].RequestID, "unknown", page.Requests[2].RequestID}, []string{"/post", "/get"}},
+	} {
+		if got := selected(c.args...); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %v, want %v", c.args, got, c.want)
+		}
+	}
+}
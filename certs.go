@@ -0,0 +1,337 @@
+package stuffpot
+
+import (
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLeafCerts bounds the MITM certificates kept, the least recently used
+// being signed again when needed.
+const maxLeafCerts = 4096
+
+// certIssuer signs the certificates of MITM'd tunnels with the CA, for the
+// name the client asks for in its SNI, or the host of the CONNECT without
+// one. IP literals get an IP SAN. The certificates are cached by SAN.
+type certIssuer struct {
+	// fallback is served to the clients sending no SNI, when configured.
+	fallback atomic.Pointer[tls.Certificate]
+	log      *slog.Logger
+	// failed records the handshakes which failed.
+	failed func(f *tlsFailure)
+	pins   pinCheckers
+	// cacheDir keeps the certificates across restarts, when set.
+	cacheDir string
+
+	mu     sync.Mutex
+	leaves map[string]*list.Element
+	lru    *list.List
+}
+
+type leafCert struct {
+	san  string
+	cert *tls.Certificate
+}
+
+// newCertIssuer loads the default certificate of cfg, if any, and creates its
+// certificate cache directory.
+func newCertIssuer(cfg MitmConfig, failed func(f *tlsFailure)) (*certIssuer, error) {
+	ci := &certIssuer{log: slog.With("component", "mitm"), failed: failed, leaves: make(map[string]*list.Element),
+		lru: list.New(), cacheDir: cfg.CertCache}
+	if err := ci.loadFallback(cfg); err != nil {
+		return nil, err
+	}
+	if ci.cacheDir != "" {
+		if err := os.MkdirAll(ci.cacheDir, 0700); err != nil {
+			return nil, fmt.Errorf("mitm certificate cache: %w", err)
+		}
+	}
+	return ci, nil
+}
+
+// loadFallback loads the default certificate of cfg, or drops it when there's
+// none.
+func (ci *certIssuer) loadFallback(cfg MitmConfig) error {
+	if cfg.DefaultCert == "" {
+		ci.fallback.Store(nil)
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.DefaultCert, cfg.DefaultKey)
+	if err != nil {
+		return fmt.Errorf("mitm default certificate: %w", err)
+	}
+	ci.fallback.Store(&cert)
+	return nil
+}
+
+// reload loads the default certificate of cfg again, for the handshakes which
+// follow, keeping the current one when it fails.
+func (ci *certIssuer) reload(cfg MitmConfig) error {
+	if err := ci.loadFallback(cfg); err != nil {
+		ci.log.Error("Keeping current default certificate, reload failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+// mitmHandshake is what's known of the TLS handshake of a MITM'd tunnel.
+type mitmHandshake struct {
+	// Host is the host of the CONNECT, SNI the name the client asked for,
+	// and SAN the name the certificate served was issued for, default for
+	// the default certificate.
+	Host     string
+	SNI      string
+	SAN      string
+	ClientIP string
+	// JA3 is the hash of the ClientHello, empty when it couldn't be read.
+	JA3 string
+	id  string
+	// hello is the ClientHello, once read, and certSent is set once the
+	// certificate is chosen.
+	hello    *tls.ClientHelloInfo
+	certSent bool
+	ci       *certIssuer
+}
+
+// done logs the outcome of the handshake. Failures, the clients which didn't
+// accept the certificate or don't speak TLS after all, are recorded, and the
+// clients aborting right after the certificate are remembered as checking its
+// pin.
+func (hs *mitmHandshake) done(err error) {
+	log := hs.ci.log.With("tunnel_id", hs.id, "client", hs.ClientIP, "host", hs.Host, "sni", hs.SNI, "san", hs.SAN,
+		"ja3", hs.JA3)
+	if err == nil {
+		log.Debug("MITM handshake completed")
+		return
+	}
+	f := hs.failure(err)
+	log.Info("MITM handshake failed", "kind", f.Kind, "pin_check", f.PinCheck, "error", err)
+	if f.PinCheck {
+		hs.ci.pins.add(f.ClientIP, f.At)
+	}
+	if hs.ci.failed != nil {
+		hs.ci.failed(f)
+	}
+}
+
+// tlsConfig returns the server config of a tunnel of ip to host, a
+// host:port, and the handshake it records.
+func (ci *certIssuer) tlsConfig(cfg *Config, host, ip, id string) (*tls.Config, *mitmHandshake) {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hs := &mitmHandshake{Host: host, ClientIP: ip, id: id, ci: ci}
+	return &tls.Config{
+		// The ClientHello is kept before the version is negotiated, so that
+		// it's known even when that fails.
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hs.hello, hs.SNI = hello, hello.ServerName
+			return nil, nil
+		},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				if fallback := ci.fallback.Load(); fallback != nil {
+					hs.SAN, hs.certSent = "default", true
+					return fallback, nil
+				}
+				name = hostname
+			}
+			hs.SAN = leafSAN(cfg, name)
+			cert, err := ci.leaf(hs.SAN)
+			hs.certSent = err == nil
+			return cert, err
+		},
+	}, hs
+}
+
+// leafSAN returns the name the certificate of name is issued for: the
+// wildcard of its parent domain when it's under one of the wildcard domains,
+// so that the siblings share it, or name itself.
+func leafSAN(cfg *Config, name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if net.ParseIP(name) != nil {
+		return name
+	}
+	_, parent, ok := strings.Cut(name, ".")
+	if !ok {
+		return name
+	}
+	for _, d := range cfg.Mitm.WildcardDomains {
+		if d = strings.ToLower(strings.Trim(d, ".")); parent == d || strings.HasSuffix(parent, "."+d) {
+			return "*." + parent
+		}
+	}
+	return name
+}
+
+// leaf returns the certificate of san, from memory, from the cache directory,
+// or signing it.
+func (ci *certIssuer) leaf(san string) (*tls.Certificate, error) {
+	ci.mu.Lock()
+	if e, ok := ci.leaves[san]; ok {
+		ci.lru.MoveToFront(e)
+		ci.mu.Unlock()
+		return e.Value.(*leafCert).cert, nil
+	}
+	ci.mu.Unlock()
+
+	cert := ci.cached(san)
+	if cert == nil {
+		var err error
+		if cert, err = signLeaf(san); err != nil {
+			ci.log.Warn("Cannot create certificate", "san", san, "error", err)
+			return nil, err
+		}
+		ci.cache(san, cert)
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	if e, ok := ci.leaves[san]; ok {
+		return e.Value.(*leafCert).cert, nil
+	}
+	ci.leaves[san] = ci.lru.PushFront(&leafCert{san, cert})
+	if ci.lru.Len() > maxLeafCerts {
+		e := ci.lru.Back()
+		ci.lru.Remove(e)
+		delete(ci.leaves, e.Value.(*leafCert).san)
+	}
+	return cert, nil
+}
+
+// cachePath returns the file of the certificate of san in the cache
+// directory.
+func (ci *certIssuer) cachePath(san string) string {
+	sum := sha256.Sum256([]byte(san))
+	return filepath.Join(ci.cacheDir, hex.EncodeToString(sum[:16])+".pem")
+}
+
+// cached returns the certificate of san from the cache directory, unless it
+// wasn't signed by the current CA or expires within a day.
+func (ci *certIssuer) cached(san string) *tls.Certificate {
+	if ci.cacheDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(ci.cachePath(san))
+	if err != nil {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	ca, caCert, err := currentCA()
+	if err != nil || leaf.CheckSignatureFrom(caCert) != nil || time.Until(leaf.NotAfter) < 24*time.Hour {
+		return nil
+	}
+	cert.Certificate, cert.Leaf = [][]byte{leaf.Raw, ca.Certificate[0]}, leaf
+	return &cert
+}
+
+// cache writes the certificate of san, with its key, to the cache directory.
+// Failing to is only logged, the certificate being signed again next time.
+func (ci *certIssuer) cache(san string, cert *tls.Certificate) {
+	if ci.cacheDir == "" {
+		return
+	}
+	err := func() error {
+		key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			return err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+		f, err := os.CreateTemp(ci.cacheDir, ".leaf-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), ci.cachePath(san))
+	}()
+	if err != nil {
+		ci.log.Warn("Cannot cache certificate", "san", san, "error", err)
+	}
+}
+
+// currentCA returns goproxy's CA, replaced by LoadCA when configured, with
+// its certificate parsed.
+func currentCA() (*tls.Certificate, *x509.Certificate, error) {
+	ca := goproxy.GoproxyCa
+	if ca.Leaf != nil {
+		return &ca, ca.Leaf, nil
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	return &ca, caCert, err
+}
+
+// signLeaf signs a certificate for san, an IP address or a DNS name, with
+// the current CA.
+func signLeaf(san string) (*tls.Certificate, error) {
+	ca, caCert, err := currentCA()
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: san},
+		NotBefore:             now.Add(-30 * 24 * time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(san); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{san}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, ca.Certificate[0]}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,232 @@
+package stuffpot
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mitmHandshakeWith does the handshake of a client asking for sni with the
+// MITM server of a tunnel to host, and returns the certificate served and the
+// handshake recorded.
+func mitmHandshakeWith(t *testing.T, ci *certIssuer, cfg *Config, host, sni string) (*x509.Certificate,
+	*mitmHandshake) {
+	t.Helper()
+	serverConfig, hs := ci.tlsConfig(cfg, host, "192.0.2.1", "t1")
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	served := make(chan error, 1)
+	go func() { served <- tls.Server(server, serverConfig).Handshake() }()
+	tc := tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("%v, %q: %v", host, sni, err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("%v, %q: %v", host, sni, err)
+	}
+	return tc.ConnectionState().PeerCertificates[0], hs
+}
+
+func TestMITMCertificatesMatchTheRequestedName(t *testing.T) {
+	ci, err := newCertIssuer(MitmConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, "-mitm-wildcard-domains", "example.com").Load()
+	_, caCert, err := currentCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	tests := []struct {
+		host, sni, san string
+	}{
+		{"shop.example:443", "www.shop.example", "www.shop.example"},
+		{"shop.example:443", "", "shop.example"},
+		{"192.0.2.10:443", "", "192.0.2.10"},
+		{"a.example.com:443", "A.Example.COM", "*.example.com"},
+		{"example.com:443", "example.com", "example.com"},
+	}
+	for _, tt := range tests {
+		cert, hs := mitmHandshakeWith(t, ci, cfg, tt.host, tt.sni)
+		if hs.SAN != tt.san || !strings.EqualFold(hs.SNI, tt.sni) {
+			t.Errorf("%v, %q: recorded SNI %q and SAN %q, want SAN %q", tt.host, tt.sni, hs.SNI, hs.SAN, tt.san)
+		}
+		name := tt.sni
+		if name == "" {
+			name, _, _ = net.SplitHostPort(tt.host)
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: name}); err != nil {
+			t.Errorf("%v, %q: the certificate doesn't verify: %v", tt.host, tt.sni, err)
+		}
+	}
+	first, _ := mitmHandshakeWith(t, ci, cfg, "b.example.com:443", "b.example.com")
+	again, _ := mitmHandshakeWith(t, ci, cfg, "c.example.com:443", "c.example.com")
+	if !first.Equal(again) {
+		t.Error("the subdomains of a wildcard domain got different certificates")
+	}
+
+	// The default certificate is served to the clients sending no SNI.
+	ca := newTestCA(t, "default CA")
+	_, certFile, keyFile := ca.issue(t, "default", true)
+	ci, err = newCertIssuer(MitmConfig{DefaultCert: certFile, DefaultKey: keyFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, hs := mitmHandshakeWith(t, ci, cfg, "192.0.2.10:443", ""); cert.Subject.CommonName != "default" ||
+		hs.SAN != "default" {
+		t.Errorf("without SNI: got the certificate of %v, SAN %q, want the default one", cert.Subject.CommonName,
+			hs.SAN)
+	}
+	if cert, _ := mitmHandshakeWith(t, ci, cfg, "192.0.2.10:443", "shop.example"); cert.Subject.CommonName !=
+		"shop.example" {
+		t.Errorf("with SNI: got the certificate of %v", cert.Subject.CommonName)
+	}
+}
+
+func TestDefaultCertificateIsReloaded(t *testing.T) {
+	ca := newTestCA(t, "default CA")
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "default.pem"), filepath.Join(dir, "default-key.pem")
+	// install copies the certificate issued to name where the config has it.
+	install := func(name string) {
+		_, cert, key := ca.issue(t, name, true)
+		for src, dst := range map[string]string{cert: certFile, key: keyFile} {
+			b, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(dst, b, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	install("first")
+	path := writeConfig(t, fmt.Sprintf("mitm:\n  default_cert: %v\n  default_key: %v\n", certFile, keyFile))
+	s, _ := startServer(t, testConfig(t, "-config", path), &recordingLogger{})
+	served := func() string {
+		t.Helper()
+		cert, _ := mitmHandshakeWith(t, s.certs, s.config.Load(), "192.0.2.10:443", "")
+		return cert.Subject.CommonName
+	}
+	if name := served(); name != "first" {
+		t.Fatalf("got the certificate of %v, want the default one", name)
+	}
+
+	install("second")
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := served(); name != "second" {
+		t.Errorf("after a reload: got the certificate of %v, want the new one", name)
+	}
+
+	// One failing to load keeps the current one.
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "mitm default certificate") {
+		t.Errorf("reloading an invalid certificate: got %v", err)
+	}
+	if name := served(); name != "second" {
+		t.Errorf("after a failed reload: got the certificate of %v, want the current one", name)
+	}
+}
+
+func TestGenerateCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	if created, err := GenerateCA(certFile, keyFile); err != nil || !created {
+		t.Fatalf("got %v, %v, want the CA created", created, err)
+	}
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("the key: got %v, %v, want a file of mode 0600", fi, err)
+	}
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 || cert.PublicKeyAlgorithm != x509.ECDSA ||
+		cert.NotAfter.Before(time.Now().AddDate(9, 11, 0)) {
+		t.Errorf("got a certificate for %v, CA %v, %v key, expiring %v", cert.Subject, cert.IsCA,
+			cert.PublicKeyAlgorithm, cert.NotAfter)
+	}
+
+	// The next runs keep it.
+	if created, err := GenerateCA(certFile, keyFile); err != nil || created {
+		t.Errorf("got %v, %v on the next run, want the CA kept", created, err)
+	}
+	if again, _ := os.ReadFile(certFile); string(again) != string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: ca.Certificate[0]})) {
+		t.Errorf("the certificate was overwritten")
+	}
+	// A lone file is not overwritten.
+	os.Remove(keyFile)
+	if _, err := GenerateCA(certFile, keyFile); err == nil || !strings.Contains(err.Error(), "must both exist") {
+		t.Errorf("got %v with the key missing", err)
+	}
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Errorf("the key was created: %v", err)
+	}
+}
+
+func TestMITMCertificatesAreCachedOnDisk(t *testing.T) {
+	builtin := goproxy.GoproxyCa
+	t.Cleanup(func() {
+		goproxy.GoproxyCa = builtin
+		goproxy.MitmConnect.TLSConfig = goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)
+	})
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "certs")
+	cfg := testConfig(t, "-mitm-cert-cache", cacheDir).Load()
+	issue := func() *x509.Certificate {
+		t.Helper()
+		ci, err := newCertIssuer(cfg.Mitm, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := mitmHandshakeWith(t, ci, cfg, "a.example:443", "a.example")
+		return cert
+	}
+
+	first := issue()
+	entries, _ := os.ReadDir(cacheDir)
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ".pem") {
+		t.Fatalf("got %v in the cache directory, want the certificate of a.example", entries)
+	}
+	// After a restart, the certificate is read back rather than signed again.
+	if again := issue(); again.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Errorf("got the serial %v after a restart, want %v from the cache", again.SerialNumber, first.SerialNumber)
+	}
+
+	// One signed by another CA is signed again.
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	if _, err := GenerateCA(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadCA(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	resigned := issue()
+	if resigned.SerialNumber.Cmp(first.SerialNumber) == 0 || resigned.CheckSignatureFrom(goproxy.GoproxyCa.Leaf) != nil {
+		t.Errorf("got the certificate issued by %v, want one signed by the new CA", resigned.Issuer)
+	}
+	if again := issue(); again.SerialNumber.Cmp(resigned.SerialNumber) != 0 {
+		t.Errorf("the certificate signed again was not cached")
+	}
+}
@@ -0,0 +1,130 @@
+package stuffpot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"log/slog"
+	"math/big"
+	"os"
+	"time"
+)
+
+// Commands are the subcommands of the stuffpot binary, by name. Each takes
+// the arguments following its name and exits on failure.
+var Commands = map[string]func(args []string){
+	"config":        configCommand,
+	"version":       func([]string) { PrintVersion(os.Stdout) },
+	"query":         queryCommand,
+	"selftest":      selftestCommand,
+	"reindex-stats": reindexStatsCommand,
+	"reindex-fts":   reindexFTSCommand,
+	"stats":         statsCommand,
+	"report":        reportCommand,
+	"purge":         purgeCommand,
+	"import":        importCommand,
+	"export":        exportCommand,
+	"db":            dbCommand,
+	"replay":        replayCommand,
+}
+
+// SetupLogging sends the operational log of the package to stderr, in the
+// format and at the level of cfg. Reloads update the level.
+func SetupLogging(cfg *Config) error {
+	handler, err := newLogHandler(os.Stderr, cfg.Log.Format)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(cfg.logLevel)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// LoadCA replaces goproxy's built-in CA used to sign MITM certificates.
+func LoadCA(certFile, keyFile string) error {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return err
+	}
+	goproxy.GoproxyCa = ca
+	goproxy.MitmConnect.TLSConfig = goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)
+	return nil
+}
+
+// GenerateCA creates a CA signing MITM certificates at certFile and keyFile,
+// unless both exist already, and tells whether it did. Either existing alone
+// is an error rather than being overwritten.
+func GenerateCA(certFile, keyFile string) (bool, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	switch {
+	case certErr == nil && keyErr == nil:
+		return false, nil
+	case !os.IsNotExist(certErr) || !os.IsNotExist(keyErr):
+		return false, fmt.Errorf("generate CA: %v and %v must both exist or both be missing", certFile, keyFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Proxy CA", Organization: []string{"Proxy"}},
+		NotBefore:             now.Add(-24 * time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return false, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return false, err
+	}
+	if err := writeNewFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return false, err
+	}
+	if err := writeNewFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		os.Remove(keyFile)
+		return false, err
+	}
+	return true, nil
+}
+
+// writeNewFile writes data to name, which must not exist.
+func writeNewFile(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	return f.Close()
+}
+
+func orPanic(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/securized/stuffpot"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := stuffpot.Commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	config, err := stuffpot.NewConfigStore(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err == stuffpot.ErrVersion {
+		stuffpot.PrintVersion(os.Stdout)
+		return
+	}
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	cfg := config.Load()
+
+	if err := stuffpot.SetupLogging(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot set up logging:", err)
+		os.Exit(1)
+	}
+	log := slog.With("component", "listener")
+
+	if cfg.Mitm.CAGenerate {
+		created, err := stuffpot.GenerateCA(cfg.Mitm.CACert, cfg.Mitm.CAKey)
+		if err != nil {
+			fatal("Cannot create CA", err)
+		}
+		if created {
+			log.Info("Created the CA, to be trusted by the clients", "cert", cfg.Mitm.CACert)
+		}
+	}
+	if cfg.Mitm.CACert != "" {
+		if err := stuffpot.LoadCA(cfg.Mitm.CACert, cfg.Mitm.CAKey); err != nil {
+			fatal("Cannot load CA", err)
+		}
+	}
+
+	if cfg.Storage.InitOnly {
+		if err := stuffpot.InitDatabase(cfg); err != nil {
+			fatal("Cannot initialize the database", err)
+		}
+		log.Info("Database initialized", "path", cfg.Storage.Path)
+		return
+	}
+
+	server, err := stuffpot.NewServer(config, nil)
+	if err != nil {
+		fatal("Cannot start", err)
+	}
+	if err := server.Start(); err != nil {
+		fatal("Cannot listen", err)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if reopenSignal != nil {
+		signal.Notify(sigc, reopenSignal)
+	}
+
+loop:
+	for {
+		select {
+		case err := <-server.Err():
+			fatal("Listener failed", err)
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				server.Reload()
+				continue
+			}
+			if sig == reopenSignal {
+				if err := server.Reopen(); err != nil {
+					log.Warn("Failed to reopen log files", "error", err)
+				}
+				continue
+			}
+			log.Info("Shutting down", "signal", sig.String())
+			break loop
+		}
+	}
+
+	grace := config.Load().Limits.ShutdownGrace
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	// A second SIGINT or SIGTERM ends the grace period, the queued events
+	// being dropped.
+	go func() {
+		for sig := range sigc {
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				log.Warn("Ending the grace period", "signal", sig.String())
+				cancel()
+				return
+			}
+		}
+	}()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to close loggers", "component", "logger", "error", err)
+	}
+}
@@ -0,0 +1,304 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs main in the processes the tests start with STUFFPOT_TEST_MAIN
+// set, the test binary standing for stuffpot.
+func TestMain(m *testing.M) {
+	if os.Getenv("STUFFPOT_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// listening is the line the proxy logs once it listens, with its address.
+var listening = regexp.MustCompile(`Starting Proxy.*addr=(\S+)`)
+
+// process is stuffpot run by a test, its log read as it goes.
+type process struct {
+	cmd    *exec.Cmd
+	addr   string
+	lines  chan string
+	logged []string
+}
+
+// startProcess starts stuffpot with args, listening on a free port, and
+// waits for it to listen. It's killed at the end of the test.
+func startProcess(t *testing.T, args ...string) *process {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-addr", "127.0.0.1:0"}, args...)...)
+	cmd.Env = append(os.Environ(), "STUFFPOT_TEST_MAIN=1")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+	p := &process{cmd: cmd, lines: make(chan string, 100)}
+	go func() {
+		defer close(p.lines)
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			p.lines <- sc.Text()
+		}
+	}()
+	for p.addr == "" {
+		select {
+		case line, ok := <-p.lines:
+			if !ok {
+				t.Fatalf("stuffpot exited before listening: %v", p.log())
+			}
+			p.logged = append(p.logged, line)
+			if m := listening.FindStringSubmatch(line); m != nil {
+				p.addr = m[1]
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("stuffpot isn't listening: %v", p.log())
+		}
+	}
+	return p
+}
+
+// log returns what was read of the log.
+func (p *process) log() string {
+	return strings.Join(p.logged, "\n")
+}
+
+// exited returns the result of Wait, once the log is read to its end. The log
+// mustn't be read meanwhile.
+func (p *process) exited() <-chan error {
+	exited := make(chan error, 1)
+	go func() {
+		// The log is read to its end before Wait closes the pipe.
+		for line := range p.lines {
+			p.logged = append(p.logged, line)
+		}
+		exited <- p.cmd.Wait()
+	}()
+	return exited
+}
+
+// result is the body of a response read in full, or the error getting it.
+type result struct {
+	body string
+	err  error
+}
+
+// get sends a request for u through the proxy of p.
+func (p *process) get(u string) <-chan result {
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: p.addr})},
+		Timeout: 10 * time.Second}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := client.Get(u)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- result{string(body), err}
+	}()
+	return done
+}
+
+// slowUpstream starts a server answering "late" once answer is called, and
+// returns its URL and a channel closed once a request arrives.
+func slowUpstream(t *testing.T) (string, <-chan struct{}, func()) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+		io.WriteString(w, "late")
+	}))
+	var released sync.Once
+	answer := func() { released.Do(func() { close(release) }) }
+	// Close waits for the handler, which a failing test leaves waiting.
+	t.Cleanup(upstream.Close)
+	t.Cleanup(answer)
+	return upstream.URL, arrived, answer
+}
+
+func TestSIGTERMLetsInFlightRequestsFinish(t *testing.T) {
+	upstream, arrived, answer := slowUpstream(t)
+	path := filepath.Join(t.TempDir(), "log.db")
+	p := startProcess(t, "-db", path, "-shutdown-grace", "10s")
+	done := p.get(upstream + "/slow")
+	select {
+	case <-arrived:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the request didn't reach the upstream")
+	}
+
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	exited := p.exited()
+	select {
+	case err := <-exited:
+		t.Fatalf("stuffpot exited with the request in flight: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	answer()
+	if r := <-done; r.err != nil || r.body != "late" {
+		t.Errorf("the in-flight request got %q, %v", r.body, r.err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("stuffpot exited with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stuffpot didn't exit after the request")
+	}
+	if !strings.Contains(p.log(), "Shutting down") {
+		t.Errorf("the shutdown wasn't logged: %v", p.log())
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var u string
+	var status int
+	if err := db.QueryRow("select url, status from requests").Scan(&u, &status); err != nil {
+		t.Fatalf("the in-flight request wasn't stored: %v", err)
+	}
+	if !strings.HasSuffix(u, strings.TrimPrefix(upstream, "http://")+"/slow") || status != http.StatusOK {
+		t.Errorf("got %v with status %d, want %v/slow with 200", u, status, upstream)
+	}
+}
+
+func TestSecondSignalEndsTheGracePeriod(t *testing.T) {
+	upstream, arrived, _ := slowUpstream(t)
+	path := filepath.Join(t.TempDir(), "log.db")
+	p := startProcess(t, "-db", path, "-shutdown-grace", "1m")
+	p.get(upstream + "/slow")
+	select {
+	case <-arrived:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the request didn't reach the upstream")
+	}
+
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	exited := p.exited()
+	select {
+	case err := <-exited:
+		t.Fatalf("stuffpot exited with the request in flight: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if err := p.cmd.Process.Signal(syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("stuffpot exited with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stuffpot didn't exit on the second signal")
+	}
+	if !strings.Contains(p.log(), "Ending the grace period") {
+		t.Errorf("the end of the grace period wasn't logged: %v", p.log())
+	}
+
+	// The database was closed cleanly all the same.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var integrity string
+	if err := db.QueryRow("pragma integrity_check").Scan(&integrity); err != nil || integrity != "ok" {
+		t.Errorf("integrity check: %v, %v", integrity, err)
+	}
+}
+
+func TestReplaySendsTheStoredRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "original")
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	path, raw := filepath.Join(dir, "log.db"), filepath.Join(dir, "raw")
+	p := startProcess(t, "-db", path, "-raw-dir", raw, "-max-body-size", "64KB")
+	if r := <-p.get(upstream.URL + "/replayed?q=1"); r.err != nil || r.body != "original" {
+		t.Fatalf("got %q, %v through the proxy", r.body, r.err)
+	}
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-p.exited(); err != nil {
+		t.Fatalf("stuffpot exited with %v", err)
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var id string
+	if err := db.QueryRow("select request_id from requests").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command(os.Args[0], append([]string{"replay", "-db", path, "-raw-dir", raw}, args...)...)
+		cmd.Env = append(os.Environ(), "STUFFPOT_TEST_MAIN=1")
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("replay %v: %v", args, err)
+		}
+		return string(out)
+	}
+	if out := replay("-show", id); !strings.HasPrefix(out, "GET "+upstream.URL+"/replayed?q=1 HTTP/1.1\r\n") ||
+		!strings.HasSuffix(out, "\r\n\r\noriginal") {
+		t.Errorf("got the stored messages %q", out)
+	}
+
+	// The request is sent as it was to another address, with the request
+	// line it had.
+	got := make(chan string, 1)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.RequestURI
+		io.WriteString(w, "replayed")
+	}))
+	defer other.Close()
+	if out := replay("-to", other.Listener.Addr().String(), id); !strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n") ||
+		!strings.HasSuffix(out, "\r\n\r\nreplayed") {
+		t.Errorf("got the response %q to the replay", out)
+	}
+	if uri := <-got; uri != upstream.URL+"/replayed?q=1" {
+		t.Errorf("the replay was sent for %v", uri)
+	}
+
+	cmd := exec.Command(os.Args[0], "replay", "-db", path, "-raw-dir", raw, "missing")
+	cmd.Env = append(os.Environ(), "STUFFPOT_TEST_MAIN=1")
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "no request missing") {
+		t.Errorf("got %q, %v replaying an unknown request", out, err)
+	}
+}
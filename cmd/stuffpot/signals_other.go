@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// reopenSignal is nil where there's no SIGUSR1, the files of the sinks not
+// being reopened then.
+var reopenSignal os.Signal
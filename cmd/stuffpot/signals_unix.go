@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignal has the sinks reopen their files, after an external rotation.
+var reopenSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,1320 @@
+package stuffpot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//go:generate go run ./cmd/stuffpot config example -o stuffpot.example.yaml
+
+// Config holds every setting of the proxy. Each setting can be given, from
+// lowest to highest precedence, by its default, a STUFFPOT_* environment
+// variable, the configuration file, or its command line flag.
+//
+// The yaml tag names the setting in the file, and the environment variable is
+// derived from it: mitm.ports is STUFFPOT_MITM_PORTS. The flag and doc tags
+// name the command line flag and describe the setting. A Config is never
+// modified once loaded.
+type Config struct {
+	Listen    ListenConfig  `yaml:"listen"`
+	Admin     AdminConfig   `yaml:"admin"`
+	Storage   StorageConfig `yaml:"storage"`
+	Mitm      MitmConfig    `yaml:"mitm"`
+	Blocklist []string      `yaml:"blocklist" flag:"blocklist" doc:"Host patterns which are refused, but still logged"`
+	Egress    EgressConfig  `yaml:"egress"`
+	// SmtpBlock answers mail port tunnels with a fake server.
+	SmtpBlock bool `yaml:"smtp_block" flag:"smtp-block" doc:"Answer tunnels to mail ports with a fake server instead of relaying mail"`
+	// Sandbox keeps every request and tunnel from reaching its remote, for
+	// an open proxy honeypot not to relay the abuse it logs.
+	Sandbox bool `yaml:"sandbox" flag:"sandbox" doc:"Never connect to the remotes: requests, tunnels and mail relaying are faked as successful and logged"`
+	// PreferIPv4 and PreferIPv6 dial upstream hosts over that family first,
+	// falling back to the other.
+	PreferIPv4 bool             `yaml:"prefer_ipv4" flag:"prefer-ipv4" doc:"Connect to upstream hosts over IPv4 first, then IPv6"`
+	PreferIPv6 bool             `yaml:"prefer_ipv6" flag:"prefer-ipv6" doc:"Connect to upstream hosts over IPv6 first, then IPv4"`
+	Upstream   UpstreamConfig   `yaml:"upstream"`
+	Limits     LimitsConfig     `yaml:"limits"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit"`
+	Tarpit     TarpitConfig     `yaml:"tarpit"`
+	ProxyAuth  ProxyAuthConfig  `yaml:"proxy_auth"`
+	Log        LogConfig        `yaml:"log"`
+	AccessLog  AccessLogConfig  `yaml:"access_log"`
+	Syslog     SyslogConfig     `yaml:"syslog"`
+	Elastic    ElasticConfig    `yaml:"elasticsearch"`
+	Kafka      KafkaConfig      `yaml:"kafka"`
+	Pcap       PcapConfig       `yaml:"pcap"`
+	RequestID  RequestIDConfig  `yaml:"request_id"`
+	Rules      RulesConfig      `yaml:"rules"`
+	Bruteforce BruteforceConfig `yaml:"bruteforce"`
+	Sessions   SessionsConfig   `yaml:"sessions"`
+	Tor        TorConfig        `yaml:"tor"`
+	Score      ScoreConfig      `yaml:"score"`
+	Report     ReportConfig     `yaml:"report"`
+	Quarantine QuarantineConfig `yaml:"quarantine"`
+	Script     ScriptConfig     `yaml:"script"`
+	Geo        GeoConfig        `yaml:"geo"`
+	RDNS       RDNSConfig       `yaml:"rdns"`
+	Errors     ErrorsConfig     `yaml:"errors"`
+	Alerts     AlertsConfig     `yaml:"alerts"`
+	// Feeds can only be given in the configuration file.
+	Feeds   []FeedConfig `yaml:"feeds" doc:"Threat feeds whose clients and hosts are tagged, or blocked"`
+	Verbose bool         `yaml:"verbose" flag:"v" doc:"Verbose log to stdout, same as a debug log level"`
+
+	logLevel slog.Level
+	// connectRules are the rules of the config, or those following from
+	// the MITM ports, ending with the default one.
+	connectRules []*ConnectRule
+	// upstreamRules are the upstream rules of the config, ending with one
+	// for the default proxy, if any.
+	upstreamRules []*UpstreamRule
+	blocklist     []*regexp.Regexp
+	loginPath     *regexp.Regexp
+	// reportAt is the time of day of the report, from midnight UTC.
+	reportAt time.Duration
+	// adminTokens are those of the config and of the tokens file.
+	adminTokens []AdminToken
+	// The origin policy lists, by country code and AS number.
+	geoDenyCountries  map[string]bool
+	geoAllowCountries map[string]bool
+	geoDenyASN        map[uint]bool
+	geoAllowASN       map[uint]bool
+	// errorPages are the responses of the error classes, and errorHostname
+	// the name of the proxy in them.
+	errorPages    map[string]*errorPage
+	errorHostname string
+	// The egress policy lists, and its port sets.
+	egressAllow, egressDeny           *feedSet
+	egressAllowPorts, egressDenyPorts map[string]bool
+	// proxyAuthUsers are the SHA-256 hashes of the user:password credentials
+	// of the proxy.
+	proxyAuthUsers [][sha256.Size]byte
+}
+
+// ListenConfig and StorageConfig are only read at startup, changing them
+// requires a restart.
+type ListenConfig struct {
+	Proxy       string `yaml:"proxy" flag:"addr" doc:"Listen Port"`
+	Socks       string `yaml:"socks" flag:"socks-addr" doc:"SOCKS5 listen address, disabled when empty"`
+	Transparent string `yaml:"transparent" flag:"transparent-addr" doc:"Listen address of the connections the firewall redirects to the proxy, disabled when empty"`
+	TProxy      bool   `yaml:"tproxy" flag:"transparent-tproxy" doc:"Accept the connections TPROXY rather than REDIRECT sends to the transparent listener, which needs CAP_NET_ADMIN"`
+	Admin       string `yaml:"admin" flag:"admin-addr" doc:"Admin API listen address, disabled when empty"`
+	Debug       string `yaml:"debug" flag:"debug-addr" doc:"pprof and expvar listen address, disabled when empty"`
+}
+
+// AdminConfig protects the admin API. The tokens and certificates are
+// reloaded with the config, but TLS is only turned on at startup.
+type AdminConfig struct {
+	// Tokens can only be given in the configuration file.
+	Tokens     []AdminToken `yaml:"tokens" doc:"Bearer tokens of the admin API"`
+	TokensFile string       `yaml:"tokens_file" flag:"admin-tokens-file" doc:"File of admin API tokens, one \"id scope token\" per line"`
+	TLSCert    string       `yaml:"tls_cert" flag:"admin-tls-cert" doc:"PEM certificate the admin API is served with over TLS"`
+	TLSKey     string       `yaml:"tls_key" flag:"admin-tls-key" doc:"PEM private key of the admin API certificate"`
+	// Clients without a certificate signed by ClientCA are refused, those
+	// with one don't need a token.
+	ClientCA    string `yaml:"client_ca" flag:"admin-client-ca" doc:"PEM CAs of the client certificates the admin API requires at the handshake"`
+	ClientScope string `yaml:"client_scope" flag:"admin-client-scope" doc:"Scope of the admin API clients authenticated by their certificate: read or admin"`
+}
+
+// AdminToken is a bearer token of the admin API. The read scope is limited
+// to the GET requests, admin allows everything.
+type AdminToken struct {
+	ID    string `yaml:"id"`
+	Token string `yaml:"token"`
+	Scope string `yaml:"scope"`
+}
+
+type StorageConfig struct {
+	// The memory store is a SQLite database in memory, lost on exit.
+	Store      string `yaml:"store" flag:"store" doc:"Storage backend: sqlite, memory for disposable runs keeping the latest records only, sql for a PostgreSQL or MySQL database, or one registered by a program embedding the proxy"`
+	MaxRecords int    `yaml:"max_records" flag:"store-max-records" doc:"Requests and tunnels kept by the memory store, the oldest being evicted"`
+	Path       string `yaml:"path" flag:"db" doc:"SQLite database requests are logged to"`
+	// Driver and DSN are only used by the sql store, and DSN by the stores
+	// registered with RegisterStore.
+	Driver string `yaml:"driver" flag:"db-driver" doc:"Database of the sql store: postgres or mysql"`
+	DSN    string `yaml:"dsn" flag:"db-dsn" doc:"Data source name of the sql store, or of a store registered by a program embedding the proxy"`
+	// InitOnly is meant for deployment scripts and containers' init steps.
+	InitOnly bool `yaml:"init_only" flag:"db-init-only" doc:"Create the database schema, or migrate it, then exit"`
+	// With daily rollover, Path names the files: log.db is written as
+	// log-2024-06-01.db on that day.
+	Rollover   string `yaml:"rollover" flag:"db-rollover" doc:"Start a new database file every UTC day (daily) or never (none)"`
+	RetainDays int    `yaml:"retain_days" flag:"db-retain-days" doc:"Daily database files kept, 0 keeps them all"`
+	// Identical requests are counted on the row of the first one, within the
+	// window from it. Read at startup only.
+	DedupeWindow time.Duration `yaml:"dedupe_window" flag:"dedupe-window" doc:"Count identical requests within this time on a single row, 0 logs each"`
+	DedupeClient bool          `yaml:"dedupe_client" flag:"dedupe-client" doc:"Only deduplicate the identical requests of the same client"`
+	// Search needs SQLite built with FTS5, by the sqlite_fts5 build tag.
+	Search bool `yaml:"search" flag:"search" doc:"Index the URL, headers and bodies of requests for /api/search, about doubling the write cost"`
+	// The hosts beyond the top ones of a day are summed into (other) once the
+	// day is over. Read at startup only.
+	HostTrafficTop int `yaml:"host_traffic_top" flag:"host-traffic-top" doc:"Hosts kept by day in host_traffic, and targets in connect_targets, once the day is over, 0 keeps them all"`
+	// Bodies are stored decoded, truncated to MaxBodySize, as long as
+	// Limits.CaptureBodies is on.
+	MaxBodySize ByteSize `yaml:"max_body_size" flag:"max-body-size" doc:"Bytes of each request and response body stored in the bodies table, such as 64KB or 1MB, 0 stores none"`
+	// The raw requests and responses carry the bodies stored, as sent. Read
+	// at startup only.
+	RawDir string `yaml:"raw_dir" flag:"raw-dir" doc:"Directory the requests and responses are stored in as sent, by their SHA-256, for stuffpot replay, disabled when empty"`
+}
+
+type MitmConfig struct {
+	// Enabled off relays the CONNECTs the rules MITM instead, for when the
+	// clients start checking certificates. It's a runtime setting.
+	Enabled bool     `yaml:"enabled" flag:"mitm" doc:"MITM the CONNECTs the rules MITM, otherwise they're relayed"`
+	Ports   []int    `yaml:"ports" flag:"mitm-ports" doc:"CONNECT ports to MITM, other ports are relayed and captured"`
+	Skip    []string `yaml:"skip" flag:"mitm-skip" doc:"Host patterns which are relayed even on a MITM port"`
+	// HTTPPorts are parsed as plaintext HTTP when they aren't MITM'd.
+	HTTPPorts []int `yaml:"http_ports" flag:"http-ports" doc:"CONNECT ports not MITM'd which are relayed request by request as plaintext HTTP"`
+	// CACert and CAKey replace goproxy's built-in CA, they are only read at
+	// startup. CAGenerate creates them on the first run.
+	CACert     string `yaml:"ca_cert" flag:"ca-cert" doc:"PEM certificate of the CA signing MITM certificates"`
+	CAKey      string `yaml:"ca_key" flag:"ca-key" doc:"PEM private key of the CA signing MITM certificates"`
+	CAGenerate bool   `yaml:"ca_generate" flag:"ca-generate" doc:"Create the CA at ca_cert and ca_key when neither exists"`
+	// CertCache keeps the certificates signed across restarts, only read at
+	// startup.
+	CertCache string `yaml:"cert_cache" flag:"mitm-cert-cache" doc:"Directory the MITM certificates are kept in across restarts, disabled when empty"`
+	// DefaultCert and DefaultKey are served to the clients sending no SNI,
+	// instead of a certificate for the CONNECT host. They are read again on
+	// reload.
+	DefaultCert string `yaml:"default_cert" flag:"mitm-default-cert" doc:"PEM certificate served to MITM'd clients sending no SNI, rather than one for the CONNECT host"`
+	DefaultKey  string `yaml:"default_key" flag:"mitm-default-key" doc:"PEM private key of the default MITM certificate"`
+	// WildcardDomains get a wildcard certificate for their subdomains, shared
+	// by the siblings, instead of one per name.
+	WildcardDomains []string `yaml:"wildcard_domains" flag:"mitm-wildcard-domains" doc:"Domains whose subdomains are MITM'd with a wildcard certificate of their parent domain"`
+	// Rules can only be given in the configuration file. Without them, the
+	// rules follow from Ports, Skip and HTTPPorts.
+	Rules []ConnectRule `yaml:"rules" doc:"Ordered rules deciding what's done with each CONNECT, replacing ports, skip and http_ports"`
+}
+
+// UpstreamConfig forwards the traffic through other proxies rather than
+// connecting to the remotes from this host.
+type UpstreamConfig struct {
+	Proxy string `yaml:"proxy" flag:"upstream-proxy" doc:"Proxy the traffic is forwarded through, as http://, https:// or socks5://, with its credentials in the URL, direct when empty"`
+	// Rules can only be given in the configuration file.
+	Rules []UpstreamRule `yaml:"rules" doc:"Ordered rules choosing the proxy of each remote, the default proxy applying when none matches"`
+}
+
+// UpstreamRule forwards the traffic to the remotes it matches through its
+// proxy, the first matching rule applying.
+type UpstreamRule struct {
+	Name string `yaml:"name"`
+	// Hosts, Domains and Ports match the host:port of the remote as those of
+	// a ConnectRule.
+	Hosts   []string `yaml:"hosts"`
+	Domains []string `yaml:"domains"`
+	Ports   []int    `yaml:"ports"`
+	// Proxy is the URL of the proxy, or direct to connect to the remote.
+	Proxy string `yaml:"proxy"`
+
+	hosts []*regexp.Regexp
+	ports map[string]bool
+	proxy *url.URL
+}
+
+// ConnectRule decides what's done with the CONNECT tunnels to the hosts and
+// ports it matches, the first matching rule applying.
+type ConnectRule struct {
+	Name string `yaml:"name"`
+	// Hosts are patterns matched against the host:port of the CONNECT, as
+	// Skip, and Domains names matched against its host, a leading *.
+	// matching the subdomains of the name. Either matches when both are
+	// given, and anything when neither is.
+	Hosts   []string `yaml:"hosts"`
+	Domains []string `yaml:"domains"`
+	// Ports are those of the CONNECT, and Sources the addresses or CIDR
+	// ranges of its client. Either matches anything when empty.
+	Ports   []int    `yaml:"ports"`
+	Sources []string `yaml:"sources"`
+	// Action is mitm, tunnel to relay the bytes verbatim, hijack-parse to
+	// relay plaintext HTTP request by request, or reject.
+	Action string `yaml:"action"`
+	// FakeOK answers the rejected tunnels with a 200 before closing them.
+	FakeOK bool `yaml:"fake_ok"`
+	// Log is what's recorded of the tunnels: full, the default, the connect
+	// and its first bytes, connect without the bytes, or none.
+	Log string `yaml:"log"`
+
+	hosts   []*regexp.Regexp
+	ports   map[string]bool
+	sources []netip.Prefix
+}
+
+type LimitsConfig struct {
+	CaptureLimit int64 `yaml:"capture_limit" flag:"capture-limit" doc:"Bytes captured per direction of a relayed tunnel"`
+	CaptureTotal int64 `yaml:"capture_total" flag:"capture-total" doc:"Bytes of tunnel capture held in memory across all tunnels"`
+	// WebsocketCapture is also what's held in memory of a message until its
+	// last frame.
+	WebsocketCapture int64 `yaml:"websocket_capture" flag:"websocket-capture" doc:"Payload bytes stored per WebSocket message"`
+	// CaptureBodies off keeps the connects rows, the body hashes and the
+	// signature scans. It's a runtime setting, for when the disk fills up.
+	CaptureBodies bool          `yaml:"capture_bodies" flag:"capture-bodies" doc:"Store the bytes of relayed tunnels, the bodies in the search index and the quarantined samples"`
+	ShutdownGrace time.Duration `yaml:"shutdown_grace" flag:"shutdown-grace" doc:"Time given to in-flight requests and tunnels on shutdown"`
+	// DialTimeout applies to each address family tried.
+	DialTimeout time.Duration `yaml:"dial_timeout" flag:"dial-timeout" doc:"Time given to connect to upstream hosts, 0 leaves it to the OS"`
+	// LogQueue and LogDeadline are only read at startup.
+	LogQueue    int           `yaml:"log_queue" flag:"log-queue" doc:"Events waiting to be logged before requests wait for the sinks"`
+	LogDeadline time.Duration `yaml:"log_deadline" flag:"log-deadline" doc:"Time an event may take to be queued and recorded before it's dropped, 0 waits forever"`
+	// LogBatch and LogFlush are only read at startup. The events of a batch
+	// the database fails to commit are lost together.
+	LogBatch int           `yaml:"log_batch" flag:"log-batch" doc:"Requests and tunnels written to the database in a single transaction, 1 writes each in its own"`
+	LogFlush time.Duration `yaml:"log_flush" flag:"log-flush" doc:"Longest time the first event of a batch waits for the batch to fill before it's written"`
+	// Shed and its thresholds are only read at startup. The detail dropped
+	// is restored once the pressure is off.
+	Shed        bool          `yaml:"shed" flag:"log-shed" doc:"Drop the detail of logged requests, bodies first, while the logging queue is deep or the sinks slow"`
+	ShedQueue   float64       `yaml:"shed_queue" flag:"log-shed-queue" doc:"Fraction of the logging queue filled from which detail is shed"`
+	ShedLatency time.Duration `yaml:"shed_latency" flag:"log-shed-latency" doc:"Average time to write an event from which detail is shed"`
+	ShedSample  int           `yaml:"shed_sample" flag:"log-shed-sample" doc:"One in this many requests is still logged in full when only minimal rows are, 0 logs none"`
+}
+
+// LogConfig configures the operational log. The format is only read at startup.
+type LogConfig struct {
+	Level  string `yaml:"level" flag:"log-level" doc:"Operational log level: debug, info, warn or error"`
+	Format string `yaml:"format" flag:"log-format" doc:"Operational log format: text or json"`
+}
+
+// AccessLogConfig configures the optional access log, only read at startup.
+type AccessLogConfig struct {
+	Path       string `yaml:"path" flag:"access-log" doc:"Access log file, disabled when empty"`
+	Format     string `yaml:"format" flag:"access-log-format" doc:"Access log format: combined, common, json, or jsonl for the request and response with all their headers"`
+	MaxSize    int64  `yaml:"max_size" flag:"access-log-max-size" doc:"Bytes after which the access log is rotated, 0 disables rotation"`
+	MaxBackups int    `yaml:"max_backups" flag:"access-log-max-backups" doc:"Rotated access logs kept"`
+}
+
+// SyslogConfig forwards the requests to a syslog endpoint, only read at
+// startup.
+type SyslogConfig struct {
+	Addr   string `yaml:"addr" flag:"syslog-addr" doc:"Syslog endpoint requests are forwarded to, as udp://, tcp:// or tls://host:port, disabled when empty"`
+	Format string `yaml:"format" flag:"syslog-format" doc:"Syslog message format: rfc5424 with structured data, or cef"`
+	// CA verifies the endpoint over TLS, instead of the system roots.
+	CA string `yaml:"ca" flag:"syslog-ca" doc:"PEM certificate of the CA the tls:// syslog endpoint is verified with"`
+}
+
+// ElasticConfig indexes the requests in Elasticsearch, only read at startup.
+type ElasticConfig struct {
+	// URL may hold the user and password of basic authentication.
+	URL      string        `yaml:"url" flag:"es-url" doc:"Elasticsearch URL requests are indexed at, disabled when empty"`
+	Index    string        `yaml:"index" flag:"es-index" doc:"Elasticsearch index of the requests, created with its mappings when missing"`
+	APIKey   string        `yaml:"api_key" flag:"es-api-key" doc:"Elasticsearch API key, the base64 form sent in the Authorization header"`
+	BulkSize int           `yaml:"bulk_size" flag:"es-bulk-size" doc:"Requests indexed by a single bulk request"`
+	Flush    time.Duration `yaml:"flush" flag:"es-flush" doc:"Longest time a request waits to be indexed"`
+}
+
+// KafkaConfig publishes the requests to a Kafka topic, only read at startup.
+type KafkaConfig struct {
+	Brokers []string `yaml:"brokers" flag:"kafka-brokers" doc:"Kafka brokers requests are published to, as host:port, disabled when empty"`
+	Topic   string   `yaml:"topic" flag:"kafka-topic" doc:"Kafka topic of the requests"`
+	TLS     bool     `yaml:"tls" flag:"kafka-tls" doc:"Connect to the Kafka brokers over TLS, verified with the system roots"`
+}
+
+// PcapConfig writes the traffic to a pcap file, only read at startup.
+type PcapConfig struct {
+	Path string `yaml:"path" flag:"pcap-out" doc:"Pcap file the requests and relayed tunnels are written to as synthesized TCP connections, disabled when empty"`
+}
+
+// RequestIDConfig exposes the id given to every request outside of the logs.
+type RequestIDConfig struct {
+	Echo    bool   `yaml:"echo" flag:"request-id-echo" doc:"Send the request id to clients in an X-Stuffpot-Request-Id header"`
+	Forward string `yaml:"forward" flag:"request-id-forward" doc:"Header sending the request id upstream, disabled when empty"`
+}
+
+// RulesConfig names the rule files. Watch is only read at startup.
+type RulesConfig struct {
+	Files []string `yaml:"files" flag:"rules" doc:"Rule files, or directories of them, reloaded when they change"`
+	Watch bool     `yaml:"watch" flag:"rules-watch" doc:"Watch the rule files for changes, otherwise they're only reloaded on SIGHUP"`
+	// BodyLimit bounds the memory held for each body until it's scanned.
+	BodyLimit int64 `yaml:"body_limit" flag:"rules-body-limit" doc:"Bytes of each request and response body scanned by the signature rules, 0 disables body scanning"`
+	// DisabledHoneytokens is a runtime setting. The tokens issued already
+	// are still detected.
+	DisabledHoneytokens []string `yaml:"disabled_honeytokens" flag:"disabled-honeytokens" doc:"Names of the honeytoken rules whose tokens aren't injected"`
+}
+
+// BruteforceConfig sets when a client sending login attempts is marked as
+// brute forcing.
+type BruteforceConfig struct {
+	Attempts    int           `yaml:"attempts" flag:"bruteforce-attempts" doc:"Login attempts from a client within the window starting a brute force session, 0 disables detection"`
+	Credentials int           `yaml:"credentials" flag:"bruteforce-credentials" doc:"Distinct credentials among the attempts needed as well"`
+	Window      time.Duration `yaml:"window" flag:"bruteforce-window" doc:"Time attempts are counted over, and after which an idle session ends"`
+	// Paths and password-like form fields both make a POST a login attempt.
+	Paths string `yaml:"paths" flag:"bruteforce-paths" doc:"Pattern of the paths of login endpoints"`
+}
+
+// SessionsConfig sets how the requests of a client are grouped into
+// sessions, by its address, TLS fingerprint and User-Agent.
+type SessionsConfig struct {
+	Gap time.Duration `yaml:"gap" flag:"session-gap" doc:"Time a client stays idle after which its next request starts a new session"`
+}
+
+// ErrorsConfig sets the responses the proxy serves itself when it can't relay
+// a request or refuses it, instead of goproxy's and bare status lines.
+type ErrorsConfig struct {
+	Preset   string `yaml:"preset" flag:"error-preset" doc:"Error responses served by the proxy: plain, or squid to answer as a Squid proxy would"`
+	Hostname string `yaml:"hostname" flag:"error-hostname" doc:"Name of the proxy in the error responses, the host name when empty"`
+	// Responses can only be given in the configuration file.
+	Responses []ErrorResponse `yaml:"responses" doc:"Error responses replacing those of the preset, by class: upstream, blocked, rate_limited, auth_required, internal or sandbox"`
+}
+
+// ErrorResponse is the response served for an error class. The header values
+// and the body are templates of the variables Class, Status, StatusText,
+// RequestID, Time, Method, URL, Host, ClientIP and Hostname, the body being
+// HTML escaped.
+type ErrorResponse struct {
+	Class   string            `yaml:"class"`
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	// BodyFile replaces Body, it's read with the config.
+	BodyFile string `yaml:"body_file"`
+}
+
+// GeoConfig is the policy applied to clients by their origin, located in
+// MaxMind databases which are only read at startup. The lists and the action
+// are reloaded.
+type GeoConfig struct {
+	CountryDB      string   `yaml:"country_db" flag:"geoip-db" doc:"MaxMind country or city database (.mmdb) clients are located with"`
+	ASNDB          string   `yaml:"asn_db" flag:"geoip-asn-db" doc:"MaxMind ASN database (.mmdb) clients are located with"`
+	DenyCountries  []string `yaml:"deny_countries" flag:"deny-countries" doc:"Country codes whose clients hit the origin policy"`
+	AllowCountries []string `yaml:"allow_countries" flag:"allow-countries" doc:"Country codes out of which clients hit the origin policy"`
+	DenyASN        []string `yaml:"deny_asn" flag:"deny-asn" doc:"AS numbers whose clients hit the origin policy"`
+	AllowASN       []string `yaml:"allow_asn" flag:"allow-asn" doc:"AS numbers out of which clients hit the origin policy"`
+	Action         string   `yaml:"action" flag:"geo-action" doc:"What's done to the requests hitting the origin policy: block, tarpit or tag"`
+	// Tarpit is how long the tarpit action holds a request before it's
+	// forwarded.
+	Tarpit time.Duration `yaml:"tarpit" flag:"geo-tarpit" doc:"Time the tarpit action holds the requests hitting the origin policy"`
+}
+
+// RateLimitConfig caps what each client, by its address, may send, and the
+// connections of all of them. It's reloaded with the config, the connections
+// open staying so.
+type RateLimitConfig struct {
+	Requests float64 `yaml:"requests" flag:"rate-limit" doc:"Requests and tunnels a second a client may open, unlimited when 0"`
+	Burst    int     `yaml:"burst" flag:"rate-limit-burst" doc:"Requests a client may send at once within its rate, the rate rounded up when 0"`
+	// Bytes counts what the clients send and are sent over all of their
+	// connections.
+	Bytes          ByteSize      `yaml:"bytes" flag:"rate-limit-bytes" doc:"Bytes a minute a client may send and be sent before its requests are limited, such as 10MB, unlimited when 0"`
+	Connections    int           `yaml:"connections" flag:"rate-limit-connections" doc:"Connections a client may have open at once, further ones being closed, unlimited when 0"`
+	MaxConnections int           `yaml:"max_connections" flag:"max-connections" doc:"Connections open at once over all the clients, further ones being closed, unlimited when 0"`
+	Action         string        `yaml:"action" flag:"rate-limit-action" doc:"What's done to the requests over the limits: reject with a 429, tarpit then reject, or drop the connection"`
+	Tarpit         time.Duration `yaml:"tarpit" flag:"rate-limit-tarpit" doc:"Time the tarpit action holds the requests over the limits"`
+}
+
+// TarpitConfig slows down the responses to the requests with its tags, such
+// as those of scanners or of clients over the rate limits, to waste the time
+// of their clients. They're logged as usual, tagged tarpitted. It's reloaded
+// with the config.
+type TarpitConfig struct {
+	Tags  []string      `yaml:"tags" flag:"tarpit-tags" doc:"Tags of the requests whose responses are tarpitted, such as scanner or rate-limited, disabled when empty"`
+	Mode  string        `yaml:"mode" flag:"tarpit-mode" doc:"How the responses are slowed down: delay holds them, drip sends the client a byte at a time from then on"`
+	Delay time.Duration `yaml:"delay" flag:"tarpit-delay" doc:"Time a response is held, or between two bytes dripped"`
+	// Jitter is random, for the delays not to give the tarpit away.
+	Jitter time.Duration `yaml:"jitter" flag:"tarpit-jitter" doc:"Time randomly added to or taken from each delay"`
+	// The connections dripping for MaxTime are then written at once.
+	MaxTime   time.Duration `yaml:"max_time" flag:"tarpit-max-time" doc:"Longest a connection is dripped, after which it's written at full speed"`
+	MaxActive int           `yaml:"max_active" flag:"tarpit-max-active" doc:"Responses held and connections dripped at once, further ones not being tarpitted"`
+	// TTL covers the tags only known once the request is logged, such as
+	// those of the payload rules.
+	TTL time.Duration `yaml:"ttl" flag:"tarpit-ttl" doc:"Time the requests of a client are tarpitted after one of them had one of the tags"`
+}
+
+// ProxyAuthConfig has the proxy require credentials from its clients, as a
+// closed proxy would, for the credentials they try to be logged. The clients
+// of the transparent listener, which can't send any, aren't asked. It's
+// reloaded with the config.
+type ProxyAuthConfig struct {
+	Enabled bool     `yaml:"enabled" flag:"proxy-auth" doc:"Require the clients to authenticate with a Proxy-Authorization, answering the others with a 407"`
+	Users   []string `yaml:"users" flag:"proxy-auth-users" doc:"Credentials accepted, as user:password"`
+	// AcceptAfter makes the proxy leaky: a client which failed that many
+	// times has any credentials accepted, for it to think it guessed them.
+	AcceptAfter int           `yaml:"accept_after" flag:"proxy-auth-accept-after" doc:"Failed attempts after which any credentials a client sends are accepted, never when 0"`
+	Window      time.Duration `yaml:"window" flag:"proxy-auth-window" doc:"Time the failed attempts of a client, and the acceptance of its credentials, are remembered after its last attempt"`
+}
+
+// EgressConfig decides the destinations the proxy connects to, whatever the
+// clients ask for, so that the honeypot can't be used for the abuse it logs.
+// The lists hold addresses, CIDR ranges, and domains which their subdomains
+// match too. It's reloaded with the config.
+type EgressConfig struct {
+	Default string   `yaml:"default" flag:"egress-default" doc:"What's done to the destinations the lists don't name: allow or deny"`
+	Allow   []string `yaml:"allow" flag:"egress-allow" doc:"Destinations connected to: addresses, CIDR ranges and domains"`
+	Deny    []string `yaml:"deny" flag:"egress-deny" doc:"Destinations refused, even when allowed: addresses, CIDR ranges and domains"`
+	// AllowPorts, when given, are the only ports connected to.
+	AllowPorts []int `yaml:"allow_ports" flag:"egress-allow-ports" doc:"Destination ports connected to, any when empty"`
+	DenyPorts  []int `yaml:"deny_ports" flag:"egress-deny-ports" doc:"Destination ports refused, such as the mail ports 25, 465 and 587"`
+	Rate       int   `yaml:"rate" flag:"egress-rate" doc:"Requests and tunnels a destination host may be sent a minute, over which they're refused, unlimited when 0"`
+}
+
+// RDNSConfig has the PTR names of the clients' addresses looked up as they
+// arrive, and logged with their requests and tunnels.
+type RDNSConfig struct {
+	Enabled bool          `yaml:"enabled" flag:"rdns" doc:"Look up the PTR name of the clients' addresses and log it with their requests"`
+	Timeout time.Duration `yaml:"timeout" flag:"rdns-timeout" doc:"Time a reverse DNS lookup may take"`
+	// TTL applies to the failed lookups as well.
+	TTL      time.Duration `yaml:"ttl" flag:"rdns-ttl" doc:"Time the name of an address is cached"`
+	MaxCache int           `yaml:"max_cache" flag:"rdns-cache-size" doc:"Addresses whose name is cached"`
+}
+
+// AlertsConfig sends alerts for the requests and CONNECTs matching its rules
+// to a webhook, Slack and email. It's reloaded with the config.
+type AlertsConfig struct {
+	Webhook string `yaml:"webhook" flag:"alert-webhook" doc:"URL alerts are posted to as JSON, disabled when empty"`
+	Slack   string `yaml:"slack" flag:"alert-slack" doc:"Slack incoming webhook URL alerts are posted to, disabled when empty"`
+	// SMTP is the mail server, which is given the user and password over
+	// TLS only, unless it's on localhost.
+	SMTP     string        `yaml:"smtp" flag:"alert-smtp" doc:"Mail server alerts are sent through, as host:port, disabled when empty"`
+	From     string        `yaml:"from" flag:"alert-from" doc:"Sender of the alert emails"`
+	To       []string      `yaml:"to" flag:"alert-to" doc:"Recipients of the alert emails"`
+	Username string        `yaml:"username" flag:"alert-smtp-user" doc:"User the mail server is authenticated to, none when empty"`
+	Password string        `yaml:"password" flag:"alert-smtp-password" doc:"Password of the mail server user"`
+	Cooldown time.Duration `yaml:"cooldown" flag:"alert-cooldown" doc:"Time during which a rule doesn't fire again for the same client, 0 fires on every match"`
+	Timeout  time.Duration `yaml:"timeout" flag:"alert-timeout" doc:"Time sending an alert to a channel may take"`
+	// Rules can only be given in the configuration file.
+	Rules []*AlertRule `yaml:"rules" doc:"Rules whose matching requests and CONNECTs send an alert"`
+}
+
+// TorConfig names the Tor exit list client addresses are tagged from. The
+// file is preferred to the URL, and neither disables the tagging.
+type TorConfig struct {
+	File    string        `yaml:"file" flag:"tor-exit-file" doc:"Local copy of the Tor exit list, one address per line"`
+	URL     string        `yaml:"url" flag:"tor-exit-url" doc:"URL the Tor exit list is downloaded from, such as https://check.torproject.org/torbulkexitlist"`
+	Refresh time.Duration `yaml:"refresh" flag:"tor-exit-refresh" doc:"Time between refreshes of the Tor exit list"`
+}
+
+// ScoreConfig weighs the signals making up the threat score of a client. The
+// events add their weight to a score which decays, while the client's
+// standing, Tor and feeds, is added as long as it lasts.
+type ScoreConfig struct {
+	HalfLife time.Duration `yaml:"half_life" flag:"score-half-life" doc:"Time after which the score of events has halved"`
+	Request  float64       `yaml:"request" flag:"score-request" doc:"Score of each request, making up the request rate"`
+	Host     float64       `yaml:"host" flag:"score-host" doc:"Score of each distinct host probed"`
+	Attack   float64       `yaml:"attack" flag:"score-attack" doc:"Score of each attack payload detected and of each brute force attempt"`
+	Tag      float64       `yaml:"tag" flag:"score-tag" doc:"Score of each rule tag, such as tool fingerprints"`
+	Tor      float64       `yaml:"tor" flag:"score-tor" doc:"Score of connecting from a Tor exit"`
+	Feed     float64       `yaml:"feed" flag:"score-feed" doc:"Score of each feed listing the client"`
+	// Block is the single knob of the auto-block policy.
+	Block float64 `yaml:"block" flag:"score-block" doc:"Score from which clients are refused, 0 never refuses them"`
+}
+
+// ReportConfig schedules the daily report of the previous day.
+type ReportConfig struct {
+	Dir string `yaml:"dir" flag:"report-dir" doc:"Directory daily reports are written to, disabled when empty"`
+	At  string `yaml:"at" flag:"report-at" doc:"UTC time of day the report of the previous day is written, as 15:04"`
+	// Notify names alert channels the report is sent to as well, those of
+	// the alerts section.
+	Notify []string `yaml:"notify" flag:"report-notify" doc:"Alert channels the daily report is sent to, webhook, slack or email, none when empty"`
+}
+
+// QuarantineConfig stores the executables seen in bodies, only read at startup.
+type QuarantineConfig struct {
+	Dir      string `yaml:"dir" flag:"quarantine-dir" doc:"Directory executables seen in request and response bodies are stored in, disabled when empty"`
+	MaxFile  int64  `yaml:"max_file" flag:"quarantine-max-file" doc:"Bytes of a body above which it isn't stored"`
+	MaxTotal int64  `yaml:"max_total" flag:"quarantine-max-total" doc:"Bytes stored in the quarantine directory, after which new samples are dropped"`
+}
+
+// ScriptConfig names the Starlark script deciding how each request is
+// handled. The script is reloaded with the config.
+type ScriptConfig struct {
+	Path      string        `yaml:"path" flag:"script" doc:"Starlark script deciding how each request is handled, disabled when empty"`
+	Timeout   time.Duration `yaml:"timeout" flag:"script-timeout" doc:"Time the script may take on a request before it's passed through"`
+	MaxTarpit time.Duration `yaml:"max_tarpit" flag:"script-max-tarpit" doc:"Longest a request may be held by the script's tarpit"`
+}
+
+// FeedConfig names a threat feed, a list of addresses, networks and domains
+// read from a file or a URL. Feeds are only read at startup.
+type FeedConfig struct {
+	Name    string        `yaml:"name"`
+	File    string        `yaml:"file"`
+	URL     string        `yaml:"url"`
+	Refresh time.Duration `yaml:"refresh"`
+	// Action is tag, the default, or block to refuse the clients as well.
+	Action string `yaml:"action"`
+	// Format is text, the default, stix for a STIX 2 bundle, or abuseipdb
+	// for the blacklist of the AbuseIPDB API, downloaded with APIKey.
+	Format string `yaml:"format"`
+	APIKey string `yaml:"api_key"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:  ListenConfig{Proxy: ":8080"},
+		Admin:   AdminConfig{ClientScope: "read"},
+		Storage: StorageConfig{Store: "sqlite", MaxRecords: 100000, Path: "./log.db", Rollover: "none", DedupeClient: true, HostTrafficTop: 1000},
+		Mitm:    MitmConfig{Enabled: true, Ports: []int{80, 443, 8080, 8443}, HTTPPorts: []int{80}},
+		Limits: LimitsConfig{
+			CaptureLimit:     64 << 10,
+			CaptureBodies:    true,
+			CaptureTotal:     64 << 20,
+			WebsocketCapture: 16 << 10,
+			ShutdownGrace:    10 * time.Second,
+			DialTimeout:      10 * time.Second,
+			LogQueue:         4096,
+			LogDeadline:      30 * time.Second,
+			LogBatch:         64,
+			LogFlush:         50 * time.Millisecond,
+			ShedQueue:        0.5,
+			ShedLatency:      100 * time.Millisecond,
+			ShedSample:       100,
+		},
+		Log:       LogConfig{Level: "info", Format: "text"},
+		AccessLog: AccessLogConfig{Format: "combined", MaxBackups: 5},
+		Syslog:    SyslogConfig{Format: "rfc5424"},
+		Elastic:   ElasticConfig{Index: "stuffpot", BulkSize: 500, Flush: 5 * time.Second},
+		Kafka:     KafkaConfig{Topic: "stuffpot"},
+		Rules:     RulesConfig{Watch: true, BodyLimit: 1 << 20},
+		Bruteforce: BruteforceConfig{
+			Attempts:    10,
+			Credentials: 5,
+			Window:      10 * time.Minute,
+			Paths:       `(?i)login|logon|sign-?in|auth|session|wp-login\.php|xmlrpc\.php|/admin`,
+		},
+		Sessions: SessionsConfig{Gap: 30 * time.Minute},
+		Tor:      TorConfig{Refresh: time.Hour},
+		Score: ScoreConfig{
+			HalfLife: time.Hour,
+			Request:  0.1,
+			Host:     2,
+			Attack:   10,
+			Tag:      5,
+			Tor:      10,
+			Feed:     20,
+		},
+		Report:     ReportConfig{At: "00:05"},
+		Quarantine: QuarantineConfig{MaxFile: 32 << 20, MaxTotal: 1 << 30},
+		Script:     ScriptConfig{Timeout: 50 * time.Millisecond, MaxTarpit: time.Minute},
+		Geo:        GeoConfig{Action: "block", Tarpit: 30 * time.Second},
+		RDNS:       RDNSConfig{Timeout: 2 * time.Second, TTL: time.Hour, MaxCache: 100000},
+		RateLimit:  RateLimitConfig{Action: "reject", Tarpit: 30 * time.Second},
+		Tarpit: TarpitConfig{
+			Mode:      "delay",
+			Delay:     10 * time.Second,
+			Jitter:    5 * time.Second,
+			MaxTime:   5 * time.Minute,
+			MaxActive: 256,
+			TTL:       time.Hour,
+		},
+		ProxyAuth: ProxyAuthConfig{Window: time.Hour},
+		Egress:    EgressConfig{Default: "allow"},
+		Errors:    ErrorsConfig{Preset: "plain"},
+		Alerts:    AlertsConfig{Cooldown: 10 * time.Minute, Timeout: 10 * time.Second},
+	}
+}
+
+// compile validates the config and prepares its derived fields.
+func (c *Config) compile() error {
+	var errs []error
+
+	var err error
+	if err := c.compileConnectRules(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.compileUpstream(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.blocklist, err = compilePatterns(c.Blocklist); err != nil {
+		errs = append(errs, fmt.Errorf("blocklist: %v", err))
+	}
+	if (c.Mitm.CACert == "") != (c.Mitm.CAKey == "") {
+		errs = append(errs, errors.New("mitm: ca_cert and ca_key must be given together"))
+	}
+	if c.Mitm.CAGenerate && c.Mitm.CACert == "" {
+		errs = append(errs, errors.New("mitm.ca_generate: needs ca_cert and ca_key"))
+	}
+	if c.PreferIPv4 && c.PreferIPv6 {
+		errs = append(errs, errors.New("prefer_ipv4 and prefer_ipv6 are exclusive"))
+	}
+	if (c.Mitm.DefaultCert == "") != (c.Mitm.DefaultKey == "") {
+		errs = append(errs, errors.New("mitm: default_cert and default_key must be given together"))
+	}
+	for _, d := range c.Mitm.WildcardDomains {
+		if d = strings.Trim(d, "."); d == "" || strings.ContainsAny(d, "*:/") {
+			errs = append(errs, fmt.Errorf("mitm.wildcard_domains: invalid domain %q", d))
+		}
+	}
+
+	if c.logLevel, err = parseLogLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %v", err))
+	}
+	if c.Verbose {
+		c.logLevel = slog.LevelDebug
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format: unknown format %q", c.Log.Format))
+	}
+
+	switch c.AccessLog.Format {
+	case "combined", "common", "json", "jsonl":
+	default:
+		errs = append(errs, fmt.Errorf("access_log.format: unknown format %q", c.AccessLog.Format))
+	}
+	if c.Elastic.URL != "" {
+		if u, err := url.Parse(c.Elastic.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("elasticsearch.url: %q is not an http or https URL", c.Elastic.URL))
+		}
+	}
+	if c.Elastic.Index == "" || c.Elastic.Index != strings.ToLower(c.Elastic.Index) || strings.ContainsAny(c.Elastic.Index, `/\*?"<>| ,#`) {
+		errs = append(errs, fmt.Errorf("elasticsearch.index: invalid index name %q", c.Elastic.Index))
+	}
+	if c.Elastic.BulkSize <= 0 || c.Elastic.Flush <= 0 {
+		errs = append(errs, errors.New("elasticsearch: bulk_size and flush must be positive"))
+	}
+	if len(c.Kafka.Brokers) > 0 && c.Kafka.Topic == "" {
+		errs = append(errs, errors.New("kafka.topic: must not be empty"))
+	}
+	for _, b := range c.Kafka.Brokers {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			errs = append(errs, fmt.Errorf("kafka.brokers: %v", err))
+		}
+	}
+	if c.Syslog.Format != "rfc5424" && c.Syslog.Format != "cef" {
+		errs = append(errs, fmt.Errorf("syslog.format: unknown format %q", c.Syslog.Format))
+	}
+	if c.Syslog.Addr != "" {
+		if _, _, err := syslogAddr(c.Syslog.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("syslog.addr: %v", err))
+		}
+	}
+	if c.AccessLog.MaxSize < 0 || c.AccessLog.MaxBackups < 0 {
+		errs = append(errs, errors.New("access_log: max_size and max_backups must not be negative"))
+	}
+
+	if c.RequestID.Forward != "" && !headerName.MatchString(c.RequestID.Forward) {
+		errs = append(errs, fmt.Errorf("request_id.forward: invalid header name %q", c.RequestID.Forward))
+	}
+
+	if c.Bruteforce.Attempts < 0 || c.Bruteforce.Credentials < 0 {
+		errs = append(errs, errors.New("bruteforce: attempts and credentials must not be negative"))
+	}
+	if c.Bruteforce.Window <= 0 {
+		errs = append(errs, errors.New("bruteforce.window: must be positive"))
+	}
+	if c.Sessions.Gap <= 0 {
+		errs = append(errs, errors.New("sessions.gap: must be positive"))
+	}
+	if c.loginPath, err = regexp.Compile(c.Bruteforce.Paths); err != nil {
+		errs = append(errs, fmt.Errorf("bruteforce.paths: %v", err))
+	}
+
+	if c.Tor.Refresh <= 0 {
+		errs = append(errs, errors.New("tor.refresh: must be positive"))
+	}
+	if c.Score.HalfLife <= 0 {
+		errs = append(errs, errors.New("score.half_life: must be positive"))
+	}
+	sc := c.Score
+	if sc.Request < 0 || sc.Host < 0 || sc.Attack < 0 || sc.Tag < 0 || sc.Tor < 0 || sc.Feed < 0 || sc.Block < 0 {
+		errs = append(errs, errors.New("score: weights must not be negative"))
+	}
+	if at, err := time.Parse("15:04", c.Report.At); err != nil {
+		errs = append(errs, fmt.Errorf("report.at: invalid time of day %q", c.Report.At))
+	} else {
+		c.reportAt = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+	}
+	names := make(map[string]bool)
+	for i := range c.Feeds {
+		f := &c.Feeds[i]
+		if f.Name == "" || names[f.Name] {
+			errs = append(errs, fmt.Errorf("feeds[%d]: missing or duplicate name %q", i, f.Name))
+		}
+		names[f.Name] = true
+		switch f.Format {
+		case "":
+			f.Format = "text"
+		case "text", "stix":
+		case "abuseipdb":
+			if f.File == "" && f.URL == "" {
+				f.URL = abuseIPDBBlacklist
+			}
+			if f.APIKey == "" || f.File != "" {
+				errs = append(errs, fmt.Errorf("feeds[%d]: abuseipdb needs an api_key and no file", i))
+			}
+			// The API allows a few downloads of the blacklist a day.
+			if f.Refresh == 0 {
+				f.Refresh = 6 * time.Hour
+			}
+		default:
+			errs = append(errs, fmt.Errorf("feeds[%d]: unknown format %q", i, f.Format))
+		}
+		if (f.File == "") == (f.URL == "") {
+			errs = append(errs, fmt.Errorf("feeds[%d]: exactly one of file and url must be given", i))
+		}
+		if f.Refresh == 0 {
+			f.Refresh = time.Hour
+		}
+		if f.Refresh < 0 {
+			errs = append(errs, fmt.Errorf("feeds[%d]: refresh must be positive", i))
+		}
+		switch f.Action {
+		case "":
+			f.Action = "tag"
+		case "tag", "block":
+		default:
+			errs = append(errs, fmt.Errorf("feeds[%d]: unknown action %q", i, f.Action))
+		}
+	}
+
+	if err := c.compileAdmin(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.compileErrors(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.compileGeo(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.compileProxyAuth(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.compileEgress(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.compileAlerts(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.Listen.Proxy == "" {
+		errs = append(errs, errors.New("listen.proxy: must not be empty"))
+	}
+	if c.Listen.TProxy && c.Listen.Transparent == "" {
+		errs = append(errs, errors.New("listen.tproxy: needs listen.transparent"))
+	}
+	if c.Storage.Path == "" {
+		errs = append(errs, errors.New("storage.path: must not be empty"))
+	}
+	_, registered := registeredStore(c.Storage.Store)
+	if c.Storage.Store != "sqlite" && c.Storage.Store != "memory" && c.Storage.Store != "sql" && !registered {
+		errs = append(errs, fmt.Errorf("storage.store: unknown store %q, not one of %v", c.Storage.Store,
+			strings.Join(storeNames(), ", ")))
+	}
+	if _, ok := sqlDrivers[c.Storage.Driver]; c.Storage.Store == "sql" && !ok {
+		errs = append(errs, fmt.Errorf("storage.driver: unknown driver %q, not postgres or mysql", c.Storage.Driver))
+	} else if c.Storage.Store != "sql" && c.Storage.Driver != "" {
+		errs = append(errs, errors.New("storage.driver: only used by the sql store"))
+	}
+	if c.Storage.Store == "sql" && c.Storage.DSN == "" {
+		errs = append(errs, errors.New("storage.dsn: the sql store needs one"))
+	}
+	if c.Storage.MaxRecords <= 0 {
+		errs = append(errs, errors.New("storage.max_records: must be positive"))
+	}
+	if c.Storage.Store != "sqlite" && c.Report.Dir != "" {
+		errs = append(errs, errors.New("report.dir: reports need the sqlite store"))
+	}
+	for _, n := range c.Report.Notify {
+		set := map[string]bool{"webhook": c.Alerts.Webhook != "", "slack": c.Alerts.Slack != "", "email": c.Alerts.SMTP != ""}
+		if !slices.Contains(alertChannels, n) {
+			errs = append(errs, fmt.Errorf("report.notify: unknown channel %q", n))
+		} else if !set[n] {
+			errs = append(errs, fmt.Errorf("report.notify: the %v alert channel isn't configured", n))
+		}
+	}
+	if c.Storage.Store != "sqlite" && len(c.Report.Notify) > 0 {
+		errs = append(errs, errors.New("report.notify: reports need the sqlite store"))
+	}
+	if c.Storage.Rollover != "none" && c.Storage.Rollover != "daily" {
+		errs = append(errs, fmt.Errorf("storage.rollover: unknown rollover %q", c.Storage.Rollover))
+	}
+	if c.Storage.RetainDays < 0 {
+		errs = append(errs, errors.New("storage.retain_days: must not be negative"))
+	}
+	if c.Storage.DedupeWindow < 0 {
+		errs = append(errs, errors.New("storage.dedupe_window: must not be negative"))
+	}
+	if c.Storage.HostTrafficTop < 0 {
+		errs = append(errs, errors.New("storage.host_traffic_top: must not be negative"))
+	}
+	if c.Quarantine.MaxFile <= 0 || c.Quarantine.MaxTotal <= 0 {
+		errs = append(errs, errors.New("quarantine: max_file and max_total must be positive"))
+	}
+	if c.RDNS.Timeout <= 0 || c.RDNS.TTL <= 0 || c.RDNS.MaxCache <= 0 {
+		errs = append(errs, errors.New("rdns: timeout, ttl and max_cache must be positive"))
+	}
+	if c.Limits.CaptureLimit < 0 {
+		errs = append(errs, errors.New("limits.capture_limit: must not be negative"))
+	}
+	if c.Limits.CaptureTotal < 0 {
+		errs = append(errs, errors.New("limits.capture_total: must not be negative"))
+	}
+	if c.Limits.WebsocketCapture < 0 {
+		errs = append(errs, errors.New("limits.websocket_capture: must not be negative"))
+	}
+	if c.Storage.MaxBodySize < 0 {
+		errs = append(errs, errors.New("storage.max_body_size: must not be negative"))
+	}
+	if c.Rules.BodyLimit < 0 {
+		errs = append(errs, errors.New("rules.body_limit: must not be negative"))
+	}
+	if c.Limits.LogDeadline < 0 {
+		errs = append(errs, errors.New("limits.log_deadline: must not be negative"))
+	}
+	if c.Limits.DialTimeout < 0 {
+		errs = append(errs, errors.New("limits.dial_timeout: must not be negative"))
+	}
+	if c.Limits.LogBatch < 1 {
+		errs = append(errs, errors.New("limits.log_batch: must be at least 1"))
+	}
+	if c.Limits.LogFlush < 0 {
+		errs = append(errs, errors.New("limits.log_flush: must not be negative"))
+	}
+	if c.Limits.LogQueue < 0 {
+		errs = append(errs, errors.New("limits.log_queue: must not be negative"))
+	}
+	if c.Limits.ShedQueue <= 0 || c.Limits.ShedQueue > 1 {
+		errs = append(errs, errors.New("limits.shed_queue: must be within (0, 1]"))
+	}
+	if c.Limits.ShedLatency <= 0 {
+		errs = append(errs, errors.New("limits.shed_latency: must be positive"))
+	}
+	if c.Limits.ShedSample < 0 {
+		errs = append(errs, errors.New("limits.shed_sample: must not be negative"))
+	}
+	if c.Script.Timeout < 0 || c.Script.MaxTarpit < 0 {
+		errs = append(errs, errors.New("script: timeout and max_tarpit must not be negative"))
+	}
+	rl := c.RateLimit
+	if rl.Requests < 0 || rl.Burst < 0 || rl.Bytes < 0 || rl.Connections < 0 || rl.MaxConnections < 0 {
+		errs = append(errs, errors.New("rate_limit: limits must not be negative"))
+	}
+	switch rl.Action {
+	case "reject", "tarpit", "drop":
+	default:
+		errs = append(errs, fmt.Errorf("rate_limit.action: unknown action %q", rl.Action))
+	}
+	if rl.Tarpit < 0 {
+		errs = append(errs, errors.New("rate_limit.tarpit: must not be negative"))
+	}
+	if c.Tarpit.Mode != "delay" && c.Tarpit.Mode != "drip" {
+		errs = append(errs, fmt.Errorf("tarpit.mode: unknown mode %q", c.Tarpit.Mode))
+	}
+	if c.Tarpit.Delay < 0 || c.Tarpit.Jitter < 0 || c.Tarpit.MaxTime < 0 || c.Tarpit.TTL < 0 {
+		errs = append(errs, errors.New("tarpit: delay, jitter, max_time and ttl must not be negative"))
+	}
+	if c.Tarpit.MaxActive <= 0 {
+		errs = append(errs, errors.New("tarpit.max_active: must be positive"))
+	}
+	if c.Limits.ShutdownGrace < 0 {
+		errs = append(errs, errors.New("limits.shutdown_grace: must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+var headerName = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+func portSet(ports []int) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, p := range ports {
+		if p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %d", p)
+		}
+		set[strconv.Itoa(p)] = true
+	}
+	return set, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix parses a CIDR range, or an address as the range of itself.
+// IPv4-mapped addresses are taken for IPv4 ones.
+func parsePrefix(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		a, aerr := netip.ParseAddr(s)
+		if aerr != nil {
+			return netip.Prefix{}, fmt.Errorf("%q: expected an address or a CIDR range", s)
+		}
+		p = netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen())
+	} else if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+func (c *Config) blocked(host string) bool {
+	return matchAny(c.blocklist, host)
+}
+
+// ErrVersion is returned by loadConfig when -version is given.
+var ErrVersion = errors.New("version requested")
+
+// newFlagSet returns the command line flags of cfg, whose current values are
+// used as defaults. path receives the -config flag.
+func newFlagSet(name string, cfg *Config, path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(path, "config", *path, "Configuration file, reloaded on SIGHUP")
+	fs.Bool("version", false, "Print version information and exit")
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(f reflect.StructField, v reflect.Value, _ string) {
+		if name := f.Tag.Get("flag"); name != "" {
+			fs.Var(&fieldValue{v}, name, f.Tag.Get("doc"))
+		}
+	})
+	return fs
+}
+
+// loadConfig builds the config from the environment, the file given with
+// -config and the command line arguments.
+func loadConfig(name string, args []string) (*Config, error) {
+	// The first pass only finds the config file and rejects bad flags.
+	var path string
+	fs := newFlagSet(name, defaultConfig(), &path)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.Lookup("version").Value.String() == "true" {
+		return nil, ErrVersion
+	}
+
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := decodeConfigFile(cfg, path); err != nil {
+			return nil, err
+		}
+	}
+
+	fs = newFlagSet(name, cfg, &path)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.compile(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func decodeConfigFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+// applyEnv sets the fields named by STUFFPOT_* variables in env.
+func applyEnv(cfg *Config, env []string) error {
+	vars := make(map[string]string)
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, "STUFFPOT_") {
+			vars[k] = v
+		}
+	}
+
+	var errs []error
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(_ reflect.StructField, v reflect.Value, key string) {
+		name := "STUFFPOT_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		if s, ok := vars[name]; ok {
+			if err := (&fieldValue{v}).Set(s); err != nil {
+				errs = append(errs, fmt.Errorf("%v: %v", name, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// walkConfig calls fn for every setting below v, with its dotted yaml key.
+func walkConfig(v reflect.Value, prefix string, fn func(f reflect.StructField, v reflect.Value, key string)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("yaml")
+		if tag == "" || !f.IsExported() {
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(time.Duration(0)) {
+			walkConfig(v.Field(i), prefix+tag+".", fn)
+			continue
+		}
+		fn(f, v.Field(i), prefix+tag)
+	}
+}
+
+// fieldValue is a flag.Value setting a config field from its string form.
+// Lists are comma separated.
+type fieldValue struct {
+	v reflect.Value
+}
+
+func (fv *fieldValue) String() string {
+	if !fv.v.IsValid() {
+		return ""
+	}
+	switch x := fv.v.Interface().(type) {
+	case []int:
+		s := make([]string, len(x))
+		for i, n := range x {
+			s[i] = strconv.Itoa(n)
+		}
+		return strings.Join(s, ",")
+	case []string:
+		return strings.Join(x, ",")
+	}
+	return fmt.Sprint(fv.v.Interface())
+}
+
+func (fv *fieldValue) Set(s string) error {
+	switch fv.v.Interface().(type) {
+	case string:
+		fv.v.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.v.SetBool(b)
+	case int, int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.v.SetInt(n)
+	case float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		fv.v.SetFloat(f)
+	case ByteSize:
+		n, err := parseByteSize(s)
+		if err != nil {
+			return err
+		}
+		fv.v.SetInt(int64(n))
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		fv.v.SetInt(int64(d))
+	case []int:
+		ports, err := parsePorts(s)
+		if err != nil {
+			return err
+		}
+		fv.v.Set(reflect.ValueOf(ports))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		fv.v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %v", fv.v.Type())
+	}
+	return nil
+}
+
+func (fv *fieldValue) IsBoolFlag() bool {
+	return fv.v.IsValid() && fv.v.Kind() == reflect.Bool
+}
+
+// exampleConfig renders cfg as YAML, documenting every setting with its flag.
+func exampleConfig(cfg *Config) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(cfg); err != nil {
+		return nil, err
+	}
+	commentConfig(&node, reflect.TypeOf(*cfg))
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func commentConfig(node *yaml.Node, t reflect.Type) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		for j := 0; j < t.NumField(); j++ {
+			f := t.Field(j)
+			if f.Tag.Get("yaml") != key.Value {
+				continue
+			}
+			if doc := f.Tag.Get("doc"); doc != "" {
+				key.HeadComment = doc
+				if flag := f.Tag.Get("flag"); flag != "" {
+					key.HeadComment = fmt.Sprintf("%v (-%v)", doc, flag)
+				}
+			}
+			if value.Kind == yaml.MappingNode {
+				commentConfig(value, f.Type)
+			}
+		}
+	}
+}
+
+// ConfigStore makes the current config available to all handlers, which take
+// a snapshot with Load when they start and use it until they're done.
+type ConfigStore struct {
+	atomic.Pointer[Config]
+	name string
+	args []string
+	// mu serializes the loads. overrides are the runtime settings changed
+	// with the admin API and not persisted, by key, applied over every load.
+	mu        sync.Mutex
+	overrides map[string]string
+}
+
+func NewConfigStore(name string, args []string) (*ConfigStore, error) {
+	store := &ConfigStore{name: name, args: args}
+	cfg, err := loadConfig(name, args)
+	if err != nil {
+		return nil, err
+	}
+	store.Store(cfg)
+	return store, nil
+}
+
+// reload swaps in a freshly loaded config. An invalid config is reported and
+// the current one is kept.
+func (store *ConfigStore) reload() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	log := slog.With("component", "config")
+	cfg, err := loadConfig(store.name, overrideArgs(store.args, store.overrides))
+	if err != nil {
+		log.Error("Keeping current configuration, reload failed", "error", err)
+		return err
+	}
+	store.Store(cfg)
+	logLevel.Set(cfg.logLevel)
+	log.Info("Configuration reloaded")
+	return nil
+}
+
+// ByteSize is a number of bytes, given as a number or with a KB, MB or GB
+// suffix, each 1024 times the previous.
+type ByteSize int64
+
+// parseByteSize parses a size such as "1048576", "512KB" or "1MB".
+func parseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	num := strings.TrimRight(s, "BbKkMmGgIi ")
+	unit := strings.ToUpper(strings.TrimSpace(s[len(num):]))
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	shift, ok := map[string]uint{"": 0, "B": 0, "K": 10, "KB": 10, "KIB": 10, "M": 20, "MB": 20, "MIB": 20,
+		"G": 30, "GB": 30, "GIB": 30}[unit]
+	if !ok || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(n << shift), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	n, err := parseByteSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %v: %v", node.Line, err)
+	}
+	*b = n
+	return nil
+}
+
+// parsePorts parses a comma separated port list such as "80,443".
+func parsePorts(s string) ([]int, error) {
+	var ports []int
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, int(n))
+	}
+	return ports, nil
+}
+
+// configCommand implements the config subcommand:
+//
+//	stuffpot config check [-config file] [flags]
+//	stuffpot config example [-o file]
+func configCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: stuffpot config check|example")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "check":
+		cfg, err := loadConfig("stuffpot config check", args[1:])
+		if err == flag.ErrHelp {
+			return
+		}
+		if err == ErrVersion {
+			PrintVersion(os.Stdout)
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		out, err := exampleConfig(cfg)
+		orPanic(err)
+		os.Stdout.Write(out)
+	case "example":
+		fs := flag.NewFlagSet("stuffpot config example", flag.ExitOnError)
+		output := fs.String("o", "", "Write to file instead of stdout")
+		fs.Parse(args[1:])
+		out, err := exampleConfig(defaultConfig())
+		orPanic(err)
+		out = append([]byte("# Generated by `stuffpot config example`, do not edit.\n"), out...)
+		if *output == "" {
+			os.Stdout.Write(out)
+			return
+		}
+		orPanic(os.WriteFile(*output, out, 0644))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown config command %q\n", args[0])
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,77 @@
+package stuffpot
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a configuration file of content and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stuffpot.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestYAMLConfig(t *testing.T) {
+	path := writeConfig(t, `listen:
+  proxy: 127.0.0.1:3128
+storage:
+  path: /var/lib/stuffpot/log.db
+  dedupe_window: 1h
+limits:
+  capture_limit: 4096
+mitm:
+  ca_cert: ca.pem
+  ca_key: ca.key
+  rules:
+    - name: no-ssh
+      ports: [22]
+      action: reject
+    - name: lab
+      sources: [10.0.0.0/8]
+      domains: ["*.example.com"]
+      action: tunnel
+`)
+	// The file overrides the environment, and the flags the file.
+	t.Setenv("STUFFPOT_LIMITS_CAPTURE_LIMIT", "8192")
+	t.Setenv("STUFFPOT_LIMITS_WEBSOCKET_CAPTURE", "1024")
+	config, err := NewConfigStore("stuffpot", []string{"-config", path, "-db", "override.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Load()
+	if cfg.Listen.Proxy != "127.0.0.1:3128" || cfg.Storage.DedupeWindow.String() != "1h0m0s" ||
+		cfg.Mitm.CACert != "ca.pem" || cfg.Mitm.CAKey != "ca.key" {
+		t.Errorf("got listen %v, dedupe window %v, CA %v and %v from the file", cfg.Listen.Proxy,
+			cfg.Storage.DedupeWindow, cfg.Mitm.CACert, cfg.Mitm.CAKey)
+	}
+	if cfg.Limits.CaptureLimit != 4096 || cfg.Limits.WebsocketCapture != 1024 || cfg.Storage.Path != "override.db" {
+		t.Errorf("got capture limits %v and %v, and database %v, want those of the file, the environment and "+
+			"the flags", cfg.Limits.CaptureLimit, cfg.Limits.WebsocketCapture, cfg.Storage.Path)
+	}
+	for _, tt := range []struct{ host, client, rule string }{
+		{"a.example.org:22", "192.0.2.1", "no-ssh"},
+		{"www.example.com:443", "10.1.2.3", "lab"},
+		{"www.example.com:443", "192.0.2.1", "default"},
+	} {
+		if got := cfg.connectRule(tt.host, tt.client).Name; got != tt.rule {
+			t.Errorf("the CONNECT of %v to %v follows rule %v, want %v", tt.client, tt.host, got, tt.rule)
+		}
+	}
+
+	_, err = NewConfigStore("stuffpot", []string{"-config", writeConfig(t, "listen:\n  proxy_port: 3128\n")})
+	if err == nil || !strings.Contains(err.Error(), "proxy_port") {
+		t.Errorf("an unknown key: got %v", err)
+	}
+}
+
+func TestExampleConfigLoads(t *testing.T) {
+	if _, err := NewConfigStore("stuffpot", []string{"-config", "stuffpot.example.yaml"}); err != nil {
+		t.Errorf("stuffpot.example.yaml: %v", err)
+	}
+}
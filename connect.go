@@ -0,0 +1,264 @@
+package stuffpot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// defaultConnectRule applies to the CONNECTs no rule of the config matches.
+var defaultConnectRule = &ConnectRule{Name: "default", Action: "tunnel", Log: "full"}
+
+// defaultRules returns the rules following from the MITM ports: the skipped
+// hosts are relayed, as plaintext HTTP on the HTTP ports, and the other
+// hosts are MITM'd on the MITM ports.
+func (m MitmConfig) defaultRules() []ConnectRule {
+	var rules []ConnectRule
+	if len(m.Skip) > 0 {
+		if len(m.HTTPPorts) > 0 {
+			rules = append(rules, ConnectRule{Name: "skip-http", Hosts: m.Skip, Ports: m.HTTPPorts, Action: "hijack-parse"})
+		}
+		rules = append(rules, ConnectRule{Name: "skip", Hosts: m.Skip, Action: "tunnel"})
+	}
+	if len(m.Ports) > 0 {
+		rules = append(rules, ConnectRule{Name: "mitm-ports", Ports: m.Ports, Action: "mitm"})
+	}
+	if len(m.HTTPPorts) > 0 {
+		rules = append(rules, ConnectRule{Name: "http-ports", Ports: m.HTTPPorts, Action: "hijack-parse"})
+	}
+	return rules
+}
+
+// compileConnectRules validates the CONNECT rules of the config, or those
+// following from the MITM ports without any. Rules of the config which an
+// earlier one shadows are warned about.
+func (c *Config) compileConnectRules() error {
+	var errs []error
+	rules, origin := c.Mitm.Rules, "mitm.rules"
+	if len(rules) == 0 {
+		rules, origin = c.Mitm.defaultRules(), "mitm"
+	}
+	c.connectRules = nil
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("%v: rule %v: %v", origin, r.Name, fmt.Sprintf(format, args...)))
+		}
+		switch r.Action {
+		case "mitm", "tunnel", "hijack-parse", "reject":
+		default:
+			fail("unknown action %q", r.Action)
+		}
+		switch r.Log {
+		case "":
+			r.Log = "full"
+		case "full", "connect", "none":
+		default:
+			fail("unknown log %q", r.Log)
+		}
+		if r.FakeOK && r.Action != "reject" {
+			fail("fake_ok only applies to reject")
+		}
+		var err error
+		if r.ports, err = portSet(r.Ports); err != nil {
+			fail("%v", err)
+		}
+		if r.hosts, err = compilePatterns(r.Hosts); err != nil {
+			fail("%v", err)
+		}
+		for _, d := range r.Domains {
+			if name := strings.TrimPrefix(d, "*."); name == "" || strings.ContainsAny(name, "*:/") {
+				fail("invalid domain %q", d)
+			}
+		}
+		r.sources = nil
+		for _, s := range r.Sources {
+			p, err := parsePrefix(s)
+			if err != nil {
+				fail("sources: %v", err)
+				continue
+			}
+			r.sources = append(r.sources, p)
+		}
+		c.connectRules = append(c.connectRules, &r)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if len(c.Mitm.Rules) > 0 {
+		log := slog.With("component", "config")
+		for j, r := range c.connectRules {
+			for _, earlier := range c.connectRules[:j] {
+				switch {
+				case earlier.covers(r):
+					log.Warn("CONNECT rule shadowed by an earlier one, it never applies", "rule", r.Name, "by", earlier.Name)
+				case earlier.overlaps(r) && earlier.Action != r.Action:
+					log.Warn("CONNECT rule partly shadowed by an earlier one with another action", "rule", r.Name,
+						"by", earlier.Name, "action", earlier.Action)
+				default:
+					continue
+				}
+				break
+			}
+		}
+	}
+	c.connectRules = append(c.connectRules, defaultConnectRule)
+	return nil
+}
+
+// covers tells whether r matches every CONNECT o does. Host patterns,
+// domains and sources are only compared as text.
+func (r *ConnectRule) covers(o *ConnectRule) bool {
+	anyHost := len(r.Hosts) == 0 && len(r.Domains) == 0
+	hosts := anyHost || len(o.Hosts)+len(o.Domains) > 0 && subset(o.Hosts, r.Hosts) && subset(o.Domains, r.Domains)
+	ports := len(r.ports) == 0 || len(o.ports) > 0 && subset(o.Ports, r.Ports)
+	sources := len(r.Sources) == 0 || len(o.Sources) > 0 && subset(o.Sources, r.Sources)
+	return hosts && ports && sources
+}
+
+// overlaps tells whether r and o share a host pattern or domain, on some port
+// and source. A rule for any host following one for some isn't reported,
+// that's how exceptions are made.
+func (r *ConnectRule) overlaps(o *ConnectRule) bool {
+	hosts := shares(r.Hosts, o.Hosts) || shares(r.Domains, o.Domains)
+	ports := len(r.ports) == 0 || len(o.ports) == 0 || shares(r.Ports, o.Ports)
+	sources := len(r.Sources) == 0 || len(o.Sources) == 0 || shares(r.Sources, o.Sources)
+	return hosts && ports && sources
+}
+
+// subset tells whether every element of a is in b.
+func subset[T comparable](a, b []T) bool {
+	return !slices.ContainsFunc(a, func(v T) bool { return !slices.Contains(b, v) })
+}
+
+// shares tells whether a and b have an element in common.
+func shares[T comparable](a, b []T) bool {
+	return slices.ContainsFunc(a, func(v T) bool { return slices.Contains(b, v) })
+}
+
+// matches tells whether r applies to a CONNECT of client to host, a
+// host:port.
+func (r *ConnectRule) matches(host string, client netip.Addr) bool {
+	if len(r.ports) > 0 && !r.ports[hostPort(host)] {
+		return false
+	}
+	if len(r.hosts)+len(r.Domains) > 0 && !matchAny(r.hosts, host) && !matchDomain(r.Domains, host) {
+		return false
+	}
+	return len(r.sources) == 0 || slices.ContainsFunc(r.sources, func(p netip.Prefix) bool {
+		return p.Contains(client)
+	})
+}
+
+// matchDomain tells whether the host of a host:port is one of domains, those
+// starting with *. matching their subdomains.
+func matchDomain(domains []string, host string) bool {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if parent, ok := strings.CutPrefix(d, "*."); ok {
+			if strings.HasSuffix(name, "."+parent) {
+				return true
+			}
+		} else if name == d {
+			return true
+		}
+	}
+	return false
+}
+
+// connectRule returns the rule applying to a CONNECT of client, an address,
+// to host, a host:port. With MITM or the capture of bodies turned off, a copy
+// of the rule relays the tunnel or only logs its CONNECT.
+func (c *Config) connectRule(host, client string) *ConnectRule {
+	addr, _ := netip.ParseAddr(client)
+	addr = addr.Unmap()
+	rule := defaultConnectRule
+	for _, r := range c.connectRules {
+		if r.matches(host, addr) {
+			rule = r
+			break
+		}
+	}
+	if (rule.Action == "mitm" && !c.Mitm.Enabled) || (rule.Log == "full" && !c.Limits.CaptureBodies) {
+		r := *rule
+		if !c.Mitm.Enabled && r.Action == "mitm" {
+			r.Action = "tunnel"
+		}
+		if !c.Limits.CaptureBodies && r.Log == "full" {
+			r.Log = "connect"
+		}
+		rule = &r
+	}
+	return rule
+}
+
+// tunnelRule returns the rule the tunnel of ctx was handled by.
+func tunnelRule(ctx *goproxy.ProxyCtx) *ConnectRule {
+	if s, ok := ctx.UserData.(*tunnelState); ok && s.rule != nil {
+		return s.rule
+	}
+	return defaultConnectRule
+}
+
+// reject answers a CONNECT refused by its rule, with the blocked error
+// response, or a 200 when it fakes success, and closes the tunnel.
+func (t *tunnelRelay) reject(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	defer client.Close()
+	if tunnelRule(ctx).FakeOK {
+		client.Write([]byte("HTTP/1.1 200 Ok\r\n\r\n"))
+		t.logRefused(req, ctx)
+		return
+	}
+	t.refuse(req, client, ctx, "blocked")
+}
+
+// drop closes the connection of a CONNECT over the rate limits of its client,
+// without answering it.
+func (t *tunnelRelay) drop(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	client.Close()
+	t.logRefused(req, ctx)
+}
+
+// refuse answers a hijacked CONNECT with the error response of class.
+func (t *tunnelRelay) refuse(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx, class string) {
+	if s, ok := ctx.UserData.(*tunnelState); ok {
+		s.errorResponse = class
+	}
+	t.config.Load().errorResponse(class, req, requestID(ctx)).Write(client)
+	t.logRefused(req, ctx)
+}
+
+// logRefused logs a tunnel which relayed nothing.
+func (t *tunnelRelay) logRefused(req *http.Request, ctx *goproxy.ProxyCtx) {
+	tc := newTunnelCapture(0, 0)
+	defer tc.release()
+	t.logTunnel(req, tc, nil, ctx)
+}
+
+// logTunnel records the end of the tunnel of ctx, with what tc captured of
+// it, unless its rule logs none.
+func (t *tunnelRelay) logTunnel(req *http.Request, tc *TunnelCapture, smtp *SmtpSession, ctx *goproxy.ProxyCtx) {
+	if s, ok := ctx.UserData.(*tunnelState); ok {
+		s.close(tc)
+		s.ptr = t.rdns.name(clientIP(req.RemoteAddr))
+	}
+	if tunnelRule(ctx).Log == "none" {
+		return
+	}
+	log := t.log.With("tunnel_id", requestID(ctx), "client", req.RemoteAddr, "host", req.URL.Host)
+	logFailed(log, "tunnel", t.logger.LogTunnel(req.Context(), req, tc, smtp, ctx))
+}
@@ -0,0 +1,304 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTunnel sends a CONNECT to target through the proxy of client, with the
+// credentials of its URL if any, and returns the connection, buffered, and the
+// proxy's response.
+func openTunnel(t *testing.T, client *http.Client, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	proxyURL, _ := client.Transport.(*http.Transport).Proxy(nil)
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	auth := ""
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		auth = "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)) +
+			"\r\n"
+	}
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n%v\r\n", target, target, auth)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatalf("CONNECT %v: %v", target, err)
+	}
+	return conn, br, resp
+}
+
+func TestConnectRulesFollowFromTheMitmFlags(t *testing.T) {
+	args := []string{"-mitm-ports", "443", "-mitm-skip", `^bank\.example:`, "-http-ports", "80"}
+	cfg := testConfig(t, args...).Load()
+	for host, want := range map[string]string{
+		"bank.example:443": "skip tunnel",
+		"bank.example:80":  "skip-http hijack-parse",
+		"shop.example:443": "mitm-ports mitm",
+		"shop.example:80":  "http-ports hijack-parse",
+		"shop.example:22":  "default tunnel",
+	} {
+		if r := cfg.connectRule(host, "192.0.2.1"); r.Name+" "+r.Action != want || r.Log != "full" {
+			t.Errorf("%v: got rule %v %v logging %v, want %v logging full", host, r.Name, r.Action, r.Log, want)
+		}
+	}
+
+	// Turned off, MITM relays the tunnels, and the capture of bodies only
+	// logs their CONNECT.
+	cfg = testConfig(t, append(args, "-mitm=false", "-capture-bodies=false")...).Load()
+	if r := cfg.connectRule("shop.example:443", "192.0.2.1"); r.Name != "mitm-ports" || r.Action != "tunnel" ||
+		r.Log != "connect" {
+		t.Errorf("without MITM and bodies: got rule %v %v logging %v", r.Name, r.Action, r.Log)
+	}
+	if cfg.connectRules[2].Action != "mitm" {
+		t.Error("the rule of the config was changed")
+	}
+}
+
+func TestInvalidConnectRules(t *testing.T) {
+	path := writeConfig(t, `mitm:
+  rules:
+    - name: a
+      action: drop
+    - name: b
+      action: tunnel
+      fake_ok: true
+    - name: c
+      action: mitm
+      log: everything
+    - name: d
+      action: tunnel
+      sources: [not-an-address]
+`)
+	_, err := NewConfigStore("stuffpot", []string{"-config", path})
+	for _, want := range []string{`rule a: unknown action "drop"`, "rule b: fake_ok only applies to reject",
+		`rule c: unknown log "everything"`, "rule d: sources:"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want %q", err, want)
+		}
+	}
+}
+
+func TestRejectedConnects(t *testing.T) {
+	path := writeConfig(t, `mitm:
+  rules:
+    - name: no-ssh
+      ports: [22]
+      action: reject
+    - name: fake-smtp
+      ports: [25]
+      action: reject
+      fake_ok: true
+    - name: quiet
+      ports: [23]
+      action: reject
+      log: none
+`)
+	config := testConfig(t, "-config", path)
+	s, client := startServer(t, config, nil)
+
+	conn, _, resp := openTunnel(t, client, "192.0.2.10:22")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("a rejected CONNECT got %v, want the blocked error response", resp.Status)
+	}
+	conn.Close()
+	conn, br, resp := openTunnel(t, client, "192.0.2.10:25")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("a CONNECT rejected faking success got %v, want 200", resp.Status)
+	}
+	if n, err := io.Copy(io.Discard, br); n != 0 || err != nil {
+		t.Errorf("the faked tunnel relayed %d bytes, %v, want it closed", n, err)
+	}
+	conn.Close()
+	conn, _, _ = openTunnel(t, client, "192.0.2.10:23")
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Those of rules logging none aren't stored.
+	want := [][]string{{"192.0.2.10:22", "no-ssh", "reject", "blocked"}, {"192.0.2.10:25", "fake-smtp", "reject", ""}}
+	got := queryRows(t, db, "select host, rule, mode, coalesce(error_response, '') from connects order by host")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got connects %v, want %v", got, want)
+	}
+	// Every CONNECT is counted in connect_targets, whatever its rule.
+	want = [][]string{{"192.0.2.10", "22", "1"}, {"192.0.2.10", "23", "1"}, {"192.0.2.10", "25", "1"}}
+	if got := queryRows(t, db, "select host, port, tunnels from connect_targets order by port"); !reflect.DeepEqual(got,
+		want) {
+		t.Errorf("got connect_targets %v, want %v", got, want)
+	}
+}
+
+func TestEveryConnectIsRecordedWithItsMode(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") })
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	echo := echoServer(t)
+
+	port := func(u string) string { return strings.TrimPrefix(u[strings.LastIndex(u, ":"):], ":") }
+	config := testConfig(t, "-mitm-ports", port(secure.URL), "-http-ports", port(plain.URL))
+	s, client := startServer(t, config, nil)
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	// The client speaks plain HTTP in the tunnel parsed as HTTP, ping to the
+	// echo server in the one relayed and HTTPS to the MITM, which is logged
+	// as its client connection closes, right before the shutdown.
+	plainHost := strings.TrimPrefix(plain.URL, "http://")
+	conn, br, _ := openTunnel(t, client, plainHost)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", plainHost)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("the request in the tunnel parsed as HTTP got %v, %v", resp, err)
+	}
+	conn.Close()
+
+	conn, br, _ = openTunnel(t, client, echo)
+	io.WriteString(conn, "ping")
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(br, echoed); err != nil || string(echoed) != "ping" {
+		t.Fatalf("the relayed tunnel echoed %q, %v", echoed, err)
+	}
+	conn.Close()
+
+	resp, err := client.Get(secure.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	client.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The relayed tunnel counts the 200 of the CONNECT with what it relayed.
+	want := [][]string{{plainHost, "hijack-parse", "http"}, {strings.TrimPrefix(secure.URL, "https://"), "mitm", "tls"},
+		{echo, "tunnel", "unknown", "4", "23"}}
+	got := queryRows(t, db, "select host, mode, protocol, bytes_up, bytes_down, duration_us from connects order by mode")
+	if len(got) != len(want) {
+		t.Fatalf("got connects %v, want those of %v", got, want)
+	}
+	for i, row := range got {
+		up, _ := strconv.Atoi(row[3])
+		down, _ := strconv.Atoi(row[4])
+		duration, _ := strconv.Atoi(row[5])
+		if !reflect.DeepEqual(row[:len(want[i])], want[i]) || up == 0 || down == 0 || duration <= 0 {
+			t.Errorf("got the connect %v, want %v with its traffic and duration", row, want[i])
+		}
+	}
+}
+
+func TestConnectRulesMatchSourcesAndDomains(t *testing.T) {
+	path := writeConfig(t, `mitm:
+  rules:
+    - name: lab
+      sources: [10.0.0.0/8, "2001:db8::1"]
+      action: tunnel
+    - name: shop
+      domains: [shop.example, "*.cdn.example"]
+      ports: [443]
+      action: mitm
+    - name: lab-shop
+      sources: [10.1.0.0/16]
+      domains: [shop.example]
+      action: reject
+    - name: cdn
+      domains: ["*.cdn.example"]
+      action: reject
+    - name: shop-scanners
+      sources: [192.0.2.0/24]
+      domains: [shop.example]
+      ports: [443]
+      action: reject
+`)
+	cfg := testConfig(t, "-config", path).Load()
+	for _, tc := range []struct{ host, client, want string }{
+		{"shop.example:443", "10.1.2.3", "lab"},
+		{"shop.example:443", "2001:db8::1", "lab"},
+		{"shop.example:443", "::ffff:10.1.2.3", "lab"},
+		{"Shop.Example.:443", "192.0.2.1", "shop"},
+		{"a.b.cdn.example:443", "192.0.2.1", "shop"},
+		{"cdn.example:443", "192.0.2.1", "default"},
+		{"a.cdn.example:80", "192.0.2.1", "cdn"},
+		{"notshop.example:443", "192.0.2.1", "default"},
+	} {
+		if r := cfg.connectRule(tc.host, tc.client); r.Name != tc.want {
+			t.Errorf("%v from %v: got rule %v, want %v", tc.host, tc.client, r.Name, tc.want)
+		}
+	}
+
+	// Sources are compared as text, lab-shop isn't reported under lab.
+	rules := cfg.connectRules
+	for _, tc := range []struct {
+		earlier, rule    int
+		covers, overlaps bool
+	}{
+		{0, 2, false, false},
+		{1, 2, false, true},
+		{1, 3, false, true},
+		{1, 4, true, true},
+		{2, 4, false, false},
+		{0, 1, false, false},
+	} {
+		e, r := rules[tc.earlier], rules[tc.rule]
+		if e.covers(r) != tc.covers || e.overlaps(r) != tc.overlaps {
+			t.Errorf("%v then %v: got covers %v and overlaps %v, want %v and %v", e.Name, r.Name, e.covers(r),
+				e.overlaps(r), tc.covers, tc.overlaps)
+		}
+	}
+
+	path = writeConfig(t, `mitm:
+  rules:
+    - name: a
+      domains: ["*."]
+      action: tunnel
+    - name: b
+      domains: ["a.*.example"]
+      action: tunnel
+    - name: c
+      domains: [a.example]
+      action: mitm
+    - name: d
+      domains: [a.example]
+      action: reject
+`)
+	_, err := NewConfigStore("stuffpot", []string{"-config", path})
+	for _, want := range []string{`rule a: invalid domain "*."`, `rule b: invalid domain "a.*.example"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxCookieValue bounds the bytes stored of the value of a cookie.
+const maxCookieValue = 4096
+
+// logCookies records the cookies the client sent with the request of ex, up,
+// and those its response set, down, for the requests of a session to be
+// found by their value whatever their client's address.
+func logCookies(tx *sql.Tx, ex *Exchange, at string) error {
+	host := ex.Request.Host
+	insert := func(direction string, c *http.Cookie) error {
+		var expires interface{}
+		if !c.Expires.IsZero() {
+			expires = c.Expires.UTC().Format(time.DateTime)
+		}
+		value := c.Value
+		if len(value) > maxCookieValue {
+			value = value[:maxCookieValue]
+		}
+		_, err := tx.Exec(`insert into cookies (request_id, from_ip, host, direction, name, value, domain, path,
+          expires, secure, http_only, created_at) values (?,?,?,?,?,?,?,?,?,?,?,?)`,
+			ex.ID, ex.ClientIP, host, direction, c.Name, value, c.Domain, c.Path, expires, c.Secure, c.HttpOnly, at)
+		if err != nil {
+			return fmt.Errorf("insert cookie: %w", err)
+		}
+		return nil
+	}
+	for _, c := range ex.Request.Cookies() {
+		if err := insert("up", c); err != nil {
+			return err
+		}
+	}
+	if ex.Response != nil {
+		for _, c := range ex.Response.Cookies() {
+			if err := insert("down", c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// minSessionToken is the length from which the value of a cookie is taken for
+// a session token, shorter ones being flags and preferences which clients
+// share by chance.
+const minSessionToken = 16
+
+// sharedCookie is a session token used by several clients.
+type sharedCookie struct {
+	Host      string `json:"host"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Clients   int64  `json:"clients"`
+	Requests  int64  `json:"requests"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+}
+
+// sharedCookies returns the session tokens sent or set for more than one
+// client address, those last seen first.
+func (logger *HttpLogger) sharedCookies(ctx context.Context, limit int) ([]sharedCookie, error) {
+	rows, err := logger.db.QueryContext(ctx, `select coalesce(host, ''), coalesce(name, ''), value,
+      count(distinct from_ip), count(distinct request_id), min(created_at), max(created_at)
+      from cookies where length(value) >= ? group by host, name, value having count(distinct from_ip) > 1
+      order by max(created_at) desc limit ?`, minSessionToken, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get shared cookies: %w", err)
+	}
+	defer rows.Close()
+	cookies := []sharedCookie{}
+	for rows.Next() {
+		var c sharedCookie
+		if err := rows.Scan(&c.Host, &c.Name, &c.Value, &c.Clients, &c.Requests, &c.FirstSeen, &c.LastSeen); err != nil {
+			return nil, err
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, rows.Err()
+}
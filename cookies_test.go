@@ -0,0 +1,71 @@
+package stuffpot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSessionTokensSharedByClients(t *testing.T) {
+	logger := testLogger(t)
+	token := strings.Repeat("f00d", 8)
+	log := func(id, ip, cookie string, setCookie ...string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "http://shop.example/", nil)
+		req.RemoteAddr = ip + ":40000"
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		resp := &http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{"Set-Cookie": setCookie}}
+		if err := logger.LogExchange(context.Background(), finishedExchange(req, id, resp, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log("r0", "192.0.2.1", "", "sid="+token+"; Domain=shop.example; Path=/; Expires=Wed, 01 Jan 2031 00:00:00 GMT; "+
+		"Secure; HttpOnly", "lang=en")
+	log("r1", "192.0.2.2", "sid="+token+"; lang=en")
+	log("r2", "192.0.2.3", "lang=en")
+
+	// lang is shared too, but too short to be a session token.
+	cookies, err := logger.sharedCookies(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 1 || cookies[0].Host != "shop.example" || cookies[0].Name != "sid" ||
+		cookies[0].Value != token || cookies[0].Clients != 2 || cookies[0].Requests != 2 {
+		t.Errorf("got the shared cookies %+v, want sid of r0 and r1", cookies)
+	}
+
+	q, err := parseRequestQuery(url.Values{"cookie": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := logger.listRequests(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, r := range page.Requests {
+		ids = append(ids, r.RequestID)
+	}
+	if !reflect.DeepEqual(ids, []string{"r1", "r0"}) {
+		t.Errorf("got the requests %v with the cookie, want r1 and r0", ids)
+	}
+
+	d, err := logger.getRequest(context.Background(), "r0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []detailCookie{
+		{Direction: "down", Name: "sid", Value: token, Domain: "shop.example", Path: "/", Expires: "2031-01-01 00:00:00",
+			Secure: true, HttpOnly: true},
+		{Direction: "down", Name: "lang", Value: "en"},
+	}
+	if !reflect.DeepEqual(d.Cookies, want) {
+		t.Errorf("got the cookies %+v of r0, want %+v", d.Cookies, want)
+	}
+}
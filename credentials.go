@@ -0,0 +1,178 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// credential is a username and password, or what stands for it, sent by a
+// client.
+type credential struct {
+	// Source is the header the credential was read from, authorization or
+	// proxy-authorization, or body for a login form.
+	Source string
+	// Scheme is basic, digest, ntlm or form.
+	Scheme   string
+	Username string
+	// Password is the password in clear, Hash the response standing for it
+	// with digest and NTLM, in hex for NTLM, and Realm the realm of digest
+	// or the domain of NTLM.
+	Password string
+	Hash     string
+	Realm    string
+}
+
+// readCredentials returns the credentials of the headers h and of the login
+// form whose fields are form, if any.
+func readCredentials(h http.Header, form map[string]string) []credential {
+	var creds []credential
+	for _, name := range []string{"Authorization", "Proxy-Authorization"} {
+		for _, v := range h.Values(name) {
+			if c, ok := authCredential(v); ok {
+				c.Source = strings.ToLower(name)
+				creds = append(creds, c)
+			}
+		}
+	}
+	if user, password, found := loginFields(form); found {
+		creds = append(creds, credential{Source: "body", Scheme: "form", Username: user, Password: password})
+	}
+	return creds
+}
+
+// authCredential parses the credential of an Authorization header. NTLM
+// negotiations only have one in their last message, the client's response to
+// the challenge.
+func authCredential(v string) (credential, bool) {
+	scheme, param, _ := strings.Cut(strings.TrimSpace(v), " ")
+	param = strings.TrimSpace(param)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		b, err := base64.StdEncoding.DecodeString(param)
+		if err != nil {
+			return credential{}, false
+		}
+		user, password, _ := strings.Cut(string(b), ":")
+		return credential{Scheme: "basic", Username: user, Password: password}, true
+	case "digest":
+		params := digestParams(param)
+		if params["username"] == "" && params["response"] == "" {
+			return credential{}, false
+		}
+		return credential{Scheme: "digest", Username: params["username"], Hash: params["response"],
+			Realm: params["realm"]}, true
+	case "ntlm", "negotiate":
+		b, err := base64.StdEncoding.DecodeString(param)
+		if err != nil {
+			return credential{}, false
+		}
+		return ntlmCredential(b)
+	}
+	return credential{}, false
+}
+
+// digestParams returns the parameters of a Digest authorization, unquoted.
+func digestParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		var name, value string
+		name, s, _ = strings.Cut(s, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		s = strings.TrimLeft(s, " ")
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			value = strings.ReplaceAll(s[1:min(end, len(s))], `\`, "")
+			s = s[min(end+1, len(s)):]
+			_, s, _ = strings.Cut(s, ",")
+		} else {
+			value, s, _ = strings.Cut(s, ",")
+		}
+		if name != "" {
+			params[name] = strings.TrimSpace(value)
+		}
+	}
+	return params
+}
+
+// ntlmCredential parses an NTLM AUTHENTICATE message, the third of the
+// negotiation, for the user, the domain and the NT response.
+func ntlmCredential(b []byte) (credential, bool) {
+	if len(b) < 64 || string(b[:8]) != "NTLMSSP\x00" || binary.LittleEndian.Uint32(b[8:]) != 3 {
+		return credential{}, false
+	}
+	// The fields are given by their length, then allocated length, and
+	// offset in the message.
+	field := func(at int) []byte {
+		n, off := int(binary.LittleEndian.Uint16(b[at:])), int(binary.LittleEndian.Uint32(b[at+4:]))
+		if off > len(b) || n > len(b)-off {
+			return nil
+		}
+		return b[off : off+n]
+	}
+	// NTLMSSP_NEGOTIATE_UNICODE has the strings in UTF-16, little endian.
+	unicode := binary.LittleEndian.Uint32(b[60:])&1 != 0
+	str := func(p []byte) string {
+		if !unicode {
+			return string(p)
+		}
+		u := make([]uint16, len(p)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(p[2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+	return credential{Scheme: "ntlm", Username: str(field(36)), Realm: str(field(28)),
+		Hash: hex.EncodeToString(field(20))}, true
+}
+
+// insertCredentials records the credentials of the request or tunnel id. It
+// returns the id of the last row inserted.
+func insertCredentials(tx *sql.Tx, id, ip string, creds []credential, at string) (int64, error) {
+	var last int64
+	for _, c := range creds {
+		res, err := tx.Exec(`insert into credentials (request_id, from_ip, source, scheme, username, password, hash,
+          realm, created_at) values (?,?,?,?,?,?,?,?,?)`,
+			id, ip, c.Source, c.Scheme, c.Username, c.Password, c.Hash, c.Realm, at)
+		if err != nil {
+			return 0, fmt.Errorf("insert credential: %w", err)
+		}
+		if last, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+		credentialsTotal.Add(1)
+	}
+	return last, nil
+}
+
+// logCredentials records the credentials of the CONNECT of a tunnel, those of
+// the requests being logged with them.
+func (logger *HttpLogger) logCredentials(tunnelID, ip string, creds []credential, at time.Time) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	tx, err := logger.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	last, err := insertCredentials(tx, tunnelID, ip, creds, at.UTC().Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	if err := logger.evict(tx, last, "delete from credentials where id <= ?"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
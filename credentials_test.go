@@ -0,0 +1,137 @@
+package stuffpot
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// ntlmAuthenticate returns an NTLM AUTHENTICATE message of user in domain,
+// with its strings in UTF-16.
+func ntlmAuthenticate(domain, user string, ntResponse []byte) []byte {
+	msg := make([]byte, 64)
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	binary.LittleEndian.PutUint32(msg[60:], 1)
+	field := func(at int, data []byte) {
+		binary.LittleEndian.PutUint16(msg[at:], uint16(len(data)))
+		binary.LittleEndian.PutUint16(msg[at+2:], uint16(len(data)))
+		binary.LittleEndian.PutUint32(msg[at+4:], uint32(len(msg)))
+		msg = append(msg, data...)
+	}
+	utf16le := func(s string) []byte {
+		var b []byte
+		for _, u := range utf16.Encode([]rune(s)) {
+			b = binary.LittleEndian.AppendUint16(b, u)
+		}
+		return b
+	}
+	field(20, ntResponse)
+	field(28, utf16le(domain))
+	field(36, utf16le(user))
+	return msg
+}
+
+func TestReadCredentials(t *testing.T) {
+	b64 := func(b []byte) string { return base64.StdEncoding.EncodeToString(b) }
+	h := http.Header{}
+	h.Add("Authorization", "Basic "+b64([]byte("admin:pa:ss")))
+	h.Add("Authorization", `Digest username="bob", realm="the \"lab\"", nonce="n", uri="/", response="6629fae4"`)
+	h.Add("Authorization", "NTLM "+b64(ntlmAuthenticate("CORP", "José", []byte{0xca, 0xfe})))
+	// A negotiation's first message has no credential, nor does an invalid
+	// or unknown scheme.
+	h.Add("Authorization", "NTLM "+b64([]byte("NTLMSSP\x00\x01\x00\x00\x00")))
+	h.Add("Authorization", "Basic !!!")
+	h.Add("Authorization", "Bearer abc")
+	h.Add("Proxy-Authorization", "Basic "+b64([]byte("proxy:pw")))
+	form := map[string]string{"email": "a@example.com", "Password": "hunter2", "remember": "1"}
+
+	want := []credential{
+		{Source: "authorization", Scheme: "basic", Username: "admin", Password: "pa:ss"},
+		{Source: "authorization", Scheme: "digest", Username: "bob", Hash: "6629fae4", Realm: `the "lab"`},
+		{Source: "authorization", Scheme: "ntlm", Username: "José", Hash: "cafe", Realm: "CORP"},
+		{Source: "proxy-authorization", Scheme: "basic", Username: "proxy", Password: "pw"},
+		{Source: "body", Scheme: "form", Username: "a@example.com", Password: "hunter2"},
+	}
+	if got := readCredentials(h, form); !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, want)
+	}
+	if got := readCredentials(http.Header{}, map[string]string{"user": "admin"}); got != nil {
+		t.Errorf("a form without a password: got %+v", got)
+	}
+}
+
+func TestCredentialsAreStored(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	config := testConfig(t, "-request-id-echo")
+	s, client := startServer(t, config, nil)
+	adminURL := serveAdmin(t, s)
+
+	req, _ := http.NewRequest("POST", upstream.URL+"/login", strings.NewReader(`{"login":"root","pwd":"toor"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("admin", "admin")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	id := resp.Header.Get(requestIDHeader)
+
+	// Those of a CONNECT are stored with its tunnel.
+	proxyURL, _ := client.Transport.(*http.Transport).Proxy(nil)
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: proxyURL.Host,
+		User: url.UserPassword("scanner", "s3cret")})
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+	resp, err = client.Get(secure.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.CloseIdleConnections()
+
+	var d requestDetail
+	for deadline := time.Now().Add(5 * time.Second); len(d.Credentials) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		getJSON(t, adminURL, "/api/requests/"+id, &d)
+	}
+	wantDetail := []detailCredential{
+		{Source: "authorization", Scheme: "basic", Username: "admin", Password: "admin"},
+		{Source: "body", Scheme: "form", Username: "root", Password: "toor"},
+	}
+	if !reflect.DeepEqual(d.Credentials, wantDetail) {
+		t.Errorf("got the credentials %+v in the detail of %v, want %+v", d.Credentials, id, wantDetail)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{{"proxy-authorization", "basic", "scanner", "s3cret", "1"}}
+	got := queryRows(t, db, `select source, scheme, username, password, count(*) from credentials
+      join connects on credentials.request_id = connects.tunnel_id group by credentials.id`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got the credentials of the CONNECT %v, want %v", got, want)
+	}
+	if n := queryRows(t, db, "select count(*) from credentials"); n[0][0] != "3" {
+		t.Errorf("got %v credentials, want 3", n[0][0])
+	}
+}
@@ -0,0 +1,29 @@
+package stuffpot
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardPage is the web UI of the admin listener. It holds no data, which
+// it reads from the admin API with the credentials the browser loaded it with,
+// or the token given in the page.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// serveDashboard serves the web UI. The values it shows come from the clients
+// of the honeypot, so it runs no script but its own and loads nothing else.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ui/" {
+		http.NotFound(w, r)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; "+
+		"connect-src 'self'; form-action 'none'; frame-ancestors 'none'")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	w.Write(dashboardPage)
+}
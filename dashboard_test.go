@@ -0,0 +1,37 @@
+package stuffpot
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveDashboard(w, httptest.NewRequest("GET", "/ui/", nil))
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	csp := resp.Header.Get("Content-Security-Policy")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		!strings.Contains(csp, "default-src 'none'") || !strings.Contains(csp, "connect-src 'self'") ||
+		resp.Header.Get("X-Content-Type-Options") != "nosniff" || !bytes.Equal(body, dashboardPage) {
+		t.Errorf("got %v with headers %v", resp.Status, resp.Header)
+	}
+
+	w = httptest.NewRecorder()
+	serveDashboard(w, httptest.NewRequest("GET", "/ui/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("another path: got %v", w.Code)
+	}
+
+	// The values of the clients are only ever set as text, and the page
+	// loads nothing but its own script.
+	if m := regexp.MustCompile(`innerHTML|outerHTML|insertAdjacentHTML|document\.write|eval\(|<script src`).Find(
+		dashboardPage); m != nil {
+		t.Errorf("the page uses %s", m)
+	}
+}
@@ -0,0 +1,180 @@
+package stuffpot
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// requestsTotal counts the requests seen by the proxy, including those
+	// read from tunnels.
+	requestsTotal atomic.Int64
+	// activeTunnels counts the relayed CONNECT tunnels currently open.
+	activeTunnels atomic.Int64
+	// servers holds the servers not shut down, whose caches are counted.
+	servers sync.Map
+)
+
+// debugVars returns the stuffpot counters, and the entries of the caches of
+// the servers.
+func debugVars() map[string]int64 {
+	vars := map[string]int64{
+		"requests":       requestsTotal.Load(),
+		"active_tunnels": activeTunnels.Load(),
+		"captured_bytes": atomic.LoadInt64(&capturedBytes),
+		"panics":         panics.Load(),
+		"log_failures":   logFailures.Load(),
+		"log_queue":      queuedEvents.Load(),
+		"log_expired":    expiredEvents.Load(),
+		"script_errors":  scriptErrors.Load(),
+		"cache_certs":    0,
+		"cache_rdns":     0,
+		"cache_sessions": 0,
+		"cache_prints":   0,
+	}
+	vars["log_shed_level"] = shedCurrent.Load()
+	for name, n := range shedEvents {
+		vars["log_shed_"+name] = n.Load()
+	}
+	for name, stage := range logStages {
+		vars["log_"+name+"_events"] = stage.events.Load()
+		vars["log_"+name+"_ns"] = stage.nanos.Load()
+	}
+	servers.Range(func(k, _ interface{}) bool {
+		k.(*Server).countCaches(vars)
+		return true
+	})
+	return vars
+}
+
+// countCaches adds the entries of the caches of s to vars.
+func (s *Server) countCaches(vars map[string]int64) {
+	s.certs.mu.Lock()
+	vars["cache_certs"] += int64(len(s.certs.leaves))
+	s.certs.mu.Unlock()
+	s.rdns.mu.Lock()
+	vars["cache_rdns"] += int64(len(s.rdns.cache))
+	s.rdns.mu.Unlock()
+	s.sessions.mu.Lock()
+	vars["cache_sessions"] += int64(len(s.sessions.sessions))
+	s.sessions.mu.Unlock()
+	s.prints.mu.Lock()
+	vars["cache_prints"] += int64(len(s.prints.byHash))
+	s.prints.mu.Unlock()
+}
+
+// newDebugHandler serves the runtime profiles and the vars, as net/http/pprof
+// and expvar do. Those aren't imported, as they register their handlers on
+// http.DefaultServeMux, which would expose them on the default mux of the
+// programs embedding the package. Like the admin API, it must only be exposed
+// on its own listener.
+func newDebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", serveProfile)
+	mux.HandleFunc("/debug/pprof/cmdline", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+	})
+	mux.HandleFunc("/debug/pprof/profile", serveCPUProfile)
+	mux.HandleFunc("/debug/pprof/trace", serveTrace)
+	mux.HandleFunc("/debug/vars", serveVars)
+	return mux
+}
+
+// serveVars serves the command line, the memory statistics and the stuffpot
+// counters as JSON, in the format of expvar.
+func serveVars(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{"cmdline": os.Args, "memstats": &mem, "stuffpot": debugVars()})
+}
+
+// serveProfile serves the profile named by the path, in the binary format or
+// as text with debug=1 or 2, or lists the profiles under /debug/pprof/. gc=1
+// collects garbage before the heap profile is taken.
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	if name == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<html><head><title>/debug/pprof/</title></head><body><table>\n")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "<tr><td>%d</td><td><a href=\"%s?debug=1\">%s</a></td></tr>\n", p.Count(),
+				html.EscapeString(p.Name()), html.EscapeString(p.Name()))
+		}
+		fmt.Fprint(w, "</table><p><a href=\"profile\">profile</a> <a href=\"trace\">trace</a></p></body></html>\n")
+		return
+	}
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.Error(w, "unknown profile", http.StatusNotFound)
+		return
+	}
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	if name == "heap" && r.FormValue("gc") == "1" {
+		runtime.GC()
+	}
+	if debug != 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	p.WriteTo(w, debug)
+}
+
+// serveCPUProfile profiles the CPU for the seconds asked for, 30 by default.
+func serveCPUProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		http.Error(w, "cannot profile the CPU: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sleep(r, profileSeconds(r, 30))
+	pprof.StopCPUProfile()
+}
+
+// serveTrace traces the execution for the seconds asked for, 1 by default.
+func serveTrace(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		http.Error(w, "cannot trace: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sleep(r, profileSeconds(r, 1))
+	trace.Stop()
+}
+
+// profileSeconds returns the seconds parameter of r, or def.
+func profileSeconds(r *http.Request, def float64) time.Duration {
+	sec, err := strconv.ParseFloat(r.FormValue("seconds"), 64)
+	if err != nil || sec <= 0 {
+		sec = def
+	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+// sleep waits for d, or until the client of r goes away.
+func sleep(r *http.Request, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
@@ -0,0 +1,92 @@
+package stuffpot
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// debugStuffpotVars returns the stuffpot vars served by debug.
+func debugStuffpotVars(t *testing.T, debug *httptest.Server) map[string]int64 {
+	t.Helper()
+	resp, err := http.Get(debug.URL + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var vars struct {
+		Cmdline  []string               `json:"cmdline"`
+		Memstats map[string]interface{} `json:"memstats"`
+		Stuffpot map[string]int64       `json:"stuffpot"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("/debug/vars: %v", err)
+	}
+	if len(vars.Cmdline) == 0 || vars.Memstats["HeapAlloc"] == nil {
+		t.Errorf("/debug/vars lacks the command line or the memory statistics")
+	}
+	return vars.Stuffpot
+}
+
+func TestDebugHandler(t *testing.T) {
+	debug := httptest.NewServer(newDebugHandler())
+	defer debug.Close()
+	for path, want := range map[string]string{
+		"/debug/pprof/":                     "goroutine",
+		"/debug/pprof/goroutine?debug=1":    "goroutine profile:",
+		"/debug/pprof/heap?debug=1&gc=1":    "heap profile:",
+		"/debug/pprof/cmdline":              "",
+		"/debug/pprof/profile?seconds=0.05": "",
+		"/debug/pprof/trace?seconds=0.05":   "",
+	} {
+		resp, err := http.Get(debug.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(body) == 0 || !strings.Contains(string(body), want) {
+			t.Errorf("%v: got %v with %d bytes, want %q", path, resp.Status, len(body), want)
+		}
+	}
+	if resp, err := http.Get(debug.URL + "/debug/pprof/nope"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("an unknown profile: got %v, %v", resp, err)
+	}
+	r := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	if _, pattern := http.DefaultServeMux.Handler(r); pattern != "" {
+		t.Errorf("http.DefaultServeMux serves %v", pattern)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	_, client := startServer(t, testConfig(t), &recordingLogger{})
+	before := debugStuffpotVars(t, debug)
+	for _, name := range []string{"cache_certs", "cache_rdns", "cache_sessions", "cache_prints"} {
+		if _, ok := before[name]; !ok {
+			t.Errorf("the stuffpot vars lack %v", name)
+		}
+	}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	after := debugStuffpotVars(t, debug)
+	if after["requests"] < before["requests"]+1 {
+		t.Errorf("requests went from %d to %d after a proxied request", before["requests"], after["requests"])
+	}
+	// The session is followed from the logging queue.
+	for deadline := time.Now().Add(5 * time.Second); after["cache_sessions"] < 1 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		after = debugStuffpotVars(t, debug)
+	}
+	if after["cache_sessions"] < 1 {
+		t.Errorf("got %d sessions cached after a proxied request", after["cache_sessions"])
+	}
+}
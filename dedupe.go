@@ -0,0 +1,106 @@
+package stuffpot
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyBodyHash is the body hash of requests without a body.
+var emptyBodyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// hashedBody hashes a request body as it's read, for the dedupe key. The hash
+// is only kept once the body has been read to its end.
+type hashedBody struct {
+	io.ReadCloser
+	h     hash.Hash
+	state *requestState
+}
+
+func (b *hashedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+	if err == io.EOF {
+		b.state.mu.Lock()
+		b.state.bodyHash = hex.EncodeToString(b.h.Sum(nil))
+		b.state.mu.Unlock()
+	}
+	return n, err
+}
+
+// hashBody returns the body of req, hashed into state when requests are
+// deduplicated.
+func hashBody(cfg *Config, req *http.Request, state *requestState) io.ReadCloser {
+	switch {
+	case cfg.Storage.DedupeWindow <= 0:
+		return req.Body
+	case req.Body == nil || req.Body == http.NoBody:
+		state.bodyHash = emptyBodyHash
+		return req.Body
+	}
+	return &hashedBody{ReadCloser: req.Body, h: sha256.New(), state: state}
+}
+
+// dedupeKey returns the hash of the method, host, URL, headers and body of
+// the request of ex, and of its client with client. It's empty when the body
+// wasn't read in full.
+func dedupeKey(ex *Exchange, client bool) string {
+	ex.state.mu.Lock()
+	bodyHash := ex.state.bodyHash
+	ex.state.mu.Unlock()
+	if bodyHash == "" {
+		return ""
+	}
+
+	req := ex.Request
+	var lines []string
+	for name, values := range req.Header {
+		for _, v := range values {
+			lines = append(lines, strings.ToLower(name)+": "+v)
+		}
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, s := range []string{req.Method, req.Host, req.URL.String(), strings.Join(lines, "\r\n"), bodyHash} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	if client {
+		io.WriteString(h, ex.ClientIP)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dedupe counts ex on the row of an identical request first seen within the
+// window before it, if any. Otherwise, it returns the key to insert ex with,
+// nil when it isn't deduplicated.
+func (logger *HttpLogger) dedupe(tx *sql.Tx, ex *Exchange, at string) (bool, interface{}, error) {
+	if logger.dedupeWindow <= 0 || ex.state.source != "" {
+		return false, nil, nil
+	}
+	key := dedupeKey(ex, logger.dedupeClient)
+	if key == "" {
+		return false, nil, nil
+	}
+	since := ex.Start.Add(-logger.dedupeWindow).UTC().Format(time.DateTime)
+	res, err := tx.Exec(`update requests set occurrences = occurrences + 1, last_seen = max(last_seen, ?)
+      where id = (select id from requests where dedupe_key = ? and created_at >= ? order by id desc limit 1)`, at, key, since)
+	if err != nil {
+		return false, nil, fmt.Errorf("dedupe request: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, key, err
+}
+
+// setDedupe has identical requests within window counted on a single row,
+// from any client unless client is set.
+func (logger *HttpLogger) setDedupe(window time.Duration, client bool) {
+	logger.dedupeWindow, logger.dedupeClient = window, client
+}
@@ -0,0 +1,270 @@
+package stuffpot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxEgressHosts bounds the destination hosts whose requests are counted for
+// the egress rate, further hosts aren't capped until the counts expire.
+const maxEgressHosts = 100000
+
+// errEgressDenied is the error of the dials the egress policy refuses.
+var errEgressDenied = errors.New("destination refused by the egress policy")
+
+// compileEgress validates the egress policy, and indexes its lists.
+func (c *Config) compileEgress() error {
+	var errs []error
+	switch c.Egress.Default {
+	case "allow", "deny":
+	default:
+		errs = append(errs, fmt.Errorf("egress.default: unknown policy %q", c.Egress.Default))
+	}
+	destinations := func(name string, list []string) *feedSet {
+		set := newFeedSet()
+		for _, s := range list {
+			if p, err := parsePrefix(s); err == nil {
+				set.ips.add(p)
+				continue
+			}
+			d := strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(s, ".")), "*.")
+			if !validHostName(d) || strings.ContainsAny(d, "/:@") {
+				errs = append(errs, fmt.Errorf("egress.%v: invalid destination %q", name, s))
+			}
+			set.domains[d] = struct{}{}
+		}
+		return set
+	}
+	c.egressAllow = destinations("allow", c.Egress.Allow)
+	c.egressDeny = destinations("deny", c.Egress.Deny)
+	var err error
+	if c.egressAllowPorts, err = portSet(c.Egress.AllowPorts); err != nil {
+		errs = append(errs, fmt.Errorf("egress.allow_ports: %v", err))
+	}
+	if c.egressDenyPorts, err = portSet(c.Egress.DenyPorts); err != nil {
+		errs = append(errs, fmt.Errorf("egress.deny_ports: %v", err))
+	}
+	if c.Egress.Rate < 0 {
+		errs = append(errs, errors.New("egress.rate: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// egressAllowed tells whether the egress policy lets the proxy connect to
+// addr, a host and port, whose address is ip. ip is invalid until a host name
+// is resolved: the names the lists don't decide are then let through for
+// their addresses to be checked as they're dialed, unless no allowed range
+// could match them.
+func (c *Config) egressAllowed(addr string, ip netip.Addr) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if c.egressDenyPorts[port] || len(c.egressAllowPorts) > 0 && !c.egressAllowPorts[port] {
+		return false
+	}
+	name := true
+	if a, err := netip.ParseAddr(host); err == nil {
+		ip, name = a, false
+	}
+	if name {
+		if _, ok := c.egressDeny.domain(host); ok {
+			return false
+		}
+	}
+	if ip.IsValid() && c.egressDeny.ips.contains(ip) {
+		return false
+	}
+	if name {
+		if _, ok := c.egressAllow.domain(host); ok {
+			return true
+		}
+	}
+	if ip.IsValid() && c.egressAllow.ips.contains(ip) {
+		return true
+	}
+	return c.Egress.Default == "allow" || !ip.IsValid() && c.egressAllow.ips.size > 0
+}
+
+// egressControl refuses the dials to addr, a host and port, reaching an
+// address the egress policy of cfg doesn't allow. It's called with every
+// address the host resolves to, so that a name can't take the proxy to a
+// refused range.
+func egressControl(cfg *Config, addr string) func(context.Context, string, string, syscall.RawConn) error {
+	host, _, _ := net.SplitHostPort(addr)
+	return func(_ context.Context, _, address string, _ syscall.RawConn) error {
+		ap, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return err
+		}
+		if !cfg.egressAllowed(net.JoinHostPort(host, strconv.Itoa(int(ap.Port()))), ap.Addr()) {
+			return errEgressDenied
+		}
+		return nil
+	}
+}
+
+// errInternalAddr is the error of the dials reaching a listener of this
+// process.
+var errInternalAddr = errors.New("refusing to connect to an internal listener")
+
+// dial connects to addr for proxied traffic, through the upstream proxy of
+// addr if any, over the address family the config prefers first. It refuses
+// the admin and debug listeners of this process, whatever name or address
+// they're reached by, and the destinations of the egress policy: those
+// reached through an upstream proxy by their name only. The dial is given up
+// on after the dial timeout, or once the server shuts down.
+func (s *Server) dial(network, addr string) (net.Conn, error) {
+	cfg := s.config.Load()
+	if !cfg.egressAllowed(addr, netip.Addr{}) {
+		egressRefused.Add(1)
+		return nil, errEgressDenied
+	}
+	var conn net.Conn
+	var err error
+	if u := cfg.upstreamProxy(addr); u != nil && strings.HasPrefix(network, "tcp") {
+		conn, err = dialUpstream(s.base, cfg, u, network, addr)
+	} else {
+		conn, err = dialFamily(s.base, cfg, network, addr, egressControl(cfg, addr))
+	}
+	if errors.Is(err, errEgressDenied) {
+		egressRefused.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	local, lok := conn.LocalAddr().(*net.TCPAddr)
+	remote, rok := conn.RemoteAddr().(*net.TCPAddr)
+	if lok && rok && (remote.IP.IsLoopback() || remote.IP.Equal(local.IP)) {
+		if _, ok := s.internal.Load(remote.Port); ok {
+			conn.Close()
+			return nil, errInternalAddr
+		}
+	}
+	return conn, nil
+}
+
+// dialFamily dials a tcp addr over the family cfg prefers, then over any
+// family when that fails, so that hosts only reachable over the other one
+// are still reached. Each attempt is given the dial timeout, and control if
+// any.
+func dialFamily(ctx context.Context, cfg *Config, network, addr string,
+	control func(context.Context, string, string, syscall.RawConn) error) (net.Conn, error) {
+	d := &net.Dialer{Timeout: cfg.Limits.DialTimeout, ControlContext: control}
+	family := ""
+	switch {
+	case cfg.PreferIPv4:
+		family = "4"
+	case cfg.PreferIPv6:
+		family = "6"
+	}
+	if family == "" || network != "tcp" {
+		return d.DialContext(ctx, network, addr)
+	}
+	if conn, err := d.DialContext(ctx, network+family, addr); err == nil || ctx.Err() != nil {
+		return conn, err
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// dialFailure returns the class of the error response of a remote which
+// couldn't be reached for err.
+func dialFailure(err error) string {
+	if errors.Is(err, errEgressDenied) {
+		return "blocked"
+	}
+	return "upstream"
+}
+
+// requestAddr returns the host and port of the remote of u.
+func requestAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// egressLimiter counts the requests and tunnels sent to each destination host
+// over a minute, for the egress rate to cap them.
+type egressLimiter struct {
+	mu        sync.Mutex
+	windows   map[string]*egressWindow
+	lastSweep time.Time
+}
+
+// egressWindow counts the requests to a host since start.
+type egressWindow struct {
+	start time.Time
+	n     int
+}
+
+func newEgressLimiter() *egressLimiter {
+	return &egressLimiter{windows: make(map[string]*egressWindow)}
+}
+
+// check applies the egress policy of cfg to a request or tunnel to addr, a
+// host and port, counting it against the rate of its host when count is set.
+// It returns the class of the error response refusing it, if it is.
+func (l *egressLimiter) check(cfg *Config, addr string, count bool) string {
+	if !cfg.egressAllowed(addr, netip.Addr{}) {
+		egressRefused.Add(1)
+		return "blocked"
+	}
+	if count && !l.allow(cfg.Egress.Rate, addr) {
+		egressRefused.Add(1)
+		return "rate_limited"
+	}
+	return ""
+}
+
+// allow counts a request to the host of addr, and tells whether the host was
+// sent fewer than rate of them over the last minute.
+func (l *egressLimiter) allow(rate int, addr string) bool {
+	if rate == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		for h, w := range l.windows {
+			if now.Sub(w.start) >= time.Minute {
+				delete(l.windows, h)
+			}
+		}
+		l.lastSweep = now
+	}
+	w := l.windows[host]
+	if w == nil || now.Sub(w.start) >= time.Minute {
+		if w == nil && len(l.windows) >= maxEgressHosts {
+			return true
+		}
+		w = &egressWindow{start: now}
+		l.windows[host] = w
+	}
+	if w.n >= rate {
+		return false
+	}
+	w.n++
+	return true
+}
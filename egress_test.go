@@ -0,0 +1,133 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEgressPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		addr string
+		ip   string
+		want bool
+	}{
+		// The names the lists don't decide are let through for their
+		// addresses to be checked, when an allowed range could match them.
+		{[]string{"-egress-default", "deny", "-egress-allow", "198.51.100.0/24,example.com"}, "www.example.com:80", "", true},
+		{[]string{"-egress-default", "deny", "-egress-allow", "198.51.100.0/24,example.com"}, "other.test:80", "", true},
+		{[]string{"-egress-default", "deny", "-egress-allow", "198.51.100.0/24,example.com"}, "other.test:80",
+			"192.0.2.1", false},
+		{[]string{"-egress-default", "deny", "-egress-allow", "198.51.100.0/24,example.com"}, "other.test:80",
+			"198.51.100.5", true},
+		{[]string{"-egress-default", "deny", "-egress-allow", "198.51.100.0/24,example.com"}, "192.0.2.1:80", "", false},
+		{[]string{"-egress-default", "deny", "-egress-allow", "example.com"}, "other.test:80", "", false},
+		{[]string{"-egress-deny", "10.0.0.0/8,*.bad.test"}, "x.BAD.test:443", "", false},
+		{[]string{"-egress-deny", "10.0.0.0/8,*.bad.test"}, "10.1.2.3:80", "", false},
+		{[]string{"-egress-deny", "10.0.0.0/8,*.bad.test"}, "name.test:80", "10.0.0.1", false},
+		{[]string{"-egress-deny", "10.0.0.0/8,*.bad.test"}, "name.test:80", "192.0.2.1", true},
+		// Denied destinations are refused even when allowed.
+		{[]string{"-egress-allow", "example.com", "-egress-deny", "admin.example.com"}, "admin.example.com:80", "",
+			false},
+		{[]string{"-egress-allow-ports", "80,443", "-egress-deny-ports", "25"}, "a.test:443", "", true},
+		{[]string{"-egress-allow-ports", "80,443", "-egress-deny-ports", "25"}, "a.test:8080", "", false},
+		{[]string{"-egress-deny-ports", "25"}, "a.test:25", "", false},
+		{nil, "no port", "", false},
+	} {
+		var ip netip.Addr
+		if tc.ip != "" {
+			ip = netip.MustParseAddr(tc.ip)
+		}
+		if got := testConfig(t, tc.args...).Load().egressAllowed(tc.addr, ip); got != tc.want {
+			t.Errorf("%v: %v (%v): got %v, want %v", tc.args, tc.addr, tc.ip, got, tc.want)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-egress-default", "maybe"},
+		{"-egress-deny", "a/b"},
+		{"-egress-allow-ports", "70000"},
+		{"-egress-rate", "-1"},
+	} {
+		if _, err := NewConfigStore("stuffpot", args); err == nil {
+			t.Errorf("%v: an invalid policy was accepted", args)
+		}
+	}
+}
+
+func TestEgressRate(t *testing.T) {
+	l := newEgressLimiter()
+	var got []bool
+	for _, addr := range []string{"a.test:80", "A.test.:443", "a.test:80", "b.test:80"} {
+		got = append(got, l.allow(2, addr))
+	}
+	if want := []bool{true, true, false, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the third request to a.test refused", got)
+	}
+	l.mu.Lock()
+	l.windows["a.test"].start = time.Now().Add(-time.Minute)
+	l.mu.Unlock()
+	if !l.allow(2, "a.test:80") {
+		t.Error("a request was refused a minute later")
+	}
+	if !l.allow(0, "a.test:80") {
+		t.Error("a request was refused without a rate")
+	}
+}
+
+func TestEgressRefusals(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	echo := echoServer(t)
+	config := testConfig(t, "-egress-deny", "127.0.0.0/8,::1")
+	s, client := startServer(t, config, nil)
+	refused := egressRefused.Load()
+
+	// The address is refused as the request arrives, the name once it's
+	// resolved, as it's dialed.
+	port := upstream.URL[strings.LastIndex(upstream.URL, ":"):]
+	for _, u := range []string{upstream.URL, "http://localhost" + port} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%v: got %v, want the blocked response", u, resp.Status)
+		}
+	}
+	if _, _, resp := openTunnel(t, client, "localhost"+echo[strings.LastIndex(echo, ":"):]); resp.StatusCode !=
+		http.StatusForbidden {
+		t.Errorf("got %v, want the tunnel refused", resp.Status)
+	}
+	if n := egressRefused.Load() - refused; n != 3 {
+		t.Errorf("got %v refusals counted, want 3", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{{"blocked"}, {"blocked"}}
+	if got := queryRows(t, db, "select error_response from requests"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the requests %v, want %v", got, want)
+	}
+	if got := queryRows(t, db, "select error_response from connects"); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("got the connects %v, want the tunnel blocked", got)
+	}
+}
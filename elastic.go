@@ -0,0 +1,368 @@
+package stuffpot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// elasticTimeout bounds each request to Elasticsearch.
+const elasticTimeout = 30 * time.Second
+
+// elasticMappings are those of the index of the requests, following the
+// Elastic Common Schema where it has the field. The headers, matches and parse
+// anomalies are flattened, as their keys are the clients' choice.
+const elasticMappings = `{
+  "mappings": {
+    "dynamic": false,
+    "properties": {
+      "@timestamp": {"type": "date"},
+      "event": {"properties": {"id": {"type": "keyword"}, "duration": {"type": "long"}}},
+      "source": {"properties": {
+        "ip": {"type": "ip"},
+        "domain": {"type": "keyword"},
+        "geo": {"properties": {"country_iso_code": {"type": "keyword"}, "city_name": {"type": "keyword"},
+          "location": {"type": "geo_point"}}},
+        "as": {"properties": {"number": {"type": "long"}}}
+      }},
+      "http": {"properties": {
+        "version": {"type": "keyword"},
+        "request": {"properties": {"method": {"type": "keyword"}, "headers": {"type": "flattened"}, "bytes": {"type": "long"}}},
+        "response": {"properties": {"status_code": {"type": "short"}, "headers": {"type": "flattened"}, "bytes": {"type": "long"}}}
+      }},
+      "url": {"properties": {
+        "full": {"type": "keyword", "ignore_above": 8191, "fields": {"text": {"type": "text"}}},
+        "domain": {"type": "keyword"},
+        "port": {"type": "integer"},
+        "path": {"type": "keyword", "ignore_above": 8191},
+        "query": {"type": "keyword", "ignore_above": 8191}
+      }},
+      "tls": {"properties": {"client": {"properties": {"ja3": {"type": "keyword"}}},
+        "server": {"properties": {"ja3s": {"type": "keyword"}}}}},
+      "user_agent": {"properties": {"original": {"type": "keyword", "ignore_above": 8191, "fields": {"text": {"type": "text"}}}}},
+      "tags": {"type": "keyword"},
+      "error": {"properties": {"message": {"type": "text"}}},
+      "stuffpot": {"properties": {
+        "parent_id": {"type": "keyword"},
+        "error_response": {"type": "keyword"},
+        "matches": {"type": "flattened"},
+        "parse_anomalies": {"type": "flattened"}
+      }}
+    }
+  }
+}`
+
+// Elastic indexes the completed requests in Elasticsearch with the bulk API,
+// bulkSize at a time or every flush. The index is created with its mappings
+// when it doesn't exist. A bulk request which fails is logged and its
+// requests are lost, as are those of the requests Elasticsearch refuses.
+type Elastic struct {
+	url      string
+	index    string
+	apiKey   string
+	bulkSize int
+	client   *http.Client
+	log      *slog.Logger
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	pending int
+	// err is that of the last bulk request, for the readiness check.
+	err error
+
+	// mapped is set once the index is known to exist, only used by run.
+	mapped bool
+	kick   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewElastic(cfg ElasticConfig) *Elastic {
+	es := &Elastic{
+		url:      strings.TrimRight(cfg.URL, "/"),
+		index:    cfg.Index,
+		apiKey:   cfg.APIKey,
+		bulkSize: cfg.BulkSize,
+		client:   &http.Client{Timeout: elasticTimeout},
+		log:      slog.With("component", "elasticsearch"),
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go es.run(cfg.Flush)
+	return es
+}
+
+// run sends the bulk requests, every flush or once bulkSize requests are
+// pending, until Close.
+func (es *Elastic) run(flush time.Duration) {
+	defer close(es.done)
+	t := time.NewTicker(flush)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-es.kick:
+		case <-es.stop:
+			es.flush()
+			return
+		}
+		es.flush()
+	}
+}
+
+// flush indexes the pending requests.
+func (es *Elastic) flush() {
+	defer contain(es.log, "elasticsearch bulk")
+	es.mu.Lock()
+	body, n := bytes.Clone(es.buf.Bytes()), es.pending
+	es.buf.Reset()
+	es.pending = 0
+	es.mu.Unlock()
+	if n == 0 {
+		return
+	}
+
+	err := es.bulk(body, n)
+	es.mu.Lock()
+	es.err = err
+	es.mu.Unlock()
+	if err != nil {
+		logFailures.Add(int64(n))
+		es.log.Error("Failed to index requests", "requests", n, "error", err)
+	}
+}
+
+// do sends a request to Elasticsearch, returning the response body of the
+// statuses ok accepts.
+func (es *Elastic) do(method, path string, body []byte, contentType string, ok ...int) ([]byte, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), elasticTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, es.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if es.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+es.apiKey)
+	}
+	resp, err := es.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return b, resp.StatusCode, nil
+		}
+	}
+	return nil, resp.StatusCode, fmt.Errorf("%v %v: %v: %.200s", method, path, resp.Status, b)
+}
+
+// ensureIndex creates the index with its mappings unless it exists.
+func (es *Elastic) ensureIndex() error {
+	if es.mapped {
+		return nil
+	}
+	_, status, err := es.do(http.MethodHead, "/"+es.index, nil, "", http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		b, status, err := es.do(http.MethodPut, "/"+es.index, []byte(elasticMappings), "application/json",
+			http.StatusOK, http.StatusBadRequest)
+		if err != nil {
+			return err
+		}
+		// Another instance may have created it meanwhile.
+		if status == http.StatusBadRequest && !bytes.Contains(b, []byte("resource_already_exists_exception")) {
+			return fmt.Errorf("create index %v: %.200s", es.index, b)
+		}
+		es.log.Info("Created the index", "index", es.index)
+	}
+	es.mapped = true
+	return nil
+}
+
+// bulk indexes the n requests of body, logging those refused.
+func (es *Elastic) bulk(body []byte, n int) error {
+	if err := es.ensureIndex(); err != nil {
+		return err
+	}
+	b, _, err := es.do(http.MethodPost, "/_bulk", body, "application/x-ndjson", http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil {
+		return fmt.Errorf("bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	failed := 0
+	var first json.RawMessage
+	for _, item := range result.Items {
+		for _, r := range item {
+			if r.Status >= 300 {
+				failed++
+				if first == nil {
+					first = r.Error
+				}
+			}
+		}
+	}
+	logFailures.Add(int64(failed))
+	es.log.Error("Requests refused by Elasticsearch", "requests", failed, "of", n, "error", string(first))
+	return nil
+}
+
+// elasticDoc returns the document of ex.
+func elasticDoc(ex *Exchange) map[string]interface{} {
+	req := ex.Request
+	source := map[string]interface{}{"ip": ex.ClientIP}
+	if state := ex.state; state != nil {
+		origin := state.origin
+		geo := map[string]interface{}{}
+		if origin.Country != "" {
+			geo["country_iso_code"] = origin.Country
+		}
+		if origin.City != "" {
+			geo["city_name"] = origin.City
+		}
+		if origin.Location != nil {
+			geo["location"] = origin.Location
+		}
+		if len(geo) > 0 {
+			source["geo"] = geo
+		}
+		if origin.ASN != 0 {
+			source["as"] = map[string]interface{}{"number": origin.ASN}
+		}
+		if state.ptr != "" {
+			source["domain"] = state.ptr
+		}
+	}
+	u := map[string]interface{}{"full": req.URL.String(), "domain": req.URL.Hostname(), "path": req.URL.Path}
+	if port, err := strconv.Atoi(req.URL.Port()); err == nil {
+		u["port"] = port
+	}
+	if req.URL.RawQuery != "" {
+		u["query"] = req.URL.RawQuery
+	}
+	doc := map[string]interface{}{
+		"@timestamp": ex.Start.UTC().Format(time.RFC3339Nano),
+		"event":      map[string]interface{}{"id": ex.ID, "duration": ex.End.Sub(ex.Start).Nanoseconds()},
+		"source":     source,
+		"url":        u,
+		"user_agent": map[string]interface{}{"original": req.UserAgent()},
+	}
+	if len(ex.Tags) > 0 {
+		doc["tags"] = ex.Tags
+	}
+	if ex.JA3 != "" || ex.JA3S != "" {
+		tls := map[string]interface{}{}
+		if ex.JA3 != "" {
+			tls["client"] = map[string]interface{}{"ja3": ex.JA3}
+		}
+		if ex.JA3S != "" {
+			tls["server"] = map[string]interface{}{"ja3s": ex.JA3S}
+		}
+		doc["tls"] = tls
+	}
+	httpDoc := map[string]interface{}{
+		"version": strings.TrimPrefix(req.Proto, "HTTP/"),
+		"request": map[string]interface{}{"method": req.Method, "headers": req.Header, "bytes": ex.Received},
+	}
+	if resp := ex.Response; resp != nil {
+		httpDoc["response"] = map[string]interface{}{"status_code": resp.StatusCode, "headers": resp.Header, "bytes": ex.Size}
+	}
+	doc["http"] = httpDoc
+	if ex.Err != nil {
+		doc["error"] = map[string]interface{}{"message": ex.Err.Error()}
+	}
+	sp := map[string]interface{}{}
+	if ex.ParentID != "" {
+		sp["parent_id"] = ex.ParentID
+	}
+	if ex.ErrorResponse != "" {
+		sp["error_response"] = ex.ErrorResponse
+	}
+	if len(ex.Matches) > 0 {
+		sp["matches"] = ex.Matches
+	}
+	if ex.state != nil {
+		if a := ex.state.anomaliesJSON(); a != nil {
+			sp["parse_anomalies"] = a
+		}
+	}
+	if len(sp) > 0 {
+		doc["stuffpot"] = sp
+	}
+	return doc
+}
+
+func (es *Elastic) LogExchange(ctx context.Context, ex *Exchange) error {
+	action, err := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": es.index, "_id": ex.ID}})
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(elasticDoc(ex))
+	if err != nil {
+		return err
+	}
+	es.mu.Lock()
+	es.buf.Write(action)
+	es.buf.WriteByte('\n')
+	es.buf.Write(doc)
+	es.buf.WriteByte('\n')
+	es.pending++
+	full := es.pending >= es.bulkSize
+	es.mu.Unlock()
+	if full {
+		select {
+		case es.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (es *Elastic) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	return nil
+}
+
+// Check fails while the last bulk request did.
+func (es *Elastic) Check(ctx context.Context) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.err
+}
+
+// Close indexes the pending requests.
+func (es *Elastic) Close() error {
+	close(es.stop)
+	<-es.done
+	return nil
+}
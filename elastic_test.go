@@ -0,0 +1,119 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeElastic answers the index and bulk requests of an Elastic sink, the
+// bulk ones with status once the index is created.
+type fakeElastic struct {
+	mu      sync.Mutex
+	created bool
+	status  int
+	auth    []string
+	bulks   chan []byte
+}
+
+func (f *fakeElastic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	switch {
+	case r.Method == "HEAD" && r.URL.Path == "/requests" && !f.created:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == "PUT" && r.URL.Path == "/requests":
+		var mappings map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&mappings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.created = true
+	case r.Method == "POST" && r.URL.Path == "/_bulk":
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(f.status)
+		io.WriteString(w, `{"errors": false, "items": []}`)
+		f.bulks <- body
+	}
+}
+
+func TestElasticBulkIndexing(t *testing.T) {
+	fake := &fakeElastic{status: http.StatusOK, bulks: make(chan []byte, 4)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	es := NewElastic(ElasticConfig{URL: srv.URL + "/", Index: "requests", APIKey: "a2V5", BulkSize: 2, Flush: time.Hour})
+
+	logExchange := func(id string) {
+		req := httptest.NewRequest("GET", "http://a.example:8080/x?a=b", nil)
+		ex := finishedExchange(req, id, &http.Response{StatusCode: 404, Proto: "HTTP/1.1", Header: http.Header{}}, 9)
+		ex.Tags = []string{"scanner"}
+		if err := es.LogExchange(context.Background(), ex); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bulk returns the lines of the next bulk request.
+	bulk := func() []map[string]interface{} {
+		t.Helper()
+		var lines []map[string]interface{}
+		select {
+		case body := <-fake.bulks:
+			sc := bufio.NewScanner(bytes.NewReader(body))
+			for sc.Scan() {
+				var line map[string]interface{}
+				if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+					t.Fatalf("%q: %v", sc.Text(), err)
+				}
+				lines = append(lines, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no bulk request")
+		}
+		return lines
+	}
+
+	// A bulk request is sent once bulk_size requests are pending.
+	logExchange("r1")
+	logExchange("r2")
+	lines := bulk()
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want an action and a document by request", len(lines))
+	}
+	action, _ := lines[2]["index"].(map[string]interface{})
+	doc := lines[3]
+	u, _ := doc["url"].(map[string]interface{})
+	httpDoc, _ := doc["http"].(map[string]interface{})
+	resp, _ := httpDoc["response"].(map[string]interface{})
+	if action["_index"] != "requests" || action["_id"] != "r2" || u["domain"] != "a.example" || u["port"] != 8080.0 ||
+		u["query"] != "a=b" || resp["status_code"] != 404.0 || fmt.Sprint(doc["tags"]) != "[scanner]" {
+		t.Errorf("got %v then %v", lines[2], doc)
+	}
+	fake.mu.Lock()
+	if !fake.created || fake.auth[0] != "ApiKey a2V5" {
+		t.Errorf("the index created: %v, with the authorizations %v", fake.created, fake.auth)
+	}
+	fake.status = http.StatusServiceUnavailable
+	fake.mu.Unlock()
+	if err := es.Check(context.Background()); err != nil {
+		t.Errorf("readiness after a bulk request succeeded: %v", err)
+	}
+
+	// Readiness fails along the bulk requests, and the pending requests are
+	// sent on Close.
+	logExchange("r3")
+	es.Close()
+	if lines := bulk(); len(lines) != 2 {
+		t.Errorf("on Close: got %d lines, want those of the pending request", len(lines))
+	}
+	if err := es.Check(context.Background()); err == nil {
+		t.Error("readiness didn't fail with the bulk request")
+	}
+}
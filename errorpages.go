@@ -0,0 +1,259 @@
+package stuffpot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// errorClasses are the failures the proxy answers itself: the remote can't
+// be reached, the request is refused by a policy, the client is rate limited
+// or must authenticate, or the proxy failed. sandbox isn't one, it fakes the
+// success of the requests the sandbox keeps from their remote.
+var errorClasses = []string{"upstream", "blocked", "rate_limited", "auth_required", "internal", "sandbox"}
+
+// squidVersion is the version the squid preset answers as.
+const squidVersion = "squid/5.7"
+
+// errorPage is the compiled response of an error class. The header values
+// are text templates, the body an HTML one, so that what the client sent is
+// escaped in it.
+type errorPage struct {
+	status  int
+	headers map[string]*texttemplate.Template
+	body    *htmltemplate.Template
+}
+
+// errorPageData are the variables of the error templates. RequestID is empty
+// unless the request ids are sent to the clients.
+type errorPageData struct {
+	Class      string
+	Status     int
+	StatusText string
+	RequestID  string
+	Time       string
+	Method     string
+	URL        string
+	Host       string
+	ClientIP   string
+	Hostname   string
+}
+
+// plainPreset answers with the status and its text.
+var plainPreset = map[string]ErrorResponse{
+	"upstream":     {Status: http.StatusBadGateway, Headers: plainHeaders},
+	"blocked":      {Status: http.StatusForbidden, Headers: plainHeaders},
+	"rate_limited": {Status: http.StatusTooManyRequests, Headers: plainHeaders},
+	"auth_required": {Status: http.StatusProxyAuthRequired, Headers: map[string]string{
+		"Content-Type": "text/plain; charset=utf-8", "Proxy-Authenticate": `Basic realm="proxy"`}},
+	"internal": {Status: http.StatusBadGateway, Headers: plainHeaders},
+	"sandbox":  {Status: http.StatusOK, Headers: plainHeaders},
+}
+
+var plainHeaders = map[string]string{"Content-Type": "text/plain; charset=utf-8"}
+
+const plainBody = "{{.StatusText}}\n"
+
+// squidPreset answers as a default install of Squid would, with its error
+// page of the matching error. Squid has no rate limiting page, its maxconn
+// ACLs deny access.
+var squidPreset = map[string]ErrorResponse{
+	"upstream": squidResponse(http.StatusServiceUnavailable, "ERR_CONNECT_FAIL 111", "Connection to {{.Host}} failed.",
+		"The remote host or network may be down. Please try the request again."),
+	"blocked":      squidResponse(http.StatusForbidden, "ERR_ACCESS_DENIED 0", "Access Denied.", squidDenied),
+	"rate_limited": squidResponse(http.StatusForbidden, "ERR_ACCESS_DENIED 0", "Access Denied.", squidDenied),
+	"auth_required": squidResponse(http.StatusProxyAuthRequired, "ERR_CACHE_ACCESS_DENIED 0", "Cache Access Denied.",
+		"Sorry, you are not currently allowed to request {{.URL}} from this cache until you have authenticated yourself."),
+	"internal": squidResponse(http.StatusServiceUnavailable, "ERR_CANNOT_FORWARD 0",
+		"Unable to forward this request at this time.",
+		"This request could not be forwarded to the origin server or to any parent caches."),
+	"sandbox": {Status: http.StatusOK, Headers: squidHeaders, Body: "\n"},
+}
+
+const squidDenied = "Access control configuration prevents your request from being allowed at this time. " +
+	"Please contact your service provider if you feel this is incorrect."
+
+// squidHeaders are sent along every response of the squid preset.
+var squidHeaders = map[string]string{
+	"Server":           squidVersion,
+	"Mime-Version":     "1.0",
+	"Date":             "{{.Time}}",
+	"Content-Type":     "text/html;charset=utf-8",
+	"Vary":             "Accept-Language",
+	"Content-Language": "en",
+	"X-Cache":          "MISS from {{.Hostname}}",
+	"Via":              "1.1 {{.Hostname}} (" + squidVersion + ")",
+}
+
+// squidResponse returns the response of Squid for the error err, a code
+// followed by an errno.
+func squidResponse(status int, err, title, text string) ErrorResponse {
+	headers := map[string]string{"X-Squid-Error": err}
+	for k, v := range squidHeaders {
+		headers[k] = v
+	}
+	if status == http.StatusProxyAuthRequired {
+		headers["Proxy-Authenticate"] = `Basic realm="Squid proxy-caching web server"`
+	}
+	name, _, _ := strings.Cut(err, " ")
+	return ErrorResponse{Status: status, Headers: headers, Body: squidPage(name, title, text)}
+}
+
+// squidPage returns the error page of Squid for err.
+func squidPage(err, title, text string) string {
+	return `<!DOCTYPE html PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
+<html><head>
+<meta type="copyright" content="Copyright (C) 1996-2022 The Squid Software Foundation and contributors">
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>ERROR: The requested URL could not be retrieved</title>
+</head><body id=` + err + `>
+<div id="titles">
+<h1>ERROR</h1>
+<h2>The requested URL could not be retrieved</h2>
+</div>
+<hr>
+
+<div id="content">
+<p>The following error was encountered while trying to retrieve the URL: <a href="{{.URL}}">{{.URL}}</a></p>
+
+<blockquote id="error">
+<p><b>` + title + `</b></p>
+</blockquote>
+
+<p>` + text + `</p>
+
+<p>Your cache administrator is <a href="mailto:webmaster">webmaster</a>.</p>
+<br>
+</div>
+
+<hr>
+<div id="footer">
+<p>Generated {{.Time}} by {{.Hostname}} (` + squidVersion + `)</p>
+<!-- ` + err + ` -->
+</div>
+</body></html>
+`
+}
+
+// compileErrors validates the error responses, reading their body files,
+// and compiles those of every class from the preset and the overrides.
+func (c *Config) compileErrors() error {
+	var errs []error
+	var preset map[string]ErrorResponse
+	switch c.Errors.Preset {
+	case "plain":
+		preset = plainPreset
+	case "squid":
+		preset = squidPreset
+	default:
+		errs = append(errs, fmt.Errorf("errors.preset: unknown preset %q", c.Errors.Preset))
+	}
+
+	responses := make(map[string]ErrorResponse)
+	for class, r := range preset {
+		if r.Body == "" {
+			r.Body = plainBody
+		}
+		responses[class] = r
+	}
+	for _, r := range c.Errors.Responses {
+		if !slices.Contains(errorClasses, r.Class) {
+			errs = append(errs, fmt.Errorf("errors.responses: unknown class %q", r.Class))
+			continue
+		}
+		if r.Status < 100 || r.Status > 599 {
+			errs = append(errs, fmt.Errorf("errors.responses: %v: invalid status %v", r.Class, r.Status))
+		}
+		if r.BodyFile != "" {
+			b, err := os.ReadFile(r.BodyFile)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("errors.responses: %v: %w", r.Class, err))
+			}
+			r.Body = string(b)
+		}
+		responses[r.Class] = r
+	}
+
+	c.errorHostname = c.Errors.Hostname
+	if c.errorHostname == "" {
+		c.errorHostname, _ = os.Hostname()
+	}
+	c.errorPages = make(map[string]*errorPage)
+	sample := errorPageData{Class: "upstream", Status: 502, StatusText: "Bad Gateway", RequestID: "id",
+		Time: time.Now().UTC().Format(http.TimeFormat), Method: "GET", URL: "http://example.com/", Host: "example.com",
+		ClientIP: "192.0.2.1", Hostname: "localhost"}
+	for class, r := range responses {
+		page := &errorPage{status: r.Status, headers: make(map[string]*texttemplate.Template)}
+		fail := func(err error) {
+			errs = append(errs, fmt.Errorf("errors.responses: %v: %w", class, err))
+		}
+		for k, v := range r.Headers {
+			t, err := texttemplate.New(k).Parse(v)
+			if err == nil {
+				err = t.Execute(io.Discard, sample)
+			}
+			if err != nil {
+				fail(err)
+			}
+			page.headers[http.CanonicalHeaderKey(k)] = t
+		}
+		var err error
+		if page.body, err = htmltemplate.New(class).Parse(r.Body); err == nil {
+			err = page.body.Execute(io.Discard, sample)
+		}
+		if err != nil {
+			fail(err)
+		}
+		c.errorPages[class] = page
+	}
+	return errors.Join(errs...)
+}
+
+// errorResponse returns the response of class to req, a request or a
+// CONNECT whose id is id.
+func (c *Config) errorResponse(class string, req *http.Request, id string) *http.Response {
+	page := c.errorPages[class]
+	data := errorPageData{Class: class, Status: page.status, StatusText: http.StatusText(page.status),
+		Time: time.Now().UTC().Format(http.TimeFormat), Method: req.Method, URL: req.URL.String(), Host: req.URL.Host,
+		ClientIP: clientIP(req.RemoteAddr), Hostname: c.errorHostname}
+	if c.RequestID.Echo {
+		data.RequestID = id
+	}
+	if req.Method == http.MethodConnect {
+		data.URL = req.URL.Host
+	}
+	resp := &http.Response{
+		StatusCode: page.status,
+		Status:     fmt.Sprintf("%d %s", page.status, http.StatusText(page.status)),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	var b strings.Builder
+	for k, t := range page.headers {
+		b.Reset()
+		if err := t.Execute(&b, data); err != nil {
+			slog.Warn("Cannot render error response header", "component", "errors", "class", class, "header", k, "error", err)
+			continue
+		}
+		resp.Header.Set(k, b.String())
+	}
+	var body bytes.Buffer
+	if err := page.body.Execute(&body, data); err != nil {
+		slog.Warn("Cannot render error response", "component", "errors", "class", class, "error", err)
+		body.Reset()
+	}
+	resp.Body, resp.ContentLength = io.NopCloser(&body), int64(body.Len())
+	return resp
+}
@@ -0,0 +1,105 @@
+package stuffpot
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSquidErrorResponses(t *testing.T) {
+	cfg := testConfig(t, "-error-preset", "squid", "-error-hostname", "proxy1").Load()
+	req := httptest.NewRequest("GET", "http://a.example/<script>", nil)
+	resp := cfg.errorResponse("upstream", req, "r1")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("X-Squid-Error") != "ERR_CONNECT_FAIL 111" ||
+		resp.Header.Get("Via") != "1.1 proxy1 (squid/5.7)" || resp.Header.Get("Server") != "squid/5.7" {
+		t.Errorf("got %v with headers %v", resp.Status, resp.Header)
+	}
+	if !strings.Contains(string(body), "Connection to a.example failed.") || strings.Contains(string(body), "<script>") ||
+		int64(len(body)) != resp.ContentLength {
+		t.Errorf("got the page %q of %d bytes", body, resp.ContentLength)
+	}
+
+	connect := httptest.NewRequest("CONNECT", "http://a.example:443", nil)
+	connect.URL.Host = "a.example:443"
+	resp = cfg.errorResponse("auth_required", connect, "r2")
+	body, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" ||
+		!strings.Contains(string(body), "request a.example:443 from this cache") {
+		t.Errorf("a CONNECT: got %v with headers %v and page %q", resp.Status, resp.Header, body)
+	}
+}
+
+func TestErrorResponseOverrides(t *testing.T) {
+	path := writeConfig(t, `errors:
+  responses:
+    - class: blocked
+      status: 451
+      headers:
+        X-Request: "{{.RequestID}}"
+      body: "<p>{{.Method}} {{.URL}} from {{.ClientIP}}</p>"
+`)
+	cfg := testConfig(t, "-config", path, "-request-id-echo").Load()
+	req := httptest.NewRequest("POST", "http://a.example/?q=<b>", nil)
+	resp := cfg.errorResponse("blocked", req, "r1")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 451 || resp.Header.Get("X-Request") != "r1" ||
+		string(body) != "<p>POST http://a.example/?q=&lt;b&gt; from 192.0.2.1</p>" {
+		t.Errorf("got %v with headers %v and body %q", resp.Status, resp.Header, body)
+	}
+	// The other classes keep those of the preset.
+	if resp := cfg.errorResponse("upstream", req, "r1"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("upstream: got %v", resp.Status)
+	}
+
+	path = writeConfig(t, `errors:
+  responses:
+    - class: teapot
+      status: 418
+    - class: blocked
+      status: 99
+    - class: internal
+      status: 500
+      body: "{{.Nope}}"
+`)
+	_, err := NewConfigStore("stuffpot", []string{"-config", path})
+	for _, want := range []string{`unknown class "teapot"`, "blocked: invalid status 99", "internal: template"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want %q", err, want)
+		}
+	}
+}
+
+func TestUnreachableRemotesGetTheUpstreamResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	db := &recordingLogger{}
+	s, client := startServer(t, testConfig(t), db)
+	resp, err := client.Get("http://" + closed + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || string(body) != "Bad Gateway\n" {
+		t.Errorf("got %v %q, want the upstream response of the plain preset", resp.Status, body)
+	}
+	client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+	if logged := db.logged(); len(logged) != 1 || logged[0].ErrorResponse != "upstream" ||
+		errorType(logged[0].Err) != "refused" {
+		t.Errorf("got the exchanges %v, want one answered with the upstream response", logged)
+	}
+}
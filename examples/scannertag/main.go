@@ -0,0 +1,70 @@
+// Scannertag runs the proxy with a hook tagging the requests of well-known
+// scanners by their User-Agent, as an example of extending stuffpot without
+// forking it. It takes the same flags as stuffpot.
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/securized/stuffpot"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+var scanners = []string{"masscan", "zgrab", "nmap", "nuclei", "sqlmap", "nikto"}
+
+// tagScanner adds the scanner tag to the exchanges of known scanners, unless
+// the analysis already did.
+func tagScanner(ex *stuffpot.Exchange) {
+	if slices.Contains(ex.Tags, "scanner") {
+		return
+	}
+	ua := strings.ToLower(ex.Request.UserAgent())
+	for _, name := range scanners {
+		if strings.Contains(ua, name) {
+			ex.Tags = append(ex.Tags, "scanner")
+			return
+		}
+	}
+}
+
+func main() {
+	config, err := stuffpot.NewConfigStore(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	if err := stuffpot.SetupLogging(config.Load()); err != nil {
+		panic(err)
+	}
+
+	server, err := stuffpot.NewServer(config, nil)
+	if err != nil {
+		slog.Error("Cannot start", "error", err)
+		os.Exit(1)
+	}
+	server.OnExchangeComplete(tagScanner)
+	if err := server.Start(); err != nil {
+		slog.Error("Cannot listen", "error", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-server.Err():
+		slog.Error("Listener failed", "error", err)
+	case <-ctx.Done():
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Load().Limits.ShutdownGrace)
+	defer cancel()
+	server.Shutdown(ctx)
+}
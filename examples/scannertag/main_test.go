@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/securized/stuffpot"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagScanner(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want bool
+	}{
+		{"Mozilla/5.0 zgrab/0.x", true},
+		{"masscan/1.3 (https://github.com/robertdavidgraham/masscan)", true},
+		{"Mozilla/5.0 (compatible; Nmap Scripting Engine; https://nmap.org/book/nse.html)", true},
+		{"sqlmap/1.7.2#stable (https://sqlmap.org)", true},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0", false},
+		{"curl/8.5.0", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("User-Agent", tt.ua)
+		ex := &stuffpot.Exchange{Request: req, Tags: []string{"existing"}}
+		tagScanner(ex)
+		want := []string{"existing"}
+		if tt.want {
+			want = append(want, "scanner")
+		}
+		if !slices.Equal(ex.Tags, want) {
+			t.Errorf("%q: got tags %v, want %v", tt.ua, ex.Tags, want)
+		}
+	}
+
+	// The analysis tags some scanners itself.
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("User-Agent", "nikto")
+	ex := &stuffpot.Exchange{Request: req, Tags: []string{"scanner"}}
+	tagScanner(ex)
+	if len(ex.Tags) != 1 {
+		t.Errorf("an exchange already tagged got tags %v", ex.Tags)
+	}
+}
+
+func TestScannerTagIsRecorded(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "log.db")
+	config, err := stuffpot.NewConfigStore("scannertag", []string{"-db", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := stuffpot.NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.OnExchangeComplete(tagScanner)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	// The scanner rule of the payloads only matches whole words, the hook
+	// alone tags this one.
+	agents := map[string]string{"/scanner": "Mozilla/5.0 (compatible; Zgrab2Bot)", "/browser": "curl/8.5.0"}
+	for path, ua := range agents {
+		req, _ := http.NewRequest("GET", upstream.URL+path, nil)
+		req.Header.Set("User-Agent", ua)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select coalesce(tags, ''), url from requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var n int
+	for rows.Next() {
+		var tags, u string
+		if err := rows.Scan(&tags, &u); err != nil {
+			t.Fatal(err)
+		}
+		if scanner := strings.HasSuffix(u, "/scanner"); scanner != (tags == "scanner") {
+			t.Errorf("%v was recorded with tags %q", u, tags)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("recorded %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,200 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Exchange is a request with its response, handed whole to the sinks once the
+// response has been sent to the client, or the request failed or was refused.
+type Exchange struct {
+	ID string
+	// ParentID is the id of the tunnel the request was read from, if any.
+	ParentID string
+	ClientIP string
+	// JA3 is the JA3 hash of the client's ClientHello, for the requests of
+	// MITM'd tunnels, and JA3S that of the remote's ServerHello, for the
+	// requests sent to it over TLS.
+	JA3  string
+	JA3S string
+	// Request is a copy of the request as received from the client, before
+	// the proxy modified it. Its body has been read.
+	Request *http.Request
+	// Response is nil when the request failed. Its body has been read.
+	Response *http.Response
+	// Size is the number of response body bytes sent to the client, and
+	// Received that of request body bytes read from it.
+	Size     int64
+	Received int64
+	// Err is why the request failed, when it did.
+	Err error
+	// ErrorResponse is the class of the error response the proxy served
+	// itself, if it did.
+	ErrorResponse string
+	// Start is when the request was received, Responded when the response
+	// headers arrived from the remote, and End when the exchange was over.
+	Start     time.Time
+	Responded time.Time
+	End       time.Time
+	// Upstream is how long the round trip to the remote took, until the
+	// response headers or the error, 0 without one.
+	Upstream time.Duration
+	// Tags, Matches and SessionID, that of the session of the client the
+	// request is grouped into, are set by the analysis in the logging queue,
+	// before the sinks are called.
+	Tags      []string
+	Matches   []tagMatch
+	SessionID string
+	// RawRequest and RawResponse are the SHA-256 of the request and the
+	// response in the raw store, set by the analysis when it's on.
+	RawRequest  string
+	RawResponse string
+
+	state *requestState
+}
+
+// Status returns the status code of the response, or 0 without one.
+func (ex *Exchange) Status() int {
+	if ex.Response == nil {
+		return 0
+	}
+	return ex.Response.StatusCode
+}
+
+// MarshalJSON gives the exchange as sent to the sinks writing JSON.
+func (ex *Exchange) MarshalJSON() ([]byte, error) {
+	type request struct {
+		Method  string      `json:"method"`
+		URL     string      `json:"url"`
+		Proto   string      `json:"proto"`
+		Headers http.Header `json:"headers"`
+	}
+	type response struct {
+		Status  int         `json:"status"`
+		Proto   string      `json:"proto"`
+		Headers http.Header `json:"headers"`
+		Bytes   int64       `json:"bytes"`
+	}
+	out := struct {
+		ID        string          `json:"request_id"`
+		ParentID  string          `json:"parent_id,omitempty"`
+		Client    string          `json:"client"`
+		JA3       string          `json:"ja3,omitempty"`
+		JA3S      string          `json:"ja3s,omitempty"`
+		Session   string          `json:"session_id,omitempty"`
+		RawReq    string          `json:"raw_request,omitempty"`
+		RawResp   string          `json:"raw_response,omitempty"`
+		Start     time.Time       `json:"start"`
+		Responded *time.Time      `json:"responded,omitempty"`
+		End       time.Time       `json:"end"`
+		Request   request         `json:"request"`
+		Response  *response       `json:"response,omitempty"`
+		Error     string          `json:"error,omitempty"`
+		Served    string          `json:"error_response,omitempty"`
+		Tags      []string        `json:"tags,omitempty"`
+		Matches   []tagMatch      `json:"matches,omitempty"`
+		Anomalies json.RawMessage `json:"parse_anomalies,omitempty"`
+	}{ID: ex.ID, ParentID: ex.ParentID, Client: ex.ClientIP, JA3: ex.JA3, JA3S: ex.JA3S,
+		Session: ex.SessionID, RawReq: ex.RawRequest, RawResp: ex.RawResponse, Start: ex.Start.UTC(), End: ex.End.UTC(),
+		Request: request{ex.Request.Method, ex.Request.URL.String(), ex.Request.Proto, ex.Request.Header},
+		Served:  ex.ErrorResponse, Tags: ex.Tags, Matches: ex.Matches, Anomalies: ex.state.anomaliesJSON()}
+	if !ex.Responded.IsZero() {
+		t := ex.Responded.UTC()
+		out.Responded = &t
+	}
+	if resp := ex.Response; resp != nil {
+		out.Response = &response{resp.StatusCode, resp.Proto, resp.Header, ex.Size}
+	}
+	if ex.Err != nil {
+		out.Error = ex.Err.Error()
+	}
+	return json.Marshal(out)
+}
+
+// exchangeState is the part of requestState following the exchange to its
+// end.
+type exchangeState struct {
+	exchange *Exchange
+	once     sync.Once
+
+	// mu guards scans, scanned, bodyHash, bodies, captured and anomalies, set
+	// by the body readers.
+	mu      sync.Mutex
+	scans   []func() []tagMatch
+	scanned bool
+	// bodies are the decoded bodies read in full, for the search index.
+	bodies []string
+	// captured are the bodies read in full for the bodies table.
+	captured []*capturedBody
+	// bodyHash is the hash of the request body once read, for the dedupe
+	// key.
+	bodyHash string
+	// anomalies are those of the request as received, nil without any. The
+	// trailers are added once the body is read.
+	anomalies *parseAnomalies
+	// received counts the request body bytes read so far.
+	received atomic.Int64
+}
+
+// newExchange starts the exchange of req, copying it before the proxy goes on
+// modifying it.
+func newExchange(req *http.Request, state *requestState) *Exchange {
+	return &Exchange{ID: state.id, ParentID: state.parentID, ClientIP: clientIP(req.RemoteAddr),
+		JA3: state.ja3, Request: req.Clone(context.Background()), Start: state.start, state: state}
+}
+
+// finish ends the exchange with the response sent to the client, or the error
+// the request failed with. Only the first call returns the exchange, to be
+// logged: a request which failed isn't responded to by the proxy, and the
+// other way around.
+func (state *requestState) finish(resp *http.Response, size int64, err error) *Exchange {
+	var ex *Exchange
+	state.once.Do(func() {
+		ex = state.exchange
+		ex.Response, ex.Size, ex.Err, ex.End = resp, size, err, time.Now()
+		ex.Received = state.received.Load()
+	})
+	return ex
+}
+
+// addScan keeps the signature scan of a body read in full, to be run with
+// the analysis of the exchange. It returns false once the exchange has been
+// analyzed, the scan then being the caller's.
+func (state *requestState) addScan(scan func() []tagMatch) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.scanned {
+		return false
+	}
+	state.scans = append(state.scans, scan)
+	return true
+}
+
+// addBody keeps a decoded body for the search index, unless the exchange has
+// been analyzed already.
+func (state *requestState) addBody(body []byte) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if !state.scanned {
+		state.bodies = append(state.bodies, strings.ToValidUTF8(string(body), ""))
+	}
+}
+
+// takeScans returns the scans of the bodies read so far. The bodies read
+// later are scanned on their own.
+func (state *requestState) takeScans() []func() []tagMatch {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.scanned = true
+	scans := state.scans
+	state.scans = nil
+	return scans
+}
@@ -0,0 +1,519 @@
+package stuffpot
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/parquet-go/parquet-go"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// exportRowGroup is the number of rows of each row group, which bounds the
+	// memory held by the writer.
+	exportRowGroup = 50000
+	// exportBatch is the number of rows handed to the writer at once.
+	exportBatch = 1000
+)
+
+// exportedRequest is the schema of the exported requests. Missing values are
+// empty, and the headers are a list in the order they were stored.
+type exportedRequest struct {
+	ID          int64            `parquet:"id"`
+	RequestID   string           `parquet:"request_id"`
+	ParentID    string           `parquet:"parent_id"`
+	ClientIP    string           `parquet:"client_ip"`
+	Method      string           `parquet:"method"`
+	Host        string           `parquet:"host"`
+	URL         string           `parquet:"url"`
+	Headers     []exportedHeader `parquet:"headers,list"`
+	Tags        []string         `parquet:"tags,list"`
+	Status      int32            `parquet:"status"`
+	Size        int64            `parquet:"size"`
+	Fingerprint string           `parquet:"fingerprint"`
+	JA3         string           `parquet:"ja3"`
+	Source      string           `parquet:"source"`
+	Occurrences int64            `parquet:"occurrences"`
+	CreatedAt   time.Time        `parquet:"created_at,timestamp(millisecond)"`
+	LastSeen    time.Time        `parquet:"last_seen,timestamp(millisecond)"`
+}
+
+type exportedHeader struct {
+	Name  string `parquet:"name"`
+	Value string `parquet:"value"`
+}
+
+// parquetExport writes the requests of databases to Parquet files under dir,
+// in dir/day=2006-01-02/ directories when byDay is set.
+type parquetExport struct {
+	dir   string
+	byDay bool
+
+	// file and writer are those of the current partition.
+	file   *os.File
+	writer *parquet.GenericWriter[exportedRequest]
+	day    string
+	files  int
+	rows   int64
+}
+
+// exportFile exports the requests of the database at path, named after it in
+// each partition. They're read in the order of their time, so that each day
+// is written in turn. The database is migrated to the current schema first.
+func (e *parquetExport) exportFile(path string) error {
+	logger, err := NewLogger(path)
+	if err != nil {
+		return err
+	}
+	defer logger.Close()
+
+	rows, err := logger.db.Query(`select id, coalesce(request_id, ''), coalesce(parent_id, ''), coalesce(from_ip, ''),
+      coalesce(method, ''), coalesce(host, ''), coalesce(url, ''), coalesce(headers, ''), coalesce(tags, ''),
+      coalesce(status, 0), coalesce(size, 0), coalesce(fingerprint, ''), coalesce(ja3, ''), coalesce(source, ''),
+      coalesce(occurrences, 1), coalesce(created_at, ''), coalesce(last_seen, created_at, '') from requests
+      order by created_at, id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + ".parquet"
+	batch := make([]exportedRequest, 0, exportBatch)
+	for rows.Next() {
+		var r exportedRequest
+		var headers, tags, created, lastSeen string
+		if err := rows.Scan(&r.ID, &r.RequestID, &r.ParentID, &r.ClientIP, &r.Method, &r.Host, &r.URL, &headers, &tags,
+			&r.Status, &r.Size, &r.Fingerprint, &r.JA3, &r.Source, &r.Occurrences, &created, &lastSeen); err != nil {
+			return err
+		}
+		for _, line := range strings.Split(headers, "\r\n") {
+			if n, v, ok := strings.Cut(line, ": "); ok {
+				r.Headers = append(r.Headers, exportedHeader{n, v})
+			}
+		}
+		if tags != "" {
+			r.Tags = strings.Split(tags, ",")
+		}
+		r.CreatedAt, _ = time.Parse(time.DateTime, created)
+		r.LastSeen, _ = time.Parse(time.DateTime, lastSeen)
+
+		day := ""
+		if e.byDay {
+			day = r.CreatedAt.Format(time.DateOnly)
+		}
+		if e.writer == nil || day != e.day || len(batch) == exportBatch {
+			if err := e.write(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		if e.writer == nil || day != e.day {
+			if err := e.open(day, name); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := e.write(batch); err != nil {
+		return err
+	}
+	return e.close()
+}
+
+// open starts the file of a partition, closing the current one.
+func (e *parquetExport) open(day, name string) error {
+	if err := e.close(); err != nil {
+		return err
+	}
+	dir := e.dir
+	if e.byDay {
+		dir = filepath.Join(dir, "day="+day)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	e.file, e.day, e.files = f, day, e.files+1
+	e.writer = parquet.NewGenericWriter[exportedRequest](f, parquet.Compression(&parquet.Snappy),
+		parquet.MaxRowsPerRowGroup(exportRowGroup), parquet.CreatedBy("stuffpot", version, ""))
+	return nil
+}
+
+func (e *parquetExport) write(batch []exportedRequest) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	n, err := e.writer.Write(batch)
+	e.rows += int64(n)
+	return err
+}
+
+// close writes the footer of the current file.
+func (e *parquetExport) close() error {
+	if e.writer == nil {
+		return nil
+	}
+	err := e.writer.Close()
+	if cerr := e.file.Close(); err == nil {
+		err = cerr
+	}
+	e.writer, e.file = nil, nil
+	return err
+}
+
+// importParquetFile imports the requests of an exported Parquet file into the
+// database of logger, in one transaction. The requests it already has, by
+// their request id, are skipped. The stats aren't updated.
+func importParquetFile(ctx context.Context, logger *HttpLogger, path string) (imported, duplicates int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	reader := parquet.NewGenericReader[exportedRequest](f)
+	defer reader.Close()
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	tx, err := logger.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	insert, err := tx.PrepareContext(ctx, `insert into requests (request_id, parent_id, from_ip, method, host, url, headers,
+      tags, status, size, fingerprint, ja3, source, occurrences, last_seen, created_at)
+      select ?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,? where not exists (select 1 from requests where request_id = ?)`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer insert.Close()
+
+	// Empty values are stored as null, as the proxy stores them.
+	null := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	batch := make([]exportedRequest, exportBatch)
+	for {
+		n, err := reader.Read(batch)
+		for _, r := range batch[:n] {
+			lines := make([]string, len(r.Headers))
+			for i, h := range r.Headers {
+				lines[i] = h.Name + ": " + h.Value
+			}
+			created, lastSeen := r.CreatedAt.UTC().Format(time.DateTime), r.LastSeen.UTC().Format(time.DateTime)
+			res, err := insert.ExecContext(ctx, r.RequestID, null(r.ParentID), r.ClientIP, r.Method, r.Host, r.URL,
+				null(strings.Join(lines, "\r\n")), null(strings.Join(r.Tags, ",")), r.Status, r.Size, null(r.Fingerprint),
+				null(r.JA3), null(r.Source), r.Occurrences, lastSeen, created, r.RequestID)
+			if err != nil {
+				return 0, 0, err
+			}
+			if rows, _ := res.RowsAffected(); rows == 0 {
+				duplicates++
+			} else {
+				imported++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return imported, duplicates, tx.Commit()
+}
+
+// parquetFiles returns the files of paths, and the Parquet files found in the
+// directories among them.
+func parquetFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		err := filepath.WalkDir(p, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// The files given are taken whatever their extension.
+			if !d.IsDir() && (path == p || filepath.Ext(path) == ".parquet") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// parquetImportCommand implements the parquet import:
+//
+//	stuffpot import parquet [-db path] file.parquet|dir...
+//
+// It imports the requests of Parquet files written by the export into the
+// database, and rebuilds its stats.
+func parquetImportCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot import parquet", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database the requests are imported into")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stuffpot import parquet [-db path] file.parquet|dir...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	files, err := parquetFiles(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := NewLogger("file:" + *path + "?_busy_timeout=10000")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer logger.Close()
+	logger.setTrafficTop(cfg.Storage.HostTrafficTop)
+	for _, file := range files {
+		imported, duplicates, err := importParquetFile(context.Background(), logger, file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+			logger.Close()
+			os.Exit(1)
+		}
+		fmt.Printf("%v: %d imported, %d duplicates\n", file, imported, duplicates)
+	}
+	if err := logger.reindexStats(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", *path, err)
+		logger.Close()
+		os.Exit(1)
+	}
+}
+
+// exportCommand implements the export subcommand:
+//
+//	stuffpot export parquet [-db path] -o dir [-partition-by day|none]
+//	stuffpot export har [-db path] [-o file] [filters] [request_id...]
+//	stuffpot export burp [-db path] [-raw-dir dir] [-o file] [filters] [request_id...]
+//
+// It writes the requests of the database and of its daily files as Parquet
+// files, one per database and partition, migrating them to the current schema
+// first, which parquetImportCommand reads back. The HAR and Burp exports are
+// those of harExportCommand and burpExportCommand.
+func exportCommand(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "har":
+			harExportCommand(args[1:])
+			return
+		case "burp":
+			burpExportCommand(args[1:])
+			return
+		}
+	}
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot export parquet", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	out := fs.String("o", "", "Directory the Parquet files are written to")
+	partition := fs.String("partition-by", "day", "Partitioning of the files: day, in day=2006-01-02 directories, or none")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stuffpot export parquet [-db path] -o dir [-partition-by day|none]")
+		fmt.Fprintln(fs.Output(), "       stuffpot export har [-db path] [-o file] [filters] [request_id...]")
+		fmt.Fprintln(fs.Output(), "       stuffpot export burp [-db path] [-raw-dir dir] [-o file] [filters] [request_id...]")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "parquet" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fs.Parse(args[1:])
+	if *out == "" || fs.NArg() > 0 || (*partition != "day" && *partition != "none") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	paths, err := databaseFiles(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	e := &parquetExport{dir: *out, byDay: *partition == "day"}
+	for _, p := range paths {
+		if err := e.exportFile(p); err != nil {
+			e.close()
+			fmt.Fprintf(os.Stderr, "%v: %v\n", p, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("%d requests exported to %d files\n", e.rows, e.files)
+}
+
+// requestReader reads the logged requests, as the admin API lists them.
+type requestReader interface {
+	listRequests(ctx context.Context, q *requestQuery) (*requestPage, error)
+	getRequest(ctx context.Context, requestID string) (*requestDetail, error)
+}
+
+// readRequests calls fn with the requests of ids, leaving out those unknown
+// to db.
+func readRequests(ctx context.Context, db requestReader, ids []string, fn func(*requestDetail) error) error {
+	for _, id := range ids {
+		d, err := db.getRequest(ctx, id)
+		if err != nil {
+			return err
+		}
+		if d == nil {
+			continue
+		}
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listedIDs returns the request ids of a page, the oldest first.
+func listedIDs(page *requestPage, desc bool) []string {
+	ids := make([]string, 0, len(page.Requests))
+	for _, r := range page.Requests {
+		ids = append(ids, r.RequestID)
+	}
+	if desc {
+		slices.Reverse(ids)
+	}
+	return ids
+}
+
+// requestSelection is the requests selected by the flags of an export: those
+// of the ids given, or else those matching the filters, up to the limit.
+type requestSelection struct {
+	path   string
+	values url.Values
+	limit  int
+	ids    []string
+}
+
+// addFlags adds the flags of the selection to fs.
+func (sel *requestSelection) addFlags(fs *flag.FlagSet, cfg *Config) {
+	sel.values = url.Values{}
+	fs.StringVar(&sel.path, "db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	for _, name := range []string{"client", "host", "method", "tag", "session", "since", "until"} {
+		fs.Func(name, "Only the requests with this "+name+", as filtered by /api/requests", func(v string) error {
+			sel.values.Set(name, v)
+			return nil
+		})
+	}
+	fs.IntVar(&sel.limit, "limit", 0, "Maximum number of requests exported, 0 for all")
+}
+
+// parse takes the ids from the arguments left by fs, and checks the filters.
+func (sel *requestSelection) parse(fs *flag.FlagSet) error {
+	if sel.limit < 0 {
+		return fmt.Errorf("limit: must not be negative")
+	}
+	sel.ids = fs.Args()
+	sel.values.Set("sort", "created_at")
+	sel.values.Set("limit", strconv.Itoa(maxPageSize))
+	_, err := parseRequestQuery(sel.values)
+	return err
+}
+
+// each calls fn with the selected requests of the database and of its daily
+// files, the oldest first. The databases are migrated to the current schema
+// first.
+func (sel *requestSelection) each(ctx context.Context, fn func(*requestDetail) error) error {
+	paths, err := databaseFiles(sel.path)
+	if err != nil {
+		return err
+	}
+	n := 0
+	count := func(d *requestDetail) error {
+		n++
+		return fn(d)
+	}
+	for _, p := range paths {
+		err := func() error {
+			logger, err := NewLogger(p)
+			if err != nil {
+				return err
+			}
+			defer logger.Close()
+			if len(sel.ids) > 0 {
+				return readRequests(ctx, logger, sel.ids, count)
+			}
+			values := maps.Clone(sel.values)
+			for sel.limit == 0 || n < sel.limit {
+				q, err := parseRequestQuery(values)
+				if err != nil {
+					return err
+				}
+				if sel.limit > 0 {
+					q.Limit = min(q.Limit, sel.limit-n)
+				}
+				page, err := logger.listRequests(ctx, q)
+				if err != nil {
+					return err
+				}
+				if err := readRequests(ctx, logger, listedIDs(page, q.Desc), count); err != nil {
+					return err
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				values.Set("cursor", page.NextCursor)
+			}
+			return nil
+		}()
+		if err != nil {
+			return fmt.Errorf("%v: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// writeExport has write write an export to the file at path, or to the
+// standard output when path is empty.
+func writeExport(path string, write func(io.Writer) error) error {
+	if path == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
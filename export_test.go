@@ -0,0 +1,139 @@
+package stuffpot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParquetExportImportRoundTrip(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer upstream.Close()
+
+	src := filepath.Join(t.TempDir(), "log.db")
+	config, err := NewConfigStore("stuffpot", []string{"-db", src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, client := startServer(t, config, nil)
+	const n = 30
+	for i := 0; i < n; i++ {
+		u := upstream.URL + []string{"/", "/missing", "/search?q=1'%20OR%20'1'='1", "/wp-login.php"}[i%4]
+		req, _ := http.NewRequest("GET", u, nil)
+		req.Header.Set("X-Request", fmt.Sprint(i))
+		if i%3 == 0 {
+			req.Header.Set("User-Agent", "sqlmap/1.7")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// A connection the client dialed but didn't use would hold Shutdown.
+	client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	out := t.TempDir()
+	e := &parquetExport{dir: out, byDay: true}
+	if err := e.exportFile(src); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if e.rows != n {
+		t.Fatalf("exported %d requests, want %d", e.rows, n)
+	}
+	files, err := parquetFiles([]string{out})
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got the files %v, %v, want one", files, err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "imported.db")
+	imported, err := NewLogger(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.Close()
+	for pass := 0; pass < 2; pass++ {
+		added, duplicates, err := importParquetFile(context.Background(), imported, files[0])
+		if err != nil {
+			t.Fatalf("import: %v", err)
+		}
+		// Importing the file again adds nothing.
+		want := [2]int{n, 0}
+		if pass == 1 {
+			want = [2]int{0, n}
+		}
+		if [2]int{added, duplicates} != want {
+			t.Errorf("import %d: %d imported, %d duplicates, want %v", pass, added, duplicates, want)
+		}
+	}
+	if err := imported.reindexStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := NewLogger(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer original.Close()
+	// The export keeps these columns of the requests, and the stats rebuilt
+	// from them. The client scores are the proxy's, and aren't exported.
+	exported := map[string]string{
+		"requests": `select request_id, coalesce(parent_id, ''), from_ip, method, host, url, coalesce(headers, ''),
+          coalesce(tags, ''), coalesce(status, 0), coalesce(size, 0), coalesce(fingerprint, ''), coalesce(ja3, ''),
+          coalesce(source, ''), coalesce(occurrences, 1), created_at, coalesce(last_seen, created_at)
+          from requests order by created_at, request_id`,
+		"client_stats":         "select ip, first_seen, last_seen, requests, bytes, errors from client_stats order by ip",
+		"client_tag_stats":     "select * from client_tag_stats order by 1, 2",
+		"host_stats":           "select * from host_stats order by 1",
+		"host_clients":         "select * from host_clients order by 1, 2",
+		"daily_client_stats":   "select * from daily_client_stats order by 1, 2",
+		"daily_host_stats":     "select * from daily_host_stats order by 1, 2",
+		"daily_tag_stats":      "select * from daily_tag_stats order by 1, 2",
+		"host_traffic":         "select * from host_traffic order by 1, 2",
+		"host_traffic_clients": "select * from host_traffic_clients order by 1, 2, 3",
+	}
+	tables, err := tableNames(original.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		query, ok := exported[table]
+		if table == "metadata" || table == "schema_version" {
+			continue
+		}
+		if !ok {
+			// The other tables aren't exported, and are left empty.
+			if rows := tableRows(t, imported.db, table); len(rows) > 0 {
+				t.Errorf("%v: got %d rows from an import of the requests", table, len(rows))
+			}
+			continue
+		}
+		want, got := queryRows(t, original.db, query), queryRows(t, imported.db, query)
+		if len(want) == 0 {
+			t.Errorf("%v: empty in the exported database", table)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v:\nimported %v\nexported %v", table, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out, "day="+time.Now().UTC().Format(time.DateOnly), "log.parquet")); err != nil {
+		t.Errorf("the file isn't in the partition of the day: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package stuffpot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	texttemplate "text/template"
+	"time"
+)
+
+// maxFakeRequestBody bounds the bytes of a request body read before it's
+// answered by a fake response, for them to be captured.
+const maxFakeRequestBody = 1 << 20
+
+// FakeRule answers the requests it matches itself, with a canned response,
+// instead of forwarding them: the proxy passes for the service the response
+// is copied from. Every pattern given must match, a rule without any matching
+// every request, and the first rule matching answers.
+type FakeRule struct {
+	Name   string `yaml:"name"`
+	Method string `yaml:"method"`
+	Host   string `yaml:"host"`
+	Path   string `yaml:"path"`
+	// Status is 200 by default. The header values are text templates and
+	// the body an HTML one, of the variables of fakeData.
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	// BodyFile replaces Body, it's relative to the rule file and read with
+	// it.
+	BodyFile string `yaml:"body_file"`
+
+	// dir is that of the rule file.
+	dir                string
+	method, host, path *regexp.Regexp
+	headers            map[string]*texttemplate.Template
+	body               *htmltemplate.Template
+}
+
+// fakeData are the variables of the fake response templates.
+type fakeData struct {
+	Rule      string
+	RequestID string
+	Time      string
+	Method    string
+	URL       string
+	Host      string
+	Path      string
+	Query     string
+	ClientIP  string
+	Header    http.Header
+}
+
+func (r *FakeRule) compile() error {
+	if r.Name == "" {
+		return errors.New("missing name")
+	}
+	var errs []error
+	for _, p := range []struct {
+		re      **regexp.Regexp
+		name, s string
+	}{{&r.method, "method", r.Method}, {&r.host, "host", r.Host}, {&r.path, "path", r.Path}} {
+		if p.s == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", p.name, err))
+		}
+		*p.re = re
+	}
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	if r.Status < 100 || r.Status > 599 {
+		errs = append(errs, fmt.Errorf("invalid status %v", r.Status))
+	}
+	if r.BodyFile != "" {
+		path := r.BodyFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(r.dir, path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		r.Body = string(b)
+	}
+
+	sample := fakeData{Rule: r.Name, RequestID: "id", Time: time.Now().UTC().Format(http.TimeFormat), Method: "GET",
+		URL: "http://example.com/?q=1", Host: "example.com", Path: "/", Query: "q=1", ClientIP: "192.0.2.1",
+		Header: http.Header{}}
+	r.headers = make(map[string]*texttemplate.Template)
+	for k, v := range r.Headers {
+		if !headerName.MatchString(k) {
+			errs = append(errs, fmt.Errorf("headers: invalid name %q", k))
+			continue
+		}
+		t, err := texttemplate.New(k).Parse(v)
+		if err == nil {
+			err = t.Execute(io.Discard, sample)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("headers: %w", err))
+		}
+		r.headers[http.CanonicalHeaderKey(k)] = t
+	}
+	var err error
+	if r.body, err = htmltemplate.New(r.Name).Parse(r.Body); err == nil {
+		err = r.body.Execute(io.Discard, sample)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("body: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *FakeRule) match(req *http.Request) bool {
+	return (r.method == nil || r.method.MatchString(req.Method)) &&
+		(r.host == nil || r.host.MatchString(req.URL.Hostname())) &&
+		(r.path == nil || r.path.MatchString(req.URL.Path))
+}
+
+// fake returns the response of the first fake rule matching req, whose id is
+// id, with the name of the rule, or nil when none does.
+func (rules *Rules) fake(req *http.Request, id string) (*http.Response, string) {
+	for _, r := range rules.Fakes {
+		if r.match(req) {
+			return r.respond(req, id), r.Name
+		}
+	}
+	return nil, ""
+}
+
+// respond renders the response of r to req. A template failing on what the
+// client sent leaves its header out, or the body empty.
+func (r *FakeRule) respond(req *http.Request, id string) *http.Response {
+	data := fakeData{Rule: r.Name, RequestID: id, Time: time.Now().UTC().Format(http.TimeFormat), Method: req.Method,
+		URL: req.URL.String(), Host: req.URL.Hostname(), Path: req.URL.Path, Query: req.URL.RawQuery,
+		ClientIP: clientIP(req.RemoteAddr), Header: req.Header}
+	resp := &http.Response{
+		StatusCode: r.Status,
+		Status:     strconv.Itoa(r.Status) + " " + http.StatusText(r.Status),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	log := slog.With("component", "fakes", "rule", r.Name, "request_id", id)
+	var b bytes.Buffer
+	for k, t := range r.headers {
+		b.Reset()
+		if err := t.Execute(&b, data); err != nil {
+			log.Warn("Cannot render fake response header", "header", k, "error", err)
+			continue
+		}
+		resp.Header.Set(k, b.String())
+	}
+	var body bytes.Buffer
+	if err := r.body.Execute(&body, data); err != nil {
+		log.Warn("Cannot render fake response", "error", err)
+		body.Reset()
+	}
+	resp.Body, resp.ContentLength = io.NopCloser(&body), int64(body.Len())
+	return resp
+}
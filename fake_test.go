@@ -0,0 +1,159 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeFakes writes a rule file of fakes answering POSTs to /login on any
+// host, from a body file, and returns its path.
+func writeFakes(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "login.html"), []byte(`<p>{{.Header.Get "User-Agent"}}</p>`),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "fakes.yaml")
+	if err := os.WriteFile(path, []byte(`fakes:
+  - name: jenkins
+    method: ^POST$
+    path: ^/login$
+    status: 403
+    headers:
+      X-Jenkins: "2.401.1"
+      Set-Cookie: "JSESSIONID.{{.RequestID}}=node01; Path=/"
+    body_file: login.html
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFakeRules(t *testing.T) {
+	rules, err := loadRules([]string{writeFakes(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "http://ci.example/login", nil)
+	req.Header.Set("User-Agent", "<script>")
+	resp, name := rules.fake(req, "r1")
+	if resp == nil || name != "jenkins" {
+		t.Fatalf("got %v, %q, want the response of jenkins", resp, name)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || resp.Status != "403 Forbidden" ||
+		resp.Header.Get("X-Jenkins") != "2.401.1" || resp.Header.Get("Set-Cookie") != "JSESSIONID.r1=node01; Path=/" ||
+		string(body) != "<p>&lt;script&gt;</p>" || resp.ContentLength != int64(len(body)) {
+		t.Errorf("got %v %v %q, want the rendered response", resp.Status, resp.Header, body)
+	}
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "http://ci.example/login", nil),
+		httptest.NewRequest("POST", "http://ci.example/login/x", nil),
+	} {
+		if resp, _ := rules.fake(req, "r2"); resp != nil {
+			t.Errorf("%v %v was faked", req.Method, req.URL)
+		}
+	}
+
+	// A rule without patterns catches every request, with a 200.
+	catchAll := &FakeRule{Name: "all", Body: "hi"}
+	if err := catchAll.compile(); err != nil {
+		t.Fatal(err)
+	}
+	rules = &Rules{Fakes: []*FakeRule{catchAll}}
+	if resp, _ := rules.fake(httptest.NewRequest("DELETE", "http://x.example/any", nil), "r3"); resp == nil ||
+		resp.StatusCode != http.StatusOK {
+		t.Errorf("got %v, want the catch-all to answer", resp)
+	}
+
+	for _, r := range []*FakeRule{
+		{},
+		{Name: "path", Path: "("},
+		{Name: "status", Status: 700},
+		{Name: "file", BodyFile: "missing.html", dir: t.TempDir()},
+		{Name: "header", Headers: map[string]string{"Bad Name": "x"}},
+		{Name: "header template", Headers: map[string]string{"X": "{{.Nope}}"}},
+		{Name: "body", Body: "{{"},
+	} {
+		if err := r.compile(); err == nil {
+			t.Errorf("%q: an invalid rule compiled", r.Name)
+		}
+	}
+}
+
+func TestFakeResponsesAreServedAndLogged(t *testing.T) {
+	var forwarded atomic.Int32
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		io.WriteString(w, "hello")
+	}))
+	defer plain.Close()
+	plainHost := strings.TrimPrefix(plain.URL, "http://")
+	config := testConfig(t, "-rules", writeFakes(t), "-http-ports", plainHost[strings.LastIndex(plainHost, ":")+1:])
+	s, client := startServer(t, config, nil)
+
+	resp, err := client.Post(plain.URL+"/login", "application/x-www-form-urlencoded", strings.NewReader("u=a&p=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-Jenkins") == "" {
+		t.Errorf("got %v %v, want the fake response", resp.Status, resp.Header)
+	}
+
+	// In a tunnel parsed as HTTP, the request after the faked one is
+	// forwarded.
+	conn, br, _ := openTunnel(t, client, plainHost)
+	fmt.Fprintf(conn, "POST /login HTTP/1.1\r\nHost: %v\r\nContent-Length: 7\r\n\r\nu=b&p=2"+
+		"GET /next HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", plainHost, plainHost)
+	var got []string
+	for range 2 {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		got = append(got, fmt.Sprintf("%v %s", resp.StatusCode, body))
+	}
+	conn.Close()
+	if want := []string{"403 <p></p>", "200 hello"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got the responses %q in the tunnel, want %q", got, want)
+	}
+	if n := forwarded.Load(); n != 1 {
+		t.Errorf("got %v requests forwarded, want only the one not faked", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The bodies of the faked requests were read.
+	want := [][]string{
+		{plain.URL + "/login", "403", "7", "fake:jenkins"},
+		{plain.URL + "/login", "403", "7", "fake:jenkins"},
+		{plain.URL + "/next", "200", "0", ""},
+	}
+	rows := queryRows(t, db, "select url, status, request_size, coalesce(tags, '') from requests order by id")
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got the requests %v, want %v", rows, want)
+	}
+}
@@ -0,0 +1,494 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxFeed bounds the size of a downloaded feed.
+	maxFeed = 64 << 20
+	// maxFeedSeen bounds the clients and hosts of a feed whose first match
+	// is remembered, to only log it once.
+	maxFeedSeen = 10000
+	// abuseIPDBBlacklist is the endpoint of the AbuseIPDB feeds by default.
+	abuseIPDBBlacklist = "https://api.abuseipdb.com/api/v2/blacklist"
+)
+
+// ipSet matches addresses against addresses and networks. Single addresses
+// are kept in a map, networks in a binary trie per family.
+type ipSet struct {
+	addrs  map[netip.Addr]struct{}
+	v4, v6 *trieNode
+	size   int
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	// leaf ends a network, every address below it matches.
+	leaf bool
+}
+
+func newIPSet() *ipSet {
+	return &ipSet{addrs: make(map[netip.Addr]struct{})}
+}
+
+func (s *ipSet) add(p netip.Prefix) {
+	if a := p.Addr(); a.Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(a.Unmap(), p.Bits()-96)
+	}
+	p = p.Masked()
+	s.size++
+	if p.IsSingleIP() {
+		s.addrs[p.Addr()] = struct{}{}
+		return
+	}
+	root := &s.v6
+	if p.Addr().Is4() {
+		root = &s.v4
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+	n := *root
+	b := p.Addr().AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		if n.leaf {
+			return
+		}
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = &trieNode{}
+		}
+		n = n.child[bit]
+	}
+	n.leaf = true
+}
+
+func (s *ipSet) contains(a netip.Addr) bool {
+	a = a.Unmap()
+	if _, ok := s.addrs[a]; ok {
+		return true
+	}
+	n := s.v6
+	if a.Is4() {
+		n = s.v4
+	}
+	b := a.AsSlice()
+	for i := 0; n != nil; i++ {
+		if n.leaf {
+			return true
+		}
+		if i == len(b)*8 {
+			return false
+		}
+		n = n.child[b[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+// feedSet is the entries of a feed: addresses and networks, and domains,
+// which their subdomains match too.
+type feedSet struct {
+	ips     *ipSet
+	domains map[string]struct{}
+}
+
+func newFeedSet() *feedSet {
+	return &feedSet{ips: newIPSet(), domains: make(map[string]struct{})}
+}
+
+func (s *feedSet) size() int {
+	return s.ips.size + len(s.domains)
+}
+
+// add adds an address, a network, a domain or the host of a URL, ignoring
+// anything else.
+func (s *feedSet) add(v string) {
+	if p, err := netip.ParsePrefix(v); err == nil {
+		s.ips.add(p)
+		return
+	}
+	if a, err := netip.ParseAddr(strings.Trim(v, "[]")); err == nil {
+		s.ips.add(netip.PrefixFrom(a, a.BitLen()))
+		return
+	}
+	if strings.Contains(v, "://") {
+		if u, err := url.Parse(v); err == nil && u.Hostname() != "" {
+			s.add(u.Hostname())
+		}
+		return
+	}
+	name := strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(v, ".")), "*.")
+	if strings.Contains(name, ".") && !strings.ContainsAny(name, "/:@") && validHostName(name) {
+		s.domains[name] = struct{}{}
+	}
+}
+
+// domain returns the listed domain host is, or is a subdomain of.
+func (s *feedSet) domain(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(s.domains) == 0 || host == "" {
+		return "", false
+	}
+	for {
+		if _, ok := s.domains[host]; ok {
+			return host, true
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return "", false
+		}
+		host = parent
+	}
+}
+
+// parseFeed reads a feed in its format. Text feeds have an entry per line.
+// Anything after a # or a ; is a comment, as are the fields after the first,
+// but for the lines of hosts files, which sink a domain to 0.0.0.0 or
+// 127.0.0.1.
+func parseFeed(r io.Reader, format string) (*feedSet, error) {
+	if format == "stix" {
+		return parseSTIX(r)
+	}
+	set := newFeedSet()
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line, _, _ = strings.Cut(line, ";")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case len(fields) > 1 && (fields[0] == "0.0.0.0" || fields[0] == "127.0.0.1"):
+			set.add(fields[1])
+		default:
+			set.add(fields[0])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if set.size() == 0 {
+		return nil, fmt.Errorf("no entries")
+	}
+	return set, nil
+}
+
+// stixPattern matches the comparisons of the patterns of STIX indicators
+// whose value is an entry.
+var stixPattern = regexp.MustCompile(`(ipv4-addr|ipv6-addr|domain-name|url):value\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+// parseSTIX reads the indicators and the address, domain and URL objects of a
+// STIX 2 bundle. Revoked and expired indicators are left out.
+func parseSTIX(r io.Reader) (*feedSet, error) {
+	var bundle struct {
+		Objects []struct {
+			Type       string    `json:"type"`
+			Value      string    `json:"value"`
+			Pattern    string    `json:"pattern"`
+			Revoked    bool      `json:"revoked"`
+			ValidUntil time.Time `json:"valid_until"`
+		} `json:"objects"`
+	}
+	if err := json.NewDecoder(r).Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("STIX bundle: %w", err)
+	}
+	set := newFeedSet()
+	now := time.Now()
+	for _, o := range bundle.Objects {
+		switch o.Type {
+		case "ipv4-addr", "ipv6-addr", "domain-name", "url":
+			set.add(o.Value)
+		case "indicator":
+			if o.Revoked || !o.ValidUntil.IsZero() && o.ValidUntil.Before(now) {
+				continue
+			}
+			for _, m := range stixPattern.FindAllStringSubmatch(o.Pattern, -1) {
+				set.add(strings.ReplaceAll(m[2], `\'`, "'"))
+			}
+		}
+	}
+	if set.size() == 0 {
+		return nil, fmt.Errorf("no entries")
+	}
+	return set, nil
+}
+
+// feed is one threat feed, refreshed in the background. A refresh which
+// fails keeps the current list.
+type feed struct {
+	FeedConfig
+	set     atomic.Pointer[feedSet]
+	matches atomic.Int64
+	blocks  atomic.Int64
+
+	mu           sync.Mutex
+	fetchedAt    time.Time
+	attempted    time.Time
+	err          error
+	etag         string
+	lastModified string
+	// seen are the clients and hosts whose match was logged since the last
+	// refresh, up to maxFeedSeen.
+	seen map[string]bool
+}
+
+func (f *feed) tag() string {
+	return "feed:" + f.Name
+}
+
+// feeds are the feeds of the config, which are only read at startup.
+type feeds struct {
+	list   []*feed
+	log    *slog.Logger
+	client *http.Client
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newFeeds(configs []FeedConfig) *feeds {
+	fs := &feeds{
+		log:    slog.With("component", "feeds"),
+		client: &http.Client{Timeout: torTimeout},
+		stop:   make(chan struct{}),
+	}
+	for _, c := range configs {
+		fs.list = append(fs.list, &feed{FeedConfig: c})
+	}
+	return fs
+}
+
+// run refreshes every feed in the background until close is called.
+func (fs *feeds) run() {
+	for _, f := range fs.list {
+		fs.wg.Add(1)
+		go func() {
+			defer fs.wg.Done()
+			defer contain(fs.log, "feed refresh")
+			for {
+				fs.refresh(f)
+				select {
+				case <-fs.stop:
+					return
+				case <-time.After(f.Refresh):
+				}
+			}
+		}()
+	}
+}
+
+func (fs *feeds) refresh(f *feed) {
+	var set *feedSet
+	var err error
+	if f.File != "" {
+		set, err = fs.read(f)
+	} else {
+		set, err = fs.download(f)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempted = time.Now()
+	f.err = err
+	if err != nil {
+		fs.log.Warn("Keeping current feed, refresh failed", "feed", f.Name, "error", err)
+		return
+	}
+	f.fetchedAt = f.attempted
+	if set == nil {
+		fs.log.Debug("Feed unchanged", "feed", f.Name)
+		return
+	}
+	f.set.Store(set)
+	f.seen = nil
+	fs.log.Info("Feed refreshed", "feed", f.Name, "entries", set.size())
+}
+
+func (fs *feeds) read(f *feed) (*feedSet, error) {
+	file, err := os.Open(f.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	set, err := parseFeed(file, f.Format)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", f.File, err)
+	}
+	return set, nil
+}
+
+// download fetches the feed, unless it's unchanged since the last download in
+// which case the set returned is nil.
+func (fs *feeds) download(f *feed) (*feedSet, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-fs.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.Format == "abuseipdb" {
+		req.Header.Set("Key", f.APIKey)
+		req.Header.Set("Accept", "text/plain")
+	}
+	f.mu.Lock()
+	etag, lastModified := f.etag, f.lastModified
+	f.mu.Unlock()
+	if f.set.Load() != nil {
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%v: %v", f.URL, resp.Status)
+	}
+	set, err := parseFeed(io.LimitReader(resp.Body, maxFeed), f.Format)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", f.URL, err)
+	}
+	f.mu.Lock()
+	f.etag, f.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	f.mu.Unlock()
+	return set, nil
+}
+
+// match returns the tags of the feeds listing ip, or the domain of host, and
+// counts the matches. The first match of each client or host of a feed is
+// logged.
+func (fs *feeds) match(ip, host string) []tagMatch {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	var matches []tagMatch
+	for _, f := range fs.list {
+		set := f.set.Load()
+		if set == nil {
+			continue
+		}
+		m := tagMatch{Tag: f.tag(), Location: "client", Match: ip, Source: f.Name}
+		if !set.ips.contains(a) {
+			domain, ok := set.domain(host)
+			if !ok {
+				continue
+			}
+			m.Location, m.Match = "host", domain
+		}
+		f.matches.Add(1)
+		matches = append(matches, m)
+		if f.firstMatch(m.Match) {
+			fs.log.Warn("Feed match", "feed", f.Name, "client", ip, "host", host, "entry", m.Match)
+		}
+	}
+	return matches
+}
+
+// firstMatch tells whether entry matched for the first time since the last
+// refresh, as far as it's remembered.
+func (f *feed) firstMatch(entry string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seen[entry] {
+		return false
+	}
+	if f.seen == nil || len(f.seen) >= maxFeedSeen {
+		f.seen = make(map[string]bool)
+	}
+	f.seen[entry] = true
+	return true
+}
+
+// blocked returns the name of a block feed listing ip or the domain of host,
+// if any.
+func (fs *feeds) blocked(ip, host string) (string, bool) {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", false
+	}
+	for _, f := range fs.list {
+		if f.Action != "block" {
+			continue
+		}
+		set := f.set.Load()
+		if set == nil {
+			continue
+		}
+		if _, ok := set.domain(host); ok || set.ips.contains(a) {
+			f.blocks.Add(1)
+			return f.Name, true
+		}
+	}
+	return "", false
+}
+
+type feedStatus struct {
+	Name      string    `json:"name"`
+	Action    string    `json:"action"`
+	Entries   int       `json:"entries"`
+	FetchedAt time.Time `json:"fetched_at,omitzero"`
+	Attempted time.Time `json:"attempted_at,omitzero"`
+	Matches   int64     `json:"matches"`
+	Blocks    int64     `json:"blocks"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (fs *feeds) status() []feedStatus {
+	st := []feedStatus{}
+	for _, f := range fs.list {
+		f.mu.Lock()
+		s := feedStatus{Name: f.Name, Action: f.Action, FetchedAt: f.fetchedAt, Attempted: f.attempted,
+			Matches: f.matches.Load(), Blocks: f.blocks.Load()}
+		if f.err != nil {
+			s.Error = f.err.Error()
+		}
+		f.mu.Unlock()
+		if set := f.set.Load(); set != nil {
+			s.Entries = set.size()
+		}
+		st = append(st, s)
+	}
+	return st
+}
+
+// close stops the refreshes, interrupting downloads in progress.
+func (fs *feeds) close() {
+	close(fs.stop)
+	fs.wg.Wait()
+}
@@ -0,0 +1,203 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFeed(t *testing.T) {
+	set, err := parseFeed(strings.NewReader(`# A feed of everything
+192.0.2.1 ; a scanner
+198.51.100.0/24
+2001:db8::/32
+[2001:db8:1::1]
+Bad.Example.
+*.wild.example
+0.0.0.0 sink.example
+127.0.0.1 localhost
+http://url.example:8080/path
+not a domain
+`), "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"192.0.2.1": true, "192.0.2.2": false, "198.51.100.7": true, "::ffff:198.51.100.7": true, "2001:db8:5::1": true,
+		"2001:db9::1": false,
+	} {
+		if got := set.ips.contains(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("contains(%v): got %v, want %v", ip, got, want)
+		}
+	}
+	for host, want := range map[string]string{
+		"bad.example": "bad.example", "www.BAD.example:443": "bad.example", "a.wild.example": "wild.example",
+		"sink.example": "sink.example", "url.example": "url.example", "good.example": "", "example": "",
+		"localhost": "", "a": "",
+	} {
+		if got, _ := set.domain(host); got != want {
+			t.Errorf("domain(%v): got %q, want %q", host, got, want)
+		}
+	}
+	if set.size() != 8 {
+		t.Errorf("got %v entries, want 8", set.size())
+	}
+	if _, err := parseFeed(strings.NewReader("# nothing\n\n"), "text"); err == nil {
+		t.Error("an empty feed was read")
+	}
+}
+
+func TestParseSTIX(t *testing.T) {
+	set, err := parseFeed(strings.NewReader(`{"type": "bundle", "objects": [
+  {"type": "indicator", "pattern": "[ipv4-addr:value = '192.0.2.0/24'] OR [domain-name:value='c2.example']"},
+  {"type": "indicator", "pattern": "[url:value = 'http://drop.example/it\\'s']", "valid_until": "2100-01-01T00:00:00Z"},
+  {"type": "indicator", "pattern": "[domain-name:value = 'revoked.example']", "revoked": true},
+  {"type": "indicator", "pattern": "[domain-name:value = 'expired.example']", "valid_until": "2000-01-01T00:00:00Z"},
+  {"type": "ipv6-addr", "value": "2001:db8::1"},
+  {"type": "malware", "name": "x"}
+]}`), "stix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var domains []string
+	for _, host := range []string{"c2.example", "drop.example", "revoked.example", "expired.example"} {
+		if d, ok := set.domain(host); ok {
+			domains = append(domains, d)
+		}
+	}
+	if !reflect.DeepEqual(domains, []string{"c2.example", "drop.example"}) {
+		t.Errorf("got the domains %v, want c2.example and drop.example", domains)
+	}
+	if !set.ips.contains(netip.MustParseAddr("192.0.2.9")) || !set.ips.contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("the addresses of the bundle aren't listed")
+	}
+	if _, err := parseFeed(strings.NewReader(`{"objects": [{"type": "malware"}]}`), "stix"); err == nil {
+		t.Error("a bundle without entries was read")
+	}
+	if _, err := parseFeed(strings.NewReader(`192.0.2.1`), "stix"); err == nil {
+		t.Error("a text feed was read as a bundle")
+	}
+}
+
+func TestAbuseIPDBFeedIsDownloadedWhenChanged(t *testing.T) {
+	var downloads int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Key") != "k3y" || r.Header.Get("Accept") != "text/plain" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, "192.0.2.1\n192.0.2.2\n")
+	}))
+	defer api.Close()
+	fs := newFeeds([]FeedConfig{
+		{Name: "abuse", URL: api.URL, Format: "abuseipdb", APIKey: "k3y"},
+		{Name: "nokey", URL: api.URL, Format: "abuseipdb"},
+	})
+	defer fs.close()
+	for range 2 {
+		for _, f := range fs.list {
+			fs.refresh(f)
+		}
+	}
+	st := fs.status()
+	if downloads != 1 || st[0].Entries != 2 || st[0].Error != "" || st[0].FetchedAt.IsZero() {
+		t.Errorf("got %v downloads and the status %+v, want the feed downloaded once", downloads, st[0])
+	}
+	if st[1].Entries != 0 || !strings.Contains(st[1].Error, "401") {
+		t.Errorf("got the status %+v, want the download without a key refused", st[1])
+	}
+}
+
+func TestFeedsTagAndBlock(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts.txt")
+	bundle := filepath.Join(dir, "bundle.json")
+	if err := os.WriteFile(hosts, []byte("0.0.0.0 tracker.test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stix := `{"objects": [{"type": "domain-name", "value": "evil.test"}]}`
+	if err := os.WriteFile(bundle, []byte(stix), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfig(t, fmt.Sprintf(`feeds:
+  - name: hosts
+    file: %v
+  - name: stix
+    file: %v
+    format: stix
+    action: block
+`, hosts, bundle))
+	config := testConfig(t, "-config", path)
+	s, client := startServer(t, config, nil)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if st := s.feeds.status(); st[0].Entries == 1 && st[1].Entries == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the feeds weren't read")
+		}
+	}
+
+	// The hosts don't resolve, the requests being only refused or not.
+	get := func(host string) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", upstream.URL, nil)
+		req.Host = host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("www.tracker.test"); code == http.StatusForbidden {
+		t.Errorf("got %v for a tagged host, want it forwarded", code)
+	}
+	if code := get("www.evil.test"); code != http.StatusForbidden {
+		t.Errorf("got %v for a blocked host, want it refused", code)
+	}
+	if _, _, resp := openTunnel(t, client, "evil.test:443"); resp.StatusCode == http.StatusOK {
+		t.Error("a tunnel to a blocked host was opened")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{{"www.evil.test", "feed:stix", "host", "evil.test", "1"},
+		{"www.tracker.test", "feed:hosts", "host", "tracker.test", "0"}}
+	got := queryRows(t, db, `select r.host, t.tag, t.location, t.match, r.error_response = 'blocked' from requests r
+      join request_tags t using (request_id) where t.tag like 'feed:%' order by r.host`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got the tagged requests %v, want %v", got, want)
+	}
+	if got := queryRows(t, db, "select host, error_response from connects"); !reflect.DeepEqual(got,
+		[][]string{{"evil.test:443", "blocked"}}) {
+		t.Errorf("got the connects %v, want the tunnel to evil.test refused", got)
+	}
+}
@@ -0,0 +1,507 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/elazarl/goproxy"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxRecorded bounds the bytes a client connection keeps to find the
+	// headers of its requests in, longer headers give no fingerprint.
+	maxRecorded = 64 << 10
+	// maxFingerprints bounds the fingerprints kept in memory, the further
+	// ones are only stored.
+	maxFingerprints = 65536
+)
+
+type connKey struct{}
+
+// withClientConn is the ConnContext of the proxy server, giving requests the
+// connection they were read from.
+func withClientConn(ctx context.Context, c net.Conn) context.Context {
+	if cc, ok := c.(*clientConn); ok {
+		return context.WithValue(ctx, connKey{}, cc)
+	}
+	return ctx
+}
+
+// clientListener records what its clients send, see clientConn. transparent
+// is set on the transparent listener.
+type clientListener struct {
+	net.Listener
+	transparent bool
+}
+
+func (l clientListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	return &clientConn{Conn: c, inner: c, recording: true, transparent: l.transparent}, nil
+}
+
+// clientConn is a connection from a proxy client. It records what the client
+// sends, so that the headers of its requests are known in the order and case
+// they were sent in, which http.Header loses. The TLS of MITM'd tunnels is
+// terminated here rather than by goproxy for the same reason: goproxy then
+// relays the decrypted requests as plaintext ones.
+type clientConn struct {
+	net.Conn
+	// transparent is set for the clients of the transparent listener, which
+	// don't know they're proxied.
+	transparent bool
+
+	mu        sync.Mutex
+	inner     net.Conn
+	recording bool
+	buf       []byte
+	// tlsConfig is set for a MITM'd tunnel until its first read tells whether
+	// the client speaks TLS, and secure once it does.
+	tlsConfig *tls.Config
+	handshake *mitmHandshake
+	secure    bool
+	// ja3 is the JA3 hash of the ClientHello of the tunnel, once read, and
+	// protocol tls or http once its first byte is.
+	ja3      string
+	protocol string
+	// closed is called once the connection is closed, if set.
+	closed func()
+	// drip slows down the writes to a tarpitted client, if set.
+	drip *drip
+
+	// read and written count the bytes read from the client and written to
+	// it, after TLS for MITM'd tunnels.
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+// bufferedConn reads a connection through the reader which peeked at it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	conn, err := c.reader()
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(p)
+	if n > 0 {
+		c.read.Add(int64(n))
+		c.record(p[:n])
+	}
+	return n, err
+}
+
+// reader returns the connection to read from, starting the TLS of a MITM'd
+// tunnel when the client's first byte is a handshake record.
+func (c *clientConn) reader() (net.Conn, error) {
+	c.mu.Lock()
+	inner, config, hs := c.inner, c.tlsConfig, c.handshake
+	c.mu.Unlock()
+	if config == nil {
+		return inner, nil
+	}
+
+	br := bufio.NewReaderSize(c.Conn, maxTLSRecord)
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	inner = &bufferedConn{c.Conn, br}
+	secure := b[0] == 0x16
+	c.mu.Lock()
+	c.protocol = "http"
+	if secure {
+		c.protocol = "tls"
+	}
+	c.mu.Unlock()
+	if secure {
+		hs.JA3 = peekJA3(br)
+		tc := tls.Server(inner, config)
+		err := tc.Handshake()
+		hs.done(err)
+		if err != nil {
+			return nil, err
+		}
+		inner = tc
+	}
+	c.mu.Lock()
+	c.inner, c.tlsConfig, c.handshake, c.secure = inner, nil, nil, secure
+	if secure {
+		c.ja3 = hs.JA3
+		// The frames of HTTP/2 have no header names to find.
+		if inner.(*tls.Conn).ConnectionState().NegotiatedProtocol == "h2" {
+			c.recording, c.buf = false, nil
+		}
+	}
+	c.mu.Unlock()
+	return inner, nil
+}
+
+// peekRecord returns the TLS record br starts with, without consuming it, or
+// nil when it can't be read.
+func peekRecord(br *bufio.Reader) []byte {
+	head, err := br.Peek(5)
+	if err != nil {
+		return nil
+	}
+	record, err := br.Peek(5 + int(binary.BigEndian.Uint16(head[3:])))
+	if err != nil {
+		return nil
+	}
+	return record
+}
+
+// peekJA3 returns the JA3 hash of the ClientHello br starts with, without
+// consuming it, or "" when it isn't a single valid record.
+func peekJA3(br *bufio.Reader) string {
+	_, hash, err := ja3(peekRecord(br))
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+func (c *clientConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	inner, drip := c.inner, c.drip
+	c.mu.Unlock()
+	var n int
+	var err error
+	if drip != nil {
+		n, err = drip.write(inner, p)
+	} else {
+		n, err = inner.Write(p)
+	}
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *clientConn) Close() error {
+	c.mu.Lock()
+	inner, closed, drip := c.inner, c.closed, c.drip
+	c.closed = nil
+	c.mu.Unlock()
+	// The tunnel is logged before inner, which Shutdown waits for, is closed.
+	if closed != nil {
+		closed()
+	}
+	err := inner.Close()
+	if drip != nil {
+		drip.end()
+	}
+	return err
+}
+
+// tarpit has the writes to the connection go through d, unless they already
+// go through another drip.
+func (c *clientConn) tarpit(d *drip) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.drip != nil {
+		return false
+	}
+	c.drip = d
+	return true
+}
+
+// onClose has f called once the connection is closed.
+func (c *clientConn) onClose(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = f
+}
+
+// tunnelProtocol returns what the client of a MITM'd tunnel spoke, tls or
+// http, or "" before it sent anything.
+func (c *clientConn) tunnelProtocol() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.protocol
+}
+
+// traffic returns the bytes read from the client and written to it so far.
+func (c *clientConn) traffic() (int64, int64) {
+	return c.read.Load(), c.written.Load()
+}
+
+// mitm makes the tunnel over the connection terminate the TLS of the client
+// with config, once the CONNECT is answered, the handshake being logged to hs.
+func (c *clientConn) mitm(config *tls.Config, hs *mitmHandshake) {
+	config = config.Clone()
+	config.NextProtos = []string{"h2", "http/1.1"}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tlsConfig, c.handshake = config, hs
+}
+
+// isSecure tells whether the TLS of the tunnel was terminated.
+func (c *clientConn) isSecure() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.secure
+}
+
+// tlsJA3 returns the JA3 hash of the client of the tunnel, if its TLS was
+// terminated.
+func (c *clientConn) tlsJA3() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ja3
+}
+
+// stopRecording is called for tunnels relayed verbatim, whose bytes aren't
+// requests.
+func (c *clientConn) stopRecording() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recording = false
+	c.buf = nil
+}
+
+func (c *clientConn) record(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.recording {
+		return
+	}
+	c.buf = append(c.buf, p...)
+	if over := len(c.buf) - maxRecorded; over > 0 {
+		c.buf = c.buf[:copy(c.buf, c.buf[over:])]
+	}
+}
+
+// take returns the header names of req as they were sent, the anomalies of
+// its head, and a copy of the head itself when raw is set, and forgets what
+// was recorded up to the end of its headers.
+// The body of the previous request on the connection, which may not end with
+// a newline, is skipped by looking for the request line anywhere.
+func (c *clientConn) take(req *http.Request, raw bool) ([]string, *parseAnomalies, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := bytes.Index(c.buf, []byte(req.Method+" "+req.RequestURI+" "))
+	if i < 0 {
+		return nil, nil, nil
+	}
+	names, anomalies, n := headerNames(c.buf[i:])
+	if n < 0 {
+		return nil, nil, nil
+	}
+	var head []byte
+	if raw {
+		head = bytes.Clone(c.buf[i : i+n])
+	}
+	c.buf = c.buf[:copy(c.buf, c.buf[i+n:])]
+	return names, anomalies, head
+}
+
+// headerNames parses the header names of the request at the start of b, and
+// the anomalies of its head, and returns the length of the head, or -1 when
+// it's incomplete.
+func headerNames(b []byte) ([]string, *parseAnomalies, int) {
+	var names []string
+	a := &parseAnomalies{}
+	host := false
+	first := true
+	for n := 0; ; {
+		i := bytes.IndexByte(b[n:], '\n')
+		if i < 0 {
+			return nil, nil, -1
+		}
+		line, crlf := bytes.CutSuffix(b[n:n+i], []byte("\r"))
+		a.BareLF = a.BareLF || !crlf
+		n += i + 1
+		switch {
+		case first:
+			first = false
+		case len(line) == 0:
+			a.MissingHost = !host
+			return names, a, n
+		case line[0] == ' ' || line[0] == '\t':
+			// A folded continuation of the previous value.
+			if len(names) > 0 && !slices.Contains(a.FoldedHeaders, names[len(names)-1]) {
+				a.FoldedHeaders = append(a.FoldedHeaders, names[len(names)-1])
+			}
+		default:
+			if name, value, ok := bytes.Cut(line, []byte(":")); ok {
+				names = append(names, string(name))
+				switch strings.ToLower(string(name)) {
+				case "host":
+					host = true
+				case "content-length":
+					a.ContentLengths = append(a.ContentLengths, string(bytes.TrimSpace(value)))
+				}
+			}
+		}
+	}
+}
+
+// requestConn returns the client connection req was read from, that of its
+// tunnel for tunneled requests.
+func requestConn(req *http.Request, ctx *goproxy.ProxyCtx) *clientConn {
+	if t, ok := ctx.UserData.(*tunnelState); ok && t.conn != nil {
+		return t.conn
+	}
+	c, _ := req.Context().Value(connKey{}).(*clientConn)
+	return c
+}
+
+// fingerprint hashes the header names in order, as 12 hex digits. Cookie and
+// Referer, which a client sends or not from one request to the next, and the
+// proxy headers, which it only sends to proxies, are left out.
+func fingerprint(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if lower == "cookie" || lower == "referer" || strings.HasPrefix(lower, "proxy-") {
+			continue
+		}
+		io.WriteString(h, name)
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:6])
+}
+
+// clientFingerprint is a fingerprint seen by the proxy, and its label.
+type clientFingerprint struct {
+	Hash      string    `json:"hash"`
+	Headers   string    `json:"headers"`
+	Label     string    `json:"label,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Requests  int64     `json:"requests"`
+	// labeled is set when the label was stored, even an empty one.
+	labeled bool
+}
+
+// fingerprints keeps the fingerprints seen, reloaded from the database at
+// startup so that their labels are kept.
+type fingerprints struct {
+	mu     sync.Mutex
+	byHash map[string]*clientFingerprint
+}
+
+func newFingerprints() *fingerprints {
+	return &fingerprints{byHash: make(map[string]*clientFingerprint)}
+}
+
+func (fs *fingerprints) add(prints []clientFingerprint) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for i := range prints {
+		fs.byHash[prints[i].Hash] = &prints[i]
+	}
+}
+
+// observe counts a request with the fingerprint hash of headers, and returns
+// its label.
+func (fs *fingerprints) observe(hash string, headers []string, t time.Time) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f := fs.byHash[hash]
+	if f == nil {
+		if len(fs.byHash) >= maxFingerprints {
+			return ""
+		}
+		f = &clientFingerprint{Hash: hash, Headers: strings.Join(headers, ","), FirstSeen: t}
+		fs.byHash[hash] = f
+	}
+	f.LastSeen = t
+	f.Requests++
+	return f.Label
+}
+
+// label names a known fingerprint, an empty label removing its name.
+func (fs *fingerprints) label(hash, label string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f := fs.byHash[hash]
+	if f == nil {
+		return false
+	}
+	f.Label = label
+	return true
+}
+
+func (fs *fingerprints) get(hash string) (clientFingerprint, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f := fs.byHash[hash]
+	if f == nil {
+		return clientFingerprint{}, false
+	}
+	return *f, true
+}
+
+// top returns the n fingerprints with the most requests.
+func (fs *fingerprints) top(n int) []clientFingerprint {
+	fs.mu.Lock()
+	all := make([]clientFingerprint, 0, len(fs.byHash))
+	for _, f := range fs.byHash {
+		all = append(all, *f)
+	}
+	fs.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Requests != all[j].Requests {
+			return all[i].Requests > all[j].Requests
+		}
+		return all[i].Hash < all[j].Hash
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// readFingerprints reads the fingerprints stored in db, which may predate the
+// table.
+func readFingerprints(db *sql.DB) ([]clientFingerprint, error) {
+	if ok, err := hasTable(db, "fingerprints"); err != nil || !ok {
+		return nil, err
+	}
+	rows, err := db.Query(`select hash, coalesce(headers, ''), label, coalesce(first_seen, ''),
+      coalesce(last_seen, ''), coalesce(requests, 0) from fingerprints`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var prints []clientFingerprint
+	for rows.Next() {
+		var f clientFingerprint
+		var first, last string
+		var label sql.NullString
+		if err := rows.Scan(&f.Hash, &f.Headers, &label, &first, &last, &f.Requests); err != nil {
+			return nil, err
+		}
+		f.Label, f.labeled = label.String, label.Valid
+		f.FirstSeen, _ = time.Parse(time.DateTime, first)
+		f.LastSeen, _ = time.Parse(time.DateTime, last)
+		prints = append(prints, f)
+	}
+	return prints, rows.Err()
+}
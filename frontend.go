@@ -0,0 +1,158 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// frontendTimeout bounds the handshake of the clients of the SOCKS5 and
+// transparent listeners, until their CONNECT is known.
+const frontendTimeout = 30 * time.Second
+
+// The states of a frontendConn.
+const (
+	// frontendHandshake is before the first read, which does the handshake.
+	frontendHandshake = iota
+	// frontendHead waits for the response to the CONNECT, and frontendSkip
+	// for the end of its head once it's a 200.
+	frontendHead
+	frontendSkip
+	// frontendOpen relays the bytes verbatim, and frontendFailed drops those
+	// written once the CONNECT failed.
+	frontendOpen
+	frontendFailed
+)
+
+// frontendConn is a connection from a client which doesn't speak to an HTTP
+// proxy, such as a SOCKS5 one. It reads as a CONNECT to the address open
+// returns followed by what the client sends, so that its tunnel goes through
+// the rules, MITM and logging of the CONNECTs. The head of the response to the
+// CONNECT isn't written, reply answers the client with its status instead if
+// set, 0 when there was no response. open returning no address has the client
+// read verbatim, as on the proxy listener.
+type frontendConn struct {
+	net.Conn
+	open  func(br *bufio.Reader) (host, auth string, err error)
+	reply func(status int) error
+
+	once sync.Once
+	r    io.Reader
+	err  error
+
+	mu    sync.Mutex
+	state int
+	tail  []byte
+}
+
+func (c *frontendConn) Read(p []byte) (int, error) {
+	c.once.Do(func() { c.err = c.handshake() })
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *frontendConn) handshake() error {
+	c.SetDeadline(time.Now().Add(frontendTimeout))
+	defer c.SetDeadline(time.Time{})
+	br := bufio.NewReader(c.Conn)
+	host, auth, err := c.open(br)
+	if err != nil {
+		// The 400 the server answers the failed read with isn't for the
+		// client, which has had its reply.
+		c.setState(frontendFailed)
+		return err
+	}
+	if host == "" {
+		c.setState(frontendOpen)
+		c.r = br
+		return nil
+	}
+	connect := "CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n"
+	if auth != "" {
+		connect += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	c.setState(frontendHead)
+	c.r = io.MultiReader(strings.NewReader(connect+"\r\n"), br)
+	return nil
+}
+
+func (c *frontendConn) setState(state int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+}
+
+func (c *frontendConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.state == frontendHandshake || c.state == frontendOpen {
+		c.mu.Unlock()
+		return c.Conn.Write(p)
+	}
+	defer c.mu.Unlock()
+	switch c.state {
+	case frontendHead:
+		status := 0
+		line, _, _ := bytes.Cut(p, []byte("\r\n"))
+		if fields := strings.Fields(string(line)); len(fields) > 1 && strings.HasPrefix(fields[0], "HTTP/") {
+			status, _ = strconv.Atoi(fields[1])
+		}
+		if c.reply != nil {
+			if err := c.reply(status); err != nil {
+				return 0, err
+			}
+		}
+		if status != http.StatusOK {
+			c.state = frontendFailed
+			return len(p), nil
+		}
+		c.state = frontendSkip
+		fallthrough
+	case frontendSkip:
+		c.tail = append(c.tail, p...)
+		i := bytes.Index(c.tail, []byte("\r\n\r\n"))
+		if i < 0 {
+			c.tail = c.tail[max(0, len(c.tail)-3):]
+			return len(p), nil
+		}
+		rest := c.tail[i+4:]
+		c.state, c.tail = frontendOpen, nil
+		if len(rest) > 0 {
+			if _, err := c.Conn.Write(rest); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Close replies to a client whose CONNECT got no response.
+func (c *frontendConn) Close() error {
+	c.mu.Lock()
+	if c.state == frontendHead {
+		if c.reply != nil {
+			c.reply(0)
+		}
+		c.state = frontendFailed
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// validHostName tells whether name, sent by a client, can be the host of a
+// CONNECT.
+func validHostName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] >= 0x7f {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,274 @@
+package stuffpot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geoRecord is the part of a country or city database record looked up.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	// City and Location are only in city databases.
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location *geoLocation `maxminddb:"location"`
+}
+
+// geoLocation is the approximate location of an address.
+type geoLocation struct {
+	Latitude  float64 `maxminddb:"latitude" json:"lat"`
+	Longitude float64 `maxminddb:"longitude" json:"lon"`
+}
+
+// asnRecord is the record of an ASN database.
+type asnRecord struct {
+	Number uint `maxminddb:"autonomous_system_number"`
+}
+
+// geoInfo is where a client is from. Country and City, its English name, are
+// empty when they're unknown, ASN is 0 and Location nil.
+type geoInfo struct {
+	Country  string
+	City     string
+	ASN      uint
+	Location *geoLocation
+}
+
+// columns returns the country, city and ASN as logged, NULL when unknown.
+func (info geoInfo) columns() (country, city, asn interface{}) {
+	if info.Country != "" {
+		country = info.Country
+	}
+	if info.City != "" {
+		city = info.City
+	}
+	if info.ASN != 0 {
+		asn = info.ASN
+	}
+	return country, city, asn
+}
+
+// geoIP locates the clients in MaxMind databases, opened at startup, and
+// applies the origin policy of the config. The requests and policy hits are
+// counted by country. The databases are never closed, as requests still in
+// flight after shutdown may be looking clients up.
+type geoIP struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+	// err is why a configured database couldn't be opened, the policy then
+	// only tagging the clients.
+	err error
+	log *slog.Logger
+
+	mu       sync.Mutex
+	requests map[string]int64
+	hits     map[string]int64
+}
+
+func newGeoIP(cfg GeoConfig) *geoIP {
+	g := &geoIP{log: slog.With("component", "geoip"), requests: make(map[string]int64), hits: make(map[string]int64)}
+	var errs []error
+	var err error
+	if cfg.CountryDB != "" {
+		if g.country, err = maxminddb.Open(cfg.CountryDB); err != nil {
+			errs = append(errs, fmt.Errorf("country database: %w", err))
+		}
+	}
+	if cfg.ASNDB != "" {
+		if g.asn, err = maxminddb.Open(cfg.ASNDB); err != nil {
+			errs = append(errs, fmt.Errorf("ASN database: %w", err))
+		}
+	}
+	if g.err = errors.Join(errs...); g.err != nil {
+		g.log.Warn("GeoIP unavailable, the origin policy only tags clients", "error", g.err)
+	}
+	return g
+}
+
+// enabled tells whether clients are located at all.
+func (g *geoIP) enabled() bool {
+	return g.country != nil || g.asn != nil || g.err != nil
+}
+
+// lookup locates ip. Addresses missing from the databases have no country or
+// ASN, which isn't an error.
+func (g *geoIP) lookup(ip string) (geoInfo, error) {
+	var info geoInfo
+	if g.err != nil {
+		return info, g.err
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return info, fmt.Errorf("invalid address %q", ip)
+	}
+	if g.country != nil {
+		var r geoRecord
+		if err := g.country.Lookup(addr, &r); err != nil {
+			return info, err
+		}
+		info.Country, info.City, info.Location = r.Country.ISOCode, r.City.Names["en"], r.Location
+	}
+	if g.asn != nil {
+		var r asnRecord
+		if err := g.asn.Lookup(addr, &r); err != nil {
+			return info, err
+		}
+		info.ASN = r.Number
+	}
+	return info, nil
+}
+
+// policy returns the match of ip against the origin policy, if it hits it,
+// along with where it's from. An allow list only applies to the clients
+// whose country or ASN is known. A client which can't be located is tagged
+// geo-unavailable, and never blocked.
+func (g *geoIP) policy(cfg *Config, ip string) (*tagMatch, geoInfo) {
+	if !g.enabled() {
+		return nil, geoInfo{}
+	}
+	info, err := g.lookup(ip)
+	if err != nil {
+		if !cfg.Geo.hasPolicy() {
+			return nil, info
+		}
+		return &tagMatch{Tag: "geo-unavailable", Location: "client", Match: ip, Source: err.Error()}, info
+	}
+	hit := func(match, source string) (*tagMatch, geoInfo) {
+		return &tagMatch{Tag: "geo-policy", Location: "client", Match: match, Source: source}, info
+	}
+	country, asn := info.Country, "AS"+strconv.FormatUint(uint64(info.ASN), 10)
+	switch {
+	case country != "" && cfg.geoDenyCountries[country]:
+		return hit(country, "deny_countries")
+	case country != "" && len(cfg.geoAllowCountries) > 0 && !cfg.geoAllowCountries[country]:
+		return hit(country, "allow_countries")
+	case info.ASN != 0 && cfg.geoDenyASN[info.ASN]:
+		return hit(asn, "deny_asn")
+	case info.ASN != 0 && len(cfg.geoAllowASN) > 0 && !cfg.geoAllowASN[info.ASN]:
+		return hit(asn, "allow_asn")
+	}
+	return nil, info
+}
+
+// enforce applies the origin policy to a request or tunnel of ip before it's
+// forwarded, counting it. It holds the tarpitted ones, and returns where the
+// client is from and whether it's to be refused. The match is to be added to
+// the request's tags.
+func (g *geoIP) enforce(ctx context.Context, cfg *Config, ip, id string) (*tagMatch, geoInfo, bool) {
+	m, info := g.policy(cfg, ip)
+	if !g.enabled() {
+		return m, info, false
+	}
+	country := info.Country
+	if country == "" {
+		country = "unknown"
+	}
+	g.mu.Lock()
+	g.requests[country]++
+	if m != nil && m.Tag == "geo-policy" {
+		g.hits[country]++
+	}
+	g.mu.Unlock()
+	if m == nil || m.Tag != "geo-policy" {
+		return m, info, false
+	}
+
+	action := cfg.Geo.Action
+	g.log.Info("Origin policy hit", "request_id", id, "client", ip, "country", info.Country, "asn", info.ASN,
+		"rule", m.Source, "action", action)
+	switch action {
+	case "block":
+		return m, info, true
+	case "tarpit":
+		t := time.NewTimer(cfg.Geo.Tarpit)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+	return m, info, false
+}
+
+// geoCount is the number of requests, and of policy hits, of a country.
+type geoCount struct {
+	Country  string
+	Requests int64
+	Hits     int64
+}
+
+// counts returns the counts by country, sorted.
+func (g *geoIP) counts() []geoCount {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	counts := make([]geoCount, 0, len(g.requests))
+	for country, n := range g.requests {
+		counts = append(counts, geoCount{country, n, g.hits[country]})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Country < counts[j].Country })
+	return counts
+}
+
+// hasPolicy tells whether any of the lists is set.
+func (c GeoConfig) hasPolicy() bool {
+	return len(c.DenyCountries) > 0 || len(c.AllowCountries) > 0 || len(c.DenyASN) > 0 || len(c.AllowASN) > 0
+}
+
+// compileGeo validates the origin policy, and indexes its lists.
+func (c *Config) compileGeo() error {
+	var errs []error
+	countries := func(name string, list []string) map[string]bool {
+		set := make(map[string]bool)
+		for _, code := range list {
+			code = strings.ToUpper(code)
+			if len(code) != 2 {
+				errs = append(errs, fmt.Errorf("geo.%v: invalid country code %q", name, code))
+			}
+			set[code] = true
+		}
+		return set
+	}
+	asns := func(name string, list []string) map[uint]bool {
+		set := make(map[uint]bool)
+		for _, s := range list {
+			n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+			if err != nil || n == 0 {
+				errs = append(errs, fmt.Errorf("geo.%v: invalid AS number %q", name, s))
+			}
+			set[uint(n)] = true
+		}
+		return set
+	}
+	c.geoDenyCountries = countries("deny_countries", c.Geo.DenyCountries)
+	c.geoAllowCountries = countries("allow_countries", c.Geo.AllowCountries)
+	c.geoDenyASN = asns("deny_asn", c.Geo.DenyASN)
+	c.geoAllowASN = asns("allow_asn", c.Geo.AllowASN)
+
+	switch c.Geo.Action {
+	case "block", "tarpit", "tag":
+	default:
+		errs = append(errs, fmt.Errorf("geo.action: unknown action %q", c.Geo.Action))
+	}
+	if c.Geo.Tarpit < 0 {
+		errs = append(errs, errors.New("geo.tarpit: must not be negative"))
+	}
+	if len(c.Geo.DenyCountries)+len(c.Geo.AllowCountries) > 0 && c.Geo.CountryDB == "" {
+		errs = append(errs, errors.New("geo: the country lists need country_db"))
+	}
+	if len(c.Geo.DenyASN)+len(c.Geo.AllowASN) > 0 && c.Geo.ASNDB == "" {
+		errs = append(errs, errors.New("geo: the AS lists need asn_db"))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,177 @@
+package stuffpot
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// mmdbValue appends v, a string, uint16, uint32, uint64, map or slice, in the
+// data format of MaxMind databases.
+func mmdbValue(b []byte, v interface{}) []byte {
+	control := func(typ, size int) {
+		if typ <= 7 {
+			b = append(b, byte(typ<<5|size))
+		} else {
+			b = append(b, byte(size), byte(typ-7))
+		}
+	}
+	unsigned := func(typ int, n uint64) {
+		var be []byte
+		for ; n > 0; n >>= 8 {
+			be = append([]byte{byte(n)}, be...)
+		}
+		control(typ, len(be))
+		b = append(b, be...)
+	}
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		b = append(b, v...)
+	case uint16:
+		unsigned(5, uint64(v))
+	case uint32:
+		unsigned(6, uint64(v))
+	case uint64:
+		unsigned(9, v)
+	case map[string]interface{}:
+		control(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = mmdbValue(mmdbValue(b, k), v[k])
+		}
+	case []interface{}:
+		control(11, len(v))
+		for _, e := range v {
+			b = mmdbValue(b, e)
+		}
+	}
+	return b
+}
+
+// writeMMDB writes an IPv4 MaxMind database of type typ where every address
+// has record, and returns its path.
+func writeMMDB(t *testing.T, typ string, record map[string]interface{}) string {
+	t.Helper()
+	var b bytes.Buffer
+	// A single node whose records both point to the data, 16 bytes past the
+	// end of the tree.
+	node := make([]byte, 4)
+	binary.BigEndian.PutUint32(node, 1+16)
+	b.Write(node[1:])
+	b.Write(node[1:])
+	b.Write(make([]byte, 16))
+	b.Write(mmdbValue(nil, record))
+	b.WriteString("\xab\xcd\xefMaxMind.com")
+	b.Write(mmdbValue(nil, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               typ,
+		"description":                 map[string]interface{}{"en": "test"},
+		"ip_version":                  uint16(4),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(1),
+		"record_size":                 uint16(24),
+	}))
+	path := filepath.Join(t.TempDir(), typ+".mmdb")
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// geoDatabases writes a city and an ASN database locating every address in
+// Paris, FR, AS64496.
+func geoDatabases(t *testing.T) (city, asn string) {
+	city = writeMMDB(t, "GeoLite2-City", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "FR"},
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Paris", "fr": "Paris"}},
+	})
+	asn = writeMMDB(t, "GeoLite2-ASN", map[string]interface{}{"autonomous_system_number": uint32(64496)})
+	return city, asn
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	city, asn := geoDatabases(t)
+	g := newGeoIP(GeoConfig{CountryDB: city, ASNDB: asn})
+	info, err := g.lookup("192.0.2.1")
+	if err != nil || info.Country != "FR" || info.City != "Paris" || info.ASN != 64496 {
+		t.Errorf("got %+v, %v, want Paris, FR, AS64496", info, err)
+	}
+	if country, city, asn := info.columns(); country != "FR" || city != "Paris" || asn != uint(64496) {
+		t.Errorf("got the columns %v %v %v", country, city, asn)
+	}
+	if country, city, asn := (geoInfo{}).columns(); country != nil || city != nil || asn != nil {
+		t.Errorf("an unknown origin: got the columns %v %v %v, want NULLs", country, city, asn)
+	}
+	if _, err := g.lookup("nope"); err == nil {
+		t.Error("an invalid address was located")
+	}
+	if g := newGeoIP(GeoConfig{CountryDB: filepath.Join(t.TempDir(), "missing.mmdb")}); g.err == nil {
+		t.Error("a missing database was opened")
+	}
+}
+
+func TestOriginIsStoredWithRequestsAndTunnels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	city, asn := geoDatabases(t)
+	path := writeConfig(t, `mitm:
+  rules:
+    - name: no-ssh
+      ports: [22]
+      action: reject
+`)
+	config := testConfig(t, "-config", path, "-geoip-db", city, "-geoip-asn-db", asn, "-request-id-echo")
+	s, client := startServer(t, config, nil)
+	adminURL := serveAdmin(t, s)
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	conn, _, _ := openTunnel(t, client, "192.0.2.10:22")
+	conn.Close()
+
+	var d requestDetail
+	for deadline := time.Now().Add(5 * time.Second); d.Country == "" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		getJSON(t, adminURL, "/api/requests/"+resp.Header.Get(requestIDHeader), &d)
+	}
+	if d.Country != "FR" || d.City != "Paris" || d.ASN != 64496 {
+		t.Errorf("got the origin %v %v %v in the detail, want Paris, FR, AS64496", d.Country, d.City, d.ASN)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{{"FR", "Paris", "64496"}}
+	for _, table := range []string{"requests", "connects"} {
+		if got := queryRows(t, db, "select country, city, asn from "+table); !reflect.DeepEqual(got, want) {
+			t.Errorf("got the origins %v in %v, want %v", got, table, want)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+package stuffpot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// harEntry is the part of a HAR entry which is imported.
+type harEntry struct {
+	StartedDateTime string  `json:"startedDateTime"`
+	Time            float64 `json:"time"`
+	Request         struct {
+		Method      string      `json:"method"`
+		URL         string      `json:"url"`
+		HTTPVersion string      `json:"httpVersion"`
+		Headers     []harHeader `json:"headers"`
+		PostData    *struct {
+			Text string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status      int         `json:"status"`
+		HTTPVersion string      `json:"httpVersion"`
+		Headers     []harHeader `json:"headers"`
+		Content     struct {
+			Size     int64  `json:"size"`
+			Text     string `json:"text"`
+			Encoding string `json:"encoding"`
+		} `json:"content"`
+		BodySize int64 `json:"bodySize"`
+	} `json:"response"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harImporter imports HAR entries into a database, running the rules over
+// them as the proxy would.
+type harImporter struct {
+	logger *HttpLogger
+	rules  *Rules
+	// bodyLimit is the number of body bytes scanned by the signatures.
+	bodyLimit int64
+	// client is the address given to the entries, unless clientField names
+	// an entry field holding theirs.
+	client      string
+	clientField string
+}
+
+// harResult counts the entries of an import.
+type harResult struct {
+	Imported   int
+	Duplicates int
+	Malformed  int
+}
+
+// importFile imports the entries of the HAR file at path. Malformed entries
+// are skipped, and so are those already imported, by the hash of their JSON.
+func (im *harImporter) importFile(ctx context.Context, path string) (harResult, error) {
+	var res harResult
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return res, err
+	}
+	var har struct {
+		Log *struct {
+			Entries []json.RawMessage `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(b, &har); err != nil || har.Log == nil {
+		return res, errors.New("not a HAR file")
+	}
+	for _, raw := range har.Log.Entries {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, raw); err != nil {
+			res.Malformed++
+			continue
+		}
+		sum := sha256.Sum256(compact.Bytes())
+		hash := hex.EncodeToString(sum[:])
+		var one int
+		err := im.logger.db.QueryRowContext(ctx, "select 1 from requests where import_hash = ?", hash).Scan(&one)
+		if err == nil {
+			res.Duplicates++
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return res, err
+		}
+		ex, err := im.exchange(raw, hash)
+		if err != nil {
+			res.Malformed++
+			continue
+		}
+		if err := im.logger.LogExchange(ctx, ex); err != nil {
+			return res, err
+		}
+		res.Imported++
+	}
+	return res, nil
+}
+
+// exchange builds the exchange of a HAR entry, tagged by the rules.
+func (im *harImporter) exchange(raw json.RawMessage, hash string) (*Exchange, error) {
+	var e harEntry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, err
+	}
+	start, err := time.Parse(time.RFC3339Nano, e.StartedDateTime)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if e.Request.PostData != nil {
+		body = []byte(e.Request.PostData.Text)
+	}
+	req, err := http.NewRequest(e.Request.Method, e.Request.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if major, minor, ok := http.ParseHTTPVersion(e.Request.HTTPVersion); ok {
+		req.Proto, req.ProtoMajor, req.ProtoMinor = e.Request.HTTPVersion, major, minor
+	}
+	for _, h := range e.Request.Headers {
+		// HTTP/2 pseudo headers aren't headers.
+		if !strings.HasPrefix(h.Name, ":") {
+			req.Header.Add(h.Name, h.Value)
+		}
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+
+	ip := im.client
+	if im.clientField != "" {
+		var fields map[string]json.RawMessage
+		var v string
+		if json.Unmarshal(raw, &fields) == nil && json.Unmarshal(fields[im.clientField], &v) == nil && v != "" {
+			ip = v
+		}
+	}
+	req.RemoteAddr = ip
+
+	rules := im.rules
+	state := &requestState{id: newIDAt(start), start: start, tags: rules.tag(req), source: "import:har", importHash: hash}
+	state.matches = rules.detect(req)
+	state.check = rules.proxyCheck(req)
+	respBody := []byte(e.Response.Content.Text)
+	if e.Response.Content.Encoding == "base64" {
+		if respBody, err = base64.StdEncoding.DecodeString(e.Response.Content.Text); err != nil {
+			return nil, err
+		}
+	}
+	if im.bodyLimit > 0 {
+		for _, b := range []struct {
+			body     []byte
+			location string
+		}{{body, "request"}, {respBody, "response"}} {
+			if int64(len(b.body)) > im.bodyLimit {
+				b.body = b.body[:im.bodyLimit]
+			}
+			if len(b.body) > 0 {
+				state.matches = append(state.matches, rules.signatures.scan(b.body, b.location)...)
+				state.addBody(b.body)
+			}
+		}
+	}
+
+	ex := newExchange(req, state)
+	ex.ClientIP = ip
+	ex.Received = int64(len(body))
+	ex.End = start.Add(time.Duration(e.Time * float64(time.Millisecond)))
+	if e.Response.Status > 0 {
+		resp := &http.Response{StatusCode: e.Response.Status, Proto: e.Response.HTTPVersion, Header: make(http.Header)}
+		for _, h := range e.Response.Headers {
+			if !strings.HasPrefix(h.Name, ":") {
+				resp.Header.Add(h.Name, h.Value)
+			}
+		}
+		ex.Response, ex.Size = resp, max(e.Response.Content.Size, e.Response.BodySize, 0)
+	} else {
+		ex.Err = errors.New("no response")
+	}
+	ex.Tags, ex.Matches = state.tagNames(), state.matches
+	return ex, nil
+}
+
+// importCommand implements the import subcommand:
+//
+//	stuffpot import har [-db path] [-rules files] [-client addr] [-client-field name] file.har...
+//
+// It imports the entries of HAR files into the database, tagged by the rules.
+// The flags may follow the files.
+func importCommand(args []string) {
+	if len(args) > 0 && args[0] == "parquet" {
+		parquetImportCommand(args[1:])
+		return
+	}
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot import har", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database the entries are imported into")
+	fs.Var(&fieldValue{reflect.ValueOf(&cfg.Rules.Files).Elem()}, "rules", "Rule files, or directories of them, tagging the entries")
+	client := fs.String("client", "0.0.0.0", "Client address given to the entries")
+	clientField := fs.String("client-field", "_clientIP", "Custom entry field holding the client address, preferred to -client")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stuffpot import har [-db path] [-rules files] [-client addr] [-client-field name] file.har...")
+		fmt.Fprintln(fs.Output(), "       stuffpot import parquet [-db path] file.parquet|dir...")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "har" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var files []string
+	for args = args[1:]; len(args) > 0; args = args[1:] {
+		fs.Parse(args)
+		if args = fs.Args(); len(args) == 0 {
+			break
+		}
+		files = append(files, args[0])
+	}
+	if len(files) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	rules, err := loadRules(cfg.Rules.Files)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logger, err := NewLogger("file:" + *path + "?_busy_timeout=10000")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer logger.Close()
+
+	im := &harImporter{logger: logger, rules: rules, bodyLimit: cfg.Rules.BodyLimit, client: *client, clientField: *clientField}
+	failed := false
+	for _, file := range files {
+		res, err := im.importFile(context.Background(), file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%v: %d imported, %d duplicates, %d malformed\n", file, res.Imported, res.Duplicates, res.Malformed)
+	}
+	if failed {
+		logger.Close()
+		os.Exit(1)
+	}
+}
+
+// harFile is a HAR 1.2 file as exported.
+type harFile struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []harExportedEntry `json:"entries"`
+	} `json:"log"`
+}
+
+// harExportedEntry is an exported request. The fields starting with an
+// underscore are custom ones: _clientIP is that read back by the import.
+type harExportedEntry struct {
+	StartedDateTime string             `json:"startedDateTime"`
+	Time            float64            `json:"time"`
+	Request         harExportedRequest `json:"request"`
+	Response        harExportedResp    `json:"response"`
+	Cache           struct{}           `json:"cache"`
+	Timings         struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	} `json:"timings"`
+	RequestID string   `json:"_requestId"`
+	ClientIP  string   `json:"_clientIP"`
+	Tags      []string `json:"_tags"`
+}
+
+type harExportedRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harCookie  `json:"cookies"`
+	Headers     []harHeader  `json:"headers"`
+	QueryString []harHeader  `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int64        `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// Encoding isn't in HAR 1.2, but is understood by most tools.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harExportedResp struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harCookie `json:"cookies"`
+	Headers     []harHeader `json:"headers"`
+	Content     struct {
+		Size     int64  `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+		Encoding string `json:"encoding,omitempty"`
+	} `json:"content"`
+	RedirectURL string `json:"redirectURL"`
+	HeadersSize int64  `json:"headersSize"`
+	BodySize    int64  `json:"bodySize"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// newHARFile returns an empty HAR file, created by this version.
+func newHARFile() *harFile {
+	f := &harFile{}
+	f.Log.Version = "1.2"
+	f.Log.Creator.Name = "stuffpot"
+	f.Log.Creator.Version = getBuildInfo().Version
+	f.Log.Entries = []harExportedEntry{}
+	return f
+}
+
+// harHeaders parses the logged header lines.
+func harHeaders(lines string) []harHeader {
+	headers := []harHeader{}
+	for _, line := range strings.Split(lines, "\r\n") {
+		if name, value, ok := strings.Cut(line, ": "); ok {
+			headers = append(headers, harHeader{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// orderHeaders sorts headers by order, the comma separated names as they were
+// sent, and gives them their names as sent.
+func orderHeaders(headers []harHeader, order string) {
+	if order == "" {
+		return
+	}
+	names := strings.Split(order, ",")
+	index := func(name string) int {
+		if i := slices.IndexFunc(names, func(n string) bool { return strings.EqualFold(n, name) }); i >= 0 {
+			return i
+		}
+		return len(names)
+	}
+	slices.SortStableFunc(headers, func(a, b harHeader) int { return index(a.Name) - index(b.Name) })
+	for i, h := range headers {
+		if j := index(h.Name); j < len(names) {
+			headers[i].Name = names[j]
+		}
+	}
+}
+
+// requestHeaders returns the headers of the request of d, with its Host, in
+// the order they were sent.
+func requestHeaders(d *requestDetail) []harHeader {
+	headers := harHeaders(d.Headers)
+	if d.Host != "" && !slices.ContainsFunc(headers, func(h harHeader) bool { return strings.EqualFold(h.Name, "host") }) {
+		headers = append([]harHeader{{Name: "host", Value: d.Host}}, headers...)
+	}
+	orderHeaders(headers, d.HeaderOrder)
+	return headers
+}
+
+// harText returns b as the text of a HAR body, in base64 when it's binary or
+// still encoded.
+func harText(b []byte, contentEncoding string) (string, string) {
+	if contentEncoding == "" && utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+// harExportEntry converts a request and its response into a HAR entry. The
+// bodies are those stored, so they may be truncated or missing, and the
+// request's version, which isn't logged, is given as HTTP/1.1.
+func harExportEntry(d *requestDetail) harExportedEntry {
+	e := harExportedEntry{RequestID: d.RequestID, ClientIP: d.Client, Tags: d.Tags}
+	if t, err := time.Parse(time.DateTime, d.CreatedAt); err == nil {
+		e.StartedDateTime = t.UTC().Format(time.RFC3339Nano)
+	}
+
+	r := &e.Request
+	r.Method, r.URL, r.HTTPVersion = d.Method, d.URL, "HTTP/1.1"
+	r.HeadersSize, r.BodySize = -1, d.RequestSize
+	r.Headers = requestHeaders(d)
+	r.QueryString = []harHeader{}
+	if u, err := url.Parse(d.URL); err == nil {
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			if pair == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(pair, "=")
+			if n, err := url.QueryUnescape(name); err == nil {
+				name = n
+			}
+			if v, err := url.QueryUnescape(value); err == nil {
+				value = v
+			}
+			r.QueryString = append(r.QueryString, harHeader{Name: name, Value: value})
+		}
+	}
+
+	resp := &e.Response
+	resp.Cookies, resp.Headers = []harCookie{}, []harHeader{}
+	resp.HeadersSize, resp.BodySize = -1, -1
+	r.Cookies = []harCookie{}
+	for _, c := range d.Cookies {
+		cookie := harCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, Expires: c.Expires,
+			HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if c.Direction == "up" {
+			r.Cookies = append(r.Cookies, cookie)
+		} else {
+			resp.Cookies = append(resp.Cookies, cookie)
+		}
+	}
+	if p := d.Response; p != nil {
+		resp.Status, resp.StatusText, resp.HTTPVersion = p.Status, http.StatusText(p.Status), p.Proto
+		resp.Headers = harHeaders(p.Headers)
+		resp.BodySize, resp.Content.Size = p.Size, p.Size
+		for _, h := range resp.Headers {
+			switch strings.ToLower(h.Name) {
+			case "content-type":
+				resp.Content.MimeType = h.Value
+			case "location":
+				resp.RedirectURL = h.Value
+			}
+		}
+		if p.LatencyUs != nil {
+			e.Time = float64(*p.LatencyUs) / 1000
+			e.Timings.Wait = e.Time
+		}
+	}
+
+	for _, b := range d.Bodies {
+		text, encoding := harText(b.Data, b.ContentEncoding)
+		switch b.Location {
+		case "request":
+			r.PostData = &harPostData{MimeType: b.ContentType, Text: text, Encoding: encoding}
+		case "response":
+			resp.Content.Text, resp.Content.Encoding = text, encoding
+			if resp.Content.MimeType == "" {
+				resp.Content.MimeType = b.ContentType
+			}
+		}
+	}
+	return e
+}
+
+// harExportCommand implements the har export:
+//
+//	stuffpot export har [-db path] [-o file] [filters] [request_id...]
+//
+// It writes the selected requests as a HAR file.
+func harExportCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot export har", flag.ExitOnError)
+	var sel requestSelection
+	sel.addFlags(fs, cfg)
+	out := fs.String("o", "", "File the HAR is written to, instead of the standard output")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stuffpot export har [-db path] [-o file] [-client ip] [-host host] [-tag tag] "+
+			"[-session id] [-since time] [-until time] [-limit n] [request_id...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := sel.parse(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f := newHARFile()
+	err := sel.each(context.Background(), func(d *requestDetail) error {
+		f.Log.Entries = append(f.Log.Entries, harExportEntry(d))
+		return nil
+	})
+	if err == nil {
+		err = writeExport(*out, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(f)
+		})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *out != "" {
+		fmt.Printf("%d requests exported to %v\n", len(f.Log.Entries), *out)
+	}
+}
@@ -0,0 +1,128 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHARExportEntry(t *testing.T) {
+	latency := int64(1500)
+	d := &requestDetail{
+		listedRequest: listedRequest{RequestID: "r1", Client: "192.0.2.1", Method: "POST", Host: "a.example",
+			URL: "http://a.example/login?next=%2Fhome&x", Tags: []string{"login"}, CreatedAt: "2024-06-01 10:00:00"},
+		Headers:     "Content-Type: application/x-www-form-urlencoded\r\nUser-Agent: curl/8.0\r\n",
+		HeaderOrder: "user-agent,Host,content-type",
+		RequestSize: 9,
+		Response: &detailResponse{Status: 302, Proto: "HTTP/1.1", Headers: "Location: /home\r\nContent-Type: text/html\r\n",
+			LatencyUs: &latency, Size: 4},
+		Bodies: []detailBody{
+			{Location: "request", ContentType: "application/x-www-form-urlencoded", Data: []byte("user=root")},
+			{Location: "response", ContentType: "text/html", ContentEncoding: "gzip", Data: []byte{0x1f, 0x8b}},
+		},
+		Cookies: []detailCookie{
+			{Direction: "up", Name: "sid", Value: "1"},
+			{Direction: "down", Name: "sid", Value: "2", Path: "/", HttpOnly: true},
+		},
+	}
+	e := harExportEntry(d)
+	if e.StartedDateTime != "2024-06-01T10:00:00Z" || e.Time != 1.5 || e.RequestID != "r1" || e.ClientIP != "192.0.2.1" {
+		t.Errorf("got the entry %+v", e)
+	}
+	// The headers come in the order they were sent, with their names as sent.
+	want := []harHeader{{"user-agent", "curl/8.0"}, {"Host", "a.example"},
+		{"content-type", "application/x-www-form-urlencoded"}}
+	if !reflect.DeepEqual(e.Request.Headers, want) {
+		t.Errorf("got the headers %v, want %v", e.Request.Headers, want)
+	}
+	if want := []harHeader{{"next", "/home"}, {"x", ""}}; !reflect.DeepEqual(e.Request.QueryString, want) {
+		t.Errorf("got the query %v, want %v", e.Request.QueryString, want)
+	}
+	if p := e.Request.PostData; p == nil || p.Text != "user=root" || p.Encoding != "" {
+		t.Errorf("got the post data %+v", p)
+	}
+	r := e.Response
+	if r.Status != 302 || r.StatusText != "Found" || r.RedirectURL != "/home" || r.Content.MimeType != "text/html" ||
+		r.Content.Text != "H4s=" || r.Content.Encoding != "base64" {
+		t.Errorf("got the response %+v", r)
+	}
+	if len(e.Request.Cookies) != 1 || e.Request.Cookies[0].Value != "1" ||
+		len(r.Cookies) != 1 || r.Cookies[0].Value != "2" || !r.Cookies[0].HTTPOnly {
+		t.Errorf("got the cookies %+v and %+v", e.Request.Cookies, r.Cookies)
+	}
+}
+
+func TestHARIsExportedAndImportedBack(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "welcome")
+	}))
+	defer upstream.Close()
+	s, client := startServer(t, testConfig(t, "-max-body-size", "64KB"), nil)
+	adminURL := serveAdmin(t, s)
+	for _, path := range []string{"/login", "/other"} {
+		resp, err := client.Post(upstream.URL+path+"?q=1", "text/plain", strings.NewReader("user=root"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	var page requestPage
+	for deadline := time.Now().Add(5 * time.Second); len(page.Requests) != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the requests weren't logged")
+		}
+		getJSON(t, adminURL, "/api/requests", &page)
+	}
+
+	var f harFile
+	resp, err := http.Get(adminURL + "/api/export/har?limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&f)
+	resp.Body.Close()
+	if err != nil || len(f.Log.Entries) != 1 || resp.Header.Get("X-Next-Cursor") == "" {
+		t.Fatalf("got %v entries, %v, and the cursor %q, want a page of one", len(f.Log.Entries), err,
+			resp.Header.Get("X-Next-Cursor"))
+	}
+	getJSON(t, adminURL, "/api/export/har?id="+page.Requests[1].RequestID+"&id="+page.Requests[0].RequestID+"&id=x", &f)
+	if f.Log.Version != "1.2" || f.Log.Creator.Name != "stuffpot" || len(f.Log.Entries) != 2 {
+		t.Fatalf("got the file %+v, want both requests", f.Log)
+	}
+	e := f.Log.Entries[0]
+	if e.Request.URL != upstream.URL+"/login?q=1" || e.Response.Content.Text != "welcome" ||
+		e.Request.PostData == nil || e.Request.PostData.Text != "user=root" || e.ClientIP != "127.0.0.1" {
+		t.Errorf("got the entry %+v", e)
+	}
+
+	// The file imported back keeps the clients.
+	file := filepath.Join(t.TempDir(), "export.har")
+	b, _ := json.Marshal(f)
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	logger, err := NewLogger(filepath.Join(t.TempDir(), "imported.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	im := &harImporter{logger: logger, rules: &Rules{}, client: "0.0.0.0", clientField: "_clientIP"}
+	if res, err := im.importFile(context.Background(), file); err != nil || res.Imported != 2 {
+		t.Fatalf("got %+v, %v importing the export", res, err)
+	}
+	got := queryRows(t, logger.db, "select from_ip, method, url from requests order by id")
+	if want := [][]string{{"127.0.0.1", "POST", upstream.URL + "/login?q=1"},
+		{"127.0.0.1", "POST", upstream.URL + "/other?q=1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got the imported requests %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+package stuffpot
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checker is implemented by sinks which can tell whether they're able to
+// record traffic. Their checks decide the readiness of the proxy.
+type checker interface {
+	Check(ctx context.Context) error
+}
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// health tracks the liveness of the accept loop and the readiness checks
+// registered by the subsystems.
+type health struct {
+	accepting atomic.Bool
+
+	mu     sync.Mutex
+	checks []readinessCheck
+}
+
+const checkTimeout = 2 * time.Second
+
+func (h *health) register(name string, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks = append(h.checks, readinessCheck{name, check})
+}
+
+// registerSink registers the check of sink if it implements checker.
+func (h *health) registerSink(name string, sink Logger) {
+	if c, ok := sink.(checker); ok {
+		h.register(name, c.Check)
+	}
+}
+
+func (h *health) alive() error {
+	if !h.accepting.Load() {
+		return errors.New("not accepting connections")
+	}
+	return nil
+}
+
+// ready runs every check concurrently and returns their results by name.
+func (h *health) ready(ctx context.Context) (map[string]error, bool) {
+	h.mu.Lock()
+	checks := append([]readinessCheck(nil), h.checks...)
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c readinessCheck) {
+			defer wg.Done()
+			results[i] = c.check(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	res := map[string]error{"listener": h.alive()}
+	ok := res["listener"] == nil
+	for i, c := range checks {
+		res[c.name] = results[i]
+		ok = ok && results[i] == nil
+	}
+	return res, ok
+}
@@ -0,0 +1,82 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyStore is a store whose check fails while down is set.
+type flakyStore struct {
+	recordingLogger
+	down atomic.Bool
+}
+
+func (s *flakyStore) Check(ctx context.Context) error {
+	if s.down.Load() {
+		return errors.New("database is locked")
+	}
+	return nil
+}
+
+// serveAdmin serves the admin API of s on a loopback listener and returns its
+// URL.
+func serveAdmin(t *testing.T, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeAdmin(ln)
+	return "http://" + ln.Addr().String()
+}
+
+// readiness returns the status code and the checks of /readyz.
+func readiness(t *testing.T, adminURL string) (int, map[string]string) {
+	t.Helper()
+	resp, err := http.Get(adminURL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body.Checks
+}
+
+func TestReadyzFollowsTheDatabase(t *testing.T) {
+	store := &flakyStore{}
+	s, _ := startServer(t, testConfig(t), store)
+	adminURL := serveAdmin(t, s)
+
+	// The listener is ready once Serve has started.
+	deadline := time.Now().Add(5 * time.Second)
+	code, checks := readiness(t, adminURL)
+	for code != http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		code, checks = readiness(t, adminURL)
+	}
+	if code != http.StatusOK || checks["database"] != "ok" {
+		t.Fatalf("healthy: got %v %v, want 200 with the database ok", code, checks)
+	}
+
+	store.down.Store(true)
+	if code, checks := readiness(t, adminURL); code != http.StatusServiceUnavailable ||
+		checks["database"] != "database is locked" || checks["listener"] != "ok" {
+		t.Errorf("database down: got %v %v, want 503 with the database's error", code, checks)
+	}
+
+	store.down.Store(false)
+	if code, checks := readiness(t, adminURL); code != http.StatusOK || checks["database"] != "ok" {
+		t.Errorf("database back: got %v %v, want 200", code, checks)
+	}
+}
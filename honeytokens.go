@@ -0,0 +1,251 @@
+package stuffpot
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenLen is the length of a honeytoken: 128 random bits in lower case hex.
+const tokenLen = 32
+
+// HoneytokenRule injects a token into the responses to the requests it
+// matches, every pattern given must match. A client gets the same token from
+// a rule for as long as it's remembered.
+type HoneytokenRule struct {
+	Name string `yaml:"name"`
+	// Client is matched against the client's IP address.
+	Client string `yaml:"client"`
+	Host   string `yaml:"host"`
+	Path   string `yaml:"path"`
+	// Header is a header line added to the response, such as
+	// "Set-Cookie: admin_session={token}".
+	Header string `yaml:"header"`
+	// Body is appended to uncompressed text responses.
+	Body string `yaml:"body"`
+
+	client, host, path      *regexp.Regexp
+	headerName, headerValue string
+}
+
+func (r *HoneytokenRule) compile() error {
+	if r.Name == "" {
+		return errors.New("missing name")
+	}
+	if r.Header == "" && r.Body == "" {
+		return errors.New("neither header nor body")
+	}
+	if r.Header != "" {
+		name, value, ok := strings.Cut(r.Header, ":")
+		if !ok || !headerName.MatchString(name) || !strings.Contains(value, "{token}") {
+			return errors.New(`header must be "Name: value" with a {token}`)
+		}
+		r.headerName, r.headerValue = name, strings.TrimSpace(value)
+	}
+	if r.Body != "" && !strings.Contains(r.Body, "{token}") {
+		return errors.New("body must have a {token}")
+	}
+	var errs []error
+	for _, p := range []struct {
+		re      **regexp.Regexp
+		name, s string
+	}{{&r.client, "client", r.Client}, {&r.host, "host", r.Host}, {&r.path, "path", r.Path}} {
+		if p.s == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", p.name, err))
+		}
+		*p.re = re
+	}
+	return errors.Join(errs...)
+}
+
+func (r *HoneytokenRule) match(req *http.Request, ip string) bool {
+	return (r.client == nil || r.client.MatchString(ip)) &&
+		(r.host == nil || r.host.MatchString(req.URL.Hostname())) &&
+		(r.path == nil || r.path.MatchString(req.URL.Path))
+}
+
+// honeytoken is an issued token, and what it was issued for.
+type honeytoken struct {
+	Token     string
+	Rule      string
+	ClientIP  string
+	RequestID string
+	IssuedAt  time.Time
+}
+
+// honeytokenStore keeps the tokens issued, reloaded from the database at
+// startup so that they're recognized for as long as they're stored.
+type honeytokenStore struct {
+	mu       sync.RWMutex
+	byToken  map[string]*honeytoken
+	byClient map[[2]string]*honeytoken
+}
+
+func newHoneytokenStore() *honeytokenStore {
+	return &honeytokenStore{byToken: make(map[string]*honeytoken), byClient: make(map[[2]string]*honeytoken)}
+}
+
+func (s *honeytokenStore) add(tokens []honeytoken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range tokens {
+		t := &tokens[i]
+		s.byToken[t.Token] = t
+		s.byClient[[2]string{t.ClientIP, t.Rule}] = t
+	}
+}
+
+// issue returns the token of ip for rule, and whether it's a new one.
+func (s *honeytokenStore) issue(rule, ip, requestID string) (*honeytoken, bool) {
+	key := [2]string{ip, rule}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.byClient[key]; t != nil {
+		return t, false
+	}
+	b := make([]byte, tokenLen/2)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	t := &honeytoken{Token: hex.EncodeToString(b), Rule: rule, ClientIP: ip, RequestID: requestID, IssuedAt: time.Now()}
+	s.byToken[t.Token] = t
+	s.byClient[key] = t
+	return t, true
+}
+
+// inject adds the token of the first rule matching the request of resp, but
+// those cfg disables. It returns the token when it's a new one, which must be
+// recorded.
+func (s *honeytokenStore) inject(cfg *Config, rules *Rules, resp *http.Response, ip, requestID string) *honeytoken {
+	if resp == nil || resp.Request == nil {
+		return nil
+	}
+	for _, r := range rules.Honeytokens {
+		if slices.Contains(cfg.Rules.DisabledHoneytokens, r.Name) || !r.match(resp.Request, ip) {
+			continue
+		}
+		t, created := s.issue(r.Name, ip, requestID)
+		if r.headerName != "" {
+			resp.Header.Add(r.headerName, strings.ReplaceAll(r.headerValue, "{token}", t.Token))
+		}
+		if r.Body != "" && resp.Body != nil && textual(resp) {
+			body := strings.ReplaceAll(r.Body, "{token}", t.Token)
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(resp.Body, strings.NewReader(body)), resp.Body}
+			if resp.ContentLength >= 0 {
+				resp.ContentLength += int64(len(body))
+				resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+			}
+		}
+		if created {
+			return t
+		}
+		return nil
+	}
+	return nil
+}
+
+// textual tells whether resp has an uncompressed text body which can be
+// appended to.
+func textual(resp *http.Response) bool {
+	if resp.Header.Get("Content-Encoding") != "" || resp.Request.Method == http.MethodHead {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/javascript"
+}
+
+// recall finds the issued tokens in the path, query and headers of req.
+func (s *honeytokenStore) recall(req *http.Request) []tagMatch {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.byToken) == 0 {
+		return nil
+	}
+
+	var matches []tagMatch
+	seen := make(map[string]bool)
+	scan := func(location, text string) {
+		for i, run := 0, 0; i <= len(text); i++ {
+			if i < len(text) && ('0' <= text[i] && text[i] <= '9' || 'a' <= text[i] && text[i] <= 'f') {
+				run++
+				continue
+			}
+			for start := i - run; start+tokenLen <= i; start++ {
+				tok := text[start : start+tokenLen]
+				if t := s.byToken[tok]; t != nil && !seen[tok] {
+					seen[tok] = true
+					matches = append(matches, tagMatch{Tag: "honeytoken-recall", Location: location, Offset: start,
+						Match: tok, Source: t.RequestID})
+				}
+			}
+			run = 0
+		}
+	}
+	scan("path", req.URL.Path)
+	if query, err := url.QueryUnescape(req.URL.RawQuery); err == nil {
+		scan("query", query)
+	} else {
+		scan("query", req.URL.RawQuery)
+	}
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range req.Header[name] {
+			scan("header:"+strings.ToLower(name), v)
+		}
+	}
+	return matches
+}
+
+// get returns the issuance of token.
+func (s *honeytokenStore) get(token string) *honeytoken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byToken[token]
+}
+
+// readHoneytokens reads the tokens stored in db, which may predate the table.
+func readHoneytokens(db *sql.DB) ([]honeytoken, error) {
+	if ok, err := hasTable(db, "honeytokens"); err != nil || !ok {
+		return nil, err
+	}
+	rows, err := db.Query("select token, rule, client_ip, request_id, issued_at from honeytokens")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []honeytoken
+	for rows.Next() {
+		var t honeytoken
+		var issued string
+		if err := rows.Scan(&t.Token, &t.Rule, &t.ClientIP, &t.RequestID, &issued); err != nil {
+			return nil, err
+		}
+		t.IssuedAt, _ = time.Parse(time.DateTime, issued)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
@@ -0,0 +1,163 @@
+package stuffpot
+
+import (
+	"context"
+	"github.com/elazarl/goproxy"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// TunnelRecord is a CONNECT tunnel, given to the OnTunnelClosed hooks once
+// it's closed. The sinks of embedding programs get theirs from
+// NewTunnelRecord.
+type TunnelRecord struct {
+	ID       string
+	ClientIP string
+	Host     string
+	// Mode is how the tunnel was handled: mitm, tunnel, hijack-parse or
+	// reject. Only relayed tunnels, in tunnel mode, have their bytes
+	// captured.
+	Mode string
+	// Rule is the name of the CONNECT rule the tunnel was handled by, and
+	// ErrorResponse the class of the error response the CONNECT was answered
+	// with, if any.
+	Rule          string
+	ErrorResponse string
+	// Protocol is known for MITM'd and parsed tunnels, or guessed from the
+	// first bytes: tls, http, smtp, ssh... Guessed tells which.
+	Protocol string
+	Guessed  bool
+	// Up and Down are the bytes captured in each direction, up to the
+	// capture limit. Truncated tells whether some were dropped.
+	Up        []byte
+	Down      []byte
+	Truncated bool
+	// Start is when the CONNECT was received and End when the tunnel was
+	// closed, Sent and Received the bytes the client sent and received over
+	// it.
+	Start    time.Time
+	End      time.Time
+	Sent     int64
+	Received int64
+	// DialTime is how long connecting to the remote took, 0 when it wasn't
+	// dialed, and DialError the class of the failure, if it failed.
+	DialTime  time.Duration
+	DialError string
+	// PTR is the name of the client's address, and Country, City and ASN
+	// where it's from, when known.
+	PTR     string
+	Country string
+	City    string
+	ASN     uint
+	// SMTP is the mail conversation of tunnels to mail ports, or nil.
+	SMTP *SmtpSession
+}
+
+// NewTunnelRecord returns the record of the tunnel a Logger's LogTunnel is
+// called with, whose state pctx holds. It must be called before LogTunnel
+// returns, the captured bytes being released afterwards.
+func NewTunnelRecord(req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) *TunnelRecord {
+	tr := &TunnelRecord{ID: requestID(pctx), ClientIP: clientIP(req.RemoteAddr), Host: req.URL.Host,
+		Mode: tunnelMode(pctx), Rule: tunnelRule(pctx).Name, Up: tc.head(dirUp, int(tc.limit)),
+		Down: tc.head(dirDown, int(tc.limit)), SMTP: smtp}
+	tr.Protocol, tr.Guessed = tunnelProtocol(tc, pctx)
+	tc.mu.Lock()
+	tr.Truncated = tc.truncated
+	tc.mu.Unlock()
+	if s, ok := pctx.UserData.(*tunnelState); ok {
+		tr.ErrorResponse, tr.Start, tr.End, tr.Sent, tr.Received = s.errorResponse, s.start, s.end, s.up, s.down
+		tr.DialTime, tr.DialError, tr.PTR = s.dialTime, s.dialError, s.ptr
+		tr.Country, tr.City, tr.ASN = s.origin.Country, s.origin.City, s.origin.ASN
+	}
+	return tr
+}
+
+// hooks are the functions registered on a Server by the programs embedding
+// it. They're a Logger run first among the sinks, so that the sinks after it
+// get the tags added by the hooks.
+type hooks struct {
+	log      *slog.Logger
+	captured []func(ex *Exchange)
+	complete []func(ex *Exchange)
+	closed   []func(tr *TunnelRecord)
+}
+
+// OnRequestCaptured registers f to be called with every request as received,
+// before it's forwarded. The exchange has no response yet, and is a copy of
+// the one given to OnExchangeComplete later.
+//
+// The hooks are called one at a time in the logging goroutine, in the order of
+// the events, and must not block: the events waiting behind them expire after
+// -log-deadline. A panicking hook is logged and counted with the others, and
+// the event goes on to the next hooks and the sinks. Hooks must be registered
+// before the server is started.
+func (s *Server) OnRequestCaptured(f func(ex *Exchange)) {
+	s.hooks.captured = append(s.hooks.captured, f)
+}
+
+// OnExchangeComplete registers f to be called with every exchange, once the
+// analysis set its tags and before the sinks record it. f can add to its Tags
+// and Matches. The hooks are called like those of OnRequestCaptured.
+func (s *Server) OnExchangeComplete(f func(ex *Exchange)) {
+	s.hooks.complete = append(s.hooks.complete, f)
+}
+
+// OnTunnelClosed registers f to be called with every CONNECT tunnel once it's
+// closed, before the sinks record it. The hooks are called like those of
+// OnRequestCaptured.
+func (s *Server) OnTunnelClosed(f func(tr *TunnelRecord)) {
+	s.hooks.closed = append(s.hooks.closed, f)
+}
+
+// RegisterSink adds l to the sinks, after those of the config. It's closed by
+// Shutdown and checked by /readyz when it implements Check. Sinks must be
+// registered before the server is started.
+func (s *Server) RegisterSink(name string, l Logger) {
+	*s.sinks = append(*s.sinks, l)
+	s.health.registerSink(name, l)
+}
+
+// run calls f, containing its panic.
+func (h *hooks) run(where string, f func()) {
+	defer func() { recovered(h.log, where, recover()) }()
+	f()
+}
+
+// capture queues the OnRequestCaptured hooks with a copy of the exchange of
+// state as received.
+func (h *hooks) capture(logger *asyncLogger, ctx context.Context, state *requestState) {
+	if len(h.captured) == 0 {
+		return
+	}
+	ex := *state.exchange
+	err := logger.enqueue(ctx, "captured request", ex.ID, func(ctx context.Context) error {
+		for _, f := range h.captured {
+			h.run("OnRequestCaptured hook", func() { f(&ex) })
+		}
+		return nil
+	}, nil)
+	logFailed(h.log.With("request_id", ex.ID), "captured request", err)
+}
+
+func (h *hooks) LogExchange(ctx context.Context, ex *Exchange) error {
+	for _, f := range h.complete {
+		h.run("OnExchangeComplete hook", func() { f(ex) })
+	}
+	return nil
+}
+
+func (h *hooks) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	if len(h.closed) == 0 {
+		return nil
+	}
+	tr := NewTunnelRecord(req, tc, smtp, pctx)
+	for _, f := range h.closed {
+		h.run("OnTunnelClosed hook", func() { f(tr) })
+	}
+	return nil
+}
+
+func (h *hooks) Close() error {
+	return nil
+}
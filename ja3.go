@@ -0,0 +1,302 @@
+package stuffpot
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxTLSRecord is the longest TLS record, with its header, which is as much
+// of a ClientHello or ServerHello as its JA3 or JA3S is computed from.
+const maxTLSRecord = 5 + 16384
+
+// The extensions of the ClientHello JA3 and the SNI are read from.
+const (
+	extServerName      = 0
+	extSupportedGroups = 10
+	extPointFormats    = 11
+)
+
+var errShortHello = errors.New("truncated hello")
+
+// helloReader reads the fields of a ClientHello, failing once past its end.
+type helloReader struct {
+	b   []byte
+	err error
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = errShortHello
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *helloReader) uint8() int {
+	if b := r.bytes(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *helloReader) uint16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// vector returns the next field, prefixed with its length on size bytes.
+func (r *helloReader) vector(size int) *helloReader {
+	n := 0
+	for _, c := range r.bytes(size) {
+		n = n<<8 | int(c)
+	}
+	return &helloReader{b: r.bytes(n), err: r.err}
+}
+
+// uint16s returns the list of 16 bit values of r, without the GREASE ones.
+func (r *helloReader) uint16s() []string {
+	var list []string
+	for r.err == nil && len(r.b) >= 2 {
+		if v := r.uint16(); !isGrease(v) {
+			list = append(list, strconv.Itoa(v))
+		}
+	}
+	return list
+}
+
+// isGrease tells whether v is one of the values reserved by RFC 8701, which
+// clients send at random and JA3 ignores.
+func isGrease(v int) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// clientHello returns a reader of the body of the ClientHello at the start of
+// record, a TLS record. A ClientHello longer than the record, which clients
+// don't send, is truncated.
+func clientHello(record []byte) (*helloReader, error) {
+	r, typ := handshake(record)
+	if r == nil {
+		return nil, errors.New("not a handshake record")
+	}
+	if typ != 1 {
+		return nil, errors.New("not a ClientHello")
+	}
+	return r, nil
+}
+
+// serverHello returns a reader of the body of the ServerHello at the start of
+// record, a TLS record.
+func serverHello(record []byte) (*helloReader, error) {
+	r, typ := handshake(record)
+	if r == nil {
+		return nil, errors.New("not a handshake record")
+	}
+	if typ != 2 {
+		return nil, errors.New("not a ServerHello")
+	}
+	return r, nil
+}
+
+// handshake returns a reader of the body of the handshake message at the
+// start of record and its type, or nil if record isn't a handshake record.
+func handshake(record []byte) (*helloReader, int) {
+	r := &helloReader{b: record}
+	if r.uint8() != 0x16 {
+		return nil, 0
+	}
+	r.bytes(2)
+	r = r.vector(2)
+	typ := r.uint8()
+	return r.vector(3), typ
+}
+
+// ja3 returns the JA3 fingerprint of the ClientHello at the start of record,
+// and its MD5 hash.
+func ja3(record []byte) (string, string, error) {
+	r, err := clientHello(record)
+	if err != nil {
+		return "", "", err
+	}
+	version := r.uint16()
+	r.bytes(32)
+	r.vector(1)
+	ciphers := r.vector(2).uint16s()
+	r.vector(1)
+
+	var exts, groups, points []string
+	if len(r.b) > 0 {
+		list := r.vector(2)
+		for list.err == nil && len(list.b) > 0 {
+			typ := list.uint16()
+			data := list.vector(2)
+			if isGrease(typ) {
+				continue
+			}
+			exts = append(exts, strconv.Itoa(typ))
+			switch typ {
+			case extSupportedGroups:
+				groups = data.vector(2).uint16s()
+			case extPointFormats:
+				for _, p := range data.vector(1).b {
+					points = append(points, strconv.Itoa(int(p)))
+				}
+			}
+		}
+		if list.err != nil {
+			r.err = list.err
+		}
+	}
+	if r.err != nil {
+		return "", "", r.err
+	}
+	s := strings.Join([]string{strconv.Itoa(version), strings.Join(ciphers, "-"), strings.Join(exts, "-"),
+		strings.Join(groups, "-"), strings.Join(points, "-")}, ",")
+	sum := md5.Sum([]byte(s))
+	return s, hex.EncodeToString(sum[:]), nil
+}
+
+// ja3s returns the JA3S fingerprint of the ServerHello at the start of
+// record, and its MD5 hash.
+func ja3s(record []byte) (string, string, error) {
+	r, err := serverHello(record)
+	if err != nil {
+		return "", "", err
+	}
+	version := r.uint16()
+	r.bytes(32)
+	r.vector(1)
+	cipher := r.uint16()
+	r.uint8()
+
+	var exts []string
+	if len(r.b) > 0 {
+		list := r.vector(2)
+		for list.err == nil && len(list.b) > 0 {
+			typ := list.uint16()
+			list.vector(2)
+			if !isGrease(typ) {
+				exts = append(exts, strconv.Itoa(typ))
+			}
+		}
+		if list.err != nil {
+			r.err = list.err
+		}
+	}
+	if r.err != nil {
+		return "", "", r.err
+	}
+	s := strings.Join([]string{strconv.Itoa(version), strconv.Itoa(cipher), strings.Join(exts, "-")}, ",")
+	sum := md5.Sum([]byte(s))
+	return s, hex.EncodeToString(sum[:]), nil
+}
+
+// serverHellos holds the JA3S hashes of the ServerHellos of the open
+// connections to the remotes, by the address they were dialed to, for the
+// requests sent over them. The proxy's ClientHello being the same for all, a
+// remote answers each connection with the same ServerHello.
+type serverHellos struct {
+	m sync.Map
+}
+
+// wrap returns conn, dialed to addr, recording the JA3S of the ServerHello
+// the remote answers with, if it speaks TLS.
+func (h *serverHellos) wrap(conn net.Conn, addr string) net.Conn {
+	return &helloConn{Conn: conn, hellos: h, addr: addr}
+}
+
+// ja3s returns the JA3S hash of the open connection to addr, "" without
+// one.
+func (h *serverHellos) ja3s(addr string) string {
+	if hash, ok := h.m.Load(addr); ok {
+		return *hash.(*string)
+	}
+	return ""
+}
+
+// helloConn reads the first TLS record the remote sends, which starts with
+// its ServerHello. Its JA3S is forgotten once the connection is closed, unless
+// another connection to the same address replaced it.
+type helloConn struct {
+	net.Conn
+	hellos *serverHellos
+	addr   string
+	// buf is the start of the first record, until read in full. It's only
+	// used by Read, unlike hash.
+	buf  []byte
+	done bool
+	hash atomic.Pointer[string]
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done && n > 0 {
+		c.record(p[:n])
+	}
+	return n, err
+}
+
+func (c *helloConn) record(b []byte) {
+	c.buf = append(c.buf, b...)
+	if c.buf[0] != 0x16 {
+		c.done, c.buf = true, nil
+		return
+	}
+	if len(c.buf) < 5 {
+		return
+	}
+	if n := 5 + int(binary.BigEndian.Uint16(c.buf[3:5])); len(c.buf) < min(n, maxTLSRecord) {
+		return
+	}
+	if _, hash, err := ja3s(c.buf); err == nil {
+		c.hash.Store(&hash)
+		c.hellos.m.Store(c.addr, &hash)
+	}
+	c.done, c.buf = true, nil
+}
+
+func (c *helloConn) Close() error {
+	if hash := c.hash.Load(); hash != nil {
+		c.hellos.m.CompareAndDelete(c.addr, hash)
+	}
+	return c.Conn.Close()
+}
+
+// serverName returns the host name of the SNI of the ClientHello at the start
+// of record, "" without one.
+func serverName(record []byte) string {
+	r, err := clientHello(record)
+	if err != nil {
+		return ""
+	}
+	r.bytes(2 + 32)
+	r.vector(1)
+	r.vector(2)
+	r.vector(1)
+	list := r.vector(2)
+	for list.err == nil && len(list.b) > 0 {
+		typ := list.uint16()
+		data := list.vector(2)
+		if typ != extServerName {
+			continue
+		}
+		names := data.vector(2)
+		for names.err == nil && len(names.b) > 0 {
+			// Host names are the only type of name defined.
+			if kind, name := names.uint8(), names.vector(2); kind == 0 && name.err == nil {
+				return string(name.b)
+			}
+		}
+	}
+	return ""
+}
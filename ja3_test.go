@@ -0,0 +1,109 @@
+package stuffpot
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readRecorder keeps the bytes read from its connection.
+type readRecorder struct {
+	net.Conn
+	read bytes.Buffer
+}
+
+func (c *readRecorder) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Write(p[:n])
+	return n, err
+}
+
+func TestServerHelloJA3S(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		var hellos serverHellos
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := &readRecorder{Conn: raw}
+		conn := tls.Client(hellos.wrap(rec, addr), &tls.Config{InsecureSkipVerify: true, MaxVersion: version})
+		if err := conn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		s, hash, err := ja3s(rec.read.Bytes())
+		if err != nil {
+			t.Fatalf("%x: %v", version, err)
+		}
+		// The version is that of TLS 1.2 for TLS 1.3 too, which tells itself
+		// by its extensions.
+		want := fmt.Sprintf("771,%d,65281-23-11", conn.ConnectionState().CipherSuite)
+		if version == tls.VersionTLS13 {
+			want = fmt.Sprintf("771,%d,43-51", conn.ConnectionState().CipherSuite)
+		}
+		if s != want {
+			t.Errorf("%x: got JA3S %q, want %q", version, s, want)
+		}
+		if got := hellos.ja3s(addr); got != hash {
+			t.Errorf("%x: recorded JA3S %q, want %q", version, got, hash)
+		}
+		conn.Close()
+		if got := hellos.ja3s(addr); got != "" {
+			t.Errorf("%x: the JA3S %v of a closed connection is kept", version, got)
+		}
+	}
+}
+
+func TestRequestsSentOverTLSHaveTheirJA3S(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	// The tunnels to the port of secure are MITM'd.
+	port := secure.Listener.Addr().(*net.TCPAddr).Port
+	rec := &recordingLogger{}
+	s, client := startServer(t, testConfig(t, "-mitm-ports", strconv.Itoa(port)), rec)
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	for _, u := range []string{secure.URL, plain.URL} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ja3s := make(map[string]string)
+	for _, ex := range rec.logged() {
+		ja3s[ex.Request.URL.Scheme] = ex.JA3S
+	}
+	if len(ja3s) != 2 {
+		t.Fatalf("got the requests of %v, want https and http", ja3s)
+	}
+	if _, err := hex.DecodeString(ja3s["https"]); err != nil || len(ja3s["https"]) != 32 {
+		t.Errorf("the request sent over TLS has JA3S %q, want an MD5 hash", ja3s["https"])
+	}
+	if ja3s["http"] != "" {
+		t.Errorf("the plain request has JA3S %q", ja3s["http"])
+	}
+}
@@ -0,0 +1,96 @@
+package stuffpot
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sync"
+)
+
+//go:embed judges.yaml
+var defaultJudges []byte
+
+// JudgeRule recognizes the requests of proxy checkers to a judge. Every
+// pattern given must match.
+type JudgeRule struct {
+	Service string `yaml:"service"`
+	Host    string `yaml:"host"`
+	Path    string `yaml:"path"`
+
+	host, path *regexp.Regexp
+}
+
+func (r *JudgeRule) compile() error {
+	if r.Service == "" {
+		return errors.New("missing service")
+	}
+	if r.Host == "" && r.Path == "" {
+		return errors.New("no pattern")
+	}
+	var err error
+	if r.Host != "" {
+		if r.host, err = regexp.Compile(r.Host); err != nil {
+			return fmt.Errorf("host: %v", err)
+		}
+	}
+	if r.Path != "" {
+		if r.path, err = regexp.Compile(r.Path); err != nil {
+			return fmt.Errorf("path: %v", err)
+		}
+	}
+	return nil
+}
+
+func (r *JudgeRule) match(req *http.Request) bool {
+	return (r.host == nil || r.host.MatchString(req.URL.Hostname())) &&
+		(r.path == nil || r.path.MatchString(req.URL.Path))
+}
+
+// proxyCheck returns the service checking the proxy with req, if any. Besides
+// the judges, a GET of / on an IP address is taken as a check against the
+// checker's own judge, named after the address.
+func (rules *Rules) proxyCheck(req *http.Request) string {
+	for _, r := range rules.Judges {
+		if r.match(req) {
+			return r.Service
+		}
+	}
+	if req.Method == http.MethodGet && req.URL.Path == "/" && req.URL.RawQuery == "" {
+		if addr, err := netip.ParseAddr(req.URL.Hostname()); err == nil {
+			return addr.String()
+		}
+	}
+	return ""
+}
+
+// maxCheckers bounds the services remembered by proxyChecks, the checks of
+// further ones aren't reported.
+const maxCheckers = 4096
+
+// proxyChecks remembers the services which checked the proxy since startup,
+// to report the first check of each.
+type proxyChecks struct {
+	mu   sync.Mutex
+	seen map[string]bool
+	// first is called on the first check of a service.
+	first func(service, ip string)
+}
+
+func newProxyChecks(first func(service, ip string)) *proxyChecks {
+	return &proxyChecks{seen: make(map[string]bool), first: first}
+}
+
+func (c *proxyChecks) observe(service, ip string) {
+	c.mu.Lock()
+	first := !c.seen[service] && len(c.seen) < maxCheckers
+	if first {
+		c.seen[service] = true
+	}
+	c.mu.Unlock()
+	if first && c.first != nil {
+		c.first(service, ip)
+	}
+}
@@ -0,0 +1,63 @@
+package stuffpot
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/elazarl/goproxy"
+	"github.com/segmentio/kafka-go"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// kafkaBatchTimeout is the longest a request waits to be published.
+const kafkaBatchTimeout = time.Second
+
+// Kafka publishes each completed request to a topic, as the JSON of the
+// exchange keyed by the client address, so that the requests of a client
+// keep their order. Messages are sent in the background, those failing
+// being logged and lost.
+type Kafka struct {
+	w   *kafka.Writer
+	log *slog.Logger
+}
+
+func NewKafka(cfg KafkaConfig) *Kafka {
+	k := &Kafka{log: slog.With("component", "kafka")}
+	k.w = &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: kafkaBatchTimeout,
+		RequiredAcks: kafka.RequireOne,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				logFailures.Add(int64(len(messages)))
+				k.log.Error("Failed to publish requests", "requests", len(messages), "error", err)
+			}
+		},
+	}
+	if cfg.TLS {
+		k.w.Transport = &kafka.Transport{TLS: &tls.Config{MinVersion: tls.VersionTLS12}}
+	}
+	return k
+}
+
+func (k *Kafka) LogExchange(ctx context.Context, ex *Exchange) error {
+	b, err := json.Marshal(ex)
+	if err != nil {
+		return err
+	}
+	return k.w.WriteMessages(ctx, kafka.Message{Key: []byte(ex.ClientIP), Value: b, Time: ex.Start})
+}
+
+func (k *Kafka) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	return nil
+}
+
+// Close publishes the pending requests.
+func (k *Kafka) Close() error {
+	return k.w.Close()
+}
@@ -0,0 +1,99 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeKafka is a broker of a single partition, answering the produce
+// requests with errorCode.
+type fakeKafka struct {
+	mu        sync.Mutex
+	errorCode int16
+	records   []kafka.Message
+}
+
+func (f *fakeKafka) RoundTrip(ctx context.Context, addr net.Addr, req kafka.Request) (kafka.Response, error) {
+	switch req := req.(type) {
+	case *metadata.Request:
+		res := &metadata.Response{Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "127.0.0.1", Port: 9092}}}
+		for _, topic := range req.TopicNames {
+			res.Topics = append(res.Topics, metadata.ResponseTopic{Name: topic,
+				Partitions: []metadata.ResponsePartition{{PartitionIndex: 0, LeaderID: 1}}})
+		}
+		return res, nil
+	case *produce.Request:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		res := &produce.Response{}
+		for _, topic := range req.Topics {
+			rt := produce.ResponseTopic{Topic: topic.Topic}
+			for _, p := range topic.Partitions {
+				for {
+					r, err := p.RecordSet.Records.ReadRecord()
+					if err != nil {
+						break
+					}
+					key, _ := protocol.ReadAll(r.Key)
+					value, _ := protocol.ReadAll(r.Value)
+					f.records = append(f.records, kafka.Message{Topic: topic.Topic, Key: key, Value: value})
+				}
+				rt.Partitions = append(rt.Partitions, produce.ResponsePartition{Partition: p.Partition,
+					ErrorCode: f.errorCode})
+			}
+			res.Topics = append(res.Topics, rt)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unexpected %T", req)
+}
+
+func TestKafkaPublishesExchanges(t *testing.T) {
+	fake := &fakeKafka{}
+	publish := func() {
+		t.Helper()
+		k := NewKafka(KafkaConfig{Brokers: []string{"127.0.0.1:9092"}, Topic: "requests"})
+		k.w.Transport, k.w.MaxAttempts = fake, 1
+		req := httptest.NewRequest("GET", "http://a.example/", nil)
+		ex := finishedExchange(req, "r1", &http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{}}, 0)
+		if err := k.LogExchange(context.Background(), ex); err != nil {
+			t.Fatal(err)
+		}
+		if err := k.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failures := logFailures.Load()
+	publish()
+	if len(fake.records) != 1 {
+		t.Fatalf("got %d messages, want 1", len(fake.records))
+	}
+	var ex map[string]interface{}
+	if err := json.Unmarshal(fake.records[0].Value, &ex); err != nil {
+		t.Fatal(err)
+	}
+	if m := fake.records[0]; m.Topic != "requests" || string(m.Key) != "192.0.2.1" || ex["request_id"] != "r1" {
+		t.Errorf("got the message %v keyed %q, %v", m.Topic, m.Key, ex)
+	}
+	if n := logFailures.Load() - failures; n != 0 {
+		t.Errorf("got %d logging failures, want none", n)
+	}
+
+	// The messages the broker doesn't acknowledge are counted as failures.
+	fake.errorCode = 2 // CORRUPT_MESSAGE
+	publish()
+	if n := logFailures.Load() - failures; n != 1 {
+		t.Errorf("got %d logging failures, want the message which wasn't acknowledged", n)
+	}
+}
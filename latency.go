@@ -0,0 +1,411 @@
+package stuffpot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// latencyGamma is the ratio between the bounds of consecutive buckets of a
+// sketch, which keeps its percentiles within 1% of the durations counted.
+const latencyGamma = 1.02
+
+// latencySketch counts durations in buckets growing exponentially from 1µs,
+// so that percentiles are read from it within a relative error, and sketches
+// are merged by adding their counts. It's stored encoded in the stats tables.
+type latencySketch struct {
+	buckets map[int32]uint64
+	count   uint64
+}
+
+func newLatencySketch() *latencySketch {
+	return &latencySketch{buckets: make(map[int32]uint64)}
+}
+
+// add counts n durations of d.
+func (s *latencySketch) add(d time.Duration, n uint64) {
+	us := float64(d) / float64(time.Microsecond)
+	var i int32
+	if us > 1 {
+		i = int32(math.Ceil(math.Log(us) / math.Log(latencyGamma)))
+	}
+	s.buckets[i] += n
+	s.count += n
+}
+
+func (s *latencySketch) merge(o *latencySketch) {
+	for i, n := range o.buckets {
+		s.buckets[i] += n
+	}
+	s.count += o.count
+}
+
+// quantile returns the duration below which the q fraction of the durations
+// counted are.
+func (s *latencySketch) quantile(q float64) time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+	keys := make([]int32, 0, len(s.buckets))
+	for i := range s.buckets {
+		keys = append(keys, i)
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a] < keys[b] })
+	rank := max(uint64(math.Ceil(q*float64(s.count))), 1)
+	var seen uint64
+	for _, i := range keys {
+		if seen += s.buckets[i]; seen >= rank {
+			if i <= 0 {
+				return time.Microsecond
+			}
+			// The middle of the bucket, relatively.
+			us := 2 * math.Pow(latencyGamma, float64(i)) / (1 + latencyGamma)
+			return time.Duration(us * float64(time.Microsecond))
+		}
+	}
+	return 0
+}
+
+// encode returns the buckets in order, as varints of the difference between
+// their index and the previous one, followed by their count.
+func (s *latencySketch) encode() []byte {
+	keys := make([]int32, 0, len(s.buckets))
+	for i := range s.buckets {
+		keys = append(keys, i)
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a] < keys[b] })
+	b := binary.AppendUvarint(nil, uint64(len(keys)))
+	prev := int32(0)
+	for _, i := range keys {
+		b = binary.AppendVarint(b, int64(i-prev))
+		b = binary.AppendUvarint(b, s.buckets[i])
+		prev = i
+	}
+	return b
+}
+
+func decodeLatencySketch(b []byte) (*latencySketch, error) {
+	s := newLatencySketch()
+	if len(b) == 0 {
+		return s, nil
+	}
+	n, k := binary.Uvarint(b)
+	if k <= 0 {
+		return nil, errors.New("invalid latency sketch")
+	}
+	b = b[k:]
+	prev := int32(0)
+	for range n {
+		delta, k := binary.Varint(b)
+		if k <= 0 {
+			return nil, errors.New("invalid latency sketch")
+		}
+		b = b[k:]
+		count, k := binary.Uvarint(b)
+		if k <= 0 {
+			return nil, errors.New("invalid latency sketch")
+		}
+		b = b[k:]
+		prev += int32(delta)
+		s.buckets[prev] = count
+		s.count += count
+	}
+	return s, nil
+}
+
+// exchangeLatency returns the upstream round trip time of ex and the time
+// added by the proxy until the response headers were ready, which ok tells
+// are known: the request got a response from the remote.
+func exchangeLatency(ex *Exchange) (upstream, overhead time.Duration, ok bool) {
+	if ex.Upstream <= 0 || ex.Responded.IsZero() {
+		return 0, 0, false
+	}
+	return ex.Upstream, max(ex.Responded.Sub(ex.Start)-ex.Upstream, 0), true
+}
+
+// errorType classifies the error of a failed exchange, or returns "" without
+// one.
+func errorType(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var headerErr tls.RecordHeaderError
+	var unknownAuth x509.UnknownAuthorityError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.As(err, &certErr), errors.As(err, &headerErr), errors.As(err, &unknownAuth),
+		strings.Contains(err.Error(), "tls:"):
+		return "tls"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	}
+	return "other"
+}
+
+// latencyKey is a row of daily_latency_stats: the latencies of a day, of all
+// the requests, or of those of a host or a client.
+type latencyKey struct {
+	day, scope, key string
+}
+
+// latencyRow is the counts of a latencyKey.
+type latencyRow struct {
+	requests           int64
+	upstream, overhead *latencySketch
+}
+
+// addLatency adds n requests with these latencies to the row of k in tx.
+func addLatency(tx *sql.Tx, k latencyKey, upstream, overhead time.Duration, n uint64) error {
+	row := &latencyRow{upstream: newLatencySketch(), overhead: newLatencySketch()}
+	var up, over []byte
+	err := tx.QueryRow("select requests, upstream, overhead from daily_latency_stats where day = ? and scope = ? and key = ?",
+		k.day, k.scope, k.key).Scan(&row.requests, &up, &over)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil {
+		if row.upstream, err = decodeLatencySketch(up); err != nil {
+			return err
+		}
+		if row.overhead, err = decodeLatencySketch(over); err != nil {
+			return err
+		}
+	}
+	row.requests += int64(n)
+	row.upstream.add(upstream, n)
+	row.overhead.add(overhead, n)
+	return writeLatency(tx, k, row)
+}
+
+func writeLatency(tx *sql.Tx, k latencyKey, row *latencyRow) error {
+	_, err := tx.Exec(`insert into daily_latency_stats (day, scope, key, requests, upstream, overhead) values (?,?,?,?,?,?)
+      on conflict (day, scope, key) do update set requests = excluded.requests, upstream = excluded.upstream,
+        overhead = excluded.overhead`, k.day, k.scope, k.key, row.requests, row.upstream.encode(), row.overhead.encode())
+	return err
+}
+
+// updateLatency counts the latencies and the error of ex, occurring n times,
+// in the stats of its day.
+func updateLatency(tx *sql.Tx, ex *Exchange, day string, n uint64) error {
+	if upstream, overhead, ok := exchangeLatency(ex); ok {
+		// The durations are counted as they're stored, to the microsecond,
+		// so that reindexing them fills the same buckets.
+		upstream, overhead = upstream.Truncate(time.Microsecond), overhead.Truncate(time.Microsecond)
+		for _, k := range []latencyKey{{day, "all", ""}, {day, "host", ex.Request.Host}, {day, "client", ex.ClientIP}} {
+			if err := addLatency(tx, k, upstream, overhead, n); err != nil {
+				return fmt.Errorf("update latency stats: %w", err)
+			}
+		}
+	}
+	if t := errorType(ex.Err); t != "" {
+		_, err := tx.Exec(`insert into daily_error_stats (day, error, requests) values (?,?,?)
+          on conflict (day, error) do update set requests = requests + excluded.requests`, day, t, n)
+		if err != nil {
+			return fmt.Errorf("update error stats: %w", err)
+		}
+	}
+	return nil
+}
+
+// reindexLatencyTx rebuilds the latency and error stats from the durations
+// and errors stored with the requests.
+func reindexLatencyTx(tx *sql.Tx) error {
+	for _, stmt := range []string{"delete from daily_latency_stats", "delete from daily_error_stats"} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	rows, err := tx.Query(`select substr(created_at, 1, 10), coalesce(host, ''), coalesce(from_ip, ''), upstream_us,
+      overhead_us, coalesce(error_type, ''), coalesce(occurrences, 1) from requests
+      where upstream_us is not null or error_type is not null`)
+	if err != nil {
+		return err
+	}
+	latencies := make(map[latencyKey]*latencyRow)
+	errs := make(map[[2]string]int64)
+	for rows.Next() {
+		var day, host, ip, errType string
+		var up, over sql.NullInt64
+		var n int64
+		if err := rows.Scan(&day, &host, &ip, &up, &over, &errType, &n); err != nil {
+			rows.Close()
+			return err
+		}
+		if up.Valid {
+			for _, k := range []latencyKey{{day, "all", ""}, {day, "host", host}, {day, "client", ip}} {
+				row := latencies[k]
+				if row == nil {
+					row = &latencyRow{upstream: newLatencySketch(), overhead: newLatencySketch()}
+					latencies[k] = row
+				}
+				row.requests += n
+				row.upstream.add(time.Duration(up.Int64)*time.Microsecond, uint64(n))
+				row.overhead.add(time.Duration(over.Int64)*time.Microsecond, uint64(n))
+			}
+		}
+		if errType != "" {
+			errs[[2]string{day, errType}] += n
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for k, row := range latencies {
+		if err := writeLatency(tx, k, row); err != nil {
+			return err
+		}
+	}
+	for k, n := range errs {
+		if _, err := tx.Exec("insert into daily_error_stats (day, error, requests) values (?,?,?)", k[0], k[1], n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latencyPercentiles are percentiles of a sketch, in milliseconds.
+type latencyPercentiles struct {
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P99 float64 `json:"p99_ms"`
+}
+
+func percentiles(s *latencySketch) latencyPercentiles {
+	ms := func(q float64) float64 {
+		return math.Round(float64(s.quantile(q))/float64(time.Millisecond)*1000) / 1000
+	}
+	return latencyPercentiles{ms(0.5), ms(0.9), ms(0.99)}
+}
+
+// reportLatency is the latency analysis of a day. Requests counts those which
+// got a response from the remote, the latencies being theirs. Overhead is the
+// time the proxy took until the response headers were ready, besides the
+// round trip.
+type reportLatency struct {
+	Day      string               `json:"day"`
+	Requests int64                `json:"requests"`
+	Upstream latencyPercentiles   `json:"upstream"`
+	Overhead latencyPercentiles   `json:"overhead"`
+	Hosts    []reportLatencyCount `json:"hosts"`
+	Clients  []reportLatencyCount `json:"clients"`
+	// Errors are the failed requests by error type, their rate being among
+	// all the requests of the day.
+	Errors []reportError `json:"errors"`
+}
+
+type reportLatencyCount struct {
+	Name     string             `json:"name"`
+	Requests int64              `json:"requests"`
+	Upstream latencyPercentiles `json:"upstream"`
+}
+
+type reportError struct {
+	Error    string  `json:"error"`
+	Requests int64   `json:"requests"`
+	Rate     float64 `json:"rate"`
+}
+
+// readLatency reads the latency analysis of day from db, with the top hosts
+// and clients by requests. A database older than the stats has none.
+func readLatency(db *sql.DB, day string, top int) (*reportLatency, error) {
+	l := &reportLatency{Day: day, Hosts: []reportLatencyCount{}, Clients: []reportLatencyCount{}, Errors: []reportError{}}
+	if ok, err := hasTable(db, "daily_latency_stats"); err != nil || !ok {
+		return l, err
+	}
+
+	var up, over []byte
+	err := db.QueryRow("select requests, upstream, overhead from daily_latency_stats where day = ? and scope = 'all'",
+		day).Scan(&l.Requests, &up, &over)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	for _, p := range []struct {
+		blob []byte
+		out  *latencyPercentiles
+	}{{up, &l.Upstream}, {over, &l.Overhead}} {
+		s, err := decodeLatencySketch(p.blob)
+		if err != nil {
+			return nil, err
+		}
+		*p.out = percentiles(s)
+	}
+
+	for _, scope := range []struct {
+		name string
+		out  *[]reportLatencyCount
+	}{{"host", &l.Hosts}, {"client", &l.Clients}} {
+		rows, err := db.Query(`select key, requests, upstream from daily_latency_stats where day = ? and scope = ?
+          order by requests desc, key limit ?`, day, scope.name, top)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var c reportLatencyCount
+			var blob []byte
+			if err := rows.Scan(&c.Name, &c.Requests, &blob); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			s, err := decodeLatencySketch(blob)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			c.Upstream = percentiles(s)
+			*scope.out = append(*scope.out, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var total int64
+	if err := db.QueryRow("select coalesce(sum(requests), 0) from daily_client_stats where day = ?", day).Scan(&total); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("select error, requests from daily_error_stats where day = ? order by requests desc, error", day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e reportError
+		if err := rows.Scan(&e.Error, &e.Requests); err != nil {
+			return nil, err
+		}
+		if total > 0 {
+			e.Rate = math.Round(float64(e.Requests)/float64(total)*10000) / 10000
+		}
+		l.Errors = append(l.Errors, e)
+	}
+	return l, rows.Err()
+}
+
+// latencyStats reads the latencies of day from the database.
+func (logger *HttpLogger) latencyStats(day string) (*reportLatency, error) {
+	return readLatency(logger.db, day, reportTop)
+}
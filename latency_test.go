@@ -0,0 +1,48 @@
+package stuffpot
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLatencySketchQuantiles(t *testing.T) {
+	whole, low, high := newLatencySketch(), newLatencySketch(), newLatencySketch()
+	for ms := 1; ms <= 1000; ms++ {
+		d := time.Duration(ms) * time.Millisecond
+		whole.add(d, 1)
+		if ms <= 500 {
+			low.add(d, 1)
+		} else {
+			high.add(d, 1)
+		}
+	}
+	for _, tt := range []struct {
+		q    float64
+		want time.Duration
+	}{{0.5, 500 * time.Millisecond}, {0.9, 900 * time.Millisecond}, {0.99, 990 * time.Millisecond}} {
+		got := whole.quantile(tt.q)
+		if math.Abs(float64(got-tt.want)) > 0.01*float64(tt.want) {
+			t.Errorf("quantile(%v) = %v, want %v within 1%%", tt.q, got, tt.want)
+		}
+	}
+	if got := newLatencySketch().quantile(0.5); got != 0 {
+		t.Errorf("the median of no durations is %v", got)
+	}
+
+	low.merge(high)
+	if !reflect.DeepEqual(low, whole) {
+		t.Errorf("the merged halves differ from the whole: %d durations, want %d", low.count, whole.count)
+	}
+	decoded, err := decodeLatencySketch(whole.encode())
+	if err != nil || !reflect.DeepEqual(decoded, whole) {
+		t.Errorf("the decoded sketch differs from the encoded one: %v", err)
+	}
+	if _, err := decodeLatencySketch([]byte{3, 1}); err == nil {
+		t.Error("a truncated sketch was decoded")
+	}
+	if p := percentiles(whole); p.P50 < 495 || p.P50 > 505 || p.P99 < 980 || p.P99 > 1000 {
+		t.Errorf("got percentiles %+v in milliseconds", p)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package stuffpot
+
+import "os"
+
+// lockDatabase creates path.lock, the lock file of the database at path,
+// without locking it: purge can't tell the database is in use here.
+func lockDatabase(path string, exclusive bool) (*os.File, error) {
+	return os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+}
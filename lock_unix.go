@@ -0,0 +1,27 @@
+//go:build unix
+
+package stuffpot
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDatabase locks path.lock, the lock file of the database at path,
+// without waiting. Serving processes hold it shared, so that purge can tell
+// the database is in use by taking it exclusively.
+func lockDatabase(path string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,737 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	_ "github.com/mattn/go-sqlite3"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HttpLogger stores the traffic in a SQLite database.
+//
+// The server writes through a single goroutine, that of its logging queue,
+// every write being queued, and reads from any. The writes still hold mu, so
+// that those of other callers, and the health checks, are serialized with
+// them instead of failing on SQLite's lock. The settings are only changed
+// before the logger is shared.
+type HttpLogger struct {
+	db *sql.DB
+	// mu is held by the writes, which use the prepared statements.
+	mu sync.Mutex
+	// maxRecords is the number of requests and tunnels kept, the oldest
+	// being evicted, or 0 to keep them all.
+	maxRecords int64
+	// dedupeWindow is the time within which identical requests are counted
+	// on the first one's row, from the same client with dedupeClient.
+	dedupeWindow time.Duration
+	dedupeClient bool
+	// search indexes the requests in the request_search table.
+	search bool
+	// trafficTop is the number of hosts kept by day in host_traffic, and of
+	// targets in connect_targets, 0 keeping them all.
+	trafficTop int
+	// stmts are the prepared statements below, closed with the database.
+	stmts []*sql.Stmt
+
+	insertRequest *sql.Stmt
+	insertTag     *sql.Stmt
+	insertResp    *sql.Stmt
+	insertBody    *sql.Stmt
+	upsertSession *sql.Stmt
+	upsertVisit   *sql.Stmt
+	upsertClient  *sql.Stmt
+	upsertHost    *sql.Stmt
+	insertHostIP  *sql.Stmt
+	upsertTagStat *sql.Stmt
+	upsertDayIP   *sql.Stmt
+	upsertDayHost *sql.Stmt
+	upsertDayTag  *sql.Stmt
+	upsertCheck   *sql.Stmt
+	insertToken   *sql.Stmt
+	upsertPrint   *sql.Stmt
+	insertSample  *sql.Stmt
+	insertConnect *sql.Stmt
+	insertSmtp    *sql.Stmt
+	insertCapture *sql.Stmt
+}
+
+// NewLogger opens the database, creating the schema if needed. A database
+// whose existing tables don't match the schema is an error.
+func NewLogger(dbname string) (*HttpLogger, error) {
+	db, err := sql.Open("sqlite3", dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := &HttpLogger{db: db}
+	if err := logger.init(); err != nil {
+		logger.Close()
+		return nil, fmt.Errorf("%v: %w", dbname, err)
+	}
+
+	return logger, nil
+}
+
+// NewMemoryLogger opens a database in memory, lost once closed, which keeps
+// the last maxRecords requests and tunnels. The stats tables still count the
+// evicted ones.
+func NewMemoryLogger(maxRecords int) (*HttpLogger, error) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// Every connection to :memory: opens a database of its own.
+	db.SetMaxOpenConns(1)
+
+	logger := &HttpLogger{db: db, maxRecords: int64(maxRecords)}
+	if err := logger.init(); err != nil {
+		logger.Close()
+		return nil, fmt.Errorf("memory store: %w", err)
+	}
+	return logger, nil
+}
+
+// evict deletes the rows of table, and those referencing them, older than
+// the last maxRecords. The ids are autoincremented, last being the latest.
+func (logger *HttpLogger) evict(tx *sql.Tx, last int64, deletes ...string) error {
+	if logger.maxRecords <= 0 || last <= logger.maxRecords {
+		return nil
+	}
+	for _, query := range deletes {
+		if _, err := tx.Exec(query, last-logger.maxRecords); err != nil {
+			return fmt.Errorf("evict: %w", err)
+		}
+	}
+	return nil
+}
+
+func (logger *HttpLogger) init() error {
+	var existing int
+	err := logger.db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'requests'").Scan(&existing)
+	if err != nil {
+		return err
+	}
+	sc, err := logger.validateSchema()
+	if err != nil {
+		return err
+	}
+
+	migrated, err := logger.migrate(sc.Version, 0, sc.Legacy)
+	if err != nil {
+		return err
+	}
+
+	// The metadata records which version created the database and which one
+	// last changed its schema, databases older than the table having no
+	// created_by.
+	if existing == 0 {
+		if err := logger.setMetadata("created_by", getBuildInfo().String()); err != nil {
+			return err
+		}
+	}
+	if existing == 0 || migrated {
+		if err := logger.setMetadata("migrated_by", getBuildInfo().String()); err != nil {
+			return err
+		}
+	}
+
+	// Preparing the inserts checks the columns of existing tables.
+	for _, s := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&logger.insertRequest, `insert into requests (request_id, parent_id, from_ip, method, host, url, headers, tags, header_order, fingerprint,
+          status, size, source, import_hash, dedupe_key, occurrences, last_seen, upstream_us, overhead_us, error_type,
+          request_size, error_response, parse_anomalies, ja3, ja3s, country, city, asn, ptr, session_id, raw_request,
+          raw_response, created_at) values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`},
+		{&logger.insertTag, "insert into request_tags (request_id, tag, location, offset, match, source) values (?,?,?,?,?,?)"},
+		{&logger.insertResp, `insert into responses (request_id, status, proto, headers, latency_us, size, created_at)
+          values (?,?,?,?,?,?,?)`},
+		{&logger.insertBody, `insert into bodies (request_id, location, content_type, content_encoding, size, truncated, data,
+          created_at) values (?,?,?,?,?,?,?,?)`},
+		{&logger.upsertSession, `insert into sessions (session_id, tag, from_ip, started_at, updated_at, attempts, usernames)
+          values (?,?,?,?,?,?,?) on conflict (session_id) do update set updated_at = excluded.updated_at,
+          attempts = excluded.attempts, usernames = excluded.usernames`},
+		{&logger.upsertVisit, `insert into client_sessions (session_id, from_ip, ja3, user_agent, tool, started_at, updated_at,
+          requests) values (?,?,?,?,?,?,?,?) on conflict (session_id) do update set updated_at = excluded.updated_at,
+          requests = excluded.requests`},
+		{&logger.upsertClient, `insert into client_stats (ip, first_seen, last_seen, requests, bytes, errors, score)
+          values (?,?,?,1,?,?,?) on conflict (ip) do update set last_seen = max(last_seen, excluded.last_seen),
+          requests = requests + 1, bytes = bytes + excluded.bytes, errors = errors + excluded.errors,
+          score = coalesce(excluded.score, score)`},
+		{&logger.insertHostIP, "insert or ignore into host_clients (host, ip) values (?,?)"},
+		{&logger.upsertHost, `insert into host_stats (host, requests, clients, first_seen, last_seen) values (?,1,?,?,?)
+          on conflict (host) do update set requests = requests + 1, clients = clients + excluded.clients,
+          last_seen = max(last_seen, excluded.last_seen)`},
+		{&logger.upsertTagStat, `insert into client_tag_stats (ip, tag, requests) values (?,?,1)
+          on conflict (ip, tag) do update set requests = requests + 1`},
+		{&logger.upsertDayIP, `insert into daily_client_stats (day, ip, requests, bytes, errors) values (?,?,1,?,?)
+          on conflict (day, ip) do update set requests = requests + 1, bytes = bytes + excluded.bytes,
+          errors = errors + excluded.errors`},
+		{&logger.upsertDayHost, `insert into daily_host_stats (day, host, requests) values (?,?,1)
+          on conflict (day, host) do update set requests = requests + 1`},
+		{&logger.upsertDayTag, `insert into daily_tag_stats (day, tag, requests) values (?,?,1)
+          on conflict (day, tag) do update set requests = requests + 1`},
+		{&logger.upsertCheck, `insert into proxy_checks (service, first_seen, last_seen, checks, last_client) values (?,?,?,1,?)
+          on conflict (service) do update set last_seen = excluded.last_seen, checks = checks + 1,
+          last_client = excluded.last_client`},
+		{&logger.insertToken, "insert or ignore into honeytokens (token, rule, client_ip, request_id, issued_at) values (?,?,?,?,?)"},
+		{&logger.upsertPrint, `insert into fingerprints (hash, headers, label, first_seen, last_seen, requests) values (?,?,?,?,?,1)
+          on conflict (hash) do update set last_seen = max(last_seen, excluded.last_seen), requests = requests + 1,
+          label = coalesce(excluded.label, label)`},
+		{&logger.insertSample, `insert into samples (sha256, size, type, direction, request_id, status, created_at)
+          values (?,?,?,?,?,?,?)`},
+		{&logger.insertConnect, `insert into connects (tunnel_id, from_ip, host, protocol, capture_truncated, rule, error_response,
+          dial_us, dial_error, mode, bytes_up, bytes_down, duration_us, country, city, asn, ptr, tags)
+          values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`},
+		{&logger.insertSmtp, `insert into smtp_attempts (connect_id, from_ip, host, helo, auth_mechanism, auth_user,
+          auth_pass, mail_from, rcpt_to, message_size, messages, starttls, blocked) values (?,?,?,?,?,?,?,?,?,?,?,?,?)`},
+		{&logger.insertCapture, "insert into tunnel_capture (connect_id, direction, offset, bytes) values (?,?,?,?)"},
+	} {
+		stmt, err := logger.db.Prepare(s.query)
+		if err != nil {
+			return fmt.Errorf("unexpected schema: %w", err)
+		}
+		*s.stmt = stmt
+		logger.stmts = append(logger.stmts, stmt)
+	}
+
+	return nil
+}
+
+// addColumn adds column to table unless it's already there, and tells whether
+// it did.
+func (logger *HttpLogger) addColumn(table, column, typ string) (bool, error) {
+	rows, err := logger.db.Query("select name from pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	_, err = logger.db.Exec(fmt.Sprintf("alter table %v add column %v %v", table, column, typ))
+	return err == nil, err
+}
+
+func (logger *HttpLogger) setMetadata(key, value string) error {
+	_, err := logger.db.Exec("insert or replace into metadata (key, value) values (?, ?)", key, value)
+	return err
+}
+
+// headerLines returns the headers of h as logged, a line per value with the
+// name in lower case.
+func headerLines(h http.Header) string {
+	var lines []string
+	for name, values := range h {
+		name = strings.ToLower(name)
+		for _, v := range values {
+			lines = append(lines, fmt.Sprintf("%v: %v", name, v))
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// LogExchange records the request with the status and size of its response, the
+// response in responses, the bodies read by then in bodies, its cookies and
+// credentials, its session, and the honeytoken first issued in it. A request
+// deduplicated is only counted on the row of the first one, and in the stats.
+// The detail shed by the logging pipeline under pressure is left out of the
+// row, never out of the stats.
+func (logger *HttpLogger) LogExchange(ctx context.Context, ex *Exchange) error {
+	req, state := ex.Request, ex.state
+	shed := shedLevel(ctx)
+
+	tx, ev, err := logger.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer ev.end()
+
+	var parentID, tags, headerOrder, print, source, importHash, anomalies, ja3, ja3s, ptr, sessionID, rawReq, rawResp interface{}
+	if ex.ParentID != "" {
+		parentID = ex.ParentID
+	}
+	if ex.SessionID != "" {
+		sessionID = ex.SessionID
+	}
+	if ex.RawRequest != "" {
+		rawReq = ex.RawRequest
+	}
+	if ex.RawResponse != "" {
+		rawResp = ex.RawResponse
+	}
+	if state.ptr != "" {
+		ptr = state.ptr
+	}
+	if ex.JA3 != "" {
+		ja3 = ex.JA3
+	}
+	if ex.JA3S != "" {
+		ja3s = ex.JA3S
+	}
+	if state.source != "" {
+		source, importHash = state.source, state.importHash
+	}
+	if len(ex.Tags) > 0 {
+		tags = strings.Join(ex.Tags, ",")
+	}
+	if state.fingerprint != "" {
+		headerOrder, print = strings.Join(state.headers, ","), state.fingerprint
+	}
+	if a := state.anomaliesJSON(); a != nil {
+		anomalies = string(a)
+	}
+	var headers interface{} = headerLines(req.Header)
+	if shed >= shedHeaders {
+		headers, headerOrder, anomalies = nil, nil, nil
+	}
+
+	ip := ex.ClientIP
+	at := ex.Start.UTC().Format(time.DateTime)
+	merged, key, err := logger.dedupe(tx, ex, at)
+	if err != nil {
+		return err
+	}
+	if !merged {
+		var occurrences, lastSeen, upstream, overhead, errType, errResp interface{}
+		if key != nil {
+			occurrences, lastSeen = 1, at
+		}
+		if up, over, ok := exchangeLatency(ex); ok {
+			upstream, overhead = up.Microseconds(), over.Microseconds()
+		}
+		if t := errorType(ex.Err); t != "" {
+			errType = t
+		}
+		if ex.ErrorResponse != "" {
+			errResp = ex.ErrorResponse
+		}
+		country, city, asn := state.origin.columns()
+		res, err := tx.Stmt(logger.insertRequest).Exec(ex.ID, parentID, ip, req.Method, req.Host, req.URL.String(),
+			headers, tags, headerOrder, print, ex.Status(), ex.Size, source, importHash,
+			key, occurrences, lastSeen, upstream, overhead, errType, ex.Received, errResp, anomalies, ja3,
+			ja3s, country, city, asn, ptr, sessionID, rawReq, rawResp, at)
+		if err != nil {
+			return fmt.Errorf("insert request: %w", err)
+		}
+		last, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if logger.search && shed < shedMinimal {
+			indexed, _ := headers.(string)
+			if err := logger.indexRequest(tx, last, ex, indexed, shed < shedBodies); err != nil {
+				return err
+			}
+		}
+		if resp := ex.Response; resp != nil && shed < shedMinimal {
+			var headers, latency interface{}
+			if shed < shedHeaders {
+				headers = headerLines(resp.Header)
+			}
+			if !ex.Responded.IsZero() {
+				latency = ex.Responded.Sub(ex.Start).Microseconds()
+			}
+			_, err := tx.Stmt(logger.insertResp).Exec(ex.ID, resp.StatusCode, resp.Proto, headers, latency, ex.Size, at)
+			if err != nil {
+				return fmt.Errorf("insert response: %w", err)
+			}
+		}
+		if shed < shedHeaders {
+			if err := logCookies(tx, ex, at); err != nil {
+				return err
+			}
+		}
+		if shed < shedBodies {
+			if err := logger.logBodies(tx, ex, at); err != nil {
+				return err
+			}
+		}
+		deletes := []string{
+			"delete from request_tags where request_id in (select request_id from requests where id <= ?)",
+			"delete from responses where request_id in (select request_id from requests where id <= ?)",
+			"delete from bodies where request_id in (select request_id from requests where id <= ?)",
+			"delete from credentials where request_id in (select request_id from requests where id <= ?)",
+			"delete from cookies where request_id in (select request_id from requests where id <= ?)",
+			"delete from requests where id <= ?",
+		}
+		if logger.search {
+			deletes = append(deletes, "delete from request_search where rowid <= ?")
+		}
+		if err := logger.evict(tx, last, deletes...); err != nil {
+			return err
+		}
+	}
+
+	if err := logger.updateStats(tx, ex, at); err != nil {
+		return err
+	}
+
+	if state.fingerprint != "" {
+		var label interface{}
+		if state.label != "" {
+			label = state.label
+		}
+		if _, err := tx.Stmt(logger.upsertPrint).Exec(state.fingerprint, headerOrder, label, at, at); err != nil {
+			return fmt.Errorf("upsert fingerprint: %w", err)
+		}
+	}
+
+	if !merged && len(ex.Matches) > 0 && shed < shedHeaders {
+		stmt := tx.Stmt(logger.insertTag)
+		for _, m := range ex.Matches {
+			var source interface{}
+			if m.Source != "" {
+				source = m.Source
+			}
+			if _, err := stmt.Exec(ex.ID, m.Tag, m.Location, m.Offset, m.Match, source); err != nil {
+				return fmt.Errorf("insert request tag: %w", err)
+			}
+		}
+	}
+
+	if !merged && len(state.credentials) > 0 {
+		if _, err := insertCredentials(tx, ex.ID, ip, state.credentials, at); err != nil {
+			return err
+		}
+	}
+
+	if state.session != nil {
+		s := state.session
+		_, err = tx.Stmt(logger.upsertSession).Exec(s.ID, s.Tag, s.ClientIP, s.Started.UTC().Format(time.DateTime),
+			s.Updated.UTC().Format(time.DateTime), s.Attempts, s.Usernames)
+		if err != nil {
+			return fmt.Errorf("upsert session: %w", err)
+		}
+	}
+
+	if v := state.visit; v != nil {
+		var ja3, userAgent, tool interface{}
+		if v.JA3 != "" {
+			ja3 = v.JA3
+		}
+		if v.UserAgent != "" {
+			userAgent = v.UserAgent
+		}
+		if v.Tool != "" {
+			tool = v.Tool
+		}
+		_, err = tx.Stmt(logger.upsertVisit).Exec(v.ID, v.ClientIP, ja3, userAgent, tool,
+			v.Started.UTC().Format(time.DateTime), v.Updated.UTC().Format(time.DateTime), v.Requests)
+		if err != nil {
+			return fmt.Errorf("upsert client session: %w", err)
+		}
+	}
+
+	if state.check != "" {
+		_, err = tx.Stmt(logger.upsertCheck).Exec(state.check, at, at, ip)
+		if err != nil {
+			return fmt.Errorf("upsert proxy check: %w", err)
+		}
+	}
+
+	if t := state.issued; t != nil {
+		_, err := tx.Stmt(logger.insertToken).Exec(t.Token, t.Rule, t.ClientIP, t.RequestID, t.IssuedAt.UTC().Format(time.DateTime))
+		if err != nil {
+			return fmt.Errorf("insert honeytoken: %w", err)
+		}
+	}
+
+	return ev.commit()
+}
+
+// updateStats counts a request in the stats tables, within the transaction
+// inserting it so that they can't drift. reindexStats must agree with it.
+func (logger *HttpLogger) updateStats(tx *sql.Tx, ex *Exchange, at string) error {
+	ip, host, tags := ex.ClientIP, ex.Request.Host, ex.Tags
+	var score interface{}
+	if ex.state.score != nil {
+		score = ex.state.score.Score
+	}
+	failed := 0
+	if status := ex.Status(); status == 0 || status >= 400 {
+		failed = 1
+	}
+	if _, err := tx.Stmt(logger.upsertClient).Exec(ip, at, at, ex.Size, failed, score); err != nil {
+		return fmt.Errorf("upsert client stats: %w", err)
+	}
+	for _, tag := range tags {
+		if _, err := tx.Stmt(logger.upsertTagStat).Exec(ip, tag); err != nil {
+			return fmt.Errorf("upsert client tag stats: %w", err)
+		}
+	}
+
+	res, err := tx.Stmt(logger.insertHostIP).Exec(host, ip)
+	if err != nil {
+		return fmt.Errorf("insert host client: %w", err)
+	}
+	newClient, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmt(logger.upsertHost).Exec(host, newClient, at, at); err != nil {
+		return fmt.Errorf("upsert host stats: %w", err)
+	}
+
+	// The daily tables are what reports are made of.
+	day := at[:len(dayFormat)]
+	if _, err := tx.Stmt(logger.upsertDayIP).Exec(day, ip, ex.Size, failed); err != nil {
+		return fmt.Errorf("upsert daily client stats: %w", err)
+	}
+	if _, err := tx.Stmt(logger.upsertDayHost).Exec(day, host); err != nil {
+		return fmt.Errorf("upsert daily host stats: %w", err)
+	}
+	for _, tag := range tags {
+		if _, err := tx.Stmt(logger.upsertDayTag).Exec(day, tag); err != nil {
+			return fmt.Errorf("upsert daily tag stats: %w", err)
+		}
+	}
+	if err := logger.updateTraffic(tx, ex, day); err != nil {
+		return err
+	}
+	return updateLatency(tx, ex, day, 1)
+}
+
+func (logger *HttpLogger) honeytokens() ([]honeytoken, error) {
+	return readHoneytokens(logger.db)
+}
+
+func (logger *HttpLogger) fingerprints() ([]clientFingerprint, error) {
+	return readFingerprints(logger.db)
+}
+
+// labelFingerprint names a fingerprint. An empty label is stored as such, so
+// that it overrides the label of older day files.
+func (logger *HttpLogger) labelFingerprint(hash, label string) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	_, err := logger.db.Exec(`insert into fingerprints (hash, label) values (?,?)
+      on conflict (hash) do update set label = excluded.label`, hash, label)
+	return err
+}
+
+// logAdminCall records a call to the admin API.
+func (logger *HttpLogger) logAdminCall(call *adminCall) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var tokenID, params interface{}
+	if call.TokenID != "" {
+		tokenID = call.TokenID
+	}
+	if call.Params != "" {
+		params = call.Params
+	}
+	_, err := logger.db.Exec(`insert into admin_audit (token_id, method, endpoint, params, status, client_ip, created_at)
+      values (?,?,?,?,?,?,?)`, tokenID, call.Method, call.Endpoint, params, call.Status, call.ClientIP,
+		call.At.UTC().Format(time.DateTime))
+	return err
+}
+
+// logSample records a sample seen in a body, stored or not.
+func (logger *HttpLogger) logSample(s *sample) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	res, err := logger.insertSample.Exec(s.SHA256, s.Size, s.Type, s.Direction, s.RequestID, s.Status,
+		time.Now().UTC().Format(time.DateTime))
+	if err != nil || logger.maxRecords <= 0 {
+		return err
+	}
+	last, err := res.LastInsertId()
+	if err == nil && last > logger.maxRecords {
+		_, err = logger.db.Exec("delete from samples where id <= ?", last-logger.maxRecords)
+	}
+	return err
+}
+
+// logBodyMatches adds the signatures matched in the bodies of a request, once
+// they're read, to its tags and to the tag stats. A request the database
+// doesn't have, logged in another day file, is skipped.
+func (logger *HttpLogger) logBodyMatches(requestID string, matches []tagMatch) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	tx, err := logger.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tags sql.NullString
+	var ip, at string
+	err = tx.QueryRow("select tags, coalesce(from_ip, ''), coalesce(created_at, '') from requests where request_id = ?",
+		requestID).Scan(&tags, &ip, &at)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("select request: %w", err)
+	}
+	var names []string
+	if tags.String != "" {
+		names = strings.Split(tags.String, ",")
+	}
+	for _, m := range matches {
+		if _, err := tx.Stmt(logger.insertTag).Exec(requestID, m.Tag, m.Location, m.Offset, m.Match, nil); err != nil {
+			return fmt.Errorf("insert request tag: %w", err)
+		}
+		if slices.Contains(names, m.Tag) {
+			continue
+		}
+		names = append(names, m.Tag)
+		if _, err := tx.Stmt(logger.upsertTagStat).Exec(ip, m.Tag); err != nil {
+			return fmt.Errorf("upsert client tag stats: %w", err)
+		}
+		if len(at) >= len(dayFormat) {
+			if _, err := tx.Stmt(logger.upsertDayTag).Exec(at[:len(dayFormat)], m.Tag); err != nil {
+				return fmt.Errorf("upsert daily tag stats: %w", err)
+			}
+		}
+	}
+	if _, err := tx.Exec("update requests set tags = ? where request_id = ?", strings.Join(names, ","), requestID); err != nil {
+		return fmt.Errorf("update request tags: %w", err)
+	}
+	return tx.Commit()
+}
+
+// LogTunnel records a relayed or rejected CONNECT tunnel with the rule it
+// matched. The captured bytes are only kept when the rule logs them in full
+// and the tunnel doesn't look like TLS or HTTP, which are handled elsewhere.
+// smtp is the parsed mail conversation for tunnels to mail ports, or nil.
+func (logger *HttpLogger) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	protocol, guessed := tunnelProtocol(tc, pctx)
+
+	tx, ev, err := logger.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer ev.end()
+
+	rule := tunnelRule(pctx)
+	var errResp, dialUs, dialErr, mode, up, down, duration, country, city, asn, ptr interface{}
+	if s, ok := pctx.UserData.(*tunnelState); ok {
+		country, city, asn = s.origin.columns()
+		if s.ptr != "" {
+			ptr = s.ptr
+		}
+		if s.mode != "" {
+			mode = s.mode
+		}
+		if !s.end.IsZero() {
+			up, down, duration = s.up, s.down, s.end.Sub(s.start).Microseconds()
+		}
+		if s.errorResponse != "" {
+			errResp = s.errorResponse
+		}
+		if s.dialTime > 0 {
+			dialUs = s.dialTime.Microseconds()
+		}
+		if s.dialError != "" {
+			dialErr = s.dialError
+		}
+		if n := tc.relayedBytes(); n > 0 && !s.start.IsZero() {
+			if err := addTargetBytes(tx, req.URL.Host, s.start, n); err != nil {
+				return err
+			}
+		}
+	}
+	var tags interface{}
+	if guessed {
+		tags = protocolTag(protocol)
+	}
+	id, ip := requestID(pctx), clientIP(req.RemoteAddr)
+	res, err := tx.Stmt(logger.insertConnect).Exec(id, ip, req.URL.Host, protocol, tc.truncated, rule.Name, errResp,
+		dialUs, dialErr, mode, up, down, duration, country, city, asn, ptr, tags)
+
+	if err != nil {
+		return fmt.Errorf("insert tunnel: %w", err)
+	}
+
+	// The guess is tagged like the detections of requests, with the
+	// tunnel's id as the request's.
+	if guessed {
+		tag, at := protocolTag(protocol), time.Now().UTC().Format(time.DateTime)
+		if _, err := tx.Stmt(logger.insertTag).Exec(id, tag, "tunnel", 0, protocol, "protocol-guess"); err != nil {
+			return fmt.Errorf("insert tunnel tag: %w", err)
+		}
+		if _, err := tx.Stmt(logger.upsertTagStat).Exec(ip, tag); err != nil {
+			return fmt.Errorf("upsert client tag stats: %w", err)
+		}
+		if _, err := tx.Stmt(logger.upsertDayTag).Exec(at[:len(dayFormat)], tag); err != nil {
+			return fmt.Errorf("upsert daily tag stats: %w", err)
+		}
+	}
+
+	last, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	err = logger.evict(tx, last, "delete from smtp_attempts where connect_id <= ?",
+		"delete from tunnel_capture where connect_id <= ?",
+		"delete from request_tags where request_id in (select tunnel_id from connects where id <= ?)",
+		"delete from connects where id <= ?")
+	if err != nil {
+		return err
+	}
+
+	if smtp != nil && smtp.seen {
+		_, err = tx.Stmt(logger.insertSmtp).Exec(last, ip, req.URL.Host, smtp.Helo,
+			smtp.AuthMechanism, smtp.AuthUser, smtp.AuthPass, smtp.MailFrom, strings.Join(smtp.RcptTo, "\n"),
+			smtp.MessageSize, smtp.Messages, smtp.StartTLS, smtp.blocked)
+
+		if err != nil {
+			return fmt.Errorf("insert smtp attempt: %w", err)
+		}
+	}
+
+	if protocol != "tls" && protocol != "http" && rule.Log == "full" && shedLevel(ctx) < shedBodies {
+		stmt := tx.Stmt(logger.insertCapture)
+		for _, c := range tc.chunks {
+			if _, err = stmt.Exec(last, directionNames[c.direction], c.offset, c.data); err != nil {
+				return fmt.Errorf("insert tunnel capture: %w", err)
+			}
+		}
+	}
+
+	return ev.commit()
+}
+
+// Check probes that the database is writable with an insert that's rolled back.
+func (logger *HttpLogger) Check(ctx context.Context) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	tx, err := logger.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "insert into requests (method) values ('HEALTHCHECK')")
+	return err
+}
+
+func (logger *HttpLogger) Close() error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var errs []error
+	for _, stmt := range logger.stmts {
+		errs = append(errs, stmt.Close())
+	}
+	return errors.Join(append(errs, logger.db.Close())...)
+}
@@ -0,0 +1,207 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger opens a database in a temporary directory, closed at the end of
+// the test.
+func testLogger(t *testing.T) *HttpLogger {
+	t.Helper()
+	logger, err := NewLogger(filepath.Join(t.TempDir(), "log.db"))
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	t.Cleanup(func() { logger.Close() })
+	return logger
+}
+
+func TestLogTunnelTagsTheGuessedProtocol(t *testing.T) {
+	logger := testLogger(t)
+	req := &http.Request{Method: "CONNECT", URL: &url.URL{Host: "192.0.2.10:22"}, RemoteAddr: "198.51.100.7:40000"}
+	tc := newTunnelCapture(1024, 1<<20)
+	tc.record(dirDown, 0, []byte("SSH-2.0-OpenSSH_9.6\r\n"))
+	pctx := &goproxy.ProxyCtx{UserData: &tunnelState{id: "tunnel-1", mode: "tunnel"}}
+	if err := logger.LogTunnel(context.Background(), req, tc, nil, pctx); err != nil {
+		t.Fatalf("LogTunnel: %v", err)
+	}
+
+	var protocol, tags string
+	if err := logger.db.QueryRow("select protocol, tags from connects where tunnel_id = 'tunnel-1'").Scan(&protocol,
+		&tags); err != nil {
+		t.Fatal(err)
+	}
+	if protocol != "ssh" || tags != "protocol-ssh" {
+		t.Errorf("got protocol %q, tags %q, want ssh tagged protocol-ssh", protocol, tags)
+	}
+	var location, match string
+	err := logger.db.QueryRow("select location, match from request_tags where request_id = 'tunnel-1' and tag = 'protocol-ssh'").
+		Scan(&location, &match)
+	if err != nil {
+		t.Fatalf("request_tags row: %v", err)
+	}
+	if location != "tunnel" || match != "ssh" {
+		t.Errorf("got the tag at %q matching %q, want tunnel, ssh", location, match)
+	}
+	var n int
+	err = logger.db.QueryRow("select requests from client_tag_stats where ip = '198.51.100.7' and tag = 'protocol-ssh'").Scan(&n)
+	if err != nil || n != 1 {
+		t.Errorf("client tag stats: %v, %v", n, err)
+	}
+
+	// A MITM'd tunnel's protocol is known, not guessed.
+	pctx = &goproxy.ProxyCtx{UserData: &tunnelState{id: "tunnel-2", mode: "mitm", protocol: "tls"}}
+	if err := logger.LogTunnel(context.Background(), req, newTunnelCapture(1024, 1<<20), nil, pctx); err != nil {
+		t.Fatalf("LogTunnel: %v", err)
+	}
+	var untagged int
+	if err := logger.db.QueryRow("select count(*) from connects where tunnel_id = 'tunnel-2' and tags is null").Scan(&untagged); err != nil {
+		t.Fatal(err)
+	}
+	if untagged != 1 {
+		t.Error("a MITM'd tunnel was tagged with its protocol")
+	}
+
+	if err := logger.reindexStats(); err != nil {
+		t.Fatalf("reindexStats: %v", err)
+	}
+	err = logger.db.QueryRow("select requests from daily_tag_stats where tag = 'protocol-ssh'").Scan(&n)
+	if err != nil || n != 1 {
+		t.Errorf("daily tag stats after reindexing: %v, %v", n, err)
+	}
+}
+
+func TestNewServerRefusesAnUnwritableDatabaseDirectory(t *testing.T) {
+	dir := t.TempDir()
+	// A file where the directory should be can't be created even by root,
+	// for whom permissions aren't enforced.
+	notDir := filepath.Join(dir, "file")
+	if err := os.WriteFile(notDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{filepath.Join(notDir, "log.db"), filepath.Join(dir, "missing", "log.db")}
+	if os.Geteuid() != 0 {
+		readOnly := filepath.Join(dir, "read-only")
+		if err := os.Mkdir(readOnly, 0o500); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.Join(readOnly, "log.db"))
+	}
+	for _, path := range paths {
+		config, err := NewConfigStore("stuffpot", []string{"-db", path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewServer(config, nil)
+		if err == nil {
+			s.Shutdown(context.Background())
+			t.Errorf("%v: the server started", path)
+			continue
+		}
+		if msg := err.Error(); !strings.HasPrefix(msg, "cannot open database: "+path+": ") {
+			t.Errorf("%v: got %q, want an error naming the database", path, msg)
+		}
+	}
+}
+
+func TestNewServerRefusesAnIncompatibleSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("create table requests (id TEXT, from_ip INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	config, err := NewConfigStore("stuffpot", []string{"-db", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(config, nil)
+	if err == nil {
+		s.Shutdown(context.Background())
+		t.Fatal("the server started on a database with another schema")
+	}
+	for _, want := range []string{path, "unexpected schema", "table requests: column id has type TEXT, want INTEGER",
+		"table requests: column from_ip has type INTEGER, want TEXT", "missing column method TEXT"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %q, want it to mention %q", err, want)
+		}
+	}
+
+	// The database is left as it was.
+	db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tables, err := tableNames(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 {
+		t.Errorf("the database was changed, it has tables %v", tables)
+	}
+}
+
+// finishedExchange returns the exchange of req, answered with resp of size
+// bytes a millisecond after it started.
+func finishedExchange(req *http.Request, id string, resp *http.Response, size int64) *Exchange {
+	state := &requestState{id: id, start: time.Now()}
+	state.exchange = newExchange(req, state)
+	ex := state.finish(resp, size, nil)
+	ex.Responded = ex.Start.Add(time.Millisecond)
+	return ex
+}
+
+func TestResponsesAreRecordedWithTheirRequests(t *testing.T) {
+	logger := testLogger(t)
+	logger.maxRecords = 2
+	for i, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+		req := httptest.NewRequest("GET", "http://a.example/", nil)
+		req.RemoteAddr = ip + ":40000"
+		resp := &http.Response{StatusCode: 201 + i, Proto: "HTTP/1.1", Header: http.Header{"Server": {"up"}}}
+		ex := finishedExchange(req, fmt.Sprintf("r%d", i), resp, 10)
+		if err := logger.LogExchange(context.Background(), ex); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The response of the request evicted goes along.
+	want := [][]string{
+		{"r1", "202", "HTTP/1.1", "server: up", "1000", "10"},
+		{"r2", "203", "HTTP/1.1", "server: up", "1000", "10"},
+	}
+	got := queryRows(t, logger.db, "select request_id, status, proto, headers, latency_us, size from responses order by 1")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got responses %v, want %v", got, want)
+	}
+
+	tx, err := logger.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := purge(tx, purgeFilter{IP: "192.0.2.1"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryRows(t, logger.db, "select request_id from responses"); !reflect.DeepEqual(got, [][]string{{"r2"}}) {
+		t.Errorf("after purging a client: got responses %v, want those of the others", got)
+	}
+}
@@ -0,0 +1,48 @@
+package stuffpot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// logLevel is shared by every handler so that a reload can change it.
+var logLevel slog.LevelVar
+
+// newLogHandler returns the handler for operational logs in the given format.
+func newLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// goproxyLogger sends goproxy's own log output through slog. goproxy only
+// prints its informational messages when Verbose is set, and marks the ones
+// it always prints with WARN.
+type goproxyLogger struct {
+	log *slog.Logger
+}
+
+func (l goproxyLogger) Printf(format string, v ...interface{}) {
+	level := slog.LevelDebug
+	if strings.Contains(format, "WARN: ") {
+		level = slog.LevelWarn
+	}
+	if !l.log.Enabled(context.Background(), level) {
+		return
+	}
+	l.log.Log(context.Background(), level, strings.TrimSpace(fmt.Sprintf(format, v...)))
+}
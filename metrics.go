@@ -0,0 +1,203 @@
+package stuffpot
+
+import (
+	"context"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metricsMaxHosts bounds the hosts counted on their own by /metrics, those
+// seen once it's reached being counted as other, as any client can make up
+// hosts.
+const metricsMaxHosts = 100
+
+// upstreamBuckets are the upper bounds, in seconds, of the buckets of the
+// upstream latency histogram.
+var upstreamBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	// mitmTunnels counts the CONNECTs MITM'd.
+	mitmTunnels atomic.Int64
+	// websocketMessages counts the messages of the WebSockets relayed.
+	websocketMessages atomic.Int64
+	// credentialsTotal counts the credentials stored.
+	credentialsTotal atomic.Int64
+	// alertsTotal counts the alerts queued, alertsDropped those dropped as
+	// the queue was full, and alertsFailed their sends to a channel failing.
+	alertsTotal   atomic.Int64
+	alertsDropped atomic.Int64
+	alertsFailed  atomic.Int64
+	// egressRefused counts the requests, tunnels and dials the egress policy
+	// refused.
+	egressRefused atomic.Int64
+	// rateLimited counts the requests and tunnels over the rate limits of
+	// their client, connectionsRefused the connections over the caps.
+	rateLimited        atomic.Int64
+	connectionsRefused atomic.Int64
+	// tarpitted counts the responses tarpitted.
+	tarpitted atomic.Int64
+	// activeConns counts the client connections to the proxy currently open.
+	activeConns atomic.Int64
+)
+
+// proxyMetrics is the sink counting the logged requests and tunnels for
+// /metrics.
+type proxyMetrics struct {
+	mu sync.Mutex
+	// requests are by status class, 0xx for those without a response.
+	requests map[string]int64
+	hosts    map[string]int64
+	// bytesIn and bytesOut are the body bytes of the requests and of the
+	// responses, and the bytes relayed by tunnels each way.
+	bytesIn  int64
+	bytesOut int64
+	tunnels  int64
+	// upstream counts the upstream latencies in upstreamBuckets, with the
+	// others above them last.
+	upstream      []int64
+	upstreamSum   float64
+	upstreamCount int64
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{requests: make(map[string]int64), hosts: make(map[string]int64),
+		upstream: make([]int64, len(upstreamBuckets)+1)}
+}
+
+func (m *proxyMetrics) LogExchange(ctx context.Context, ex *Exchange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[fmt.Sprintf("%dxx", ex.Status()/100)]++
+	host := ex.Request.URL.Hostname()
+	if _, ok := m.hosts[host]; !ok && len(m.hosts) >= metricsMaxHosts {
+		host = "other"
+	}
+	m.hosts[host]++
+	m.bytesIn += ex.Received
+	m.bytesOut += ex.Size
+	if ex.Upstream > 0 {
+		s := ex.Upstream.Seconds()
+		i := sort.SearchFloat64s(upstreamBuckets, s)
+		m.upstream[i]++
+		m.upstreamSum += s
+		m.upstreamCount++
+	}
+	return nil
+}
+
+func (m *proxyMetrics) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	// The MITM'd tunnels are counted apart, their requests with the others.
+	if tunnelMode(pctx) == "mitm" {
+		return nil
+	}
+	tc.mu.Lock()
+	up, down := tc.relayed[dirUp], tc.relayed[dirDown]
+	tc.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tunnels++
+	m.bytesIn += up
+	m.bytesOut += down
+	return nil
+}
+
+func (m *proxyMetrics) Close() error {
+	return nil
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *proxyMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP stuffpot_requests_seen_total Requests received by the proxy, including those read from tunnels.")
+	fmt.Fprintln(w, "# TYPE stuffpot_requests_seen_total counter")
+	fmt.Fprintf(w, "stuffpot_requests_seen_total %d\n", requestsTotal.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_requests_total Requests logged by the class of their status, 0xx without a response.")
+	fmt.Fprintln(w, "# TYPE stuffpot_requests_total counter")
+	classes := make([]string, 0, len(m.requests))
+	for c := range m.requests {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+	for _, c := range classes {
+		fmt.Fprintf(w, "stuffpot_requests_total{status=%q} %d\n", c, m.requests[c])
+	}
+	fmt.Fprintf(w, "# HELP stuffpot_host_requests_total Requests logged by host, the hosts past the first %d counted as other.\n",
+		metricsMaxHosts)
+	fmt.Fprintln(w, "# TYPE stuffpot_host_requests_total counter")
+	hosts := make([]string, 0, len(m.hosts))
+	for h := range m.hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		fmt.Fprintf(w, "stuffpot_host_requests_total{host=%q} %d\n", h, m.hosts[h])
+	}
+	fmt.Fprintln(w, "# HELP stuffpot_upstream_latency_seconds Time until the response headers of the remote.")
+	fmt.Fprintln(w, "# TYPE stuffpot_upstream_latency_seconds histogram")
+	var n int64
+	for i, le := range upstreamBuckets {
+		n += m.upstream[i]
+		fmt.Fprintf(w, "stuffpot_upstream_latency_seconds_bucket{le=\"%g\"} %d\n", le, n)
+	}
+	fmt.Fprintf(w, "stuffpot_upstream_latency_seconds_bucket{le=\"+Inf\"} %d\n", m.upstreamCount)
+	fmt.Fprintf(w, "stuffpot_upstream_latency_seconds_sum %g\n", m.upstreamSum)
+	fmt.Fprintf(w, "stuffpot_upstream_latency_seconds_count %d\n", m.upstreamCount)
+	fmt.Fprintln(w, "# HELP stuffpot_bytes_total Bytes of the bodies of logged requests and of relayed tunnels, by direction.")
+	fmt.Fprintln(w, "# TYPE stuffpot_bytes_total counter")
+	fmt.Fprintf(w, "stuffpot_bytes_total{direction=\"in\"} %d\n", m.bytesIn)
+	fmt.Fprintf(w, "stuffpot_bytes_total{direction=\"out\"} %d\n", m.bytesOut)
+	fmt.Fprintln(w, "# HELP stuffpot_tunnels_total Relayed tunnels logged.")
+	fmt.Fprintln(w, "# TYPE stuffpot_tunnels_total counter")
+	fmt.Fprintf(w, "stuffpot_tunnels_total %d\n", m.tunnels)
+	fmt.Fprintln(w, "# HELP stuffpot_mitm_tunnels_total CONNECTs MITM'd.")
+	fmt.Fprintln(w, "# TYPE stuffpot_mitm_tunnels_total counter")
+	fmt.Fprintf(w, "stuffpot_mitm_tunnels_total %d\n", mitmTunnels.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_websocket_messages_total Messages of the WebSockets relayed.")
+	fmt.Fprintln(w, "# TYPE stuffpot_websocket_messages_total counter")
+	fmt.Fprintf(w, "stuffpot_websocket_messages_total %d\n", websocketMessages.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_credentials_total Credentials sent by the clients stored.")
+	fmt.Fprintln(w, "# TYPE stuffpot_credentials_total counter")
+	fmt.Fprintf(w, "stuffpot_credentials_total %d\n", credentialsTotal.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_alerts_total Alerts fired by the alert rules.")
+	fmt.Fprintln(w, "# TYPE stuffpot_alerts_total counter")
+	fmt.Fprintf(w, "stuffpot_alerts_total %d\n", alertsTotal.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_alerts_dropped_total Alerts dropped as too many were waiting to be sent.")
+	fmt.Fprintln(w, "# TYPE stuffpot_alerts_dropped_total counter")
+	fmt.Fprintf(w, "stuffpot_alerts_dropped_total %d\n", alertsDropped.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_alert_failures_total Alerts which could not be sent to a channel.")
+	fmt.Fprintln(w, "# TYPE stuffpot_alert_failures_total counter")
+	fmt.Fprintf(w, "stuffpot_alert_failures_total %d\n", alertsFailed.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_egress_refused_total Requests and tunnels refused by the egress policy.")
+	fmt.Fprintln(w, "# TYPE stuffpot_egress_refused_total counter")
+	fmt.Fprintf(w, "stuffpot_egress_refused_total %d\n", egressRefused.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_rate_limited_total Requests and tunnels over the rate limits of their client.")
+	fmt.Fprintln(w, "# TYPE stuffpot_rate_limited_total counter")
+	fmt.Fprintf(w, "stuffpot_rate_limited_total %d\n", rateLimited.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_connections_refused_total Connections closed as they were over the connection caps.")
+	fmt.Fprintln(w, "# TYPE stuffpot_connections_refused_total counter")
+	fmt.Fprintf(w, "stuffpot_connections_refused_total %d\n", connectionsRefused.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_tarpitted_total Responses slowed down by the tarpit.")
+	fmt.Fprintln(w, "# TYPE stuffpot_tarpitted_total counter")
+	fmt.Fprintf(w, "stuffpot_tarpitted_total %d\n", tarpitted.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_active_connections Client connections to the proxy open.")
+	fmt.Fprintln(w, "# TYPE stuffpot_active_connections gauge")
+	fmt.Fprintf(w, "stuffpot_active_connections %d\n", activeConns.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_active_tunnels Relayed tunnels open.")
+	fmt.Fprintln(w, "# TYPE stuffpot_active_tunnels gauge")
+	fmt.Fprintf(w, "stuffpot_active_tunnels %d\n", activeTunnels.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_log_failures_total Events a sink, such as the database, failed to record.")
+	fmt.Fprintln(w, "# TYPE stuffpot_log_failures_total counter")
+	fmt.Fprintf(w, "stuffpot_log_failures_total %d\n", logFailures.Load())
+	fmt.Fprintln(w, "# HELP stuffpot_panics_total Panics recovered.")
+	fmt.Fprintln(w, "# TYPE stuffpot_panics_total counter")
+	fmt.Fprintf(w, "stuffpot_panics_total %d\n", panics.Load())
+}
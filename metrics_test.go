@@ -0,0 +1,129 @@
+package stuffpot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricLines returns the lines of the metrics of m, without the comments.
+func metricLines(m *proxyMetrics) map[string]bool {
+	var buf bytes.Buffer
+	m.write(&buf)
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines[line] = true
+		}
+	}
+	return lines
+}
+
+func TestProxyMetrics(t *testing.T) {
+	m := newProxyMetrics()
+	log := func(host string, status int, upstream time.Duration) {
+		req := httptest.NewRequest("GET", "http://"+host+":8080/", nil)
+		ex := finishedExchange(req, "r", &http.Response{StatusCode: status, Proto: "HTTP/1.1", Header: http.Header{}}, 100)
+		if status == 0 {
+			ex.Response = nil
+		}
+		ex.Received, ex.Upstream = 10, upstream
+		if err := m.LogExchange(context.Background(), ex); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log("a.example", 200, 3*time.Millisecond)
+	log("a.example", 204, 40*time.Millisecond)
+	log("b.example", 404, 20*time.Second)
+	log("b.example", 0, 0)
+	// The hosts past the first metricsMaxHosts are counted as other, those
+	// already seen still on their own.
+	for i := 0; i < metricsMaxHosts; i++ {
+		log(fmt.Sprintf("h%d.example", i), 502, 0)
+	}
+	log("a.example", 200, 0)
+
+	tc := &TunnelCapture{}
+	tc.relayed[dirUp], tc.relayed[dirDown] = 1000, 2000
+	connect := httptest.NewRequest("CONNECT", "http://c.example:443", nil)
+	m.LogTunnel(context.Background(), connect, tc, nil, &goproxy.ProxyCtx{UserData: &tunnelState{mode: "relay"}})
+	// The MITM'd tunnels are left to their requests.
+	m.LogTunnel(context.Background(), connect, tc, nil, &goproxy.ProxyCtx{UserData: &tunnelState{mode: "mitm"}})
+
+	lines := metricLines(m)
+	n := metricsMaxHosts + 5
+	for _, want := range []string{
+		`stuffpot_requests_total{status="0xx"} 1`,
+		`stuffpot_requests_total{status="2xx"} 3`,
+		`stuffpot_requests_total{status="4xx"} 1`,
+		`stuffpot_requests_total{status="5xx"} 100`,
+		`stuffpot_host_requests_total{host="a.example"} 3`,
+		`stuffpot_host_requests_total{host="b.example"} 2`,
+		`stuffpot_host_requests_total{host="h97.example"} 1`,
+		`stuffpot_host_requests_total{host="other"} 2`,
+		`stuffpot_upstream_latency_seconds_bucket{le="0.005"} 1`,
+		`stuffpot_upstream_latency_seconds_bucket{le="0.025"} 1`,
+		`stuffpot_upstream_latency_seconds_bucket{le="0.05"} 2`,
+		`stuffpot_upstream_latency_seconds_bucket{le="10"} 2`,
+		`stuffpot_upstream_latency_seconds_bucket{le="+Inf"} 3`,
+		`stuffpot_upstream_latency_seconds_sum 20.043`,
+		`stuffpot_upstream_latency_seconds_count 3`,
+		fmt.Sprintf(`stuffpot_bytes_total{direction="in"} %d`, 10*n+1000),
+		fmt.Sprintf(`stuffpot_bytes_total{direction="out"} %d`, 100*n+2000),
+		`stuffpot_tunnels_total 1`,
+	} {
+		if !lines[want] {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if lines[`stuffpot_host_requests_total{host="h98.example"} 1`] {
+		t.Errorf("h98.example was counted on its own past %d hosts", metricsMaxHosts)
+	}
+}
+
+func TestMetricsOnTheAdminListener(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	s, client := startServer(t, testConfig(t), &recordingLogger{})
+	adminURL := serveAdmin(t, s)
+	proxied, err := client.Post(upstream.URL+"/", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, proxied.Body)
+	proxied.Body.Close()
+
+	// The request reaches the sinks once its response is done.
+	var body string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(adminURL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if body = string(b); strings.Contains(body, `stuffpot_requests_total{status="2xx"} 1`) {
+			break
+		}
+	}
+	for _, want := range []string{
+		"\n" + `stuffpot_requests_total{status="2xx"} 1` + "\n",
+		"\n" + `stuffpot_host_requests_total{host="127.0.0.1"} 1` + "\n",
+		"\n" + `stuffpot_upstream_latency_seconds_count 1` + "\n",
+		"\n" + `stuffpot_bytes_total{direction="in"} 4` + "\n",
+		"\n" + `stuffpot_bytes_total{direction="out"} 5` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s in:\n%s", strings.TrimSpace(want), body)
+		}
+	}
+}
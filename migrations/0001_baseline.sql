@@ -0,0 +1,399 @@
+-- The schema as of the first release with migrations. Databases created before,
+-- which have no schema_version table, are given the columns they lack before
+-- this is applied, its tables and indexes being created unless they exist.
+
+create table if not exists metadata (
+  key TEXT PRIMARY KEY,
+  value TEXT
+);
+
+create table if not exists requests (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  request_id TEXT,
+  parent_id TEXT,
+  from_ip TEXT,
+  method TEXT,
+  host TEXT,
+  url TEXT,
+  headers TEXT,
+  tags TEXT,
+  status INTEGER,
+  size INTEGER,
+  header_order TEXT,
+  fingerprint TEXT,
+  source TEXT,
+  import_hash TEXT,
+  dedupe_key TEXT,
+  occurrences INTEGER,
+  last_seen TEXT,
+  upstream_us INTEGER,
+  overhead_us INTEGER,
+  error_type TEXT,
+  request_size INTEGER,
+  error_response TEXT,
+  parse_anomalies TEXT,
+  ja3 TEXT,
+  country TEXT,
+  city TEXT,
+  asn INTEGER,
+  ptr TEXT,
+  session_id TEXT,
+  raw_request TEXT,
+  raw_response TEXT,
+  created_at INTEGER DEFAULT CURRENT_TIMESTAMP
+);
+
+create table if not exists request_tags (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  request_id TEXT,
+  tag TEXT,
+  location TEXT,
+  offset INTEGER,
+  match TEXT,
+  source TEXT
+);
+
+create table if not exists responses (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  request_id TEXT,
+  status INTEGER,
+  proto TEXT,
+  headers TEXT,
+  latency_us INTEGER,
+  size INTEGER,
+  created_at TEXT
+);
+
+create table if not exists bodies (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  request_id TEXT,
+  location TEXT,
+  content_type TEXT,
+  content_encoding TEXT,
+  size INTEGER,
+  truncated INTEGER,
+  data BLOB,
+  created_at TEXT
+);
+
+create table if not exists sessions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  session_id TEXT UNIQUE,
+  tag TEXT,
+  from_ip TEXT,
+  started_at TEXT,
+  updated_at TEXT,
+  attempts INTEGER,
+  usernames INTEGER
+);
+
+create table if not exists client_sessions (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  session_id TEXT UNIQUE,
+  from_ip TEXT,
+  ja3 TEXT,
+  user_agent TEXT,
+  tool TEXT,
+  started_at TEXT,
+  updated_at TEXT,
+  requests INTEGER
+);
+
+create table if not exists client_stats (
+  ip TEXT PRIMARY KEY,
+  first_seen TEXT,
+  last_seen TEXT,
+  requests INTEGER,
+  bytes INTEGER DEFAULT 0,
+  errors INTEGER DEFAULT 0,
+  score REAL
+);
+
+create table if not exists client_tag_stats (
+  ip TEXT,
+  tag TEXT,
+  requests INTEGER,
+  PRIMARY KEY (ip, tag)
+);
+
+create table if not exists host_stats (
+  host TEXT PRIMARY KEY,
+  requests INTEGER,
+  clients INTEGER,
+  first_seen TEXT,
+  last_seen TEXT
+);
+
+create table if not exists host_clients (
+  host TEXT,
+  ip TEXT,
+  PRIMARY KEY (host, ip)
+);
+
+create table if not exists daily_client_stats (
+  day TEXT,
+  ip TEXT,
+  requests INTEGER,
+  bytes INTEGER DEFAULT 0,
+  errors INTEGER DEFAULT 0,
+  PRIMARY KEY (day, ip)
+);
+
+create table if not exists daily_host_stats (
+  day TEXT,
+  host TEXT,
+  requests INTEGER,
+  PRIMARY KEY (day, host)
+);
+
+create table if not exists daily_tag_stats (
+  day TEXT,
+  tag TEXT,
+  requests INTEGER,
+  PRIMARY KEY (day, tag)
+);
+
+-- The scope of the latencies is all, host or client, the key being the
+-- host or the client.
+create table if not exists daily_latency_stats (
+  day TEXT,
+  scope TEXT,
+  key TEXT,
+  requests INTEGER,
+  upstream BLOB,
+  overhead BLOB,
+  PRIMARY KEY (day, scope, key)
+);
+
+create table if not exists daily_error_stats (
+  day TEXT,
+  error TEXT,
+  requests INTEGER,
+  PRIMARY KEY (day, error)
+);
+
+-- host_traffic is rolled up once a day is over, the hosts beyond the top
+-- ones being summed into (other), and the clients of the day dropped.
+create table if not exists host_traffic (
+  day TEXT,
+  host TEXT,
+  request_count INTEGER,
+  bytes_in INTEGER DEFAULT 0,
+  bytes_out INTEGER DEFAULT 0,
+  clients INTEGER DEFAULT 0,
+  PRIMARY KEY (day, host)
+);
+
+create table if not exists host_traffic_clients (
+  day TEXT,
+  host TEXT,
+  ip TEXT,
+  PRIMARY KEY (day, host, ip)
+);
+
+-- connect_targets is rolled up like host_traffic, by port.
+create table if not exists connect_targets (
+  day TEXT,
+  host TEXT,
+  port INTEGER,
+  first_seen TEXT,
+  last_seen TEXT,
+  tunnels INTEGER,
+  bytes INTEGER DEFAULT 0,
+  clients INTEGER DEFAULT 0,
+  PRIMARY KEY (day, host, port)
+);
+
+create table if not exists connect_target_clients (
+  day TEXT,
+  host TEXT,
+  port INTEGER,
+  ip TEXT,
+  PRIMARY KEY (day, host, port, ip)
+);
+
+create table if not exists proxy_checks (
+  service TEXT PRIMARY KEY,
+  first_seen TEXT,
+  last_seen TEXT,
+  checks INTEGER,
+  last_client TEXT
+);
+
+create table if not exists honeytokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  token TEXT UNIQUE,
+  rule TEXT,
+  client_ip TEXT,
+  request_id TEXT,
+  issued_at TEXT
+);
+
+create table if not exists fingerprints (
+  hash TEXT PRIMARY KEY,
+  headers TEXT,
+  label TEXT,
+  first_seen TEXT,
+  last_seen TEXT,
+  requests INTEGER
+);
+
+create table if not exists samples (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  sha256 TEXT,
+  size INTEGER,
+  type TEXT,
+  direction TEXT,
+  request_id TEXT,
+  status TEXT,
+  created_at TEXT
+);
+
+create table if not exists tls_failures (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tunnel_id TEXT,
+  from_ip TEXT,
+  host TEXT,
+  sni TEXT,
+  versions TEXT,
+  ciphers TEXT,
+  san TEXT,
+  kind TEXT,
+  error TEXT,
+  pin_check INTEGER,
+  ja3 TEXT,
+  created_at TEXT
+);
+
+create table if not exists websocket_messages (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  request_id TEXT,
+  from_ip TEXT,
+  direction TEXT,
+  opcode INTEGER,
+  compressed INTEGER,
+  size INTEGER,
+  payload BLOB,
+  truncated INTEGER,
+  created_at TEXT
+);
+
+create table if not exists credentials (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  request_id TEXT,
+  from_ip TEXT,
+  source TEXT,
+  scheme TEXT,
+  username TEXT,
+  password TEXT,
+  hash TEXT,
+  realm TEXT,
+  created_at TEXT
+);
+
+create table if not exists cookies (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  request_id TEXT,
+  from_ip TEXT,
+  host TEXT,
+  direction TEXT,
+  name TEXT,
+  value TEXT,
+  domain TEXT,
+  path TEXT,
+  expires TEXT,
+  secure INTEGER,
+  http_only INTEGER,
+  created_at TEXT
+);
+
+create table if not exists admin_audit (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  token_id TEXT,
+  method TEXT,
+  endpoint TEXT,
+  params TEXT,
+  status INTEGER,
+  client_ip TEXT,
+  created_at TEXT
+);
+
+create table if not exists connects (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tunnel_id TEXT,
+  from_ip TEXT,
+  host TEXT,
+  protocol TEXT,
+  capture_truncated INTEGER,
+  rule TEXT,
+  error_response TEXT,
+  dial_us INTEGER,
+  dial_error TEXT,
+  mode TEXT,
+  bytes_up INTEGER,
+  bytes_down INTEGER,
+  duration_us INTEGER,
+  country TEXT,
+  city TEXT,
+  asn INTEGER,
+  ptr TEXT,
+  created_at INTEGER DEFAULT CURRENT_TIMESTAMP
+);
+
+create table if not exists tunnel_capture (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  connect_id INTEGER,
+  direction TEXT,
+  offset INTEGER,
+  bytes BLOB
+);
+
+create table if not exists smtp_attempts (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  connect_id INTEGER,
+  from_ip TEXT,
+  host TEXT,
+  helo TEXT,
+  auth_mechanism TEXT,
+  auth_user TEXT,
+  auth_pass TEXT,
+  mail_from TEXT,
+  rcpt_to TEXT,
+  message_size INTEGER,
+  messages INTEGER,
+  starttls INTEGER,
+  blocked INTEGER,
+  created_at INTEGER DEFAULT CURRENT_TIMESTAMP
+);
+
+create table if not exists schema_version (
+  version INTEGER PRIMARY KEY,
+  name TEXT,
+  applied_by TEXT,
+  applied_at TEXT DEFAULT CURRENT_TIMESTAMP
+);
+-- The version was the schema_version of the metadata before the table.
+delete from metadata where key = 'schema_version';
+
+create index if not exists requests_request_id on requests (request_id);
+create index if not exists requests_fingerprint on requests (fingerprint);
+create index if not exists requests_ja3 on requests (ja3);
+create index if not exists requests_import_hash on requests (import_hash);
+create index if not exists requests_dedupe_key on requests (dedupe_key);
+create index if not exists responses_request_id on responses (request_id);
+create index if not exists bodies_request_id on bodies (request_id);
+create index if not exists request_tags_request_id on request_tags (request_id);
+create index if not exists samples_sha256 on samples (sha256);
+create index if not exists tls_failures_from_ip on tls_failures (from_ip);
+create index if not exists websocket_messages_request_id on websocket_messages (request_id);
+create index if not exists credentials_request_id on credentials (request_id);
+create index if not exists credentials_username on credentials (username);
+create index if not exists cookies_request_id on cookies (request_id);
+create index if not exists cookies_value on cookies (value);
+create index if not exists requests_session_id on requests (session_id);
+create index if not exists client_sessions_from_ip on client_sessions (from_ip);
+-- The admin API lists the requests by these, the id coming along in the
+-- index.
+create index if not exists requests_created_at on requests (created_at);
+create index if not exists requests_from_ip on requests (from_ip);
+create index if not exists requests_host on requests (host);
@@ -0,0 +1,5 @@
+-- The protocol guessed for the relayed tunnels is one of their tags, as
+-- protocol-<name>, so that the tag filters and stats apply to them.
+alter table connects add column tags TEXT;
+update connects set tags = 'protocol-' || protocol
+  where protocol is not null and protocol != '' and coalesce(mode, '') not in ('mitm', 'hijack-parse');
@@ -0,0 +1,3 @@
+-- The JA3S of the remote's ServerHello, next to the JA3 of the client's
+-- ClientHello, for the requests sent over TLS.
+alter table requests add column ja3s TEXT;
@@ -0,0 +1,202 @@
+-- The schema of the sql store on MySQL: the tables of the SQLite schema
+-- holding the requests, tunnels and statistics, with the same columns. The
+-- keys are VARCHARs, which MySQL can index, unlike TEXT. Databases created
+-- before the sql store had migrations have the first four tables, which are
+-- left as they are.
+
+create table if not exists requests (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  request_id VARCHAR(64),
+  parent_id VARCHAR(64),
+  from_ip VARCHAR(64),
+  method TEXT,
+  host TEXT,
+  url TEXT,
+  headers MEDIUMTEXT,
+  tags TEXT,
+  status INTEGER,
+  size BIGINT,
+  header_order TEXT,
+  fingerprint TEXT,
+  upstream_us BIGINT,
+  overhead_us BIGINT,
+  error_type TEXT,
+  request_size BIGINT,
+  error_response TEXT,
+  parse_anomalies TEXT,
+  ja3 TEXT,
+  ja3s TEXT,
+  country TEXT,
+  city TEXT,
+  asn BIGINT,
+  ptr TEXT,
+  session_id TEXT,
+  raw_request TEXT,
+  raw_response TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  INDEX requests_request_id (request_id),
+  INDEX requests_created_at (created_at)
+);
+
+-- offset and match are reserved words.
+create table if not exists request_tags (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  request_id VARCHAR(64),
+  tag TEXT,
+  location TEXT,
+  `offset` BIGINT,
+  `match` TEXT,
+  source TEXT,
+  INDEX request_tags_request_id (request_id)
+);
+
+create table if not exists responses (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  request_id VARCHAR(64),
+  status INTEGER,
+  proto TEXT,
+  headers MEDIUMTEXT,
+  latency_us BIGINT,
+  size BIGINT,
+  created_at DATETIME,
+  INDEX responses_request_id (request_id)
+);
+
+create table if not exists connects (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  tunnel_id VARCHAR(64),
+  from_ip VARCHAR(64),
+  host TEXT,
+  protocol TEXT,
+  capture_truncated BOOLEAN,
+  rule TEXT,
+  error_response TEXT,
+  dial_us BIGINT,
+  dial_error TEXT,
+  mode TEXT,
+  bytes_up BIGINT,
+  bytes_down BIGINT,
+  duration_us BIGINT,
+  country TEXT,
+  city TEXT,
+  asn BIGINT,
+  ptr TEXT,
+  tags TEXT,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  INDEX connects_created_at (created_at)
+);
+
+create table if not exists client_stats (
+  ip VARCHAR(64) PRIMARY KEY,
+  first_seen TEXT,
+  last_seen TEXT,
+  requests BIGINT,
+  bytes BIGINT DEFAULT 0,
+  errors BIGINT DEFAULT 0,
+  score DOUBLE
+);
+
+create table if not exists client_tag_stats (
+  ip VARCHAR(64),
+  tag VARCHAR(255),
+  requests BIGINT,
+  PRIMARY KEY (ip, tag)
+);
+
+create table if not exists host_stats (
+  host VARCHAR(255) PRIMARY KEY,
+  requests BIGINT,
+  clients BIGINT,
+  first_seen TEXT,
+  last_seen TEXT
+);
+
+create table if not exists host_clients (
+  host VARCHAR(255),
+  ip VARCHAR(64),
+  PRIMARY KEY (host, ip)
+);
+
+create table if not exists daily_client_stats (
+  day VARCHAR(10),
+  ip VARCHAR(64),
+  requests BIGINT,
+  bytes BIGINT DEFAULT 0,
+  errors BIGINT DEFAULT 0,
+  PRIMARY KEY (day, ip)
+);
+
+create table if not exists daily_host_stats (
+  day VARCHAR(10),
+  host VARCHAR(255),
+  requests BIGINT,
+  PRIMARY KEY (day, host)
+);
+
+create table if not exists daily_tag_stats (
+  day VARCHAR(10),
+  tag VARCHAR(255),
+  requests BIGINT,
+  PRIMARY KEY (day, tag)
+);
+
+create table if not exists daily_latency_stats (
+  day VARCHAR(10),
+  scope VARCHAR(16),
+  `key` VARCHAR(255),
+  requests BIGINT,
+  upstream LONGBLOB,
+  overhead LONGBLOB,
+  PRIMARY KEY (day, scope, `key`)
+);
+
+create table if not exists daily_error_stats (
+  day VARCHAR(10),
+  error VARCHAR(255),
+  requests BIGINT,
+  PRIMARY KEY (day, error)
+);
+
+create table if not exists host_traffic (
+  day VARCHAR(10),
+  host VARCHAR(255),
+  request_count BIGINT,
+  bytes_in BIGINT DEFAULT 0,
+  bytes_out BIGINT DEFAULT 0,
+  clients BIGINT DEFAULT 0,
+  PRIMARY KEY (day, host)
+);
+
+create table if not exists host_traffic_clients (
+  day VARCHAR(10),
+  host VARCHAR(255),
+  ip VARCHAR(64),
+  PRIMARY KEY (day, host, ip)
+);
+
+create table if not exists connect_targets (
+  day VARCHAR(10),
+  host VARCHAR(255),
+  port INTEGER,
+  first_seen TEXT,
+  last_seen TEXT,
+  tunnels BIGINT,
+  bytes BIGINT DEFAULT 0,
+  clients BIGINT DEFAULT 0,
+  PRIMARY KEY (day, host, port)
+);
+
+create table if not exists connect_target_clients (
+  day VARCHAR(10),
+  host VARCHAR(255),
+  port INTEGER,
+  ip VARCHAR(64),
+  PRIMARY KEY (day, host, port, ip)
+);
+
+create table if not exists schema_version (
+  version INTEGER PRIMARY KEY,
+  name TEXT,
+  applied_by TEXT,
+  applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,202 @@
+-- The schema of the sql store on PostgreSQL: the tables of the SQLite schema
+-- holding the requests, tunnels and statistics, with the same columns.
+-- Databases created before the sql store had migrations have the first four
+-- tables and their indexes, which are left as they are.
+
+create table if not exists requests (
+  id BIGSERIAL PRIMARY KEY,
+  request_id TEXT,
+  parent_id TEXT,
+  from_ip TEXT,
+  method TEXT,
+  host TEXT,
+  url TEXT,
+  headers TEXT,
+  tags TEXT,
+  status INTEGER,
+  size BIGINT,
+  header_order TEXT,
+  fingerprint TEXT,
+  upstream_us BIGINT,
+  overhead_us BIGINT,
+  error_type TEXT,
+  request_size BIGINT,
+  error_response TEXT,
+  parse_anomalies TEXT,
+  ja3 TEXT,
+  ja3s TEXT,
+  country TEXT,
+  city TEXT,
+  asn BIGINT,
+  ptr TEXT,
+  session_id TEXT,
+  raw_request TEXT,
+  raw_response TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- offset and match are reserved words.
+create table if not exists request_tags (
+  id BIGSERIAL PRIMARY KEY,
+  request_id TEXT,
+  tag TEXT,
+  location TEXT,
+  "offset" BIGINT,
+  "match" TEXT,
+  source TEXT
+);
+
+create table if not exists responses (
+  id BIGSERIAL PRIMARY KEY,
+  request_id TEXT,
+  status INTEGER,
+  proto TEXT,
+  headers TEXT,
+  latency_us BIGINT,
+  size BIGINT,
+  created_at TIMESTAMP
+);
+
+create table if not exists connects (
+  id BIGSERIAL PRIMARY KEY,
+  tunnel_id TEXT,
+  from_ip TEXT,
+  host TEXT,
+  protocol TEXT,
+  capture_truncated BOOLEAN,
+  rule TEXT,
+  error_response TEXT,
+  dial_us BIGINT,
+  dial_error TEXT,
+  mode TEXT,
+  bytes_up BIGINT,
+  bytes_down BIGINT,
+  duration_us BIGINT,
+  country TEXT,
+  city TEXT,
+  asn BIGINT,
+  ptr TEXT,
+  tags TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+create table if not exists client_stats (
+  ip TEXT PRIMARY KEY,
+  first_seen TEXT,
+  last_seen TEXT,
+  requests BIGINT,
+  bytes BIGINT DEFAULT 0,
+  errors BIGINT DEFAULT 0,
+  score DOUBLE PRECISION
+);
+
+create table if not exists client_tag_stats (
+  ip TEXT,
+  tag TEXT,
+  requests BIGINT,
+  PRIMARY KEY (ip, tag)
+);
+
+create table if not exists host_stats (
+  host TEXT PRIMARY KEY,
+  requests BIGINT,
+  clients BIGINT,
+  first_seen TEXT,
+  last_seen TEXT
+);
+
+create table if not exists host_clients (
+  host TEXT,
+  ip TEXT,
+  PRIMARY KEY (host, ip)
+);
+
+create table if not exists daily_client_stats (
+  day TEXT,
+  ip TEXT,
+  requests BIGINT,
+  bytes BIGINT DEFAULT 0,
+  errors BIGINT DEFAULT 0,
+  PRIMARY KEY (day, ip)
+);
+
+create table if not exists daily_host_stats (
+  day TEXT,
+  host TEXT,
+  requests BIGINT,
+  PRIMARY KEY (day, host)
+);
+
+create table if not exists daily_tag_stats (
+  day TEXT,
+  tag TEXT,
+  requests BIGINT,
+  PRIMARY KEY (day, tag)
+);
+
+create table if not exists daily_latency_stats (
+  day TEXT,
+  scope TEXT,
+  key TEXT,
+  requests BIGINT,
+  upstream BYTEA,
+  overhead BYTEA,
+  PRIMARY KEY (day, scope, key)
+);
+
+create table if not exists daily_error_stats (
+  day TEXT,
+  error TEXT,
+  requests BIGINT,
+  PRIMARY KEY (day, error)
+);
+
+create table if not exists host_traffic (
+  day TEXT,
+  host TEXT,
+  request_count BIGINT,
+  bytes_in BIGINT DEFAULT 0,
+  bytes_out BIGINT DEFAULT 0,
+  clients BIGINT DEFAULT 0,
+  PRIMARY KEY (day, host)
+);
+
+create table if not exists host_traffic_clients (
+  day TEXT,
+  host TEXT,
+  ip TEXT,
+  PRIMARY KEY (day, host, ip)
+);
+
+create table if not exists connect_targets (
+  day TEXT,
+  host TEXT,
+  port INTEGER,
+  first_seen TEXT,
+  last_seen TEXT,
+  tunnels BIGINT,
+  bytes BIGINT DEFAULT 0,
+  clients BIGINT DEFAULT 0,
+  PRIMARY KEY (day, host, port)
+);
+
+create table if not exists connect_target_clients (
+  day TEXT,
+  host TEXT,
+  port INTEGER,
+  ip TEXT,
+  PRIMARY KEY (day, host, port, ip)
+);
+
+create table if not exists schema_version (
+  version INTEGER PRIMARY KEY,
+  name TEXT,
+  applied_by TEXT,
+  applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+create index if not exists requests_request_id on requests (request_id);
+create index if not exists requests_created_at on requests (created_at);
+create index if not exists request_tags_request_id on request_tags (request_id);
+create index if not exists responses_request_id on responses (request_id);
+create index if not exists connects_created_at on connects (created_at);
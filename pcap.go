@@ -0,0 +1,375 @@
+package stuffpot
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pcapMSS is the most payload bytes of a synthesized segment.
+const pcapMSS = 1460
+
+// The TCP flags of the synthesized segments.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// The addresses standing for a remote whose address isn't known, from the
+// ranges reserved for documentation.
+var (
+	pcapRemote4 = netip.MustParseAddr("192.0.2.1")
+	pcapRemote6 = netip.MustParseAddr("2001:db8::1")
+)
+
+// The MAC addresses of the client and the remote in the Ethernet headers,
+// locally administered.
+var pcapMACs = [2][6]byte{{0x02, 0, 0, 0, 0, 1}, {0x02, 0, 0, 0, 0, 2}}
+
+// Pcap writes the traffic to a pcap file, synthesized as one TCP connection
+// per request, from the client to the remote: its handshake, the request,
+// the response and the closing of the connection. The requests of MITM'd
+// tunnels are written decrypted, with the framing of HTTP/1.1. The bodies are
+// those stored in the bodies table, decoded, the Content-Length being that of
+// the bytes written. Relayed tunnels are written with the bytes captured.
+//
+// The remote is the address the request was sent to, or that of the URL when
+// it's an IP address, otherwise one reserved for documentation. The client
+// ports are synthesized.
+type Pcap struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	// port is the client port of the last connection.
+	port uint16
+}
+
+func NewPcap(cfg PcapConfig) (*Pcap, error) {
+	p := &Pcap{path: cfg.Path, port: 49151}
+	if err := p.open(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// open opens the file, writing the pcap header when it's new.
+func (p *Pcap) open() error {
+	f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if fi.Size() == 0 {
+		// Microsecond timestamps, version 2.4, snaplen 65535, Ethernet.
+		header := []byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, 1, 0, 0, 0}
+		if _, err := f.Write(header); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	p.file = f
+	return nil
+}
+
+// Reopen reopens the file, for use after it was moved away by logrotate.
+func (p *Pcap) Reopen() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.file.Close()
+	return p.open()
+}
+
+// flow starts the connection of a request from client to remote.
+func (p *Pcap) flow(client, remote netip.Addr, port uint16) *pcapFlow {
+	p.mu.Lock()
+	if p.port++; p.port == 0 {
+		p.port = 49152
+	}
+	src := p.port
+	p.mu.Unlock()
+
+	if client.Is4() != remote.Is4() {
+		remote = pcapRemote6
+		if client.Is4() {
+			remote = pcapRemote4
+		}
+	}
+	return &pcapFlow{
+		addrs: [2]netip.AddrPort{netip.AddrPortFrom(client, src), netip.AddrPortFrom(remote, port)},
+		seq:   [2]uint32{rand.Uint32(), rand.Uint32()},
+	}
+}
+
+// write appends the packets of f to the file.
+func (p *Pcap) write(f *pcapFlow) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.file.Write(f.buf.Bytes())
+	return err
+}
+
+// pcapAddr returns the address of host, if it's an IP address, or fallback.
+func pcapAddr(host string, fallback *net.TCPAddr) netip.Addr {
+	if fallback != nil {
+		if a, ok := netip.AddrFromSlice(fallback.IP); ok {
+			return a.Unmap()
+		}
+	}
+	if a, err := netip.ParseAddr(host); err == nil {
+		return a.Unmap().WithZone("")
+	}
+	return pcapRemote4
+}
+
+func (p *Pcap) LogExchange(ctx context.Context, ex *Exchange) error {
+	client, err := netip.ParseAddr(ex.ClientIP)
+	if err != nil {
+		return fmt.Errorf("pcap: client address: %w", err)
+	}
+	req := ex.Request
+	port := 80
+	if req.URL.Scheme == "https" {
+		port = 443
+	}
+	if n, err := strconv.Atoi(req.URL.Port()); err == nil {
+		port = n
+	}
+	var sent *net.TCPAddr
+	var bodies map[string]*capturedBody
+	if state := ex.state; state != nil {
+		if state.details != nil {
+			sent = state.details.TCPAddr
+		}
+		state.mu.Lock()
+		bodies = make(map[string]*capturedBody, len(state.captured))
+		for _, c := range state.captured {
+			bodies[c.Location] = c
+		}
+		state.mu.Unlock()
+	}
+	f := p.flow(client, pcapAddr(req.URL.Hostname(), sent), uint16(port))
+
+	f.open(ex.Start)
+	var b bytes.Buffer
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&b, "%v %v %v\r\nHost: %v\r\n", req.Method, req.URL.RequestURI(), pcapProto(req.ProtoMajor, req.ProtoMinor),
+		host)
+	pcapMessage(&b, req.Header, req.ContentLength != 0 || len(req.TransferEncoding) > 0, bodies["request"])
+	f.send(ex.Start, dirUp, b.Bytes())
+	if resp := ex.Response; resp != nil {
+		at := ex.Responded
+		if at.IsZero() {
+			at = ex.End
+		}
+		b.Reset()
+		status := resp.Status
+		if status == "" {
+			status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+		}
+		fmt.Fprintf(&b, "%v %v\r\n", pcapProto(resp.ProtoMajor, resp.ProtoMinor), status)
+		pcapMessage(&b, resp.Header, resp.ContentLength != 0 || len(resp.TransferEncoding) > 0, bodies["response"])
+		f.send(at, dirDown, b.Bytes())
+	}
+	f.close(ex.End)
+	return p.write(f)
+}
+
+// pcapProto returns the HTTP version of a synthesized message, HTTP/1.1 for
+// those of HTTP/2.
+func pcapProto(major, minor int) string {
+	if major != 1 {
+		return "HTTP/1.1"
+	}
+	return fmt.Sprintf("HTTP/%d.%d", major, minor)
+}
+
+// pcapMessage writes the headers and the body of a message, framed by a
+// Content-Length when the message had a body.
+func pcapMessage(b *bytes.Buffer, header http.Header, hasBody bool, body *capturedBody) {
+	h := header.Clone()
+	h.Del("Transfer-Encoding")
+	h.Del("Content-Length")
+	var data []byte
+	if body != nil {
+		data = body.Data
+		if body.Encoding == "" {
+			h.Del("Content-Encoding")
+		}
+	}
+	if hasBody || body != nil {
+		h.Set("Content-Length", strconv.Itoa(len(data)))
+	}
+	h.Write(b)
+	b.WriteString("\r\n")
+	b.Write(data)
+}
+
+func (p *Pcap) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	if len(tc.chunks) == 0 {
+		return nil
+	}
+	client, err := netip.ParseAddr(clientIP(req.RemoteAddr))
+	if err != nil {
+		return fmt.Errorf("pcap: client address: %w", err)
+	}
+	port, _ := strconv.Atoi(req.URL.Port())
+	start := time.Now()
+	if s, ok := pctx.UserData.(*tunnelState); ok && !s.start.IsZero() {
+		start = s.start
+	}
+	f := p.flow(client, pcapAddr(req.URL.Hostname(), nil), uint16(port))
+
+	// The capture has no time of each chunk, they're sent as the tunnel
+	// opens.
+	f.open(start)
+	for _, c := range tc.chunks {
+		f.send(start, c.direction, c.data)
+	}
+	f.close(time.Now())
+	return p.write(f)
+}
+
+func (p *Pcap) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.file.Close()
+}
+
+// pcapFlow synthesizes the packets of a TCP connection, by direction: dirUp
+// from the client and dirDown from the remote.
+type pcapFlow struct {
+	buf   bytes.Buffer
+	addrs [2]netip.AddrPort
+	// seq is the next sequence number of each direction.
+	seq [2]uint32
+}
+
+// open writes the three-way handshake.
+func (f *pcapFlow) open(at time.Time) {
+	f.packet(at, dirUp, tcpSYN, nil)
+	f.seq[dirUp]++
+	f.packet(at, dirDown, tcpSYN|tcpACK, nil)
+	f.seq[dirDown]++
+	f.packet(at, dirUp, tcpACK, nil)
+}
+
+// send writes data in segments of pcapMSS bytes.
+func (f *pcapFlow) send(at time.Time, dir int, data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), pcapMSS)
+		f.packet(at, dir, tcpPSH|tcpACK, data[:n])
+		f.seq[dir] += uint32(n)
+		data = data[n:]
+	}
+}
+
+// close writes the client closing the connection, then the remote.
+func (f *pcapFlow) close(at time.Time) {
+	f.packet(at, dirUp, tcpFIN|tcpACK, nil)
+	f.seq[dirUp]++
+	f.packet(at, dirDown, tcpFIN|tcpACK, nil)
+	f.seq[dirDown]++
+	f.packet(at, dirUp, tcpACK, nil)
+}
+
+// packet writes a segment sent in direction dir, acknowledging all the other
+// direction sent, with its Ethernet and IP headers.
+func (f *pcapFlow) packet(at time.Time, dir int, flags byte, payload []byte) {
+	src, dst := f.addrs[dir], f.addrs[1-dir]
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], f.seq[dir])
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], f.seq[1-dir])
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, payload...)
+
+	// The pseudo-header of the checksum.
+	var sum uint32
+	s, d := src.Addr().AsSlice(), dst.Addr().AsSlice()
+	sum = checksumAdd(sum, s)
+	sum = checksumAdd(sum, d)
+	sum += 6 + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksumFold(checksumAdd(sum, tcp)))
+
+	var ip []byte
+	etherType := uint16(0x0800)
+	if src.Addr().Is4() {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[6] = 0x40 // Don't fragment.
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], s)
+		copy(ip[16:], d)
+		binary.BigEndian.PutUint16(ip[10:], checksumFold(checksumAdd(0, ip)))
+	} else {
+		etherType = 0x86dd
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], s)
+		copy(ip[24:], d)
+	}
+
+	n := 14 + len(ip) + len(tcp)
+	var record [16]byte
+	binary.LittleEndian.PutUint32(record[0:], uint32(at.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(at.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(n))
+	binary.LittleEndian.PutUint32(record[12:], uint32(n))
+	f.buf.Write(record[:])
+	f.buf.Write(pcapMACs[1-dir][:])
+	f.buf.Write(pcapMACs[dir][:])
+	f.buf.Write(binary.BigEndian.AppendUint16(nil, etherType))
+	f.buf.Write(ip)
+	f.buf.Write(tcp)
+}
+
+// checksumAdd adds b to the one's complement sum of the Internet checksum.
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksumFold returns the Internet checksum of sum.
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,140 @@
+package stuffpot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// pcapSegment is a TCP segment read from a pcap file.
+type pcapSegment struct {
+	src, dst string
+	flags    byte
+	seq      uint32
+	payload  []byte
+}
+
+// readPcap returns the IPv4 TCP segments of the pcap file at path, checking
+// their checksums.
+func readPcap(t *testing.T, path string) []pcapSegment {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != 1 {
+		t.Fatalf("not a pcap file of Ethernet frames: %x", data[:min(len(data), 24)])
+	}
+	// valid tells whether the one's complement sum of b is all ones.
+	valid := func(sum uint32, b []byte) bool {
+		for i := 0; i < len(b); i += 2 {
+			if i+1 < len(b) {
+				sum += uint32(b[i])<<8 | uint32(b[i+1])
+			} else {
+				sum += uint32(b[i]) << 8
+			}
+		}
+		for sum > 0xffff {
+			sum = sum&0xffff + sum>>16
+		}
+		return sum == 0xffff
+	}
+	var segments []pcapSegment
+	for rest := data[24:]; len(rest) > 0; {
+		n := int(binary.LittleEndian.Uint32(rest[8:]))
+		frame := rest[16 : 16+n]
+		rest = rest[16+n:]
+		if binary.BigEndian.Uint16(frame[12:]) != 0x0800 {
+			t.Fatalf("not IPv4: %x", frame[12:14])
+		}
+		ip := frame[14 : 14+20]
+		tcp := frame[14+20:]
+		if int(binary.BigEndian.Uint16(ip[2:])) != 20+len(tcp) || !valid(0, ip) {
+			t.Fatalf("invalid IP header %x", ip)
+		}
+		pseudo := append(append([]byte(nil), ip[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		if !valid(0, append(pseudo, tcp...)) {
+			t.Fatalf("invalid TCP checksum %x", tcp[:20])
+		}
+		segments = append(segments, pcapSegment{
+			src:     fmt.Sprintf("%v.%v.%v.%v:%v", ip[12], ip[13], ip[14], ip[15], binary.BigEndian.Uint16(tcp)),
+			dst:     fmt.Sprintf("%v.%v.%v.%v:%v", ip[16], ip[17], ip[18], ip[19], binary.BigEndian.Uint16(tcp[2:])),
+			flags:   tcp[13],
+			seq:     binary.BigEndian.Uint32(tcp[4:]),
+			payload: tcp[20:],
+		})
+	}
+	return segments
+}
+
+func TestPcapOfAnExchange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.pcap")
+	p, err := NewPcap(PcapConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(strings.Repeat("<p>hello</p>", 200)))
+	zw.Close()
+	req := httptest.NewRequest("GET", "http://192.0.2.10:8080/index.html", nil)
+	req.RemoteAddr = "198.51.100.7:40000"
+	header := http.Header{"Content-Encoding": {"gzip"}, "Content-Type": {"text/html"}}
+	resp := &http.Response{StatusCode: 200, Proto: "HTTP/2.0", ProtoMajor: 2, Header: header, ContentLength: -1,
+		TransferEncoding: []string{"chunked"}}
+	ex := finishedExchange(req, "r1", resp, int64(gz.Len()))
+	ex.state.addCapture(newCapturedBody(gz.Bytes(), int64(gz.Len()), 1<<20, header, "response"))
+	if err := p.LogExchange(context.Background(), ex); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := readPcap(t, path)
+	var flags []byte
+	streams := map[string]*bytes.Buffer{}
+	next := map[string]uint32{}
+	for _, s := range segments {
+		flags = append(flags, s.flags)
+		if streams[s.src] == nil {
+			streams[s.src] = &bytes.Buffer{}
+		}
+		// Each segment follows the previous one of its direction.
+		if seq, ok := next[s.src]; ok && s.seq != seq {
+			t.Errorf("%v: got sequence %v, want %v", s.src, s.seq, seq)
+		}
+		next[s.src] = s.seq + uint32(len(s.payload))
+		if s.flags&(tcpSYN|tcpFIN) != 0 {
+			next[s.src]++
+		}
+		streams[s.src].Write(s.payload)
+	}
+	// The handshake, the request, the response in two segments, then the
+	// closing.
+	want := []byte{tcpSYN, tcpSYN | tcpACK, tcpACK, tcpPSH | tcpACK, tcpPSH | tcpACK, tcpPSH | tcpACK,
+		tcpFIN | tcpACK, tcpFIN | tcpACK, tcpACK}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("got the flags %v, want %v", flags, want)
+	}
+	client, remote := segments[0].src, segments[0].dst
+	if !strings.HasPrefix(client, "198.51.100.7:") || remote != "192.0.2.10:8080" {
+		t.Errorf("got a connection from %v to %v", client, remote)
+	}
+	if got := streams[client].String(); got != "GET /index.html HTTP/1.1\r\nHost: 192.0.2.10:8080\r\n\r\n" {
+		t.Errorf("got the request %q", got)
+	}
+	body := strings.Repeat("<p>hello</p>", 200)
+	wantResp := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\nContent-Type: text/html\r\n\r\n%v", len(body), body)
+	if got := streams[remote].String(); got != wantResp {
+		t.Errorf("got the response %q", got)
+	}
+}
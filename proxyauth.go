@@ -0,0 +1,159 @@
+package stuffpot
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAuthClients bounds the clients whose failed attempts are counted,
+// further ones never having their credentials accepted by the leaky mode.
+const maxAuthClients = 100000
+
+// compileProxyAuth validates the proxy authentication, and indexes its users.
+func (c *Config) compileProxyAuth() error {
+	var errs []error
+	c.proxyAuthUsers = nil
+	for _, u := range c.ProxyAuth.Users {
+		if user, _, ok := strings.Cut(u, ":"); !ok || user == "" {
+			errs = append(errs, fmt.Errorf("proxy_auth.users: expected user:password, got %q", u))
+		}
+		c.proxyAuthUsers = append(c.proxyAuthUsers, sha256.Sum256([]byte(u)))
+	}
+	if c.ProxyAuth.AcceptAfter < 0 {
+		errs = append(errs, errors.New("proxy_auth.accept_after: must not be negative"))
+	}
+	if c.ProxyAuth.Window <= 0 {
+		errs = append(errs, errors.New("proxy_auth.window: must be positive"))
+	}
+	if c.ProxyAuth.Enabled && len(c.ProxyAuth.Users) == 0 && c.ProxyAuth.AcceptAfter == 0 {
+		errs = append(errs, errors.New("proxy_auth: needs users or accept_after"))
+	}
+	return errors.Join(errs...)
+}
+
+// proxyAuth counts the failed attempts of the clients to authenticate to the
+// proxy, for the leaky mode to accept any credentials once they're enough.
+type proxyAuth struct {
+	config *ConfigStore
+	log    *slog.Logger
+
+	mu      sync.Mutex
+	clients map[string]*authClient
+}
+
+type authClient struct {
+	failures int
+	last     time.Time
+}
+
+func newProxyAuth(config *ConfigStore) *proxyAuth {
+	return &proxyAuth{config: config, log: slog.With("component", "proxy-auth"), clients: make(map[string]*authClient)}
+}
+
+// allow tells whether a client of ip sending creds, those of its request or
+// CONNECT, is let through the proxy authentication of cfg. The Basic
+// credentials of its Proxy-Authorization are checked against the users, or
+// any are accepted once the client failed accept_after times within the
+// window. A request without any isn't an attempt. Every user is compared, in
+// constant time, as the admin tokens are.
+func (a *proxyAuth) allow(cfg *Config, ip string, creds []credential) bool {
+	if !cfg.ProxyAuth.Enabled {
+		return true
+	}
+	var sent *credential
+	for i, c := range creds {
+		if c.Source == "proxy-authorization" && c.Scheme == "basic" {
+			sent = &creds[i]
+			break
+		}
+	}
+	if sent == nil {
+		return false
+	}
+	given, known := sha256.Sum256([]byte(sent.Username+":"+sent.Password)), 0
+	for _, want := range cfg.proxyAuthUsers {
+		known |= subtle.ConstantTimeCompare(given[:], want[:])
+	}
+	if known == 1 {
+		return true
+	}
+	if cfg.ProxyAuth.AcceptAfter == 0 {
+		return false
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c := a.clients[ip]
+	if c != nil && now.Sub(c.last) > cfg.ProxyAuth.Window {
+		c.failures = 0
+	}
+	if c == nil {
+		if len(a.clients) >= maxAuthClients {
+			for k, c := range a.clients {
+				if now.Sub(c.last) > cfg.ProxyAuth.Window {
+					delete(a.clients, k)
+				}
+			}
+			if len(a.clients) >= maxAuthClients {
+				return false
+			}
+		}
+		c = &authClient{}
+		a.clients[ip] = c
+	}
+	c.last = now
+	if c.failures >= cfg.ProxyAuth.AcceptAfter {
+		if c.failures == cfg.ProxyAuth.AcceptAfter {
+			a.log.Info("Accepting any credentials", "client", ip, "username", sent.Username)
+			c.failures++
+		}
+		return true
+	}
+	c.failures++
+	return false
+}
+
+// credentialAttempt is a credential a client sent, with how often it did.
+type credentialAttempt struct {
+	ClientIP  string `json:"client_ip"`
+	Source    string `json:"source"`
+	Scheme    string `json:"scheme"`
+	Username  string `json:"username"`
+	Password  string `json:"password,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Attempts  int64  `json:"attempts"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+}
+
+// credentialAttempts returns the credentials sent by ip, or by any client when
+// empty, those last sent first.
+func (logger *HttpLogger) credentialAttempts(ctx context.Context, ip string, limit int) ([]credentialAttempt, error) {
+	rows, err := logger.db.QueryContext(ctx, `select coalesce(from_ip, ''), coalesce(source, ''), coalesce(scheme, ''),
+      coalesce(username, ''), coalesce(password, ''), coalesce(hash, ''), count(*), min(created_at), max(created_at)
+      from credentials where ? = '' or from_ip = ? group by from_ip, source, scheme, username, password, hash
+      order by max(created_at) desc limit ?`, ip, ip, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get credential attempts: %w", err)
+	}
+	defer rows.Close()
+	attempts := []credentialAttempt{}
+	for rows.Next() {
+		var a credentialAttempt
+		if err := rows.Scan(&a.ClientIP, &a.Source, &a.Scheme, &a.Username, &a.Password, &a.Hash, &a.Attempts,
+			&a.FirstSeen, &a.LastSeen); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
@@ -0,0 +1,151 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProxyAuthentication(t *testing.T) {
+	config := testConfig(t, "-proxy-auth", "-proxy-auth-users", "alice:secret,bob:pa:ss", "-proxy-auth-accept-after",
+		"2", "-proxy-auth-window", "1h")
+	cfg := config.Load()
+	a := newProxyAuth(config)
+	basic := func(user, pass string) []credential {
+		return []credential{{Source: "proxy-authorization", Scheme: "basic", Username: user, Password: pass}}
+	}
+	for _, tc := range []struct {
+		ip    string
+		creds []credential
+		want  bool
+	}{
+		{"192.0.2.1", basic("alice", "secret"), true},
+		{"192.0.2.1", basic("bob", "pa:ss"), true},
+		// Without credentials, or with those of another header, a request
+		// isn't an attempt.
+		{"192.0.2.2", nil, false},
+		{"192.0.2.2", []credential{{Source: "authorization", Scheme: "basic", Username: "alice", Password: "secret"}},
+			false},
+		{"192.0.2.2", basic("alice", "guess"), false},
+		{"192.0.2.2", basic("root", "root"), false},
+		{"192.0.2.2", basic("root", "toor"), true},
+		{"192.0.2.2", basic("admin", "admin"), true},
+		{"192.0.2.3", basic("root", "toor"), false},
+	} {
+		if got := a.allow(cfg, tc.ip, tc.creds); got != tc.want {
+			t.Errorf("%v %+v: got %v, want %v", tc.ip, tc.creds, got, tc.want)
+		}
+	}
+	// The failures are forgotten after the window.
+	a.mu.Lock()
+	a.clients["192.0.2.2"].last = time.Now().Add(-2 * time.Hour)
+	a.mu.Unlock()
+	if a.allow(cfg, "192.0.2.2", basic("root", "toor")) {
+		t.Error("the credentials were accepted after the window")
+	}
+	if !a.allow(testConfig(t).Load(), "192.0.2.4", nil) {
+		t.Error("a client was refused without the proxy authentication")
+	}
+
+	for _, args := range [][]string{
+		{"-proxy-auth"},
+		{"-proxy-auth-users", "nopassword"},
+		{"-proxy-auth-users", ":secret"},
+		{"-proxy-auth-accept-after", "-1"},
+		{"-proxy-auth-window", "0s"},
+	} {
+		if _, err := NewConfigStore("stuffpot", args); err == nil {
+			t.Errorf("%v: an invalid config was accepted", args)
+		}
+	}
+}
+
+func TestProxyAuthenticationOfRequestsAndTunnels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	s, client := startServer(t, testConfig(t, "-proxy-auth", "-proxy-auth-users", "alice:secret"), nil)
+	adminURL := serveAdmin(t, s)
+	proxyURL, _ := client.Transport.(*http.Transport).Proxy(nil)
+	as := func(user *url.Userinfo) {
+		u := *proxyURL
+		u.User = user
+		client.Transport = &http.Transport{Proxy: http.ProxyURL(&u)}
+	}
+
+	var got []int
+	for _, user := range []*url.Userinfo{nil, url.UserPassword("mallory", "guess"), url.UserPassword("alice", "secret")} {
+		as(user)
+		resp, err := client.Get(upstream.URL + "/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		got = append(got, resp.StatusCode)
+		if resp.StatusCode == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Error("the 407 has no Proxy-Authenticate")
+		}
+		_, _, connect := openTunnel(t, client, upstream.Listener.Addr().String())
+		got = append(got, connect.StatusCode)
+	}
+	want := []int{407, 407, 407, 407, 200, 200}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want only alice let through", got)
+	}
+
+	var body struct {
+		Credentials []credentialAttempt `json:"credentials"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(body.Credentials) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		getJSON(t, adminURL, "/api/credentials?ip=127.0.0.1", &body)
+	}
+	var users []string
+	for _, c := range body.Credentials {
+		if c.ClientIP != "127.0.0.1" || c.Source != "proxy-authorization" || c.Attempts != 2 {
+			t.Errorf("got the attempt %+v, want those of the request and the CONNECT", c)
+		}
+		users = append(users, c.Username)
+	}
+	if !reflect.DeepEqual(users, []string{"alice", "mallory"}) {
+		t.Errorf("got the credentials of %v, want those of alice, then mallory", users)
+	}
+	var e map[string]string
+	if code := getJSON(t, adminURL, "/api/credentials?limit=0", &e); code != http.StatusBadRequest {
+		t.Errorf("got %v for an invalid limit, want 400", code)
+	}
+}
+
+func TestTransparentClientsAreNotAskedForCredentials(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	s, err := NewServer(testConfig(t, "-proxy-auth", "-proxy-auth-users", "alice:secret"), &recordingLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTransparent(redirectedListener{ln, upstream.Listener.Addr()})
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprint(conn, "GET /a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("got %v, %v, want the request forwarded", resp, err)
+	}
+}
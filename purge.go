@@ -0,0 +1,243 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// purgeFilter selects the traffic deleted by purge. Its filters are combined.
+type purgeFilter struct {
+	IP   string
+	Host string
+	Tag  string
+	// Before is a time.DateTime in UTC.
+	Before string
+}
+
+// where returns the condition on the requests and tunnels, or on the rows of
+// a table without tags, which match none when filtering by tag. A host
+// matches with any port.
+func (f purgeFilter) where(tagged bool) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if f.IP != "" {
+		conds, args = append(conds, "from_ip = ?"), append(args, f.IP)
+	}
+	if f.Host != "" {
+		conds, args = append(conds, "(host = ? or substr(host, 1, length(?) + 1) = ? || ':')"), append(args, f.Host, f.Host, f.Host)
+	}
+	if f.Before != "" {
+		conds, args = append(conds, "created_at < ?"), append(args, f.Before)
+	}
+	if f.Tag != "" {
+		if !tagged {
+			return "0", nil
+		}
+		conds, args = append(conds, "instr(',' || tags || ',', ?) > 0"), append(args, ","+f.Tag+",")
+	}
+	return strings.Join(conds, " and "), args
+}
+
+// purgeCount is the number of rows of a table deleted by purge.
+type purgeCount struct {
+	table string
+	rows  int64
+}
+
+// purge deletes the requests and tunnels matching f in tx, with the rows
+// recorded about them: their tags, responses, samples, honeytokens, captures,
+// WebSocket messages, cookies, credentials and search index rows, the requests
+// read from the tunnels, and the TLS failures. The brute force and client
+// sessions of the client go along when it's only filtered by address and time.
+// The stats tables are rebuilt from the requests left.
+func purge(tx *sql.Tx, f purgeFilter, trafficTop int) ([]purgeCount, error) {
+	where, args := f.where(true)
+	failWhere, failArgs := f.where(false)
+	setup := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"create temp table purged_connects as select id, tunnel_id from connects where " + where, args},
+		{"create temp table purged_requests as select id, request_id from requests where " + where, args},
+		{`insert into purged_requests select id, request_id from requests
+          where parent_id in (select tunnel_id from purged_connects) and id not in (select id from purged_requests)`, nil},
+	}
+	for _, s := range setup {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			return nil, err
+		}
+	}
+
+	deletes := []struct {
+		table string
+		query string
+		args  []interface{}
+	}{
+		{"requests", "delete from requests where id in (select id from purged_requests)", nil},
+		{"request_tags", `delete from request_tags where request_id in (select request_id from purged_requests)
+          or request_id in (select tunnel_id from purged_connects)`, nil},
+		{"responses", "delete from responses where request_id in (select request_id from purged_requests)", nil},
+		{"bodies", "delete from bodies where request_id in (select request_id from purged_requests)", nil},
+		{"samples", "delete from samples where request_id in (select request_id from purged_requests)", nil},
+		{"honeytokens", "delete from honeytokens where request_id in (select request_id from purged_requests)", nil},
+		{"websocket_messages", "delete from websocket_messages where request_id in (select request_id from purged_requests)",
+			nil},
+		{"cookies", "delete from cookies where request_id in (select request_id from purged_requests)", nil},
+		{"credentials", `delete from credentials where request_id in (select request_id from purged_requests)
+          or request_id in (select tunnel_id from purged_connects)`, nil},
+		{"connects", "delete from connects where id in (select id from purged_connects)", nil},
+		{"tunnel_capture", "delete from tunnel_capture where connect_id in (select id from purged_connects)", nil},
+		{"smtp_attempts", "delete from smtp_attempts where connect_id in (select id from purged_connects)", nil},
+		{"tls_failures", "delete from tls_failures where " + failWhere, failArgs},
+	}
+	if f.IP != "" && f.Host == "" && f.Tag == "" {
+		for _, table := range []string{"sessions", "client_sessions"} {
+			q, args := "delete from "+table+" where from_ip = ?", []interface{}{f.IP}
+			if f.Before != "" {
+				q, args = q+" and updated_at < ?", append(args, f.Before)
+			}
+			deletes = append(deletes, struct {
+				table string
+				query string
+				args  []interface{}
+			}{table, q, args})
+		}
+	}
+	if ok, err := hasSearch(tx); err != nil {
+		return nil, err
+	} else if ok {
+		deletes = append(deletes, struct {
+			table string
+			query string
+			args  []interface{}
+		}{"request_search", "delete from request_search where rowid in (select id from purged_requests)", nil})
+	}
+	var counts []purgeCount
+	for _, d := range deletes {
+		res, err := tx.Exec(d.query, d.args...)
+		if err != nil {
+			return nil, fmt.Errorf("purge %v: %w", d.table, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, purgeCount{d.table, n})
+	}
+
+	for _, stmt := range []string{"drop table purged_requests", "drop table purged_connects"} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	if err := reindexStatsTx(tx, trafficTop); err != nil {
+		return nil, fmt.Errorf("reindex stats: %w", err)
+	}
+	return counts, nil
+}
+
+// purgeCommand implements the purge subcommand:
+//
+//	stuffpot purge [-db path] [-ip addr] [-host host] [-before time] [-tag tag] [-yes] [-online]
+//
+// It deletes the matching traffic from the database and its daily files,
+// printing what's deleted from each. Without -yes, nothing is deleted.
+func purgeCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot purge", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	var f purgeFilter
+	fs.StringVar(&f.IP, "ip", "", "Purge the traffic of this client address")
+	fs.StringVar(&f.Host, "host", "", "Purge the traffic to this host, on any port")
+	fs.StringVar(&f.Tag, "tag", "", "Purge the requests and tunnels with this tag")
+	before := fs.String("before", "", "Purge the traffic before this RFC 3339 time or day, as 2006-01-02")
+	yes := fs.Bool("yes", false, "Delete, rather than only print what would be deleted")
+	online := fs.Bool("online", false, "Purge even while a stuffpot process serves the database")
+	fs.Parse(args)
+
+	if *before != "" {
+		t, err := time.Parse(time.RFC3339, *before)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, *before); err != nil {
+				fmt.Fprintln(os.Stderr, "-before: expected a RFC 3339 time or a day")
+				os.Exit(2)
+			}
+		}
+		f.Before = t.UTC().Format(time.DateTime)
+	}
+	if f == (purgeFilter{}) {
+		fmt.Fprintln(os.Stderr, "at least one of -ip, -host, -before and -tag is needed")
+		os.Exit(2)
+	}
+
+	lock, err := lockDatabase(*path, true)
+	switch {
+	case errors.Is(err, syscall.EWOULDBLOCK) && !*online:
+		fmt.Fprintf(os.Stderr, "%v is being served, stop stuffpot first or pass -online\n", *path)
+		os.Exit(1)
+	case errors.Is(err, syscall.EWOULDBLOCK):
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	default:
+		defer lock.Close()
+	}
+	paths, err := databaseFiles(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, p := range paths {
+		counts, err := purgeFile(p, f, *yes, cfg.Storage.HostTrafficTop)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", p, err)
+			failed = true
+			continue
+		}
+		parts := make([]string, len(counts))
+		for i, c := range counts {
+			parts[i] = fmt.Sprintf("%d %v", c.rows, c.table)
+		}
+		fmt.Printf("%v: %v\n", p, strings.Join(parts, ", "))
+	}
+	if !*yes {
+		fmt.Println("Nothing was deleted, run again with -yes to purge")
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// purgeFile purges the database at path, only committing with commit. The
+// busy timeout lets it wait for a serving process writing to it.
+func purgeFile(path string, f purgeFilter, commit bool, trafficTop int) ([]purgeCount, error) {
+	logger, err := NewLogger("file:" + path + "?_busy_timeout=10000")
+	if err != nil {
+		return nil, err
+	}
+	defer logger.Close()
+
+	tx, err := logger.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	counts, err := purge(tx, f, trafficTop)
+	if err != nil || !commit {
+		return counts, err
+	}
+	return counts, tx.Commit()
+}
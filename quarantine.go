@@ -0,0 +1,393 @@
+package stuffpot
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sampleHead is the number of leading bytes a body is recognized by.
+const sampleHead = 4
+
+// Sample statuses, in the samples table.
+const (
+	sampleStored    = "stored"
+	sampleDuplicate = "duplicate"
+	sampleTooLarge  = "too-large"
+	sampleDiskFull  = "disk-full"
+)
+
+var sampleName = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// sniffSample returns the type of executable a body starting with head looks
+// like, or zip for archives which may hold one.
+func sniffSample(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "pe"
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "elf"
+	case bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}),
+		bytes.HasPrefix(head, []byte{0xca, 0xfe, 0xba, 0xbe}):
+		return "macho"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return "zip"
+	}
+	return ""
+}
+
+// confirmSample parses the file a body was stored in, and returns its type
+// when it's an executable or an archive holding one.
+func confirmSample(path, sniffed string) string {
+	var err error
+	switch sniffed {
+	case "pe":
+		var f *pe.File
+		if f, err = pe.Open(path); err == nil {
+			f.Close()
+		}
+	case "elf":
+		var f *elf.File
+		if f, err = elf.Open(path); err == nil {
+			f.Close()
+		}
+	case "macho":
+		var f *macho.File
+		if f, err = macho.Open(path); err == nil {
+			f.Close()
+		} else {
+			var ff *macho.FatFile
+			if ff, err = macho.OpenFat(path); err == nil {
+				ff.Close()
+			}
+		}
+	case "zip":
+		if zipHoldsExecutable(path) {
+			return "zip"
+		}
+		return ""
+	default:
+		return ""
+	}
+	if err != nil {
+		return ""
+	}
+	return sniffed
+}
+
+// zipHoldsExecutable tells whether an entry of the archive at path looks like
+// an executable.
+func zipHoldsExecutable(path string) bool {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		head := make([]byte, sampleHead)
+		n, _ := io.ReadFull(rc, head)
+		rc.Close()
+		if t := sniffSample(head[:n]); t != "" && t != "zip" {
+			return true
+		}
+	}
+	return false
+}
+
+// sample is an executable seen in a body.
+type sample struct {
+	SHA256 string    `json:"sha256"`
+	Size   int64     `json:"size"`
+	Type   string    `json:"type"`
+	Stored time.Time `json:"stored_at"`
+	// Direction is up for request bodies and down for response bodies, and
+	// RequestID the request they belong to. They're only set for sightings.
+	Direction string `json:"-"`
+	RequestID string `json:"-"`
+	Status    string `json:"-"`
+}
+
+// quarantine stores the executables seen in bodies in a directory, named by
+// their SHA-256 and read-only.
+type quarantine struct {
+	dir      string
+	maxFile  int64
+	maxTotal int64
+	log      *slog.Logger
+	// record is called for every sample seen, stored or not.
+	record func(s *sample)
+
+	mu      sync.Mutex
+	used    int64
+	samples map[string]*sample
+}
+
+// newQuarantine indexes the samples already in dir, or returns nil when
+// there's no dir.
+func newQuarantine(cfg QuarantineConfig, record func(s *sample)) (*quarantine, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	q := &quarantine{dir: cfg.Dir, maxFile: cfg.MaxFile, maxTotal: cfg.MaxTotal, log: slog.With("component", "quarantine"),
+		record: record, samples: make(map[string]*sample)}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		// Temporary files are left behind by a crash.
+		if strings.HasPrefix(e.Name(), ".sample-") {
+			os.Remove(filepath.Join(cfg.Dir, e.Name()))
+			continue
+		}
+		if !sampleName.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(cfg.Dir, e.Name())
+		head := make([]byte, sampleHead)
+		if f, err := os.Open(path); err == nil {
+			n, _ := io.ReadFull(f, head)
+			head = head[:n]
+			f.Close()
+		}
+		q.samples[e.Name()] = &sample{SHA256: e.Name(), Size: info.Size(), Type: sniffSample(head), Stored: info.ModTime().UTC()}
+		q.used += info.Size()
+	}
+	return q, nil
+}
+
+// wrap returns body, recognizing the executables read from it unless cfg
+// captures no bodies. direction is up for request bodies and down for
+// response ones.
+func (q *quarantine) wrap(cfg *Config, body io.ReadCloser, direction, requestID string) io.ReadCloser {
+	if q == nil || body == nil || body == http.NoBody || !cfg.Limits.CaptureBodies {
+		return body
+	}
+	return &sampleBody{ReadCloser: body, q: q, direction: direction, requestID: requestID}
+}
+
+// path returns the file of a stored sample.
+func (q *quarantine) path(sha string) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.samples[sha]
+	return filepath.Join(q.dir, sha), ok
+}
+
+// list returns the stored samples, the latest first.
+func (q *quarantine) list() []sample {
+	q.mu.Lock()
+	all := make([]sample, 0, len(q.samples))
+	for _, s := range q.samples {
+		all = append(all, *s)
+	}
+	q.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].Stored.After(all[j].Stored) })
+	return all
+}
+
+// store moves the temporary file of a complete sample into the directory,
+// unless it's already there or the directory is full.
+func (q *quarantine) store(tmp string, s *sample) {
+	q.mu.Lock()
+	switch {
+	case q.samples[s.SHA256] != nil:
+		s.Status = sampleDuplicate
+	case q.used+s.Size > q.maxTotal:
+		s.Status = sampleDiskFull
+	default:
+		s.Status = sampleStored
+		s.Stored = time.Now().UTC()
+		q.used += s.Size
+		q.samples[s.SHA256] = &sample{SHA256: s.SHA256, Size: s.Size, Type: s.Type, Stored: s.Stored}
+	}
+	q.mu.Unlock()
+
+	if s.Status == sampleStored {
+		err := os.Chmod(tmp, 0o400)
+		if err == nil {
+			err = os.Rename(tmp, filepath.Join(q.dir, s.SHA256))
+		}
+		if err != nil {
+			q.mu.Lock()
+			q.used -= s.Size
+			delete(q.samples, s.SHA256)
+			q.mu.Unlock()
+			q.log.Warn("Cannot store sample", "sha256", s.SHA256, "error", err)
+			os.Remove(tmp)
+			return
+		}
+		q.log.Warn("Sample quarantined", "sha256", s.SHA256, "type", s.Type, "size", s.Size,
+			"direction", s.Direction, "request_id", s.RequestID)
+	} else {
+		os.Remove(tmp)
+	}
+	if s.Status == sampleDiskFull {
+		q.log.Warn("Quarantine full, sample dropped", "sha256", s.SHA256, "size", s.Size)
+	}
+	q.record(s)
+}
+
+// sampleBody tees a body which starts like an executable to a temporary file
+// in the quarantine, hashing it. The sample is kept once the body is read to
+// its end, an incomplete one is dropped.
+type sampleBody struct {
+	io.ReadCloser
+	q         *quarantine
+	direction string
+	requestID string
+
+	head    []byte
+	decided bool
+	sniffed string
+	file    *os.File
+	hash    hash.Hash
+	size    int64
+	done    bool
+}
+
+func (b *sampleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.write(p[:n])
+	}
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *sampleBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.drop()
+	return err
+}
+
+func (b *sampleBody) write(p []byte) {
+	if b.done {
+		return
+	}
+	if !b.decided {
+		b.head = append(b.head, p...)
+		if len(b.head) < sampleHead {
+			return
+		}
+		b.decide()
+		p, b.head = b.head, nil
+	}
+	if b.hash == nil {
+		return
+	}
+	b.hash.Write(p)
+	b.size += int64(len(p))
+	if b.file == nil {
+		return
+	}
+	if b.size > b.q.maxFile {
+		// The sample is still hashed, to record it.
+		b.closeFile()
+		return
+	}
+	if _, err := b.file.Write(p); err != nil {
+		b.q.log.Warn("Cannot write sample", "error", err)
+		b.closeFile()
+	}
+}
+
+// decide starts recording the body when its head looks like a sample.
+func (b *sampleBody) decide() {
+	b.decided = true
+	if b.sniffed = sniffSample(b.head); b.sniffed == "" {
+		return
+	}
+	b.hash = sha256.New()
+	f, err := os.CreateTemp(b.q.dir, ".sample-*")
+	if err != nil {
+		b.q.log.Warn("Cannot create sample", "error", err)
+		return
+	}
+	b.file = f
+}
+
+func (b *sampleBody) closeFile() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+}
+
+func (b *sampleBody) finish() {
+	if b.done {
+		return
+	}
+	if !b.decided {
+		b.decide()
+		head := b.head
+		b.head = nil
+		b.write(head)
+	}
+	b.done = true
+	if b.hash == nil {
+		return
+	}
+	s := &sample{SHA256: hex.EncodeToString(b.hash.Sum(nil)), Size: b.size, Type: b.sniffed,
+		Direction: b.direction, RequestID: b.requestID}
+	if b.file == nil {
+		if b.size > b.q.maxFile {
+			s.Status = sampleTooLarge
+			b.q.record(s)
+		}
+		return
+	}
+	tmp := b.file.Name()
+	err := b.file.Close()
+	b.file = nil
+	if err == nil {
+		// Magic numbers alone are too easily matched, the file must parse.
+		if s.Type = confirmSample(tmp, b.sniffed); s.Type == "" {
+			err = errors.New("not an executable")
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	b.q.store(tmp, s)
+}
+
+// drop discards a body which wasn't read to its end.
+func (b *sampleBody) drop() {
+	if !b.done {
+		b.done = true
+		b.closeFile()
+	}
+}
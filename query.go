@@ -0,0 +1,109 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// queryCommand implements the query subcommand:
+//
+//	stuffpot query [-db path] [-from day] [-to day] SQL
+//
+// It prints the result of a query as tab separated values. With -from or -to,
+// the daily files of the database are queried together, see openDays.
+func queryCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot query", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	from := fs.String("from", "", "First day queried, as 2006-01-02")
+	to := fs.String("to", "", "Last day queried, as 2006-01-02, the current day by default")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stuffpot query [-db path] [-from day] [-to day] SQL")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db, err := openQuery(*path, *from, *to)
+	if err == nil {
+		defer db.Close()
+		err = printQuery(os.Stdout, db, fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func openQuery(path, from, to string) (*sql.DB, error) {
+	if from == "" && to == "" {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		return sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	}
+
+	end := time.Now().UTC()
+	if to != "" {
+		var err error
+		if end, err = time.Parse(dayFormat, to); err != nil {
+			return nil, fmt.Errorf("-to: %v", err)
+		}
+	}
+	start := end
+	if from != "" {
+		var err error
+		if start, err = time.Parse(dayFormat, from); err != nil {
+			return nil, fmt.Errorf("-from: %v", err)
+		}
+	}
+	return openDays(path, start, end)
+}
+
+func printQuery(w io.Writer, db *sql.DB, query string) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, strings.Join(cols, "\t"))
+
+	values := make([]sql.NullString, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	fields := make([]string, len(cols))
+	escape := strings.NewReplacer("\t", `\t`, "\n", `\n`, "\r", `\r`)
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			fields[i] = escape.Replace(v.String)
+			if !v.Valid {
+				fields[i] = "NULL"
+			}
+		}
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
+	}
+	return rows.Err()
+}
@@ -0,0 +1,216 @@
+package stuffpot
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// errRateLimited ends the connection of a client over the rate limits, with
+// the drop action.
+var errRateLimited = errors.New("client over the rate limits")
+
+// clientLimiter keeps the rate limits of the clients, by address: the tokens
+// of their request rate, the bytes they sent and were sent over the current
+// minute, and their open connections.
+type clientLimiter struct {
+	config *ConfigStore
+	log    *slog.Logger
+
+	mu        sync.Mutex
+	clients   map[string]*limitedClient
+	conns     int
+	lastSweep time.Time
+}
+
+type limitedClient struct {
+	conns  int
+	tokens float64
+	// updated is when tokens was last refilled.
+	updated time.Time
+	// bytes is the traffic since window, the start of the current minute.
+	window time.Time
+	bytes  int64
+}
+
+func newClientLimiter(config *ConfigStore) *clientLimiter {
+	return &clientLimiter{config: config, log: slog.With("component", "ratelimit"),
+		clients: make(map[string]*limitedClient)}
+}
+
+// client returns the limits of ip, with a full bucket for a new client. The
+// clients without connections which were idle over a minute are forgotten.
+// l.mu is held.
+func (l *clientLimiter) client(cfg RateLimitConfig, ip string, now time.Time) *limitedClient {
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, c := range l.clients {
+			if c.conns == 0 && now.Sub(c.updated) > time.Minute && now.Sub(c.window) > time.Minute {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	c := l.clients[ip]
+	if c == nil {
+		c = &limitedClient{tokens: cfg.burst(), updated: now, window: now}
+		l.clients[ip] = c
+	}
+	return c
+}
+
+// burst is the requests a client may send at once.
+func (cfg RateLimitConfig) burst() float64 {
+	if cfg.Burst > 0 {
+		return float64(cfg.Burst)
+	}
+	return math.Max(1, math.Ceil(cfg.Requests))
+}
+
+// open counts a connection of ip, unless it's over the connection caps.
+func (l *clientLimiter) open(ip string) bool {
+	cfg := l.config.Load().RateLimit
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cfg.MaxConnections > 0 && l.conns >= cfg.MaxConnections {
+		return false
+	}
+	c := l.client(cfg, ip, time.Now())
+	if cfg.Connections > 0 && c.conns >= cfg.Connections {
+		return false
+	}
+	c.conns++
+	l.conns++
+	return true
+}
+
+func (l *clientLimiter) close(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c := l.clients[ip]; c != nil {
+		c.conns--
+	}
+	l.conns--
+}
+
+// transfer counts n bytes sent by or to ip.
+func (l *clientLimiter) transfer(ip string, n int) {
+	if n <= 0 || l.config.Load().RateLimit.Bytes == 0 {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := l.clients[ip]
+	if c == nil {
+		return
+	}
+	if now.Sub(c.window) >= time.Minute {
+		c.window, c.bytes = now, 0
+	}
+	c.bytes += int64(n)
+}
+
+// over counts a request or tunnel of ip against its rate, and tells whether
+// ip is over the rate of its requests or of its bytes.
+func (l *clientLimiter) over(cfg RateLimitConfig, ip string) bool {
+	if cfg.Requests == 0 && cfg.Bytes == 0 {
+		return false
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := l.client(cfg, ip, now)
+	over := false
+	if cfg.Requests > 0 {
+		c.tokens = math.Min(cfg.burst(), c.tokens+now.Sub(c.updated).Seconds()*cfg.Requests)
+		if c.tokens < 1 {
+			over = true
+		} else {
+			c.tokens--
+		}
+	}
+	c.updated = now
+	if cfg.Bytes > 0 && now.Sub(c.window) < time.Minute && c.bytes >= int64(cfg.Bytes) {
+		over = true
+	}
+	return over
+}
+
+// limit applies the rate limits of cfg to a request or tunnel of ip, whose id
+// is id, telling whether it's over them. The tarpit action holds it first,
+// until ctx is done.
+func (l *clientLimiter) limit(ctx context.Context, cfg *Config, ip, id string) bool {
+	if !l.over(cfg.RateLimit, ip) {
+		return false
+	}
+	rateLimited.Add(1)
+	l.log.Debug("Client over the rate limits", "request_id", id, "client", ip, "action", cfg.RateLimit.Action)
+	if cfg.RateLimit.Action == "tarpit" {
+		t := time.NewTimer(cfg.RateLimit.Tarpit)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+	return true
+}
+
+// listener returns ln, whose connections are counted against the connection
+// caps, those over them being closed as they're accepted, and whose traffic
+// is counted against the rate of their client.
+func (l *clientLimiter) listener(ln net.Listener) net.Listener {
+	return limitedListener{ln, l}
+}
+
+type limitedListener struct {
+	net.Listener
+	limits *clientLimiter
+}
+
+func (ll limitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ll.Listener.Accept()
+		if err != nil {
+			return c, err
+		}
+		ip := clientIP(c.RemoteAddr().String())
+		if ll.limits.open(ip) {
+			return &limitedConn{Conn: c, ip: ip, limits: ll.limits}, nil
+		}
+		connectionsRefused.Add(1)
+		c.Close()
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	ip     string
+	limits *clientLimiter
+	once   sync.Once
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.limits.transfer(c.ip, n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.limits.transfer(c.ip, n)
+	return n, err
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.limits.close(c.ip) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,150 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClientRequestAndByteRates(t *testing.T) {
+	l := newClientLimiter(testConfig(t))
+	cfg := RateLimitConfig{Requests: 2, Burst: 3}
+	var got []bool
+	for range 4 {
+		got = append(got, l.over(cfg, "192.0.2.1"))
+	}
+	got = append(got, l.over(cfg, "192.0.2.2"))
+	if want := []bool{false, false, false, true, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the client over its burst", got)
+	}
+	// A second later, the bucket is refilled by the rate.
+	l.mu.Lock()
+	l.clients["192.0.2.1"].updated = time.Now().Add(-time.Second)
+	l.mu.Unlock()
+	got = got[:0]
+	for range 3 {
+		got = append(got, l.over(cfg, "192.0.2.1"))
+	}
+	if want := []bool{false, false, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want two requests allowed a second later", got)
+	}
+
+	l = newClientLimiter(testConfig(t, "-rate-limit-bytes", "100"))
+	cfg = l.config.Load().RateLimit
+	l.open("192.0.2.1")
+	l.transfer("192.0.2.1", 60)
+	if l.over(cfg, "192.0.2.1") {
+		t.Error("a client under its bytes was limited")
+	}
+	l.transfer("192.0.2.1", 40)
+	if !l.over(cfg, "192.0.2.1") {
+		t.Error("a client over its bytes wasn't limited")
+	}
+	l.mu.Lock()
+	l.clients["192.0.2.1"].window = time.Now().Add(-time.Minute)
+	l.mu.Unlock()
+	if l.over(cfg, "192.0.2.1") {
+		t.Error("a client was limited for the bytes of the last minute")
+	}
+}
+
+func TestClientConnectionCaps(t *testing.T) {
+	l := newClientLimiter(testConfig(t, "-rate-limit-connections", "1", "-max-connections", "2"))
+	var got []bool
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		got = append(got, l.open(ip))
+	}
+	l.close("192.0.2.1")
+	got = append(got, l.open("192.0.2.3"))
+	if want := []bool{true, false, true, false, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want the connections over the caps refused", got)
+	}
+}
+
+func TestClientsOverTheRateLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	config := testConfig(t, "-rate-limit", "0.01", "-rate-limit-connections", "2")
+	s, client := startServer(t, config, nil)
+	limited, refused := rateLimited.Load(), connectionsRefused.Load()
+
+	var codes []int
+	for range 2 {
+		resp, err := client.Get(upstream.URL + "/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		codes = append(codes, resp.StatusCode)
+	}
+	if want := []int{http.StatusOK, http.StatusTooManyRequests}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("got %v, want the second request limited", codes)
+	}
+	if _, _, resp := openTunnel(t, client, upstream.Listener.Addr().String()); resp.StatusCode !=
+		http.StatusTooManyRequests {
+		t.Errorf("got %v, want the tunnel limited", resp.Status)
+	}
+
+	// The client has a connection kept alive, and is let one more.
+	proxyURL, _ := client.Transport.(*http.Transport).Proxy(nil)
+	var conns []net.Conn
+	for range 2 {
+		c, err := net.DialTimeout("tcp", proxyURL.Host, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	conns[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conns[1].Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v reading the connection over the cap, want it closed", err)
+	}
+	if n, m := rateLimited.Load()-limited, connectionsRefused.Load()-refused; n != 2 || m != 1 {
+		t.Errorf("got %v requests limited and %v connections refused counted, want 2 and 1", n, m)
+	}
+
+	client.CloseIdleConnections()
+	conns[0].Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{{"", ""}, {"rate_limited", "rate-limited"}}
+	got := queryRows(t, db, "select coalesce(error_response, ''), coalesce(tags, '') from requests order by id")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got the requests %v, want %v", got, want)
+	}
+	if got := queryRows(t, db, "select error_response from connects"); !reflect.DeepEqual(got,
+		[][]string{{"rate_limited"}}) {
+		t.Errorf("got the connects %v, want the tunnel limited", got)
+	}
+}
+
+func TestClientsOverTheRateLimitsAreDropped(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	_, client := startServer(t, testConfig(t, "-rate-limit", "0.01", "-rate-limit-action", "drop"), nil)
+	resp, err := client.Get(upstream.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp, err := client.Get(upstream.URL + "/a"); err == nil {
+		resp.Body.Close()
+		t.Errorf("got %v, want the connection dropped", resp.Status)
+	}
+}
@@ -0,0 +1,329 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rawStore keeps the requests and responses as they went over the wire in a
+// directory, each in a read-only file named by its SHA-256, for them to be
+// replayed. Identical messages are stored once.
+type rawStore struct {
+	dir string
+	log *slog.Logger
+}
+
+// newRawStore returns the store of dir, or nil when there's no dir.
+func newRawStore(dir string) (*rawStore, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Temporary files are left behind by a crash.
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".raw-") {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return &rawStore{dir: dir, log: slog.With("component", "raw")}, nil
+}
+
+// store writes b unless it's stored already, and returns its SHA-256.
+func (rs *rawStore) store(b []byte) (string, error) {
+	sum := sha256.Sum256(b)
+	sha := hex.EncodeToString(sum[:])
+	path := filepath.Join(rs.dir, sha)
+	if _, err := os.Stat(path); err == nil {
+		return sha, nil
+	}
+	f, err := os.CreateTemp(rs.dir, ".raw-")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o400)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return sha, nil
+}
+
+// storeExchange stores the request and the response of ex, setting their
+// hashes on it. A message which can't be stored is logged and left out.
+func (rs *rawStore) storeExchange(ex *Exchange) {
+	if rs == nil || ex.state == nil {
+		return
+	}
+	bodies := make(map[string]*capturedBody)
+	ex.state.mu.Lock()
+	for _, c := range ex.state.captured {
+		bodies[c.Location] = c
+	}
+	ex.state.mu.Unlock()
+
+	var err error
+	if ex.RawRequest, err = rs.store(rawRequest(ex, bodies["request"])); err != nil {
+		rs.log.Warn("Cannot store raw request", "request_id", ex.ID, "error", err)
+	}
+	if ex.Response == nil {
+		return
+	}
+	if ex.RawResponse, err = rs.store(rawResponse(ex, bodies["response"])); err != nil {
+		rs.log.Warn("Cannot store raw response", "request_id", ex.ID, "error", err)
+	}
+}
+
+// rawRequest returns the request of ex as the client sent it: its head as
+// read from the connection, and its body as far as it was captured, before it
+// was decoded, chunked again if it was. The head of the HTTP/2 requests is
+// rebuilt, their body framed by a Content-Length.
+func rawRequest(ex *Exchange, body *capturedBody) []byte {
+	req := ex.Request
+	var b bytes.Buffer
+	if head := ex.state.rawHead; head != nil {
+		b.Write(head)
+		rawBody(&b, body, slices.Contains(req.TransferEncoding, "chunked"))
+		return b.Bytes()
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&b, "%v %v %v\r\nHost: %v\r\n", req.Method, req.URL.RequestURI(), pcapProto(req.ProtoMajor, req.ProtoMinor),
+		host)
+	h := req.Header.Clone()
+	h.Del("Transfer-Encoding")
+	h.Del("Content-Length")
+	if body != nil {
+		h.Set("Content-Length", strconv.Itoa(len(body.Raw)))
+	}
+	h.Write(&b)
+	b.WriteString("\r\n")
+	rawBody(&b, body, false)
+	return b.Bytes()
+}
+
+// rawResponse returns the response of ex as it was sent to the client, its
+// head being rebuilt, its headers in no particular order.
+func rawResponse(ex *Exchange, body *capturedBody) []byte {
+	resp := ex.Response
+	var b bytes.Buffer
+	status := resp.Status
+	if status == "" {
+		status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	}
+	fmt.Fprintf(&b, "%v %v\r\n", pcapProto(resp.ProtoMajor, resp.ProtoMinor), status)
+	h := resp.Header.Clone()
+	chunked := slices.Contains(resp.TransferEncoding, "chunked")
+	if chunked {
+		h.Set("Transfer-Encoding", "chunked")
+	}
+	h.Write(&b)
+	b.WriteString("\r\n")
+	rawBody(&b, body, chunked)
+	return b.Bytes()
+}
+
+// rawBody writes the bytes of body as sent, in a single chunk when chunked.
+func rawBody(b *bytes.Buffer, body *capturedBody, chunked bool) {
+	if body == nil {
+		return
+	}
+	if !chunked {
+		b.Write(body.Raw)
+		return
+	}
+	if len(body.Raw) > 0 {
+		fmt.Fprintf(b, "%x\r\n", len(body.Raw))
+		b.Write(body.Raw)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("0\r\n\r\n")
+}
+
+// storedRequest is a request whose raw bytes are stored, as read by replay.
+type storedRequest struct {
+	URL         string
+	RawRequest  string
+	RawResponse string
+}
+
+// findStoredRequest looks for the request of id in the databases of path.
+func findStoredRequest(path, id string) (*storedRequest, error) {
+	paths, err := databaseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		r, err := func() (*storedRequest, error) {
+			db, err := sql.Open("sqlite3", "file:"+p+"?mode=ro")
+			if err != nil {
+				return nil, err
+			}
+			defer db.Close()
+			// The files of older versions have no raw messages.
+			columns, err := tableColumns(db, "requests")
+			if err != nil {
+				return nil, err
+			}
+			if !slices.ContainsFunc(columns, func(c schemaColumn) bool { return c.name == "raw_request" }) {
+				return nil, nil
+			}
+			var r storedRequest
+			err = db.QueryRow(`select coalesce(url, ''), coalesce(raw_request, ''), coalesce(raw_response, '')
+              from requests where request_id = ?`, id).Scan(&r.URL, &r.RawRequest, &r.RawResponse)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, nil
+			}
+			return &r, err
+		}()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", p, err)
+		}
+		if r != nil {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("no request %v", id)
+}
+
+// readRaw reads the raw message of sha from dir, checking its hash.
+func readRaw(dir, sha string) ([]byte, error) {
+	if !sampleName.MatchString(sha) {
+		return nil, fmt.Errorf("invalid hash %q", sha)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, sha))
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != sha {
+		return nil, fmt.Errorf("%v: content doesn't match its hash", sha)
+	}
+	return b, nil
+}
+
+// replayCommand sends a stored request again, byte for byte, to its remote
+// or to another address, and prints the response.
+func replayCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot replay", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	dir := fs.String("raw-dir", cfg.Storage.RawDir, "Directory the raw requests and responses are stored in")
+	to := fs.String("to", "", "Address the request is sent to instead of its remote, as host:port")
+	useTLS := fs.String("tls", "auto", "Whether the request is sent over TLS: auto, for the https requests, true or false")
+	timeout := fs.Duration("timeout", 30*time.Second, "Time the remote may take to answer")
+	show := fs.Bool("show", false, "Print the stored request and response instead of sending the request")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stuffpot replay [-db path] [-raw-dir dir] [-to host:port] [-tls auto|true|false] [-show] request_id")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *dir == "" || *useTLS != "auto" && *useTLS != "true" && *useTLS != "false" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	r, err := findStoredRequest(*path, fs.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	if r.RawRequest == "" {
+		fail(fmt.Errorf("request %v has no raw request stored", fs.Arg(0)))
+	}
+	raw, err := readRaw(*dir, r.RawRequest)
+	if err != nil {
+		fail(err)
+	}
+	if *show {
+		os.Stdout.Write(raw)
+		if r.RawResponse != "" {
+			resp, err := readRaw(*dir, r.RawResponse)
+			if err != nil {
+				fail(err)
+			}
+			fmt.Println()
+			os.Stdout.Write(resp)
+		}
+		return
+	}
+
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		fail(fmt.Errorf("request url: %w", err))
+	}
+	addr := *to
+	if addr == "" {
+		addr = requestAddr(u)
+	}
+	secure := *useTLS == "true" || *useTLS == "auto" && u.Scheme == "https"
+	dialer := &net.Dialer{Timeout: *timeout}
+	var conn net.Conn
+	if secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: true})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		fail(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(*timeout))
+	if _, err := conn.Write(raw); err != nil {
+		fail(err)
+	}
+
+	// The response is printed as read, up to its end, the connection being
+	// kept alive otherwise.
+	method, _, _ := strings.Cut(string(raw), " ")
+	resp, err := http.ReadResponse(bufio.NewReader(io.TeeReader(conn, os.Stdout)), &http.Request{Method: method})
+	if err != nil {
+		fail(err)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		fail(err)
+	}
+}
@@ -0,0 +1,141 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRawStore(t *testing.T) {
+	if rs, err := newRawStore(""); rs != nil || err != nil {
+		t.Errorf("got %v, %v without a directory, want no store", rs, err)
+	}
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, ".raw-123")
+	if err := os.WriteFile(leftover, []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := newRawStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("a temporary file left by a crash was kept")
+	}
+
+	msg := []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	sha, err := rs.store(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := rs.store(msg); again != sha || err != nil {
+		t.Errorf("got %v, %v storing the message again, want %v", again, err, sha)
+	}
+	sum := sha256.Sum256(msg)
+	if sha != hex.EncodeToString(sum[:]) {
+		t.Errorf("got the name %v, want the SHA-256 of the message", sha)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, sha)); err != nil || fi.Mode().Perm() != 0o400 {
+		t.Errorf("got %v, %v for the stored file, want it read-only", fi, err)
+	}
+	if b, err := readRaw(dir, sha); !bytes.Equal(b, msg) || err != nil {
+		t.Errorf("got %q, %v reading the message back", b, err)
+	}
+
+	if _, err := readRaw(dir, "../"+sha); err == nil {
+		t.Error("a path was read as a hash")
+	}
+	other := strings.Repeat("0", 64)
+	if err := os.WriteFile(filepath.Join(dir, other), msg, 0o400); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readRaw(dir, other); err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Errorf("got %v reading a message changed since, want its hash checked", err)
+	}
+}
+
+func TestRawMessagesAreStoredAsSent(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-Up", "1")
+		io.WriteString(w, "pong")
+	}))
+	defer upstream.Close()
+	dir := filepath.Join(t.TempDir(), "raw")
+	config := testConfig(t, "-raw-dir", dir, "-max-body-size", "64KB")
+	s, client := startServer(t, config, nil)
+
+	// The header names keep their case, and the body its encoding.
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	io.WriteString(zw, "user=admin&password=hunter2")
+	zw.Close()
+	sent := fmt.Sprintf("POST %v/login HTTP/1.1\r\nHost: %v\r\nx-lower-Case: v\r\nContent-Encoding: gzip\r\n"+
+		"Content-Length: %d\r\nConnection: close\r\n\r\n%s", upstream.URL, upstream.Listener.Addr(), body.Len(), body.Bytes())
+	proxyURL, _ := client.Transport.(*http.Transport).Proxy(nil)
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, sent)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "POST"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	path := config.Load().Storage.Path
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var id string
+	if err := db.QueryRow("select request_id from requests").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	r, err := findStoredRequest(path, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.URL != upstream.URL+"/login" {
+		t.Errorf("got the URL %v of the stored request", r.URL)
+	}
+	if b, err := readRaw(dir, r.RawRequest); string(b) != sent || err != nil {
+		t.Errorf("got the raw request %q, %v, want %q", b, err, sent)
+	}
+	b, err := readRaw(dir, r.RawResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("HTTP/1.1 200 OK\r\n")) || !bytes.Contains(b, []byte("\r\nX-Up: 1\r\n")) ||
+		!bytes.HasSuffix(b, []byte("\r\n\r\npong")) {
+		t.Errorf("got the raw response %q", b)
+	}
+	if _, err := findStoredRequest(path, "missing"); err == nil {
+		t.Error("an unknown request was found")
+	}
+}
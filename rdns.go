@@ -0,0 +1,105 @@
+package stuffpot
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRDNSLookups bounds the reverse DNS lookups in flight, those of the
+// clients arriving meanwhile being skipped.
+const maxRDNSLookups = 64
+
+// reverseDNS resolves the PTR names of the clients' addresses as their
+// requests arrive, in the background, and caches them for the requests to be
+// logged with. Failures are cached as an empty name, so that a client whose
+// address has no name isn't looked up on each request.
+type reverseDNS struct {
+	config   *ConfigStore
+	resolver *net.Resolver
+	inflight chan struct{}
+
+	mu    sync.Mutex
+	cache map[string]*ptrEntry
+}
+
+type ptrEntry struct {
+	name     string
+	resolved bool
+	expires  time.Time
+}
+
+func newReverseDNS(config *ConfigStore) *reverseDNS {
+	return &reverseDNS{config: config, resolver: net.DefaultResolver, inflight: make(chan struct{}, maxRDNSLookups),
+		cache: make(map[string]*ptrEntry)}
+}
+
+// prefetch starts looking ip up, unless it's cached already or lookups are
+// disabled.
+func (r *reverseDNS) prefetch(ip string) {
+	cfg := r.config.Load().RDNS
+	if !cfg.Enabled || ip == "" {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	if e, ok := r.cache[ip]; ok && (!e.resolved || now.Before(e.expires)) {
+		r.mu.Unlock()
+		return
+	}
+	select {
+	case r.inflight <- struct{}{}:
+	default:
+		r.mu.Unlock()
+		return
+	}
+	if len(r.cache) >= cfg.MaxCache {
+		r.evict(now)
+	}
+	r.cache[ip] = &ptrEntry{}
+	r.mu.Unlock()
+
+	go func() {
+		defer func() { <-r.inflight }()
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		defer cancel()
+		var name string
+		if names, err := r.resolver.LookupAddr(ctx, ip); err == nil && len(names) > 0 {
+			name = strings.TrimSuffix(names[0], ".")
+		}
+		r.mu.Lock()
+		r.cache[ip] = &ptrEntry{name: name, resolved: true, expires: time.Now().Add(cfg.TTL)}
+		r.mu.Unlock()
+	}()
+}
+
+// evict makes room in the cache, dropping the expired names, or any if none
+// has expired. It must be called with mu held.
+func (r *reverseDNS) evict(now time.Time) {
+	for ip, e := range r.cache {
+		if e.resolved && now.After(e.expires) {
+			delete(r.cache, ip)
+		}
+	}
+	for ip, e := range r.cache {
+		if len(r.cache) < r.config.Load().RDNS.MaxCache {
+			break
+		}
+		if e.resolved {
+			delete(r.cache, ip)
+		}
+	}
+}
+
+// name returns the PTR name of ip if it's been resolved, without waiting for
+// a lookup under way.
+func (r *reverseDNS) name(ip string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cache[ip]; ok {
+		return e.name
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ptrServer is a DNS server answering the PTR queries of names, those of slow
+// after a second, and counting them by name.
+type ptrServer struct {
+	names map[string]string
+	slow  map[string]bool
+
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+// serve answers the queries sent to conn until it's closed.
+func (p *ptrServer) serve(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil || len(msg.Questions) != 1 {
+			continue
+		}
+		q := msg.Questions[0]
+		p.mu.Lock()
+		p.queries[q.Name.String()]++
+		p.mu.Unlock()
+		go func() {
+			if p.slow[q.Name.String()] {
+				time.Sleep(time.Second)
+			}
+			resp := dnsmessage.Message{Header: dnsmessage.Header{ID: msg.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+				Questions: msg.Questions}
+			if name, ok := p.names[q.Name.String()]; ok && q.Type == dnsmessage.TypePTR {
+				resp.RCode = dnsmessage.RCodeSuccess
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET,
+						TTL: 60},
+					Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(name)},
+				}}
+			}
+			if b, err := resp.Pack(); err == nil {
+				conn.WriteTo(b, addr)
+			}
+		}()
+	}
+}
+
+func (p *ptrServer) count(name string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queries[name]
+}
+
+// resolver returns a resolver querying p, served on a loopback address until
+// the end of the test.
+func (p *ptrServer) resolver(t *testing.T) *net.Resolver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	p.queries = make(map[string]int)
+	go p.serve(conn)
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+	}}
+}
+
+func TestReverseDNS(t *testing.T) {
+	p := &ptrServer{
+		names: map[string]string{"1.2.0.192.in-addr.arpa.": "client.example."},
+		slow:  map[string]bool{"3.2.0.192.in-addr.arpa.": true},
+	}
+	config := testConfig(t, "-rdns", "-rdns-timeout", "200ms", "-rdns-cache-size", "2")
+	r := newReverseDNS(config)
+	r.resolver = p.resolver(t)
+	resolved := func(ip string) bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		e, ok := r.cache[ip]
+		return ok && e.resolved
+	}
+	lookup := func(ip string) string {
+		t.Helper()
+		r.prefetch(ip)
+		for deadline := time.Now().Add(5 * time.Second); !resolved(ip); {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v wasn't resolved", ip)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return r.name(ip)
+	}
+
+	if got := lookup("192.0.2.1"); got != "client.example" {
+		t.Errorf("got the name %q, want client.example", got)
+	}
+	// Names and failures are cached until they expire.
+	if got := lookup("192.0.2.2"); got != "" {
+		t.Errorf("got the name %q of an address without any", got)
+	}
+	lookup("192.0.2.1")
+	lookup("192.0.2.2")
+	if n, m := p.count("1.2.0.192.in-addr.arpa."), p.count("2.2.0.192.in-addr.arpa."); n != 1 || m != 1 {
+		t.Errorf("got %v and %v queries, want the cached names used", n, m)
+	}
+	r.mu.Lock()
+	r.cache["192.0.2.1"].expires = time.Now()
+	r.mu.Unlock()
+	lookup("192.0.2.1")
+	if n := p.count("1.2.0.192.in-addr.arpa."); n != 2 {
+		t.Errorf("got %v queries, want the expired name looked up again", n)
+	}
+
+	// A lookup taking too long fails, the cache staying within its size.
+	start := time.Now()
+	if got := lookup("192.0.2.3"); got != "" || time.Since(start) > 900*time.Millisecond {
+		t.Errorf("got the name %q after %v, want the lookup to time out", got, time.Since(start))
+	}
+	if n := len(r.cache); n > 2 {
+		t.Errorf("got %v cached names, want at most 2", n)
+	}
+
+	// Nothing is looked up when disabled.
+	r = newReverseDNS(testConfig(t))
+	r.prefetch("192.0.2.1")
+	if len(r.cache) != 0 {
+		t.Error("an address was looked up with -rdns off")
+	}
+}
+
+func TestPTRIsStoredWithRequestsAndTunnels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	config := testConfig(t, "-rdns", "-request-id-echo")
+	s, client := startServer(t, config, nil)
+	adminURL := serveAdmin(t, s)
+	s.rdns.mu.Lock()
+	s.rdns.cache["127.0.0.1"] = &ptrEntry{name: "client.test", resolved: true, expires: time.Now().Add(time.Hour)}
+	s.rdns.mu.Unlock()
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	conn, _, _ := openTunnel(t, client, upstream.Listener.Addr().String())
+	conn.Close()
+
+	var d requestDetail
+	for deadline := time.Now().Add(5 * time.Second); d.PTR == "" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		getJSON(t, adminURL, "/api/requests/"+resp.Header.Get(requestIDHeader), &d)
+	}
+	if d.PTR != "client.test" {
+		t.Errorf("got the name %q in the detail, want client.test", d.PTR)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{{"client.test"}}
+	for _, table := range []string{"requests", "connects"} {
+		if got := queryRows(t, db, "select ptr from "+table); !reflect.DeepEqual(got, want) {
+			t.Errorf("got the names %v in %v, want %v", got, table, want)
+		}
+	}
+}
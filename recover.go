@@ -0,0 +1,96 @@
+package stuffpot
+
+import (
+	"github.com/elazarl/goproxy"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// panics counts the panics recovered since startup.
+var panics atomic.Int64
+
+// recovered logs and counts a recovered panic value, if any, and tells
+// whether there was one. It must be called with the result of recover().
+func recovered(log *slog.Logger, where string, e interface{}) bool {
+	if e == nil {
+		return false
+	}
+	panics.Add(1)
+	log.Error("Recovered from panic", "in", where, "panic", e, "stack", string(debug.Stack()))
+	return true
+}
+
+// contain recovers from a panic in the calling goroutine and logs it. It must
+// be deferred directly: defer contain(log, "what").
+func contain(log *slog.Logger, where string) {
+	recovered(log, where, recover())
+}
+
+// recoverHandler keeps a panic in a proxy handler from taking down the
+// process. The offending connection is closed by aborting the handler.
+func recoverHandler(log *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if e := recover(); e != http.ErrAbortHandler && recovered(log, "handler", e) {
+				panic(http.ErrAbortHandler)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// The safe* wrappers contain panics in the functions registered with goproxy,
+// which also runs them outside of net/http for MITM'd connections.
+
+func safeReq(log *slog.Logger, config *ConfigStore, f func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response)) func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) (r *http.Request, resp *http.Response) {
+		defer func() {
+			if e := recover(); e != nil && recovered(log.With("request_id", requestID(ctx)), "request handler", e) {
+				if state, ok := ctx.UserData.(*requestState); ok && state.exchange != nil {
+					state.exchange.ErrorResponse = "internal"
+				}
+				r = req
+				resp = config.Load().errorResponse("internal", req, requestID(ctx))
+				resp.Close = true
+			}
+		}()
+		return f(req, ctx)
+	}
+}
+
+func safeResp(log *slog.Logger, f func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response) func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	return func(resp *http.Response, ctx *goproxy.ProxyCtx) (r *http.Response) {
+		defer func() {
+			if e := recover(); e != nil && recovered(log.With("request_id", requestID(ctx)), "response handler", e) {
+				r = resp
+			}
+		}()
+		return f(resp, ctx)
+	}
+}
+
+func safeConnect(log *slog.Logger, config *ConfigStore, f func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string)) func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	return func(host string, ctx *goproxy.ProxyCtx) (action *goproxy.ConnectAction, h string) {
+		defer func() {
+			if e := recover(); e != nil && recovered(log.With("request_id", requestID(ctx)), "connect handler", e) {
+				ctx.Resp = config.Load().errorResponse("internal", ctx.Req, requestID(ctx))
+				action, h = goproxy.RejectConnect, host
+			}
+		}()
+		return f(host, ctx)
+	}
+}
+
+func safeHijack(log *slog.Logger, f func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx)) func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	return func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+		defer func() {
+			if e := recover(); e != nil && recovered(log.With("request_id", requestID(ctx)), "hijack handler", e) {
+				client.Close()
+			}
+		}()
+		f(req, client, ctx)
+	}
+}
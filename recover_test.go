@@ -0,0 +1,115 @@
+package stuffpot
+
+import (
+	"bytes"
+	"github.com/elazarl/goproxy"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is a bytes.Buffer safe for the handlers of several
+// connections.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPanickingHandlerIsContained(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	var logs lockedBuffer
+	log := slog.New(slog.NewTextHandler(&logs, nil))
+	config := testConfig(t)
+	before := panics.Load()
+
+	// The handler is wrapped as the server wraps its own, the request getting
+	// its id before the panic.
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(safeReq(log, config, func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.UserData = &requestState{id: "req-" + req.URL.Query().Get("n")}
+		if req.URL.Path == "/panic" {
+			var m map[string]int
+			m["boom"]++
+		}
+		return req, nil
+	}))
+	srv := httptest.NewServer(recoverHandler(log, proxy))
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(upstream.URL + "/panic?n=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("panicking handler: got %v, want 502", resp.Status)
+	}
+	if panics.Load() != before+1 {
+		t.Errorf("counted %d panics, want 1", panics.Load()-before)
+	}
+	if out := logs.String(); !strings.Contains(out, "Recovered from panic") || !strings.Contains(out, "request_id=req-1") ||
+		!strings.Contains(out, "stack=") {
+		t.Errorf("the panic wasn't logged with its request id and stack: %s", out)
+	}
+
+	resp, err = client.Get(upstream.URL + "/next?n=2")
+	if err != nil {
+		t.Fatalf("request after the panic: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("request after the panic: got %v %q, want 200 hello", resp.Status, body)
+	}
+}
+
+func TestRecoverHandlerKeepsServing(t *testing.T) {
+	var logs lockedBuffer
+	log := slog.New(slog.NewTextHandler(&logs, nil))
+	srv := httptest.NewServer(recoverHandler(log, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		io.WriteString(w, "ok")
+	})))
+	defer srv.Close()
+
+	if resp, err := http.Get(srv.URL + "/panic"); err == nil {
+		resp.Body.Close()
+		t.Errorf("the connection of a panicking handler got a response: %v", resp.Status)
+	}
+	if !strings.Contains(logs.String(), "panic=boom") {
+		t.Errorf("the panic wasn't logged: %s", logs.String())
+	}
+	resp, err := http.Get(srv.URL + "/next")
+	if err != nil {
+		t.Fatalf("request after the panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request after the panic: got %v, want 200", resp.Status)
+	}
+}
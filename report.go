@@ -0,0 +1,523 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// reportTop bounds the clients, hosts and tags listed in a report.
+	reportTop = 20
+	// reportNew bounds the new clients listed, all of them are counted.
+	reportNew = 100
+)
+
+// report summarizes the traffic of a day, read from the daily stats tables.
+type report struct {
+	Day        string         `json:"day"`
+	Generated  time.Time      `json:"generated_at"`
+	Totals     reportTotals   `json:"totals"`
+	Alerts     reportAlerts   `json:"alerts"`
+	TopClients []reportClient `json:"top_clients"`
+	TopHosts   []reportCount  `json:"top_hosts"`
+	Tags       []reportCount  `json:"tags"`
+	// NewClients were never seen before the day.
+	NewClients []string       `json:"new_clients"`
+	Latency    *reportLatency `json:"latency"`
+}
+
+type reportTotals struct {
+	Requests   int64 `json:"requests"`
+	Bytes      int64 `json:"bytes"`
+	Errors     int64 `json:"errors"`
+	Clients    int64 `json:"clients"`
+	NewClients int64 `json:"new_clients"`
+	Hosts      int64 `json:"hosts"`
+}
+
+// reportAlerts counts the events the server warns about.
+type reportAlerts struct {
+	Total       int64 `json:"total"`
+	Bruteforce  int64 `json:"bruteforce"`
+	ProxyChecks int64 `json:"proxy_checks"`
+	Honeytokens int64 `json:"honeytoken_recalls"`
+}
+
+type reportClient struct {
+	IP       string   `json:"ip"`
+	Requests int64    `json:"requests"`
+	Bytes    int64    `json:"bytes"`
+	Errors   int64    `json:"errors"`
+	Score    *float64 `json:"score,omitempty"`
+}
+
+type reportCount struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+}
+
+// buildReport reads the report of day from the database at path, or from its
+// file of the day with daily rollover. The earlier day files tell which
+// clients are new.
+func buildReport(path string, day time.Time) (*report, error) {
+	d := day.Format(dayFormat)
+	files, err := dayFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	src := path
+	var earlier []string
+	if f, ok := files[d]; ok {
+		src = f
+		for other, f := range files {
+			if other < d {
+				earlier = append(earlier, f)
+			}
+		}
+	} else if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("no database for %v: %w", d, err)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+src+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	r := &report{Day: d, Generated: time.Now().UTC()}
+	if err := r.read(db); err != nil {
+		return nil, fmt.Errorf("%v: %w", src, err)
+	}
+	for _, f := range earlier {
+		if err := r.dropSeen(f); err != nil {
+			return nil, fmt.Errorf("%v: %w", f, err)
+		}
+	}
+	r.Totals.NewClients = int64(len(r.NewClients))
+	if len(r.NewClients) > reportNew {
+		r.NewClients = r.NewClients[:reportNew]
+	}
+	return r, nil
+}
+
+func (r *report) read(db *sql.DB) error {
+	ok, err := hasTable(db, "daily_client_stats")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("no daily statistics, stuffpot reindex-stats adds them")
+	}
+
+	t := &r.Totals
+	err = db.QueryRow(`select count(*), coalesce(sum(requests), 0), coalesce(sum(bytes), 0), coalesce(sum(errors), 0)
+      from daily_client_stats where day = ?`, r.Day).Scan(&t.Clients, &t.Requests, &t.Bytes, &t.Errors)
+	if err != nil {
+		return err
+	}
+	if err := db.QueryRow("select count(*) from daily_host_stats where day = ?", r.Day).Scan(&t.Hosts); err != nil {
+		return err
+	}
+
+	a := &r.Alerts
+	if err := db.QueryRow("select count(*) from sessions where substr(started_at, 1, 10) = ?", r.Day).Scan(&a.Bruteforce); err != nil {
+		return err
+	}
+	if err := db.QueryRow("select count(*) from proxy_checks where substr(first_seen, 1, 10) = ?", r.Day).Scan(&a.ProxyChecks); err != nil {
+		return err
+	}
+	err = db.QueryRow("select coalesce(sum(requests), 0) from daily_tag_stats where day = ? and tag = 'honeytoken-recall'",
+		r.Day).Scan(&a.Honeytokens)
+	if err != nil {
+		return err
+	}
+	a.Total = a.Bruteforce + a.ProxyChecks + a.Honeytokens
+
+	rows, err := db.Query(`select d.ip, d.requests, d.bytes, d.errors, c.score from daily_client_stats d
+      left join client_stats c on c.ip = d.ip where d.day = ? order by d.requests desc, d.ip limit ?`, r.Day, reportTop)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c reportClient
+		if err := rows.Scan(&c.IP, &c.Requests, &c.Bytes, &c.Errors, &c.Score); err != nil {
+			rows.Close()
+			return err
+		}
+		r.TopClients = append(r.TopClients, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if r.TopHosts, err = readCounts(db, "select host, requests from daily_host_stats where day = ? order by requests desc, host limit ?",
+		r.Day, reportTop); err != nil {
+		return err
+	}
+	if r.Tags, err = readCounts(db, "select tag, requests from daily_tag_stats where day = ? order by requests desc, tag limit ?",
+		r.Day, reportTop); err != nil {
+		return err
+	}
+
+	if r.Latency, err = readLatency(db, r.Day, reportTop); err != nil {
+		return err
+	}
+
+	// The clients first seen on the day, as far as this database knows.
+	rows, err = db.Query(`select d.ip from daily_client_stats d join client_stats c on c.ip = d.ip
+      where d.day = ? and c.first_seen >= ? order by d.requests desc, d.ip`, r.Day, r.Day)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return err
+		}
+		r.NewClients = append(r.NewClients, ip)
+	}
+	return rows.Err()
+}
+
+func readCounts(db *sql.DB, query string, args ...interface{}) ([]reportCount, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []reportCount
+	for rows.Next() {
+		var c reportCount
+		if err := rows.Scan(&c.Name, &c.Requests); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// dropSeen removes the new clients seen in an earlier day file.
+func (r *report) dropSeen(path string) error {
+	if len(r.NewClients) == 0 {
+		return nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if ok, err := hasTable(db, "client_stats"); err != nil || !ok {
+		return err
+	}
+	stmt, err := db.Prepare("select count(*) from client_stats where ip = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	kept := r.NewClients[:0]
+	for _, ip := range r.NewClients {
+		var n int
+		if err := stmt.QueryRow(ip).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			kept = append(kept, ip)
+		}
+	}
+	r.NewClients = kept
+	return nil
+}
+
+// hasTable tells whether db has a table, databases written by older versions
+// may lack the newer ones.
+func hasTable(db *sql.DB, name string) (bool, error) {
+	var n int
+	err := db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = ?", name).Scan(&n)
+	return n > 0, err
+}
+
+// writeText writes the report in plain text.
+func (r *report) writeText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "stuffpot report for %v, generated %v\n\n", r.Day, r.Generated.Format(time.DateTime))
+	t, a := r.Totals, r.Alerts
+	fmt.Fprintf(&b, "Requests  %d\nBytes     %d\nErrors    %d\n", t.Requests, t.Bytes, t.Errors)
+	fmt.Fprintf(&b, "Clients   %d, %d new\nHosts     %d\n", t.Clients, t.NewClients, t.Hosts)
+	fmt.Fprintf(&b, "Alerts    %d: %d brute force, %d proxy checkers, %d honeytoken recalls\n",
+		a.Total, a.Bruteforce, a.ProxyChecks, a.Honeytokens)
+
+	fmt.Fprintf(&b, "\nTop clients\n")
+	for _, c := range r.TopClients {
+		score := "-"
+		if c.Score != nil {
+			score = fmt.Sprintf("%.1f", *c.Score)
+		}
+		fmt.Fprintf(&b, "  %-39s %8d requests %12d bytes %6d errors  score %v\n", c.IP, c.Requests, c.Bytes, c.Errors, score)
+	}
+	for _, s := range []struct {
+		title  string
+		counts []reportCount
+	}{{"Top hosts", r.TopHosts}, {"Tags", r.Tags}} {
+		fmt.Fprintf(&b, "\n%v\n", s.title)
+		for _, c := range s.counts {
+			fmt.Fprintf(&b, "  %-50s %8d requests\n", c.Name, c.Requests)
+		}
+	}
+	if l := r.Latency; l != nil {
+		ms := func(p latencyPercentiles) string {
+			return fmt.Sprintf("p50 %8.2fms  p90 %8.2fms  p99 %8.2fms", p.P50, p.P90, p.P99)
+		}
+		fmt.Fprintf(&b, "\nLatency of %d requests answered by the remote\n", l.Requests)
+		fmt.Fprintf(&b, "  %-50s %v\n  %-50s %v\n", "upstream", ms(l.Upstream), "overhead", ms(l.Overhead))
+		for _, s := range []struct {
+			title  string
+			counts []reportLatencyCount
+		}{{"Upstream latency by host", l.Hosts}, {"Upstream latency by client", l.Clients}} {
+			fmt.Fprintf(&b, "\n%v\n", s.title)
+			for _, c := range s.counts {
+				fmt.Fprintf(&b, "  %-50s %8d requests  %v\n", c.Name, c.Requests, ms(c.Upstream))
+			}
+		}
+		fmt.Fprintf(&b, "\nErrors\n")
+		for _, e := range l.Errors {
+			fmt.Fprintf(&b, "  %-50s %8d requests %6.2f%%\n", e.Error, e.Requests, e.Rate*100)
+		}
+	}
+	fmt.Fprintf(&b, "\nNew clients\n")
+	for _, ip := range r.NewClients {
+		fmt.Fprintf(&b, "  %v\n", ip)
+	}
+	if n := t.NewClients - int64(len(r.NewClients)); n > 0 {
+		fmt.Fprintf(&b, "  and %d more\n", n)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var reportHTML = htmltemplate.Must(htmltemplate.New("report").Funcs(htmltemplate.FuncMap{
+	"percent": func(rate float64) float64 { return rate * 100 },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>stuffpot report for {{.Day}}</title></head>
+<body>
+<h1>stuffpot report for {{.Day}}</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05"}} UTC</p>
+<table>
+<tr><th>Requests</th><td>{{.Totals.Requests}}</td></tr>
+<tr><th>Bytes</th><td>{{.Totals.Bytes}}</td></tr>
+<tr><th>Errors</th><td>{{.Totals.Errors}}</td></tr>
+<tr><th>Clients</th><td>{{.Totals.Clients}}, {{.Totals.NewClients}} new</td></tr>
+<tr><th>Hosts</th><td>{{.Totals.Hosts}}</td></tr>
+<tr><th>Alerts</th><td>{{.Alerts.Total}}: {{.Alerts.Bruteforce}} brute force, {{.Alerts.ProxyChecks}} proxy checkers, {{.Alerts.Honeytokens}} honeytoken recalls</td></tr>
+</table>
+<h2>Top clients</h2>
+<table>
+<tr><th>Client</th><th>Requests</th><th>Bytes</th><th>Errors</th><th>Score</th></tr>
+{{range .TopClients}}<tr><td>{{.IP}}</td><td>{{.Requests}}</td><td>{{.Bytes}}</td><td>{{.Errors}}</td><td>{{with .Score}}{{printf "%.1f" .}}{{end}}</td></tr>
+{{end}}</table>
+<h2>Top hosts</h2>
+<table>
+{{range .TopHosts}}<tr><td>{{.Name}}</td><td>{{.Requests}}</td></tr>
+{{end}}</table>
+<h2>Tags</h2>
+<table>
+{{range .Tags}}<tr><td>{{.Name}}</td><td>{{.Requests}}</td></tr>
+{{end}}</table>
+{{with .Latency}}<h2>Latency</h2>
+<p>Of {{.Requests}} requests answered by the remote, in milliseconds.</p>
+<table>
+<tr><th></th><th>p50</th><th>p90</th><th>p99</th></tr>
+<tr><td>Upstream</td><td>{{.Upstream.P50}}</td><td>{{.Upstream.P90}}</td><td>{{.Upstream.P99}}</td></tr>
+<tr><td>Overhead</td><td>{{.Overhead.P50}}</td><td>{{.Overhead.P90}}</td><td>{{.Overhead.P99}}</td></tr>
+</table>
+<h3>Upstream latency by host</h3>
+<table>
+{{range .Hosts}}<tr><td>{{.Name}}</td><td>{{.Requests}}</td><td>{{.Upstream.P50}}</td><td>{{.Upstream.P90}}</td><td>{{.Upstream.P99}}</td></tr>
+{{end}}</table>
+<h3>Upstream latency by client</h3>
+<table>
+{{range .Clients}}<tr><td>{{.Name}}</td><td>{{.Requests}}</td><td>{{.Upstream.P50}}</td><td>{{.Upstream.P90}}</td><td>{{.Upstream.P99}}</td></tr>
+{{end}}</table>
+<h3>Errors</h3>
+<table>
+{{range .Errors}}<tr><td>{{.Error}}</td><td>{{.Requests}}</td><td>{{printf "%.2f%%" (.Rate | percent)}}</td></tr>
+{{end}}</table>
+{{end}}<h2>New clients</h2>
+<ul>
+{{range .NewClients}}<li>{{.}}</li>
+{{end}}</ul>
+</body></html>
+`))
+
+// write writes the report to dir as report-2024-06-01.json, .txt and .html,
+// and returns the paths written.
+func (r *report) write(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, f := range []struct {
+		ext   string
+		write func(io.Writer) error
+	}{
+		{".json", func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(r)
+		}},
+		{".txt", r.writeText},
+		{".html", func(w io.Writer) error { return reportHTML.Execute(w, r) }},
+	} {
+		path := filepath.Join(dir, "report-"+r.Day+f.ext)
+		if err := writeFile(path, f.write); err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// writeFile replaces path with what write writes, so that it's never seen
+// half written.
+func writeFile(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// reporter writes the report of the previous day every day at the configured
+// time, and sends it to the alert channels of report.notify, until close is
+// called.
+type reporter struct {
+	config *ConfigStore
+	alerts *alerter
+	// path is the database, only read at startup.
+	path string
+	log  *slog.Logger
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newReporter(config *ConfigStore, alerts *alerter) *reporter {
+	return &reporter{
+		config: config,
+		alerts: alerts,
+		path:   config.Load().Storage.Path,
+		log:    slog.With("component", "report"),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (r *reporter) run() {
+	defer close(r.done)
+	defer contain(r.log, "daily report")
+	for {
+		now := time.Now().UTC()
+		midnight := now.Truncate(24 * time.Hour)
+		next := midnight.Add(r.config.Load().reportAt)
+		if !next.After(now) {
+			midnight = midnight.AddDate(0, 0, 1)
+			next = midnight.Add(r.config.Load().reportAt)
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(next.Sub(now)):
+		}
+		if cfg := r.config.Load(); cfg.Report.Dir != "" || len(cfg.Report.Notify) > 0 {
+			r.generate(cfg.Report.Dir, cfg.Report.Notify, midnight.AddDate(0, 0, -1))
+		}
+	}
+}
+
+// generate writes the report of day to dir, unless it's empty, and sends it to
+// the notify channels.
+func (r *reporter) generate(dir string, notify []string, day time.Time) {
+	rep, err := buildReport(r.path, day)
+	if err != nil {
+		r.log.Warn("Cannot build the daily report", "day", day.Format(dayFormat), "error", err)
+		return
+	}
+	if dir != "" {
+		paths, err := rep.write(dir)
+		if err != nil {
+			r.log.Warn("Cannot write the daily report", "day", rep.Day, "error", err)
+		} else {
+			r.log.Info("Daily report written", "day", rep.Day, "paths", paths, "requests", rep.Totals.Requests,
+				"alerts", rep.Alerts.Total)
+		}
+	}
+	if len(notify) > 0 {
+		r.alerts.sendReport(rep, notify)
+	}
+}
+
+func (r *reporter) close() {
+	close(r.stop)
+	<-r.done
+}
+
+// reportCommand implements the report subcommand:
+//
+//	stuffpot report [-db path] [-dir dir] [-date day]
+//
+// It writes the report of a day, the previous one by default, to the reports
+// directory, or prints it as text when there's none.
+func reportCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot report", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	dir := fs.String("dir", cfg.Report.Dir, "Directory the report is written to, printed as text when empty")
+	date := fs.String("date", time.Now().UTC().AddDate(0, 0, -1).Format(dayFormat), "Day reported, as 2006-01-02")
+	fs.Parse(args)
+
+	day, err := time.Parse(dayFormat, *date)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -date: %v\n", err)
+		os.Exit(2)
+	}
+	rep, err := buildReport(*path, day)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *dir == "" {
+		err = rep.writeText(os.Stdout)
+	} else {
+		var paths []string
+		paths, err = rep.write(*dir)
+		for _, p := range paths {
+			fmt.Println(p)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,140 @@
+package stuffpot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/elazarl/goproxy"
+	"time"
+)
+
+// requestIDHeader is echoed to clients when request_id.echo is set.
+const requestIDHeader = "X-Stuffpot-Request-Id"
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newID returns a ULID: 48 bits of milliseconds followed by 80 random bits, in
+// 26 characters of Crockford's base32, so ids sort by creation time.
+func newID() string {
+	return newIDAt(time.Now())
+}
+
+// newIDAt returns a ULID created at t, for imported records.
+func newIDAt(t time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(t.UnixMilli())<<16)
+	rand.Read(b[6:])
+
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var id [26]byte
+	for i := 25; i >= 0; i-- {
+		id[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id[:])
+}
+
+// tunnelState is kept in ProxyCtx.UserData of a CONNECT. goproxy hands it to
+// the requests read from a MITM'd tunnel, which record it as their parent.
+type tunnelState struct {
+	id string
+	// conn is the client's connection, whose requests are recorded.
+	conn *clientConn
+	// rule is the CONNECT rule the tunnel is handled by.
+	rule *ConnectRule
+	// errorResponse is the class of the error response the CONNECT was
+	// answered with, if any, sandbox when the sandbox kept the tunnel from
+	// its remote.
+	errorResponse string
+	// dialTime is the time taken to connect to the remote, successfully or
+	// not, zero when it wasn't dialed, and dialError the errorType of the
+	// failure.
+	dialTime  time.Duration
+	dialError string
+	// start is when the CONNECT was received.
+	start time.Time
+	// origin is where the client is from, if located, and ptr the PTR name
+	// of its address, if resolved by the time the tunnel is logged.
+	origin geoInfo
+	ptr    string
+	// mode is how the tunnel was handled: mitm, tunnel, hijack-parse or
+	// reject, refused CONNECTs being rejected whatever their rule.
+	mode string
+	// read and written are the traffic of conn when the CONNECT was
+	// received.
+	read, written int64
+	// end is when the tunnel was closed, up and down the bytes the client
+	// sent and received over it, and protocol what it spoke when known
+	// without guessing, all set by close.
+	end      time.Time
+	up, down int64
+	protocol string
+}
+
+// close records the end of the tunnel, its traffic being counted on conn, or
+// by tc for tunnels without one.
+func (s *tunnelState) close(tc *TunnelCapture) {
+	s.end = time.Now()
+	if s.conn != nil {
+		read, written := s.conn.traffic()
+		s.up, s.down = read-s.read, written-s.written
+	} else {
+		tc.mu.Lock()
+		s.up, s.down = tc.relayed[dirUp], tc.relayed[dirDown]
+		tc.mu.Unlock()
+	}
+	switch {
+	case s.mode == "hijack-parse":
+		s.protocol = "http"
+	case s.mode == "mitm" && s.conn != nil:
+		s.protocol = s.conn.tunnelProtocol()
+	}
+}
+
+// tunnelProtocol returns the protocol spoken over the tunnel of ctx, guessed
+// from what tc captured unless it's known, and whether it was guessed.
+func tunnelProtocol(tc *TunnelCapture, ctx *goproxy.ProxyCtx) (string, bool) {
+	if s, ok := ctx.UserData.(*tunnelState); ok && s.protocol != "" {
+		return s.protocol, false
+	}
+	return guessProtocol(tc.head(dirUp, 64), tc.head(dirDown, 64)), true
+}
+
+// protocolTag is the tag of the tunnels whose protocol was guessed to be
+// protocol.
+func protocolTag(protocol string) string {
+	return "protocol-" + protocol
+}
+
+// tunnelMode returns how the tunnel of ctx was handled.
+func tunnelMode(ctx *goproxy.ProxyCtx) string {
+	if s, ok := ctx.UserData.(*tunnelState); ok {
+		return s.mode
+	}
+	return ""
+}
+
+type requestIDKey struct{}
+
+// withRequestID returns ctx carrying the id of a request or tunnel.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// contextRequestID returns the id carried by ctx, if any.
+func contextRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestID returns the id of the request or tunnel handled with ctx.
+func requestID(ctx *goproxy.ProxyCtx) string {
+	switch s := ctx.UserData.(type) {
+	case *requestState:
+		return s.id
+	case *tunnelState:
+		return s.id
+	}
+	return ""
+}
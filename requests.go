@@ -0,0 +1,537 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPageSize and maxPageSize are the number of requests listed by
+	// /api/requests without a limit, and at most.
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// requestSorts are the columns requests can be listed by, all indexed. The
+// id breaks the ties.
+var requestSorts = map[string]string{
+	"id":         "id",
+	"created_at": "created_at",
+	"client":     "from_ip",
+	"host":       "host",
+}
+
+// requestQuery is a page of requests to list.
+type requestQuery struct {
+	Client string
+	Host   string
+	Method string
+	Tag    string
+	JA3    string
+	// Session is the id of the client session of the requests.
+	Session string
+	// Cookie is the value of a cookie sent or set in the requests.
+	Cookie string
+	Since  string
+	Until  string
+	// Sort is a key of requestSorts, Desc telling the order.
+	Sort  string
+	Desc  bool
+	Limit int
+	// Count is "", exact or estimate.
+	Count  string
+	cursor *requestCursor
+}
+
+// requestCursor is the position after the last request of a page, given to
+// the client as an opaque token.
+type requestCursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	ID    int64       `json:"i"`
+}
+
+func (c *requestCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseRequestQuery reads the parameters of /api/requests.
+func parseRequestQuery(values url.Values) (*requestQuery, error) {
+	q := &requestQuery{Client: values.Get("client"), Host: values.Get("host"), Tag: values.Get("tag"),
+		JA3: strings.ToLower(values.Get("ja3")), Method: strings.ToUpper(values.Get("method")), Sort: "created_at", Desc: true, Limit: defaultPageSize,
+		Cookie: values.Get("cookie"), Session: values.Get("session"), Count: values.Get("count")}
+
+	for name, bound := range map[string]*string{"since": &q.Since, "until": &q.Until} {
+		v := values.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, v); err != nil {
+				return nil, fmt.Errorf("%v: expected a RFC 3339 time or a day", name)
+			}
+		}
+		*bound = t.UTC().Format(time.DateTime)
+	}
+	if v := values.Get("sort"); v != "" {
+		q.Sort, q.Desc = strings.TrimPrefix(v, "-"), strings.HasPrefix(v, "-")
+		if _, ok := requestSorts[q.Sort]; !ok {
+			return nil, fmt.Errorf("sort: unknown column %q", q.Sort)
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("limit: expected a positive number")
+		}
+		q.Limit = min(n, maxPageSize)
+	}
+	switch q.Count {
+	case "", "exact", "estimate":
+	default:
+		return nil, fmt.Errorf("count: expected exact or estimate")
+	}
+	if v := values.Get("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		var c requestCursor
+		if err == nil {
+			err = json.Unmarshal(b, &c)
+		}
+		if err != nil || c.Sort != q.Sort {
+			return nil, errors.New("cursor: invalid, or from another sort")
+		}
+		q.cursor = &c
+	}
+	return q, nil
+}
+
+// listedRequest is a request as listed by /api/requests.
+type listedRequest struct {
+	ID          int64    `json:"id"`
+	RequestID   string   `json:"request_id"`
+	ParentID    string   `json:"parent_id,omitempty"`
+	Client      string   `json:"client"`
+	Method      string   `json:"method"`
+	Host        string   `json:"host"`
+	URL         string   `json:"url"`
+	Status      int      `json:"status"`
+	Size        int64    `json:"size"`
+	Tags        []string `json:"tags"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	JA3         string   `json:"ja3,omitempty"`
+	SessionID   string   `json:"session_id,omitempty"`
+	// Occurrences counts the identical requests deduplicated on this one,
+	// last seen at LastSeen.
+	Occurrences int64  `json:"occurrences"`
+	LastSeen    string `json:"last_seen"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// requestPage is a page of requests. NextCursor is empty on the last page.
+type requestPage struct {
+	Requests   []listedRequest `json:"requests"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+	Count      *int64          `json:"count,omitempty"`
+}
+
+// where returns the conditions of the filters of q.
+func (q *requestQuery) where() ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if q.Client != "" {
+		conds, args = append(conds, "from_ip = ?"), append(args, q.Client)
+	}
+	if q.Host != "" {
+		conds, args = append(conds, "host = ?"), append(args, q.Host)
+	}
+	if q.Method != "" {
+		conds, args = append(conds, "method = ?"), append(args, q.Method)
+	}
+	if q.Tag != "" {
+		conds, args = append(conds, "instr(',' || tags || ',', ?) > 0"), append(args, ","+q.Tag+",")
+	}
+	if q.JA3 != "" {
+		conds, args = append(conds, "ja3 = ?"), append(args, q.JA3)
+	}
+	if q.Session != "" {
+		conds, args = append(conds, "session_id = ?"), append(args, q.Session)
+	}
+	if q.Cookie != "" {
+		conds, args = append(conds, "request_id in (select request_id from cookies where value = ?)"), append(args, q.Cookie)
+	}
+	if q.Since != "" {
+		conds, args = append(conds, "created_at >= ?"), append(args, q.Since)
+	}
+	if q.Until != "" {
+		conds, args = append(conds, "created_at < ?"), append(args, q.Until)
+	}
+	return conds, args
+}
+
+// listRequests returns a page of the requests. Pages are read after the
+// cursor, rather than at an offset, so that requests inserted meanwhile
+// don't shift them.
+func (logger *HttpLogger) listRequests(ctx context.Context, q *requestQuery) (*requestPage, error) {
+	col := requestSorts[q.Sort]
+	conds, args := q.where()
+	page := &requestPage{Requests: []listedRequest{}}
+
+	switch q.Count {
+	case "exact":
+		query := "select count(*) from requests"
+		if len(conds) > 0 {
+			query += " where " + strings.Join(conds, " and ")
+		}
+		var n int64
+		if err := logger.db.QueryRowContext(ctx, query, args...).Scan(&n); err != nil {
+			return nil, fmt.Errorf("count requests: %w", err)
+		}
+		page.Count = &n
+	case "estimate":
+		n, err := logger.estimateRequests(ctx, q)
+		if err != nil {
+			return nil, fmt.Errorf("estimate requests: %w", err)
+		}
+		page.Count = &n
+	}
+
+	order, after := "asc", ">"
+	if q.Desc {
+		order, after = "desc", "<"
+	}
+	if c := q.cursor; c != nil {
+		if col == "id" {
+			conds, args = append(conds, "id "+after+" ?"), append(args, c.ID)
+		} else {
+			conds, args = append(conds, fmt.Sprintf("(%v, id) %v (?, ?)", col, after)), append(args, c.Value, c.ID)
+		}
+	}
+	query := `select id, coalesce(request_id, ''), coalesce(parent_id, ''), coalesce(from_ip, ''), coalesce(method, ''),
+      coalesce(host, ''), coalesce(url, ''), coalesce(status, 0), coalesce(size, 0), coalesce(tags, ''),
+      coalesce(fingerprint, ''), coalesce(ja3, ''), coalesce(session_id, ''), coalesce(occurrences, 1),
+      coalesce(last_seen, created_at, ''), coalesce(created_at, '') from requests`
+	if len(conds) > 0 {
+		query += " where " + strings.Join(conds, " and ")
+	}
+	if col == "id" {
+		query += fmt.Sprintf(" order by id %v limit ?", order)
+	} else {
+		query += fmt.Sprintf(" order by %v %v, id %v limit ?", col, order, order)
+	}
+	// One more request tells whether there's a next page.
+	rows, err := logger.db.QueryContext(ctx, query, append(args, q.Limit+1)...)
+	if err != nil {
+		return nil, fmt.Errorf("list requests: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r listedRequest
+		var tags string
+		if err := rows.Scan(&r.ID, &r.RequestID, &r.ParentID, &r.Client, &r.Method, &r.Host, &r.URL,
+			&r.Status, &r.Size, &tags, &r.Fingerprint, &r.JA3, &r.SessionID, &r.Occurrences, &r.LastSeen,
+			&r.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.Tags = []string{}
+		if tags != "" {
+			r.Tags = strings.Split(tags, ",")
+		}
+		page.Requests = append(page.Requests, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Requests) > q.Limit {
+		page.Requests = page.Requests[:q.Limit]
+		last := page.Requests[q.Limit-1]
+		c := &requestCursor{Sort: q.Sort, ID: last.ID}
+		switch col {
+		case "created_at":
+			c.Value = last.CreatedAt
+		case "from_ip":
+			c.Value = last.Client
+		case "host":
+			c.Value = last.Host
+		}
+		page.NextCursor = c.String()
+	}
+	return page, nil
+}
+
+// estimateRequests reads the number of requests matching q from the stats,
+// rather than counting them. It's the smallest of the totals of the client,
+// host and tag of q, or the total of all the clients without them, and
+// ignores the method, JA3, session, cookie, since and until.
+func (logger *HttpLogger) estimateRequests(ctx context.Context, q *requestQuery) (int64, error) {
+	type stat struct {
+		query string
+		arg   string
+	}
+	var stats []stat
+	if q.Client != "" {
+		stats = append(stats, stat{"select requests from client_stats where ip = ?", q.Client})
+	}
+	if q.Host != "" {
+		stats = append(stats, stat{"select requests from host_stats where host = ?", q.Host})
+	}
+	if q.Tag != "" {
+		stats = append(stats, stat{"select sum(requests) from daily_tag_stats where tag = ?", q.Tag})
+	}
+	if len(stats) == 0 {
+		var n sql.NullInt64
+		err := logger.db.QueryRowContext(ctx, "select sum(requests) from client_stats").Scan(&n)
+		return n.Int64, err
+	}
+	var est int64 = -1
+	for _, s := range stats {
+		var n sql.NullInt64
+		err := logger.db.QueryRowContext(ctx, s.query, s.arg).Scan(&n)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+		if est < 0 || n.Int64 < est {
+			est = n.Int64
+		}
+	}
+	return est, nil
+}
+
+// requestDetail is a request as given by /api/requests/<id>, with its
+// headers, response, matches and stored bodies.
+type requestDetail struct {
+	listedRequest
+	Headers        string          `json:"headers"`
+	HeaderOrder    string          `json:"header_order,omitempty"`
+	RequestSize    int64           `json:"request_size"`
+	UpstreamUs     *int64          `json:"upstream_us,omitempty"`
+	ErrorType      string          `json:"error_type,omitempty"`
+	ErrorResponse  string          `json:"error_response,omitempty"`
+	ParseAnomalies json.RawMessage `json:"parse_anomalies,omitempty"`
+	Response       *detailResponse `json:"response,omitempty"`
+	Matches        []detailMatch   `json:"matches"`
+	Bodies         []detailBody    `json:"bodies"`
+	// Country, City and ASN are where the client was from when logged.
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	ASN     int64  `json:"asn,omitempty"`
+	// PTR is the name of the client's address, if it was resolved.
+	PTR string `json:"ptr,omitempty"`
+	// JA3S is the JA3S hash of the remote's ServerHello, for the requests
+	// sent to it over TLS.
+	JA3S string `json:"ja3s,omitempty"`
+	// RawRequest and RawResponse are the SHA-256 of the request and the
+	// response as sent, in the raw directory.
+	RawRequest  string `json:"raw_request,omitempty"`
+	RawResponse string `json:"raw_response,omitempty"`
+	// Websocket are the messages of the WebSocket the request opened.
+	Websocket []detailWebsocket `json:"websocket,omitempty"`
+	// Credentials are those the request carries, and Cookies those it sent,
+	// up, and those its response set, down.
+	Credentials []detailCredential `json:"credentials,omitempty"`
+	Cookies     []detailCookie     `json:"cookies,omitempty"`
+}
+
+type detailResponse struct {
+	Status    int    `json:"status"`
+	Proto     string `json:"proto"`
+	Headers   string `json:"headers"`
+	LatencyUs *int64 `json:"latency_us,omitempty"`
+	Size      int64  `json:"size"`
+}
+
+type detailMatch struct {
+	Tag      string `json:"tag"`
+	Location string `json:"location,omitempty"`
+	Offset   int64  `json:"offset"`
+	Match    string `json:"match,omitempty"`
+}
+
+// detailBody is a stored body, Data being base64 in JSON.
+type detailBody struct {
+	Location        string `json:"location"`
+	ContentType     string `json:"content_type,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	Size            int64  `json:"size"`
+	Truncated       bool   `json:"truncated"`
+	Data            []byte `json:"data"`
+}
+
+// detailWebsocket is a WebSocket message, Payload being base64 in JSON.
+type detailWebsocket struct {
+	Direction  string `json:"direction"`
+	Opcode     int    `json:"opcode"`
+	Compressed bool   `json:"compressed,omitempty"`
+	Size       int64  `json:"size"`
+	Truncated  bool   `json:"truncated"`
+	Payload    []byte `json:"payload"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type detailCredential struct {
+	Source   string `json:"source"`
+	Scheme   string `json:"scheme"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+	Realm    string `json:"realm,omitempty"`
+}
+
+type detailCookie struct {
+	Direction string `json:"direction"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	Domain    string `json:"domain,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Expires   string `json:"expires,omitempty"`
+	Secure    bool   `json:"secure,omitempty"`
+	HttpOnly  bool   `json:"http_only,omitempty"`
+}
+
+// getRequest returns the request of the given request id, or nil when there's
+// none. Deduplicated requests are given with the details of the first one.
+func (logger *HttpLogger) getRequest(ctx context.Context, requestID string) (*requestDetail, error) {
+	var d requestDetail
+	var tags, anomalies string
+	var upstream sql.NullInt64
+	err := logger.db.QueryRowContext(ctx, `select id, coalesce(request_id, ''), coalesce(parent_id, ''),
+      coalesce(from_ip, ''), coalesce(method, ''), coalesce(host, ''), coalesce(url, ''), coalesce(status, 0),
+      coalesce(size, 0), coalesce(tags, ''), coalesce(fingerprint, ''), coalesce(ja3, ''), coalesce(session_id, ''),
+      coalesce(occurrences, 1), coalesce(last_seen, created_at, ''), coalesce(created_at, ''), coalesce(headers, ''), coalesce(header_order, ''),
+      coalesce(request_size, 0), upstream_us, coalesce(error_type, ''), coalesce(error_response, ''),
+      coalesce(parse_anomalies, ''), coalesce(country, ''), coalesce(city, ''), coalesce(asn, 0), coalesce(ptr, ''),
+      coalesce(raw_request, ''), coalesce(raw_response, ''), coalesce(ja3s, '') from requests where request_id = ?`, requestID).Scan(&d.ID, &d.RequestID, &d.ParentID, &d.Client, &d.Method,
+		&d.Host, &d.URL, &d.Status, &d.Size, &tags, &d.Fingerprint, &d.JA3, &d.SessionID, &d.Occurrences, &d.LastSeen,
+		&d.CreatedAt, &d.Headers, &d.HeaderOrder, &d.RequestSize, &upstream, &d.ErrorType, &d.ErrorResponse, &anomalies, &d.Country,
+		&d.City, &d.ASN, &d.PTR, &d.RawRequest, &d.RawResponse, &d.JA3S)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get request: %w", err)
+	}
+	d.Tags = []string{}
+	if tags != "" {
+		d.Tags = strings.Split(tags, ",")
+	}
+	if upstream.Valid {
+		d.UpstreamUs = &upstream.Int64
+	}
+	if anomalies != "" {
+		d.ParseAnomalies = json.RawMessage(anomalies)
+	}
+
+	var resp detailResponse
+	var latency sql.NullInt64
+	err = logger.db.QueryRowContext(ctx, `select coalesce(status, 0), coalesce(proto, ''), coalesce(headers, ''),
+      latency_us, coalesce(size, 0) from responses where request_id = ?`, requestID).Scan(&resp.Status, &resp.Proto,
+		&resp.Headers, &latency, &resp.Size)
+	switch {
+	case err == nil:
+		if latency.Valid {
+			resp.LatencyUs = &latency.Int64
+		}
+		d.Response = &resp
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, fmt.Errorf("get response: %w", err)
+	}
+
+	d.Matches = []detailMatch{}
+	rows, err := logger.db.QueryContext(ctx, `select coalesce(tag, ''), coalesce(location, ''), coalesce(offset, 0),
+      coalesce(match, '') from request_tags where request_id = ? order by id`, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("get matches: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m detailMatch
+		if err := rows.Scan(&m.Tag, &m.Location, &m.Offset, &m.Match); err != nil {
+			return nil, err
+		}
+		d.Matches = append(d.Matches, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	d.Bodies = []detailBody{}
+	rows, err = logger.db.QueryContext(ctx, `select coalesce(location, ''), coalesce(content_type, ''),
+      coalesce(content_encoding, ''), coalesce(size, 0), coalesce(truncated, 0), data
+      from bodies where request_id = ? order by id`, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("get bodies: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b detailBody
+		if err := rows.Scan(&b.Location, &b.ContentType, &b.ContentEncoding, &b.Size, &b.Truncated, &b.Data); err != nil {
+			return nil, err
+		}
+		d.Bodies = append(d.Bodies, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = logger.db.QueryContext(ctx, `select coalesce(direction, ''), coalesce(opcode, 0), coalesce(compressed, 0),
+      coalesce(size, 0), coalesce(truncated, 0), payload, coalesce(created_at, '')
+      from websocket_messages where request_id = ? order by id`, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("get websocket messages: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m detailWebsocket
+		if err := rows.Scan(&m.Direction, &m.Opcode, &m.Compressed, &m.Size, &m.Truncated, &m.Payload, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.Websocket = append(d.Websocket, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = logger.db.QueryContext(ctx, `select coalesce(source, ''), coalesce(scheme, ''), coalesce(username, ''),
+      coalesce(password, ''), coalesce(hash, ''), coalesce(realm, '') from credentials where request_id = ? order by id`,
+		requestID)
+	if err != nil {
+		return nil, fmt.Errorf("get credentials: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c detailCredential
+		if err := rows.Scan(&c.Source, &c.Scheme, &c.Username, &c.Password, &c.Hash, &c.Realm); err != nil {
+			return nil, err
+		}
+		d.Credentials = append(d.Credentials, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = logger.db.QueryContext(ctx, `select coalesce(direction, ''), coalesce(name, ''), coalesce(value, ''),
+      coalesce(domain, ''), coalesce(path, ''), coalesce(expires, ''), coalesce(secure, 0), coalesce(http_only, 0)
+      from cookies where request_id = ? order by id`, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("get cookies: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c detailCookie
+		if err := rows.Scan(&c.Direction, &c.Name, &c.Value, &c.Domain, &c.Path, &c.Expires, &c.Secure, &c.HttpOnly); err != nil {
+			return nil, err
+		}
+		d.Cookies = append(d.Cookies, c)
+	}
+	return &d, rows.Err()
+}
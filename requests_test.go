@@ -0,0 +1,225 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListRequestsPagesDuringInserts(t *testing.T) {
+	logger := testLogger(t)
+	insert := func(i int, createdAt string) error {
+		_, err := logger.db.Exec(`insert into requests (request_id, from_ip, method, host, url, created_at)
+          values (?,?,?,?,?,?)`, fmt.Sprintf("r%d", i), fmt.Sprintf("192.0.2.%d", i%7), "GET", fmt.Sprintf("h%d.example", i%5),
+			fmt.Sprintf("http://h%d.example/%d", i%5, i), createdAt)
+		return err
+	}
+	// Several requests share a second, the id breaking the ties.
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := insert(i, fmt.Sprintf("2024-06-01 12:%02d:%02d", i/60/3, i/3%60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next := n
+	for _, sort := range []string{"id", "-id", "created_at", "-created_at", "client", "-client", "host", "-host"} {
+		t.Run(sort, func(t *testing.T) {
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for end := next + 100; next < end; next++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					// Inserted in the middle of the sort of every column.
+					if err := insert(next, "2024-06-01 12:00:30"); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			defer func() {
+				close(stop)
+				wg.Wait()
+			}()
+
+			seen := make(map[int64]bool)
+			values := url.Values{"sort": {sort}, "limit": {"7"}}
+			for pages := 0; ; pages++ {
+				q, err := parseRequestQuery(values)
+				if err != nil {
+					t.Fatal(err)
+				}
+				page, err := logger.listRequests(context.Background(), q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range page.Requests {
+					if seen[r.ID] {
+						t.Fatalf("request %d listed twice", r.ID)
+					}
+					seen[r.ID] = true
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				if pages > 1000 {
+					t.Fatal("the pages don't end")
+				}
+				values.Set("cursor", page.NextCursor)
+			}
+
+			for id := int64(1); id <= n; id++ {
+				if !seen[id] {
+					t.Errorf("request %d was skipped", id)
+				}
+			}
+		})
+	}
+}
+
+func TestListRequestsOrder(t *testing.T) {
+	logger := testLogger(t)
+	for i, host := range []string{"b.example", "a.example", "c.example", "a.example", "b.example"} {
+		_, err := logger.db.Exec("insert into requests (request_id, from_ip, host, created_at) values (?,?,?,?)",
+			fmt.Sprintf("r%d", i), "192.0.2.1", host, "2024-06-01 12:00:00")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := map[string]string{
+		"host":  "2 4 1 5 3",
+		"-host": "3 5 1 4 2",
+		"id":    "1 2 3 4 5",
+		"-id":   "5 4 3 2 1",
+	}
+	for sort, want := range tests {
+		values := url.Values{"sort": {sort}, "limit": {"2"}}
+		var ids []string
+		for {
+			q, err := parseRequestQuery(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err := logger.listRequests(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range page.Requests {
+				ids = append(ids, fmt.Sprint(r.ID))
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			values.Set("cursor", page.NextCursor)
+		}
+		if got := strings.Join(ids, " "); got != want {
+			t.Errorf("sort %v: got %v, want %v", sort, got, want)
+		}
+	}
+}
+
+func TestParseRequestQueryRejectsInvalidSorts(t *testing.T) {
+	for _, sort := range []string{"nope", "url", "id; drop table requests", "-", "--id", "created_at desc"} {
+		if _, err := parseRequestQuery(url.Values{"sort": {sort}}); err == nil || !strings.HasPrefix(err.Error(), "sort: ") {
+			t.Errorf("sort %q: got %v, want it rejected", sort, err)
+		}
+	}
+
+	// A cursor is only valid for the sort it was made for.
+	cursor := (&requestCursor{Sort: "host", Value: "a.example", ID: 3}).String()
+	if _, err := parseRequestQuery(url.Values{"sort": {"host"}, "cursor": {cursor}}); err != nil {
+		t.Errorf("cursor of the same sort: %v", err)
+	}
+	for _, values := range []url.Values{
+		{"sort": {"client"}, "cursor": {cursor}},
+		{"cursor": {cursor}},
+		{"cursor": {"not base64!"}},
+		{"cursor": {"bm90IGpzb24"}},
+	} {
+		if _, err := parseRequestQuery(values); err == nil || !strings.HasPrefix(err.Error(), "cursor: ") {
+			t.Errorf("%v: got %v, want the cursor rejected", values, err)
+		}
+	}
+}
+
+// getJSON decodes the response of the admin API to a GET of path into v, and
+// returns its status.
+func getJSON(t *testing.T, adminURL, path string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(adminURL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("%v: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestGetRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "1")
+		io.WriteString(w, "welcome")
+	}))
+	defer upstream.Close()
+	s, client := startServer(t, testConfig(t, "-max-body-size", "1KB"), nil)
+	adminURL := serveAdmin(t, s)
+	for _, method := range []string{"GET", "POST"} {
+		req, err := http.NewRequest(method, upstream.URL+"/login", strings.NewReader("user=admin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// The requests are listed once the logging queue wrote them.
+	var page requestPage
+	for deadline := time.Now().Add(5 * time.Second); len(page.Requests) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		getJSON(t, adminURL, "/api/requests", &page)
+	}
+	getJSON(t, adminURL, "/api/requests?method=post", &page)
+	if len(page.Requests) != 1 || page.Requests[0].Method != "POST" {
+		t.Fatalf("got %+v, want the POST only", page.Requests)
+	}
+
+	var d requestDetail
+	if status := getJSON(t, adminURL, "/api/requests/"+page.Requests[0].RequestID, &d); status != http.StatusOK {
+		t.Fatalf("got %v", status)
+	}
+	wantBodies := []detailBody{
+		{Location: "request", ContentType: "application/x-www-form-urlencoded", Size: 10, Data: []byte("user=admin")},
+		{Location: "response", ContentType: "text/plain", Size: 7, Data: []byte("welcome")},
+	}
+	if d.Method != "POST" || !strings.Contains(d.Headers, "content-type: application/x-www-form-urlencoded") ||
+		d.RequestSize != 10 || d.Response == nil || d.Response.Status != 200 ||
+		!strings.Contains(d.Response.Headers, "x-upstream: 1") || !reflect.DeepEqual(d.Bodies, wantBodies) {
+		t.Errorf("got %+v, response %+v", d, d.Response)
+	}
+	var e map[string]string
+	if status := getJSON(t, adminURL, "/api/requests/unknown", &e); status != http.StatusNotFound {
+		t.Errorf("an unknown request: got %v %v", status, e)
+	}
+}
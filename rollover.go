@@ -0,0 +1,587 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dayFormat = "2006-01-02"
+
+// rolloverGrace is how long the previous day's file stays open for the events
+// which started before midnight.
+const rolloverGrace = time.Minute
+
+// maxDays is the number of day files which can be attached at once, SQLite's
+// default limit.
+const maxDays = 10
+
+// tables are queried across day files by openDays.
+var tables = []string{"requests", "request_tags", "responses", "bodies", "sessions", "client_stats", "proxy_checks", "honeytokens", "fingerprints", "samples", "connects", "tunnel_capture", "smtp_attempts", "host_traffic", "tls_failures", "connect_targets", "websocket_messages", "credentials", "cookies", "client_sessions"}
+
+// errNoDayFile is returned for the days without a file.
+var errNoDayFile = errors.New("no database file")
+
+// dayPath returns the file of day for the database path: log.db gives
+// log-2024-06-01.db.
+func dayPath(path string, day time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + day.Format(dayFormat) + ext
+}
+
+// dayFiles returns the existing day files of path by day.
+func dayFiles(path string) (map[string]string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	matches, err := filepath.Glob(base + "-????-??-??" + ext)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, m := range matches {
+		day := strings.TrimSuffix(strings.TrimPrefix(m, base+"-"), ext)
+		if _, err := time.Parse(dayFormat, day); err == nil {
+			files[day] = m
+		}
+	}
+	return files, nil
+}
+
+// RollingLogger writes to one database file per UTC day, named by dayPath.
+// Files older than retainDays are deleted when a new one is started.
+type RollingLogger struct {
+	log        *slog.Logger
+	path       string
+	retainDays int
+
+	mu   sync.Mutex
+	day  string
+	cur  *HttpLogger
+	prev *HttpLogger
+	// dedupeWindow and dedupeClient are set on every day file.
+	dedupeWindow time.Duration
+	dedupeClient bool
+	// search is enabled on every day file.
+	search bool
+	// trafficTop is set on every day file, which is rolled up once closed.
+	trafficTop int
+}
+
+func NewRollingLogger(path string, retainDays int) (*RollingLogger, error) {
+	r := &RollingLogger{log: slog.With("component", "logger"), path: path, retainDays: retainDays}
+	if _, err := r.current(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// current returns the logger of the current day, switching files after
+// midnight.
+func (r *RollingLogger) current() (*HttpLogger, error) {
+	now := time.Now().UTC()
+	day := now.Format(dayFormat)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if day == r.day {
+		return r.cur, nil
+	}
+
+	next, err := NewLogger(dayPath(r.path, now))
+	if err != nil {
+		return nil, err
+	}
+	next.setDedupe(r.dedupeWindow, r.dedupeClient)
+	next.setTrafficTop(r.trafficTop)
+	if r.search {
+		if err := next.enableSearch(); err != nil {
+			next.Close()
+			return nil, err
+		}
+	}
+	if r.prev != nil {
+		r.closePrev(day)
+	}
+	if r.cur != nil {
+		prev := r.cur
+		r.prev = prev
+		time.AfterFunc(rolloverGrace, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.prev == prev {
+				r.closePrev(day)
+			}
+		})
+		r.log.Info("Database rolled over", "path", dayPath(r.path, now))
+	}
+	r.day, r.cur = day, next
+
+	if err := r.expire(now); err != nil {
+		r.log.Warn("Failed to delete expired databases", "error", err)
+	}
+	return next, nil
+}
+
+// closePrev closes the file of the previous day once the requests in flight
+// at midnight are logged, rolling up its traffic before day.
+func (r *RollingLogger) closePrev(day string) {
+	if err := r.prev.closeTraffic(day); err != nil {
+		r.log.Warn("Failed to roll up the host traffic", "error", err)
+	}
+	r.prev.Close()
+	r.prev = nil
+}
+
+// expire deletes the day files older than retainDays.
+func (r *RollingLogger) expire(now time.Time) error {
+	if r.retainDays <= 0 {
+		return nil
+	}
+	files, err := dayFiles(r.path)
+	if err != nil {
+		return err
+	}
+	oldest := now.AddDate(0, 0, -r.retainDays).Format(dayFormat)
+	var errs []error
+	for day, file := range files {
+		if day >= oldest {
+			continue
+		}
+		for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+			if err := os.Remove(file + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+		r.log.Info("Deleted expired database", "path", file)
+	}
+	return errors.Join(errs...)
+}
+
+func (r *RollingLogger) LogExchange(ctx context.Context, ex *Exchange) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.LogExchange(ctx, ex)
+}
+
+// honeytokens reads the tokens of every day file still kept.
+func (r *RollingLogger) honeytokens() ([]honeytoken, error) {
+	files, err := dayFiles(r.path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []honeytoken
+	var errs []error
+	for _, f := range files {
+		db, err := sql.Open("sqlite3", "file:"+f+"?mode=ro")
+		if err == nil {
+			var day []honeytoken
+			day, err = readHoneytokens(db)
+			tokens = append(tokens, day...)
+			db.Close()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", f, err))
+		}
+	}
+	return tokens, errors.Join(errs...)
+}
+
+// fingerprints merges the fingerprints of every day file still kept, the
+// latest label of each winning.
+func (r *RollingLogger) fingerprints() ([]clientFingerprint, error) {
+	files, err := dayFiles(r.path)
+	if err != nil {
+		return nil, err
+	}
+	days := make([]string, 0, len(files))
+	for day := range files {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	byHash := make(map[string]*clientFingerprint)
+	var prints []*clientFingerprint
+	var errs []error
+	for _, day := range days {
+		db, err := sql.Open("sqlite3", "file:"+files[day]+"?mode=ro")
+		var dayPrints []clientFingerprint
+		if err == nil {
+			dayPrints, err = readFingerprints(db)
+			db.Close()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", files[day], err))
+			continue
+		}
+		for _, f := range dayPrints {
+			m := byHash[f.Hash]
+			if m == nil {
+				m = &clientFingerprint{Hash: f.Hash, Headers: f.Headers, FirstSeen: f.FirstSeen}
+				byHash[f.Hash] = m
+				prints = append(prints, m)
+			}
+			if f.labeled {
+				m.Label = f.Label
+			}
+			m.LastSeen = f.LastSeen
+			m.Requests += f.Requests
+		}
+	}
+	merged := make([]clientFingerprint, len(prints))
+	for i, f := range prints {
+		merged[i] = *f
+	}
+	return merged, errors.Join(errs...)
+}
+
+func (r *RollingLogger) labelFingerprint(hash, label string) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.labelFingerprint(hash, label)
+}
+
+func (r *RollingLogger) setDedupe(window time.Duration, client bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dedupeWindow, r.dedupeClient = window, client
+	if r.cur != nil {
+		r.cur.setDedupe(window, client)
+	}
+}
+
+func (r *RollingLogger) setTrafficTop(top int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trafficTop = top
+	if r.cur != nil {
+		r.cur.setTrafficTop(top)
+	}
+}
+
+func (r *RollingLogger) enableSearch() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.search = true
+	if r.cur != nil {
+		return r.cur.enableSearch()
+	}
+	return nil
+}
+
+// searchRequests searches the requests of the current day.
+func (r *RollingLogger) searchRequests(ctx context.Context, q *searchQuery) ([]searchResult, error) {
+	l, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	return l.searchRequests(ctx, q)
+}
+
+// latencyStats reads the latencies of the day file of day.
+func (r *RollingLogger) latencyStats(day string) (*reportLatency, error) {
+	files, err := dayFiles(r.path)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := files[day]
+	if !ok {
+		return nil, fmt.Errorf("%w for %v", errNoDayFile, day)
+	}
+	db, err := sql.Open("sqlite3", "file:"+f+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return readLatency(db, day, reportTop)
+}
+
+// hostTraffic reads the traffic by host of the day files from since.
+func (r *RollingLogger) hostTraffic(since string, limit int) ([]hostTraffic, error) {
+	files, err := dayFiles(r.path)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]*hostTraffic)
+	for day, f := range files {
+		if day < since {
+			continue
+		}
+		db, err := sql.Open("sqlite3", "file:"+f+"?mode=ro")
+		if err != nil {
+			return nil, err
+		}
+		err = readHostTraffic(db, since, hosts)
+		db.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return topHostTraffic(hosts, limit), nil
+}
+
+// tagStats reads the requests by tag of the day files from since.
+func (r *RollingLogger) tagStats(since string, limit int) ([]tagStats, error) {
+	files, err := dayFiles(r.path)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]*tagStats)
+	for day, f := range files {
+		if day < since {
+			continue
+		}
+		db, err := sql.Open("sqlite3", "file:"+f+"?mode=ro")
+		if err != nil {
+			return nil, err
+		}
+		err = readTagStats(db, since, tags)
+		db.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return topTagStats(tags, limit), nil
+}
+
+// connectTargets reads the connect targets of the day files from since.
+func (r *RollingLogger) connectTargets(since string, port, limit int) ([]targetStats, error) {
+	files, err := dayFiles(r.path)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]*targetStats)
+	for day, f := range files {
+		if day < since {
+			continue
+		}
+		db, err := sql.Open("sqlite3", "file:"+f+"?mode=ro")
+		if err != nil {
+			return nil, err
+		}
+		err = readConnectTargets(db, since, targets)
+		db.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return topConnectTargets(targets, port, limit), nil
+}
+
+// listRequests lists the requests of the current day.
+func (r *RollingLogger) listRequests(ctx context.Context, q *requestQuery) (*requestPage, error) {
+	l, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	return l.listRequests(ctx, q)
+}
+
+// getRequest reads the request from the database of the current day.
+func (r *RollingLogger) getRequest(ctx context.Context, requestID string) (*requestDetail, error) {
+	l, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	return l.getRequest(ctx, requestID)
+}
+
+// credentialAttempts reads the credentials sent over the current day.
+func (r *RollingLogger) credentialAttempts(ctx context.Context, ip string, limit int) ([]credentialAttempt, error) {
+	l, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	return l.credentialAttempts(ctx, ip, limit)
+}
+
+// listSessions reads the client sessions of the current day.
+func (r *RollingLogger) listSessions(ctx context.Context, ip string, limit int) ([]listedSession, error) {
+	l, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	return l.listSessions(ctx, ip, limit)
+}
+
+// attackerProfile reads the profile of a client over the current day.
+func (r *RollingLogger) attackerProfile(ctx context.Context, ip string, limit int) (*attackerProfile, error) {
+	l, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	return l.attackerProfile(ctx, ip, limit)
+}
+
+// sharedCookies reads the session tokens of the current day.
+func (r *RollingLogger) sharedCookies(ctx context.Context, limit int) ([]sharedCookie, error) {
+	l, err := r.current()
+	if err != nil {
+		return nil, err
+	}
+	return l.sharedCookies(ctx, limit)
+}
+
+func (r *RollingLogger) logAdminCall(call *adminCall) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.logAdminCall(call)
+}
+
+func (r *RollingLogger) logSample(s *sample) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.logSample(s)
+}
+
+func (r *RollingLogger) logConnectTarget(t *connectTarget) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.logConnectTarget(t)
+}
+
+func (r *RollingLogger) logTLSFailure(f *tlsFailure) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.logTLSFailure(f)
+}
+
+func (r *RollingLogger) logWebsocketMessage(m *websocketMessage) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.logWebsocketMessage(m)
+}
+
+func (r *RollingLogger) logCredentials(tunnelID, ip string, creds []credential, at time.Time) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.logCredentials(tunnelID, ip, creds, at)
+}
+
+func (r *RollingLogger) logBodyMatches(requestID string, matches []tagMatch) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.logBodyMatches(requestID, matches)
+}
+
+func (r *RollingLogger) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.LogTunnel(ctx, req, tc, smtp, pctx)
+}
+
+func (r *RollingLogger) Check(ctx context.Context) error {
+	l, err := r.current()
+	if err != nil {
+		return err
+	}
+	return l.Check(ctx)
+}
+
+func (r *RollingLogger) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	if r.prev != nil {
+		errs = append(errs, r.prev.Close())
+		r.prev = nil
+	}
+	errs = append(errs, r.cur.Close())
+	return errors.Join(errs...)
+}
+
+// openDays opens the day files of path from one day to another, inclusive, as
+// a single database whose tables are views across the days with an added day
+// column. Days without a file are skipped.
+func openDays(path string, from, to time.Time) (*sql.DB, error) {
+	files, err := dayFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		if _, ok := files[d.Format(dayFormat)]; ok {
+			days = append(days, d.Format(dayFormat))
+		}
+	}
+	if len(days) == 0 {
+		return nil, fmt.Errorf("no database files for %v between %v and %v", path, from.Format(dayFormat), to.Format(dayFormat))
+	}
+	if len(days) > maxDays {
+		return nil, fmt.Errorf("at most %d days can be queried at once", maxDays)
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// Attached databases and temporary views belong to a connection.
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+
+	if err := attachDays(db, files, days); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func attachDays(db *sql.DB, files map[string]string, days []string) error {
+	for i, day := range days {
+		if _, err := db.Exec(fmt.Sprintf("attach database ? as d%d", i), "file:"+files[day]+"?mode=ro"); err != nil {
+			return fmt.Errorf("%v: %w", files[day], err)
+		}
+	}
+	for _, table := range tables {
+		// Files written by older versions may lack the newer tables.
+		var selects []string
+		for i, day := range days {
+			var n int
+			q := fmt.Sprintf("select count(*) from d%d.sqlite_master where type = 'table' and name = ?", i)
+			if err := db.QueryRow(q, table).Scan(&n); err != nil {
+				return fmt.Errorf("%v: %w", files[day], err)
+			}
+			if n > 0 {
+				selects = append(selects, fmt.Sprintf("select '%v' as day, * from d%d.%v", day, i, table))
+			}
+		}
+		if len(selects) == 0 {
+			continue
+		}
+		view := fmt.Sprintf("create temp view %v as %v", table, strings.Join(selects, " union all "))
+		if _, err := db.Exec(view); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package stuffpot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rulesDebounce is how long the rule files must stay untouched after a change
+// before they're reloaded, editors and sync tools write in several steps.
+const rulesDebounce = 500 * time.Millisecond
+
+// Rules are loaded from the rule files, which are meant to be edited while the
+// proxy runs. Every file may have any of the sections, they're concatenated.
+type Rules struct {
+	// Tags name the requests matching them. Every pattern given must match.
+	Tags []*TagRule `yaml:"tags"`
+	// Payloads detect attacks in requests, in addition to the embedded
+	// defaults.
+	Payloads []*PayloadRule `yaml:"payloads"`
+	// Judges recognize proxy checks, in addition to the embedded defaults.
+	Judges []*JudgeRule `yaml:"judges"`
+	// Honeytokens inject tokens into responses, whose later use is detected.
+	Honeytokens []*HoneytokenRule `yaml:"honeytokens"`
+	// Signatures detect known content in bodies.
+	Signatures []*SignatureRule `yaml:"signatures"`
+	// Fakes answer requests with canned responses instead of forwarding
+	// them.
+	Fakes []*FakeRule `yaml:"fakes"`
+
+	signatures *signatureSet
+}
+
+type TagRule struct {
+	Name   string `yaml:"name"`
+	Method string `yaml:"method"`
+	Host   string `yaml:"host"`
+	URL    string `yaml:"url"`
+	// Header is matched against each "name: value" header line, with the
+	// name in lower case.
+	Header string `yaml:"header"`
+
+	method, host, url, header *regexp.Regexp
+}
+
+func (r *TagRule) compile() error {
+	if r.Name == "" {
+		return errors.New("missing name")
+	}
+	var errs []error
+	for _, p := range []struct {
+		re      **regexp.Regexp
+		name, s string
+	}{{&r.method, "method", r.Method}, {&r.host, "host", r.Host}, {&r.url, "url", r.URL}, {&r.header, "header", r.Header}} {
+		if p.s == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", p.name, err))
+		}
+		*p.re = re
+	}
+	if len(errs) == 0 && r.method == nil && r.host == nil && r.url == nil && r.header == nil {
+		return errors.New("no pattern")
+	}
+	return errors.Join(errs...)
+}
+
+func (r *TagRule) match(req *http.Request) bool {
+	if r.method != nil && !r.method.MatchString(req.Method) {
+		return false
+	}
+	if r.host != nil && !r.host.MatchString(req.Host) {
+		return false
+	}
+	if r.url != nil && !r.url.MatchString(req.URL.String()) {
+		return false
+	}
+	if r.header != nil {
+		for name, values := range req.Header {
+			for _, v := range values {
+				if r.header.MatchString(strings.ToLower(name) + ": " + v) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// tag returns the names of the tag rules matching req, without duplicates.
+func (rules *Rules) tag(req *http.Request) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, r := range rules.Tags {
+		if !seen[r.Name] && r.match(req) {
+			seen[r.Name] = true
+			tags = append(tags, r.Name)
+		}
+	}
+	return tags
+}
+
+// counts gives the number of rules by section, for logging.
+func (rules *Rules) counts() map[string]int {
+	return map[string]int{"tags": len(rules.Tags), "payloads": len(rules.Payloads), "judges": len(rules.Judges),
+		"honeytokens": len(rules.Honeytokens), "signatures": len(rules.Signatures), "fakes": len(rules.Fakes)}
+}
+
+func loadRules(files []string) (*Rules, error) {
+	rules := &Rules{}
+	var errs []error
+	if err := decodeRules(rules, "default payloads", defaultPayloads); err != nil {
+		errs = append(errs, err)
+	}
+	if err := decodeRules(rules, "default judges", defaultJudges); err != nil {
+		errs = append(errs, err)
+	}
+	files, err := ruleFiles(files)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err == nil {
+			err = decodeRules(rules, f, data)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i, r := range rules.Tags {
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("tags[%d] %v: %v", i, r.Name, err))
+		}
+	}
+	for i, r := range rules.Payloads {
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("payloads[%d] %v: %v", i, r.Name, err))
+		}
+	}
+	for i, r := range rules.Judges {
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("judges[%d] %v: %v", i, r.Service, err))
+		}
+	}
+	for i, r := range rules.Honeytokens {
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("honeytokens[%d] %v: %v", i, r.Name, err))
+		}
+	}
+	for i, r := range rules.Signatures {
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("signatures[%d] %v: %v", i, r.ID, err))
+		}
+	}
+	for i, r := range rules.Fakes {
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("fakes[%d] %v: %v", i, r.Name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	rules.signatures = newSignatureSet(rules.Signatures)
+	return rules, nil
+}
+
+func decodeRules(rules *Rules, path string, data []byte) error {
+	var file Rules
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && err != io.EOF {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	rules.Tags = append(rules.Tags, file.Tags...)
+	rules.Payloads = append(rules.Payloads, file.Payloads...)
+	rules.Judges = append(rules.Judges, file.Judges...)
+	rules.Honeytokens = append(rules.Honeytokens, file.Honeytokens...)
+	rules.Signatures = append(rules.Signatures, file.Signatures...)
+	for _, r := range file.Fakes {
+		r.dir = filepath.Dir(path)
+	}
+	rules.Fakes = append(rules.Fakes, file.Fakes...)
+	return nil
+}
+
+// ruleFiles replaces the directories among paths by their YAML files, in name
+// order.
+func ruleFiles(paths []string) ([]string, error) {
+	var files []string
+	var errs []error
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() && isRuleFile(e.Name()) {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	return files, errors.Join(errs...)
+}
+
+func isRuleFile(name string) bool {
+	ext := filepath.Ext(name)
+	return (ext == ".yaml" || ext == ".yml") && !strings.HasPrefix(name, ".")
+}
+
+// ruleStore holds the current rules, reloaded from the files named by the
+// config. A reload which fails keeps the current rules.
+type ruleStore struct {
+	atomic.Pointer[Rules]
+	config *ConfigStore
+	log    *slog.Logger
+
+	mu       sync.Mutex
+	loadedAt time.Time
+	err      error
+	watcher  *fsnotify.Watcher
+	timer    *time.Timer
+}
+
+func newRuleStore(config *ConfigStore) (*ruleStore, error) {
+	store := &ruleStore{config: config, log: slog.With("component", "rules")}
+	rules, err := loadRules(config.Load().Rules.Files)
+	if err != nil {
+		return nil, err
+	}
+	store.Store(rules)
+	store.loadedAt = time.Now()
+	return store, nil
+}
+
+func (store *ruleStore) reload() error {
+	rules, err := loadRules(store.config.Load().Rules.Files)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.watchFiles()
+
+	store.err = err
+	if err != nil {
+		store.log.Error("Keeping current rules, reload failed", "error", err)
+		return err
+	}
+	before := store.Swap(rules)
+	store.loadedAt = time.Now()
+	store.log.Info("Rules reloaded", "before", before.counts(), "after", rules.counts())
+	return nil
+}
+
+type rulesStatus struct {
+	Files    []string       `json:"files"`
+	Counts   map[string]int `json:"counts"`
+	LoadedAt time.Time      `json:"loaded_at"`
+	Watching bool           `json:"watching"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func (store *ruleStore) status() rulesStatus {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	st := rulesStatus{
+		Files:    store.config.Load().Rules.Files,
+		Counts:   store.Load().counts(),
+		LoadedAt: store.loadedAt,
+		Watching: store.watcher != nil,
+	}
+	if store.err != nil {
+		st.Error = store.err.Error()
+	}
+	return st
+}
+
+// watch reloads the rules whenever their files change, until close is called.
+func (store *ruleStore) watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	store.watcher = w
+	store.watchFiles()
+	store.mu.Unlock()
+
+	go func() {
+		defer contain(store.log, "rules watcher")
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if store.watched(ev.Name) {
+					store.changed()
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				store.log.Warn("Watching rule files failed", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchFiles watches the directories of the rule files, which are often
+// replaced rather than written to, and the rule directories. It must be called
+// with mu held.
+func (store *ruleStore) watchFiles() {
+	if store.watcher == nil {
+		return
+	}
+	for _, f := range store.config.Load().Rules.Files {
+		dir := filepath.Dir(absPath(f))
+		if info, err := os.Stat(f); err == nil && info.IsDir() {
+			dir = absPath(f)
+		}
+		if err := store.watcher.Add(dir); err != nil {
+			store.log.Warn("Cannot watch rule file", "path", f, "error", err)
+		}
+	}
+}
+
+func (store *ruleStore) watched(name string) bool {
+	name = absPath(name)
+	for _, f := range store.config.Load().Rules.Files {
+		if absPath(f) == name {
+			return true
+		}
+		if absPath(f) == filepath.Dir(name) && isRuleFile(filepath.Base(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// changed schedules a reload once the files have settled.
+func (store *ruleStore) changed() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.timer == nil {
+		store.timer = time.AfterFunc(rulesDebounce, func() { store.reload() })
+		return
+	}
+	store.timer.Reset(rulesDebounce)
+}
+
+func (store *ruleStore) close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.timer != nil {
+		store.timer.Stop()
+	}
+	if store.watcher == nil {
+		return nil
+	}
+	err := store.watcher.Close()
+	store.watcher = nil
+	return err
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
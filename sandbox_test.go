@@ -0,0 +1,107 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFakeSMTPAcceptsMessagesInTheSandbox(t *testing.T) {
+	for _, accept := range []bool{false, true} {
+		s := &SmtpSession{accept: accept}
+		for _, line := range []string{"HELO x", "MAIL FROM:<a@example.com>", "RCPT TO:<b@example.org>", "DATA", "hi"} {
+			s.handleLine(line)
+		}
+		reply := s.handleLine(".")
+		if got := strings.HasPrefix(reply, "250 2.0.0 Ok: queued as "); got != accept {
+			t.Errorf("accept %v: got the reply %q to the message", accept, reply)
+		}
+	}
+}
+
+func TestSandboxKeepsRequestsAndTunnelsFromTheRemotes(t *testing.T) {
+	var forwarded atomic.Int32
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+	}))
+	defer plain.Close()
+	plainHost := strings.TrimPrefix(plain.URL, "http://")
+	echo := echoServer(t)
+	config := testConfig(t, "-sandbox", "-http-ports", plainHost[strings.LastIndex(plainHost, ":")+1:])
+	s, client := startServer(t, config, nil)
+
+	resp, err := client.Post(plain.URL+"/upload", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %v, want the request faked as successful", resp.Status)
+	}
+
+	conn, br, _ := openTunnel(t, client, plainHost)
+	parsed := fmt.Sprintf("GET / HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", plainHost)
+	io.WriteString(conn, parsed)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("the request in the tunnel parsed as HTTP got %v, %v", resp, err)
+	}
+	conn.Close()
+
+	// The echo server never gets what the client sends.
+	conn, br, _ = openTunnel(t, client, echo)
+	io.WriteString(conn, "ping")
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := br.Read(make([]byte, 4)); n != 0 {
+		t.Error("the tunnel was relayed to its remote")
+	}
+	conn.Close()
+
+	// Mail is accepted as if relayed.
+	conn, br, _ = openTunnel(t, client, "192.0.2.1:25")
+	fmt.Fprint(conn, "HELO x\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA\r\nSubject: hi\r\n\r\n"+
+		"body\r\n.\r\nQUIT\r\n")
+	replies, _ := io.ReadAll(br)
+	conn.Close()
+	if !strings.Contains(string(replies), "250 2.0.0 Ok: queued as ") {
+		t.Errorf("got the replies %q, want the message accepted", replies)
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("got %v requests forwarded, want none", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{{plain.URL + "/upload", "sandbox", "4"}, {plain.URL + "/", "sandbox", "0"}}
+	if got := queryRows(t, db, "select url, error_response, request_size from requests order by id"); !reflect.DeepEqual(
+		got, want) {
+		t.Errorf("got the requests %v, want %v", got, want)
+	}
+	// The bytes the client sent are captured.
+	want = [][]string{{plainHost, "sandbox", fmt.Sprint(len(parsed))}, {echo, "sandbox", "4"},
+		{"192.0.2.1:25", "sandbox", "96"}}
+	got := queryRows(t, db, "select host, error_response, coalesce(bytes_up, '') from connects order by id")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got the connects %v, want %v", got, want)
+	}
+	want = [][]string{{"a@example.com", "b@example.org", "1", "1"}}
+	if got := queryRows(t, db, "select mail_from, rcpt_to, messages, blocked from smtp_attempts"); !reflect.DeepEqual(
+		got, want) {
+		t.Errorf("got the mail %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,582 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+//go:embed migrations/*.sql migrations/postgres/*.sql migrations/mysql/*.sql
+var migrationFiles embed.FS
+
+// migrationName is the name of a migration file, after its version.
+var migrationName = regexp.MustCompile(`^(\d{4})_\w+\.sql$`)
+
+// migration is a change of the schema, applied once to each database, the
+// first one creating it.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// statements splits the SQL of m at the semicolons ending its lines, leaving
+// out those made of comments only. MySQL runs one statement at a time.
+func (m migration) statements() []string {
+	var stmts []string
+	var b strings.Builder
+	code := false
+	for _, line := range strings.SplitAfter(m.sql, "\n") {
+		b.WriteString(line)
+		line = strings.TrimSpace(line)
+		code = code || line != "" && !strings.HasPrefix(line, "--")
+		if strings.HasSuffix(line, ";") && !strings.HasPrefix(line, "--") {
+			stmts = append(stmts, strings.TrimSpace(b.String()))
+			b.Reset()
+			code = false
+		}
+	}
+	if code {
+		stmts = append(stmts, strings.TrimSpace(b.String()))
+	}
+	return stmts
+}
+
+// readMigrations returns the SQL files of dir, by version, each following the
+// previous one.
+func readMigrations(dir string) ([]migration, error) {
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ms []migration
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		want := len(ms) + 1
+		m := migrationName.FindStringSubmatch(e.Name())
+		if m == nil || m[1] != fmt.Sprintf("%04d", want) {
+			return nil, fmt.Errorf("%v/%v: expected a name like %04d_change.sql", dir, e.Name(), want)
+		}
+		b, err := migrationFiles.ReadFile(dir + "/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, migration{version: want, name: strings.TrimSuffix(e.Name(), ".sql"), sql: string(b)})
+	}
+	if len(ms) == 0 {
+		return nil, fmt.Errorf("%v: no migrations", dir)
+	}
+	return ms, nil
+}
+
+// migrations returns the migrations of the SQLite schema, those of the
+// migrations directory.
+var migrations = sync.OnceValues(func() ([]migration, error) {
+	return readMigrations("migrations")
+})
+
+// sqlMigrations return the migrations of the sql store by driver, those of
+// the directory of its dialect under migrations.
+var sqlMigrations = map[string]func() ([]migration, error){
+	"postgres": sync.OnceValues(func() ([]migration, error) {
+		return readMigrations("migrations/postgres")
+	}),
+	"mysql": sync.OnceValues(func() ([]migration, error) {
+		return readMigrations("migrations/mysql")
+	}),
+}
+
+// legacyColumns were added to the tables after they were first created,
+// before there were migrations. Databases of that time, which have no
+// schema_version table, are given those they lack before the baseline is
+// applied, which leaves their existing tables as they are.
+var legacyColumns = []struct{ table, column, typ string }{
+	{"requests", "request_id", "TEXT"},
+	{"requests", "parent_id", "TEXT"},
+	{"connects", "tunnel_id", "TEXT"},
+	{"requests", "tags", "TEXT"},
+	{"request_tags", "source", "TEXT"},
+	{"requests", "status", "INTEGER"},
+	{"requests", "size", "INTEGER"},
+	{"client_stats", "bytes", "INTEGER DEFAULT 0"},
+	{"client_stats", "errors", "INTEGER DEFAULT 0"},
+	{"requests", "header_order", "TEXT"},
+	{"requests", "fingerprint", "TEXT"},
+	{"requests", "source", "TEXT"},
+	{"requests", "import_hash", "TEXT"},
+	{"requests", "dedupe_key", "TEXT"},
+	{"requests", "occurrences", "INTEGER"},
+	{"requests", "last_seen", "TEXT"},
+	{"requests", "upstream_us", "INTEGER"},
+	{"requests", "overhead_us", "INTEGER"},
+	{"requests", "error_type", "TEXT"},
+	{"requests", "request_size", "INTEGER"},
+	{"connects", "rule", "TEXT"},
+	{"requests", "error_response", "TEXT"},
+	{"connects", "error_response", "TEXT"},
+	{"connects", "dial_us", "INTEGER"},
+	{"connects", "dial_error", "TEXT"},
+	{"requests", "parse_anomalies", "TEXT"},
+	{"requests", "ja3", "TEXT"},
+	{"tls_failures", "ja3", "TEXT"},
+	{"connects", "mode", "TEXT"},
+	{"connects", "bytes_up", "INTEGER"},
+	{"connects", "bytes_down", "INTEGER"},
+	{"connects", "duration_us", "INTEGER"},
+	{"requests", "country", "TEXT"},
+	{"requests", "city", "TEXT"},
+	{"requests", "asn", "INTEGER"},
+	{"connects", "country", "TEXT"},
+	{"connects", "city", "TEXT"},
+	{"connects", "asn", "INTEGER"},
+	{"requests", "ptr", "TEXT"},
+	{"connects", "ptr", "TEXT"},
+	{"requests", "session_id", "TEXT"},
+	{"requests", "raw_request", "TEXT"},
+	{"requests", "raw_response", "TEXT"},
+}
+
+// upgradeLegacy adds the legacy columns the existing tables lack, and tells
+// whether it added any. The missing tables are left to the baseline.
+func (logger *HttpLogger) upgradeLegacy() (bool, error) {
+	tables, err := tableNames(logger.db)
+	if err != nil {
+		return false, err
+	}
+	migrated := false
+	for _, c := range legacyColumns {
+		if !slices.Contains(tables, c.table) {
+			continue
+		}
+		added, err := logger.addColumn(c.table, c.column, c.typ)
+		if err != nil {
+			return false, err
+		}
+		migrated = migrated || added
+	}
+	return migrated, nil
+}
+
+// migrate applies the migrations after version up to to, or all of them when
+// to is 0. Legacy databases are upgraded first. It tells whether it changed
+// anything.
+func (logger *HttpLogger) migrate(version, to int, legacy bool) (bool, error) {
+	ms, err := migrations()
+	if err != nil {
+		return false, err
+	}
+	migrated := false
+	if legacy {
+		if migrated, err = logger.upgradeLegacy(); err != nil {
+			return false, err
+		}
+	}
+	applied, err := applyMigrations(logger.db, ms, version, to,
+		"insert into schema_version (version, name, applied_by) values (?, ?, ?)")
+	return migrated || applied, err
+}
+
+// applyMigrations applies the migrations of ms after version up to to, or all
+// of them when to is 0, each in a transaction recording it in schema_version
+// with the record query. MySQL commits the statements changing the schema as
+// they're run, so there the transaction only covers the others. It tells
+// whether it applied any.
+func applyMigrations(db *sql.DB, ms []migration, version, to int, record string) (bool, error) {
+	migrated := false
+	for _, m := range ms {
+		if m.version <= version || to > 0 && m.version > to {
+			continue
+		}
+		err := func() error {
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+			for _, stmt := range m.statements() {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			if _, err = tx.Exec(record, m.version, m.name, getBuildInfo().String()); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}()
+		if err != nil {
+			return migrated, fmt.Errorf("migration %v: %w", m.name, err)
+		}
+		migrated = true
+	}
+	return migrated, nil
+}
+
+// schemaColumn is a column of the schema and its declared type.
+type schemaColumn struct {
+	name, typ string
+}
+
+// expectedTables are the tables of the schema and their columns.
+type expectedTables struct {
+	columns map[string][]schemaColumn
+	// added are the columns added to the tables after they were first
+	// created, by the legacy columns or the migrations, as table.column.
+	added map[string]bool
+}
+
+// expectedSchema returns the tables of the schema, created in a database in
+// memory.
+var expectedSchema = sync.OnceValues(func() (*expectedTables, error) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	columns := func() (map[string][]schemaColumn, error) {
+		tables, err := tableNames(db)
+		if err != nil {
+			return nil, err
+		}
+		columns := make(map[string][]schemaColumn)
+		for _, t := range tables {
+			if columns[t], err = tableColumns(db, t); err != nil {
+				return nil, err
+			}
+		}
+		return columns, nil
+	}
+	logger := &HttpLogger{db: db}
+	if _, err := logger.migrate(0, 1, false); err != nil {
+		return nil, err
+	}
+	baseline, err := columns()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := logger.migrate(1, 0, false); err != nil {
+		return nil, err
+	}
+	expected := &expectedTables{added: make(map[string]bool)}
+	if expected.columns, err = columns(); err != nil {
+		return nil, err
+	}
+	for _, c := range legacyColumns {
+		expected.added[c.table+"."+c.column] = true
+	}
+	for t, columns := range expected.columns {
+		for _, c := range columns {
+			if baseline[t] != nil && !slices.Contains(baseline[t], c) {
+				expected.added[t+"."+c.name] = true
+			}
+		}
+	}
+	return expected, nil
+})
+
+// tableNames returns the tables of db, but those of SQLite itself.
+func tableNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("select name from sqlite_master where type = 'table' and name not like 'sqlite_%' order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+// tableColumns returns the columns of table in db.
+func tableColumns(db *sql.DB, table string) ([]schemaColumn, error) {
+	rows, err := db.Query("select name, type from pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []schemaColumn
+	for rows.Next() {
+		var c schemaColumn
+		if err := rows.Scan(&c.name, &c.typ); err != nil {
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// schemaCheck is the schema of a database compared with that of this build.
+type schemaCheck struct {
+	// Problems are the differences opening the database can't fix: a table
+	// or column with another type, or missing while it's not added by the
+	// migrations.
+	Problems []string
+	// Pending are the tables and columns opening the database adds.
+	Pending []string
+	// Version is the schema version recorded in the database, that of its
+	// last migration, 0 for empty and legacy databases, and Expected that of
+	// this build. CreatedBy and MigratedBy are the builds which created the
+	// database and last changed its schema.
+	Version    int
+	Expected   int
+	CreatedBy  string
+	MigratedBy string
+	// Legacy is set for the databases created before there were migrations,
+	// which have tables but no schema_version.
+	Legacy bool
+}
+
+// checkSchema compares the tables of db with the schema. Tables which aren't
+// part of it are ignored, but in databases which have none of the schema.
+func checkSchema(db *sql.DB) (*schemaCheck, error) {
+	expected, err := expectedSchema()
+	if err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	tables, err := tableNames(db)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := migrations()
+	if err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	sc := &schemaCheck{Expected: ms[len(ms)-1].version}
+	if len(tables) > 0 && !slices.Contains(tables, "metadata") && !slices.Contains(tables, "requests") {
+		sc.Problems = append(sc.Problems, fmt.Sprintf("not a stuffpot database, it has tables %v", strings.Join(tables, ", ")))
+		return sc, nil
+	}
+	if slices.Contains(tables, "schema_version") {
+		if err := db.QueryRow("select coalesce(max(version), 0) from schema_version").Scan(&sc.Version); err != nil {
+			return nil, err
+		}
+	} else {
+		sc.Legacy = len(tables) > 0
+	}
+	if slices.Contains(tables, "metadata") {
+		for key, v := range map[string]*string{"created_by": &sc.CreatedBy, "migrated_by": &sc.MigratedBy} {
+			err := db.QueryRow("select value from metadata where key = ?", key).Scan(v)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return nil, err
+			}
+		}
+	}
+
+	names := make([]string, 0, len(expected.columns))
+	for t := range expected.columns {
+		names = append(names, t)
+	}
+	slices.Sort(names)
+	for _, t := range names {
+		if !slices.Contains(tables, t) {
+			sc.Pending = append(sc.Pending, fmt.Sprintf("table %v", t))
+			continue
+		}
+		columns, err := tableColumns(db, t)
+		if err != nil {
+			return nil, err
+		}
+		for _, want := range expected.columns[t] {
+			i := slices.IndexFunc(columns, func(c schemaColumn) bool { return strings.EqualFold(c.name, want.name) })
+			switch {
+			case i < 0 && expected.added[t+"."+want.name]:
+				sc.Pending = append(sc.Pending, fmt.Sprintf("table %v: column %v", t, want.name))
+			case i < 0:
+				sc.Problems = append(sc.Problems, fmt.Sprintf("table %v: missing column %v %v", t, want.name, want.typ))
+			case !strings.EqualFold(columns[i].typ, want.typ):
+				sc.Problems = append(sc.Problems, fmt.Sprintf("table %v: column %v has type %v, want %v", t, want.name,
+					orUnknown(columns[i].typ), want.typ))
+			}
+		}
+	}
+	if len(tables) > 0 {
+		for _, m := range ms {
+			if m.version > sc.Version {
+				sc.Pending = append(sc.Pending, "migration "+m.name)
+			}
+		}
+	}
+	return sc, nil
+}
+
+// versions describes the builds and schema versions involved.
+func (sc *schemaCheck) versions() string {
+	return fmt.Sprintf("database schema version %v, created by %v, migrated by %v; this is %v, schema version %v",
+		sc.Version, orUnknown(sc.CreatedBy), orUnknown(sc.MigratedBy), getBuildInfo().String(), sc.Expected)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// validateSchema refuses databases whose schema the migrations can't bring to
+// that of this build. Databases of a later schema version are opened, their
+// additions being ignored.
+func (logger *HttpLogger) validateSchema() (*schemaCheck, error) {
+	sc, err := checkSchema(logger.db)
+	if err != nil {
+		return nil, err
+	}
+	if len(sc.Problems) > 0 {
+		return nil, fmt.Errorf("unexpected schema: %v (%v)", strings.Join(sc.Problems, "; "), sc.versions())
+	}
+	if sc.Version > sc.Expected {
+		slog.Warn("Database written by a later version", "component", "logger", "schema_version", sc.Version,
+			"migrated_by", sc.MigratedBy, "expected_version", sc.Expected)
+	}
+	if len(sc.Pending) > 0 && (sc.Version > 0 || sc.Legacy) {
+		slog.Info("Migrating database schema", "component", "logger", "from_version", sc.Version, "to_version", sc.Expected,
+			"legacy", sc.Legacy, "changes", len(sc.Pending))
+	}
+	return sc, nil
+}
+
+// InitDatabase creates the database of cfg, or migrates its schema, for
+// -db-init-only. The sql store and the registered ones are opened and closed.
+func InitDatabase(cfg *Config) error {
+	var db interface{ Close() error }
+	var err error
+	open, registered := registeredStore(cfg.Storage.Store)
+	switch {
+	case registered:
+		db, err = open(cfg.Storage.DSN)
+	case cfg.Storage.Store == "memory":
+		return errors.New("the memory store has no database to create")
+	case cfg.Storage.Store == "sql":
+		db, err = NewSQLStore(cfg.Storage.Driver, cfg.Storage.DSN)
+	case cfg.Storage.Rollover == "daily":
+		db, err = NewRollingLogger(cfg.Storage.Path, cfg.Storage.RetainDays)
+	default:
+		db, err = NewLogger(cfg.Storage.Path)
+	}
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// dbCommand implements the db subcommand:
+//
+//	stuffpot db check [-db path]
+//
+// check runs SQLite's integrity check on the database and its daily files,
+// and compares their schema with that of this build. It exits with status 1
+// when a file is corrupt or has an unexpected schema, and only reads them.
+func dbCommand(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: stuffpot db check [-db path]")
+		os.Exit(2)
+	}
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot db check", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stuffpot db check [-db path]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	paths, err := databaseFiles(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "%v: no database\n", *path)
+		os.Exit(1)
+	}
+	failed := false
+	for _, p := range paths {
+		problems, err := checkDatabase(p)
+		if err != nil {
+			fmt.Printf("%v: %v\n", p, err)
+			failed = true
+			continue
+		}
+		if len(problems) > 0 {
+			failed = true
+		}
+		for _, problem := range problems {
+			fmt.Printf("%v: %v\n", p, problem)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// checkDatabase returns the problems of the database at path, or prints
+// that it's fine.
+func checkDatabase(path string) ([]string, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var problems []string
+	rows, err := db.Query("pragma integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if msg != "ok" {
+			problems = append(problems, "integrity: "+msg)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sc, err := checkSchema(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range sc.Problems {
+		problems = append(problems, "schema: "+p)
+	}
+	if len(problems) > 0 {
+		problems = append(problems, sc.versions())
+		return problems, nil
+	}
+	status := "ok"
+	if len(sc.Pending) > 0 {
+		status = fmt.Sprintf("ok, %d changes pending migration: %v", len(sc.Pending), strings.Join(sc.Pending, ", "))
+	}
+	fmt.Printf("%v: %v (%v)\n", path, status, sc.versions())
+	return nil, nil
+}
@@ -0,0 +1,151 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMigrationsFollowEachOther(t *testing.T) {
+	dialects := map[string]func() ([]migration, error){"sqlite": migrations}
+	for driver, ms := range sqlMigrations {
+		dialects[driver] = ms
+	}
+	for dialect, migrations := range dialects {
+		ms, err := migrations()
+		if err != nil {
+			t.Fatalf("%v: %v", dialect, err)
+		}
+		for i, m := range ms {
+			if m.version != i+1 {
+				t.Errorf("%v: migration %v has version %v, want %v", dialect, m.name, m.version, i+1)
+			}
+		}
+	}
+}
+
+func TestMigrationStatements(t *testing.T) {
+	m := migration{sql: `-- A comment; not a statement.
+create table a (
+  x TEXT -- the x
+);
+
+-- Another comment.
+alter table a add column y TEXT;
+update a set y = ';'
+  where x is null;
+-- The end.
+`}
+	want := []string{
+		"-- A comment; not a statement.\ncreate table a (\n  x TEXT -- the x\n);",
+		"-- Another comment.\nalter table a add column y TEXT;",
+		"update a set y = ';'\n  where x is null;",
+	}
+	if got := m.statements(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got statements %q, want %q", got, want)
+	}
+}
+
+func TestLegacyDatabaseIsUpgraded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A database of before the migrations: tables lacking the later columns,
+	// and the version in the metadata.
+	for _, stmt := range []string{
+		"create table metadata (key TEXT PRIMARY KEY, value TEXT)",
+		"insert into metadata (key, value) values ('schema_version', '12')",
+		`create table requests (id INTEGER PRIMARY KEY AUTOINCREMENT, from_ip TEXT, method TEXT, host TEXT, url TEXT,
+			headers TEXT, created_at INTEGER DEFAULT CURRENT_TIMESTAMP)`,
+		"insert into requests (from_ip, method, host, url, headers) values ('192.0.2.1', 'GET', 'example.com', '/', '{}')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%v: %v", stmt, err)
+		}
+	}
+	db.Close()
+
+	logger, err := NewLogger(path)
+	if err != nil {
+		t.Fatalf("NewLogger: %v", err)
+	}
+	defer logger.Close()
+	sc, err := checkSchema(logger.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Legacy || sc.Version != sc.Expected || len(sc.Problems) > 0 || len(sc.Pending) > 0 {
+		t.Errorf("after the upgrade: version %v of %v, legacy %v, problems %v, pending %v", sc.Version, sc.Expected,
+			sc.Legacy, sc.Problems, sc.Pending)
+	}
+	var host, tags sql.NullString
+	if err := logger.db.QueryRow("select host, tags from requests").Scan(&host, &tags); err != nil {
+		t.Fatal(err)
+	}
+	if host.String != "example.com" || tags.Valid {
+		t.Errorf("got host %q, tags %v, want the request kept with no tags", host.String, tags)
+	}
+	var version sql.NullString
+	err = logger.db.QueryRow("select value from metadata where key = 'schema_version'").Scan(&version)
+	if err != sql.ErrNoRows {
+		t.Errorf("metadata schema_version %v left (%v)", version, err)
+	}
+}
+
+func TestNewDatabaseHasTheLatestVersion(t *testing.T) {
+	logger, err := NewLogger(filepath.Join(t.TempDir(), "new.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	sc, err := checkSchema(logger.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Legacy || sc.Version != sc.Expected || len(sc.Problems) > 0 || len(sc.Pending) > 0 || sc.CreatedBy == "" {
+		t.Errorf("got version %v of %v, legacy %v, problems %v, pending %v, created by %q", sc.Version, sc.Expected,
+			sc.Legacy, sc.Problems, sc.Pending, sc.CreatedBy)
+	}
+}
+
+func TestCheckDatabase(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, "-db", filepath.Join(dir, "log.db")).Load()
+	if err := InitDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := checkDatabase(cfg.Storage.Path); err != nil || len(problems) > 0 {
+		t.Errorf("the database of -db-init-only: got %v, %v, want no problems", problems, err)
+	}
+
+	// Files of another program are refused, and left as they were.
+	other := filepath.Join(dir, "other.db")
+	db, err := sql.Open("sqlite3", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("create table accounts (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	problems, err := checkDatabase(other)
+	if err != nil || len(problems) == 0 || !strings.Contains(problems[0], "not a stuffpot database, it has tables accounts") {
+		t.Errorf("another program's database: got %v, %v", problems, err)
+	}
+	if logger, err := NewLogger(other); err == nil {
+		logger.Close()
+		t.Error("another program's database was opened")
+	}
+	db, err = sql.Open("sqlite3", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if tables, err := tableNames(db); err != nil || !slices.Equal(tables, []string{"accounts"}) {
+		t.Errorf("got the tables %v, %v, want the database unchanged", tables, err)
+	}
+}
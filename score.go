@@ -0,0 +1,170 @@
+package stuffpot
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxScoredHosts bounds the hosts remembered per client, further hosts aren't
+// scored.
+const maxScoredHosts = 1024
+
+// clientScore is the threat score of a client and what it's made of.
+type clientScore struct {
+	IP        string    `json:"ip"`
+	Score     float64   `json:"score"`
+	Events    float64   `json:"events"`
+	Standing  float64   `json:"standing"`
+	Requests  int64     `json:"requests"`
+	Hosts     int       `json:"hosts"`
+	Attacks   int64     `json:"attacks"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type scoredClient struct {
+	clientScore
+	// updated is when Events was last decayed.
+	updated time.Time
+	hosts   map[string]bool
+}
+
+// decay brings the score of the events to t.
+func (c *scoredClient) decay(t time.Time, halfLife time.Duration) {
+	if t.After(c.updated) {
+		c.Events *= math.Exp2(-float64(t.Sub(c.updated)) / float64(halfLife))
+		c.updated = t
+	}
+	c.Score = c.Events + c.Standing
+}
+
+// scorer keeps the threat score of every client, updated by the logging queue
+// as requests arrive. The score is what policies act on.
+type scorer struct {
+	config *ConfigStore
+
+	mu        sync.Mutex
+	clients   map[string]*scoredClient
+	lastSweep time.Time
+}
+
+func newScorer(config *ConfigStore) *scorer {
+	return &scorer{config: config, clients: make(map[string]*scoredClient)}
+}
+
+// observe scores a request from ip, once its state is complete, and returns
+// the client's score.
+func (s *scorer) observe(ip string, req *requestState, host string) clientScore {
+	cfg := s.config.Load().Score
+	t := req.start
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.Sub(s.lastSweep) > cfg.HalfLife {
+		s.sweep(t, cfg.HalfLife)
+	}
+	c := s.clients[ip]
+	if c == nil {
+		c = &scoredClient{clientScore: clientScore{IP: ip, FirstSeen: t}, updated: t, hosts: make(map[string]bool)}
+		s.clients[ip] = c
+	}
+	c.decay(t, cfg.HalfLife)
+
+	c.Requests++
+	c.LastSeen = t
+	c.Events += cfg.Request
+	if host != "" && !c.hosts[host] && len(c.hosts) < maxScoredHosts {
+		c.hosts[host] = true
+		c.Hosts = len(c.hosts)
+		c.Events += cfg.Host
+	}
+	c.Events += cfg.Tag * float64(len(req.tags))
+
+	standing := 0.0
+	for _, m := range req.matches {
+		switch {
+		case m.Tag == "tor-exit":
+			standing += cfg.Tor
+		case strings.HasPrefix(m.Tag, "feed:"):
+			standing += cfg.Feed
+		default:
+			c.Events += cfg.Attack
+			c.Attacks++
+		}
+	}
+	if req.session != nil && req.login != nil {
+		c.Events += cfg.Attack
+		c.Attacks++
+	}
+	c.Standing = standing
+	c.Score = c.Events + c.Standing
+	return c.clientScore
+}
+
+// score returns the current score of ip, 0 for unknown clients.
+func (s *scorer) score(ip string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.clients[ip]
+	if c == nil {
+		return 0
+	}
+	c.decay(time.Now(), s.config.Load().Score.HalfLife)
+	return c.Score
+}
+
+// blocked tells whether ip's score reaches the auto-block threshold.
+func (s *scorer) blocked(ip string) bool {
+	threshold := s.config.Load().Score.Block
+	return threshold > 0 && s.score(ip) >= threshold
+}
+
+// get returns the current score of ip.
+func (s *scorer) get(ip string) (clientScore, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.clients[ip]
+	if c == nil {
+		return clientScore{}, false
+	}
+	c.decay(time.Now(), s.config.Load().Score.HalfLife)
+	return c.clientScore, true
+}
+
+// top returns the n clients with the highest current scores.
+func (s *scorer) top(n int) []clientScore {
+	halfLife := s.config.Load().Score.HalfLife
+	now := time.Now()
+
+	s.mu.Lock()
+	scores := make([]clientScore, 0, len(s.clients))
+	for _, c := range s.clients {
+		c.decay(now, halfLife)
+		scores = append(scores, c.clientScore)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+	if len(scores) > n {
+		scores = scores[:n]
+	}
+	return scores
+}
+
+// sweep forgets the clients whose score has decayed to nothing. It must be
+// called with mu held.
+func (s *scorer) sweep(t time.Time, halfLife time.Duration) {
+	s.lastSweep = t
+	for ip, c := range s.clients {
+		c.decay(t, halfLife)
+		if c.Score < 0.01 {
+			delete(s.clients, ip)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package stuffpot
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestScoreTrajectory(t *testing.T) {
+	config := testConfig(t, "-score-half-life", "1h", "-score-request", "1", "-score-host", "2", "-score-attack", "10",
+		"-score-tag", "3", "-score-tor", "5", "-score-feed", "4")
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	type event struct {
+		after   time.Duration
+		host    string
+		tags    []string
+		matches []string
+		login   bool
+		score   float64
+	}
+	tests := []struct {
+		name     string
+		events   []event
+		attacks  int64
+		requests int64
+	}{
+		{"requests decay", []event{
+			{after: 0, host: "a.example", score: 3},
+			{after: time.Hour, host: "a.example", score: 3.0/2 + 1},
+			{after: 3 * time.Hour, score: 2.5/4 + 1},
+		}, 0, 3},
+		{"new hosts", []event{
+			{host: "a.example", score: 3},
+			{host: "b.example", score: 6},
+			{host: "a.example", score: 7},
+		}, 0, 3},
+		{"attacks and tags", []event{
+			{host: "a.example", tags: []string{"scanner"}, matches: []string{"sqli"}, score: 1 + 2 + 3 + 10},
+			{after: 2 * time.Hour, score: 16.0/4 + 1},
+			{after: 2 * time.Hour, login: true, score: 5 + 1 + 10},
+		}, 2, 3},
+		{"the standing doesn't decay", []event{
+			{host: "a.example", matches: []string{"tor-exit", "feed:spamhaus"}, score: 1 + 2 + 5 + 4},
+			{after: time.Hour, matches: []string{"tor-exit"}, score: 3.0/2 + 1 + 5},
+			{after: 2 * time.Hour, score: 2.5/2 + 1},
+		}, 0, 3},
+		// A client whose score decayed below 0.01 is forgotten, and starts
+		// over.
+		{"decayed to nothing", []event{
+			{host: "a.example", score: 3},
+			{after: 20 * time.Hour, score: 1},
+		}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScorer(config)
+			var last clientScore
+			for i, e := range tt.events {
+				req := &requestState{start: start.Add(e.after), tags: e.tags}
+				for _, m := range e.matches {
+					req.matches = append(req.matches, tagMatch{Tag: m})
+				}
+				if e.login {
+					req.session, req.login = &bruteSession{}, &loginAttempt{}
+				}
+				last = s.observe("192.0.2.1", req, e.host)
+				if math.Abs(last.Score-e.score) > 1e-9 {
+					t.Errorf("event %d: score %v, want %v", i, last.Score, e.score)
+				}
+			}
+			if last.Attacks != tt.attacks || last.Requests != tt.requests {
+				t.Errorf("got %d attacks in %d requests, want %d in %d", last.Attacks, last.Requests, tt.attacks,
+					tt.requests)
+			}
+		})
+	}
+}
+
+func TestScoreBlockThreshold(t *testing.T) {
+	s := newScorer(testConfig(t, "-score-attack", "50", "-score-block", "40"))
+	if s.blocked("192.0.2.1") {
+		t.Error("an unknown client is blocked")
+	}
+	s.observe("192.0.2.1", &requestState{start: time.Now(), matches: []tagMatch{{Tag: "sqli"}}}, "a.example")
+	if !s.blocked("192.0.2.1") {
+		t.Errorf("a client scoring %v isn't blocked at 40", s.score("192.0.2.1"))
+	}
+}
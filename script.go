@@ -0,0 +1,279 @@
+package stuffpot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scriptLoadTimeout bounds the execution of the top level of a script.
+const scriptLoadTimeout = 5 * time.Second
+
+// scriptErrors counts the requests passed through because the script failed
+// on them or took too long.
+var scriptErrors atomic.Int64
+
+// scriptDecision is what the script returns for a request, built by one of
+// its builtins.
+type scriptDecision struct {
+	// action is forward, block, respond or tarpit.
+	action string
+	status int
+	body   string
+	delay  time.Duration
+	tags   []string
+	// headers are set on the forwarded request, or on the response served
+	// by respond. An empty value removes a request header.
+	headers map[string]string
+}
+
+func (d *scriptDecision) String() string       { return fmt.Sprintf("%v(...)", d.action) }
+func (d *scriptDecision) Type() string         { return "decision" }
+func (d *scriptDecision) Freeze()              {}
+func (d *scriptDecision) Truth() starlark.Bool { return starlark.True }
+func (d *scriptDecision) Hash() (uint32, error) {
+	return 0, errors.New("unhashable type: decision")
+}
+
+// scriptBuiltins are predeclared in scripts. Each returns a decision, and
+// takes the tags to add to the request.
+var scriptBuiltins = starlark.StringDict{
+	"forward": starlark.NewBuiltin("forward", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var tags starlark.Iterable
+		var headers *starlark.Dict
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "headers?", &headers, "tags?", &tags); err != nil {
+			return nil, err
+		}
+		return newScriptDecision(fn.Name(), "forward", 0, "", 0, tags, headers)
+	}),
+	"block": starlark.NewBuiltin("block", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		status, body := http.StatusForbidden, "Forbidden"
+		var tags starlark.Iterable
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "status?", &status, "body?", &body, "tags?", &tags); err != nil {
+			return nil, err
+		}
+		return newScriptDecision(fn.Name(), "block", status, body, 0, tags, nil)
+	}),
+	"respond": starlark.NewBuiltin("respond", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		status, body := http.StatusOK, ""
+		var tags starlark.Iterable
+		var headers *starlark.Dict
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "status?", &status, "body?", &body, "headers?", &headers, "tags?", &tags); err != nil {
+			return nil, err
+		}
+		return newScriptDecision(fn.Name(), "respond", status, body, 0, tags, headers)
+	}),
+	"tarpit": starlark.NewBuiltin("tarpit", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var n starlark.Value
+		var tags starlark.Iterable
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "seconds", &n, "tags?", &tags); err != nil {
+			return nil, err
+		}
+		// seconds may be an int or a float.
+		seconds, ok := starlark.AsFloat(n)
+		if !ok {
+			return nil, fmt.Errorf("%v: seconds must be a number, got %v", fn.Name(), n.Type())
+		}
+		if seconds < 0 {
+			return nil, fmt.Errorf("%v: negative seconds", fn.Name())
+		}
+		return newScriptDecision(fn.Name(), "tarpit", 0, "", time.Duration(seconds*float64(time.Second)), tags, nil)
+	}),
+}
+
+func newScriptDecision(fn, action string, status int, body string, delay time.Duration, tags starlark.Iterable, headers *starlark.Dict) (*scriptDecision, error) {
+	if status != 0 && (status < 100 || status > 599) {
+		return nil, fmt.Errorf("%v: invalid status %d", fn, status)
+	}
+	d := &scriptDecision{action: action, status: status, body: body, delay: delay}
+	if tags != nil {
+		iter := tags.Iterate()
+		defer iter.Done()
+		var v starlark.Value
+		for iter.Next(&v) {
+			tag, ok := starlark.AsString(v)
+			if !ok || tag == "" {
+				return nil, fmt.Errorf("%v: tags must be non-empty strings, got %v", fn, v)
+			}
+			d.tags = append(d.tags, tag)
+		}
+	}
+	if headers != nil {
+		d.headers = make(map[string]string)
+		for _, item := range headers.Items() {
+			name, ok := starlark.AsString(item[0])
+			value, ok2 := starlark.AsString(item[1])
+			if !ok || !ok2 || !headerName.MatchString(name) {
+				return nil, fmt.Errorf("%v: headers must map header names to strings, got %v: %v", fn, item[0], item[1])
+			}
+			d.headers[name] = value
+		}
+	}
+	return d, nil
+}
+
+// script is a loaded script, whose handle function is called with every
+// request. Its globals are frozen, so that it can run on several requests at
+// once.
+type script struct {
+	path   string
+	handle starlark.Callable
+}
+
+func loadScript(path string) (*script, error) {
+	if path == "" {
+		return nil, nil
+	}
+	thread := &starlark.Thread{Name: "load " + path}
+	timer := time.AfterFunc(scriptLoadTimeout, func() { thread.Cancel("timeout") })
+	defer timer.Stop()
+
+	globals, err := starlark.ExecFile(thread, path, nil, scriptBuiltins)
+	if err != nil {
+		return nil, err
+	}
+	globals.Freeze()
+	handle, ok := globals["handle"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%v: no handle function", path)
+	}
+	return &script{path: path, handle: handle}, nil
+}
+
+// requestValue gives req to the script as a struct with the method, host,
+// path, query, client and tags of the request, and its headers as a dict of
+// lower case names to their values joined by commas.
+func requestValue(req *http.Request, ip string, tags []string) starlark.Value {
+	headers := starlark.NewDict(len(req.Header))
+	for name, values := range req.Header {
+		headers.SetKey(starlark.String(strings.ToLower(name)), starlark.String(strings.Join(values, ", ")))
+	}
+	tagList := make([]starlark.Value, len(tags))
+	for i, t := range tags {
+		tagList[i] = starlark.String(t)
+	}
+	return starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+		"method":  starlark.String(req.Method),
+		"host":    starlark.String(req.Host),
+		"path":    starlark.String(req.URL.Path),
+		"query":   starlark.String(req.URL.RawQuery),
+		"client":  starlark.String(ip),
+		"tags":    starlark.NewList(tagList),
+		"headers": headers,
+	})
+}
+
+// decide runs the script on req. It fails once timeout has passed.
+func (sc *script) decide(req *http.Request, ip string, tags []string, timeout time.Duration) (*scriptDecision, error) {
+	thread := &starlark.Thread{Name: "handle"}
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() { thread.Cancel("timeout") })
+		defer timer.Stop()
+	}
+	v, err := starlark.Call(thread, sc.handle, starlark.Tuple{requestValue(req, ip, tags)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return &scriptDecision{action: "forward"}, nil
+	case *scriptDecision:
+		return v, nil
+	}
+	return nil, fmt.Errorf("handle returned a %v, not a decision", v.Type())
+}
+
+// scriptStore holds the script of the config, reloaded with it.
+type scriptStore struct {
+	atomic.Pointer[script]
+	config *ConfigStore
+	log    *slog.Logger
+	mu     sync.Mutex
+}
+
+func newScriptStore(config *ConfigStore) (*scriptStore, error) {
+	store := &scriptStore{config: config, log: slog.With("component", "script")}
+	sc, err := loadScript(config.Load().Script.Path)
+	if err != nil {
+		return nil, err
+	}
+	store.Store(sc)
+	return store, nil
+}
+
+// reload loads the script again, keeping the current one when it fails.
+func (store *scriptStore) reload() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	path := store.config.Load().Script.Path
+	sc, err := loadScript(path)
+	if err != nil {
+		store.log.Error("Keeping current script, reload failed", "error", err)
+		return err
+	}
+	store.Store(sc)
+	if sc != nil {
+		store.log.Info("Script reloaded", "path", path)
+	}
+	return nil
+}
+
+// apply runs the script on req, adding its tags to state, and returns the
+// response to serve instead of forwarding req, if any. A script failing is
+// counted, and req forwarded unchanged.
+func (store *scriptStore) apply(req *http.Request, state *requestState) *http.Response {
+	sc := store.Load()
+	if sc == nil {
+		return nil
+	}
+	cfg := store.config.Load().Script
+	log := store.log.With("request_id", state.id)
+	d, err := sc.decide(req, state.exchange.ClientIP, state.tags, cfg.Timeout)
+	if err != nil {
+		scriptErrors.Add(1)
+		log.Warn("Script failed, request passed through", "error", err)
+		return nil
+	}
+	for _, tag := range d.tags {
+		if !slices.Contains(state.tags, tag) {
+			state.tags = append(state.tags, tag)
+		}
+	}
+
+	switch d.action {
+	case "block":
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, d.status, d.body)
+	case "respond":
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeHtml, d.status, d.body)
+		for name, value := range d.headers {
+			resp.Header.Set(name, value)
+		}
+		return resp
+	case "tarpit":
+		t := time.NewTimer(min(d.delay, cfg.MaxTarpit))
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+		}
+	case "forward":
+		for name, value := range d.headers {
+			if value == "" {
+				req.Header.Del(name)
+			} else {
+				req.Header.Set(name, value)
+			}
+		}
+	}
+	return nil
+}
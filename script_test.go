@@ -0,0 +1,255 @@
+package stuffpot
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeScript writes src to a script file and returns its path.
+func writeScript(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "handle.star")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScriptSeesTheRequest(t *testing.T) {
+	sc, err := loadScript(writeScript(t, `
+def handle(req):
+    return respond(body = "|".join([req.method, req.host, req.path, req.query, req.client, ",".join(req.tags),
+                                    req.headers["user-agent"], req.headers["x-multi"]]))
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "http://example.com/login?next=%2F", nil)
+	req.Header.Set("User-Agent", "curl/8.5.0")
+	req.Header.Add("X-Multi", "a")
+	req.Header.Add("X-Multi", "b")
+	d, err := sc.decide(req, "192.0.2.1", []string{"scanner", "tor-exit"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "POST|example.com|/login|next=%2F|192.0.2.1|scanner,tor-exit|curl/8.5.0|a, b"; d.body != want {
+		t.Errorf("the script saw %q, want %q", d.body, want)
+	}
+}
+
+func TestScriptDecisions(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want scriptDecision
+		err  string
+	}{
+		{"none forwards", "None", scriptDecision{action: "forward"}, ""},
+		{"forward", `forward(headers = {"X-Honeypot": "1", "Cookie": ""}, tags = ["seen"])`,
+			scriptDecision{action: "forward", tags: []string{"seen"},
+				headers: map[string]string{"X-Honeypot": "1", "Cookie": ""}}, ""},
+		{"block", "block()", scriptDecision{action: "block", status: 403, body: "Forbidden"}, ""},
+		{"block with status", `block(status = 451, body = "gone", tags = ("legal",))`,
+			scriptDecision{action: "block", status: 451, body: "gone", tags: []string{"legal"}}, ""},
+		{"respond", `respond(status = 200, body = "<h1>ok</h1>", headers = {"Server": "nginx"})`,
+			scriptDecision{action: "respond", status: 200, body: "<h1>ok</h1>",
+				headers: map[string]string{"Server": "nginx"}}, ""},
+		{"tarpit", "tarpit(1.5)", scriptDecision{action: "tarpit", delay: 1500 * time.Millisecond}, ""},
+		{"tarpit of an int", "tarpit(2)", scriptDecision{action: "tarpit", delay: 2 * time.Second}, ""},
+		{"negative tarpit", "tarpit(-1)", scriptDecision{}, "tarpit: negative seconds"},
+		{"tarpit of a string", `tarpit("1")`, scriptDecision{}, "tarpit: seconds must be a number, got string"},
+		{"invalid status", "block(status = 700)", scriptDecision{}, "block: invalid status 700"},
+		{"empty tag", `forward(tags = [""])`, scriptDecision{}, "tags must be non-empty strings"},
+		{"tag not a string", "forward(tags = [1])", scriptDecision{}, "tags must be non-empty strings"},
+		{"invalid header name", `forward(headers = {"bad name": "x"})`, scriptDecision{},
+			"headers must map header names to strings"},
+		{"unknown argument", "block(reason = 1)", scriptDecision{}, "unexpected keyword argument"},
+		{"not a decision", `"forward"`, scriptDecision{}, "handle returned a string, not a decision"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := loadScript(writeScript(t, "def handle(req):\n    return "+tt.src+"\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := sc.decide(httptest.NewRequest("GET", "http://example.com/", nil), "192.0.2.1", nil, time.Second)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.action != tt.want.action || d.status != tt.want.status || d.body != tt.want.body ||
+				d.delay != tt.want.delay || !slices.Equal(d.tags, tt.want.tags) || len(d.headers) != len(tt.want.headers) {
+				t.Errorf("got %+v, want %+v", *d, tt.want)
+			}
+			for name, value := range tt.want.headers {
+				if v, ok := d.headers[name]; !ok || v != value {
+					t.Errorf("header %v: got %q, want %q", name, v, value)
+				}
+			}
+		})
+	}
+}
+
+func TestScriptSandbox(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"no modules", "load(\"os.star\", \"system\")\ndef handle(req):\n    return None\n", "load not implemented"},
+		{"no handle", "x = 1\n", "no handle function"},
+		{"no while loops", "def handle(req):\n    while True:\n        pass\n", "does not support while loops"},
+		{"no recursion at load", "def f():\n    return f()\nf()\ndef handle(req):\n    return None\n",
+			"called recursively"},
+		{"load timeout", "x = [i for i in range(100000000000) for j in range(1000000)]\ndef handle(req):\n    return None\n",
+			"timeout"},
+		{"no open", "def handle(req):\n    return open(\"/etc/passwd\")\n", "undefined: open"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			_, err := loadScript(writeScript(t, tt.src))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error with %q", err, tt.err)
+			}
+			if time.Since(start) > scriptLoadTimeout+time.Second {
+				t.Errorf("loading took %v", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestScriptLimitsOfHandle(t *testing.T) {
+	sc, err := loadScript(writeScript(t, `
+seen = []
+
+def handle(req):
+    if req.path == "/spin":
+        for i in range(100000000000):
+            pass
+    if req.path == "/mutate":
+        seen.append(req.client)
+    if req.path == "/recurse":
+        return handle(req)
+    if req.path == "/tags":
+        req.tags.append("added")
+    return None
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		err  string
+	}{
+		{"/spin", "timeout"},
+		{"/mutate", "frozen list"},
+		{"/recurse", "called recursively"},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		_, err := sc.decide(httptest.NewRequest("GET", "http://example.com"+tt.path, nil), "192.0.2.1", nil,
+			50*time.Millisecond)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: got %v, want an error with %q", tt.path, err, tt.err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%v: took %v with a timeout of 50ms", tt.path, elapsed)
+		}
+	}
+
+	// The request's tags are a copy, the script adds to them through its
+	// decision only.
+	tags := []string{"scanner"}
+	if _, err := sc.decide(httptest.NewRequest("GET", "http://example.com/tags", nil), "192.0.2.1", tags,
+		time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 {
+		t.Errorf("the script changed the tags to %v", tags)
+	}
+}
+
+func TestScriptStoreApply(t *testing.T) {
+	path := writeScript(t, `
+def handle(req):
+    if req.path == "/block":
+        return block(status = 404, body = "nope", tags = ["blocked"])
+    if req.path == "/respond":
+        return respond(body = "fake", headers = {"Server": "Apache"}, tags = ["scanner"])
+    if req.path == "/tarpit":
+        return tarpit(3600)
+    if req.path == "/fail":
+        fail("boom")
+    return forward(headers = {"X-Seen": "yes", "Cookie": ""})
+`)
+	config := testConfig(t, "-script", path, "-script-max-tarpit", "20ms")
+	store, err := newScriptStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply := func(p string) (*http.Request, *requestState, *http.Response) {
+		req := httptest.NewRequest("GET", "http://example.com"+p, nil)
+		req.Header.Set("Cookie", "session=1")
+		state := &requestState{id: "r1", tags: []string{"scanner"}}
+		state.exchange = &Exchange{ClientIP: "192.0.2.1"}
+		return req, state, store.apply(req, state)
+	}
+
+	_, state, resp := apply("/block")
+	if resp == nil || resp.StatusCode != 404 || !slices.Equal(state.tags, []string{"scanner", "blocked"}) {
+		t.Errorf("block: got %v with tags %v", resp, state.tags)
+	} else if body, _ := io.ReadAll(resp.Body); string(body) != "nope" {
+		t.Errorf("block: got body %q", body)
+	}
+
+	_, state, resp = apply("/respond")
+	if resp == nil || resp.StatusCode != 200 || resp.Header.Get("Server") != "Apache" || len(state.tags) != 1 {
+		t.Errorf("respond: got %v with tags %v", resp, state.tags)
+	}
+
+	start := time.Now()
+	if _, _, resp = apply("/tarpit"); resp != nil {
+		t.Errorf("tarpit: got %v, want the request forwarded", resp.Status)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond || elapsed > time.Second {
+		t.Errorf("tarpit: held the request %v, want the 20ms of -script-max-tarpit", elapsed)
+	}
+
+	req, _, resp := apply("/forward")
+	if resp != nil || req.Header.Get("X-Seen") != "yes" || req.Header.Get("Cookie") != "" {
+		t.Errorf("forward: got %v with headers %v", resp, req.Header)
+	}
+
+	before := scriptErrors.Load()
+	req, state, resp = apply("/fail")
+	if resp != nil || req.Header.Get("Cookie") == "" || len(state.tags) != 1 {
+		t.Errorf("a failing script changed the request: %v %v %v", resp, req.Header, state.tags)
+	}
+	if scriptErrors.Load() != before+1 {
+		t.Error("the script's failure wasn't counted")
+	}
+
+	// A script which fails to load on reload leaves the current one.
+	if err := os.WriteFile(path, []byte("def handle(req) syntax error"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.reload(); err == nil {
+		t.Error("reloading a broken script succeeded")
+	}
+	if _, _, resp = apply("/block"); resp == nil {
+		t.Error("the script was dropped by a failed reload")
+	}
+}
@@ -0,0 +1,214 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// errSearchDisabled is returned by searches of a database without the
+	// index.
+	errSearchDisabled = errors.New("search is disabled, see -search")
+	// errInvalidSearch is returned for queries FTS5 can't parse.
+	errInvalidSearch = errors.New("invalid query")
+)
+
+// enableSearch creates the request_search index if needed, and has the
+// requests logged from now on indexed in it. SQLite needs to be built with
+// FTS5.
+func (logger *HttpLogger) enableSearch() error {
+	_, err := logger.db.Exec("create virtual table if not exists request_search using fts5(url, headers, body)")
+	if err == nil {
+		// An existing index is only loaded once read.
+		_, err = logger.db.Exec("select rowid from request_search limit 0")
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return errors.New("search needs a build with -tags sqlite_fts5")
+		}
+		return fmt.Errorf("create search index: %w", err)
+	}
+	logger.search = true
+	return nil
+}
+
+// hasSearch tells whether the database has the search index, whether or not
+// it's enabled.
+func hasSearch(tx *sql.Tx) (bool, error) {
+	var n int
+	err := tx.QueryRow("select count(*) from sqlite_master where name = 'request_search'").Scan(&n)
+	return n > 0, err
+}
+
+// indexRequest indexes the request of ex, logged as the row id, with the
+// bodies read by the time it's logged unless they're left out.
+func (logger *HttpLogger) indexRequest(tx *sql.Tx, id int64, ex *Exchange, headers string, bodies bool) error {
+	var body string
+	if bodies {
+		ex.state.mu.Lock()
+		body = strings.Join(ex.state.bodies, "\n")
+		ex.state.mu.Unlock()
+	}
+	_, err := tx.Exec("insert into request_search (rowid, url, headers, body) values (?,?,?,?)",
+		id, ex.Request.URL.String(), headers, body)
+	if err != nil {
+		return fmt.Errorf("index request: %w", err)
+	}
+	return nil
+}
+
+// searchQuery is a search of /api/search, in the FTS5 query syntax.
+type searchQuery struct {
+	Query string
+	Limit int
+}
+
+// parseSearchQuery reads the parameters of /api/search.
+func parseSearchQuery(values url.Values) (*searchQuery, error) {
+	q := &searchQuery{Query: strings.TrimSpace(values.Get("q")), Limit: defaultPageSize}
+	if q.Query == "" {
+		return nil, errors.New("q: must not be empty")
+	}
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("limit: expected a positive number")
+		}
+		q.Limit = min(n, maxPageSize)
+	}
+	return q, nil
+}
+
+// searchResult is a request matched by a search, with the best matching
+// part of its URL, headers or bodies, the terms marked.
+type searchResult struct {
+	listedRequest
+	Snippet string `json:"snippet"`
+}
+
+// searchRequests returns the requests matching q, the most relevant first.
+func (logger *HttpLogger) searchRequests(ctx context.Context, q *searchQuery) ([]searchResult, error) {
+	if !logger.search {
+		return nil, errSearchDisabled
+	}
+	rows, err := logger.db.QueryContext(ctx, `select r.id, coalesce(r.request_id, ''), coalesce(r.parent_id, ''),
+      coalesce(r.from_ip, ''), coalesce(r.method, ''), coalesce(r.host, ''), coalesce(r.url, ''), coalesce(r.status, 0),
+      coalesce(r.size, 0), coalesce(r.tags, ''), coalesce(r.fingerprint, ''), coalesce(r.occurrences, 1),
+      coalesce(r.last_seen, r.created_at, ''), coalesce(r.created_at, ''),
+      snippet(request_search, -1, '<mark>', '</mark>', '…', 24)
+      from request_search join requests r on r.id = request_search.rowid
+      where request_search match ? order by rank limit ?`, q.Query, q.Limit)
+	if err != nil {
+		return nil, searchError(err)
+	}
+	defer rows.Close()
+	results := []searchResult{}
+	for rows.Next() {
+		var r searchResult
+		var tags string
+		if err := rows.Scan(&r.ID, &r.RequestID, &r.ParentID, &r.Client, &r.Method, &r.Host, &r.URL, &r.Status,
+			&r.Size, &tags, &r.Fingerprint, &r.Occurrences, &r.LastSeen, &r.CreatedAt, &r.Snippet); err != nil {
+			return nil, searchError(err)
+		}
+		r.Tags = []string{}
+		if tags != "" {
+			r.Tags = strings.Split(tags, ",")
+		}
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, searchError(err)
+	}
+	return results, nil
+}
+
+// searchError tells the queries FTS5 couldn't parse from the other errors.
+// They're only reported once the query runs.
+func searchError(err error) error {
+	msg := err.Error()
+	if strings.HasPrefix(msg, "fts5:") || strings.HasPrefix(msg, "no such column") ||
+		strings.HasPrefix(msg, "unknown special query") {
+		return fmt.Errorf("%w: %v", errInvalidSearch, msg)
+	}
+	return fmt.Errorf("search requests: %w", err)
+}
+
+// backfillSearch indexes the requests missing from the search index, and
+// drops the rows of the requests deleted. Bodies aren't stored, the requests
+// are indexed by their URL and headers only.
+func (logger *HttpLogger) backfillSearch() (int64, error) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	tx, err := logger.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("delete from request_search where rowid not in (select id from requests)"); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`insert into request_search (rowid, url, headers, body)
+      select id, coalesce(url, ''), coalesce(headers, ''), '' from requests
+      where id not in (select rowid from request_search)`)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// reindexFTSCommand implements the reindex-fts subcommand:
+//
+//	stuffpot reindex-fts [-db path]
+//
+// It creates the search index of the database and of its daily files, and
+// indexes the requests logged without it.
+func reindexFTSCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot reindex-fts", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	fs.Parse(args)
+
+	paths, err := databaseFiles(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, p := range paths {
+		var n int64
+		logger, err := NewLogger("file:" + p + "?_busy_timeout=10000")
+		if err == nil {
+			if err = logger.enableSearch(); err == nil {
+				n, err = logger.backfillSearch()
+			}
+			logger.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", p, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%v: %d requests indexed\n", p, n)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,443 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const selftestHeader = "X-Stuffpot-Selftest"
+
+// selftestConcurrency is the number of requests sent at once to check that
+// concurrent requests are each logged. Built with -race, the selftest also
+// checks the logging for data races.
+const selftestConcurrency = 200
+
+// selftestRow is the part of a requests row checked by the selftest.
+type selftestRow struct {
+	Method string
+	Host   string
+	URL    string
+	FromIP string
+	// Header is the logged value of the selftest header.
+	Header string
+	// Anomalies is the parse_anomalies column, and Received what the target
+	// received of the raw requests.
+	Anomalies string
+	Received  string
+}
+
+func (r selftestRow) String() string {
+	s := fmt.Sprintf("%v %v host=%v from=%v %v=%q", r.Method, r.URL, r.Host, r.FromIP, strings.ToLower(selftestHeader), r.Header)
+	if r.Anomalies != "" || r.Received != "" {
+		s += fmt.Sprintf(" anomalies=%v received: %v", r.Anomalies, r.Received)
+	}
+	return s
+}
+
+// selftestRawCases are requests sent as raw bytes, to the proxy or through a
+// CONNECT tunnel parsed as HTTP, each with an oddity which net/http smooths
+// over. The row must record it, and the target get the request as it was
+// sent. {host} and {token} are replaced by the target and the selftest token.
+var selftestRawCases = []struct {
+	name   string
+	tunnel bool
+	method string
+	path   string
+	raw    string
+	// status is that of the response, and anomalies the parse_anomalies
+	// logged; requests answered with a 400 aren't logged.
+	status    int
+	anomalies string
+	received  string
+}{
+	{"folded header", false, "GET", "/raw/folded",
+		"GET http://{host}/raw/folded HTTP/1.1\r\nHost: {host}\r\nX-Folded: one\r\n two\r\nX-Stuffpot-Selftest: {token}\r\n\r\n",
+		200, `{"folded_headers":["X-Folded"]}`, `ua="" folded="one two" body="" trailer=map[]`},
+	{"duplicate Content-Length", false, "POST", "/raw/length",
+		"POST http://{host}/raw/length HTTP/1.1\r\nHost: {host}\r\nContent-Length: 3\r\nContent-Length: 3\r\n" +
+			"X-Stuffpot-Selftest: {token}\r\n\r\nabc",
+		200, `{"content_lengths":["3","3"],"content_length_used":"3"}`, `ua="" folded="" body="abc" trailer=map[]`},
+	{"undeclared trailer", false, "POST", "/raw/trailer",
+		"POST http://{host}/raw/trailer HTTP/1.1\r\nHost: {host}\r\nTransfer-Encoding: chunked\r\n" +
+			"X-Stuffpot-Selftest: {token}\r\n\r\n3\r\nabc\r\n0\r\nX-Trailer: yes\r\n\r\n",
+		200, `{"trailers":{"X-Trailer":["yes"]}}`, `ua="" folded="" body="abc" trailer=map[X-Trailer:[yes]]`},
+	{"HTTP/1.0 without Host", false, "GET", "/raw/nohost",
+		"GET http://{host}/raw/nohost HTTP/1.0\r\nX-Stuffpot-Selftest: {token}\r\n\r\n",
+		200, `{"missing_host":true}`, `ua="" folded="" body="" trailer=map[]`},
+	{"bare LF line endings", false, "GET", "/raw/lf",
+		"GET http://{host}/raw/lf HTTP/1.1\nHost: {host}\nX-Stuffpot-Selftest: {token}\n\n",
+		200, `{"bare_lf":true}`, `ua="" folded="" body="" trailer=map[]`},
+	{"absolute-form target in a tunnel", true, "GET", "/raw/tunnel-absolute",
+		"GET http://{host}/raw/tunnel-absolute HTTP/1.1\r\nHost: {host}\r\nX-Stuffpot-Selftest: {token}\r\n\r\n",
+		200, `{"target_form":"absolute"}`, `ua="" folded="" body="" trailer=map[]`},
+	{"folded header in a tunnel", true, "GET", "/raw/tunnel-folded",
+		"GET /raw/tunnel-folded HTTP/1.1\r\nHost: {host}\r\nX-Folded: one\r\n\ttwo\r\nX-Stuffpot-Selftest: {token}\r\n\r\n",
+		200, `{"folded_headers":["X-Folded"]}`, `ua="" folded="one two" body="" trailer=map[]`},
+	{"undeclared trailer in a tunnel", true, "POST", "/raw/tunnel-trailer",
+		"POST /raw/tunnel-trailer HTTP/1.1\r\nHost: {host}\r\nTransfer-Encoding: chunked\r\n" +
+			"X-Stuffpot-Selftest: {token}\r\n\r\n3\r\nabc\r\n0\r\nX-Trailer: yes\r\n\r\n",
+		200, `{"trailers":{"X-Trailer":["yes"]}}`, `ua="" folded="" body="abc" trailer=map[X-Trailer:[yes]]`},
+	{"differing Content-Lengths in a tunnel", true, "POST", "/raw/tunnel-length",
+		"POST /raw/tunnel-length HTTP/1.1\r\nHost: {host}\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd",
+		400, "", ""},
+}
+
+// selftestCommand implements the selftest subcommand:
+//
+//	stuffpot selftest [-config file] [flags]
+//
+// It runs the proxy on an ephemeral port with a database in memory, sends it
+// a request of each kind and checks the rows they produced. The flags are the
+// ones of the proxy, except those the selftest sets itself.
+func selftestCommand(args []string) {
+	handler, err := newLogHandler(os.Stderr, "text")
+	orPanic(err)
+	logLevel.Set(slog.LevelWarn)
+	slog.SetDefault(slog.New(handler))
+
+	if err := selftest(os.Stdout, args); err != nil {
+		fmt.Fprintln(os.Stderr, "selftest failed:", err)
+		os.Exit(1)
+	}
+}
+
+func selftest(w io.Writer, args []string) error {
+	dir, err := os.MkdirTemp("", "stuffpot-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "selftest.db")
+
+	// received is what the target received of the raw requests, by path.
+	var received sync.Map
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/raw/") {
+			body, _ := io.ReadAll(r.Body)
+			received.Store(r.URL.Path, fmt.Sprintf("ua=%q folded=%q body=%q trailer=%v", r.UserAgent(),
+				r.Header.Get("X-Folded"), body, r.Trailer))
+		}
+		fmt.Fprintln(w, "stuffpot selftest")
+	})
+	plain := httptest.NewServer(target)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(target)
+	defer secure.Close()
+	plainHost, secureHost := plain.Listener.Addr().String(), secure.Listener.Addr().String()
+
+	// The memory store is the default, and the selftest's own flags come
+	// last to override the given ones.
+	config, err := NewConfigStore("stuffpot selftest", append(append([]string{"-store", "memory"}, args...),
+		"-addr", "127.0.0.1:0", "-admin-addr", "", "-db", dbPath, "-db-rollover", "none", "-access-log", "",
+		"-mitm-ports", hostPort(secureHost), "-mitm-skip", "", "-http-ports", hostPort(plainHost), "-blocklist", ""))
+	if err != nil {
+		return err
+	}
+	if cfg := config.Load(); cfg.Mitm.CACert != "" {
+		if err := LoadCA(cfg.Mitm.CACert, cfg.Mitm.CAKey); err != nil {
+			return err
+		}
+	}
+
+	// The memory store is read once the server is shut down, which would close
+	// it.
+	var mem *HttpLogger
+	var db Logger
+	if config.Load().Storage.Store == "memory" {
+		if mem, err = NewMemoryLogger(config.Load().Storage.MaxRecords); err != nil {
+			return err
+		}
+		defer mem.Close()
+		db = keepOpen{mem}
+	}
+	server, err := NewServer(config, db)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		server.Shutdown(context.Background())
+		return err
+	}
+	go server.Serve(ln)
+	proxyAddr := ln.Addr().String()
+
+	token := newID()
+	var concurrent []selftestRow
+	for i := range selftestConcurrency {
+		target := fmt.Sprintf("http://%v/concurrent/%d", plainHost, i)
+		concurrent = append(concurrent, selftestRow{"GET", plainHost, target, "127.0.0.1", token, "", ""})
+	}
+	checks := []struct {
+		name string
+		send func() error
+		want []selftestRow
+	}{
+		{
+			"plain HTTP request",
+			func() error { return selftestGet(proxyAddr, "http://"+plainHost+"/plain", token) },
+			[]selftestRow{{"GET", plainHost, "http://" + plainHost + "/plain", "127.0.0.1", token, "", ""}},
+		},
+		{
+			"HTTPS request through CONNECT and MITM",
+			func() error { return selftestGet(proxyAddr, "https://"+secureHost+"/mitm", token) },
+			[]selftestRow{{"GET", secureHost, "https://" + secureHost + "/mitm", "127.0.0.1", token, "", ""}},
+		},
+		{
+			"HTTP request through a CONNECT tunnel",
+			func() error { return selftestTunnel(proxyAddr, plainHost, "/tunnel", token) },
+			[]selftestRow{{"GET", plainHost, "http://" + plainHost + "/tunnel", "127.0.0.1", token, "", ""}},
+		},
+		{
+			fmt.Sprintf("%d concurrent plain HTTP requests", selftestConcurrency),
+			func() error {
+				errs := make([]error, len(concurrent))
+				var wg sync.WaitGroup
+				for i, r := range concurrent {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						errs[i] = selftestGet(proxyAddr, r.URL, token)
+					}()
+				}
+				wg.Wait()
+				return errors.Join(errs...)
+			},
+			concurrent,
+		},
+	}
+	for _, c := range selftestRawCases {
+		raw := strings.NewReplacer("{host}", plainHost, "{token}", token).Replace(c.raw)
+		var want []selftestRow
+		if c.status == http.StatusOK {
+			want = append(want, selftestRow{c.method, plainHost, "http://" + plainHost + c.path, "127.0.0.1", token,
+				c.anomalies, c.received})
+		}
+		checks = append(checks, struct {
+			name string
+			send func() error
+			want []selftestRow
+		}{"raw request: " + c.name, func() error { return selftestRaw(proxyAddr, plainHost, c.tunnel, raw, c.status) }, want})
+	}
+
+	sendErrs := make([]error, len(checks))
+	for i, c := range checks {
+		sendErrs[i] = c.send()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	var rows map[string]selftestRow
+	if mem != nil {
+		rows, err = selftestRows(mem.db)
+	} else {
+		rows, err = selftestFile(dbPath)
+	}
+	if err != nil {
+		return err
+	}
+	for url, r := range rows {
+		if v, ok := received.Load(strings.TrimPrefix(url, "http://"+plainHost)); ok {
+			r.Received = v.(string)
+			rows[url] = r
+		}
+	}
+
+	failed := 0
+	for i, c := range checks {
+		var diffs []string
+		for _, want := range c.want {
+			if got, ok := rows[want.URL]; !ok {
+				diffs = append(diffs, fmt.Sprintf("     - %v\n     + no row\n", want))
+			} else if got != want {
+				diffs = append(diffs, fmt.Sprintf("     - %v\n     + %v\n", want, got))
+			}
+		}
+		if sendErrs[i] == nil && len(diffs) == 0 {
+			fmt.Fprintf(w, "ok   %v\n", c.name)
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "FAIL %v\n", c.name)
+		if sendErrs[i] != nil {
+			fmt.Fprintf(w, "     request failed: %v\n", sendErrs[i])
+		}
+		if len(diffs) > 1 {
+			fmt.Fprintf(w, "     %d of %d rows missing or wrong, the first:\n", len(diffs), len(c.want))
+		}
+		if len(diffs) > 0 {
+			fmt.Fprint(w, diffs[0])
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// selftestGet gets target through the proxy, which intercepts HTTPS targets.
+func selftestGet(proxyAddr, target, token string) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr}),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(selftestHeader, token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// selftestTunnel opens a CONNECT tunnel to host and sends a plaintext request
+// for path through it.
+func selftestTunnel(proxyAddr, host, path, token string) error {
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT refused: %v", resp.Status)
+	}
+
+	req, err := http.NewRequest("GET", "http://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(selftestHeader, token)
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err = http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// selftestRaw sends raw to the proxy, or through a CONNECT tunnel to host,
+// and checks the status of the response.
+func selftestRaw(proxyAddr, host string, tunnel bool, raw string, status int) error {
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	br := bufio.NewReader(conn)
+	if tunnel {
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+		resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("CONNECT refused: %v", resp.Status)
+		}
+	}
+	if _, err := io.WriteString(conn, raw); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != status {
+		return fmt.Errorf("unexpected status %v, want %v", resp.Status, status)
+	}
+	return nil
+}
+
+// keepOpen keeps a Logger open when the server is shut down.
+type keepOpen struct {
+	Logger
+}
+
+func (keepOpen) Close() error {
+	return nil
+}
+
+// selftestFile reads the requests logged to the database file.
+func selftestFile(path string) (map[string]selftestRow, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return selftestRows(db)
+}
+
+// selftestRows reads the requests logged to db, by URL.
+func selftestRows(db *sql.DB) (map[string]selftestRow, error) {
+	rows, err := db.Query("select method, host, url, from_ip, headers, coalesce(parse_anomalies, '') from requests")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]selftestRow)
+	prefix := strings.ToLower(selftestHeader) + ": "
+	for rows.Next() {
+		var r selftestRow
+		var headers string
+		if err := rows.Scan(&r.Method, &r.Host, &r.URL, &r.FromIP, &headers, &r.Anomalies); err != nil {
+			return nil, err
+		}
+		for _, h := range strings.Split(headers, "\r\n") {
+			if v, ok := strings.CutPrefix(h, prefix); ok {
+				r.Header = v
+			}
+		}
+		res[r.URL] = r
+	}
+	return res, rows.Err()
+}
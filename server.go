@@ -0,0 +1,973 @@
+package stuffpot
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"github.com/elazarl/goproxy/transport"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// requestState is kept in ProxyCtx.UserData from the request handler until the
+// response is logged.
+type requestState struct {
+	id       string
+	parentID string
+	start    time.Time
+	tags     []string
+	details  *transport.RoundTripDetails
+	// login is set for login attempts, and credentials are those the
+	// request carries.
+	login       *loginAttempt
+	credentials []credential
+	// matches and session are set by the logging queue, before the request
+	// is logged.
+	matches []tagMatch
+	session *bruteSession
+	// visit is the session of the client the request is grouped into, set
+	// by the logging queue.
+	visit *clientSession
+	// check is the service checking the proxy with the request.
+	check string
+	// score is the client's once the request is scored.
+	score *clientScore
+	// issued is the honeytoken first injected into the response.
+	issued *honeytoken
+	// geo is the origin policy's match of the client, if any, and origin
+	// where the client is from, if located.
+	geo    *tagMatch
+	origin geoInfo
+	// ptr is the PTR name of the client's address, if resolved by the time
+	// the request is logged.
+	ptr string
+	// headers are the header names as sent, fingerprint their hash and label
+	// its name, set by the logging queue.
+	headers     []string
+	fingerprint string
+	label       string
+	// ja3 is the JA3 hash of the ClientHello of the MITM'd tunnel the
+	// request was read from, if any.
+	ja3 string
+	// source is where an imported request comes from, such as import:har,
+	// and importHash the hash of its record, which it's only imported once
+	// by.
+	source     string
+	importHash string
+	// rawHead is the head of the request as read from the client, kept for
+	// the raw store.
+	rawHead []byte
+
+	exchangeState
+}
+
+// tagNames returns the tags of the rules, the matches, the session and the
+// proxy check, without duplicates.
+func (state *requestState) tagNames() []string {
+	names := append([]string(nil), state.tags...)
+	for _, m := range state.matches {
+		if !slices.Contains(names, m.Tag) {
+			names = append(names, m.Tag)
+		}
+	}
+	if state.session != nil && !slices.Contains(names, state.session.Tag) {
+		names = append(names, state.session.Tag)
+	}
+	if state.check != "" && !slices.Contains(names, "proxy-check") {
+		names = append(names, "proxy-check")
+	}
+	return names
+}
+
+// countingBody counts the bytes of a response body read by the client, and
+// calls done once when it's closed.
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n) })
+	return err
+}
+
+type stoppableListener struct {
+	net.Listener
+	sync.WaitGroup
+}
+
+type stoppableConn struct {
+	net.Conn
+	wg   *sync.WaitGroup
+	once sync.Once
+}
+
+func newStoppableListener(l net.Listener) *stoppableListener {
+	return &stoppableListener{l, sync.WaitGroup{}}
+}
+
+func (sl *stoppableListener) Accept() (net.Conn, error) {
+	c, err := sl.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	sl.Add(1)
+	activeConns.Add(1)
+	return &stoppableConn{Conn: c, wg: &sl.WaitGroup}, nil
+}
+
+func (sc *stoppableConn) Close() error {
+	sc.once.Do(func() {
+		activeConns.Add(-1)
+		sc.wg.Done()
+	})
+	return sc.Conn.Close()
+}
+
+// waitTimeout waits for every accepted connection to be closed, including
+// hijacked ones which http.Server.Shutdown doesn't track, or for ctx to expire.
+func (sl *stoppableListener) waitTimeout(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		sl.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Server is the proxy with its sinks and admin API. It's built from a config
+// store which it keeps reading from, so reloads apply to running servers.
+type Server struct {
+	config *ConfigStore
+	log    *slog.Logger
+	logger *asyncLogger
+	health *health
+	rules  *ruleStore
+	script *scriptStore
+	brute  *bruteTracker
+	// sessions groups the requests of the clients into sessions.
+	sessions *sessionTracker
+	tor      *torExits
+	feeds    *feeds
+	geo      *geoIP
+	rdns     *reverseDNS
+	egress   *egressLimiter
+	limits   *clientLimiter
+	tarpit   *tarpit
+	auth     *proxyAuth
+	alerts   *alerter
+	certs    *certIssuer
+	scores   *scorer
+	checks   *proxyChecks
+	honey    *honeytokenStore
+	prints   *fingerprints
+	report   *reporter
+	// samples is nil without a quarantine directory.
+	samples *quarantine
+	// raw is nil without a raw directory.
+	raw *rawStore
+	// db is the database sink, which labels fingerprints.
+	db Logger
+	// dbLock is held on the database opened by the server, see purge.
+	dbLock *os.File
+	// sinks are those of the logger, to which RegisterSink adds.
+	sinks *multiLogger
+	hooks *hooks
+	// stream is the sink of /api/stream, and metrics that of /metrics.
+	stream  *liveStream
+	metrics *proxyMetrics
+
+	proxy *http.Server
+	admin *http.Server
+	debug *http.Server
+	// adminTLS holds the certificates of the admin server, if served over TLS.
+	adminTLS *adminTLSStore
+	// listenersMu guards the listeners below, set by the Serve methods while
+	// Shutdown may be reading them. socks and transparent are those of the
+	// SOCKS5 and redirected clients, if any.
+	listenersMu sync.Mutex
+	sl          *stoppableListener
+	socks       *stoppableListener
+	transparent *stoppableListener
+	// internal holds the ports of the admin and debug listeners.
+	internal sync.Map
+	// hellos are the ServerHellos of the connections of the transports.
+	hellos serverHellos
+	errc   chan error
+	// base is canceled by Shutdown, giving up on the dials in progress.
+	base context.Context
+	stop context.CancelFunc
+	// shutdown runs Shutdown once, its error being shutdownErr.
+	shutdown    sync.Once
+	shutdownErr error
+}
+
+// NewServer opens the sinks configured in config and sets up the proxy
+// handlers. Nothing is served until Start or Serve is called.
+//
+// db replaces the configured database when it isn't nil, and is closed by
+// Shutdown like the other sinks. The features reading back their state, such
+// as honeytokens and fingerprint labels, need one of the package's loggers.
+func NewServer(config *ConfigStore, db Logger) (*Server, error) {
+	cfg := config.Load()
+	log := slog.With("component", "listener")
+
+	var err error
+	var dbLock *os.File
+	if db == nil {
+		open, registered := registeredStore(cfg.Storage.Store)
+		switch {
+		case registered:
+			db, err = open(cfg.Storage.DSN)
+		case cfg.Storage.Store == "memory":
+			db, err = NewMemoryLogger(cfg.Storage.MaxRecords)
+		case cfg.Storage.Store == "sql":
+			db, err = NewSQLStore(cfg.Storage.Driver, cfg.Storage.DSN)
+		case cfg.Storage.Rollover == "daily":
+			db, err = NewRollingLogger(cfg.Storage.Path, cfg.Storage.RetainDays)
+		default:
+			db, err = NewLogger(cfg.Storage.Path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot open database: %w", err)
+		}
+		if cfg.Storage.Store == "sqlite" {
+			if dbLock, err = lockDatabase(cfg.Storage.Path, false); err != nil {
+				db.Close()
+				return nil, fmt.Errorf("cannot lock database: %w", err)
+			}
+		}
+	}
+	if d, ok := db.(interface{ setDedupe(time.Duration, bool) }); ok {
+		d.setDedupe(cfg.Storage.DedupeWindow, cfg.Storage.DedupeClient)
+	}
+	if d, ok := db.(interface{ setTrafficTop(int) }); ok {
+		d.setTrafficTop(cfg.Storage.HostTrafficTop)
+	}
+	if d, ok := db.(interface{ enableSearch() error }); ok && cfg.Storage.Search {
+		if err := d.enableSearch(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	rules, err := newRuleStore(config)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid rules: %w", err)
+	}
+	script, err := newScriptStore(config)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid script: %w", err)
+	}
+	s := &Server{config: config, log: log, health: &health{}, rules: rules, script: script, honey: newHoneytokenStore(),
+		prints: newFingerprints(), db: db, dbLock: dbLock, errc: make(chan error, 3)}
+	s.base, s.stop = context.WithCancel(context.Background())
+	if src, ok := db.(interface{ honeytokens() ([]honeytoken, error) }); ok {
+		tokens, err := src.honeytokens()
+		if err != nil {
+			log.Warn("Cannot read the issued honeytokens, they won't be recognized", "error", err)
+		}
+		s.honey.add(tokens)
+	}
+	if src, ok := db.(interface {
+		fingerprints() ([]clientFingerprint, error)
+	}); ok {
+		prints, err := src.fingerprints()
+		if err != nil {
+			log.Warn("Cannot read the fingerprints, their labels are lost", "error", err)
+		}
+		s.prints.add(prints)
+	}
+	s.hooks = &hooks{log: slog.With("component", "hooks")}
+	s.stream, s.metrics = newLiveStream(), newProxyMetrics()
+	sinks := multiLogger{s.hooks, db, s.stream, s.metrics}
+	s.health.registerSink("database", db)
+
+	if cfg.AccessLog.Path != "" {
+		al, err := NewAccessLog(cfg.AccessLog)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("cannot open access log: %w", err)
+		}
+		sinks = append(sinks, al)
+		s.health.registerSink("access-log", al)
+	}
+	if cfg.Syslog.Addr != "" {
+		sl, err := NewSyslog(cfg.Syslog)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("cannot set up syslog: %w", err)
+		}
+		sinks = append(sinks, sl)
+	}
+	if cfg.Elastic.URL != "" {
+		es := NewElastic(cfg.Elastic)
+		sinks = append(sinks, es)
+		s.health.registerSink("elasticsearch", es)
+	}
+	if len(cfg.Kafka.Brokers) > 0 {
+		sinks = append(sinks, NewKafka(cfg.Kafka))
+	}
+	if cfg.Pcap.Path != "" {
+		p, err := NewPcap(cfg.Pcap)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("cannot open pcap file: %w", err)
+		}
+		sinks = append(sinks, p)
+	}
+	// The writes of the components below are queued like the exchanges, the
+	// database being only written by the goroutine of the queue.
+	s.samples, err = newQuarantine(cfg.Quarantine, func(sm *sample) {
+		if db, ok := db.(interface{ logSample(s *sample) error }); ok {
+			err := s.logger.enqueue(context.Background(), "sample", sm.RequestID, func(context.Context) error {
+				return db.logSample(sm)
+			}, nil)
+			logFailed(slog.With("component", "quarantine", "request_id", sm.RequestID), "sample", err)
+		}
+	})
+	if err != nil {
+		sinks.Close()
+		return nil, fmt.Errorf("cannot open quarantine: %w", err)
+	}
+	s.tor = newTorExits(config)
+	s.feeds = newFeeds(cfg.Feeds)
+	s.geo = newGeoIP(cfg.Geo)
+	s.rdns = newReverseDNS(config)
+	s.egress = newEgressLimiter()
+	s.limits = newClientLimiter(config)
+	s.tarpit = newTarpit(config)
+	s.auth = newProxyAuth(config)
+	s.alerts = newAlerter(config)
+	s.certs, err = newCertIssuer(cfg.Mitm, func(f *tlsFailure) {
+		if db, ok := db.(interface{ logTLSFailure(f *tlsFailure) error }); ok {
+			err := s.logger.enqueue(context.Background(), "TLS failure", f.TunnelID, func(context.Context) error {
+				return db.logTLSFailure(f)
+			}, nil)
+			logFailed(slog.With("component", "mitm", "tunnel_id", f.TunnelID), "TLS failure", err)
+		}
+	})
+	if err != nil {
+		sinks.Close()
+		return nil, err
+	}
+	if s.raw, err = newRawStore(cfg.Storage.RawDir); err != nil {
+		sinks.Close()
+		return nil, fmt.Errorf("cannot open raw directory: %w", err)
+	}
+	if s.adminTLS, err = newAdminTLSStore(config); err != nil {
+		sinks.Close()
+		return nil, err
+	}
+	s.scores = newScorer(config)
+	s.report = newReporter(config, s.alerts)
+	s.checks = newProxyChecks(func(service, ip string) {
+		slog.Warn("Proxy validated by a checker, real traffic should follow", "component", "proxy-check",
+			"service", service, "client", ip)
+		s.alerts.check(alert{Time: time.Now(), Kind: "proxy-check", ClientIP: ip, Detail: "checked by " + service})
+	})
+	s.sessions = newSessionTracker(config)
+	s.brute = newBruteTracker(config, func(session bruteSession) {
+		slog.Warn("Brute force detected", "component", "bruteforce", "session_id", session.ID,
+			"client", session.ClientIP, "attempts", session.Attempts, "usernames", session.Usernames)
+		s.alerts.check(alert{Time: session.Updated, Kind: "bruteforce", ID: session.ID, ClientIP: session.ClientIP,
+			Detail: fmt.Sprintf("%d login attempts with %d usernames since %v", session.Attempts, session.Usernames,
+				session.Started.UTC().Format(time.RFC3339))})
+	})
+	s.sinks = &sinks
+	s.logger = newAsyncLogger(s.sinks, cfg.Limits, func(ex *Exchange) {
+		if state, req := ex.state, ex.Request; state != nil {
+			ip := ex.ClientIP
+			state.matches = rules.Load().detect(req)
+			if m, ok := s.tor.lookup(ip); ok {
+				state.matches = append(state.matches, m)
+			}
+			state.matches = append(state.matches, s.feeds.match(ip, req.Host)...)
+			if m, ok := s.certs.pins.lookup(ip); ok {
+				state.matches = append(state.matches, m)
+			}
+			if state.geo != nil {
+				state.matches = append(state.matches, *state.geo)
+			}
+			state.ptr = s.rdns.name(ip)
+			state.session = s.brute.observe(ip, state.login, state.start)
+			if state.visit = s.sessions.observe(ip, ex.JA3, req.UserAgent(), state.start); state.visit != nil {
+				ex.SessionID = state.visit.ID
+			}
+			s.tarpit.observe(ip, state)
+			if state.check = rules.Load().proxyCheck(req); state.check != "" {
+				s.checks.observe(state.check, ip)
+			}
+			for _, m := range s.honey.recall(req) {
+				state.matches = append(state.matches, m)
+				if t := s.honey.get(m.Match); t != nil {
+					slog.Warn("Honeytoken recalled", "component", "honeytokens", "request_id", state.id, "client", ip,
+						"rule", t.Rule, "issued_to", t.ClientIP, "issued_in", t.RequestID, "issued_at", t.IssuedAt)
+					al := newAlert("honeytoken", state.id, req, nil, nil, state.start)
+					al.Detail = fmt.Sprintf("token of rule %v issued to %v in request %v at %v", t.Rule, t.ClientIP,
+						t.RequestID, t.IssuedAt.UTC().Format(time.RFC3339))
+					s.alerts.check(al)
+				}
+			}
+			if state.fingerprint != "" {
+				state.label = s.prints.observe(state.fingerprint, state.headers, state.start)
+			}
+			for _, scan := range state.takeScans() {
+				state.matches = append(state.matches, scan()...)
+			}
+			score := s.scores.observe(ip, state, req.URL.Hostname())
+			state.score = &score
+			ex.Tags, ex.Matches = state.tagNames(), state.matches
+			s.raw.storeExchange(ex)
+		}
+	})
+
+	handler := slog.Default().Handler()
+	s.proxy = &http.Server{
+		Handler:     recoverHandler(log, s.newProxy()),
+		ConnContext: withClientConn,
+		ErrorLog:    slog.NewLogLogger(handler.WithAttrs([]slog.Attr{slog.String("component", "listener")}), slog.LevelWarn),
+	}
+	s.admin = &http.Server{
+		Handler:  s.adminAuth(newAdminHandler(s)),
+		ErrorLog: slog.NewLogLogger(handler.WithAttrs([]slog.Attr{slog.String("component", "admin")}), slog.LevelWarn),
+	}
+	s.admin.TLSConfig = s.adminTLS.serverConfig()
+	s.debug = &http.Server{
+		Handler:  newDebugHandler(),
+		ErrorLog: slog.NewLogLogger(handler.WithAttrs([]slog.Attr{slog.String("component", "debug")}), slog.LevelWarn),
+	}
+
+	go s.tor.run()
+	go s.report.run()
+	go s.alerts.run()
+	s.feeds.run()
+	if cfg.Rules.Watch {
+		if err := rules.watch(); err != nil {
+			log.Warn("Cannot watch rule files, they're only reloaded on SIGHUP", "error", err)
+		}
+	}
+	servers.Store(s, true)
+	return s, nil
+}
+
+func (s *Server) newProxy() *goproxy.ProxyHttpServer {
+	config, logger, rules, feeds, scores, honey, samples, log := s.config, s.logger, s.rules, s.feeds, s.scores, s.honey, s.samples, s.log
+
+	proxy := goproxy.NewProxyHttpServer()
+	// goproxy filters its informational messages itself, the level decides
+	// whether they're printed.
+	proxy.Verbose = true
+	proxy.Logger = goproxyLogger{slog.With("component", "goproxy")}
+	// The clients of MITM'd tunnels negotiating h2 are served over HTTP/2.
+	proxy.AllowHTTP2 = true
+
+	// The connections of the transports record the remotes' ServerHellos,
+	// for the JA3S of the requests sent over TLS.
+	dial := func(network, addr string) (net.Conn, error) {
+		conn, err := s.dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return s.hellos.wrap(conn, addr), nil
+	}
+	tr := transport.Transport{
+		Dial:  dial,
+		Proxy: transport.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{
+			// Ignore cert errors
+			InsecureSkipVerify: true,
+		},
+	}
+	// std sends the requests goproxy's transport can't: those of HTTP/2
+	// clients, over HTTP/2 to the remotes offering it, and the WebSocket
+	// handshakes, whose 101 response has the connection as its body.
+	std := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(network, addr)
+		},
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}
+
+	relay := &tunnelRelay{logger, config, rules, honey, samples, s.raw != nil, s.scanned, s.dial, s.hooks, s.script,
+		s.geo, s.rdns, s.egress, s.limits, s.tarpit, s.certs, slog.With("component", "tunnel")}
+	hijack := func(f func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx)) *goproxy.ConnectAction {
+		return &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: safeHijack(relay.log, f)}
+	}
+	proxy.OnRequest().HandleConnectFunc(safeConnect(log, config, func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		conn, _ := ctx.Req.Context().Value(connKey{}).(*clientConn)
+		cfg := config.Load()
+		rule := cfg.connectRule(host, clientIP(ctx.Req.RemoteAddr))
+		state := &tunnelState{id: newID(), conn: conn, rule: rule, start: time.Now(), mode: rule.Action}
+		s.rdns.prefetch(clientIP(ctx.Req.RemoteAddr))
+		if conn != nil {
+			state.read, state.written = conn.traffic()
+		}
+		ctx.UserData = state
+		if db, ok := s.db.(interface{ logConnectTarget(t *connectTarget) error }); ok {
+			t := newConnectTarget(host, clientIP(ctx.Req.RemoteAddr), state.start)
+			err := logger.enqueue(context.Background(), "connect target", state.id, func(context.Context) error {
+				return db.logConnectTarget(t)
+			}, nil)
+			logFailed(log.With("tunnel_id", state.id), "connect target", err)
+		}
+		// Those of SOCKS5 clients come as a Proxy-Authorization too.
+		creds := readCredentials(ctx.Req.Header, nil)
+		s.alerts.check(newAlert("connect", state.id, ctx.Req, creds, nil, state.start))
+		if db, ok := s.db.(interface {
+			logCredentials(tunnelID, ip string, creds []credential, at time.Time) error
+		}); ok && len(creds) > 0 {
+			ip := clientIP(ctx.Req.RemoteAddr)
+			err := logger.enqueue(context.Background(), "credentials", state.id, func(context.Context) error {
+				return db.logCredentials(state.id, ip, creds, state.start)
+			}, nil)
+			logFailed(log.With("tunnel_id", state.id), "credentials", err)
+		}
+		authenticated := conn != nil && conn.transparent || s.auth.allow(cfg, clientIP(ctx.Req.RemoteAddr), creds)
+		refuse := func(class string) (*goproxy.ConnectAction, string) {
+			state.mode, state.errorResponse = "reject", class
+			if state.origin == (geoInfo{}) {
+				_, state.origin = s.geo.policy(cfg, clientIP(ctx.Req.RemoteAddr))
+			}
+			ctx.Resp = cfg.errorResponse(state.errorResponse, ctx.Req, state.id)
+			relay.logRefused(ctx.Req, ctx)
+			return goproxy.RejectConnect, host
+		}
+		if !authenticated {
+			return refuse("auth_required")
+		}
+		if cfg.blocked(host) {
+			return refuse("blocked")
+		}
+		ip := clientIP(ctx.Req.RemoteAddr)
+		if _, ok := feeds.blocked(ip, host); ok || scores.blocked(ip) {
+			return refuse("blocked")
+		}
+		_, origin, blocked := s.geo.enforce(ctx.Req.Context(), cfg, ip, requestID(ctx))
+		state.origin = origin
+		if blocked {
+			return refuse("blocked")
+		}
+		if s.limits.limit(ctx.Req.Context(), cfg, ip, state.id) {
+			if cfg.RateLimit.Action == "drop" {
+				state.mode, state.errorResponse = "reject", "rate_limited"
+				return hijack(relay.drop), host
+			}
+			return refuse("rate_limited")
+		}
+		// The requests of the tunnels whose requests are read are counted
+		// against the egress rate on their own, those rejected and sandboxed
+		// don't connect.
+		if !cfg.Sandbox && rule.Action != "reject" {
+			if class := s.egress.check(cfg, host, rule.Action == "tunnel"); class != "" {
+				return refuse(class)
+			}
+		}
+		log.Debug("CONNECT rule matched", "tunnel_id", requestID(ctx), "host", host, "rule", rule.Name, "action", rule.Action)
+		switch rule.Action {
+		case "mitm":
+			mitmTunnels.Add(1)
+			if conn != nil {
+				conn.mitm(s.certs.tlsConfig(cfg, host, ip, requestID(ctx)))
+				req := ctx.Req
+				conn.onClose(func() {
+					tc := newTunnelCapture(0, 0)
+					defer tc.release()
+					relay.logTunnel(req, tc, nil, ctx)
+				})
+			}
+			return goproxy.MitmConnect, host
+		case "hijack-parse":
+			return hijack(relay.hijackHTTP), host
+		}
+		if conn != nil {
+			conn.stopRecording()
+		}
+		if rule.Action == "reject" {
+			return hijack(relay.reject), host
+		}
+		return hijack(relay.hijack), host
+	}))
+	proxy.OnRequest().DoFunc(safeReq(log, config, func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		requestsTotal.Add(1)
+		cfg := config.Load()
+		var headers []string
+		var head *parseAnomalies
+		var ja3 string
+		var rawHead []byte
+		if conn := requestConn(req, ctx); conn != nil {
+			// goproxy takes the requests of tunnels whose TLS was terminated
+			// by conn for plaintext ones.
+			if conn.isSecure() {
+				req.URL.Scheme = "https"
+				ja3 = conn.tlsJA3()
+			}
+			headers, head, rawHead = conn.take(req, s.raw != nil)
+		}
+		form := readForm(req)
+		state := &requestState{id: newID(), start: time.Now(), tags: rules.Load().tag(req),
+			login: readLogin(req, cfg, form), credentials: readCredentials(req.Header, form),
+			headers: headers, fingerprint: fingerprint(headers), ja3: ja3, rawHead: rawHead}
+		if t, ok := ctx.UserData.(*tunnelState); ok {
+			state.parentID = t.id
+		}
+		state.exchange = newExchange(req, state)
+		state.noteAnomalies(req, head)
+		ctx.UserData = state
+		s.hooks.capture(logger, req.Context(), state)
+		s.alerts.check(newAlert("request", state.id, req, state.credentials, state.tags, state.start))
+		log := log.With("request_id", state.id)
+		ip := clientIP(req.RemoteAddr)
+		s.rdns.prefetch(ip)
+		_, feedBlocked := feeds.blocked(ip, req.Host)
+		// The requests of a tunnel are only tagged, the tunnel having been
+		// through the policy.
+		geoBlocked := false
+		if state.parentID != "" {
+			state.geo, state.origin = s.geo.policy(cfg, ip)
+		} else {
+			state.geo, state.origin, geoBlocked = s.geo.enforce(req.Context(), cfg, ip, state.id)
+		}
+		// The requests of tunnels were authenticated with their CONNECT.
+		if conn := requestConn(req, ctx); state.parentID == "" && (conn == nil || !conn.transparent) &&
+			!s.auth.allow(cfg, ip, state.credentials) {
+			state.exchange.ErrorResponse = "auth_required"
+			return req, cfg.errorResponse("auth_required", req, state.id)
+		}
+		if cfg.blocked(req.URL.Host) || feedBlocked || scores.blocked(ip) || geoBlocked {
+			// The refusal is logged by the response handler.
+			state.exchange.ErrorResponse = "blocked"
+			return req, cfg.errorResponse("blocked", req, state.id)
+		}
+		if s.limits.limit(req.Context(), cfg, ip, state.id) {
+			state.tags = append(state.tags, "rate-limited")
+			state.exchange.ErrorResponse = "rate_limited"
+			if c := requestConn(req, ctx); c != nil && cfg.RateLimit.Action == "drop" {
+				// The response is lost with the connection.
+				c.Close()
+			}
+			return req, cfg.errorResponse("rate_limited", req, state.id)
+		}
+		if resp := s.script.apply(req, state); resp != nil {
+			return req, resp
+		}
+		req.Body = countBody(req, state)
+		req.Body = s.scanned(samples.wrap(cfg, hashBody(cfg, req, state), "up", state.id), req.Header, "request", state)
+		if resp, name := rules.Load().fake(req, state.id); resp != nil {
+			// The body is read for it to be captured, as the remote would.
+			io.Copy(io.Discard, io.LimitReader(req.Body, maxFakeRequestBody))
+			state.tags = append(state.tags, "fake:"+name)
+			return req, resp
+		}
+		if cfg.Sandbox {
+			io.Copy(io.Discard, io.LimitReader(req.Body, maxFakeRequestBody))
+			state.exchange.ErrorResponse = "sandbox"
+			return req, cfg.errorResponse("sandbox", req, state.id)
+		}
+		if class := s.egress.check(cfg, requestAddr(req.URL), true); class != "" {
+			state.exchange.ErrorResponse = class
+			return req, cfg.errorResponse(class, req, state.id)
+		}
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (resp *http.Response, err error) {
+			sent := time.Now()
+			if req.ProtoMajor == 2 && req.URL.Scheme == "https" || isWebsocket(req.Header) {
+				state.details, resp, err = roundTripStd(std, req)
+			} else {
+				state.details, resp, err = tr.DetailedRoundTrip(req)
+			}
+			state.exchange.Upstream = time.Since(sent)
+			if err != nil {
+				// The failure is logged before the error response, which
+				// isn't the remote's, is served in place of goproxy's.
+				state.exchange.ErrorResponse = dialFailure(err)
+				if ex := state.finish(nil, 0, err); ex != nil {
+					logFailed(log, "exchange", logger.LogExchange(req.Context(), ex))
+				}
+				return config.Load().errorResponse(state.exchange.ErrorResponse, req, state.id), nil
+			}
+			state.exchange.Responded = time.Now()
+			if req.URL.Scheme == "https" {
+				state.exchange.JA3S = s.hellos.ja3s(requestAddr(req.URL))
+			}
+			return
+		})
+		if cfg.RequestID.Forward != "" {
+			req.Header.Set(cfg.RequestID.Forward, state.id)
+		}
+		return req, nil
+	}))
+	proxy.OnResponse().DoFunc(safeResp(log, func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		log := log.With("request_id", requestID(ctx))
+		cfg := config.Load()
+		if resp != nil && cfg.RequestID.Echo {
+			resp.Header.Set(requestIDHeader, requestID(ctx))
+		}
+		state, ok := ctx.UserData.(*requestState)
+		if !ok {
+			return resp
+		}
+		// goproxy relays a WebSocket over the body of its 101 response. The
+		// exchange is logged as it opens, its messages as they come.
+		if resp != nil && resp.StatusCode == http.StatusSwitchingProtocols && isWebsocket(resp.Header) {
+			if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+				if ex := state.finish(resp, 0, nil); ex != nil {
+					logFailed(log, "exchange", logger.LogExchange(ctx.Req.Context(), ex))
+				}
+				resp.Body = s.websocket(cfg, rwc, requestConn(ctx.Req, ctx), state.id,
+					clientIP(ctx.Req.RemoteAddr))
+				return resp
+			}
+		}
+		if s.tarpit.apply(ctx.Req.Context(), cfg, clientIP(ctx.Req.RemoteAddr), state.tags, requestConn(ctx.Req, ctx), state.id) {
+			state.tags = append(state.tags, "tarpitted")
+		}
+		var body io.ReadCloser
+		if resp != nil {
+			body = resp.Body
+			resp.Body = s.scanned(samples.wrap(cfg, resp.Body, "down", state.id), resp.Header, "response", state)
+		}
+		state.issued = honey.inject(cfg, rules.Load(), resp, clientIP(ctx.Req.RemoteAddr), state.id)
+		// Replacing the body makes goproxy drop Content-Length, so the
+		// exchange only waits for the body to be sent when it's been
+		// replaced already or its length isn't known up front.
+		if resp == nil || resp.ContentLength >= 0 && resp.Body == body {
+			size := int64(0)
+			if resp != nil {
+				size = resp.ContentLength
+			}
+			if ex := state.finish(resp, size, ctx.Error); ex != nil {
+				logFailed(log, "exchange", logger.LogExchange(ctx.Req.Context(), ex))
+			}
+			return resp
+		}
+		resp.Body = &countingBody{ReadCloser: resp.Body, done: func(n int64) {
+			if ex := state.finish(resp, n, nil); ex != nil {
+				logFailed(log, "exchange", logger.LogExchange(ctx.Req.Context(), ex))
+			}
+		}}
+		return resp
+	}))
+	return proxy
+}
+
+// roundTripStd sends req with tr, with the details goproxy's transport gives.
+func roundTripStd(tr *http.Transport, req *http.Request) (*transport.RoundTripDetails, *http.Response, error) {
+	details := &transport.RoundTripDetails{Host: req.URL.Host}
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		details.TCPAddr, _ = info.Conn.RemoteAddr().(*net.TCPAddr)
+	}}
+	out := req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	// It's set on the requests read by a server, which clients refuse.
+	out.RequestURI = ""
+	resp, err := tr.RoundTrip(out)
+	details.Error = err
+	return details, resp, err
+}
+
+// Start listens on the addresses of the config and serves them in the
+// background. A listener failing later is reported by Err.
+func (s *Server) Start() error {
+	cfg := s.config.Load()
+	var tproxy func(string, string, syscall.RawConn) error
+	if cfg.Listen.TProxy {
+		tproxy = transparentControl
+	}
+	listeners := []struct {
+		addr    string
+		serve   func(net.Listener) error
+		control func(string, string, syscall.RawConn) error
+	}{{cfg.Listen.Proxy, s.Serve, nil}, {cfg.Listen.Socks, s.ServeSocks, nil},
+		{cfg.Listen.Transparent, s.ServeTransparent, tproxy}, {cfg.Listen.Admin, s.ServeAdmin, nil},
+		{cfg.Listen.Debug, s.ServeDebug, nil}}
+	var lns []net.Listener
+	for _, l := range listeners {
+		if l.addr == "" {
+			lns = append(lns, nil)
+			continue
+		}
+		lc := net.ListenConfig{Control: l.control}
+		ln, err := lc.Listen(context.Background(), "tcp", l.addr)
+		if err != nil {
+			for _, ln := range lns {
+				if ln != nil {
+					ln.Close()
+				}
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
+	for i, l := range listeners {
+		if ln := lns[i]; ln != nil {
+			serve := l.serve
+			go func() {
+				if err := serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					s.errc <- err
+				}
+			}()
+		}
+	}
+	return nil
+}
+
+// Err receives the errors of the listeners started by Start.
+func (s *Server) Err() <-chan error {
+	return s.errc
+}
+
+// Serve accepts proxy connections on ln until Shutdown is called.
+func (s *Server) Serve(ln net.Listener) error {
+	sl := s.listen(&s.sl, ln)
+	s.log.Info("Starting Proxy", "addr", ln.Addr().String(), "version", version)
+
+	s.health.accepting.Store(true)
+	defer s.health.accepting.Store(false)
+	return s.proxy.Serve(clientListener{Listener: sl})
+}
+
+// ServeSocks accepts SOCKS5 connections on ln until Shutdown is called. Their
+// tunnels are served by the proxy as CONNECTs, see frontendConn.
+func (s *Server) ServeSocks(ln net.Listener) error {
+	sl := s.listen(&s.socks, ln)
+	s.log.Info("Starting SOCKS5 listener", "addr", ln.Addr().String())
+	return s.proxy.Serve(clientListener{Listener: socksListener{sl, s.socksAuth}})
+}
+
+// ServeTransparent accepts the connections redirected by the firewall on ln
+// until Shutdown is called. Their tunnels are served by the proxy as CONNECTs
+// to their original destination, see transparentListener.
+func (s *Server) ServeTransparent(ln net.Listener) error {
+	sl := s.listen(&s.transparent, transparentListener{ln})
+	s.log.Info("Starting transparent listener", "addr", ln.Addr().String(), "tproxy", s.config.Load().Listen.TProxy)
+	return s.proxy.Serve(clientListener{Listener: sl, transparent: true})
+}
+
+// listen wraps ln in the listener stored in *field, whose tunnels Shutdown
+// waits for.
+func (s *Server) listen(field **stoppableListener, ln net.Listener) *stoppableListener {
+	sl := newStoppableListener(s.limits.listener(ln))
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	*field = sl
+	return sl
+}
+
+// ServeAdmin serves the admin API on ln until Shutdown is called. Without
+// tokens or client CAs, it refuses to serve a listener other hosts can reach.
+func (s *Server) ServeAdmin(ln net.Listener) error {
+	cfg := s.config.Load()
+	if !cfg.adminProtected() {
+		if ln.Addr().Network() != "unix" && !loopbackAddr(ln.Addr().String()) {
+			ln.Close()
+			return fmt.Errorf("admin API on %v: reachable from other hosts without tokens or client CAs", ln.Addr())
+		}
+		s.log.Warn("The admin API is open to anyone on the host, configure admin tokens to protect it")
+	}
+	s.log.Info("Starting admin API", "addr", ln.Addr().String(), "tls", s.admin.TLSConfig != nil)
+	s.addInternal(ln)
+	if s.admin.TLSConfig != nil {
+		return s.admin.ServeTLS(ln, "", "")
+	}
+	return s.admin.Serve(ln)
+}
+
+// ServeDebug serves pprof and expvar on ln until Shutdown is called.
+func (s *Server) ServeDebug(ln net.Listener) error {
+	s.log.Info("Starting debug listener", "addr", ln.Addr().String())
+	s.addInternal(ln)
+	return s.debug.Serve(ln)
+}
+
+// addInternal keeps the proxy from connecting to ln.
+func (s *Server) addInternal(ln net.Listener) {
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		s.internal.Store(addr.Port, true)
+	}
+}
+
+// Reload reloads the config, then the rules, script, admin certificates and
+// default MITM certificate which it names. Any of them failing keeps the
+// current one.
+func (s *Server) Reload() error {
+	err := s.config.reload()
+	return errors.Join(err, s.rules.reload(), s.script.reload(), s.adminTLS.reload(),
+		s.certs.reload(s.config.Load().Mitm))
+}
+
+// Reopen reopens the files written by the sinks.
+func (s *Server) Reopen() error {
+	return s.logger.Reopen()
+}
+
+// Shutdown gives up on the dials in progress and waits for in-flight requests
+// and tunnels until ctx expires, then closes the sinks once they've recorded
+// the queued events, or dropped them when ctx has expired. Calling it again
+// returns the error of the first call.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdown.Do(func() { s.shutdownErr = s.close(ctx) })
+	return s.shutdownErr
+}
+
+func (s *Server) close(ctx context.Context) error {
+	servers.Delete(s)
+	s.stop()
+	s.rules.close()
+	s.tor.close()
+	s.feeds.close()
+	s.report.close()
+	s.admin.Close()
+	s.debug.Close()
+	if err := s.proxy.Shutdown(ctx); err != nil {
+		s.log.Warn("Requests still in flight after grace period", "error", err)
+	}
+	// A listener served from now on is closed by the proxy's Serve, which
+	// returns at once.
+	s.listenersMu.Lock()
+	listeners := []*stoppableListener{s.sl, s.socks, s.transparent}
+	s.listenersMu.Unlock()
+	for _, sl := range listeners {
+		if sl == nil {
+			continue
+		}
+		if err := sl.waitTimeout(ctx); err != nil {
+			s.log.Warn("Tunnels still open after grace period", "error", err)
+		}
+	}
+	// The alerts still queued are sent until ctx expires.
+	s.alerts.close(ctx)
+	// The events still queued once ctx expires are given up on.
+	stop := context.AfterFunc(ctx, s.logger.abandon)
+	defer stop()
+	err := s.logger.Close()
+	if s.dbLock != nil {
+		s.dbLock.Close()
+	}
+	return err
+}
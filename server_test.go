@@ -0,0 +1,335 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps the events it's given, for the tests to look at.
+type recordingLogger struct {
+	mu        sync.Mutex
+	exchanges []*Exchange
+	tunnels   int
+	closed    bool
+}
+
+func (l *recordingLogger) LogExchange(ctx context.Context, ex *Exchange) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.exchanges = append(l.exchanges, ex)
+	return nil
+}
+
+func (l *recordingLogger) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession,
+	pctx *goproxy.ProxyCtx) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tunnels++
+	return nil
+}
+
+func (l *recordingLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	return nil
+}
+
+func (l *recordingLogger) logged() []*Exchange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*Exchange(nil), l.exchanges...)
+}
+
+// testConfig returns a config store from args, its database in a temporary
+// directory.
+func testConfig(t *testing.T, args ...string) *ConfigStore {
+	t.Helper()
+	args = append([]string{"-db", filepath.Join(t.TempDir(), "log.db")}, args...)
+	config, err := NewConfigStore("stuffpot", args)
+	if err != nil {
+		t.Fatalf("NewConfigStore(%v): %v", args, err)
+	}
+	return config
+}
+
+// startServer serves the proxy of config, recording to db, on a loopback
+// listener, and returns the server and a client going through it. The server
+// is shut down at the end of the test, unless the test did.
+func startServer(t *testing.T, config *ConfigStore, db Logger) (*Server, *http.Client) {
+	t.Helper()
+	s, err := NewServer(config, db)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 10 * time.Second}
+	return s, client
+}
+
+func TestServerServesCallerListenerAndLogger(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	rec := &recordingLogger{}
+	s, client := startServer(t, testConfig(t), rec)
+	resp, err := client.Get(upstream.URL + "/path?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("got %v %q, want 200 hello", resp.Status, body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	logged := rec.logged()
+	if len(logged) != 1 {
+		t.Fatalf("logged %d exchanges, want 1", len(logged))
+	}
+	if ex := logged[0]; ex.Request.URL.Path != "/path" || ex.Response == nil || ex.Response.StatusCode != 200 ||
+		ex.ClientIP != "127.0.0.1" {
+		t.Errorf("logged %v %v from %v, want /path with a 200 from 127.0.0.1", ex.Request.URL, ex.Status(), ex.ClientIP)
+	}
+	if !rec.closed {
+		t.Error("Shutdown didn't close the logger")
+	}
+}
+
+func TestConfigStoreVersionAndInvalidFlags(t *testing.T) {
+	if _, err := NewConfigStore("stuffpot", []string{"-version"}); !errors.Is(err, ErrVersion) {
+		t.Errorf("-version: got %v, want ErrVersion", err)
+	}
+	if _, err := NewConfigStore("stuffpot", []string{"-no-such-flag"}); err == nil {
+		t.Error("an unknown flag was accepted")
+	}
+	if _, err := NewConfigStore("stuffpot", []string{"-db-rollover", "hourly"}); err == nil {
+		t.Error("an invalid -db-rollover was accepted")
+	}
+}
+
+func TestCommandsAreRegistered(t *testing.T) {
+	for _, name := range []string{"version", "query", "report", "import", "export", "purge", "db", "replay"} {
+		if Commands[name] == nil {
+			t.Errorf("no %v subcommand", name)
+		}
+	}
+}
+
+func TestShutdownWaitsForInFlightRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "done")
+	}))
+	defer upstream.Close()
+
+	rec := &recordingLogger{}
+	s, client := startServer(t, testConfig(t), rec)
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := client.Get(upstream.URL + "/slow")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		done <- result{string(body), err}
+	}()
+	<-started
+
+	const grace = 5 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	start := time.Now()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a request in flight", err)
+	default:
+	}
+	close(release)
+
+	if r := <-done; r.err != nil || r.body != "done" {
+		t.Errorf("in-flight request: got %q, %v, want done", r.body, r.err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= grace {
+		t.Errorf("Shutdown took %v, longer than the grace period", elapsed)
+	}
+	if len(rec.logged()) != 1 {
+		t.Errorf("logged %d exchanges, want the in-flight one", len(rec.logged()))
+	}
+}
+
+func TestShutdownGivesUpAfterTheGracePeriod(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	s, client := startServer(t, testConfig(t), &recordingLogger{})
+	go func() {
+		if resp, err := client.Get(upstream.URL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	const grace = 500 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	start := time.Now()
+	s.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > grace+2*time.Second {
+		t.Errorf("Shutdown took %v with a grace period of %v", elapsed, grace)
+	}
+}
+
+func TestShutdownRightAfterServe(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s, err := NewServer(testConfig(t), &recordingLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		serves := []func(net.Listener) error{s.Serve, s.ServeSocks, s.ServeTransparent}
+		errc := make(chan error, len(serves))
+		for _, serve := range serves {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() { errc <- serve(ln) }()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+		cancel()
+		for range serves {
+			select {
+			case err := <-errc:
+				if !errors.Is(err, http.ErrServerClosed) {
+					t.Errorf("a listener returned %v, want http.ErrServerClosed", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("a listener is still serving after Shutdown")
+			}
+		}
+	}
+}
+
+func TestHTTP2ClientsAreServedInMITMdTunnels(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+
+	port := upstream.Listener.Addr().(*net.TCPAddr).Port
+	config := testConfig(t, "-mitm-ports", strconv.Itoa(port))
+	s, client := startServer(t, config, nil)
+	proxyURL, _ := client.Transport.(*http.Transport).Proxy(nil)
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %v: got %v, %v", target, resp, err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Fatalf("the MITM negotiated %q, want h2", proto)
+	}
+	h2, err := (&http2.Transport{}).NewClientConn(tlsConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://"+target+"/h2", nil)
+	resp, err = h2.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Proto != "HTTP/2.0" || string(body) != "HTTP/2.0" {
+		t.Errorf("got a %v response to a request the remote got over %q, want HTTP/2.0 end to end", resp.Proto, body)
+	}
+	h2.Close()
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var u, proto string
+	var status int
+	err = db.QueryRow("select url, responses.status, proto from requests join responses using (request_id)").
+		Scan(&u, &status, &proto)
+	if err != nil || u != "https://"+target+"/h2" || status != http.StatusOK || proto != "HTTP/2.0" {
+		t.Errorf("got %v %v %v, %v, want the request logged with an HTTP/2.0 response", u, status, proto, err)
+	}
+}
@@ -0,0 +1,230 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxClientSessions bounds the sessions followed at once, the requests
+	// of further clients being left out of any until idle ones end.
+	maxClientSessions = 100000
+	// maxSessionUserAgent bounds the User-Agent a session is keyed by.
+	maxSessionUserAgent = 512
+)
+
+// toolPattern finds the tool a client uses in its User-Agent: the scanners
+// and the HTTP libraries of the usual scripts.
+var toolPattern = regexp.MustCompile(`(?i)\b(sqlmap|nikto|nuclei|masscan|zgrab|nmap|wpscan|dirbuster|gobuster|` +
+	`feroxbuster|ffuf|wfuzz|acunetix|nessus|openvas|netsparker|w3af|whatweb|jaeles|commix|hydra|curl|wget|` +
+	`python-requests|python-urllib|aiohttp|httpx|go-http-client|libwww-perl|okhttp|apache-httpclient|java|` +
+	`node-fetch|axios|powershell|scrapy|headlesschrome|phantomjs)\b`)
+
+// inferTool returns the tool named by userAgent, in lower case, if any.
+func inferTool(userAgent string) string {
+	return strings.ToLower(toolPattern.FindString(userAgent))
+}
+
+// clientSession groups the requests of a client sharing a TLS fingerprint
+// and a User-Agent, from the first one until the client stays idle for the
+// gap.
+type clientSession struct {
+	ID        string
+	ClientIP  string
+	JA3       string
+	UserAgent string
+	// Tool is that inferred from the User-Agent.
+	Tool     string
+	Started  time.Time
+	Updated  time.Time
+	Requests int
+}
+
+type sessionKey struct {
+	ip, ja3, userAgent string
+}
+
+// sessionTracker groups the requests into sessions as they're logged.
+type sessionTracker struct {
+	config *ConfigStore
+
+	mu        sync.Mutex
+	sessions  map[sessionKey]*clientSession
+	lastSweep time.Time
+}
+
+func newSessionTracker(config *ConfigStore) *sessionTracker {
+	return &sessionTracker{config: config, sessions: make(map[sessionKey]*clientSession)}
+}
+
+// observe records a request from ip at t, whose ClientHello hashes to ja3,
+// and returns a copy of its session, nil when too many are followed.
+func (st *sessionTracker) observe(ip, ja3, userAgent string, t time.Time) *clientSession {
+	gap := st.config.Load().Sessions.Gap
+	if len(userAgent) > maxSessionUserAgent {
+		userAgent = userAgent[:maxSessionUserAgent]
+	}
+	key := sessionKey{ip, ja3, userAgent}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if t.Sub(st.lastSweep) > gap {
+		st.lastSweep = t
+		for k, s := range st.sessions {
+			if t.Sub(s.Updated) > gap {
+				delete(st.sessions, k)
+			}
+		}
+	}
+	s := st.sessions[key]
+	if s == nil || t.Sub(s.Updated) > gap {
+		if s == nil && len(st.sessions) >= maxClientSessions {
+			return nil
+		}
+		s = &clientSession{ID: newID(), ClientIP: ip, JA3: ja3, UserAgent: userAgent, Tool: inferTool(userAgent),
+			Started: t}
+		st.sessions[key] = s
+	}
+	s.Requests++
+	// The requests may be logged a little out of order.
+	if t.After(s.Updated) {
+		s.Updated = t
+	}
+	c := *s
+	return &c
+}
+
+// listedSession is a session as listed by /api/sessions and in the profiles.
+type listedSession struct {
+	SessionID string `json:"session_id"`
+	ClientIP  string `json:"client_ip"`
+	JA3       string `json:"ja3,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Tool      string `json:"tool,omitempty"`
+	StartedAt string `json:"started_at"`
+	UpdatedAt string `json:"updated_at"`
+	Requests  int64  `json:"requests"`
+}
+
+// listSessions returns the sessions of ip, or of any client when empty, the
+// last updated first.
+func (logger *HttpLogger) listSessions(ctx context.Context, ip string, limit int) ([]listedSession, error) {
+	rows, err := logger.db.QueryContext(ctx, `select session_id, coalesce(from_ip, ''), coalesce(ja3, ''),
+      coalesce(user_agent, ''), coalesce(tool, ''), coalesce(started_at, ''), coalesce(updated_at, ''),
+      coalesce(requests, 0) from client_sessions where ? = '' or from_ip = ? order by updated_at desc, id desc
+      limit ?`, ip, ip, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	defer rows.Close()
+	sessions := []listedSession{}
+	for rows.Next() {
+		var s listedSession
+		if err := rows.Scan(&s.SessionID, &s.ClientIP, &s.JA3, &s.UserAgent, &s.Tool, &s.StartedAt, &s.UpdatedAt,
+			&s.Requests); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// attackerProfile sums up what a client did, as given by /api/profiles/<ip>.
+type attackerProfile struct {
+	ClientIP  string `json:"client_ip"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+	Requests  int64  `json:"requests"`
+	Tunnels   int64  `json:"tunnels"`
+	// Hosts are those targeted the most, with their requests and tunnels.
+	Hosts []profileCount `json:"hosts"`
+	// Tools are those inferred from the User-Agents of the sessions, and
+	// the labels of the header fingerprints of the requests.
+	Tools       []string            `json:"tools"`
+	Tags        []profileCount      `json:"tags"`
+	Sessions    []listedSession     `json:"sessions"`
+	Credentials []credentialAttempt `json:"credentials"`
+}
+
+// profileCount is a host or tag of a profile, and the requests with it.
+type profileCount struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+}
+
+// attackerProfile returns the profile of ip, with up to limit hosts, tags,
+// sessions and credentials, or nil when ip sent nothing.
+func (logger *HttpLogger) attackerProfile(ctx context.Context, ip string, limit int) (*attackerProfile, error) {
+	p := &attackerProfile{ClientIP: ip, Tools: []string{}}
+	var first, last sql.NullString
+	err := logger.db.QueryRowContext(ctx, `select min(first), max(last), sum(requests), sum(tunnels) from (
+      select min(created_at) first, max(coalesce(last_seen, created_at)) last, sum(coalesce(occurrences, 1)) requests,
+        0 tunnels from requests where from_ip = ?
+      union all select min(created_at), max(created_at), 0, count(*) from connects where from_ip = ?)`,
+		ip, ip).Scan(&first, &last, &p.Requests, &p.Tunnels)
+	if err != nil {
+		return nil, fmt.Errorf("get profile: %w", err)
+	}
+	if !first.Valid {
+		return nil, nil
+	}
+	p.FirstSeen, p.LastSeen = first.String, last.String
+
+	counts := func(query string, args ...interface{}) ([]profileCount, error) {
+		rows, err := logger.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		counts := []profileCount{}
+		for rows.Next() {
+			var c profileCount
+			if err := rows.Scan(&c.Name, &c.Requests); err != nil {
+				return nil, err
+			}
+			counts = append(counts, c)
+		}
+		return counts, rows.Err()
+	}
+	if p.Hosts, err = counts(`select host, count(*) from (select host from requests where from_ip = ? and parent_id is null
+      union all select host from connects where from_ip = ?) group by host order by count(*) desc, host limit ?`,
+		ip, ip, limit); err != nil {
+		return nil, fmt.Errorf("get profile hosts: %w", err)
+	}
+	if p.Tags, err = counts(`select tag, requests from client_tag_stats where ip = ? order by requests desc, tag limit ?`,
+		ip, limit); err != nil {
+		return nil, fmt.Errorf("get profile tags: %w", err)
+	}
+
+	rows, err := logger.db.QueryContext(ctx, `select tool from client_sessions where from_ip = ? and tool != ''
+      union select label from fingerprints where label != ''
+        and hash in (select fingerprint from requests where from_ip = ?)`, ip, ip)
+	if err != nil {
+		return nil, fmt.Errorf("get profile tools: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tool string
+		if err := rows.Scan(&tool); err != nil {
+			return nil, err
+		}
+		p.Tools = append(p.Tools, tool)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if p.Sessions, err = logger.listSessions(ctx, ip, limit); err != nil {
+		return nil, err
+	}
+	if p.Credentials, err = logger.credentialAttempts(ctx, ip, limit); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
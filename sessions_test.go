@@ -0,0 +1,129 @@
+package stuffpot
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestInferTool(t *testing.T) {
+	for ua, want := range map[string]string{
+		"sqlmap/1.7.2#stable (https://sqlmap.org)":       "sqlmap",
+		"Mozilla/5.0 (compatible; Nuclei - Open-source)": "nuclei",
+		"python-requests/2.31.0":                         "python-requests",
+		"Go-http-client/1.1":                             "go-http-client",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64)":      "",
+		"javascript-engine":                              "",
+	} {
+		if got := inferTool(ua); got != want {
+			t.Errorf("inferTool(%q): got %q, want %q", ua, got, want)
+		}
+	}
+}
+
+func TestSessionTracker(t *testing.T) {
+	st := newSessionTracker(testConfig(t, "-session-gap", "1m"))
+	start := time.Now()
+	first := st.observe("192.0.2.1", "ja3", "sqlmap/1.7", start)
+	second := st.observe("192.0.2.1", "ja3", "sqlmap/1.7", start.Add(30*time.Second))
+	if second.ID != first.ID || second.Requests != 2 || second.Tool != "sqlmap" || !second.Started.Equal(start) {
+		t.Errorf("got the session %+v, want the second request grouped with the first", second)
+	}
+	// A request logged out of order doesn't move the session back.
+	if s := st.observe("192.0.2.1", "ja3", "sqlmap/1.7", start.Add(10*time.Second)); !s.Updated.Equal(
+		start.Add(30 * time.Second)) {
+		t.Errorf("got the session updated at %v, want the last request kept", s.Updated)
+	}
+
+	// Another fingerprint, User-Agent or client is another session.
+	for _, s := range []*clientSession{
+		st.observe("192.0.2.1", "other", "sqlmap/1.7", start),
+		st.observe("192.0.2.1", "ja3", "curl/8.0", start),
+		st.observe("192.0.2.2", "ja3", "sqlmap/1.7", start),
+	} {
+		if s.ID == first.ID || s.Requests != 1 {
+			t.Errorf("got the session %+v, want a new one", s)
+		}
+	}
+
+	// The client idle for longer than the gap starts a new session.
+	if s := st.observe("192.0.2.1", "ja3", "sqlmap/1.7", start.Add(2*time.Minute)); s.ID == first.ID ||
+		s.Requests != 1 {
+		t.Errorf("got the session %+v after the gap, want a new one", s)
+	}
+	if n := len(st.sessions); n != 1 {
+		t.Errorf("got %v sessions followed, want the idle ones swept", n)
+	}
+}
+
+func TestSessionsAndProfilesAreServed(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	s, client := startServer(t, testConfig(t), nil)
+	adminURL := serveAdmin(t, s)
+	for _, ua := range []string{"sqlmap/1.7", "sqlmap/1.7", "curl/8.0"} {
+		req, _ := http.NewRequest("GET", upstream.URL+"/a", nil)
+		req.Header.Set("User-Agent", ua)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	var list struct {
+		Sessions []listedSession `json:"sessions"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		getJSON(t, adminURL, "/api/sessions?ip=127.0.0.1", &list)
+		var requests int64
+		for _, s := range list.Sessions {
+			requests += s.Requests
+		}
+		if requests == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got the sessions %+v, want the 3 requests in them", list.Sessions)
+		}
+	}
+	tools := map[string]listedSession{}
+	for _, s := range list.Sessions {
+		tools[s.Tool] = s
+	}
+	sqlmap := tools["sqlmap"]
+	if len(list.Sessions) != 2 || sqlmap.Requests != 2 || sqlmap.UserAgent != "sqlmap/1.7" || tools["curl"].Requests != 1 {
+		t.Fatalf("got the sessions %+v, want one of sqlmap and one of curl", list.Sessions)
+	}
+
+	var page requestPage
+	getJSON(t, adminURL, "/api/requests?session="+sqlmap.SessionID, &page)
+	if len(page.Requests) != 2 {
+		t.Errorf("got %v requests in the sqlmap session, want 2", len(page.Requests))
+	}
+	for _, r := range page.Requests {
+		if r.SessionID != sqlmap.SessionID {
+			t.Errorf("got the request %+v, want it in the sqlmap session", r)
+		}
+	}
+
+	var p attackerProfile
+	if code := getJSON(t, adminURL, "/api/profiles/127.0.0.1", &p); code != http.StatusOK {
+		t.Fatalf("got %v for the profile", code)
+	}
+	sort.Strings(p.Tools)
+	host := upstream.Listener.Addr().String()
+	if p.Requests != 3 || p.FirstSeen == "" || len(p.Sessions) != 2 ||
+		!reflect.DeepEqual(p.Tools, []string{"curl", "sqlmap"}) ||
+		!reflect.DeepEqual(p.Hosts, []profileCount{{Name: host, Requests: 3}}) {
+		t.Errorf("got the profile %+v", p)
+	}
+	if code := getJSON(t, adminURL, "/api/profiles/192.0.2.1", &p); code != http.StatusNotFound {
+		t.Errorf("got %v for the profile of an unknown client, want 404", code)
+	}
+}
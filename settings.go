@@ -0,0 +1,221 @@
+package stuffpot
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// runtimeSettings are the settings /api/settings changes while running, by
+// key. A change applies to the connections and requests which follow it.
+var runtimeSettings = []string{"mitm.enabled", "limits.capture_bodies", "smtp_block", "sandbox", "rules.disabled_honeytokens"}
+
+// settingField returns the field of the setting key in cfg, and its flag.
+func settingField(cfg *Config, key string) (reflect.Value, string) {
+	var field reflect.Value
+	var flag string
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(f reflect.StructField, v reflect.Value, k string) {
+		if k == key {
+			field, flag = v, f.Tag.Get("flag")
+		}
+	})
+	return field, flag
+}
+
+// overrideArgs returns args followed by the flags of the overrides, which
+// take precedence over every other source.
+func overrideArgs(args []string, overrides map[string]string) []string {
+	args = slices.Clone(args)
+	for _, key := range slices.Sorted(maps.Keys(overrides)) {
+		_, flag := settingField(defaultConfig(), key)
+		args = append(args, fmt.Sprintf("-%v=%v", flag, overrides[key]))
+	}
+	return args
+}
+
+// parseSettings validates the settings of a request, by key, returning them
+// in their flag form. Lists are given as JSON arrays.
+func parseSettings(body map[string]interface{}) (map[string]string, error) {
+	if len(body) == 0 {
+		return nil, errors.New("no settings given")
+	}
+	cfg := defaultConfig()
+	values := make(map[string]string)
+	var errs []error
+	for key, raw := range body {
+		if !slices.Contains(runtimeSettings, key) {
+			errs = append(errs, fmt.Errorf("%v: not a runtime setting", key))
+			continue
+		}
+		var s string
+		switch x := raw.(type) {
+		case nil:
+		case []interface{}:
+			items := make([]string, len(x))
+			for i, item := range x {
+				items[i] = fmt.Sprint(item)
+			}
+			s = strings.Join(items, ",")
+		default:
+			s = fmt.Sprint(x)
+		}
+		field, _ := settingField(cfg, key)
+		fv := &fieldValue{field}
+		if err := fv.Set(s); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", key, err))
+			continue
+		}
+		values[key] = fv.String()
+	}
+	return values, errors.Join(errs...)
+}
+
+// settings returns the runtime settings of the current config, and those
+// changed since it was loaded from the sources without being persisted.
+func (store *ConfigStore) settings() (map[string]interface{}, map[string]string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	cfg := store.Load()
+	current := make(map[string]interface{})
+	for _, key := range runtimeSettings {
+		field, _ := settingField(cfg, key)
+		current[key] = field.Interface()
+	}
+	overrides := maps.Clone(store.overrides)
+	if overrides == nil {
+		overrides = make(map[string]string)
+	}
+	return current, overrides
+}
+
+// set changes the runtime settings in values, by key, reloading the config
+// like SIGHUP does. They are kept over the reloads until the process exits,
+// or written to the config file with persist.
+func (store *ConfigStore) set(values map[string]string, persist bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	overrides := maps.Clone(store.overrides)
+	if overrides == nil {
+		overrides = make(map[string]string)
+	}
+	maps.Copy(overrides, values)
+	cfg, err := loadConfig(store.name, overrideArgs(store.args, overrides))
+	if err != nil {
+		return err
+	}
+	if persist {
+		if err := store.persist(cfg, values); err != nil {
+			return err
+		}
+		for key := range values {
+			delete(overrides, key)
+		}
+	}
+	store.overrides = overrides
+	store.Store(cfg)
+	slog.Info("Runtime settings changed", "component", "config", "settings", values, "persisted", persist)
+	return nil
+}
+
+// persist writes the settings in values of cfg to the config file given with
+// -config, keeping its comments. Settings given on the command line can't be,
+// the flags overriding the file.
+func (store *ConfigStore) persist(cfg *Config, values map[string]string) error {
+	var path string
+	fs := newFlagSet(store.name, defaultConfig(), &path)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(store.args); err != nil {
+		return err
+	}
+	if path == "" {
+		return errors.New("no configuration file to persist the settings to, -config wasn't given")
+	}
+	keys := slices.Sorted(maps.Keys(values))
+	var errs []error
+	fs.Visit(func(f *flag.Flag) {
+		for _, key := range keys {
+			if _, name := settingField(cfg, key); name == f.Name {
+				errs = append(errs, fmt.Errorf("%v: set with -%v on the command line, which overrides the configuration file",
+					key, name))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if root := doc.Content[0]; root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%v: not a mapping", path)
+	}
+	for _, key := range keys {
+		field, _ := settingField(cfg, key)
+		value := &yaml.Node{}
+		if err := value.Encode(field.Interface()); err != nil {
+			return err
+		}
+		if err := setNode(doc.Content[0], strings.Split(key, "."), value); err != nil {
+			return fmt.Errorf("%v: %v: %v", path, key, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return writeFile(path, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
+
+// setNode sets the value of the dotted key path in the mapping node, adding
+// the keys missing. The comment following the value replaced is kept.
+func setNode(node *yaml.Node, path []string, value *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			value.LineComment = node.Content[i+1].LineComment
+			node.Content[i+1] = value
+			return nil
+		}
+		if node.Content[i+1].Kind != yaml.MappingNode {
+			return fmt.Errorf("%v is not a mapping", path[0])
+		}
+		return setNode(node.Content[i+1], path[1:], value)
+	}
+	if len(path) > 1 {
+		child := &yaml.Node{Kind: yaml.MappingNode}
+		setNode(child, path[1:], value)
+		value = child
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: path[0]}, value)
+	return nil
+}
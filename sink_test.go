@@ -0,0 +1,110 @@
+package stuffpot_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"github.com/securized/stuffpot"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tunnelSink is a sink of an embedding program, which only has the exported
+// API to read the tunnels with.
+type tunnelSink struct {
+	mu      sync.Mutex
+	tunnels []*stuffpot.TunnelRecord
+}
+
+func (s *tunnelSink) LogExchange(ctx context.Context, ex *stuffpot.Exchange) error {
+	return nil
+}
+
+func (s *tunnelSink) LogTunnel(ctx context.Context, req *http.Request, tc *stuffpot.TunnelCapture,
+	smtp *stuffpot.SmtpSession, pctx *goproxy.ProxyCtx) error {
+	tr := stuffpot.NewTunnelRecord(req, tc, smtp, pctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnels = append(s.tunnels, tr)
+	return nil
+}
+
+func (s *tunnelSink) Close() error {
+	return nil
+}
+
+func TestRegisteredSinkReadsTheTunnels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+
+	config, err := stuffpot.NewConfigStore("stuffpot", []string{"-db", filepath.Join(t.TempDir(), "log.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := stuffpot.NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &tunnelSink{}
+	s.RegisterSink("tunnels", sink)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %v: got %v, %v", target, resp, err)
+	}
+	fmt.Fprintf(conn, "GET /tunneled HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", target)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.tunnels) != 1 {
+		t.Fatalf("the sink got %d tunnels, want 1", len(sink.tunnels))
+	}
+	tr := sink.tunnels[0]
+	if tr.ID == "" || tr.ClientIP != "127.0.0.1" || tr.Host != target || tr.Mode != "tunnel" || tr.Rule != "default" {
+		t.Errorf("got tunnel %v from %v to %v in mode %v by rule %v", tr.ID, tr.ClientIP, tr.Host, tr.Mode, tr.Rule)
+	}
+	if tr.Protocol != "http" || !tr.Guessed || !strings.HasPrefix(string(tr.Up), "GET /tunneled") ||
+		!strings.Contains(string(tr.Down), "hello") {
+		t.Errorf("got protocol %v, guessed %v, up %q, down %q", tr.Protocol, tr.Guessed, tr.Up, tr.Down)
+	}
+	if tr.Sent < int64(len(tr.Up)) || tr.Received < int64(len(tr.Down)) || tr.DialTime <= 0 || tr.Start.IsZero() ||
+		tr.End.Before(tr.Start) {
+		t.Errorf("got %d bytes sent, %d received, dialed in %v, from %v to %v", tr.Sent, tr.Received, tr.DialTime,
+			tr.Start, tr.End)
+	}
+}
@@ -0,0 +1,210 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+)
+
+// mailPorts are the CONNECT ports whose tunnels are parsed as SMTP. Port 465
+// speaks SMTP over implicit TLS, which is terminated with the MITM CA.
+var mailPorts = map[string]bool{"25": true, "465": true, "587": true}
+
+const smtpMaxLine = 4096
+
+// SmtpSession follows the client side of an SMTP conversation and extracts
+// the envelope of every relay attempt. It's fed the raw client stream through
+// Write, or one line at a time through handleLine when emulating a server.
+type SmtpSession struct {
+	Helo          string
+	AuthMechanism string
+	AuthUser      string
+	AuthPass      string
+	MailFrom      string
+	RcptTo        []string
+	MessageSize   int64
+	Messages      int
+	StartTLS      bool
+
+	seen    bool
+	blocked bool
+	// accept has the fake server accept the messages, as if relaying them.
+	accept bool
+	inData bool
+	auth   string // pending AUTH exchange step
+	buf    []byte
+}
+
+func (s *SmtpSession) Write(p []byte) (int, error) {
+	if s.StartTLS {
+		return len(p), nil
+	}
+	s.buf = append(s.buf, p...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		s.handleLine(strings.TrimRight(string(s.buf[:i]), "\r"))
+		s.buf = s.buf[i+1:]
+	}
+	if len(s.buf) > smtpMaxLine {
+		if s.inData {
+			s.MessageSize += int64(len(s.buf))
+		}
+		s.buf = s.buf[:0]
+	}
+	return len(p), nil
+}
+
+// handleLine processes one client line and returns the reply a permissive
+// server would send, or "" when the line gets no reply (message content).
+func (s *SmtpSession) handleLine(line string) string {
+	if s.inData {
+		if line == "." {
+			s.inData = false
+			s.Messages++
+			if s.accept {
+				return fmt.Sprintf("250 2.0.0 Ok: queued as %010X", rand.Uint64()>>24)
+			}
+			return "554 5.7.1 Relay access denied"
+		}
+		s.MessageSize += int64(len(line)) + 2
+		return ""
+	}
+
+	switch s.auth {
+	case "plain":
+		s.auth = ""
+		s.decodePlain(line)
+		return "235 2.7.0 Authentication successful"
+	case "login-user":
+		s.auth = "login-pass"
+		s.AuthUser = decodeBase64(line)
+		return "334 UGFzc3dvcmQ6"
+	case "login-pass":
+		s.auth = ""
+		s.AuthPass = decodeBase64(line)
+		return "235 2.7.0 Authentication successful"
+	}
+
+	s.seen = true
+	verb, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+
+	switch strings.ToUpper(verb) {
+	case "EHLO":
+		s.Helo = arg
+		return "250-mail\r\n250-PIPELINING\r\n250-SIZE 10240000\r\n250-AUTH PLAIN LOGIN\r\n250 8BITMIME"
+	case "HELO":
+		s.Helo = arg
+		return "250 mail"
+	case "AUTH":
+		mech, ir, _ := strings.Cut(arg, " ")
+		s.AuthMechanism = strings.ToUpper(mech)
+		switch s.AuthMechanism {
+		case "PLAIN":
+			if ir == "" {
+				s.auth = "plain"
+				return "334 "
+			}
+			s.decodePlain(ir)
+			return "235 2.7.0 Authentication successful"
+		case "LOGIN":
+			if ir == "" {
+				s.auth = "login-user"
+				return "334 VXNlcm5hbWU6"
+			}
+			s.AuthUser = decodeBase64(ir)
+			s.auth = "login-pass"
+			return "334 UGFzc3dvcmQ6"
+		}
+		return "504 5.5.4 Unrecognized authentication type"
+	case "MAIL":
+		s.MailFrom = envelopeAddress(arg)
+		return "250 2.1.0 Ok"
+	case "RCPT":
+		s.RcptTo = append(s.RcptTo, envelopeAddress(arg))
+		return "250 2.1.5 Ok"
+	case "DATA":
+		s.inData = true
+		return "354 End data with <CR><LF>.<CR><LF>"
+	case "STARTTLS":
+		// A relayed conversation can't be followed past this point.
+		s.StartTLS = true
+		return "454 4.7.0 TLS not available due to local problem"
+	case "RSET", "NOOP":
+		return "250 2.0.0 Ok"
+	case "QUIT":
+		return "221 2.0.0 Bye"
+	}
+	return "502 5.5.2 Error: command not recognized"
+}
+
+func (s *SmtpSession) decodePlain(ir string) {
+	// authzid \0 authcid \0 passwd
+	parts := strings.SplitN(decodeBase64(ir), "\x00", 3)
+	if len(parts) == 3 {
+		s.AuthUser, s.AuthPass = parts[1], parts[2]
+	}
+}
+
+func decodeBase64(s string) string {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return s
+	}
+	return string(b)
+}
+
+// envelopeAddress extracts the address from "FROM:<a@b> SIZE=1" style args.
+func envelopeAddress(arg string) string {
+	if _, v, ok := strings.Cut(arg, ":"); ok {
+		arg = v
+	}
+	arg = strings.TrimSpace(arg)
+	if i := strings.IndexByte(arg, '>'); strings.HasPrefix(arg, "<") && i > 0 {
+		return arg[1:i]
+	}
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		return arg[:i]
+	}
+	return arg
+}
+
+// serveFakeSMTP plays the part of a permissive mail server so that the whole
+// relay attempt is captured, then rejects every message instead of relaying it,
+// or accepts it when s.accept is set, as if relayed. The client stream is read
+// through in so it is captured like a relayed one.
+func serveFakeSMTP(client net.Conn, in *bufio.Reader, s *SmtpSession) {
+	s.blocked = true
+	client.Write([]byte("220 mail ESMTP Postfix\r\n"))
+	for {
+		line, err := in.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if s.inData {
+				s.MessageSize += int64(len(line))
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		reply := s.handleLine(strings.TrimRight(string(line), "\r\n"))
+		if reply == "" {
+			continue
+		}
+		if _, err := client.Write([]byte(reply + "\r\n")); err != nil {
+			return
+		}
+		if strings.HasPrefix(reply, "221") {
+			return
+		}
+	}
+}
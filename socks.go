@@ -0,0 +1,230 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion   = 5
+	socksNoAuth    = 0
+	socksUserPass  = 2
+	socksNoMethods = 0xff
+	socksConnect   = 1
+)
+
+// The reply codes of RFC 1928.
+const (
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksNotAllowed         = 2
+	socksHostUnreachable    = 4
+	socksCommandUnsupported = 7
+	socksAddrUnsupported    = 8
+)
+
+// socksListener serves SOCKS5 clients as HTTP proxy ones, the reply to their
+// request following the response to the CONNECT it's read as. auth tells
+// whether the client at addr is let through with the user:pass of its RFC 1929
+// subnegotiation.
+type socksListener struct {
+	net.Listener
+	auth func(addr, userPass string) bool
+}
+
+func (l socksListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	fc := &frontendConn{Conn: c}
+	fc.open = func(br *bufio.Reader) (string, string, error) {
+		return socksHandshake(c, br, func(userPass string) bool { return l.auth(c.RemoteAddr().String(), userPass) })
+	}
+	fc.reply = func(status int) error { return socksReply(c, socksReplyCode(status)) }
+	return fc, nil
+}
+
+// socksHandshake negotiates the authentication with a SOCKS5 client on conn
+// and reads its request, returning the address the tunnel is to and the
+// credentials, if any, as a Proxy-Authorization. Username and password
+// credentials are preferred, for the proxy authentication to check them: those
+// allow refuses fail the subnegotiation, and the connection. A client not
+// speaking SOCKS5 gets no address.
+func socksHandshake(conn net.Conn, br *bufio.Reader, allow func(userPass string) bool) (string, string, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return "", "", err
+	}
+	if b[0] != socksVersion {
+		return "", "", nil
+	}
+
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return "", "", err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", "", err
+	}
+	method := byte(socksNoMethods)
+	switch {
+	case bytes.IndexByte(methods, socksUserPass) >= 0:
+		method = socksUserPass
+	case bytes.IndexByte(methods, socksNoAuth) >= 0:
+		method = socksNoAuth
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", "", err
+	}
+	if method == socksNoMethods {
+		return "", "", errors.New("socks: no supported authentication method")
+	}
+	auth := ""
+	if method == socksUserPass {
+		creds, err := readSocksAuth(br)
+		if err != nil {
+			return "", "", err
+		}
+		// Any status but 0 is a failure, after which the client is
+		// disconnected.
+		if !allow(creds) {
+			conn.Write([]byte{1, 1})
+			return "", "", errors.New("socks: authentication failed")
+		}
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return "", "", err
+		}
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return "", "", err
+	}
+	if req[0] != socksVersion {
+		return "", "", fmt.Errorf("socks: version %d in request", req[0])
+	}
+	if req[1] != socksConnect {
+		socksReply(conn, socksCommandUnsupported)
+		return "", "", fmt.Errorf("socks: unsupported command %d", req[1])
+	}
+	host, err := readSocksAddr(br, req[3])
+	if err != nil {
+		socksReply(conn, socksAddrUnsupported)
+		return "", "", err
+	}
+	return host, auth, nil
+}
+
+// socksAuth tells whether the SOCKS5 client at addr is let through the proxy
+// authentication with the user:pass of its subnegotiation, as that of a
+// CONNECT would be. The credentials refused are recorded on their own, the
+// client never getting to send the request of a tunnel.
+func (s *Server) socksAuth(addr, userPass string) bool {
+	cfg := s.config.Load()
+	ip := clientIP(addr)
+	h := http.Header{"Proxy-Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(userPass))}}
+	creds := readCredentials(h, nil)
+	if s.auth.allow(cfg, ip, creds) {
+		return true
+	}
+	if db, ok := s.db.(interface {
+		logCredentials(tunnelID, ip string, creds []credential, at time.Time) error
+	}); ok {
+		id, at := newID(), time.Now()
+		err := s.logger.enqueue(context.Background(), "credentials", id, func(context.Context) error {
+			return db.logCredentials(id, ip, creds, at)
+		}, nil)
+		logFailed(s.log.With("tunnel_id", id), "credentials", err)
+	}
+	return false
+}
+
+// readSocksAuth reads the username and password of RFC 1929, as user:pass.
+func readSocksAuth(br *bufio.Reader) (string, error) {
+	// The version of the subnegotiation, then the username and password,
+	// each prefixed with its length.
+	if _, err := br.ReadByte(); err != nil {
+		return "", err
+	}
+	var fields [2]string
+	for i := range fields {
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return "", err
+		}
+		fields[i] = string(b)
+	}
+	return fields[0] + ":" + fields[1], nil
+}
+
+// readSocksAddr reads the address of a request with the address type typ, as
+// a host:port.
+func readSocksAddr(br *bufio.Reader, typ byte) (string, error) {
+	var host string
+	switch typ {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if typ == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		n, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", err
+		}
+		if host = string(name); !validHostName(host) {
+			return "", fmt.Errorf("socks: invalid host name %q", name)
+		}
+	default:
+		return "", fmt.Errorf("socks: unsupported address type %d", typ)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// socksReply sends the reply to the request of the client on conn with code,
+// without a bound address.
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyCode returns the reply code to the response status of a CONNECT.
+func socksReplyCode(status int) byte {
+	switch status {
+	case http.StatusOK:
+		return socksSucceeded
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return socksNotAllowed
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
@@ -0,0 +1,120 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// socksAuthenticate opens a SOCKS5 connection to addr with the credentials,
+// and returns it with the status of the subnegotiation.
+func socksAuthenticate(t *testing.T, addr, user, pass string) (net.Conn, byte) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte{socksVersion, 1, socksUserPass, 1, byte(len(user))}
+	msg = append(append(append(msg, user...), byte(len(pass))), pass...)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != socksVersion || reply[1] != socksUserPass || reply[2] != 1 {
+		t.Fatalf("got the replies %v, want the username and password method", reply)
+	}
+	return conn, reply[3]
+}
+
+func TestSocksAuthentication(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	target := upstream.Listener.Addr().(*net.TCPAddr)
+
+	path := filepath.Join(t.TempDir(), "log.db")
+	s, err := NewServer(testConfig(t, "-db", path, "-proxy-auth", "-proxy-auth-users", "alice:secret",
+		"-proxy-auth-accept-after", "2"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeSocks(ln)
+	addr := ln.Addr().String()
+
+	// The wrong credentials fail the subnegotiation, and the connection,
+	// until the leaky mode accepts them.
+	for i := 0; i < 2; i++ {
+		conn, status := socksAuthenticate(t, addr, "mallory", "guess")
+		if status == 0 {
+			t.Fatalf("attempt %d: wrong credentials were accepted", i)
+		}
+		if b, err := io.ReadAll(conn); len(b) != 0 || err != nil {
+			t.Errorf("attempt %d: got %q, %v after the failure, want the connection closed", i, b, err)
+		}
+		conn.Close()
+	}
+	conn, status := socksAuthenticate(t, addr, "mallory", "guess")
+	conn.Close()
+	if status != 0 {
+		t.Errorf("the leaky mode refused the third attempt: status %d", status)
+	}
+
+	conn, status = socksAuthenticate(t, addr, "alice", "secret")
+	defer conn.Close()
+	if status != 0 {
+		t.Fatalf("the right credentials were refused: status %d", status)
+	}
+	req := append([]byte{socksVersion, socksConnect, 0, 1}, target.IP.To4()...)
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(req, uint16(target.Port))); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socksSucceeded {
+		t.Fatalf("CONNECT: got %v, %v", reply, err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+target.String()+"\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("got %q through the tunnel, want hello", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var refused int
+	if err := db.QueryRow("select count(*) from credentials where username = 'mallory'").Scan(&refused); err != nil {
+		t.Fatal(err)
+	}
+	if refused != 2 {
+		t.Errorf("recorded %d refused credentials, want 2", refused)
+	}
+}
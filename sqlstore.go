@@ -0,0 +1,257 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// sqlDrivers are the databases of the sql store, and the database/sql
+// drivers they're opened with.
+var sqlDrivers = map[string]string{"postgres": "pgx", "mysql": "mysql"}
+
+// SQLStore logs the requests and tunnels to a PostgreSQL or MySQL database,
+// which several instances can share. Each event is inserted in a transaction
+// of its own, in the requests, responses, request_tags and connects tables of
+// the SQLite schema.
+//
+// The other tables aren't written, the stats among them, which the
+// migrations create though, and the features reading their state back from
+// the database need the sqlite store.
+type SQLStore struct {
+	db     *sql.DB
+	driver string
+
+	insertRequest string
+	insertResp    string
+	insertTag     string
+	insertConnect string
+}
+
+// NewSQLStore opens the database of driver, postgres or mysql, at dsn and
+// migrates its schema.
+func NewSQLStore(driver, dsn string) (*SQLStore, error) {
+	name, ok := sqlDrivers[driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+	db, err := sql.Open(name, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", driver, err)
+	}
+	s := &SQLStore{db: db, driver: driver}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %w", driver, err)
+	}
+
+	s.insertRequest = s.rebind(`insert into requests (request_id, parent_id, from_ip, method, host, url, headers, tags,
+      header_order, fingerprint, status, size, upstream_us, overhead_us, error_type, request_size, error_response,
+      parse_anomalies, ja3, ja3s, country, city, asn, ptr, session_id, raw_request, raw_response, created_at)
+      values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`)
+	s.insertResp = s.rebind(`insert into responses (request_id, status, proto, headers, latency_us, size, created_at)
+      values (?,?,?,?,?,?,?)`)
+	s.insertTag = s.rebind(fmt.Sprintf("insert into request_tags (request_id, tag, location, %v, %v, source) values (?,?,?,?,?,?)",
+		s.quote("offset"), s.quote("match")))
+	s.insertConnect = s.rebind(`insert into connects (tunnel_id, from_ip, host, protocol, capture_truncated, rule,
+      error_response, dial_us, dial_error, mode, bytes_up, bytes_down, duration_us, country, city, asn, ptr, tags)
+      values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`)
+	return s, nil
+}
+
+// migrate applies the migrations of the dialect the database lacks, those
+// after the version of its schema_version table. Databases created before
+// there were migrations have no such table, and are given them all.
+func (s *SQLStore) migrate() error {
+	ms, err := sqlMigrations[s.driver]()
+	if err != nil {
+		return err
+	}
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	_, err = applyMigrations(s.db, ms, version, 0,
+		s.rebind("insert into schema_version (version, name, applied_by) values (?, ?, ?)"))
+	return err
+}
+
+// schemaVersion returns the version of the schema of the database, 0 when it
+// has no schema_version table.
+func (s *SQLStore) schemaVersion() (int, error) {
+	schema := "current_schema()"
+	if s.driver == "mysql" {
+		schema = "database()"
+	}
+	var tables int
+	err := s.db.QueryRow("select count(*) from information_schema.tables where table_schema = " + schema +
+		" and table_name = 'schema_version'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err = s.db.QueryRow("select coalesce(max(version), 0) from schema_version").Scan(&version)
+	return version, err
+}
+
+// rebind numbers the placeholders of query for PostgreSQL, which doesn't
+// take ?.
+func (s *SQLStore) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// quote quotes the column name, a reserved word of the database.
+func (s *SQLStore) quote(name string) string {
+	if s.driver == "mysql" {
+		return "`" + name + "`"
+	}
+	return `"` + name + `"`
+}
+
+// nullable returns nil for the empty string, stored as NULL like the SQLite
+// store does.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// LogExchange records the request with the status and size of its response,
+// the response in responses, and its detections in request_tags. The detail
+// shed by the logging pipeline under pressure is left out as by the sqlite
+// store.
+func (s *SQLStore) LogExchange(ctx context.Context, ex *Exchange) error {
+	req, state := ex.Request, ex.state
+	shed := shedLevel(ctx)
+
+	var tags, headerOrder, print, anomalies, upstream, overhead interface{}
+	if len(ex.Tags) > 0 {
+		tags = strings.Join(ex.Tags, ",")
+	}
+	if state.fingerprint != "" {
+		headerOrder, print = strings.Join(state.headers, ","), state.fingerprint
+	}
+	if a := state.anomaliesJSON(); a != nil {
+		anomalies = string(a)
+	}
+	var headers interface{} = headerLines(req.Header)
+	if shed >= shedHeaders {
+		headers, headerOrder, anomalies = nil, nil, nil
+	}
+	if up, over, ok := exchangeLatency(ex); ok {
+		upstream, overhead = up.Microseconds(), over.Microseconds()
+	}
+	at := ex.Start.UTC()
+	country, city, asn := state.origin.columns()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, s.insertRequest, ex.ID, nullable(ex.ParentID), ex.ClientIP, req.Method, req.Host,
+		req.URL.String(), headers, tags, headerOrder, print, ex.Status(), ex.Size, upstream, overhead,
+		nullable(errorType(ex.Err)), ex.Received, nullable(ex.ErrorResponse), anomalies, nullable(ex.JA3),
+		nullable(ex.JA3S), country, city, asn, nullable(state.ptr), nullable(ex.SessionID), nullable(ex.RawRequest),
+		nullable(ex.RawResponse), at)
+	if err != nil {
+		return fmt.Errorf("insert request: %w", err)
+	}
+	if resp := ex.Response; resp != nil && shed < shedMinimal {
+		var headers, latency interface{}
+		if shed < shedHeaders {
+			headers = headerLines(resp.Header)
+		}
+		if !ex.Responded.IsZero() {
+			latency = ex.Responded.Sub(ex.Start).Microseconds()
+		}
+		_, err := tx.ExecContext(ctx, s.insertResp, ex.ID, resp.StatusCode, resp.Proto, headers, latency, ex.Size, at)
+		if err != nil {
+			return fmt.Errorf("insert response: %w", err)
+		}
+	}
+	if shed < shedHeaders {
+		for _, m := range ex.Matches {
+			_, err := tx.ExecContext(ctx, s.insertTag, ex.ID, m.Tag, m.Location, m.Offset, m.Match, nullable(m.Source))
+			if err != nil {
+				return fmt.Errorf("insert request tag: %w", err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// LogTunnel records a relayed or rejected CONNECT tunnel with the rule it
+// matched, the protocol guessed being tagged as by the sqlite store. The
+// bytes captured and the mail conversations aren't kept.
+func (s *SQLStore) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	protocol, guessed := tunnelProtocol(tc, pctx)
+	rule := tunnelRule(pctx)
+	var errResp, dialUs, dialErr, mode, up, down, duration, country, city, asn, ptr, tags interface{}
+	if st, ok := pctx.UserData.(*tunnelState); ok {
+		country, city, asn = st.origin.columns()
+		ptr, mode, errResp, dialErr = nullable(st.ptr), nullable(st.mode), nullable(st.errorResponse), nullable(st.dialError)
+		if !st.end.IsZero() {
+			up, down, duration = st.up, st.down, st.end.Sub(st.start).Microseconds()
+		}
+		if st.dialTime > 0 {
+			dialUs = st.dialTime.Microseconds()
+		}
+	}
+	if guessed {
+		tags = protocolTag(protocol)
+	}
+	id, ip := requestID(pctx), clientIP(req.RemoteAddr)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, s.insertConnect, id, ip, req.URL.Host, protocol, tc.truncated, rule.Name, errResp,
+		dialUs, dialErr, mode, up, down, duration, country, city, asn, ptr, tags)
+	if err != nil {
+		return fmt.Errorf("insert tunnel: %w", err)
+	}
+	if guessed {
+		if _, err := tx.ExecContext(ctx, s.insertTag, id, protocolTag(protocol), "tunnel", 0, protocol, "protocol-guess"); err != nil {
+			return fmt.Errorf("insert tunnel tag: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Check probes that the database is writable with an insert that's rolled back.
+func (s *SQLStore) Check(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "insert into requests (method) values ('HEALTHCHECK')")
+	return err
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
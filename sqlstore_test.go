@@ -0,0 +1,153 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"github.com/elazarl/goproxy"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLStoreConfig(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-store", "sql", "-db-dsn", "postgres://db/stuffpot"}, `storage.driver: unknown driver ""`},
+		{[]string{"-store", "sql", "-db-driver", "oracle", "-db-dsn", "x"}, `storage.driver: unknown driver "oracle"`},
+		{[]string{"-store", "sql", "-db-driver", "mysql"}, "storage.dsn: the sql store needs one"},
+		{[]string{"-db-driver", "postgres"}, "storage.driver: only used by the sql store"},
+		{[]string{"-store", "sql", "-db-driver", "postgres", "-db-dsn", "x", "-report-dir", "reports"},
+			"report.dir: reports need the sqlite store"},
+	}
+	for _, tt := range tests {
+		_, err := NewConfigStore("stuffpot", tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+	if _, err := NewConfigStore("stuffpot", []string{"-store", "sql", "-db-driver", "mysql", "-db-dsn", "x"}); err != nil {
+		t.Errorf("a valid sql store: %v", err)
+	}
+}
+
+func TestSQLStoreRebind(t *testing.T) {
+	query := "insert into t (a, b) values (?,?)"
+	if got := (&SQLStore{driver: "postgres"}).rebind(query); got != "insert into t (a, b) values ($1,$2)" {
+		t.Errorf("postgres: got %q", got)
+	}
+	if got := (&SQLStore{driver: "mysql"}).rebind(query); got != query {
+		t.Errorf("mysql: got %q", got)
+	}
+}
+
+// TestSQLStore logs to the databases of STUFFPOT_TEST_POSTGRES_DSN and
+// STUFFPOT_TEST_MYSQL_DSN, skipping those unset.
+func TestSQLStore(t *testing.T) {
+	for _, driver := range []string{"postgres", "mysql"} {
+		t.Run(driver, func(t *testing.T) {
+			dsn := os.Getenv("STUFFPOT_TEST_" + strings.ToUpper(driver) + "_DSN")
+			if dsn == "" {
+				t.Skipf("STUFFPOT_TEST_%v_DSN isn't set", strings.ToUpper(driver))
+			}
+			store, err := NewSQLStore(driver, dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if err := store.Check(context.Background()); err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+			// Opened again, the database is left as it is.
+			again, err := NewSQLStore(driver, dsn)
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			again.Close()
+			ms, err := sqlMigrations[driver]()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var version, applied int
+			err = store.db.QueryRow("select max(version), count(*) from schema_version").Scan(&version, &applied)
+			if err != nil || version != len(ms) || applied != len(ms) {
+				t.Errorf("schema_version: got version %v of %v migrations, want %v, %v", version, applied, len(ms), err)
+			}
+			var stats int
+			if err := store.db.QueryRow("select count(*) from daily_client_stats").Scan(&stats); err != nil {
+				t.Errorf("the statistics tables: %v", err)
+			}
+			// The ids are unique to the run, the database outliving it.
+			id := "sqlstore-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+
+			req := httptest.NewRequest("GET", "http://a.example/wp-login.php?q=1", nil)
+			req.RemoteAddr = "192.0.2.1:40000"
+			state := &requestState{id: id, start: time.Now(), ptr: "host.example"}
+			state.exchange = newExchange(req, state)
+			ex := state.finish(&http.Response{StatusCode: 404, Proto: "HTTP/1.1", Header: http.Header{"Server": {"x"}}}, 9,
+				nil)
+			ex.Tags, ex.Matches = []string{"wordpress"}, []tagMatch{{Tag: "wordpress", Location: "url", Offset: 16,
+				Match: "/wp-login.php"}}
+			if err := store.LogExchange(context.Background(), ex); err != nil {
+				t.Fatalf("LogExchange: %v", err)
+			}
+
+			connect := &http.Request{Method: "CONNECT", URL: &url.URL{Host: "192.0.2.10:22"}, RemoteAddr: "198.51.100.7:40000"}
+			tc := newTunnelCapture(1024, 1<<20)
+			tc.record(dirDown, 0, []byte("SSH-2.0-OpenSSH_9.6\r\n"))
+			pctx := &goproxy.ProxyCtx{UserData: &tunnelState{id: id + "-t", mode: "tunnel"}}
+			if err := store.LogTunnel(context.Background(), connect, tc, nil, pctx); err != nil {
+				t.Fatalf("LogTunnel: %v", err)
+			}
+
+			db, err := sql.Open(sqlDrivers[driver], dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			var ip, tags, ptr string
+			var status int
+			err = db.QueryRow(store.rebind("select from_ip, status, tags, ptr from requests where request_id = ?"), id).
+				Scan(&ip, &status, &tags, &ptr)
+			if err != nil || ip != "192.0.2.1" || status != 404 || tags != "wordpress" || ptr != "host.example" {
+				t.Errorf("request: got %v %v %v %v, %v", ip, status, tags, ptr, err)
+			}
+			var proto string
+			err = db.QueryRow(store.rebind("select status, proto from responses where request_id = ?"), id).Scan(&status,
+				&proto)
+			if err != nil || status != 404 || proto != "HTTP/1.1" {
+				t.Errorf("response: got %v %v, %v", status, proto, err)
+			}
+			var host, protocol string
+			err = db.QueryRow(store.rebind("select from_ip, host, protocol, tags from connects where tunnel_id = ?"),
+				id+"-t").Scan(&ip, &host, &protocol, &tags)
+			if err != nil || ip != "198.51.100.7" || host != "192.0.2.10:22" || protocol != "ssh" || tags != "protocol-ssh" {
+				t.Errorf("tunnel: got %v %v %v %v, %v", ip, host, protocol, tags, err)
+			}
+			rows, err := db.Query(store.rebind("select request_id, tag, "+store.quote("match")+
+				" from request_tags where request_id in (?, ?) order by request_id"), id, id+"-t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var got []string
+			for rows.Next() {
+				var requestID, tag, match string
+				if err := rows.Scan(&requestID, &tag, &match); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, strings.Join([]string{strings.TrimPrefix(requestID, id), tag, match}, " "))
+			}
+			if want := []string{" wordpress /wp-login.php", "-t protocol-ssh ssh"}; strings.Join(got, ",") !=
+				strings.Join(want, ",") {
+				t.Errorf("request_tags: got %q, want %q", got, want)
+			}
+		})
+	}
+}
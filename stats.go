@@ -0,0 +1,238 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reindexStats rebuilds the stats tables from the requests, counting them as
+// updateStats does. The scores are kept, they can't be recomputed.
+func (logger *HttpLogger) reindexStats() error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	tx, err := logger.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := reindexStatsTx(tx, logger.trafficTop); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reindexStatsTx rebuilds the stats tables in tx, the host traffic of the days
+// before today being rolled up to the top trafficTop hosts.
+func reindexStatsTx(tx *sql.Tx, trafficTop int) error {
+	for _, stmt := range []string{
+		"create temp table old_scores as select ip, score from client_stats",
+		"delete from client_stats",
+		"delete from client_tag_stats",
+		"delete from host_stats",
+		"delete from host_clients",
+		"delete from daily_client_stats",
+		"delete from daily_host_stats",
+		"delete from daily_tag_stats",
+		`insert into client_stats (ip, first_seen, last_seen, requests, bytes, errors, score)
+          select from_ip, min(created_at), max(coalesce(last_seen, created_at)), sum(coalesce(occurrences, 1)),
+            coalesce(sum(size * coalesce(occurrences, 1)), 0),
+            coalesce(sum(case when status = 0 or status >= 400 then coalesce(occurrences, 1) end), 0),
+            (select score from old_scores where old_scores.ip = from_ip)
+          from requests group by from_ip`,
+		"insert into host_clients (host, ip) select distinct host, from_ip from requests",
+		`insert into host_stats (host, requests, clients, first_seen, last_seen)
+          select host, sum(coalesce(occurrences, 1)), count(distinct from_ip), min(created_at),
+            max(coalesce(last_seen, created_at))
+          from requests group by host`,
+		`insert into daily_client_stats (day, ip, requests, bytes, errors)
+          select substr(created_at, 1, 10), from_ip, sum(coalesce(occurrences, 1)),
+            coalesce(sum(size * coalesce(occurrences, 1)), 0),
+            coalesce(sum(case when status = 0 or status >= 400 then coalesce(occurrences, 1) end), 0)
+          from requests group by substr(created_at, 1, 10), from_ip`,
+		`insert into daily_host_stats (day, host, requests)
+          select substr(created_at, 1, 10), host, sum(coalesce(occurrences, 1)) from requests group by substr(created_at, 1, 10), host`,
+		"drop table old_scores",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	// The tags are a list in a column, they're counted here, those of the
+	// tunnels included. Deduplicated requests count as many times as they
+	// occurred.
+	counts := make(map[[2]string]int)
+	days := make(map[[2]string]int)
+	rows, err := tx.Query(`select from_ip, substr(created_at, 1, 10), tags, coalesce(occurrences, 1) from requests
+      where tags is not null and tags != ''
+      union all select from_ip, substr(created_at, 1, 10), tags, 1 from connects where tags is not null and tags != ''`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var ip, day, tags string
+		var n int
+		if err := rows.Scan(&ip, &day, &tags, &n); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, tag := range strings.Split(tags, ",") {
+			counts[[2]string{ip, tag}] += n
+			days[[2]string{day, tag}] += n
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for key, n := range counts {
+		if _, err := tx.Exec("insert into client_tag_stats (ip, tag, requests) values (?,?,?)", key[0], key[1], n); err != nil {
+			return err
+		}
+	}
+	for key, n := range days {
+		if _, err := tx.Exec("insert into daily_tag_stats (day, tag, requests) values (?,?,?)", key[0], key[1], n); err != nil {
+			return err
+		}
+	}
+	if err := reindexTrafficTx(tx, time.Now().UTC().Format(dayFormat), trafficTop); err != nil {
+		return err
+	}
+	return reindexLatencyTx(tx)
+}
+
+// tagStats is the requests given a tag over some days.
+type tagStats struct {
+	Tag      string `json:"tag"`
+	Requests int64  `json:"requests"`
+	Days     int    `json:"days"`
+	FirstDay string `json:"first_day"`
+	LastDay  string `json:"last_day"`
+}
+
+// readTagStats adds the tag counts of the days from since, all of them when
+// empty, to tags.
+func readTagStats(db *sql.DB, since string, tags map[string]*tagStats) error {
+	rows, err := db.Query("select day, tag, requests from daily_tag_stats where day >= ?", since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day, tag string
+		var n int64
+		if err := rows.Scan(&day, &tag, &n); err != nil {
+			return err
+		}
+		t := tags[tag]
+		if t == nil {
+			t = &tagStats{Tag: tag, FirstDay: day, LastDay: day}
+			tags[tag] = t
+		}
+		t.Requests += n
+		t.Days++
+		t.FirstDay, t.LastDay = min(t.FirstDay, day), max(t.LastDay, day)
+	}
+	return rows.Err()
+}
+
+// topTagStats returns the limit tags given to the most requests.
+func topTagStats(tags map[string]*tagStats, limit int) []tagStats {
+	list := make([]tagStats, 0, len(tags))
+	for _, t := range tags {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Requests != list[j].Requests {
+			return list[i].Requests > list[j].Requests
+		}
+		return list[i].Tag < list[j].Tag
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// tagStats returns the requests by tag of the days from since.
+func (logger *HttpLogger) tagStats(since string, limit int) ([]tagStats, error) {
+	tags := make(map[string]*tagStats)
+	if err := readTagStats(logger.db, since, tags); err != nil {
+		return nil, err
+	}
+	return topTagStats(tags, limit), nil
+}
+
+// reindexStatsCommand implements the reindex-stats subcommand:
+//
+//	stuffpot reindex-stats [-db path]
+//
+// It rebuilds the stats tables of the database and of its daily files, which
+// are migrated to the current schema first.
+func reindexStatsCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot reindex-stats", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	fs.Parse(args)
+
+	paths, err := databaseFiles(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, p := range paths {
+		logger, err := NewLogger(p)
+		if err == nil {
+			logger.setTrafficTop(cfg.Storage.HostTrafficTop)
+			err = logger.reindexStats()
+			logger.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", p, err)
+			failed = true
+			continue
+		}
+		fmt.Println(p, "reindexed")
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// databaseFiles returns the database at path, if any, and its daily files by
+// day. Finding none is an error.
+func databaseFiles(path string) ([]string, error) {
+	var paths []string
+	if _, err := os.Stat(path); err == nil {
+		paths = append(paths, path)
+	}
+	files, err := dayFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	days := make([]string, 0, len(files))
+	for day := range files {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	for _, day := range days {
+		paths = append(paths, files[day])
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no database at %v", path)
+	}
+	return paths, nil
+}
@@ -0,0 +1,186 @@
+package stuffpot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// tableRows returns the rows of table in db, ordered, as strings.
+func tableRows(t *testing.T, db *sql.DB, table string) [][]string {
+	t.Helper()
+	return queryRows(t, db, "select * from "+table+" order by 1, 2")
+}
+
+// queryRows returns the rows of query in db as strings.
+func queryRows(t *testing.T, db *sql.DB, query string) [][]string {
+	t.Helper()
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("%v: %v", query, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all [][]string
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			t.Fatal(err)
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			row[i] = fmt.Sprint(v)
+		}
+		all = append(all, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return all
+}
+
+func TestReindexedStatsEqualTheIncrementalOnes(t *testing.T) {
+	hosts := make([]*httptest.Server, 3)
+	for i := range hosts {
+		hosts[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/missing" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, "host %d", i)
+		}))
+		defer hosts[i].Close()
+	}
+
+	path := filepath.Join(t.TempDir(), "log.db")
+	config, err := NewConfigStore("stuffpot", []string{"-db", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, client := startServer(t, config, nil)
+	const n = 60
+	for i := 0; i < n; i++ {
+		u := hosts[i%len(hosts)].URL + []string{"/", "/missing", "/search?q=1'%20OR%20'1'='1", "/admin"}[i%4]
+		req, _ := http.NewRequest("GET", u, nil)
+		if i%5 == 0 {
+			req.Header.Set("User-Agent", "sqlmap/1.7")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	logger, err := NewLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	tables := []string{"client_stats", "client_tag_stats", "host_stats", "host_clients", "daily_client_stats",
+		"daily_host_stats", "daily_tag_stats", "host_traffic", "host_traffic_clients", "daily_latency_stats",
+		"daily_error_stats"}
+	incremental := make(map[string][][]string)
+	for _, table := range tables {
+		incremental[table] = tableRows(t, logger.db, table)
+	}
+	var requests int
+	logger.db.QueryRow("select count(*) from requests").Scan(&requests)
+	if requests != n || len(incremental["client_tag_stats"]) == 0 {
+		t.Fatalf("logged %d requests and %d tag stats, want %d and some", requests, len(incremental["client_tag_stats"]), n)
+	}
+
+	if err := logger.reindexStats(); err != nil {
+		t.Fatalf("reindexStats: %v", err)
+	}
+	for _, table := range tables {
+		if got := tableRows(t, logger.db, table); !reflect.DeepEqual(got, incremental[table]) {
+			t.Errorf("%v:\nreindexed   %v\nincremental %v", table, got, incremental[table])
+		}
+	}
+}
+
+func TestTagStats(t *testing.T) {
+	logger := testLogger(t)
+	for _, r := range []struct {
+		day, tag string
+		n        int
+	}{
+		{"2026-01-01", "sqli", 3}, {"2026-01-02", "sqli", 2}, {"2026-01-02", "scanner", 4},
+		{"2026-01-03", "xss", 1}, {"2026-01-03", "scanner", 1},
+	} {
+		if _, err := logger.db.Exec("insert into daily_tag_stats (day, tag, requests) values (?,?,?)", r.day, r.tag,
+			r.n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []tagStats{
+		{Tag: "scanner", Requests: 5, Days: 2, FirstDay: "2026-01-02", LastDay: "2026-01-03"},
+		{Tag: "sqli", Requests: 5, Days: 2, FirstDay: "2026-01-01", LastDay: "2026-01-02"},
+	}
+	if got, err := logger.tagStats("", 2); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got the top tags %+v, %v, want %+v", got, err, want)
+	}
+	want = []tagStats{
+		{Tag: "scanner", Requests: 5, Days: 2, FirstDay: "2026-01-02", LastDay: "2026-01-03"},
+		{Tag: "sqli", Requests: 2, Days: 1, FirstDay: "2026-01-02", LastDay: "2026-01-02"},
+		{Tag: "xss", Requests: 1, Days: 1, FirstDay: "2026-01-03", LastDay: "2026-01-03"},
+	}
+	if got, err := logger.tagStats("2026-01-02", 0); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got the tags since 2026-01-02 %+v, %v, want %+v", got, err, want)
+	}
+}
+
+func TestTagStatsOnTheAdminListener(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	s, client := startServer(t, testConfig(t), nil)
+	adminURL := serveAdmin(t, s)
+	req, _ := http.NewRequest("GET", upstream.URL+"/login", nil)
+	req.Header.Set("User-Agent", "sqlmap/1.8.4#stable (https://sqlmap.org)")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var body struct {
+		Tags []tagStats `json:"tags"`
+	}
+	today := time.Now().UTC().Format(dayFormat)
+	for deadline := time.Now().Add(5 * time.Second); len(body.Tags) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		getJSON(t, adminURL, "/api/stats/tags?since="+today, &body)
+	}
+	want := []tagStats{{Tag: "scanner", Requests: 1, Days: 1, FirstDay: today, LastDay: today}}
+	if !reflect.DeepEqual(body.Tags, want) {
+		t.Errorf("got the tags %+v, want %+v", body.Tags, want)
+	}
+	for _, q := range []string{"since=yesterday", "limit=0", "limit=x"} {
+		var e map[string]string
+		if code := getJSON(t, adminURL, "/api/stats/tags?"+q, &e); code != http.StatusBadRequest {
+			t.Errorf("%v: got %v, want 400", q, code)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package stuffpot
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// StoreOpener opens a storage backend registered with RegisterStore, given
+// the -db-dsn of the config.
+type StoreOpener func(dsn string) (Logger, error)
+
+var (
+	storesMu sync.Mutex
+	stores   = make(map[string]StoreOpener)
+)
+
+// RegisterStore makes the storage backend open selectable by name with
+// -store, for instance a database shared by several instances. It's meant to
+// be called from the init function of a program embedding the proxy, before
+// the config is loaded. The sqlite, memory and sql stores can't be replaced.
+//
+// The features reading back their state, such as honeytokens, fingerprint
+// labels and the admin API's listings, need one of the package's loggers: a
+// registered store only receives the events, like the other sinks.
+func RegisterStore(name string, open StoreOpener) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if name == "sqlite" || name == "memory" || name == "sql" {
+		panic(fmt.Sprintf("stuffpot: RegisterStore: the %v store can't be replaced", name))
+	}
+	stores[name] = open
+}
+
+// registeredStore returns the opener of the store name, if registered.
+func registeredStore(name string) (StoreOpener, bool) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	open, ok := stores[name]
+	return open, ok
+}
+
+// storeNames returns the names of the stores -store accepts.
+func storeNames() []string {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	names := []string{"sqlite", "memory", "sql"}
+	for name := range stores {
+		names = append(names, name)
+	}
+	slices.Sort(names[3:])
+	return names
+}
@@ -0,0 +1,57 @@
+package stuffpot
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisteredStoreReceivesTheEvents(t *testing.T) {
+	if _, err := NewConfigStore("stuffpot", []string{"-store", "shared"}); err == nil ||
+		!strings.Contains(err.Error(), "not one of sqlite, memory, sql") {
+		t.Errorf("got %v for an unregistered store", err)
+	}
+	rec := &recordingLogger{}
+	var dsn string
+	RegisterStore("shared", func(s string) (Logger, error) {
+		dsn = s
+		return rec, nil
+	})
+	defer func() {
+		storesMu.Lock()
+		delete(stores, "shared")
+		storesMu.Unlock()
+	}()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	s, client := startServer(t, testConfig(t, "-store", "shared", "-db-dsn", "shared://db"), nil)
+	resp, err := client.Get(upstream.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if dsn != "shared://db" || len(rec.exchanges) != 1 || !rec.closed {
+		t.Errorf("got the dsn %q, %v exchanges and closed %v, want the request logged to the store", dsn,
+			len(rec.exchanges), rec.closed)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("the sqlite store was replaced")
+		}
+	}()
+	RegisterStore("sqlite", func(string) (Logger, error) { return rec, nil })
+}
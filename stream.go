@@ -0,0 +1,181 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamBuffer is the number of requests a subscriber of /api/stream can fall
+// behind by before it misses some.
+const streamBuffer = 256
+
+// streamKeepAlive is the time between the comments keeping an idle stream
+// open through proxies.
+const streamKeepAlive = 15 * time.Second
+
+// liveStream is the sink of /api/stream, handing each completed request to the
+// subscribers whose filters it matches. The requests a subscriber is too slow
+// for are dropped and counted, so that it never holds up the logging queue.
+type liveStream struct {
+	mu   sync.Mutex
+	subs map[*streamSub]struct{}
+	// n is the number of subscribers, checked without the lock.
+	n    atomic.Int32
+	done chan struct{}
+}
+
+// streamSub is a subscriber of the stream with its filters. host is nil, and
+// client invalid, when not filtered on.
+type streamSub struct {
+	host   *regexp.Regexp
+	client netip.Prefix
+	tag    string
+	events chan []byte
+	missed atomic.Int64
+}
+
+func newLiveStream() *liveStream {
+	return &liveStream{subs: make(map[*streamSub]struct{}), done: make(chan struct{})}
+}
+
+// parseStreamFilters reads the filters of /api/stream: host, a regular
+// expression the host must match, client, an address or CIDR range, and tag.
+func parseStreamFilters(values url.Values) (*streamSub, error) {
+	sub := &streamSub{tag: values.Get("tag"), events: make(chan []byte, streamBuffer)}
+	if v := values.Get("host"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("host: %v", err)
+		}
+		sub.host = re
+	}
+	if v := values.Get("client"); v != "" {
+		p, err := parsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("client: %v", err)
+		}
+		sub.client = p
+	}
+	return sub, nil
+}
+
+// matches tells whether ex passes the filters of sub.
+func (sub *streamSub) matches(ex *Exchange) bool {
+	if sub.host != nil && !sub.host.MatchString(ex.Request.Host) {
+		return false
+	}
+	if sub.client.IsValid() {
+		a, err := netip.ParseAddr(ex.ClientIP)
+		if err != nil || !sub.client.Contains(a.Unmap()) {
+			return false
+		}
+	}
+	return sub.tag == "" || slices.Contains(ex.Tags, sub.tag)
+}
+
+func (ls *liveStream) subscribe(sub *streamSub) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.subs[sub] = struct{}{}
+	ls.n.Add(1)
+}
+
+func (ls *liveStream) unsubscribe(sub *streamSub) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	delete(ls.subs, sub)
+	ls.n.Add(-1)
+}
+
+func (ls *liveStream) LogExchange(ctx context.Context, ex *Exchange) error {
+	if ls.n.Load() == 0 {
+		return nil
+	}
+	var event []byte
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for sub := range ls.subs {
+		if !sub.matches(ex) {
+			continue
+		}
+		if event == nil {
+			var err error
+			if event, err = json.Marshal(ex); err != nil {
+				return err
+			}
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.missed.Add(1)
+		}
+	}
+	return nil
+}
+
+func (ls *liveStream) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	return nil
+}
+
+// Close ends the streams.
+func (ls *liveStream) Close() error {
+	close(ls.done)
+	return nil
+}
+
+// serve streams the requests matching the filters of r as server-sent events,
+// until the client goes away or the server shuts down. The requests missed
+// meanwhile are counted in a missed event.
+func (ls *liveStream) serve(w http.ResponseWriter, r *http.Request) {
+	sub, err := parseStreamFilters(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	rc := http.NewResponseController(w)
+	ls.subscribe(sub)
+	defer ls.unsubscribe(sub)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	t := time.NewTicker(streamKeepAlive)
+	defer t.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ls.done:
+			return
+		case <-t.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-sub.events:
+			if n := sub.missed.Swap(0); n > 0 {
+				fmt.Fprintf(w, "event: missed\ndata: {\"requests\": %d}\n\n", n)
+			}
+			_, err = fmt.Fprintf(w, "event: request\ndata: %s\n\n", event)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
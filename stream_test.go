@@ -0,0 +1,202 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamExchange returns an exchange of a GET of host from ip with tags.
+func streamExchange(id, host, ip string, tags ...string) *Exchange {
+	req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+	req.RemoteAddr = ip + ":40000"
+	ex := finishedExchange(req, id, &http.Response{StatusCode: 200, Proto: "HTTP/1.1", Header: http.Header{}}, 0)
+	ex.Tags = tags
+	return ex
+}
+
+func TestStreamFilters(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  []bool
+	}{
+		{"", []bool{true, true, true}},
+		{"host=^a%5C.example$", []bool{true, false, true}},
+		{"client=192.0.2.0/24", []bool{true, true, false}},
+		{"client=198.51.100.7", []bool{false, false, true}},
+		{"tag=scanner", []bool{false, true, false}},
+		{"host=example&client=192.0.2.1&tag=scanner", []bool{false, true, false}},
+	} {
+		values, _ := url.ParseQuery(tc.query)
+		sub, err := parseStreamFilters(values)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+		for i, ex := range []*Exchange{
+			streamExchange("r0", "a.example", "192.0.2.1"),
+			streamExchange("r1", "b.example", "192.0.2.1", "scanner"),
+			streamExchange("r2", "a.example", "198.51.100.7", "bot"),
+		} {
+			if got := sub.matches(ex); got != tc.want[i] {
+				t.Errorf("%q: matches(r%d) = %v, want %v", tc.query, i, got, tc.want[i])
+			}
+		}
+	}
+
+	for query, want := range map[string]string{"host=(": "host: ", "client=nope": "client: "} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parseStreamFilters(values); err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("%q: got %v, want an error on %s", query, err, want)
+		}
+	}
+}
+
+// blockingWriter is a ResponseWriter whose writes wait for release. The first
+// one is signalled on blocked, and all of them on wrote once done.
+type blockingWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	header  http.Header
+	blocked chan struct{}
+	release chan struct{}
+	wrote   chan struct{}
+}
+
+func (w *blockingWriter) Header() http.Header { return w.header }
+func (w *blockingWriter) WriteHeader(int)     {}
+func (w *blockingWriter) Flush()              {}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.blocked <- struct{}{}:
+	default:
+	}
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.wrote <- struct{}{}
+	return w.buf.Write(p)
+}
+
+func TestStreamCountsTheMissedRequests(t *testing.T) {
+	ls := newLiveStream()
+	w := &blockingWriter{header: http.Header{}, blocked: make(chan struct{}, 1), release: make(chan struct{}),
+		wrote: make(chan struct{}, 2*streamBuffer)}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/api/stream?host=a.example", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		ls.serve(w, r)
+		close(done)
+	}()
+	for ls.n.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The first request holds the stream in its write, the next ones fill the
+	// buffer and the last two are missed. Those filtered out are not.
+	log := func(id, host string) {
+		if err := ls.LogExchange(context.Background(), streamExchange(id, host, "192.0.2.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log("r0", "a.example")
+	<-w.blocked
+	for i := 1; i <= streamBuffer+2; i++ {
+		log(fmt.Sprintf("r%d", i), "a.example")
+		log(fmt.Sprintf("other%d", i), "b.example")
+	}
+	close(w.release)
+	// One write per event, and one for the missed event.
+	for i := 0; i < streamBuffer+2; i++ {
+		<-w.wrote
+	}
+	cancel()
+	<-done
+
+	if ct := w.header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got the content type %q", ct)
+	}
+	out := w.buf.String()
+	events := strings.Split(strings.TrimSuffix(out, "\n\n"), "\n\n")
+	if len(events) != streamBuffer+2 {
+		t.Fatalf("got %d events, want %d", len(events), streamBuffer+2)
+	}
+	if events[1] != "event: missed\ndata: {\"requests\": 2}" {
+		t.Errorf("got %q after the first request, want the missed event", events[1])
+	}
+	for i, event := range append(events[:1:1], events[2:]...) {
+		var ex struct {
+			ID string `json:"request_id"`
+		}
+		data, ok := strings.CutPrefix(event, "event: request\ndata: ")
+		if !ok || json.Unmarshal([]byte(data), &ex) != nil || ex.ID != fmt.Sprintf("r%d", i) {
+			t.Fatalf("event %d: got %q, want the request r%d", i, event, i)
+		}
+	}
+	if ls.n.Load() != 0 {
+		t.Errorf("the subscriber was not removed")
+	}
+}
+
+func TestStreamOnTheAdminListener(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	s, client := startServer(t, testConfig(t), &recordingLogger{})
+	adminURL := serveAdmin(t, s)
+
+	var body map[string]string
+	if code := getJSON(t, adminURL, "/api/stream?client=nope", &body); code != http.StatusBadRequest ||
+		!strings.HasPrefix(body["error"], "client: ") {
+		t.Errorf("got %d %v, want a 400 on the client filter", code, body)
+	}
+
+	resp, err := http.Get(adminURL + "/api/stream?client=127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got %v with headers %v", resp.Status, resp.Header)
+	}
+	for s.stream.n.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	proxied, err := client.Get(upstream.URL + "/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxied.Body.Close()
+
+	lines := bufio.NewScanner(resp.Body)
+	var event []string
+	for lines.Scan() && lines.Text() != "" {
+		event = append(event, lines.Text())
+	}
+	var ex struct {
+		Client  string `json:"client"`
+		Request struct {
+			URL string `json:"url"`
+		} `json:"request"`
+		Response struct {
+			Status int `json:"status"`
+		} `json:"response"`
+	}
+	if len(event) != 2 || event[0] != "event: request" ||
+		json.Unmarshal([]byte(strings.TrimPrefix(event[1], "data: ")), &ex) != nil ||
+		ex.Request.URL != upstream.URL+"/path" || ex.Client != "127.0.0.1" || ex.Response.Status != 200 {
+		t.Errorf("got the event %q", event)
+	}
+}
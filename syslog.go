@@ -0,0 +1,227 @@
+package stuffpot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogDialTimeout bounds the connection to the syslog endpoint.
+const syslogDialTimeout = 5 * time.Second
+
+// syslogEnterprise is the private enterprise number of the structured data
+// id, the one reserved for documentation as stuffpot has none.
+const syslogEnterprise = "32473"
+
+// The syslog priorities, of the local0 facility: notice for the requests and
+// warning for those tagged.
+const (
+	syslogNotice  = 16*8 + 5
+	syslogWarning = 16*8 + 4
+)
+
+// syslogAddr splits a syslog endpoint such as tcp://siem:514 into its network
+// and address.
+func syslogAddr(addr string) (string, string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return "", "", fmt.Errorf("unknown scheme in %q, not udp, tcp or tls", addr)
+	}
+	if u.Port() == "" {
+		return "", "", fmt.Errorf("no port in %q", addr)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// Syslog forwards a summary of each completed request to a syslog endpoint,
+// in RFC 5424 with structured data or in CEF. Over TCP and TLS the messages
+// are framed by their length, as in RFC 6587, and the connection is dialed
+// again after a failure.
+type Syslog struct {
+	mu       sync.Mutex
+	network  string
+	addr     string
+	format   string
+	tls      *tls.Config
+	hostname string
+	conn     net.Conn
+}
+
+func NewSyslog(cfg SyslogConfig) (*Syslog, error) {
+	network, addr, err := syslogAddr(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	sl := &Syslog{network: network, addr: addr, format: cfg.Format, hostname: "-"}
+	if h, err := os.Hostname(); err == nil && h != "" {
+		sl.hostname = h
+	}
+	if network == "tls" {
+		host, _, _ := net.SplitHostPort(addr)
+		sl.tls = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if cfg.CA != "" {
+			pem, err := os.ReadFile(cfg.CA)
+			if err != nil {
+				return nil, fmt.Errorf("syslog CA: %w", err)
+			}
+			sl.tls.RootCAs = x509.NewCertPool()
+			if !sl.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("syslog CA: no certificate in %v", cfg.CA)
+			}
+		}
+	}
+	return sl, nil
+}
+
+// dial connects to the endpoint.
+func (sl *Syslog) dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, syslogDialTimeout)
+	defer cancel()
+	if sl.tls != nil {
+		d := &tls.Dialer{Config: sl.tls}
+		return d.DialContext(ctx, "tcp", sl.addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, sl.network, sl.addr)
+}
+
+// send writes msg, dialing first when there's no connection. A connection
+// failing is closed, to be dialed again by the next message.
+func (sl *Syslog) send(ctx context.Context, msg string) error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if sl.conn == nil {
+		conn, err := sl.dial(ctx)
+		if err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+		sl.conn = conn
+	}
+	if sl.network != "udp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	deadline, _ := ctx.Deadline()
+	sl.conn.SetWriteDeadline(deadline)
+	if _, err := sl.conn.Write([]byte(msg)); err != nil {
+		sl.conn.Close()
+		sl.conn = nil
+		return fmt.Errorf("syslog: %w", err)
+	}
+	return nil
+}
+
+func (sl *Syslog) LogExchange(ctx context.Context, ex *Exchange) error {
+	return sl.send(ctx, sl.message(ex))
+}
+
+func (sl *Syslog) LogTunnel(ctx context.Context, req *http.Request, tc *TunnelCapture, smtp *SmtpSession, pctx *goproxy.ProxyCtx) error {
+	return nil
+}
+
+// message returns the syslog message of ex, with its RFC 5424 header.
+func (sl *Syslog) message(ex *Exchange) string {
+	pri := syslogNotice
+	if len(ex.Tags) > 0 {
+		pri = syslogWarning
+	}
+	header := fmt.Sprintf("<%d>1 %v %v stuffpot %d request", pri, ex.Start.UTC().Format(time.RFC3339Nano),
+		sl.hostname, os.Getpid())
+	if sl.format == "cef" {
+		return header + " - " + cefMessage(ex)
+	}
+
+	params := []struct{ name, value string }{
+		{"id", ex.ID}, {"client", ex.ClientIP}, {"method", ex.Request.Method}, {"host", ex.Request.Host},
+		{"url", ex.Request.URL.String()}, {"status", strconv.Itoa(ex.Status())}, {"bytes", strconv.FormatInt(ex.Size, 10)},
+		{"user_agent", ex.Request.UserAgent()}, {"tags", strings.Join(ex.Tags, ",")},
+	}
+	if ex.ParentID != "" {
+		params = append(params, struct{ name, value string }{"parent_id", ex.ParentID})
+	}
+	var b strings.Builder
+	b.WriteString(header + " [request@" + syslogEnterprise)
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		b.WriteString(" " + p.name + `="`)
+		for _, r := range strings.ToValidUTF8(p.value, "�") {
+			if r == '"' || r == '\\' || r == ']' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+	}
+	fmt.Fprintf(&b, "] %v %v %d", ex.Request.Method, escapeLogField(ex.Request.URL.String()), ex.Status())
+	return b.String()
+}
+
+// cefMessage returns ex in the ArcSight Common Event Format. Tagged requests
+// have severity 7, the others 3.
+func cefMessage(ex *Exchange) string {
+	severity := 3
+	if len(ex.Tags) > 0 {
+		severity = 7
+	}
+	ext := []struct{ key, value string }{
+		{"rt", strconv.FormatInt(ex.Start.UnixMilli(), 10)}, {"src", ex.ClientIP}, {"requestMethod", ex.Request.Method},
+		{"dhost", ex.Request.URL.Hostname()}, {"request", ex.Request.URL.String()},
+		{"requestClientApplication", ex.Request.UserAgent()}, {"outcome", strconv.Itoa(ex.Status())},
+		{"out", strconv.FormatInt(ex.Size, 10)}, {"externalId", ex.ID}, {"dpt", ex.Request.URL.Port()},
+	}
+	if len(ex.Tags) > 0 {
+		ext = append(ext, struct{ key, value string }{"cs1Label", "tags"},
+			struct{ key, value string }{"cs1", strings.Join(ex.Tags, ",")})
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|securized|stuffpot|%v|http-request|HTTP request|%d|", cefEscape(version, "|"), severity)
+	first := true
+	for _, e := range ext {
+		if e.value == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(e.key + "=" + cefEscape(e.value, "="))
+	}
+	return b.String()
+}
+
+// cefEscape escapes the backslashes and the special character of a CEF field,
+// and its line breaks.
+func cefEscape(s, special string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, special, `\`+special)
+	s = strings.ReplaceAll(s, "\r", `\r`)
+	return strings.ReplaceAll(s, "\n", `\n`)
+}
+
+func (sl *Syslog) Close() error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.conn == nil {
+		return nil
+	}
+	err := sl.conn.Close()
+	sl.conn = nil
+	return err
+}
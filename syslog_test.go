@@ -0,0 +1,113 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogAddr(t *testing.T) {
+	if network, addr, err := syslogAddr("tls://siem.example:6514"); err != nil || network != "tls" ||
+		addr != "siem.example:6514" {
+		t.Errorf("got %v, %v, %v", network, addr, err)
+	}
+	for _, addr := range []string{"siem.example:514", "http://siem.example:514", "udp://siem.example"} {
+		if _, _, err := syslogAddr(addr); err == nil {
+			t.Errorf("%v: got no error", addr)
+		}
+	}
+}
+
+// syslogExchange returns a tagged exchange, with a User-Agent to escape.
+func syslogExchange() *Exchange {
+	req := httptest.NewRequest("GET", "http://a.example:8080/x?a=b", nil)
+	req.Header.Set("User-Agent", `evil"] agent\`)
+	ex := finishedExchange(req, "r1", &http.Response{StatusCode: 404, Proto: "HTTP/1.1", Header: http.Header{}}, 9)
+	ex.Tags = []string{"scanner", "sqli"}
+	return ex
+}
+
+func TestSyslogOverTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sl, err := NewSyslog(SyslogConfig{Addr: "tcp://" + ln.Addr().String(), Format: "rfc5424"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+
+	// readFrame reads a message framed by its length from the next
+	// connection accepted.
+	readFrame := func() string {
+		t.Helper()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		br := bufio.NewReader(conn)
+		length, err := br.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("the length %q: %v", length, err)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			t.Fatal(err)
+		}
+		return string(msg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sl.LogExchange(ctx, syslogExchange()); err != nil {
+		t.Fatal(err)
+	}
+	msg := readFrame()
+	for _, want := range []string{"<132>1 ", " stuffpot ", fmt.Sprintf(" request [request@%v id=\"r1\"", syslogEnterprise),
+		`client="192.0.2.1"`, `status="404"`, `user_agent="evil\"\] agent\\"`, `tags="scanner,sqli"`,
+		"] GET http://a.example:8080/x?a=b 404"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("got %q, want it to contain %q", msg, want)
+		}
+	}
+
+	// A connection which failed is dialed again by the next message.
+	sl.conn.Close()
+	if err := sl.LogExchange(ctx, syslogExchange()); err == nil {
+		t.Error("writing to a closed connection didn't fail")
+	}
+	if err := sl.LogExchange(ctx, syslogExchange()); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readFrame(); !strings.HasPrefix(msg, "<132>1 ") {
+		t.Errorf("after a failure: got %q", msg)
+	}
+}
+
+func TestCEFMessage(t *testing.T) {
+	ex := syslogExchange()
+	ex.Request.Header.Set("User-Agent", "a=b\nc")
+	msg := cefMessage(ex)
+	want := fmt.Sprintf("CEF:0|securized|stuffpot|%v|http-request|HTTP request|7|rt=%d src=192.0.2.1 requestMethod=GET "+
+		`dhost=a.example request=http://a.example:8080/x?a\=b requestClientApplication=a\=b\nc outcome=404 out=9 `+
+		"externalId=r1 dpt=8080 cs1Label=tags cs1=scanner,sqli", cefEscape(version, "|"), ex.Start.UnixMilli())
+	if msg != want {
+		t.Errorf("got  %q\nwant %q", msg, want)
+	}
+}
@@ -0,0 +1,229 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// connectTarget is a CONNECT, counted in connect_targets whatever is done
+// with it.
+type connectTarget struct {
+	Host     string
+	Port     int
+	ClientIP string
+	At       time.Time
+}
+
+// newConnectTarget returns the target of a CONNECT of ip to host, a
+// host:port.
+func newConnectTarget(host, ip string, at time.Time) *connectTarget {
+	t := &connectTarget{Host: host, ClientIP: ip, At: at}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		t.Host = h
+		t.Port, _ = strconv.Atoi(port)
+	}
+	return t
+}
+
+// logConnectTarget counts a CONNECT in connect_targets. The days before
+// yesterday are rolled up first, like host_traffic.
+func (logger *HttpLogger) logConnectTarget(t *connectTarget) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	tx, err := logger.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	at := t.At.UTC()
+	day := at.Format(dayFormat)
+	if err := rollupTargets(tx, at.AddDate(0, 0, -1).Format(dayFormat), logger.trafficTop); err != nil {
+		return fmt.Errorf("roll up connect targets: %w", err)
+	}
+	res, err := tx.Exec("insert or ignore into connect_target_clients (day, host, port, ip) values (?,?,?,?)",
+		day, t.Host, t.Port, t.ClientIP)
+	if err != nil {
+		return fmt.Errorf("insert connect target client: %w", err)
+	}
+	newClient, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	seen := at.Format(time.DateTime)
+	_, err = tx.Exec(`insert into connect_targets (day, host, port, first_seen, last_seen, tunnels, clients)
+      values (?,?,?,?,?,1,?) on conflict (day, host, port) do update set last_seen = max(last_seen, excluded.last_seen),
+        tunnels = tunnels + 1, clients = clients + excluded.clients`,
+		day, t.Host, t.Port, seen, seen, newClient)
+	if err != nil {
+		return fmt.Errorf("upsert connect target: %w", err)
+	}
+	return tx.Commit()
+}
+
+// addTargetBytes adds the bytes relayed by a tunnel opened at start to its
+// target, within the transaction logging it. Targets rolled up since are
+// left as they are.
+func addTargetBytes(tx *sql.Tx, host string, start time.Time, bytes int64) error {
+	t := newConnectTarget(host, "", start)
+	_, err := tx.Exec("update connect_targets set bytes = bytes + ? where day = ? and host = ? and port = ?",
+		bytes, start.UTC().Format(dayFormat), t.Host, t.Port)
+	if err != nil {
+		return fmt.Errorf("update connect target bytes: %w", err)
+	}
+	return nil
+}
+
+// rollupTargets sums the targets of each day before before, beyond the top
+// ones by tunnels, into the otherHost row of their port, and drops the
+// clients of the day. top 0 keeps every target.
+func rollupTargets(tx *sql.Tx, before string, top int) error {
+	rows, err := tx.Query("select distinct day from connect_target_clients where day < ?", before)
+	if err != nil {
+		return err
+	}
+	var days []string
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return err
+		}
+		days = append(days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, day := range days {
+		if top > 0 {
+			if err := rollupTargetDay(tx, day, top); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("delete from connect_target_clients where day = ?", day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupTargetDay sums the targets of day beyond the top ones into otherHost,
+// by port, keeping what each port is wanted for.
+func rollupTargetDay(tx *sql.Tx, day string, top int) error {
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"create temp table if not exists rolled_targets (host TEXT, port INTEGER, PRIMARY KEY (host, port))", nil},
+		{"delete from temp.rolled_targets", nil},
+		{`insert into temp.rolled_targets select host, port from connect_targets where day = ? and host != ?
+          order by tunnels desc, clients desc, host, port limit -1 offset ?`, []interface{}{day, otherHost, top}},
+		{`insert into connect_targets (day, host, port, first_seen, last_seen, tunnels, bytes, clients)
+          select ?, ?, t.port, min(t.first_seen), max(t.last_seen), sum(t.tunnels), sum(t.bytes),
+            (select count(distinct c.ip) from connect_target_clients c where c.day = ? and c.port = t.port
+              and (c.host, c.port) in (select host, port from temp.rolled_targets))
+          from connect_targets t where t.day = ? and (t.host, t.port) in (select host, port from temp.rolled_targets)
+          group by t.port
+          on conflict (day, host, port) do update set first_seen = min(first_seen, excluded.first_seen),
+            last_seen = max(last_seen, excluded.last_seen), tunnels = tunnels + excluded.tunnels,
+            bytes = bytes + excluded.bytes, clients = clients + excluded.clients`, []interface{}{day, otherHost, day, day}},
+		{`delete from connect_targets where day = ? and (host, port) in (select host, port from temp.rolled_targets)`,
+			[]interface{}{day}},
+	} {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// targetStats is what's known of the CONNECTs to a target over some days.
+type targetStats struct {
+	Host    string `json:"host"`
+	Port    int    `json:"port"`
+	Tunnels int64  `json:"tunnels"`
+	// Clients is summed over the days, a client counting once a day.
+	Clients int64 `json:"clients"`
+	// Bytes is relayed by the tunnels which were neither intercepted nor
+	// parsed, those being counted in host_traffic.
+	Bytes     int64  `json:"bytes"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+	Days      int    `json:"days"`
+}
+
+// readConnectTargets adds the targets of the days from since, all of them
+// when empty, to targets, by host:port. Databases without connect_targets
+// have none.
+func readConnectTargets(db *sql.DB, since string, targets map[string]*targetStats) error {
+	if ok, err := hasTable(db, "connect_targets"); err != nil || !ok {
+		return err
+	}
+	rows, err := db.Query(`select host, port, tunnels, clients, bytes, first_seen, last_seen from connect_targets
+      where day >= ?`, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t targetStats
+		if err := rows.Scan(&t.Host, &t.Port, &t.Tunnels, &t.Clients, &t.Bytes, &t.FirstSeen, &t.LastSeen); err != nil {
+			return err
+		}
+		key := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+		s := targets[key]
+		if s == nil {
+			s = &targetStats{Host: t.Host, Port: t.Port, FirstSeen: t.FirstSeen, LastSeen: t.LastSeen}
+			targets[key] = s
+		}
+		s.Tunnels += t.Tunnels
+		s.Clients += t.Clients
+		s.Bytes += t.Bytes
+		s.FirstSeen = min(s.FirstSeen, t.FirstSeen)
+		s.LastSeen = max(s.LastSeen, t.LastSeen)
+		s.Days++
+	}
+	return rows.Err()
+}
+
+// topConnectTargets returns the limit targets with the most tunnels, of port
+// only unless it's 0.
+func topConnectTargets(targets map[string]*targetStats, port, limit int) []targetStats {
+	list := make([]targetStats, 0, len(targets))
+	for _, t := range targets {
+		if port == 0 || t.Port == port {
+			list = append(list, *t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Tunnels != list[j].Tunnels {
+			return list[i].Tunnels > list[j].Tunnels
+		}
+		if list[i].Clients != list[j].Clients {
+			return list[i].Clients > list[j].Clients
+		}
+		if list[i].Host != list[j].Host {
+			return list[i].Host < list[j].Host
+		}
+		return list[i].Port < list[j].Port
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// connectTargets returns the targets of the days from since.
+func (logger *HttpLogger) connectTargets(since string, port, limit int) ([]targetStats, error) {
+	targets := make(map[string]*targetStats)
+	if err := readConnectTargets(logger.db, since, targets); err != nil {
+		return nil, err
+	}
+	return topConnectTargets(targets, port, limit), nil
+}
@@ -0,0 +1,65 @@
+package stuffpot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConnectTargetsAreCountedAndRolledUp(t *testing.T) {
+	logger := testLogger(t)
+	logger.trafficTop = 1
+	day1 := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, c := range []struct{ host, ip string }{
+		{"a.example:443", "192.0.2.1"}, {"a.example:443", "192.0.2.2"}, {"a.example:443", "192.0.2.1"},
+		{"b.example:443", "192.0.2.1"}, {"c.example:443", "192.0.2.3"}, {"192.0.2.10:22", "192.0.2.1"},
+	} {
+		if err := logger.logConnectTarget(newConnectTarget(c.host, c.ip, day1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := logger.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := addTargetBytes(tx, "192.0.2.10:22", day1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []targetStats{
+		{Host: "a.example", Port: 443, Tunnels: 3, Clients: 2, FirstSeen: "2026-01-01 10:00:00",
+			LastSeen: "2026-01-01 10:00:00", Days: 1},
+		{Host: "192.0.2.10", Port: 22, Tunnels: 1, Clients: 1, Bytes: 100, FirstSeen: "2026-01-01 10:00:00",
+			LastSeen: "2026-01-01 10:00:00", Days: 1},
+	}
+	if got, err := logger.connectTargets("", 0, 2); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got the top targets %+v, %v, want %+v", got, err, want)
+	}
+
+	// A CONNECT two days later rolls the first day up: the targets beyond the
+	// top one are summed by port.
+	if err := logger.logConnectTarget(newConnectTarget("a.example:443", "192.0.2.1", day1.AddDate(0, 0, 2))); err != nil {
+		t.Fatal(err)
+	}
+	wantRows := [][]string{
+		{"2026-01-01", "(other)", "22", "1", "100", "1"},
+		{"2026-01-01", "(other)", "443", "2", "0", "2"},
+		{"2026-01-01", "a.example", "443", "3", "0", "2"},
+		{"2026-01-03", "a.example", "443", "1", "0", "1"},
+	}
+	got := queryRows(t, logger.db, `select day, host, port, tunnels, bytes, clients from connect_targets
+	  order by day, host, port`)
+	if !reflect.DeepEqual(got, wantRows) {
+		t.Errorf("got connect_targets %v, want %v", got, wantRows)
+	}
+	if got := queryRows(t, logger.db, "select distinct day from connect_target_clients"); !reflect.DeepEqual(got,
+		[][]string{{"2026-01-03"}}) {
+		t.Errorf("got the clients of the days %v, want those of the day not over only", got)
+	}
+	if got, err := logger.connectTargets("2026-01-02", 443, 0); err != nil || len(got) != 1 || got[0].Tunnels != 1 {
+		t.Errorf("since the second day: got %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,166 @@
+package stuffpot
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTarpitClients bounds the clients remembered as tarpitted, further ones
+// being tarpitted by the tags of their requests only.
+const maxTarpitClients = 100000
+
+// tarpit slows down the responses to the requests with the tags of the
+// tarpit config, and to the clients which sent one within its TTL, to waste
+// their time. It keeps count of the responses tarpitted at once.
+type tarpit struct {
+	config *ConfigStore
+	active atomic.Int64
+	log    *slog.Logger
+
+	mu sync.Mutex
+	// clients are tarpitted until their time.
+	clients map[string]time.Time
+}
+
+func newTarpit(config *ConfigStore) *tarpit {
+	return &tarpit{config: config, log: slog.With("component", "tarpit"), clients: make(map[string]time.Time)}
+}
+
+// observe tarpits ip for the TTL once its request, whose state is complete,
+// has one of the tags of the tarpit, as a tag or as the match of a rule, so
+// that the clients matched by the payload rules once their requests are
+// logged are tarpitted from their next request on.
+func (tp *tarpit) observe(ip string, state *requestState) {
+	cfg := tp.config.Load().Tarpit
+	matched := slices.ContainsFunc(state.matches, func(m tagMatch) bool { return slices.Contains(cfg.Tags, m.Tag) })
+	if !matched && !tarpitTagged(cfg, state.tags) {
+		return
+	}
+	now := time.Now()
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if _, ok := tp.clients[ip]; !ok && len(tp.clients) >= maxTarpitClients {
+		for k, until := range tp.clients {
+			if now.After(until) {
+				delete(tp.clients, k)
+			}
+		}
+		if len(tp.clients) >= maxTarpitClients {
+			return
+		}
+	}
+	tp.clients[ip] = now.Add(cfg.TTL)
+}
+
+// tarpitTagged tells whether one of tags is tarpitted by cfg.
+func tarpitTagged(cfg TarpitConfig, tags []string) bool {
+	return slices.ContainsFunc(tags, func(tag string) bool { return slices.Contains(cfg.Tags, tag) })
+}
+
+// tarpitted tells whether the requests of ip are tarpitted, whatever their
+// tags.
+func (tp *tarpit) tarpitted(ip string) bool {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	until, ok := tp.clients[ip]
+	if ok && time.Now().After(until) {
+		delete(tp.clients, ip)
+		return false
+	}
+	return ok
+}
+
+// apply tarpits the response to a request of ip with tags, whose id is id and
+// whose client connection is conn, if cfg tarpits one of its tags or ip, and
+// fewer than its max_active responses are. The delay mode holds it until ctx
+// is done, the drip mode has conn written a byte at a time from then on. It
+// tells whether the response was tarpitted.
+func (tp *tarpit) apply(ctx context.Context, cfg *Config, ip string, tags []string, conn *clientConn, id string) bool {
+	tc := cfg.Tarpit
+	if len(tc.Tags) == 0 || !tarpitTagged(tc, tags) && !tp.tarpitted(ip) {
+		return false
+	}
+	if tc.Mode == "drip" && conn == nil {
+		return false
+	}
+	if tp.active.Add(1) > int64(tc.MaxActive) {
+		tp.active.Add(-1)
+		return false
+	}
+	tarpitted.Add(1)
+	tp.log.Debug("Tarpitting response", "request_id", id, "client", ip, "mode", tc.Mode)
+	if tc.Mode == "drip" {
+		d := &drip{delay: tc.Delay, jitter: tc.Jitter, until: time.Now().Add(tc.MaxTime), done: make(chan struct{}),
+			release: func() { tp.active.Add(-1) }}
+		// A connection already dripping keeps its drip.
+		if !conn.tarpit(d) {
+			d.end()
+		}
+		return true
+	}
+	defer tp.active.Add(-1)
+	t := time.NewTimer(jittered(tc.Delay, tc.Jitter))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+// jittered returns d, plus or minus up to jitter, and at least 0.
+func jittered(d, jitter time.Duration) time.Duration {
+	if jitter > 0 {
+		d += time.Duration(rand.Int64N(int64(2*jitter)+1)) - jitter
+	}
+	return max(d, 0)
+}
+
+// drip writes to a tarpitted connection a byte at a time, waiting between
+// the bytes, until the drip ends.
+type drip struct {
+	delay, jitter time.Duration
+	until         time.Time
+	done          chan struct{}
+	once          sync.Once
+	release       func()
+}
+
+// write writes p to w, a byte at a time until the drip ends, then the bytes
+// left at once.
+func (d *drip) write(w io.Writer, p []byte) (int, error) {
+	n := 0
+	for n < len(p) && time.Now().Before(d.until) {
+		t := time.NewTimer(jittered(d.delay, d.jitter))
+		select {
+		case <-t.C:
+		case <-d.done:
+			t.Stop()
+		}
+		m, err := w.Write(p[n : n+1])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	d.end()
+	m, err := w.Write(p[n:])
+	return n + m, err
+}
+
+// end ends the drip, the connection being closed or its time up.
+func (d *drip) end() {
+	d.once.Do(func() {
+		close(d.done)
+		d.release()
+	})
+}
@@ -0,0 +1,164 @@
+package stuffpot
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJittered(t *testing.T) {
+	for range 100 {
+		if d := jittered(10*time.Millisecond, 5*time.Millisecond); d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("got %v, want 10ms plus or minus 5ms", d)
+		}
+	}
+	if d := jittered(time.Millisecond, time.Second); d < 0 {
+		t.Errorf("got %v, want at least 0", d)
+	}
+}
+
+func TestDrip(t *testing.T) {
+	released := 0
+	d := &drip{delay: time.Millisecond, until: time.Now().Add(time.Hour), done: make(chan struct{}),
+		release: func() { released++ }}
+	var w bytes.Buffer
+	start := time.Now()
+	if n, err := d.write(&w, []byte("abcde")); n != 5 || err != nil || w.String() != "abcde" {
+		t.Errorf("got %v, %v, %q, want the bytes written", n, err, w.String())
+	}
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Errorf("the bytes were written in %v, want a byte a millisecond", elapsed)
+	}
+
+	// Once its time is up, the rest is written at once and the drip ends.
+	d.until = time.Now()
+	w.Reset()
+	if n, err := d.write(&w, []byte("fgh")); n != 3 || err != nil || w.String() != "fgh" {
+		t.Errorf("got %v, %v, %q, want the bytes written", n, err, w.String())
+	}
+	d.end()
+	if released != 1 {
+		t.Errorf("the drip was released %v times, want once", released)
+	}
+}
+
+func TestTarpitClientsAndTags(t *testing.T) {
+	config := testConfig(t, "-tarpit-tags", "scanner,rate-limited", "-tarpit-delay", "50ms", "-tarpit-jitter", "0",
+		"-tarpit-max-active", "1")
+	cfg := config.Load()
+	tp := newTarpit(config)
+	start := time.Now()
+	if !tp.apply(context.Background(), cfg, "192.0.2.1", []string{"rate-limited"}, nil, "r1") ||
+		time.Since(start) < 50*time.Millisecond {
+		t.Errorf("a tagged response was held %v, want 50ms", time.Since(start))
+	}
+	if tp.apply(context.Background(), cfg, "192.0.2.1", []string{"other"}, nil, "r2") {
+		t.Error("a response without the tags was tarpitted")
+	}
+
+	// A client matched by a payload rule is tarpitted until the TTL.
+	tp.observe("192.0.2.1", &requestState{matches: []tagMatch{{Tag: "scanner"}}})
+	if !tp.tarpitted("192.0.2.1") || tp.tarpitted("192.0.2.2") {
+		t.Error("want only the scanner tarpitted")
+	}
+	if !tp.apply(context.Background(), cfg, "192.0.2.1", nil, nil, "r3") {
+		t.Error("a response to the scanner wasn't tarpitted")
+	}
+	tp.mu.Lock()
+	tp.clients["192.0.2.1"] = time.Now()
+	tp.mu.Unlock()
+	if tp.tarpitted("192.0.2.1") {
+		t.Error("the scanner was tarpitted past the TTL")
+	}
+
+	// The responses over max_active aren't held, nor is a drip without a
+	// connection.
+	ctx, cancel := context.WithCancel(context.Background())
+	held := make(chan bool)
+	go func() { held <- tp.apply(ctx, cfg, "192.0.2.3", []string{"scanner"}, nil, "r4") }()
+	for tp.active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if tp.apply(context.Background(), cfg, "192.0.2.4", []string{"scanner"}, nil, "r5") {
+		t.Error("a response over max_active was tarpitted")
+	}
+	cancel()
+	<-held
+	cfg.Tarpit.Mode = "drip"
+	if tp.apply(context.Background(), cfg, "192.0.2.4", []string{"scanner"}, nil, "r6") {
+		t.Error("a response without a connection was dripped")
+	}
+}
+
+func TestScannersAreTarpitted(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	config := testConfig(t, "-tarpit-tags", "scanner", "-tarpit-delay", "200ms", "-tarpit-jitter", "0")
+	s, client := startServer(t, config, nil)
+	get := func(ua string) time.Duration {
+		t.Helper()
+		req, _ := http.NewRequest("GET", upstream.URL+"/a", nil)
+		req.Header.Set("User-Agent", ua)
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return time.Since(start)
+	}
+	// The scanner is known once its first request is logged.
+	get("sqlmap/1.8.4#stable (https://sqlmap.org)")
+	for deadline := time.Now().Add(5 * time.Second); !s.tarpit.tarpitted("127.0.0.1"); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the scanner wasn't tarpitted")
+		}
+	}
+	if elapsed := get("Mozilla/5.0"); elapsed < 200*time.Millisecond {
+		t.Errorf("the next response took %v, want it held 200ms", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{{"scanner"}, {"tarpitted"}}
+	if got := queryRows(t, db, "select coalesce(tags, '') from requests order by id"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the tags %v, want %v", got, want)
+	}
+}
+
+func TestRateLimitedClientsAreDripped(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	_, client := startServer(t, testConfig(t, "-rate-limit", "0.01", "-tarpit-tags", "rate-limited", "-tarpit-mode",
+		"drip", "-tarpit-delay", "10ms", "-tarpit-jitter", "0", "-tarpit-max-time", "300ms"), nil)
+	var elapsed []time.Duration
+	for range 2 {
+		start := time.Now()
+		resp, err := client.Get(upstream.URL + "/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		elapsed = append(elapsed, time.Since(start))
+	}
+	// The limited response is dripped for max_time, then written at once.
+	if elapsed[0] > 200*time.Millisecond || elapsed[1] < 300*time.Millisecond || elapsed[1] > 3*time.Second {
+		t.Errorf("the responses took %v, want the second one dripped for 300ms", elapsed)
+	}
+}
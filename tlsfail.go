@@ -0,0 +1,140 @@
+package stuffpot
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxPinCheckers bounds the clients remembered as checking certificate
+// pinning, the oldest being forgotten first.
+const maxPinCheckers = 65536
+
+// pinCheckTTL is how long the requests of a client are tagged pin-check after
+// its last such handshake.
+const pinCheckTTL = 24 * time.Hour
+
+// tlsFailure is a MITM handshake the client didn't complete.
+type tlsFailure struct {
+	TunnelID string
+	ClientIP string
+	Host     string
+	SNI      string
+	// Versions and Ciphers are those offered in the ClientHello, empty when
+	// the client sent none.
+	Versions []string
+	Ciphers  []string
+	// SAN is that of the certificate served, empty when none was.
+	SAN string
+	// Kind is alert for an alert from the client, eof, unsupported-protocol,
+	// timeout or other, and Error the error itself.
+	Kind  string
+	Error string
+	// PinCheck is set when the client aborted right after our certificate,
+	// which is how clients checking its pin behave.
+	PinCheck bool
+	JA3      string
+	At       time.Time
+}
+
+// failure returns the failure of hs, with err.
+func (hs *mitmHandshake) failure(err error) *tlsFailure {
+	f := &tlsFailure{
+		TunnelID: hs.id, ClientIP: hs.ClientIP, Host: hs.Host, SNI: hs.SNI, SAN: hs.SAN, JA3: hs.JA3,
+		Kind: tlsFailureKind(err, hs.certSent), Error: err.Error(), At: time.Now(),
+	}
+	if hs.hello != nil {
+		for _, v := range hs.hello.SupportedVersions {
+			f.Versions = append(f.Versions, tls.VersionName(v))
+		}
+		for _, c := range hs.hello.CipherSuites {
+			f.Ciphers = append(f.Ciphers, tls.CipherSuiteName(c))
+		}
+	}
+	f.PinCheck = hs.certSent && (f.Kind == "alert" || f.Kind == "eof")
+	return f
+}
+
+// tlsFailureKind classifies a handshake error, certSent telling whether the
+// certificate was sent. TLS 1.3 clients rejecting it may send their alert
+// unencrypted, which fails to decrypt.
+func tlsFailureKind(err error, certSent bool) string {
+	var op *net.OpError
+	var ne net.Error
+	switch {
+	case errors.As(err, &op) && op.Op == "remote error":
+		return "alert"
+	case certSent && strings.Contains(err.Error(), "bad record MAC"):
+		return "alert"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return "eof"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case strings.Contains(err.Error(), "unsupported versions"), strings.Contains(err.Error(), "protocol version"),
+		strings.Contains(err.Error(), "no cipher suite"), strings.Contains(err.Error(), "first record does not look like"):
+		return "unsupported-protocol"
+	}
+	return "other"
+}
+
+// pinCheckers are the clients whose handshakes aborted as pin checks, by
+// the time of the last one.
+type pinCheckers struct {
+	mu      sync.Mutex
+	clients map[string]time.Time
+}
+
+func (p *pinCheckers) add(ip string, t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients == nil {
+		p.clients = make(map[string]time.Time)
+	}
+	if _, ok := p.clients[ip]; !ok && len(p.clients) >= maxPinCheckers {
+		oldest, at := "", t
+		for c, seen := range p.clients {
+			if seen.Before(at) {
+				oldest, at = c, seen
+			}
+		}
+		delete(p.clients, oldest)
+	}
+	p.clients[ip] = t
+}
+
+// lookup returns the pin-check tag of ip if it checked pins lately.
+func (p *pinCheckers) lookup(ip string) (tagMatch, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.clients[ip]
+	if !ok {
+		return tagMatch{}, false
+	} else if time.Since(t) > pinCheckTTL {
+		delete(p.clients, ip)
+		return tagMatch{}, false
+	}
+	return tagMatch{Tag: "pin-check", Location: "client", Match: ip, Source: "tls " + t.UTC().Format(time.RFC3339)}, true
+}
+
+// logTLSFailure records a failed MITM handshake.
+func (logger *HttpLogger) logTLSFailure(f *tlsFailure) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	res, err := logger.db.Exec(`insert into tls_failures (tunnel_id, from_ip, host, sni, versions, ciphers, san, kind, error,
+        pin_check, ja3, created_at) values (?,?,?,?,?,?,?,?,?,?,?,?)`,
+		f.TunnelID, f.ClientIP, f.Host, f.SNI, strings.Join(f.Versions, ","), strings.Join(f.Ciphers, ","), f.SAN,
+		f.Kind, f.Error, f.PinCheck, f.JA3, f.At.UTC().Format(time.DateTime))
+	if err != nil || logger.maxRecords <= 0 {
+		return err
+	}
+	last, err := res.LastInsertId()
+	if err == nil && last > logger.maxRecords {
+		_, err = logger.db.Exec("delete from tls_failures where id <= ?", last-logger.maxRecords)
+	}
+	return err
+}
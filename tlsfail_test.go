@@ -0,0 +1,72 @@
+package stuffpot
+
+import (
+	"crypto/tls"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// failedHandshake has client run against the MITM server of a tunnel to
+// shop.example, and returns the failure recorded, if any.
+func failedHandshake(t *testing.T, client func(conn net.Conn)) *tlsFailure {
+	t.Helper()
+	var failure *tlsFailure
+	ci, err := newCertIssuer(MitmConfig{}, func(f *tlsFailure) { failure = f })
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, hs := ci.tlsConfig(testConfig(t).Load(), "shop.example:443", "192.0.2.1", "t1")
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		defer clientConn.Close()
+		client(clientConn)
+	}()
+	serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+	hs.done(tls.Server(serverConn, serverConfig).Handshake())
+	serverConn.Close()
+	if failure != nil {
+		if _, ok := ci.pins.lookup(failure.ClientIP); ok != failure.PinCheck {
+			t.Errorf("the client is remembered as checking pins: %v, want %v", ok, failure.PinCheck)
+		}
+	}
+	return failure
+}
+
+func TestFailedMITMHandshakes(t *testing.T) {
+	// A client checking the certificate against its pin or its roots.
+	f := failedHandshake(t, func(conn net.Conn) {
+		tls.Client(conn, &tls.Config{ServerName: "shop.example"}).Handshake()
+	})
+	if f == nil || f.Kind != "alert" || !f.PinCheck || f.SNI != "shop.example" || f.SAN != "shop.example" ||
+		!slices.Contains(f.Versions, "TLS 1.3") || len(f.Ciphers) == 0 {
+		t.Errorf("a rejected certificate: got %+v", f)
+	}
+
+	// A client which doesn't speak TLS.
+	f = failedHandshake(t, func(conn net.Conn) {
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: shop.example\r\n\r\n"))
+	})
+	if f == nil || f.Kind != "unsupported-protocol" || f.PinCheck || f.SAN != "" {
+		t.Errorf("plaintext HTTP: got %+v", f)
+	}
+
+	if f := failedHandshake(t, func(conn net.Conn) {
+		tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	}); f != nil {
+		t.Errorf("a completed handshake was recorded: %+v", f)
+	}
+}
+
+func TestPinCheckersAreForgotten(t *testing.T) {
+	var p pinCheckers
+	p.add("192.0.2.1", time.Now().Add(-pinCheckTTL-time.Minute))
+	p.add("192.0.2.2", time.Now())
+	if _, ok := p.lookup("192.0.2.1"); ok {
+		t.Error("a client is tagged pin-check past the TTL")
+	}
+	if m, ok := p.lookup("192.0.2.2"); !ok || m.Tag != "pin-check" || m.Match != "192.0.2.2" {
+		t.Errorf("got %+v, %v, want the pin-check tag", m, ok)
+	}
+}
@@ -0,0 +1,211 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxTorList bounds the size of a downloaded exit list.
+	maxTorList = 16 << 20
+	torTimeout = 30 * time.Second
+)
+
+// torList is a set of exit addresses, never modified once built.
+type torList struct {
+	addrs     map[string]struct{}
+	origin    string
+	fetchedAt time.Time
+}
+
+// torExits keeps the Tor exit list named by the config, refreshed in the
+// background. A refresh which fails keeps the current list.
+type torExits struct {
+	atomic.Pointer[torList]
+	config *ConfigStore
+	log    *slog.Logger
+	client *http.Client
+
+	mu        sync.Mutex
+	attempted time.Time
+	err       error
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newTorExits(config *ConfigStore) *torExits {
+	return &torExits{
+		config: config,
+		log:    slog.With("component", "tor"),
+		client: &http.Client{Timeout: torTimeout},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// run refreshes the list until close is called, starting right away.
+func (t *torExits) run() {
+	defer close(t.done)
+	defer contain(t.log, "tor exit refresh")
+	for {
+		t.refresh()
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(t.config.Load().Tor.Refresh):
+		}
+	}
+}
+
+func (t *torExits) refresh() {
+	cfg := t.config.Load().Tor
+	var list *torList
+	var err error
+	switch {
+	case cfg.File != "":
+		list, err = t.read(cfg.File)
+	case cfg.URL != "":
+		list, err = t.download(cfg.URL)
+	default:
+		t.Store(nil)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempted = time.Now()
+	t.err = err
+	if err != nil {
+		t.log.Warn("Keeping current Tor exit list, refresh failed", "error", err)
+		return
+	}
+	t.Store(list)
+	t.log.Info("Tor exit list refreshed", "origin", list.origin, "addresses", len(list.addrs))
+}
+
+func (t *torExits) read(path string) (*torList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// The file is as recent as its last change.
+	return parseTorList(f, path, st.ModTime())
+}
+
+func (t *torExits) download(url string) (*torList, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %v", url, resp.Status)
+	}
+	return parseTorList(io.LimitReader(resp.Body, maxTorList), url, time.Now())
+}
+
+// parseTorList reads one address per line, as in the bulk exit list, or the
+// ExitAddress lines of the exit-addresses format.
+func parseTorList(r io.Reader, origin string, fetchedAt time.Time) (*torList, error) {
+	list := &torList{addrs: make(map[string]struct{}), origin: origin, fetchedAt: fetchedAt}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		s := fields[0]
+		if s == "ExitAddress" && len(fields) > 1 {
+			s = fields[1]
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			list.addrs[addr.String()] = struct{}{}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%v: %w", origin, err)
+	}
+	if len(list.addrs) == 0 {
+		return nil, fmt.Errorf("%v: no addresses", origin)
+	}
+	return list, nil
+}
+
+// lookup returns the tag of ip if it's a Tor exit.
+func (t *torExits) lookup(ip string) (tagMatch, bool) {
+	list := t.Load()
+	if list == nil {
+		return tagMatch{}, false
+	}
+	if _, ok := list.addrs[ip]; !ok {
+		return tagMatch{}, false
+	}
+	return tagMatch{
+		Tag:      "tor-exit",
+		Location: "client",
+		Match:    ip,
+		Source:   list.origin + " " + list.fetchedAt.UTC().Format(time.RFC3339),
+	}, true
+}
+
+type torStatus struct {
+	Origin    string    `json:"origin,omitempty"`
+	Addresses int       `json:"addresses"`
+	FetchedAt time.Time `json:"fetched_at,omitzero"`
+	Attempted time.Time `json:"attempted_at,omitzero"`
+	// Stale is set when a list is configured but missing, or older than two
+	// refreshes.
+	Stale bool   `json:"stale"`
+	Error string `json:"error,omitempty"`
+}
+
+func (t *torExits) status() torStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cfg := t.config.Load().Tor
+	st := torStatus{Attempted: t.attempted, Stale: cfg.File != "" || cfg.URL != ""}
+	if list := t.Load(); list != nil {
+		st.Origin, st.Addresses, st.FetchedAt = list.origin, len(list.addrs), list.fetchedAt
+		st.Stale = time.Since(list.fetchedAt) > 2*cfg.Refresh
+	}
+	if t.err != nil {
+		st.Error = t.err.Error()
+	}
+	return st
+}
+
+// close stops the refreshes, interrupting a download in progress.
+func (t *torExits) close() {
+	close(t.stop)
+	<-t.done
+}
@@ -0,0 +1,327 @@
+package stuffpot
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// otherHost is the host_traffic row the hosts beyond the top ones of a day
+// are summed into. It can't be the name of a host.
+const otherHost = "(other)"
+
+// receivedBody counts the bytes of a request body read from the client, and
+// calls eof once it's been read in full.
+type receivedBody struct {
+	io.ReadCloser
+	n   *atomic.Int64
+	eof func()
+}
+
+func (b *receivedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	if err == io.EOF && b.eof != nil {
+		b.eof()
+		b.eof = nil
+	}
+	return n, err
+}
+
+// countBody returns the body of req, its bytes counted into state and its
+// trailers kept once it's read.
+func countBody(req *http.Request, state *requestState) io.ReadCloser {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req.Body
+	}
+	return &receivedBody{ReadCloser: req.Body, n: &state.received, eof: func() {
+		state.addTrailers(req.Trailer)
+	}}
+}
+
+// updateTraffic counts the request of ex in host_traffic, within the
+// transaction logging it. The days before yesterday are rolled up first,
+// once, yesterday still getting the requests which were in flight at
+// midnight.
+func (logger *HttpLogger) updateTraffic(tx *sql.Tx, ex *Exchange, day string) error {
+	if d, err := time.Parse(dayFormat, day); err == nil {
+		if err := rollupTraffic(tx, d.AddDate(0, 0, -1).Format(dayFormat), logger.trafficTop); err != nil {
+			return fmt.Errorf("roll up host traffic: %w", err)
+		}
+	}
+	host := ex.Request.Host
+	res, err := tx.Exec("insert or ignore into host_traffic_clients (day, host, ip) values (?,?,?)", day, host, ex.ClientIP)
+	if err != nil {
+		return fmt.Errorf("insert host traffic client: %w", err)
+	}
+	newClient, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`insert into host_traffic (day, host, request_count, bytes_in, bytes_out, clients) values (?,?,1,?,?,?)
+      on conflict (day, host) do update set request_count = request_count + 1, bytes_in = bytes_in + excluded.bytes_in,
+        bytes_out = bytes_out + excluded.bytes_out, clients = clients + excluded.clients`,
+		day, host, ex.Received, ex.Size, newClient)
+	if err != nil {
+		return fmt.Errorf("upsert host traffic: %w", err)
+	}
+	return nil
+}
+
+// rollupTraffic sums the hosts of each day before before, beyond the top ones
+// by bytes, into the otherHost row of the day, and drops the clients of the
+// day, its counts being final. The days rolled up are those which still have
+// clients. top 0 keeps every host.
+func rollupTraffic(tx *sql.Tx, before string, top int) error {
+	rows, err := tx.Query("select distinct day from host_traffic_clients where day < ?", before)
+	if err != nil {
+		return err
+	}
+	var days []string
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return err
+		}
+		days = append(days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, day := range days {
+		if top > 0 {
+			if err := rollupDay(tx, day, top); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("delete from host_traffic_clients where day = ?", day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupDay sums the hosts of day beyond the top ones into otherHost, which
+// is added to if the day was rolled up already.
+func rollupDay(tx *sql.Tx, day string, top int) error {
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"create temp table if not exists rolled_hosts (host TEXT PRIMARY KEY)", nil},
+		{"delete from temp.rolled_hosts", nil},
+		{`insert into temp.rolled_hosts select host from host_traffic where day = ? and host != ?
+          order by bytes_in + bytes_out desc, request_count desc, host limit -1 offset ?`, []interface{}{day, otherHost, top}},
+		{`insert into host_traffic (day, host, request_count, bytes_in, bytes_out, clients)
+          select ?, ?, sum(request_count), sum(bytes_in), sum(bytes_out),
+            (select count(distinct ip) from host_traffic_clients where day = ? and host in temp.rolled_hosts)
+          from host_traffic where day = ? and host in temp.rolled_hosts having count(*) > 0
+          on conflict (day, host) do update set request_count = request_count + excluded.request_count,
+            bytes_in = bytes_in + excluded.bytes_in, bytes_out = bytes_out + excluded.bytes_out,
+            clients = clients + excluded.clients`, []interface{}{day, otherHost, day, day}},
+		{"delete from host_traffic where day = ? and host in temp.rolled_hosts", []interface{}{day}},
+	} {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeTraffic rolls up the host traffic and the connect targets of the days
+// of the database before before, once no more requests are logged to them.
+func (logger *HttpLogger) closeTraffic(before string) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	tx, err := logger.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := rollupTraffic(tx, before, logger.trafficTop); err != nil {
+		return err
+	}
+	if err := rollupTargets(tx, before, logger.trafficTop); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setTrafficTop sets the number of hosts kept by day in host_traffic, and of
+// targets in connect_targets.
+func (logger *HttpLogger) setTrafficTop(top int) {
+	logger.trafficTop = top
+}
+
+// reindexTrafficTx rebuilds host_traffic from the requests in tx, the days
+// before before being rolled up.
+func reindexTrafficTx(tx *sql.Tx, before string, top int) error {
+	for _, stmt := range []string{
+		"delete from host_traffic",
+		"delete from host_traffic_clients",
+		`insert into host_traffic_clients (day, host, ip)
+          select distinct substr(created_at, 1, 10), host, from_ip from requests`,
+		`insert into host_traffic (day, host, request_count, bytes_in, bytes_out, clients)
+          select substr(created_at, 1, 10), host, sum(coalesce(occurrences, 1)),
+            coalesce(sum(request_size * coalesce(occurrences, 1)), 0), coalesce(sum(size * coalesce(occurrences, 1)), 0),
+            count(distinct from_ip)
+          from requests group by substr(created_at, 1, 10), host`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return rollupTraffic(tx, before, top)
+}
+
+// hostTraffic is the traffic through the proxy to a host over some days.
+type hostTraffic struct {
+	Host     string `json:"host"`
+	Requests int64  `json:"requests"`
+	// BytesIn is the bytes of the request bodies sent by the clients, and
+	// BytesOut those of the response bodies sent back to them.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Clients is summed over the days, a client counting once a day.
+	Clients int64 `json:"clients"`
+	Days    int   `json:"days"`
+}
+
+// readHostTraffic adds the traffic of the days from since, all of them when
+// empty, to hosts. Databases without host_traffic have none.
+func readHostTraffic(db *sql.DB, since string, hosts map[string]*hostTraffic) error {
+	if ok, err := hasTable(db, "host_traffic"); err != nil || !ok {
+		return err
+	}
+	rows, err := db.Query(`select host, request_count, bytes_in, bytes_out, clients from host_traffic where day >= ?`, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t hostTraffic
+		if err := rows.Scan(&t.Host, &t.Requests, &t.BytesIn, &t.BytesOut, &t.Clients); err != nil {
+			return err
+		}
+		h := hosts[t.Host]
+		if h == nil {
+			h = &hostTraffic{Host: t.Host}
+			hosts[t.Host] = h
+		}
+		h.Requests += t.Requests
+		h.BytesIn += t.BytesIn
+		h.BytesOut += t.BytesOut
+		h.Clients += t.Clients
+		h.Days++
+	}
+	return rows.Err()
+}
+
+// topHostTraffic returns the limit hosts which pulled the most bytes.
+func topHostTraffic(hosts map[string]*hostTraffic, limit int) []hostTraffic {
+	list := make([]hostTraffic, 0, len(hosts))
+	for _, h := range hosts {
+		list = append(list, *h)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].BytesOut != list[j].BytesOut {
+			return list[i].BytesOut > list[j].BytesOut
+		}
+		return list[i].Host < list[j].Host
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// hostTraffic returns the traffic by host of the days from since.
+func (logger *HttpLogger) hostTraffic(since string, limit int) ([]hostTraffic, error) {
+	hosts := make(map[string]*hostTraffic)
+	if err := readHostTraffic(logger.db, since, hosts); err != nil {
+		return nil, err
+	}
+	return topHostTraffic(hosts, limit), nil
+}
+
+// statsCommand implements the stats subcommand:
+//
+//	stuffpot stats -by-host|-connects [-db path] [-since 2006-01-02] [-port n] [-top n]
+//
+// It prints the requests and bytes by destination host, or the CONNECTs by
+// target, over the database and its daily files.
+func statsCommand(args []string) {
+	cfg := defaultConfig()
+	if err := applyEnv(cfg, os.Environ()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stuffpot stats", flag.ExitOnError)
+	path := fs.String("db", cfg.Storage.Path, "SQLite database, or the name of its daily files")
+	byHost := fs.Bool("by-host", false, "Print the traffic by destination host")
+	connects := fs.Bool("connects", false, "Print the CONNECTs by target host and port")
+	since := fs.String("since", "", "First day counted, as 2006-01-02, every day when empty")
+	port := fs.Int("port", 0, "Only print the CONNECT targets of this port")
+	top := fs.Int("top", 50, "Hosts or targets printed, the most bytes sent to the clients or tunnels first, 0 prints them all")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stuffpot stats -by-host|-connects [-db path] [-since 2006-01-02] [-port n] [-top n]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *byHost == *connects || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *since != "" {
+		if _, err := time.Parse(dayFormat, *since); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -since: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	paths, err := databaseFiles(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	hosts := make(map[string]*hostTraffic)
+	targets := make(map[string]*targetStats)
+	for _, p := range paths {
+		db, err := sql.Open("sqlite3", "file:"+p+"?mode=ro")
+		if err == nil {
+			if *connects {
+				err = readConnectTargets(db, *since, targets)
+			} else {
+				err = readHostTraffic(db, *since, hosts)
+			}
+			db.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", p, err)
+			os.Exit(1)
+		}
+	}
+	if *connects {
+		fmt.Printf("%5v %-48v %10v %8v %14v %-19v %-19v\n", "PORT", "HOST", "TUNNELS", "CLIENTS", "BYTES", "FIRST SEEN",
+			"LAST SEEN")
+		for _, t := range topConnectTargets(targets, *port, *top) {
+			fmt.Printf("%5d %-48v %10d %8d %14d %-19v %-19v\n", t.Port, t.Host, t.Tunnels, t.Clients, t.Bytes, t.FirstSeen,
+				t.LastSeen)
+		}
+		return
+	}
+	fmt.Printf("%-48v %10v %8v %14v %14v\n", "HOST", "REQUESTS", "CLIENTS", "BYTES IN", "BYTES OUT")
+	for _, h := range topHostTraffic(hosts, *top) {
+		fmt.Printf("%-48v %10d %8d %14d %14d\n", h.Host, h.Requests, h.Clients, h.BytesIn, h.BytesOut)
+	}
+}
@@ -0,0 +1,57 @@
+package stuffpot
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRollupTrafficKeepsTheTopHosts(t *testing.T) {
+	logger, err := NewLogger(filepath.Join(t.TempDir(), "log.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	for _, stmt := range []string{
+		`insert into host_traffic (day, host, request_count, bytes_in, bytes_out, clients) values
+		  ('2026-01-01', 'big.example', 10, 1000, 9000, 1), ('2026-01-01', 'mid.example', 5, 500, 500, 2),
+		  ('2026-01-01', 'small.example', 2, 10, 20, 2), ('2026-01-01', 'tiny.example', 1, 1, 2, 1),
+		  ('2026-01-02', 'tiny.example', 1, 1, 2, 1)`,
+		`insert into host_traffic_clients (day, host, ip) values ('2026-01-01', 'big.example', '192.0.2.1'),
+		  ('2026-01-01', 'mid.example', '192.0.2.1'), ('2026-01-01', 'mid.example', '192.0.2.2'),
+		  ('2026-01-01', 'small.example', '192.0.2.2'), ('2026-01-01', 'small.example', '192.0.2.3'),
+		  ('2026-01-01', 'tiny.example', '192.0.2.3'), ('2026-01-02', 'tiny.example', '192.0.2.3')`,
+	} {
+		if _, err := logger.db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := logger.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rollupTraffic(tx, "2026-01-02", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hosts beyond the top two by bytes of the day over are summed, their
+	// clients counted once.
+	want := [][]string{
+		{"2026-01-01", "(other)", "3", "11", "22", "2"},
+		{"2026-01-01", "big.example", "10", "1000", "9000", "1"},
+		{"2026-01-01", "mid.example", "5", "500", "500", "2"},
+		{"2026-01-02", "tiny.example", "1", "1", "2", "1"},
+	}
+	got := queryRows(t, logger.db, `select day, host, request_count, bytes_in, bytes_out, clients from host_traffic
+	  order by day, host`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got host_traffic %v, want %v", got, want)
+	}
+	if got := queryRows(t, logger.db, "select day, host, ip from host_traffic_clients"); !reflect.DeepEqual(got,
+		[][]string{{"2026-01-02", "tiny.example", "192.0.2.3"}}) {
+		t.Errorf("got the clients %v, want those of the day not over only", got)
+	}
+}
@@ -0,0 +1,96 @@
+package stuffpot
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transparentSniff bounds the wait for the first bytes of a redirected client,
+// whose SNI or Host names the remote. The clients of protocols the server
+// speaks first are tunneled to their original destination once it expires.
+const transparentSniff = 3 * time.Second
+
+// transparentListener serves the connections the firewall redirects to it,
+// with REDIRECT or TPROXY, as CONNECTs to the remote they were made to.
+// Connections made to the listener itself are read as from proxy clients.
+type transparentListener struct {
+	net.Listener
+}
+
+func (l transparentListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	local := addrPort(c.LocalAddr())
+	dst, err := originalDst(c)
+	if err != nil {
+		// TPROXY keeps the original destination as the local address.
+		dst = local
+	}
+	direct := dst == local && local.Port() == addrPort(l.Addr()).Port()
+	fc := &frontendConn{Conn: c}
+	fc.open = func(br *bufio.Reader) (string, string, error) {
+		if direct {
+			return "", "", nil
+		}
+		return sniffHost(c, br, dst), "", nil
+	}
+	return fc, nil
+}
+
+// addrPort returns the address of a TCP addr, IPv4 ones unmapped.
+func addrPort(addr net.Addr) netip.AddrPort {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	ap := tcp.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// sniffHost returns the address of the remote of a redirected client: the
+// name of the SNI of its ClientHello or of the Host of its request, with the
+// port of its original destination dst, or dst itself.
+func sniffHost(conn net.Conn, br *bufio.Reader, dst netip.AddrPort) string {
+	conn.SetReadDeadline(time.Now().Add(transparentSniff))
+	b, err := br.Peek(1)
+	conn.SetReadDeadline(time.Now().Add(frontendTimeout))
+	if err != nil {
+		return dst.String()
+	}
+	var name string
+	if b[0] == 0x16 {
+		name = serverName(peekRecord(br))
+	} else {
+		b, _ = br.Peek(br.Buffered())
+		name = requestHost(b)
+	}
+	if !validHostName(name) {
+		return dst.String()
+	}
+	return net.JoinHostPort(name, strconv.Itoa(int(dst.Port())))
+}
+
+// requestHost returns the host name of the Host header of the request head b
+// starts with, "" when b isn't one or has none.
+func requestHost(b []byte) string {
+	head, _, _ := strings.Cut(string(b), "\r\n\r\n")
+	lines := strings.Split(head, "\r\n")
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(name, "Host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return strings.Trim(host, "[]")
+	}
+	return ""
+}
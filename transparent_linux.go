@@ -0,0 +1,69 @@
+package stuffpot
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// The socket options of netfilter, IP6T_SO_ORIGINAL_DST having the same value.
+const (
+	soOriginalDst   = 80
+	ipv6Transparent = 75
+)
+
+// originalDst returns the destination of a connection before REDIRECT changed
+// it to the listener, as conntrack knows it.
+func originalDst(c net.Conn) (netip.AddrPort, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var dst netip.AddrPort
+	var serr error
+	ipv4 := addrPort(c.LocalAddr()).Addr().Is4()
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			// A sockaddr_in: the family, port and address.
+			var mreq *syscall.IPv6Mreq
+			if mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); serr == nil {
+				sa := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4]))
+			}
+			return
+		}
+		var info *syscall.IPv6MTUInfo
+		if info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); serr == nil {
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	return dst, err
+}
+
+// transparentControl sets IP_TRANSPARENT on the listener, for it to accept the
+// connections TPROXY redirects to it.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package stuffpot
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+var errNoTransparent = errors.New("transparent proxying is only supported on Linux")
+
+func originalDst(c net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errNoTransparent
+}
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errNoTransparent
+}
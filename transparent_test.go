@@ -0,0 +1,132 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSniffHost(t *testing.T) {
+	dst := netip.MustParseAddrPort("192.0.2.1:8443")
+	sniff := func(send func(c net.Conn)) string {
+		server, client := net.Pipe()
+		defer server.Close()
+		go func() {
+			defer client.Close()
+			send(client)
+		}()
+		return sniffHost(server, bufio.NewReader(server), dst)
+	}
+	for name, tc := range map[string]struct {
+		send func(c net.Conn)
+		want string
+	}{
+		"ClientHello": {func(c net.Conn) {
+			tls.Client(c, &tls.Config{ServerName: "shop.example"}).Handshake()
+		}, "shop.example:8443"},
+		"ClientHello without SNI": {func(c net.Conn) {
+			tls.Client(c, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		}, "192.0.2.1:8443"},
+		"request": {func(c net.Conn) {
+			io.WriteString(c, "GET / HTTP/1.1\r\nUser-Agent: x\r\nhost: shop.example:80\r\n\r\n")
+		}, "shop.example:8443"},
+		"IPv6 Host": {func(c net.Conn) {
+			io.WriteString(c, "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n")
+		}, "[2001:db8::1]:8443"},
+		"request without Host": {func(c net.Conn) {
+			io.WriteString(c, "GET / HTTP/1.0\r\n\r\n")
+		}, "192.0.2.1:8443"},
+		"binary": {func(c net.Conn) {
+			c.Write([]byte{0, 1, 2, 3})
+		}, "192.0.2.1:8443"},
+		"nothing": {func(c net.Conn) {}, "192.0.2.1:8443"},
+	} {
+		if got := sniff(tc.send); got != tc.want {
+			t.Errorf("%v: got %q, want %q", name, got, tc.want)
+		}
+	}
+}
+
+// redirectedListener stands for a listener TPROXY redirects connections to,
+// those it accepts having dst as their local address.
+type redirectedListener struct {
+	net.Listener
+	dst net.Addr
+}
+
+type redirectedConn struct {
+	net.Conn
+	dst net.Addr
+}
+
+func (l redirectedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	return redirectedConn{c, l.dst}, nil
+}
+
+func (c redirectedConn) LocalAddr() net.Addr { return c.dst }
+
+func TestRedirectedConnectionsAreServedAsConnects(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %v", r.Host)
+	}))
+	defer upstream.Close()
+	config := testConfig(t)
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTransparent(redirectedListener{ln, upstream.Listener.Addr()})
+
+	// The client asks for the remote by name, the original port being kept.
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprint(conn, "GET /a HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	conn.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello localhost" {
+		t.Errorf("got %v %q, want the response of the original destination", resp.Status, body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	port := upstream.Listener.Addr().(*net.TCPAddr).Port
+	var host string
+	if err := db.QueryRow("select host from connects").Scan(&host); err != nil ||
+		host != fmt.Sprintf("localhost:%d", port) {
+		t.Errorf("got the connect to %q, %v, want one to localhost:%d", host, err, port)
+	}
+}
@@ -0,0 +1,526 @@
+package stuffpot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"github.com/elazarl/goproxy"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dirUp   = 0 // client -> remote
+	dirDown = 1 // remote -> client
+)
+
+var directionNames = [2]string{"up", "down"}
+
+// capturedBytes is the number of captured bytes currently held in memory by
+// all tunnels, bounded by the global capture limit.
+var capturedBytes int64
+
+type captureChunk struct {
+	direction int
+	offset    int64
+	data      []byte
+}
+
+// TunnelCapture records the first bytes sent in each direction of a tunnel.
+// Recording never blocks or fails; once a cap is reached the data is dropped.
+type TunnelCapture struct {
+	mu          sync.Mutex
+	limit       int64
+	globalLimit int64
+	held        int64
+	refs        int
+	sizes       [2]int64
+	chunks      []captureChunk
+	truncated   bool
+	// relayed counts every byte of each direction, captured or not.
+	relayed [2]int64
+}
+
+func newTunnelCapture(limit, globalLimit int64) *TunnelCapture {
+	return &TunnelCapture{limit: limit, globalLimit: globalLimit, refs: 1}
+}
+
+func (tc *TunnelCapture) record(dir int, offset int64, p []byte) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	n := int64(len(p))
+	tc.relayed[dir] += n
+	if room := tc.limit - tc.sizes[dir]; n > room {
+		n = room
+		tc.truncated = true
+	}
+	if n <= 0 {
+		return
+	}
+	if atomic.AddInt64(&capturedBytes, n) > tc.globalLimit {
+		atomic.AddInt64(&capturedBytes, -n)
+		tc.truncated = true
+		return
+	}
+	tc.held += n
+	tc.sizes[dir] += n
+	tc.chunks = append(tc.chunks, captureChunk{dir, offset, append([]byte(nil), p[:n]...)})
+}
+
+// relayedBytes returns the bytes relayed both ways.
+func (tc *TunnelCapture) relayedBytes() int64 {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.relayed[dirUp] + tc.relayed[dirDown]
+}
+
+// head returns up to n leading bytes captured in the given direction.
+func (tc *TunnelCapture) head(dir int, n int) []byte {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	var buf []byte
+	for _, c := range tc.chunks {
+		if c.direction != dir {
+			continue
+		}
+		buf = append(buf, c.data...)
+		if len(buf) >= n {
+			return buf[:n]
+		}
+	}
+	return buf
+}
+
+// retain keeps the captured bytes until a matching release, for loggers which
+// use them after LogTunnel returns.
+func (tc *TunnelCapture) retain() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.refs++
+}
+
+// release frees the captured bytes once every retain has been released, as well
+// as the reference of the tunnel which created tc.
+func (tc *TunnelCapture) release() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.refs--; tc.refs > 0 {
+		return
+	}
+	atomic.AddInt64(&capturedBytes, -tc.held)
+	tc.held = 0
+	tc.chunks = nil
+}
+
+type captureWriter struct {
+	tc     *TunnelCapture
+	dir    int
+	offset int64
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.tc.record(w.dir, w.offset, p)
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+// guessProtocol makes a best-effort guess of the protocol spoken over a tunnel
+// from the first bytes sent by the client (up) and the server (down).
+func guessProtocol(up, down []byte) string {
+	switch {
+	case len(up) > 2 && up[0] == 0x16 && up[1] == 0x03:
+		return "tls"
+	case isHTTPRequestLine(up):
+		return "http"
+	case bytes.HasPrefix(down, []byte("SSH-")) || bytes.HasPrefix(up, []byte("SSH-")):
+		return "ssh"
+	case bytes.HasPrefix(down, []byte("220")) && bytes.Contains(bytes.ToUpper(firstLine(down)), []byte("SMTP")):
+		return "smtp"
+	case bytes.HasPrefix(down, []byte("220")) && bytes.Contains(bytes.ToUpper(firstLine(down)), []byte("FTP")):
+		return "ftp"
+	case bytes.HasPrefix(down, []byte("RFB ")):
+		return "vnc"
+	case len(up) > 4 && up[0] == 0x03 && up[1] == 0x00:
+		return "rdp"
+	case bytes.HasPrefix(down, []byte("* OK")):
+		return "imap"
+	case bytes.HasPrefix(down, []byte("+OK")):
+		return "pop3"
+	case bytes.HasPrefix(up, []byte("NICK ")) || bytes.HasPrefix(up, []byte("USER ")) ||
+		bytes.HasPrefix(up, []byte("CAP LS")) || bytes.HasPrefix(down, []byte(":")):
+		return "irc"
+	case bytes.HasPrefix(down, []byte("220")) || bytes.HasPrefix(bytes.ToUpper(up), []byte("EHLO ")) ||
+		bytes.HasPrefix(bytes.ToUpper(up), []byte("HELO ")):
+		return "smtp"
+	case len(up) > 2 && (up[0] == 0x05 || up[0] == 0x04) && up[1] < 0x10:
+		return "socks"
+	case len(up) == 0 && len(down) == 0:
+		return "empty"
+	}
+	return "unknown"
+}
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "CONNECT ", "PATCH ", "TRACE "}
+
+func isHTTPRequestLine(b []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstLine(b []byte) []byte {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
+
+func hostPort(host string) string {
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "80"
+	}
+	return port
+}
+
+// clientIP returns the address of a client from the RemoteAddr of its
+// request, an IPv4-mapped address on a dual-stack listener being returned as
+// IPv4.
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if a, err := netip.ParseAddr(host); err == nil {
+		return a.Unmap().WithZone("").String()
+	}
+	return host
+}
+
+// tunnelRelay relays CONNECT tunnels verbatim while capturing their first
+// bytes for the logger.
+type tunnelRelay struct {
+	logger *asyncLogger
+	config *ConfigStore
+	rules  *ruleStore
+	honey  *honeytokenStore
+	// samples is nil without a quarantine directory.
+	samples *quarantine
+	// raw is set when the raw requests are stored.
+	raw bool
+	// scanned wraps bodies to be scanned by the signature rules.
+	scanned func(body io.ReadCloser, header http.Header, location string, state *requestState) io.ReadCloser
+	dial    func(network, addr string) (net.Conn, error)
+	hooks   *hooks
+	script  *scriptStore
+	geo     *geoIP
+	rdns    *reverseDNS
+	egress  *egressLimiter
+	limits  *clientLimiter
+	tarpit  *tarpit
+	certs   *certIssuer
+	log     *slog.Logger
+}
+
+// dialRemote connects to the host of the CONNECT, recording the time it took
+// and the failure on the tunnel's state.
+func (t *tunnelRelay) dialRemote(req *http.Request, ctx *goproxy.ProxyCtx) (net.Conn, error) {
+	start := time.Now()
+	conn, err := t.dial("tcp", req.URL.Host)
+	if s, ok := ctx.UserData.(*tunnelState); ok {
+		s.dialTime, s.dialError = time.Since(start), errorType(err)
+	}
+	return conn, err
+}
+
+// tunnelDialTime returns the time the tunnel of ctx took to dial its remote.
+func tunnelDialTime(ctx *goproxy.ProxyCtx) time.Duration {
+	if s, ok := ctx.UserData.(*tunnelState); ok {
+		return s.dialTime
+	}
+	return 0
+}
+
+func (t *tunnelRelay) hijack(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	defer client.Close()
+	activeTunnels.Add(1)
+	defer activeTunnels.Add(-1)
+	cfg := t.config.Load()
+	log := t.log.With("tunnel_id", requestID(ctx), "client", req.RemoteAddr, "host", req.URL.Host)
+
+	port := hostPort(req.URL.Host)
+	var smtp *SmtpSession
+	if mailPorts[port] {
+		smtp = &SmtpSession{accept: cfg.Sandbox && !cfg.SmtpBlock}
+	}
+
+	var remote net.Conn
+	if cfg.Sandbox {
+		sandboxed(ctx)
+	} else if smtp == nil || !cfg.SmtpBlock {
+		var err error
+		remote, err = t.dialRemote(req, ctx)
+		if err != nil {
+			log.Info("Cannot reach remote", "dial_time", tunnelDialTime(ctx), "error", err)
+			t.refuse(req, client, ctx, dialFailure(err))
+			return
+		}
+		defer remote.Close()
+	}
+	client.Write([]byte("HTTP/1.1 200 Ok\r\n\r\n"))
+
+	if port == "465" {
+		tlsConfig, hs := t.certs.tlsConfig(cfg, req.URL.Host, clientIP(req.RemoteAddr), requestID(ctx))
+		tc := tls.Server(client, tlsConfig)
+		err := tc.Handshake()
+		hs.done(err)
+		if err != nil {
+			return
+		}
+		client = tc
+		if remote != nil {
+			remote = tls.Client(remote, &tls.Config{InsecureSkipVerify: true})
+		}
+	}
+
+	// Without the bytes logged, only enough of them to guess the protocol
+	// are captured.
+	rule := tunnelRule(ctx)
+	limit := cfg.Limits.CaptureLimit
+	if rule.Log == "connect" {
+		limit = min(limit, 64)
+	}
+	tc := newTunnelCapture(limit, cfg.Limits.CaptureTotal)
+	defer tc.release()
+	logTunnel := func() { t.logTunnel(req, tc, smtp, ctx) }
+
+	var up io.Writer = &captureWriter{tc: tc, dir: dirUp}
+	switch {
+	case remote == nil && smtp != nil:
+		serveFakeSMTP(client, bufio.NewReaderSize(io.TeeReader(client, up), smtpMaxLine), smtp)
+		logTunnel()
+		return
+	case remote == nil:
+		sink(client, up)
+		logTunnel()
+		return
+	}
+	if smtp != nil {
+		up = io.MultiWriter(up, smtp)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer remote.Close()
+		defer contain(log, "tunnel copy")
+		io.Copy(remote, io.TeeReader(client, up))
+	}()
+	go func() {
+		defer wg.Done()
+		// Closing client would let Shutdown close the logger before the
+		// tunnel is logged, its reads are ended instead.
+		defer client.SetReadDeadline(time.Now())
+		defer contain(log, "tunnel copy")
+		io.Copy(client, io.TeeReader(remote, &captureWriter{tc: tc, dir: dirDown}))
+	}()
+	wg.Wait()
+	logTunnel()
+}
+
+// sandboxIdle is how long a tunnel kept from its remote by the sandbox stays
+// open without the client sending anything.
+const sandboxIdle = 30 * time.Second
+
+// sandboxed records that the tunnel of ctx is kept from its remote.
+func sandboxed(ctx *goproxy.ProxyCtx) {
+	if s, ok := ctx.UserData.(*tunnelState); ok {
+		s.errorResponse = "sandbox"
+	}
+}
+
+// sink reads what the client sends into w, answering nothing, until it closes
+// the tunnel or goes quiet for sandboxIdle.
+func sink(client net.Conn, w io.Writer) {
+	buf := make([]byte, 32<<10)
+	for {
+		client.SetReadDeadline(time.Now().Add(sandboxIdle))
+		n, err := client.Read(buf)
+		w.Write(buf[:n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+// hijackHTTP relays a CONNECT tunnel as a sequence of plaintext HTTP requests
+// and responses.
+func (t *tunnelRelay) hijackHTTP(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	defer client.Close()
+	activeTunnels.Add(1)
+	defer activeTunnels.Add(-1)
+	log := t.log.With("tunnel_id", requestID(ctx), "client", req.RemoteAddr, "host", req.URL.Host)
+
+	// In the sandbox, the requests are answered without a remote.
+	var remoteBuf *bufio.ReadWriter
+	if t.config.Load().Sandbox {
+		sandboxed(ctx)
+	} else {
+		remote, err := t.dialRemote(req, ctx)
+		if err != nil {
+			log.Info("Cannot reach remote", "dial_time", tunnelDialTime(ctx), "error", err)
+			t.refuse(req, client, ctx, dialFailure(err))
+			return
+		}
+		defer remote.Close()
+		remoteBuf = bufio.NewReadWriter(bufio.NewReader(remote), bufio.NewWriter(remote))
+	}
+	// The requests are logged on their own, the tunnel only as such.
+	tc := newTunnelCapture(0, 0)
+	defer tc.release()
+	defer t.logTunnel(req, tc, nil, ctx)
+	client.Write([]byte("HTTP/1.1 200 Ok\r\n\r\n"))
+
+	clientBuf := bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+	for {
+		if err := t.relayHTTP(req, ctx, clientBuf, remoteBuf); err != nil {
+			if err != io.EOF {
+				log.Info("Hijacked connection failed", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// relayHTTP forwards one request from client to remote, and its response back,
+// or answers it with the sandbox response when remote is nil, or the error
+// response of the rate limits or the egress policy refusing it. The exchange is
+// logged like proxied ones, with the tunnel as the parent.
+func (t *tunnelRelay) relayHTTP(connect *http.Request, tunnel *goproxy.ProxyCtx, client, remote *bufio.ReadWriter) error {
+	req, err := http.ReadRequest(client.Reader)
+	if err != nil {
+		// The requests which can't be parsed, such as those with differing
+		// Content-Lengths, are answered like the proxy answers them.
+		var ne net.Error
+		if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.As(err, &ne) {
+			client.WriteString(badRequest)
+			client.Flush()
+		}
+		return err
+	}
+	requestsTotal.Add(1)
+	req.RemoteAddr = connect.RemoteAddr
+	req.URL.Scheme, req.URL.Host = "http", connect.URL.Host
+
+	cfg := t.config.Load()
+	var headers []string
+	var head *parseAnomalies
+	var rawHead []byte
+	if conn := requestConn(req, tunnel); conn != nil {
+		headers, head, rawHead = conn.take(req, t.raw)
+	}
+	form := readForm(req)
+	state := &requestState{id: newID(), parentID: requestID(tunnel), start: time.Now(), tags: t.rules.Load().tag(req),
+		login: readLogin(req, cfg, form), credentials: readCredentials(req.Header, form), headers: headers,
+		fingerprint: fingerprint(headers), rawHead: rawHead}
+	state.geo, state.origin = t.geo.policy(cfg, clientIP(req.RemoteAddr))
+	state.exchange = newExchange(req, state)
+	state.noteAnomalies(req, head)
+	t.hooks.capture(t.logger, req.Context(), state)
+	log := t.log.With("request_id", state.id)
+	failed := func(err error) error {
+		if ex := state.finish(nil, 0, err); ex != nil {
+			logFailed(log, "exchange", t.logger.LogExchange(req.Context(), ex))
+		}
+		return err
+	}
+
+	class := ""
+	if t.limits.limit(req.Context(), cfg, clientIP(req.RemoteAddr), state.id) {
+		state.tags = append(state.tags, "rate-limited")
+		if cfg.RateLimit.Action == "drop" {
+			state.exchange.ErrorResponse = "rate_limited"
+			return failed(errRateLimited)
+		}
+		class = "rate_limited"
+	} else if resp := t.script.apply(req, state); resp != nil {
+		// The body is read for the next request to follow it.
+		io.Copy(io.Discard, req.Body)
+		if ex := state.finish(resp, resp.ContentLength, nil); ex != nil {
+			logFailed(log, "exchange", t.logger.LogExchange(req.Context(), ex))
+		}
+		if err := resp.Write(client.Writer); err != nil {
+			return err
+		}
+		return client.Flush()
+	}
+
+	req.Body = countBody(req, state)
+	req.Body = t.scanned(t.samples.wrap(cfg, hashBody(cfg, req, state), "up", state.id), req.Header, "request", state)
+	var resp *http.Response
+	var name string
+	if class == "" {
+		resp, name = t.rules.Load().fake(req, state.id)
+	}
+	if class == "" && resp == nil && remote != nil {
+		class = t.egress.check(cfg, connect.URL.Host, true)
+	}
+	switch {
+	case class != "":
+		io.Copy(io.Discard, req.Body)
+		state.exchange.ErrorResponse = class
+		resp = cfg.errorResponse(class, req, state.id)
+	case resp != nil:
+		// The body is read for the next request to follow it.
+		io.Copy(io.Discard, req.Body)
+		state.tags = append(state.tags, "fake:"+name)
+	case remote == nil:
+		io.Copy(io.Discard, req.Body)
+		state.exchange.ErrorResponse = "sandbox"
+		resp = cfg.errorResponse("sandbox", req, state.id)
+	default:
+		sent := time.Now()
+		err = req.Write(remote)
+		if err == nil {
+			err = remote.Flush()
+		}
+		if err == nil {
+			resp, err = http.ReadResponse(remote.Reader, req)
+		}
+		state.exchange.Upstream = time.Since(sent)
+		if err != nil {
+			return failed(err)
+		}
+	}
+	state.exchange.Responded = time.Now()
+	if t.tarpit.apply(req.Context(), cfg, clientIP(req.RemoteAddr), state.tags, requestConn(req, tunnel), state.id) {
+		state.tags = append(state.tags, "tarpitted")
+	}
+	resp.Body = t.scanned(t.samples.wrap(cfg, resp.Body, "down", state.id), resp.Header, "response", state)
+	state.issued = t.honey.inject(cfg, t.rules.Load(), resp, clientIP(req.RemoteAddr), state.id)
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: func(n int64) {
+		if ex := state.finish(resp, n, nil); ex != nil {
+			logFailed(log, "exchange", t.logger.LogExchange(req.Context(), ex))
+		}
+	}}
+	defer resp.Body.Close()
+	if err := resp.Write(client.Writer); err != nil {
+		return err
+	}
+	return client.Flush()
+}
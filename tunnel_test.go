@@ -0,0 +1,327 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:40000", "192.0.2.1"},
+		{"[::1]:40000", "::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[2001:DB8:0:0::1]:443", "2001:db8::1"},
+		{"[fe80::1%eth0]:40000", "fe80::1"},
+		// Dual-stack listeners see IPv4 clients as mapped addresses.
+		{"[::ffff:192.0.2.1]:40000", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"@", "@"},
+	}
+	for _, tt := range tests {
+		if got := clientIP(tt.remoteAddr); got != tt.want {
+			t.Errorf("clientIP(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+// listenIPv6 listens on the IPv6 loopback address, skipping the test when the
+// environment has no IPv6.
+func listenIPv6(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	return ln
+}
+
+func TestIPv6ListenerAndUpstream(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	upstream.Listener.Close()
+	upstream.Listener = listenIPv6(t)
+	upstream.Start()
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+
+	path := filepath.Join(t.TempDir(), "log.db")
+	config, err := NewConfigStore("stuffpot", []string{"-db", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := listenIPv6(t)
+	go s.Serve(ln)
+
+	// A plain request to an IPv6 literal URL.
+	proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String()}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + target + "/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("plain request: got %v %q, want 200 hello", resp.Status, body)
+	}
+	client.CloseIdleConnections()
+
+	// A CONNECT to a bracketed IPv6 literal, relayed.
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %v: got %v", target, resp.Status)
+	}
+	fmt.Fprintf(conn, "GET /tunneled HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", target)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	conn.Close()
+	if string(body) != "hello" {
+		t.Errorf("tunneled request: got %q, want hello", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var ip, host, u string
+	if err := db.QueryRow("select from_ip, host, url from requests").Scan(&ip, &host, &u); err != nil {
+		t.Fatal(err)
+	}
+	if ip != "::1" || host != target || !strings.HasSuffix(u, target+"/plain") {
+		t.Errorf("the request was stored from %q to %q %q, want from ::1 to %v", ip, host, u, target)
+	}
+	if err := db.QueryRow("select from_ip, host from connects").Scan(&ip, &host); err != nil {
+		t.Fatal(err)
+	}
+	if ip != "::1" || host != target {
+		t.Errorf("the CONNECT was stored from %q to %q, want from ::1 to %v", ip, host, target)
+	}
+	if err := db.QueryRow("select ip from client_stats").Scan(&ip); err != nil || ip != "::1" {
+		t.Errorf("client stats: got %q, %v, want ::1", ip, err)
+	}
+}
+
+func TestDialErrorMapping(t *testing.T) {
+	tests := []struct {
+		err       error
+		errorType string
+		response  string
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}, "timeout", "upstream"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}},
+			"refused", "upstream"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "x.invalid"}}, "dns",
+			"upstream"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: context.Canceled}, "canceled", "upstream"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errEgressDenied}, "other", "blocked"},
+		{errInternalAddr, "other", "upstream"},
+	}
+	for _, tt := range tests {
+		if got := errorType(tt.err); got != tt.errorType {
+			t.Errorf("errorType(%v) = %q, want %q", tt.err, got, tt.errorType)
+		}
+		if got := dialFailure(tt.err); got != tt.response {
+			t.Errorf("dialFailure(%v) = %q, want %q", tt.err, got, tt.response)
+		}
+	}
+}
+
+// nonRoutable is an address whose dials go unanswered, for them to time out.
+const nonRoutable = "10.255.255.1:81"
+
+func TestDialToANonRoutableAddressTimesOut(t *testing.T) {
+	// Some sandboxes answer for any address.
+	if conn, err := net.DialTimeout("tcp", nonRoutable, 200*time.Millisecond); errorType(err) != "timeout" {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Skipf("%v doesn't time out here: %v", nonRoutable, err)
+	}
+	db := &recordingLogger{}
+	s, client := startServer(t, testConfig(t, "-dial-timeout", "300ms"), db)
+
+	start := time.Now()
+	_, err := s.dial("tcp", nonRoutable)
+	if elapsed := time.Since(start); errorType(err) != "timeout" || elapsed > 3*time.Second {
+		t.Errorf("dial: got %v after %v, want a timeout after 300ms", err, elapsed)
+	}
+
+	resp, err := client.Get("http://" + nonRoutable + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want the upstream error response", resp.StatusCode)
+	}
+	client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+	logged := db.logged()
+	if len(logged) != 1 {
+		t.Fatalf("got %d exchanges, want 1", len(logged))
+	}
+	if ex := logged[0]; ex.ErrorResponse != "upstream" || errorType(ex.Err) != "timeout" {
+		t.Errorf("got the %q error response for %v, want upstream for a timeout", ex.ErrorResponse, ex.Err)
+	}
+}
+
+func TestShutdownCancelsAPendingDial(t *testing.T) {
+	if conn, err := net.DialTimeout("tcp", nonRoutable, 200*time.Millisecond); errorType(err) != "timeout" {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Skipf("%v doesn't time out here: %v", nonRoutable, err)
+	}
+	db := &recordingLogger{}
+	s, client := startServer(t, testConfig(t, "-dial-timeout", "1m"), db)
+
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := s.dial("tcp", nonRoutable)
+		dialed <- err
+	}()
+	requested := make(chan *http.Response, 1)
+	go func() {
+		resp, err := client.Get("http://" + nonRoutable + "/")
+		if err != nil {
+			t.Error(err)
+		} else {
+			resp.Body.Close()
+		}
+		requested <- resp
+	}()
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err := <-dialed:
+		t.Fatalf("the dial returned before the shutdown: %v", err)
+	default:
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Shutdown took %v, with a dial timeout of a minute", elapsed)
+	}
+	select {
+	case err := <-dialed:
+		if !errors.Is(err, context.Canceled) || errorType(err) != "canceled" {
+			t.Errorf("dial: got %v, want it canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the dial is still pending after the shutdown")
+	}
+	if resp := <-requested; resp != nil && resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want the upstream error response", resp.StatusCode)
+	}
+	logged := db.logged()
+	if len(logged) != 1 {
+		t.Fatalf("got %d exchanges, want 1", len(logged))
+	}
+	if ex := logged[0]; ex.ErrorResponse != "upstream" || errorType(ex.Err) != "canceled" {
+		t.Errorf("got the %q error response for %v, want upstream for a canceled dial", ex.ErrorResponse, ex.Err)
+	}
+}
+
+// echoServer starts a TCP server sending back what it reads, and returns its
+// address.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTunnelClosedRightBeforeShutdownIsLogged(t *testing.T) {
+	config := testConfig(t)
+	s, client := startServer(t, config, nil)
+	target := echoServer(t)
+	conn, br, _ := openTunnel(t, client, target)
+	io.WriteString(conn, "ping")
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(br, echoed); err != nil || string(echoed) != "ping" {
+		t.Fatalf("the tunnel echoed %q, %v", echoed, err)
+	}
+	conn.Close()
+
+	// Shutdown waits for the tunnel to be logged, not only for its client
+	// connection to be closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var host string
+	if err := db.QueryRow("select host from connects").Scan(&host); err != nil || host != target {
+		t.Errorf("got the connect to %q, %v, want the tunnel to %v", host, err, target)
+	}
+}
@@ -0,0 +1,194 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// upstreamPorts are the ports of the proxy URLs without one.
+var upstreamPorts = map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}
+
+// parseUpstream parses the URL of an upstream proxy, nil for direct.
+func parseUpstream(s string) (*url.URL, error) {
+	if s == "" || s == "direct" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	port, ok := upstreamPorts[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown scheme in %q, not http, https or socks5", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %q", u.Redacted())
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// compileUpstream validates the upstream rules of the config, and appends one
+// for the default proxy.
+func (c *Config) compileUpstream() error {
+	var errs []error
+	c.upstreamRules = nil
+	for i, r := range c.Upstream.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("upstream.rules: rule %v: %v", r.Name, fmt.Sprintf(format, args...)))
+		}
+		if r.Proxy == "" {
+			fail("no proxy, which is direct to connect to the remotes")
+		}
+		var err error
+		if r.proxy, err = parseUpstream(r.Proxy); err != nil {
+			fail("%v", err)
+		}
+		if r.ports, err = portSet(r.Ports); err != nil {
+			fail("%v", err)
+		}
+		if r.hosts, err = compilePatterns(r.Hosts); err != nil {
+			fail("%v", err)
+		}
+		for _, d := range r.Domains {
+			if name := strings.TrimPrefix(d, "*."); name == "" || strings.ContainsAny(name, "*:/") {
+				fail("invalid domain %q", d)
+			}
+		}
+		c.upstreamRules = append(c.upstreamRules, &r)
+	}
+	u, err := parseUpstream(c.Upstream.Proxy)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("upstream.proxy: %v", err))
+	}
+	c.upstreamRules = append(c.upstreamRules, &UpstreamRule{Name: "default", proxy: u})
+	return errors.Join(errs...)
+}
+
+// upstreamProxy returns the proxy to connect to addr, a host:port, through,
+// or nil to connect directly.
+func (c *Config) upstreamProxy(addr string) *url.URL {
+	for _, r := range c.upstreamRules {
+		if len(r.ports) > 0 && !r.ports[hostPort(addr)] {
+			continue
+		}
+		if len(r.hosts)+len(r.Domains) > 0 && !matchAny(r.hosts, addr) && !matchDomain(r.Domains, addr) {
+			continue
+		}
+		return r.proxy
+	}
+	return nil
+}
+
+// familyDialer dials with dialFamily, for the SOCKS5 client.
+type familyDialer struct {
+	cfg *Config
+}
+
+func (d familyDialer) Dial(network, addr string) (net.Conn, error) {
+	return dialFamily(context.Background(), d.cfg, network, addr, nil)
+}
+
+func (d familyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialFamily(ctx, d.cfg, network, addr, nil)
+}
+
+// dialUpstream connects to addr through the proxy u. The handshake with the
+// proxy is given the dial timeout too, and given up on once ctx is done.
+func dialUpstream(ctx context.Context, cfg *Config, u *url.URL, network, addr string) (net.Conn, error) {
+	if strings.HasPrefix(u.Scheme, "socks5") {
+		var auth *proxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, familyDialer{cfg})
+		if err != nil {
+			return nil, err
+		}
+		if t := cfg.Limits.DialTimeout; t > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, t)
+			defer cancel()
+		}
+		conn, err := d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy %v: %w", u.Host, err)
+		}
+		return conn, nil
+	}
+
+	raw, err := dialFamily(ctx, cfg, "tcp", u.Host, nil)
+	if err != nil {
+		return nil, fmt.Errorf("upstream proxy %v: %w", u.Host, err)
+	}
+	if t := cfg.Limits.DialTimeout; t > 0 {
+		raw.SetDeadline(time.Now().Add(t))
+	}
+	stop := context.AfterFunc(ctx, func() { raw.SetDeadline(time.Unix(1, 0)) })
+	conn, err := connectThrough(raw, u, addr)
+	if !stop() {
+		if err == nil {
+			conn.Close()
+		}
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upstream proxy %v: %w", u.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connectThrough opens a tunnel to addr with a CONNECT to the HTTP proxy u
+// over conn, which is closed on failure.
+func connectThrough(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	if u.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req += "Proxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)) + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %v: %v", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,202 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRules(t *testing.T) {
+	path := writeConfig(t, `upstream:
+  proxy: http://u:p@192.0.2.1
+  rules:
+    - name: internal
+      domains: ["*.corp.example"]
+      proxy: direct
+    - name: ssh
+      ports: [22]
+      proxy: socks5://192.0.2.2
+    - name: tls
+      hosts: ['^secure\.']
+      proxy: https://192.0.2.3:8443
+`)
+	cfg := testConfig(t, "-config", path).Load()
+	for addr, want := range map[string]string{
+		"a.corp.example:443": "",
+		"a.corp.example:22":  "",
+		"shop.example:22":    "socks5://192.0.2.2:1080",
+		"secure.example:443": "https://192.0.2.3:8443",
+		"shop.example:443":   "http://u:p@192.0.2.1:80",
+	} {
+		got := ""
+		if u := cfg.upstreamProxy(addr); u != nil {
+			got = u.String()
+		}
+		if got != want {
+			t.Errorf("%v: got the proxy %q, want %q", addr, got, want)
+		}
+	}
+
+	path = writeConfig(t, `upstream:
+  proxy: ftp://192.0.2.1
+  rules:
+    - name: a
+      ports: [22]
+    - name: b
+      proxy: socks5://
+    - name: c
+      domains: ["*"]
+      proxy: direct
+`)
+	_, err := NewConfigStore("stuffpot", []string{"-config", path})
+	for _, want := range []string{`upstream.proxy: unknown scheme in "ftp://192.0.2.1"`, "rule a: no proxy",
+		`rule b: no host in "socks5:"`, `rule c: invalid domain "*"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got %v, want %q", err, want)
+		}
+	}
+}
+
+// connectProxy starts an HTTP proxy answering CONNECTs with status, relaying
+// the tunnels it accepts, and returns its address and the CONNECTs it got.
+func connectProxy(t *testing.T, status int) (string, <-chan *http.Request) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	connects := make(chan *http.Request, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				connects <- req
+				if status != http.StatusOK {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				remote, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer remote.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(remote, conn)
+				io.Copy(conn, remote)
+			}()
+		}
+	}()
+	return ln.Addr().String(), connects
+}
+
+func TestRequestsAreForwardedThroughTheUpstreamProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "http://")
+
+	proxyAddr, connects := connectProxy(t, http.StatusOK)
+	_, client := startServer(t, testConfig(t, "-upstream-proxy", "http://alice:secret@"+proxyAddr), nil)
+	resp, err := client.Get(upstream.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("got %v %q through the upstream proxy", resp.Status, body)
+	}
+	select {
+	case req := <-connects:
+		if req.Method != http.MethodConnect || req.Host != target ||
+			req.Header.Get("Proxy-Authorization") != "Basic YWxpY2U6c2VjcmV0" {
+			t.Errorf("the upstream proxy got %v %v with headers %v", req.Method, req.Host, req.Header)
+		}
+	default:
+		t.Error("the request didn't go through the upstream proxy")
+	}
+
+	// An upstream proxy refusing the CONNECT fails the request.
+	proxyAddr, _ = connectProxy(t, http.StatusProxyAuthRequired)
+	rec := &recordingLogger{}
+	s, client := startServer(t, testConfig(t, "-upstream-proxy", "http://"+proxyAddr), rec)
+	resp, err = client.Get(upstream.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+	logged := rec.logged()
+	if resp.StatusCode != http.StatusBadGateway || len(logged) != 1 || logged[0].Err == nil ||
+		!strings.Contains(logged[0].Err.Error(), "upstream proxy "+proxyAddr) ||
+		!strings.Contains(logged[0].Err.Error(), "407") {
+		t.Errorf("got %v and the exchanges %v, want the refusal of the upstream proxy", resp.Status, logged)
+	}
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	n atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.n.Add(1)
+	}
+	return conn, err
+}
+
+func TestTunnelsAreForwardedThroughASocksProxy(t *testing.T) {
+	// Another honeypot's SOCKS5 listener serves as the upstream proxy.
+	socks, err := NewServer(testConfig(t, "-proxy-auth", "-proxy-auth-users", "alice:secret"), &recordingLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &countingListener{Listener: ln}
+	go socks.ServeSocks(counted)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		socks.Shutdown(ctx)
+	})
+
+	_, client := startServer(t, testConfig(t, "-upstream-proxy", "socks5://alice:secret@"+ln.Addr().String()), nil)
+	conn, br, resp := openTunnel(t, client, echoServer(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("the CONNECT got %v", resp.Status)
+	}
+	io.WriteString(conn, "ping")
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(br, echoed); err != nil || string(echoed) != "ping" {
+		t.Fatalf("the tunnel echoed %q, %v", echoed, err)
+	}
+	if n := counted.n.Load(); n != 1 {
+		t.Errorf("the SOCKS5 proxy got %d connections, want the tunnel's", n)
+	}
+}
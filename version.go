@@ -0,0 +1,59 @@
+package stuffpot
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with:
+//
+//	pkg=github.com/securized/stuffpot
+//	go build -ldflags "-X $pkg.version=1.2.0 -X $pkg.commit=$(git rev-parse HEAD) -X $pkg.buildDate=$(date -u +%FT%TZ)" ./cmd/stuffpot
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// getBuildInfo falls back to the VCS stamp of the go command when the build
+// didn't set commit and buildDate.
+func getBuildInfo() buildInfo {
+	info := buildInfo{version, commit, buildDate, runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// String identifies the binary in one line, as recorded in the database.
+func (info buildInfo) String() string {
+	return fmt.Sprintf("%v (%v)", info.Version, info.Commit)
+}
+
+// PrintVersion writes the version information printed by -version.
+func PrintVersion(w io.Writer) {
+	info := getBuildInfo()
+	fmt.Fprintf(w, "stuffpot %v\ncommit: %v\nbuilt: %v\ngo: %v\n", info.Version, info.Commit, info.BuildDate, info.GoVersion)
+}
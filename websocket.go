@@ -0,0 +1,276 @@
+package stuffpot
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketMessage is a message of a WebSocket, or one of its control frames.
+type websocketMessage struct {
+	RequestID string
+	ClientIP  string
+	// Direction is up from the client, down from the remote.
+	Direction string
+	Opcode    int
+	// Compressed is set on the messages of permessage-deflate, whose payload
+	// is stored deflated.
+	Compressed bool
+	Size       int64
+	// Payload is the start of the unmasked payload, Truncated set when
+	// it isn't all of it, including when the WebSocket closed mid-message.
+	Payload   []byte
+	Truncated bool
+	At        time.Time
+}
+
+// isWebsocket tells whether h are the headers of a WebSocket handshake.
+func isWebsocket(h http.Header) bool {
+	return headerHas(h, "Connection", "upgrade") && headerHas(h, "Upgrade", "websocket")
+}
+
+// headerHas tells whether the comma-separated values of the header name of h
+// include value, in any case.
+func headerHas(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketFrames parses the frames of one direction of a WebSocket, emitting
+// each message once its last frame is read. Control frames, which may come
+// between the frames of a message, are emitted on their own.
+type websocketFrames struct {
+	direction string
+	limit     int
+	emit      func(*websocketMessage)
+
+	mu   sync.Mutex
+	head []byte
+	// frame is the message the payload being read belongs to, nil while
+	// reading a frame header, and data the message of the data frames.
+	frame     *websocketMessage
+	data      *websocketMessage
+	fin       bool
+	remaining uint64
+	mask      []byte
+	pos       int
+}
+
+// frameHeaderLen returns the length of the frame header h starts with, or
+// that of what's needed to know it.
+func frameHeaderLen(h []byte) int {
+	if len(h) < 2 {
+		return 2
+	}
+	n := 2
+	switch h[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if h[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+func (f *websocketFrames) feed(p []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(p) > 0 {
+		if f.frame == nil {
+			n := min(frameHeaderLen(f.head)-len(f.head), len(p))
+			f.head, p = append(f.head, p[:n]...), p[n:]
+			if len(f.head) >= 2 && len(f.head) == frameHeaderLen(f.head) {
+				f.start()
+			}
+			continue
+		}
+		n := int(min(uint64(len(p)), f.remaining))
+		f.payload(p[:n])
+		p = p[n:]
+		if f.remaining -= uint64(n); f.remaining == 0 {
+			f.end()
+		}
+	}
+}
+
+// start begins the frame whose header was read.
+func (f *websocketFrames) start() {
+	h := f.head
+	f.fin = h[0]&0x80 != 0
+	opcode := int(h[0] & 0x0f)
+	f.remaining = uint64(h[1] & 0x7f)
+	rest := h[2:]
+	switch f.remaining {
+	case 126:
+		f.remaining, rest = uint64(binary.BigEndian.Uint16(rest)), rest[2:]
+	case 127:
+		f.remaining, rest = binary.BigEndian.Uint64(rest), rest[8:]
+	}
+	f.mask = nil
+	if h[1]&0x80 != 0 {
+		f.mask = append([]byte(nil), rest[:4]...)
+	}
+	f.pos = 0
+	f.head = f.head[:0]
+
+	switch {
+	case opcode >= 8:
+		f.frame = &websocketMessage{Direction: f.direction, Opcode: opcode}
+	case opcode == 0 && f.data != nil:
+		f.frame = f.data
+	default:
+		f.data = &websocketMessage{Direction: f.direction, Opcode: opcode, Compressed: h[0]&0x40 != 0}
+		f.frame = f.data
+	}
+	if f.remaining == 0 {
+		f.end()
+	}
+}
+
+func (f *websocketFrames) payload(b []byte) {
+	m := f.frame
+	m.Size += int64(len(b))
+	keep := min(len(b), max(0, f.limit-len(m.Payload)))
+	if keep < len(b) {
+		m.Truncated = true
+	}
+	for i, c := range b[:keep] {
+		if f.mask != nil {
+			c ^= f.mask[(f.pos+i)%4]
+		}
+		m.Payload = append(m.Payload, c)
+	}
+	f.pos += len(b)
+}
+
+// end completes the frame whose payload was read.
+func (f *websocketFrames) end() {
+	m := f.frame
+	f.frame = nil
+	if m != f.data {
+		m.At = time.Now()
+		f.emit(m)
+	} else if f.fin {
+		f.data = nil
+		m.At = time.Now()
+		f.emit(m)
+	}
+}
+
+// flush emits the message the WebSocket closed in the middle of, if any.
+func (f *websocketFrames) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := f.data
+	if f.frame != nil && f.frame != f.data {
+		m = f.frame
+	}
+	if m != nil {
+		m.Truncated, m.At = true, time.Now()
+		f.emit(m)
+	}
+	f.frame, f.data = nil, nil
+}
+
+// websocketConn is the body of the 101 response of a WebSocket, which goproxy
+// relays it over, parsing its frames both ways. goproxy closes neither it nor
+// the client connection once either end is done, so it closes itself and
+// client, when known, as soon as reading or writing fails.
+type websocketConn struct {
+	io.ReadWriteCloser
+	up, down *websocketFrames
+	client   *clientConn
+	once     sync.Once
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.down.feed(p[:n])
+	if err != nil {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.up.feed(p[:n])
+	if err != nil {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *websocketConn) Close() error {
+	c.once.Do(func() {
+		c.up.flush()
+		c.down.flush()
+		if c.client != nil {
+			c.client.Close()
+		}
+	})
+	return c.ReadWriteCloser.Close()
+}
+
+// websocket returns the body relaying the WebSocket of the request id over
+// rwc, which logs its messages and closes client once done.
+func (s *Server) websocket(cfg *Config, rwc io.ReadWriteCloser, client *clientConn, requestID,
+	clientIP string) io.ReadWriteCloser {
+	log := slog.With("component", "websocket", "request_id", requestID)
+	db, ok := s.db.(interface {
+		logWebsocketMessage(m *websocketMessage) error
+	})
+	emit := func(m *websocketMessage) {
+		websocketMessages.Add(1)
+		if !ok {
+			return
+		}
+		m.RequestID, m.ClientIP = requestID, clientIP
+		err := s.logger.enqueue(context.Background(), "websocket message", requestID, func(context.Context) error {
+			return db.logWebsocketMessage(m)
+		}, nil)
+		logFailed(log, "websocket message", err)
+	}
+	limit := int(cfg.Limits.WebsocketCapture)
+	if !cfg.Limits.CaptureBodies {
+		limit = 0
+	}
+	return &websocketConn{
+		ReadWriteCloser: rwc,
+		client:          client,
+		up:              &websocketFrames{direction: "up", limit: limit, emit: emit},
+		down:            &websocketFrames{direction: "down", limit: limit, emit: emit},
+	}
+}
+
+// logWebsocketMessage records a message of a WebSocket.
+func (logger *HttpLogger) logWebsocketMessage(m *websocketMessage) error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	res, err := logger.db.Exec(`insert into websocket_messages (request_id, from_ip, direction, opcode, compressed,
+        size, payload, truncated, created_at) values (?,?,?,?,?,?,?,?,?)`,
+		m.RequestID, m.ClientIP, m.Direction, m.Opcode, m.Compressed, m.Size, m.Payload, m.Truncated,
+		m.At.UTC().Format(time.DateTime))
+	if err != nil || logger.maxRecords <= 0 {
+		return err
+	}
+	last, err := res.LastInsertId()
+	if err == nil && last > logger.maxRecords {
+		_, err = logger.db.Exec("delete from websocket_messages where id <= ?", last-logger.maxRecords)
+	}
+	return err
+}
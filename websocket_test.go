@@ -0,0 +1,152 @@
+package stuffpot
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsFrame returns a WebSocket frame, masked with mask unless nil.
+func wsFrame(fin bool, rsv1 bool, opcode byte, payload []byte, mask []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	frame := []byte{b0}
+	var b1 byte
+	if mask != nil {
+		b1 = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, b1|byte(n))
+	case n < 1<<16:
+		frame = append(frame, b1|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, b1|127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		if mask != nil {
+			c ^= mask[i%4]
+		}
+		frame = append(frame, c)
+	}
+	return frame
+}
+
+func TestWebsocketFrames(t *testing.T) {
+	var got []websocketMessage
+	f := &websocketFrames{direction: "up", limit: 8, emit: func(m *websocketMessage) {
+		got = append(got, *m)
+	}}
+	mask := []byte{1, 2, 3, 4}
+	var stream []byte
+	// A text message in two frames, with a ping between them.
+	stream = append(stream, wsFrame(false, false, 1, []byte("hello "), mask)...)
+	stream = append(stream, wsFrame(true, false, 9, []byte("p"), mask)...)
+	stream = append(stream, wsFrame(true, false, 0, []byte("world"), mask)...)
+	// A compressed binary message with a 16-bit length.
+	stream = append(stream, wsFrame(true, true, 2, []byte(strings.Repeat("x", 300)), mask)...)
+	// An empty close frame, then a message cut short.
+	stream = append(stream, wsFrame(true, false, 8, nil, mask)...)
+	stream = append(stream, wsFrame(true, false, 1, []byte("cut"), mask)[:8]...)
+	// The frames are fed in chunks splitting their headers and payloads.
+	for len(stream) > 0 {
+		n := min(len(stream), 3)
+		f.feed(stream[:n])
+		stream = stream[n:]
+	}
+	f.flush()
+
+	want := []websocketMessage{
+		{Direction: "up", Opcode: 9, Size: 1, Payload: []byte("p")},
+		{Direction: "up", Opcode: 1, Size: 11, Payload: []byte("hello wo"), Truncated: true},
+		{Direction: "up", Opcode: 2, Compressed: true, Size: 300, Payload: []byte("xxxxxxxx"), Truncated: true},
+		{Direction: "up", Opcode: 8},
+		{Direction: "up", Opcode: 1, Size: 2, Payload: []byte("cu"), Truncated: true},
+	}
+	for i := range got {
+		got[i].At = time.Time{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got the messages\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestWebsocketMessagesAreLogged(t *testing.T) {
+	// The remote accepts the WebSocket, greets the client and waits for its
+	// message before closing in the middle of another.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n")
+		conn.Write(wsFrame(true, false, 1, []byte("welcome"), nil))
+		brw.Reader.ReadByte()
+		conn.Write(wsFrame(true, false, 1, []byte("bye"), nil)[:4])
+	}))
+	defer upstream.Close()
+
+	config := testConfig(t, "-websocket-capture", "4")
+	s, client := startServer(t, config, nil)
+	proxyURL, _ := client.Transport.(*http.Transport).Proxy(nil)
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "GET %v/chat HTTP/1.1\r\nHost: %v\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", upstream.URL,
+		upstream.Listener.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %v, %v, want the WebSocket accepted", resp, err)
+	}
+	greeting := make([]byte, 9)
+	if _, err := io.ReadFull(br, greeting); err != nil || string(greeting[2:]) != "welcome" {
+		t.Fatalf("got %q, %v, want the greeting of the remote", greeting, err)
+	}
+	conn.Write(wsFrame(true, false, 1, []byte("hi there"), []byte{9, 8, 7, 6}))
+	// The proxy closes the client connection once the remote is done.
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		t.Errorf("got %v, want the connection closed by the proxy", err)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", config.Load().Storage.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := [][]string{{"down", "1", "0", "7", "welc", "1"}, {"down", "1", "0", "2", "by", "1"},
+		{"up", "1", "0", "8", "hi t", "1"}}
+	got := queryRows(t, db, `select m.direction, m.opcode, m.compressed, m.size, cast(m.payload as text),
+      m.truncated from websocket_messages m join requests r using (request_id) where r.url like '%/chat'
+      order by m.direction, m.id`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got the messages %v, want %v", got, want)
+	}
+}